@@ -0,0 +1,197 @@
+package oauthproxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/OpusCapita/oauth2_proxy/logger"
+	sessionsapi "github.com/OpusCapita/oauth2_proxy/pkg/apis/sessions"
+)
+
+// weekdays maps the day names of access hours to time.Weekday
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// accessHours limits access by the users a rule lets through, i.e. all
+// users when the rule lists none, to requests matching the rule made during
+// a weekly time window. The path defaults to every path.
+type accessHours struct {
+	authzRule `yaml:",inline"`
+	Days      []string `yaml:"days"`
+	From      string   `yaml:"from"`
+	To        string   `yaml:"to"`
+	Timezone  string   `yaml:"timezone"`
+
+	days     [7]bool
+	from, to int
+	location *time.Location
+}
+
+// parseClock parses a HH:MM time of day into minutes since midnight
+func parseClock(s string) (int, error) {
+	var h, m int
+	if _, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || len(s) != 5 || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("invalid time %q, must be HH:MM", s)
+	}
+	return h*60 + m, nil
+}
+
+// compile checks and parses the access hours
+func (h *accessHours) compile() error {
+	var err error
+	if h.Path == "" {
+		h.Path = "/**"
+	}
+	if !strings.HasPrefix(h.Path, "/") {
+		return fmt.Errorf("path must start with /")
+	}
+	if h.pattern, err = globToRegexp(h.Path); err != nil {
+		return err
+	}
+	if h.Condition != "" {
+		return fmt.Errorf("conditions are only supported in rules and hosts")
+	}
+
+	if len(h.Days) == 0 {
+		h.days = [7]bool{true, true, true, true, true, true, true}
+	}
+	for _, d := range h.Days {
+		r := strings.SplitN(strings.ToLower(d), "-", 2)
+		first, ok := weekdays[r[0]]
+		last := first
+		if ok && len(r) == 2 {
+			last, ok = weekdays[r[1]]
+		}
+		if !ok {
+			return fmt.Errorf("invalid day %q, must be mon, tue, ... or a range such as mon-fri", d)
+		}
+		for day := first; ; day = (day + 1) % 7 {
+			h.days[day] = true
+			if day == last {
+				break
+			}
+		}
+	}
+
+	h.from, h.to = 0, 24*60
+	if h.From != "" {
+		if h.from, err = parseClock(h.From); err != nil {
+			return err
+		}
+	}
+	if h.To != "" {
+		if h.to, err = parseClock(h.To); err != nil {
+			return err
+		}
+	}
+
+	h.location = time.Local
+	if h.Timezone != "" {
+		if h.location, err = time.LoadLocation(h.Timezone); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// contains returns whether t falls into the time window. A window ending
+// before it starts, such as 22:00 to 06:00, spans midnight, and its days are
+// those it starts on.
+func (h *accessHours) contains(t time.Time) bool {
+	t = t.In(h.location)
+	minute := t.Hour()*60 + t.Minute()
+	switch {
+	case h.from < h.to:
+		return h.days[t.Weekday()] && minute >= h.from && minute < h.to
+	case h.from > h.to:
+		if minute >= h.from {
+			return h.days[t.Weekday()]
+		}
+		return minute < h.to && h.days[(t.Weekday()+6)%7]
+	}
+	return h.days[t.Weekday()]
+}
+
+// String describes the time window to users
+func (h *accessHours) String() string {
+	days := "daily"
+	if len(h.Days) > 0 {
+		days = strings.Join(h.Days, ", ")
+	}
+	from, to := h.From, h.To
+	if from == "" {
+		from = "00:00"
+	}
+	if to == "" {
+		to = "24:00"
+	}
+	return fmt.Sprintf("%s %s-%s (%s)", days, from, to, h.location)
+}
+
+// OutsideAccessHours returns the access hours applying to the request and
+// user which t falls outside of, or nil if there are none. Dry run access
+// hours are skipped.
+func (pol *authzPolicy) OutsideAccessHours(method, path string, s *sessionsapi.SessionState, t time.Time) *accessHours {
+	return pol.outsideAccessHours(method, path, s, t, false)
+}
+
+// outsideAccessHours returns the access hours, either the dry run ones or
+// the others, applying to the request and user which t falls outside of
+func (pol *authzPolicy) outsideAccessHours(method, path string, s *sessionsapi.SessionState, t time.Time, dryRun bool) *accessHours {
+	for _, h := range pol.AccessHours {
+		if h.DryRun == dryRun && h.matches(method, path) && h.allows(s) && !h.contains(t) {
+			return h
+		}
+	}
+	return nil
+}
+
+// outsideAccessHours returns the access hours of the authorization policies
+// the request is made outside of, logging the denial. In dry run mode, and
+// for dry run access hours, the denial is only logged.
+func (p *OAuthProxy) outsideAccessHours(req *http.Request, method, path string, s *sessionsapi.SessionState) *accessHours {
+	now := time.Now()
+	for _, pol := range p.policies() {
+		if h := pol.OutsideAccessHours(method, path, s, now); h != nil {
+			if !p.authzDryRun {
+				logger.PrintAuthf(s.Email, req, logger.AuthFailure, "Permission denied for %s %s outside of access hours %s", method, path, h)
+				p.auditDenied(req, s, fmt.Sprintf("outside of access hours %s", h))
+				return h
+			}
+			logger.PrintAuthf(s.Email, req, logger.AuthDryRun, "Dry run: permission would be denied for %s %s outside of access hours %s", method, path, h)
+			p.metrics.dryRunDenial("access_hours")
+		}
+		if pol.dryRun {
+			if h := pol.outsideAccessHours(method, path, s, now, true); h != nil {
+				logger.PrintAuthf(s.Email, req, logger.AuthDryRun, "Dry run: permission would be denied for %s %s outside of access hours %s", method, path, h)
+				p.metrics.dryRunDenial("access_hours")
+			}
+		}
+	}
+	return nil
+}
+
+// OutsideAccessHoursPage tells the user when they may access the page
+func (p *OAuthProxy) OutsideAccessHoursPage(rw http.ResponseWriter, h *accessHours) {
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusForbidden)
+	t := struct {
+		Title       string
+		Hours       string
+		ProxyPrefix string
+	}{
+		Title:       "Outside of Access Hours",
+		Hours:       h.String(),
+		ProxyPrefix: p.ProxyPrefix,
+	}
+	p.templates.ExecuteTemplate(rw, "access_hours.html", t)
+}
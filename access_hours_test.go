@@ -0,0 +1,100 @@
+package oauthproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	sessionsapi "github.com/OpusCapita/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccessHoursContains(t *testing.T) {
+	// 2020-03-02 is a Monday
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2020, 3, day, hour, min, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		hours    accessHours
+		at       time.Time
+		contains bool
+	}{
+		{accessHours{Days: []string{"mon-fri"}, From: "09:00", To: "17:00"}, at(2, 9, 0), true},
+		{accessHours{Days: []string{"mon-fri"}, From: "09:00", To: "17:00"}, at(2, 17, 0), false},
+		{accessHours{Days: []string{"mon-fri"}, From: "09:00", To: "17:00"}, at(7, 12, 0), false},
+		{accessHours{Days: []string{"sat", "sun"}}, at(7, 23, 59), true},
+		{accessHours{Days: []string{"fri-mon"}}, at(3, 12, 0), false},
+		{accessHours{Days: []string{"fri-mon"}}, at(8, 12, 0), true},
+		{accessHours{Days: []string{"mon"}, From: "22:00", To: "06:00"}, at(2, 23, 0), true},
+		{accessHours{Days: []string{"mon"}, From: "22:00", To: "06:00"}, at(3, 5, 0), true},
+		{accessHours{Days: []string{"mon"}, From: "22:00", To: "06:00"}, at(2, 5, 0), false},
+		{accessHours{From: "09:00", To: "17:00", Timezone: "America/New_York"}, at(2, 15, 0), true},
+		{accessHours{From: "09:00", To: "17:00", Timezone: "America/New_York"}, at(2, 23, 0), false},
+	}
+	for _, tc := range tests {
+		h := tc.hours
+		if h.Timezone == "" {
+			h.Timezone = "UTC"
+		}
+		assert.NoError(t, h.compile())
+		assert.Equal(t, tc.contains, h.contains(tc.at), "%v at %s", tc.hours, tc.at)
+	}
+
+	for _, h := range []accessHours{
+		{Days: []string{"monday"}},
+		{From: "9:00"},
+		{To: "24:01"},
+		{Timezone: "Nowhere/Special"},
+	} {
+		assert.Error(t, h.compile())
+	}
+}
+
+func TestAccessHoursPolicy(t *testing.T) {
+	path := writeAuthzPolicy(t, `access_hours:
+  - groups: [contractors]
+    days: [mon-fri]
+    from: "09:00"
+    to: "17:00"
+    timezone: UTC
+`)
+	defer os.Remove(path)
+	policy, err := loadAuthzPolicy(path)
+	assert.NoError(t, err)
+
+	saturday := time.Date(2020, 3, 7, 12, 0, 0, 0, time.UTC)
+	contractor := &sessionsapi.SessionState{Email: "joe@example.com", Groups: []string{"contractors"}}
+	employee := &sessionsapi.SessionState{Email: "jane@example.com", Groups: []string{"staff"}}
+	assert.NotNil(t, policy.OutsideAccessHours("GET", "/app", contractor, saturday))
+	assert.Nil(t, policy.OutsideAccessHours("GET", "/app", employee, saturday))
+	assert.Nil(t, policy.OutsideAccessHours("GET", "/app", contractor, saturday.Add(-24*time.Hour)))
+}
+
+func TestOutsideAccessHoursPage(t *testing.T) {
+	tomorrow := strings.ToLower(time.Now().UTC().Add(24 * time.Hour).Weekday().String()[:3])
+	path := writeAuthzPolicy(t, "access_hours:\n  - days: ["+tomorrow+"]\n    timezone: UTC\n")
+	defer os.Remove(path)
+
+	opts := NewOptions()
+	opts.CookieSecret = "foobar"
+	opts.DevFakeIdentity = "jane@example.com"
+	opts.AuthzPolicyFile = path
+	assert.NoError(t, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(email string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/app/", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	assert.Contains(t, rw.Body.String(), "Outside of Access Hours")
+	assert.Contains(t, rw.Body.String(), tomorrow+" 00:00-24:00 (UTC)")
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/oauth2/auth", nil)
+	req.Header.Set("X-Original-URI", "/app/")
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+}
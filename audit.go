@@ -0,0 +1,234 @@
+package oauthproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/OpusCapita/oauth2_proxy/logger"
+	sessionsapi "github.com/OpusCapita/oauth2_proxy/pkg/apis/sessions"
+)
+
+// Types of audit events
+const (
+	auditLoginSuccess   = "login_success"
+	auditLoginFailure   = "login_failure"
+	auditTokenRefresh   = "token_refresh"
+	auditLogout         = "logout"
+	auditAuthzDenied    = "authorization_denied"
+	auditSessionRevoked = "session_revoked"
+)
+
+const (
+	// auditQueueSize bounds the events waiting to be delivered to a
+	// webhook or Kafka, further events are dropped
+	auditQueueSize = 1024
+	// auditBatchSize is the most events delivered in one request
+	auditBatchSize = 100
+	// auditRetryInterval is how long to wait after a delivery failed
+	auditRetryInterval = 5 * time.Second
+)
+
+// auditEvent is a security relevant step in the life of a session
+type auditEvent struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Success  bool      `json:"success"`
+	User     string    `json:"user,omitempty"`
+	Email    string    `json:"email,omitempty"`
+	Provider string    `json:"provider,omitempty"`
+	Method   string    `json:"method,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+	Client   string    `json:"client"`
+	Host     string    `json:"host"`
+	Request  string    `json:"request"`
+}
+
+// auditLog writes audit events as JSON lines to a log destination and
+// delivers them to a webhook or a Kafka topic, separately from the access
+// logs. The methods of a nil auditLog do nothing.
+type auditLog struct {
+	writer   io.Writer
+	sinks    []*auditSink
+	provider string
+
+	mu sync.Mutex
+}
+
+// auditSink delivers audit events over HTTP in the background
+type auditSink struct {
+	name   string
+	url    string
+	kafka  bool
+	client *http.Client
+	retry  time.Duration
+	queue  chan auditEvent
+}
+
+// parseAuditLog sets up the audit log of the options, if it has a sink
+func parseAuditLog(o *Options, msgs []string) (*auditLog, []string) {
+	if o.AuditLogFilename == "" && o.AuditWebhookURL == "" && o.AuditKafkaRESTURL == "" {
+		return nil, msgs
+	}
+	a := &auditLog{provider: o.Provider}
+	if o.AuditLogFilename != "" {
+		w, err := logWriter(o, o.AuditLogFilename)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("invalid audit-log-filename: %s", err))
+		}
+		a.writer = w
+	}
+	for _, sink := range []*auditSink{
+		{name: "audit-webhook-url", url: o.AuditWebhookURL},
+		{name: "audit-kafka-rest-url", url: o.AuditKafkaRESTURL, kafka: true},
+	} {
+		if sink.url == "" {
+			continue
+		}
+		if u, err := url.Parse(sink.url); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			msgs = append(msgs, fmt.Sprintf("invalid %s %q: must be an http(s) URL", sink.name, sink.url))
+			continue
+		}
+		sink.client = &http.Client{Timeout: 10 * time.Second}
+		sink.retry = auditRetryInterval
+		sink.queue = make(chan auditEvent, auditQueueSize)
+		a.sinks = append(a.sinks, sink)
+	}
+	return a, msgs
+}
+
+// Record records an event of a request. The session may be nil.
+func (a *auditLog) Record(req *http.Request, s *sessionsapi.SessionState, event auditEvent) {
+	if a == nil {
+		return
+	}
+	event.Time = time.Now().UTC()
+	event.Provider = a.provider
+	event.Client = logger.GetClient(req)
+	event.Host = req.Host
+	event.Request = req.Method + " " + req.URL.RequestURI()
+	if s != nil {
+		if event.User == "" {
+			event.User = s.User
+		}
+		event.Email = s.Email
+	}
+
+	if a.writer != nil {
+		line, _ := json.Marshal(event)
+		a.mu.Lock()
+		a.writer.Write(append(line, '\n'))
+		a.mu.Unlock()
+	}
+	for _, sink := range a.sinks {
+		select {
+		case sink.queue <- event:
+		default:
+			logger.Printf("%s queue full: dropping %s audit event of %s", sink.name, event.Type, event.User)
+		}
+	}
+}
+
+// Run delivers the queued events to the webhook and Kafka until done is
+// closed
+func (a *auditLog) Run(done <-chan bool) {
+	if a == nil {
+		return
+	}
+	var wg sync.WaitGroup
+	for _, sink := range a.sinks {
+		wg.Add(1)
+		go func(sink *auditSink) {
+			defer wg.Done()
+			sink.run(done)
+		}(sink)
+	}
+	wg.Wait()
+}
+
+func (s *auditSink) run(done <-chan bool) {
+	for {
+		var batch []auditEvent
+		select {
+		case <-done:
+			return
+		case event := <-s.queue:
+			batch = append(batch, event)
+		}
+		if s.kafka {
+		fill:
+			for len(batch) < auditBatchSize {
+				select {
+				case event := <-s.queue:
+					batch = append(batch, event)
+				default:
+					break fill
+				}
+			}
+		}
+		for {
+			err := s.deliver(batch)
+			if err == nil {
+				break
+			}
+			logger.Printf("error delivering %d audit events to %s: %s", len(batch), s.url, err)
+			select {
+			case <-done:
+				return
+			case <-time.After(s.retry):
+			}
+		}
+	}
+}
+
+// deliver sends a batch of events: the webhook receives a single event, the
+// Kafka REST Proxy a batch of records keyed by user
+func (s *auditSink) deliver(batch []auditEvent) error {
+	var v interface{} = batch[0]
+	contentType := "application/json"
+	if s.kafka {
+		var records []map[string]interface{}
+		for _, event := range batch {
+			records = append(records, map[string]interface{}{"key": event.User, "value": event})
+		}
+		v = map[string]interface{}{"records": records}
+		contentType = "application/vnd.kafka.json.v2+json"
+	}
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(s.url, contentType, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("got %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// auditLogin records a login of the user via the method, which failed for the
+// reason unless it is empty, in the audit log and the metrics. The session
+// may be nil.
+func (p *OAuthProxy) auditLogin(req *http.Request, s *sessionsapi.SessionState, user, method, reason string) {
+	eventType := auditLoginSuccess
+	if reason != "" {
+		eventType = auditLoginFailure
+	}
+	p.metrics.login(p.providerID, method, reason == "")
+	p.auditLog.Record(req, s, auditEvent{Type: eventType, Success: reason == "", User: user, Method: method, Reason: reason})
+}
+
+// auditDenied records that the user of the session was denied access for the
+// reason, counting it towards the failure alerts
+func (p *OAuthProxy) auditDenied(req *http.Request, s *sessionsapi.SessionState, reason string) {
+	p.auditLog.Record(req, s, auditEvent{Type: auditAuthzDenied, Reason: reason})
+	p.failureAlerts.Record(failureDenial, reason)
+}
@@ -0,0 +1,99 @@
+package oauthproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	sessionsapi "github.com/OpusCapita/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAuditLog(t *testing.T) {
+	o := testOptions()
+	a, msgs := parseAuditLog(o, nil)
+	assert.Nil(t, a)
+	assert.Empty(t, msgs)
+
+	o.AuditWebhookURL = "siem.example.com/events"
+	o.AuditKafkaRESTURL = "ftp://kafka-rest:8082/topics/audit"
+	_, msgs = parseAuditLog(o, nil)
+	assert.Equal(t, []string{
+		`invalid audit-webhook-url "siem.example.com/events": must be an http(s) URL`,
+		`invalid audit-kafka-rest-url "ftp://kafka-rest:8082/topics/audit": must be an http(s) URL`}, msgs)
+}
+
+func TestAuditLogRecord(t *testing.T) {
+	var buf bytes.Buffer
+	a := &auditLog{writer: &buf, provider: "google"}
+	req := httptest.NewRequest("GET", "/oauth2/callback?code=x", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	a.Record(req, &sessionsapi.SessionState{User: "jdoe", Email: "jdoe@example.com"}, auditEvent{Type: auditLoginSuccess, Success: true, Method: "oauth2"})
+
+	var event auditEvent
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &event))
+	assert.Equal(t, auditLoginSuccess, event.Type)
+	assert.True(t, event.Success)
+	assert.Equal(t, "jdoe", event.User)
+	assert.Equal(t, "jdoe@example.com", event.Email)
+	assert.Equal(t, "google", event.Provider)
+	assert.Equal(t, "oauth2", event.Method)
+	assert.Equal(t, "10.0.0.1", event.Client)
+	assert.Equal(t, "GET /oauth2/callback?code=x", event.Request)
+
+	// a nil audit log records nothing
+	var nilLog *auditLog
+	nilLog.Record(req, nil, auditEvent{Type: auditLogout})
+}
+
+func TestAuditLogSinks(t *testing.T) {
+	received := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		received <- req.URL.Path + " " + req.Header.Get("Content-Type") + " " + string(body)
+	}))
+	defer server.Close()
+
+	o := testOptions()
+	o.AuditWebhookURL = server.URL + "/events"
+	o.AuditKafkaRESTURL = server.URL + "/topics/audit"
+	a, msgs := parseAuditLog(o, nil)
+	assert.Empty(t, msgs)
+	done := make(chan bool)
+	defer close(done)
+	go a.Run(done)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	a.Record(req, nil, auditEvent{Type: auditLoginFailure, User: "jdoe", Method: "htpasswd", Reason: "invalid password"})
+	got := map[string]string{}
+	for i := 0; i < 2; i++ {
+		select {
+		case r := <-received:
+			fields := strings.SplitN(r, " ", 3)
+			path := fields[0]
+			got[path] = fields[1]
+			var body map[string]interface{}
+			assert.NoError(t, json.Unmarshal([]byte(fields[2]), &body))
+			if path == "/events" {
+				assert.Equal(t, "login_failure", body["type"])
+				assert.Equal(t, "invalid password", body["reason"])
+			} else {
+				records := body["records"].([]interface{})
+				assert.Len(t, records, 1)
+				record := records[0].(map[string]interface{})
+				assert.Equal(t, "jdoe", record["key"])
+				assert.Equal(t, "login_failure", record["value"].(map[string]interface{})["type"])
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("audit event not delivered")
+		}
+	}
+	assert.Equal(t, map[string]string{
+		"/events":       "application/json",
+		"/topics/audit": "application/vnd.kafka.json.v2+json"}, got)
+}
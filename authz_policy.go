@@ -0,0 +1,329 @@
+package oauthproxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/OpusCapita/oauth2_proxy/logger"
+	sessionsapi "github.com/OpusCapita/oauth2_proxy/pkg/apis/sessions"
+	"gopkg.in/yaml.v2"
+)
+
+// authzPolicy holds the per-host and per-route authorization rules and
+// access hours of the authz-policy-file, applied to authenticated requests
+// on top of the global email validation
+type authzPolicy struct {
+	Hosts       []*hostRule    `yaml:"hosts"`
+	Rules       []*authzRule   `yaml:"rules"`
+	AccessHours []*accessHours `yaml:"access_hours"`
+
+	// dryRun is set if any of the entries is a dry run
+	dryRun bool
+}
+
+// authzRule restricts requests for paths matching a glob, and optionally
+// only some methods, to the listed emails, email domains and groups. A rule
+// without any of them lets every authenticated user through. A condition
+// expression further restricts the requests the rule lets through. A dry run
+// rule only logs the requests it would deny.
+type authzRule struct {
+	Path      string   `yaml:"path"`
+	Methods   []string `yaml:"methods"`
+	Emails    []string `yaml:"emails"`
+	Domains   []string `yaml:"domains"`
+	Groups    []string `yaml:"groups"`
+	Condition string   `yaml:"condition"`
+	DryRun    bool     `yaml:"dry_run"`
+
+	pattern   *regexp.Regexp
+	condition *exprProgram
+}
+
+// loadAuthzPolicy reads and compiles an authorization policy file
+func loadAuthzPolicy(path string) (*authzPolicy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return compileAuthzPolicy(data)
+}
+
+// compileAuthzPolicy parses and compiles an authorization policy in YAML or
+// JSON
+func compileAuthzPolicy(data []byte) (*authzPolicy, error) {
+	var err error
+	policy := &authzPolicy{}
+	if err := yaml.UnmarshalStrict(data, policy); err != nil {
+		return nil, err
+	}
+	for i, rule := range policy.Hosts {
+		if err := rule.compile(); err != nil {
+			return nil, fmt.Errorf("host %d: %v", i+1, err)
+		}
+		policy.dryRun = policy.dryRun || rule.DryRun
+	}
+	for i, rule := range policy.Rules {
+		if !strings.HasPrefix(rule.Path, "/") {
+			return nil, fmt.Errorf("rule %d: path must start with /", i+1)
+		}
+		rule.pattern, err = globToRegexp(rule.Path)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i+1, err)
+		}
+		if err := rule.compileCondition(); err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i+1, err)
+		}
+		policy.dryRun = policy.dryRun || rule.DryRun
+	}
+	for i, hours := range policy.AccessHours {
+		if err := hours.compile(); err != nil {
+			return nil, fmt.Errorf("access hours %d: %v", i+1, err)
+		}
+		policy.dryRun = policy.dryRun || hours.DryRun
+	}
+	return policy, nil
+}
+
+// parseAuthzPolicy loads the authz-policy-file, if any
+func parseAuthzPolicy(o *Options, msgs []string) (*authzPolicy, []string) {
+	if o.AuthzPolicyFile == "" {
+		return nil, msgs
+	}
+	policy, err := loadAuthzPolicy(o.AuthzPolicyFile)
+	if err != nil {
+		return nil, append(msgs, fmt.Sprintf("could not load authz-policy-file=%q %s", o.AuthzPolicyFile, err))
+	}
+	return policy, msgs
+}
+
+// globToRegexp compiles a path glob: * matches within a path segment, **
+// across segments, and a trailing /** also matches the directory itself
+func globToRegexp(glob string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], "/**") && i+3 == len(glob):
+			b.WriteString("(/.*)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case glob[i] == '*':
+			b.WriteString("[^/]*")
+		case glob[i] == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// compileCondition compiles the condition expression of the rule, if any
+func (r *authzRule) compileCondition() error {
+	if r.Condition == "" {
+		return nil
+	}
+	var err error
+	if r.condition, err = compileExpr(r.Condition); err != nil {
+		return fmt.Errorf("invalid condition %q: %v", r.Condition, err)
+	}
+	return nil
+}
+
+// matches returns whether the rule applies to a request
+func (r *authzRule) matches(method, path string) bool {
+	if !r.pattern.MatchString(path) {
+		return false
+	}
+	if len(r.Methods) == 0 {
+		return true
+	}
+	for _, m := range r.Methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// allows returns whether the rule lets the user of the session through
+func (r *authzRule) allows(s *sessionsapi.SessionState) bool {
+	if len(r.Emails) == 0 && len(r.Domains) == 0 && len(r.Groups) == 0 {
+		return true
+	}
+	email := strings.ToLower(s.Email)
+	for _, e := range r.Emails {
+		if email != "" && strings.ToLower(e) == email {
+			return true
+		}
+	}
+	for _, d := range r.Domains {
+		if email != "" && strings.HasSuffix(email, "@"+strings.ToLower(strings.TrimPrefix(d, "@"))) {
+			return true
+		}
+	}
+	for _, g := range r.Groups {
+		for _, sg := range s.Groups {
+			if g == sg {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Authorize applies the first rule matching the request. Requests no rule
+// matches are allowed. Dry run rules are skipped.
+func (pol *authzPolicy) Authorize(method, path string, s *sessionsapi.SessionState) (bool, *authzRule) {
+	return pol.authorize(method, path, s, false)
+}
+
+// authorize applies the first rule matching the request, including the dry
+// run rules if dryRun is set
+func (pol *authzPolicy) authorize(method, path string, s *sessionsapi.SessionState, dryRun bool) (bool, *authzRule) {
+	for _, rule := range pol.Rules {
+		if (dryRun || !rule.DryRun) && rule.matches(method, path) {
+			return rule.allows(s), rule
+		}
+	}
+	return true, nil
+}
+
+// authRequestTarget returns the method and path of the request a forward
+// auth or auth_request subrequest is made for, from the headers set by the
+// reverse proxy. The path is unescaped like the path of proxied requests,
+// and is empty if the headers do not give one.
+func authRequestTarget(req *http.Request) (string, string) {
+	method := req.Header.Get("X-Forwarded-Method")
+	if method == "" {
+		method = req.Header.Get("X-Original-Method")
+	}
+	uri := req.Header.Get("X-Forwarded-Uri")
+	if uri == "" {
+		uri = req.Header.Get("X-Original-URI")
+	}
+	if i := strings.IndexAny(uri, "?#"); i != -1 {
+		uri = uri[:i]
+	}
+	unescaped, err := url.PathUnescape(uri)
+	if err != nil {
+		return method, ""
+	}
+	return method, unescaped
+}
+
+// cleanRequestPath resolves the . and .. segments and repeated slashes of a
+// request path, keeping a trailing slash, so that policies written for
+// /admin also match //admin and /public/../admin. Paths which are not
+// absolute give an empty string.
+func cleanRequestPath(p string) string {
+	if !strings.HasPrefix(p, "/") {
+		return ""
+	}
+	cleaned := path.Clean(p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// conditionHolds evaluates the condition expression of a rule for a request. Errors,
+// such as a missing claim, deny the request.
+func conditionHolds(req *http.Request, host, method, path string, s *sessionsapi.SessionState, rule *authzRule) bool {
+	if rule.condition == nil {
+		return true
+	}
+	ok, err := rule.condition.Eval(newExprVars(req, host, method, path, s))
+	if err != nil {
+		logger.PrintAuthf(s.Email, req, logger.AuthError, "Error evaluating condition %q for %s %s: %s", rule.Condition, method, path, err)
+		return false
+	}
+	return ok
+}
+
+// policies returns the authorization policy of the authz-policy-file and
+// those of the ProxyPolicy resources, when configured
+func (p *OAuthProxy) policies() []*authzPolicy {
+	var policies []*authzPolicy
+	if p.authzPolicy != nil {
+		policies = append(policies, p.authzPolicy)
+	}
+	kube, _ := p.kubePolicies.Policies()
+	return append(policies, kube...)
+}
+
+// policyDenial checks the host rules and rules of a policy, returning which
+// one denies the request or "" if the policy allows it. The dry run rules
+// are applied as well if dryRun is set.
+func policyDenial(pol *authzPolicy, req *http.Request, host, method, path string, s *sessionsapi.SessionState, dryRun bool) string {
+	if allowed, rule := pol.authorizeHost(host, method, path, s, dryRun); !allowed || (rule != nil && !conditionHolds(req, host, method, path, s, &rule.authzRule)) {
+		return fmt.Sprintf("on %s by authz policy host rule for %s", host, rule.Host)
+	}
+	if allowed, rule := pol.authorize(method, path, s, dryRun); !allowed || (rule != nil && !conditionHolds(req, host, method, path, s, rule)) {
+		return fmt.Sprintf("by authz policy rule for %s", rule.Path)
+	}
+	return ""
+}
+
+// allowedByPolicy checks the host rules and rules of a policy, only logging
+// the denials in dry run mode and those of dry run rules
+func (p *OAuthProxy) allowedByPolicy(pol *authzPolicy, req *http.Request, host, method, path string, s *sessionsapi.SessionState) bool {
+	if denial := policyDenial(pol, req, host, method, path, s, false); denial != "" {
+		if !p.authzDryRun {
+			logger.PrintAuthf(s.Email, req, logger.AuthFailure, "Permission denied for %s %s %s", method, path, denial)
+			p.auditDenied(req, s, denial)
+			return false
+		}
+		logger.PrintAuthf(s.Email, req, logger.AuthDryRun, "Dry run: permission would be denied for %s %s %s", method, path, denial)
+		p.metrics.dryRunDenial("policy")
+		return true
+	}
+	if pol.dryRun {
+		if denial := policyDenial(pol, req, host, method, path, s, true); denial != "" {
+			logger.PrintAuthf(s.Email, req, logger.AuthDryRun, "Dry run: permission would be denied for %s %s %s", method, path, denial)
+			p.metrics.dryRunDenial("policy")
+		}
+	}
+	return true
+}
+
+// authorized checks the session against the authorization policies, their
+// access hours and OPA for a request with method and path
+func (p *OAuthProxy) authorized(req *http.Request, method, path string, s *sessionsapi.SessionState) bool {
+	defer timingsFromContext(req.Context()).addAuth(time.Now())
+	if _, loaded := p.kubePolicies.Policies(); p.kubePolicies != nil && !loaded {
+		logger.PrintAuthf(s.Email, req, logger.AuthError, "Permission denied for %s %s until the ProxyPolicy resources are loaded", method, path)
+		return false
+	}
+	if p.outsideAccessHours(req, method, path, s) != nil {
+		return false
+	}
+	host := p.getRequestHost(req)
+	for _, pol := range p.policies() {
+		if !p.allowedByPolicy(pol, req, host, method, path, s) {
+			return false
+		}
+	}
+	if p.opa != nil {
+		allowed, err := p.opa.Allow(newOPAInput(req, method, path, s))
+		if err != nil {
+			logger.PrintAuthf(s.Email, req, logger.AuthError, "Error querying OPA for %s %s: %s", method, path, err)
+			return false
+		}
+		if !allowed {
+			logger.PrintAuthf(s.Email, req, logger.AuthFailure, "Permission denied for %s %s by OPA", method, path)
+			p.auditDenied(req, s, "by OPA")
+			return false
+		}
+	}
+	return true
+}
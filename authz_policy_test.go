@@ -0,0 +1,194 @@
+package oauthproxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/OpusCapita/oauth2_proxy/logger"
+	sessionsapi "github.com/OpusCapita/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeAuthzPolicy(t *testing.T, policy string) string {
+	f, err := ioutil.TempFile("", "authz-policy")
+	assert.NoError(t, err)
+	defer f.Close()
+	_, err = f.WriteString(policy)
+	assert.NoError(t, err)
+	return f.Name()
+}
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		glob    string
+		path    string
+		matches bool
+	}{
+		{"/admin/**", "/admin", true},
+		{"/admin/**", "/admin/users/1", true},
+		{"/admin/**", "/administrator", false},
+		{"/api/*/items", "/api/v1/items", true},
+		{"/api/*/items", "/api/v1/x/items", false},
+		{"/api/**/items", "/api/v1/x/items", true},
+		{"/file?.txt", "/file1.txt", true},
+		{"/report.csv", "/reportxcsv", false},
+	}
+	for _, tc := range tests {
+		r, err := globToRegexp(tc.glob)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.matches, r.MatchString(tc.path), "%s %s", tc.glob, tc.path)
+	}
+}
+
+func TestAuthzPolicy(t *testing.T) {
+	path := writeAuthzPolicy(t, `
+rules:
+  - path: /admin/**
+    groups: [ops]
+  - path: /api/**
+    methods: [POST, DELETE]
+    emails: [jane@example.com]
+    domains: [ops.example.com]
+  - path: /public/**
+`)
+	defer os.Remove(path)
+	policy, err := loadAuthzPolicy(path)
+	assert.NoError(t, err)
+
+	ops := &sessionsapi.SessionState{Email: "john@example.com", Groups: []string{"ops"}}
+	jane := &sessionsapi.SessionState{Email: "Jane@example.com"}
+	opsDomain := &sessionsapi.SessionState{Email: "bob@ops.example.com"}
+
+	allowed, rule := policy.Authorize("GET", "/admin/users", ops)
+	assert.True(t, allowed)
+	assert.Equal(t, "/admin/**", rule.Path)
+	allowed, _ = policy.Authorize("GET", "/admin/users", jane)
+	assert.False(t, allowed)
+
+	allowed, _ = policy.Authorize("POST", "/api/items", jane)
+	assert.True(t, allowed)
+	allowed, _ = policy.Authorize("delete", "/api/items/1", opsDomain)
+	assert.True(t, allowed)
+	allowed, _ = policy.Authorize("POST", "/api/items", ops)
+	assert.False(t, allowed)
+	allowed, _ = policy.Authorize("GET", "/api/items", ops)
+	assert.True(t, allowed)
+
+	allowed, rule = policy.Authorize("GET", "/public/index.html", ops)
+	assert.True(t, allowed)
+	assert.NotNil(t, rule)
+	allowed, rule = policy.Authorize("GET", "/", ops)
+	assert.True(t, allowed)
+	assert.Nil(t, rule)
+}
+
+func TestLoadAuthzPolicyErrors(t *testing.T) {
+	path := writeAuthzPolicy(t, "rules:\n  - path: /admin/**\n    group: [ops]\n")
+	defer os.Remove(path)
+	_, err := loadAuthzPolicy(path)
+	assert.Error(t, err)
+
+	relative := writeAuthzPolicy(t, "rules:\n  - path: admin/**\n")
+	defer os.Remove(relative)
+	_, err = loadAuthzPolicy(relative)
+	assert.EqualError(t, err, "rule 1: path must start with /")
+}
+
+func TestAuthzPolicyAuthOnly(t *testing.T) {
+	path := writeAuthzPolicy(t, "rules:\n  - path: /admin/**\n    groups: [ops]\n")
+	defer os.Remove(path)
+
+	opts := NewOptions()
+	opts.CookieSecret = "foobar"
+	opts.DevFakeIdentity = "jane@example.com"
+	opts.AuthzPolicyFile = path
+	assert.NoError(t, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(email string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/oauth2/auth", nil)
+	req.Header.Set("X-Original-URI", "/admin/users?page=2")
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+
+	rw = httptest.NewRecorder()
+	req.Header.Set("X-Original-URI", "/app/")
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusAccepted, rw.Code)
+
+	for _, uri := range []string{"//admin/users", "/app/../admin/users", "/%2e%2e/admin/users", "/admin%2Fusers", "", "%zz"} {
+		rw = httptest.NewRecorder()
+		req.Header.Set("X-Original-URI", uri)
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, http.StatusForbidden, rw.Code, uri)
+	}
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/admin/", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+}
+
+func TestCleanRequestPath(t *testing.T) {
+	assert.Equal(t, "/admin", cleanRequestPath("/public/../admin"))
+	assert.Equal(t, "/admin/", cleanRequestPath("//admin//"))
+	assert.Equal(t, "/", cleanRequestPath("/.."))
+	assert.Equal(t, "", cleanRequestPath(""))
+	assert.Equal(t, "", cleanRequestPath("admin"))
+}
+
+func TestAuthzPolicyDryRun(t *testing.T) {
+	path := writeAuthzPolicy(t, `
+rules:
+  - path: /admin/**
+    groups: [admins]
+    dry_run: true
+  - path: /admin/**
+    groups: [ops]
+access_hours:
+  # today is outside of one of them
+  - days: [mon]
+    dry_run: true
+  - days: [tue]
+    dry_run: true
+`)
+	defer os.Remove(path)
+
+	opts := NewOptions()
+	opts.CookieSecret = "foobar"
+	opts.DevFakeIdentity = "jane@example.com"
+	opts.AuthzPolicyFile = path
+	assert.NoError(t, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(email string) bool { return true })
+	proxy.metrics = newProxyMetrics()
+
+	buf := &bytes.Buffer{}
+	logger.SetOutput(buf)
+	defer logger.SetOutput(os.Stdout)
+
+	req, _ := http.NewRequest("GET", "/admin/users", nil)
+	ops := &sessionsapi.SessionState{Email: "john@example.com", Groups: []string{"ops"}}
+	assert.True(t, proxy.authorized(req, "GET", "/admin/users", ops))
+	assert.Contains(t, buf.String(), "[AuthDryRun] Dry run: permission would be denied for GET /admin/users by authz policy rule for /admin/**")
+	assert.Contains(t, buf.String(), "[AuthDryRun] Dry run: permission would be denied for GET /admin/users outside of access hours")
+
+	buf.Reset()
+	jane := &sessionsapi.SessionState{Email: "jane@example.com"}
+	assert.False(t, proxy.authorized(req, "GET", "/admin/users", jane))
+	assert.Contains(t, buf.String(), "[AuthFailure] Permission denied for GET /admin/users by authz policy rule for /admin/**")
+
+	buf.Reset()
+	proxy.authzDryRun = true
+	assert.True(t, proxy.authorized(req, "GET", "/admin/users", jane))
+	assert.Contains(t, buf.String(), "[AuthDryRun] Dry run: permission would be denied for GET /admin/users by authz policy rule for /admin/**")
+	assert.NotContains(t, buf.String(), "AuthFailure")
+
+	rw := httptest.NewRecorder()
+	proxy.metrics.ServeHTTP(rw, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Contains(t, rw.Body.String(), `oauth2_proxy_authz_dry_run_denials_total{check="policy"} 2`)
+	assert.Contains(t, rw.Body.String(), `oauth2_proxy_authz_dry_run_denials_total{check="access_hours"} 3`)
+}
@@ -0,0 +1,157 @@
+package oauthproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/OpusCapita/oauth2_proxy/logger"
+	"github.com/OpusCapita/oauth2_proxy/pkg/aws"
+)
+
+// awsSecrets reads the client and cookie secrets given as KMS encrypted blobs
+// or Secrets Manager ARNs, and watches the Secrets Manager secrets for new
+// versions. The methods of a nil awsSecrets do nothing.
+type awsSecrets struct {
+	client   *aws.Client
+	interval time.Duration
+	// versions holds the version read of every Secrets Manager secret
+	versions map[string]string
+	// rotated is called when a secret was rotated, reloading the
+	// configuration unless the proxy is embedded
+	rotated func()
+}
+
+// parseAWSSecrets reads the aws-client-secret and aws-cookie-secret, if set
+func parseAWSSecrets(o *Options, msgs []string) (*awsSecrets, []string) {
+	secrets := []struct {
+		name  string
+		value *string
+		ref   string
+	}{
+		{"client-secret", &o.ClientSecret, o.AWSClientSecret},
+		{"cookie-secret", &o.CookieSecret, o.AWSCookieSecret},
+	}
+	region := o.AWSRegion
+	if region == "" {
+		region = aws.DefaultRegion()
+	}
+	invalid, used := len(msgs), false
+	for _, secret := range secrets {
+		if secret.ref == "" {
+			continue
+		}
+		used = true
+		if isSecretARN(secret.ref) {
+			arn := strings.SplitN(secret.ref, "#", 2)[0]
+			if _, err := aws.ARNRegion(arn); err != nil {
+				msgs = append(msgs, fmt.Sprintf("invalid aws-%s: %s", secret.name, err))
+			}
+		} else if _, err := aws.DecodeBlob(secret.ref); err != nil {
+			msgs = append(msgs, fmt.Sprintf("invalid aws-%s: %s", secret.name, err))
+		} else if region == "" {
+			msgs = append(msgs, fmt.Sprintf("missing setting: aws-region is required to decrypt aws-%s with KMS", secret.name))
+		}
+		if *secret.value != "" {
+			msgs = append(msgs, fmt.Sprintf("only one of %s and aws-%s may be set", secret.name, secret.name))
+		}
+	}
+	if !used || len(msgs) > invalid {
+		return nil, msgs
+	}
+	client, err := aws.NewClient(region, o.AWSEndpointURL)
+	if err != nil {
+		return nil, append(msgs, fmt.Sprintf("invalid AWS configuration: %s", err))
+	}
+
+	s := &awsSecrets{
+		client:   client,
+		interval: o.AWSSecretsRefreshInterval,
+		versions: map[string]string{},
+		rotated: func() {
+			logger.Printf("reloading configuration")
+			reloadConfiguration()
+		},
+	}
+	for _, secret := range secrets {
+		if secret.ref == "" {
+			continue
+		}
+		value, err := s.read(secret.ref)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("unable to read aws-%s: %s", secret.name, err))
+			continue
+		}
+		*secret.value = value
+	}
+	return s, msgs
+}
+
+// isSecretARN returns whether a secret is given by a Secrets Manager ARN
+// rather than as a KMS encrypted blob
+func isSecretARN(ref string) bool {
+	return strings.HasPrefix(ref, "arn:")
+}
+
+// read reads a secret given as a Secrets Manager ARN, optionally followed by
+// #<key> to read the key of a JSON secret, or as a base64 encoded KMS
+// encrypted blob
+func (s *awsSecrets) read(ref string) (string, error) {
+	if !isSecretARN(ref) {
+		blob, err := aws.DecodeBlob(ref)
+		if err != nil {
+			return "", err
+		}
+		plaintext, err := s.client.Decrypt(blob)
+		return string(plaintext), err
+	}
+
+	parts := strings.SplitN(ref, "#", 2)
+	value, version, err := s.client.GetSecretValue(parts[0])
+	if err != nil {
+		return "", err
+	}
+	s.versions[parts[0]] = version
+	if len(parts) == 1 {
+		return value, nil
+	}
+	var values map[string]interface{}
+	if err := json.Unmarshal([]byte(value), &values); err != nil {
+		return "", fmt.Errorf("secret %s is not a JSON object of keys", parts[0])
+	}
+	key, ok := values[parts[1]].(string)
+	if !ok {
+		return "", fmt.Errorf("no string value %q in the secret %s", parts[1], parts[0])
+	}
+	return key, nil
+}
+
+// Run checks the Secrets Manager secrets for a new version every interval
+// until done is closed, and calls rotated when one was
+func (s *awsSecrets) Run(done <-chan bool) {
+	if s == nil || s.interval <= 0 || len(s.versions) == 0 {
+		return
+	}
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		for arn, version := range s.versions {
+			_, current, err := s.client.GetSecretValue(arn)
+			if err != nil {
+				logger.Printf("error checking %s for a new version: %s", arn, err)
+				continue
+			}
+			if current != version {
+				logger.Printf("secret %s was rotated", arn)
+				s.rotated()
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package oauthproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testSecretARN = "arn:aws:secretsmanager:eu-west-1:123456789012:secret:oauth2-proxy-AbCdEf"
+
+func TestParseAWSSecretsInvalid(t *testing.T) {
+	os.Unsetenv("AWS_REGION")
+	os.Unsetenv("AWS_DEFAULT_REGION")
+	o := testOptions()
+	s, msgs := parseAWSSecrets(o, nil)
+	assert.Nil(t, s)
+	assert.Empty(t, msgs)
+
+	o.AWSClientSecret = "arn:aws:secretsmanager:eu-west-1:123456789012:oauth2-proxy"
+	o.AWSCookieSecret = "YmxvYg=="
+	_, msgs = parseAWSSecrets(o, nil)
+	assert.Equal(t, []string{
+		`invalid aws-client-secret: invalid Secrets Manager secret ARN "arn:aws:secretsmanager:eu-west-1:123456789012:oauth2-proxy"`,
+		"only one of client-secret and aws-client-secret may be set",
+		"missing setting: aws-region is required to decrypt aws-cookie-secret with KMS",
+		"only one of cookie-secret and aws-cookie-secret may be set",
+	}, msgs)
+}
+
+func TestParseAWSSecrets(t *testing.T) {
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+	var version atomic.Value
+	version.Store("v1")
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.Header.Get("X-Amz-Target") {
+		case "TrentService.Decrypt":
+			rw.Write([]byte(`{"Plaintext": "Y29va2llLXMzY3IzdA=="}`))
+		case "secretsmanager.GetSecretValue":
+			secret, _ := json.Marshal(map[string]string{"client_secret": "client-s3cr3t"})
+			json.NewEncoder(rw).Encode(map[string]string{"SecretString": string(secret), "VersionId": version.Load().(string)})
+		}
+	}))
+	defer server.Close()
+
+	o := testOptions()
+	o.ClientSecret = ""
+	o.CookieSecret = ""
+	o.AWSRegion = "eu-central-1"
+	o.AWSEndpointURL = server.URL
+	o.AWSClientSecret = testSecretARN + "#client_secret"
+	o.AWSCookieSecret = "YmxvYg=="
+	o.AWSSecretsRefreshInterval = 10 * time.Millisecond
+	s, msgs := parseAWSSecrets(o, nil)
+	assert.Empty(t, msgs)
+	assert.Equal(t, "client-s3cr3t", o.ClientSecret)
+	assert.Equal(t, "cookie-s3cr3t", o.CookieSecret)
+	assert.Equal(t, map[string]string{testSecretARN: "v1"}, s.versions)
+
+	_, err := s.read(testSecretARN + "#cookie_secret")
+	assert.EqualError(t, err, `no string value "cookie_secret" in the secret `+testSecretARN)
+
+	reloaded := make(chan bool, 1)
+	defer func(reload func()) { reloadConfiguration = reload }(reloadConfiguration)
+	reloadConfiguration = func() { reloaded <- true }
+	done := make(chan bool)
+	defer close(done)
+	go s.Run(done)
+
+	select {
+	case <-reloaded:
+		t.Fatal("reloaded without a new version")
+	case <-time.After(50 * time.Millisecond):
+	}
+	version.Store("v2")
+	select {
+	case <-reloaded:
+	case <-time.After(time.Second):
+		t.Fatal("not reloaded after the secret was rotated")
+	}
+}
@@ -0,0 +1,69 @@
+package oauthproxy
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/OpusCapita/oauth2_proxy/logger"
+)
+
+// loadBasicAuthUsers reads the passwords of users for a legacy upstream
+// from a file of email:password lines. Blank lines and lines starting with
+// # are ignored.
+func loadBasicAuthUsers(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		parts := strings.SplitN(text, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("line %d: must be of the form email:password", line)
+		}
+		users[strings.ToLower(parts[0])] = parts[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// basicAuthProxy sends the upstream an Authorization header with basic auth
+// credentials, replacing the one of the client. The credentials are looked
+// up by the email of the session, and users without a password are denied.
+// Requests without a session, which skip authentication, are proxied
+// unchanged.
+type basicAuthProxy struct {
+	users   map[string]string
+	handler http.Handler
+	denied  func(rw http.ResponseWriter)
+}
+
+func (b *basicAuthProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	session := sessionFromContext(req.Context())
+	if session == nil {
+		b.handler.ServeHTTP(rw, req)
+		return
+	}
+	password, ok := b.users[strings.ToLower(session.Email)]
+	if !ok || session.Email == "" {
+		logger.Printf("%s has no basic auth password for upstream %s", session.Email, req.URL.Path)
+		b.denied(rw)
+		return
+	}
+	req.SetBasicAuth(session.Email, password)
+	b.handler.ServeHTTP(rw, req)
+}
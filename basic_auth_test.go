@@ -0,0 +1,66 @@
+package oauthproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	sessionsapi "github.com/OpusCapita/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadBasicAuthUsers(t *testing.T) {
+	f, err := ioutil.TempFile("", "basic_auth")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString("# legacy accounts\nJDoe@Example.com:s3cr:et\n\nadmin@example.com:hunter2\n")
+	f.Close()
+
+	users, err := loadBasicAuthUsers(f.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"jdoe@example.com":  "s3cr:et",
+		"admin@example.com": "hunter2",
+	}, users)
+
+	u, _ := url.Parse("http://127.0.0.1:8080/legacy/#basic-auth-file=" + f.Name())
+	uo, err := parseUpstreamOptions(u)
+	assert.NoError(t, err)
+	assert.Equal(t, users, uo.basicAuthUsers)
+
+	// credentials in the upstream URL would end up in the logs
+	u, _ = url.Parse("http://127.0.0.1:8080/legacy/#basic-auth=svc%3Apass")
+	_, err = parseUpstreamOptions(u)
+	assert.Equal(t, `unknown upstream option "basic-auth"`, err.Error())
+}
+
+func TestBasicAuthProxy(t *testing.T) {
+	var user, password string
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ = r.BasicAuth()
+	})
+	denied := func(rw http.ResponseWriter) {
+		rw.WriteHeader(http.StatusForbidden)
+	}
+	session := &sessionsapi.SessionState{User: "jdoe", Email: "JDoe@example.com"}
+
+	proxy := &basicAuthProxy{users: map[string]string{"jdoe@example.com": "hunter2"}, handler: upstream, denied: denied}
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/legacy/", nil)
+	req.SetBasicAuth("client", "supplied")
+	proxy.ServeHTTP(rw, withSession(req, session))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "JDoe@example.com", user)
+	assert.Equal(t, "hunter2", password)
+
+	user, password = "", ""
+	rw = httptest.NewRecorder()
+	other := &sessionsapi.SessionState{User: "other", Email: "other@example.com"}
+	proxy.ServeHTTP(rw, withSession(httptest.NewRequest(http.MethodGet, "/legacy/", nil), other))
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	assert.Equal(t, "", user)
+}
@@ -0,0 +1,9 @@
+package main
+
+import (
+	oauthproxy "github.com/OpusCapita/oauth2_proxy"
+)
+
+func main() {
+	oauthproxy.Main()
+}
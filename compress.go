@@ -0,0 +1,117 @@
+package oauthproxy
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// defaultCompressTypes are the content types compressed when no
+// compress-type is configured
+var defaultCompressTypes = []string{
+	"text/html",
+	"text/css",
+	"text/plain",
+	"text/xml",
+	"application/javascript",
+	"application/json",
+	"application/xml",
+	"image/svg+xml",
+}
+
+// setProxyCompression compresses upstream responses which are not already
+// encoded with brotli or gzip, depending on what the client accepts
+func setProxyCompression(proxy *httputil.ReverseProxy, types []string, minSize int64) {
+	modify := proxy.ModifyResponse
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if modify != nil {
+			if err := modify(resp); err != nil {
+				return err
+			}
+		}
+		compressResponse(resp, types, minSize)
+		return nil
+	}
+}
+
+func compressResponse(resp *http.Response, types []string, minSize int64) {
+	if resp.Header.Get("Content-Encoding") != "" || resp.StatusCode == http.StatusNoContent ||
+		resp.StatusCode == http.StatusNotModified || resp.Request.Method == http.MethodHead {
+		return
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength < minSize {
+		return
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !contains(types, mediaType) {
+		return
+	}
+
+	var encoding string
+	var newWriter func(io.Writer) io.WriteCloser
+	accept := resp.Request.Header.Get("Accept-Encoding")
+	switch {
+	case acceptsEncoding(accept, "br"):
+		encoding = "br"
+		newWriter = func(w io.Writer) io.WriteCloser { return brotli.NewWriter(w) }
+	case acceptsEncoding(accept, "gzip"):
+		encoding = "gzip"
+		newWriter = func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }
+	default:
+		return
+	}
+
+	body := resp.Body
+	pr, pw := io.Pipe()
+	go func() {
+		defer body.Close()
+		w := newWriter(pw)
+		_, err := io.Copy(w, body)
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+		pw.CloseWithError(err)
+	}()
+
+	resp.Body = pr
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	resp.Header.Set("Content-Encoding", encoding)
+	resp.Header.Add("Vary", "Accept-Encoding")
+}
+
+// acceptsEncoding checks whether the Accept-Encoding header allows the given
+// content coding
+func acceptsEncoding(accept string, encoding string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		if strings.TrimSpace(params[0]) != encoding {
+			continue
+		}
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package oauthproxy
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcceptsEncoding(t *testing.T) {
+	assert.True(t, acceptsEncoding("gzip, deflate, br", "br"))
+	assert.True(t, acceptsEncoding("gzip;q=0.5", "gzip"))
+	assert.False(t, acceptsEncoding("gzip;q=0, deflate", "gzip"))
+	assert.False(t, acceptsEncoding("", "gzip"))
+}
+
+func TestProxyCompression(t *testing.T) {
+	body := strings.Repeat("compress me ", 200)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/image.png" {
+			w.Header().Set("Content-Type", "image/png")
+		} else {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		}
+		w.Write([]byte(body))
+	}))
+	defer backend.Close()
+
+	backendURL, _ := url.Parse(backend.URL)
+	proxyHandler := NewReverseProxy(backendURL, time.Second)
+	setProxyCompression(proxyHandler, defaultCompressTypes, 1024)
+	frontend := httptest.NewServer(proxyHandler)
+	defer frontend.Close()
+
+	req, _ := http.NewRequest("GET", frontend.URL+"/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	res, err := http.DefaultTransport.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	gz, err := gzip.NewReader(res.Body)
+	require.NoError(t, err)
+	decoded, _ := ioutil.ReadAll(gz)
+	assert.Equal(t, body, string(decoded))
+
+	req, _ = http.NewRequest("GET", frontend.URL+"/image.png", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	res, err = http.DefaultTransport.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, "", res.Header.Get("Content-Encoding"))
+}
@@ -0,0 +1,1035 @@
+package oauthproxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	sessionsapi "github.com/OpusCapita/oauth2_proxy/pkg/apis/sessions"
+)
+
+// exprProgram is a compiled condition expression over the variables claims
+// and request, e.g.
+// `claims.department == "finance" && request.path.startsWith("/reports")`.
+//
+// The expressions have null, bool, int, double, string and list literals,
+// the operators ! - * / % + < <= > >= == != in && || and ?:, field selection,
+// indexing, has(), size(), the string functions startsWith, endsWith,
+// contains, matches, lowerAscii and upperAscii, and the exists and all
+// macros over lists and maps.
+type exprProgram struct {
+	source string
+	root   exprNode
+}
+
+// exprVars are the variables a program is evaluated with
+type exprVars map[string]interface{}
+
+// exprNode is a node of the syntax tree of a program
+type exprNode interface {
+	eval(vars exprVars) (interface{}, error)
+}
+
+// compileExpr parses a condition
+func compileExpr(source string) (*exprProgram, error) {
+	tokens, err := tokenizeExpr(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens, scope: map[string]bool{"claims": true, "request": true}}
+	root, err := p.conditional()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() != "" {
+		return nil, fmt.Errorf("unexpected %q", p.peek())
+	}
+	return &exprProgram{source: source, root: root}, nil
+}
+
+// Eval evaluates the program, which has to result in a bool
+func (c *exprProgram) Eval(vars exprVars) (bool, error) {
+	v, err := c.root.eval(vars)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("condition must be a bool, got %s", exprTypeName(v))
+	}
+	return b, nil
+}
+
+// newExprVars returns the claims of the session and the attributes of the
+// request a condition is evaluated with. The claims are those of the ID
+// token of the session, if any, overridden by the fields of the session.
+func newExprVars(req *http.Request, host, method, path string, s *sessionsapi.SessionState) exprVars {
+	claims := idTokenClaims(s.IDToken)
+	claims["email"] = s.Email
+	claims["user"] = s.User
+	groups := make([]interface{}, len(s.Groups))
+	for i, g := range s.Groups {
+		groups[i] = g
+	}
+	claims["groups"] = groups
+	if s.ACR != "" {
+		claims["acr"] = s.ACR
+	}
+	if s.Tenant != "" {
+		claims["tenant"] = s.Tenant
+	}
+
+	headers := make(map[string]interface{}, len(req.Header))
+	for name, values := range req.Header {
+		if !opaExcludedHeaders[name] && len(values) > 0 {
+			headers[strings.ToLower(name)] = values[0]
+		}
+	}
+	query := make(map[string]interface{})
+	for name, values := range req.URL.Query() {
+		query[name] = values[0]
+	}
+	return exprVars{
+		"claims": claims,
+		"request": map[string]interface{}{
+			"method":      method,
+			"path":        path,
+			"host":        host,
+			"remote_addr": getRemoteAddr(req),
+			"headers":     headers,
+			"query":       query,
+		},
+	}
+}
+
+// idTokenClaims decodes the claims of an ID token taken from a session,
+// which was verified when the session was created
+func idTokenClaims(idToken string) map[string]interface{} {
+	claims := make(map[string]interface{})
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return claims
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return claims
+	}
+	d := json.NewDecoder(strings.NewReader(string(b)))
+	d.UseNumber()
+	var raw map[string]interface{}
+	if d.Decode(&raw) != nil {
+		return claims
+	}
+	for k, v := range raw {
+		claims[k] = exprFromJSON(v)
+	}
+	return claims
+}
+
+// exprFromJSON converts JSON numbers to ints or doubles
+func exprFromJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case []interface{}:
+		for i := range v {
+			v[i] = exprFromJSON(v[i])
+		}
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = exprFromJSON(v[k])
+		}
+	}
+	return v
+}
+
+// exprToken is an operator, identifier or literal; literals keep their value
+type exprToken struct {
+	text  string
+	value interface{}
+	lit   bool
+}
+
+var exprOperators = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "+", "-", "*", "/", "%", ".", "(", ")", "[", "]", ",", "?", ":"}
+
+func tokenizeExpr(s string) ([]exprToken, error) {
+	var tokens []exprToken
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"' || c == '\'':
+			value, n, err := unquoteExpr(s[i:])
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, exprToken{text: s[i : i+n], value: value, lit: true})
+			i += n
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(s) && (s[j] >= '0' && s[j] <= '9' || s[j] == '.' || s[j] == 'e' || s[j] == 'E') {
+				j++
+			}
+			text := s[i:j]
+			if n, err := strconv.ParseInt(text, 10, 64); err == nil {
+				tokens = append(tokens, exprToken{text: text, value: n, lit: true})
+			} else if f, err := strconv.ParseFloat(text, 64); err == nil {
+				tokens = append(tokens, exprToken{text: text, value: f, lit: true})
+			} else {
+				return nil, fmt.Errorf("invalid number %q", text)
+			}
+			i = j
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			j := i
+			for j < len(s) && (s[j] == '_' || s[j] >= 'a' && s[j] <= 'z' || s[j] >= 'A' && s[j] <= 'Z' || s[j] >= '0' && s[j] <= '9') {
+				j++
+			}
+			tokens = append(tokens, exprToken{text: s[i:j]})
+			i = j
+		default:
+			op := ""
+			for _, o := range exprOperators {
+				if strings.HasPrefix(s[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected character %q", c)
+			}
+			tokens = append(tokens, exprToken{text: op})
+			i += len(op)
+		}
+	}
+	return tokens, nil
+}
+
+// unquoteExpr reads the string literal s starts with, returning its value
+// and length
+func unquoteExpr(s string) (string, int, error) {
+	quote := s[0]
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case quote:
+			return b.String(), i + 1, nil
+		case '\\':
+			i++
+			if i == len(s) {
+				break
+			}
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case '\\', '"', '\'':
+				b.WriteByte(s[i])
+			default:
+				return "", 0, fmt.Errorf("invalid escape \\%c", s[i])
+			}
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string")
+}
+
+// exprParser is a recursive descent parser for the precedence levels of the
+// operators
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+	// scope holds the variables, including those of enclosing macros
+	scope map[string]bool
+}
+
+func (p *exprParser) peek() string {
+	if p.pos == len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos].text
+}
+
+// identifier consumes the next token if it is an identifier
+func (p *exprParser) identifier() (string, bool) {
+	if p.pos < len(p.tokens) && !p.tokens[p.pos].lit && exprIdentifier.MatchString(p.tokens[p.pos].text) && p.tokens[p.pos].text != "in" {
+		p.pos++
+		return p.tokens[p.pos-1].text, true
+	}
+	return "", false
+}
+
+func (p *exprParser) accept(text string) bool {
+	if p.pos < len(p.tokens) && !p.tokens[p.pos].lit && p.tokens[p.pos].text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) expect(text string) error {
+	if !p.accept(text) {
+		if p.pos == len(p.tokens) {
+			return fmt.Errorf("expected %q, got end of expression", text)
+		}
+		return fmt.Errorf("expected %q, got %q", text, p.tokens[p.pos].text)
+	}
+	return nil
+}
+
+func (p *exprParser) conditional() (exprNode, error) {
+	cond, err := p.or()
+	if err != nil || !p.accept("?") {
+		return cond, err
+	}
+	then, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	els, err := p.conditional()
+	if err != nil {
+		return nil, err
+	}
+	return &exprConditional{cond: cond, then: then, els: els}, nil
+}
+
+// binary parses a left-associative level of operators
+func (p *exprParser) binary(ops []string, operand func() (exprNode, error)) (exprNode, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := ""
+		for _, o := range ops {
+			if p.accept(o) {
+				op = o
+				break
+			}
+		}
+		if op == "" {
+			return left, nil
+		}
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		left = &exprBinary{op: op, left: left, right: right}
+	}
+}
+
+func (p *exprParser) or() (exprNode, error) {
+	return p.binary([]string{"||"}, p.and)
+}
+
+func (p *exprParser) and() (exprNode, error) {
+	return p.binary([]string{"&&"}, p.relation)
+}
+
+func (p *exprParser) relation() (exprNode, error) {
+	return p.binary([]string{"==", "!=", "<=", ">=", "<", ">", "in"}, p.addition)
+}
+
+func (p *exprParser) addition() (exprNode, error) {
+	return p.binary([]string{"+", "-"}, p.multiplication)
+}
+
+func (p *exprParser) multiplication() (exprNode, error) {
+	return p.binary([]string{"*", "/", "%"}, p.unary)
+}
+
+func (p *exprParser) unary() (exprNode, error) {
+	for _, op := range []string{"!", "-"} {
+		if p.accept(op) {
+			operand, err := p.unary()
+			if err != nil {
+				return nil, err
+			}
+			return &exprUnary{op: op, operand: operand}, nil
+		}
+	}
+	return p.member()
+}
+
+func (p *exprParser) member() (exprNode, error) {
+	n, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.accept("."):
+			name, ok := p.identifier()
+			if !ok {
+				return nil, fmt.Errorf("expected a field or function name after '.', got %q", p.peek())
+			}
+			if !p.accept("(") {
+				n = &exprSelect{operand: n, field: name}
+				continue
+			}
+			if name == "exists" || name == "all" {
+				n, err = p.macro(name, n)
+			} else {
+				n, err = p.call(name, n)
+			}
+			if err != nil {
+				return nil, err
+			}
+		case p.accept("["):
+			index, err := p.conditional()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			n = &exprIndex{operand: n, index: index}
+		default:
+			return n, nil
+		}
+	}
+}
+
+var exprIdentifier = regexp.MustCompile(`^[_a-zA-Z][_a-zA-Z0-9]*$`)
+
+func (p *exprParser) primary() (exprNode, error) {
+	if p.pos == len(p.tokens) {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+	switch {
+	case t.lit:
+		return &exprLiteral{value: t.value}, nil
+	case t.text == "(":
+		n, err := p.conditional()
+		if err != nil {
+			return nil, err
+		}
+		return n, p.expect(")")
+	case t.text == "[":
+		list := &exprList{}
+		for !p.accept("]") {
+			if len(list.elems) > 0 {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+			elem, err := p.conditional()
+			if err != nil {
+				return nil, err
+			}
+			list.elems = append(list.elems, elem)
+		}
+		return list, nil
+	case t.text == "true" || t.text == "false":
+		return &exprLiteral{value: t.text == "true"}, nil
+	case t.text == "null":
+		return &exprLiteral{}, nil
+	case t.text == "has" && p.accept("("):
+		arg, err := p.member()
+		if err != nil {
+			return nil, err
+		}
+		sel, ok := arg.(*exprSelect)
+		if !ok {
+			return nil, fmt.Errorf("has() needs a field selection such as claims.department")
+		}
+		return &exprHas{sel: sel}, p.expect(")")
+	case t.text == "size" && p.accept("("):
+		return p.call("size", nil)
+	case exprIdentifier.MatchString(t.text) && t.text != "in":
+		if !p.scope[t.text] {
+			return nil, fmt.Errorf("undeclared reference to %q", t.text)
+		}
+		return &exprIdent{name: t.text}, nil
+	}
+	return nil, fmt.Errorf("unexpected %q", t.text)
+}
+
+// exprFunctions are the functions, called as methods unless noted, and their
+// number of arguments besides the target
+var exprFunctions = map[string]int{
+	"startsWith": 1,
+	"endsWith":   1,
+	"contains":   1,
+	"matches":    1,
+	"lowerAscii": 0,
+	"upperAscii": 0,
+	// size is also a global function
+	"size": 0,
+}
+
+// call parses the arguments of a function, the opening parenthesis already
+// consumed
+func (p *exprParser) call(name string, target exprNode) (exprNode, error) {
+	arity, ok := exprFunctions[name]
+	if !ok {
+		return nil, fmt.Errorf("undeclared function %q", name)
+	}
+	c := &exprCall{function: name, target: target}
+	for !p.accept(")") {
+		if len(c.args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.conditional()
+		if err != nil {
+			return nil, err
+		}
+		c.args = append(c.args, arg)
+	}
+	if target == nil {
+		// a global function takes its target as the first argument
+		if len(c.args) != arity+1 {
+			return nil, fmt.Errorf("%s() takes %d argument(s)", name, arity+1)
+		}
+		c.target, c.args = c.args[0], c.args[1:]
+	} else if len(c.args) != arity {
+		return nil, fmt.Errorf("%s() takes %d argument(s)", name, arity)
+	}
+	if name == "matches" {
+		if lit, ok := c.args[0].(*exprLiteral); ok {
+			pattern, isString := lit.value.(string)
+			if !isString {
+				return nil, fmt.Errorf("matches() needs a string pattern")
+			}
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %s", pattern, err)
+			}
+			c.pattern = re
+		}
+	}
+	return c, nil
+}
+
+// macro parses the variable and predicate of exists or all, the opening
+// parenthesis already consumed
+func (p *exprParser) macro(name string, target exprNode) (exprNode, error) {
+	v, ok := p.identifier()
+	if !ok {
+		return nil, fmt.Errorf("%s() needs a variable name, got %q", name, p.peek())
+	}
+	if err := p.expect(","); err != nil {
+		return nil, err
+	}
+	shadowed := p.scope[v]
+	p.scope[v] = true
+	body, err := p.conditional()
+	p.scope[v] = shadowed
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	return &exprMacro{name: name, target: target, variable: v, body: body}, nil
+}
+
+type exprLiteral struct {
+	value interface{}
+}
+
+func (n *exprLiteral) eval(vars exprVars) (interface{}, error) {
+	return n.value, nil
+}
+
+type exprIdent struct {
+	name string
+}
+
+func (n *exprIdent) eval(vars exprVars) (interface{}, error) {
+	v, ok := vars[n.name]
+	if !ok {
+		return nil, fmt.Errorf("no such variable %q", n.name)
+	}
+	return v, nil
+}
+
+type exprList struct {
+	elems []exprNode
+}
+
+func (n *exprList) eval(vars exprVars) (interface{}, error) {
+	list := make([]interface{}, len(n.elems))
+	for i, e := range n.elems {
+		v, err := e.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		list[i] = v
+	}
+	return list, nil
+}
+
+type exprSelect struct {
+	operand exprNode
+	field   string
+}
+
+func (n *exprSelect) eval(vars exprVars) (interface{}, error) {
+	m, err := n.object(vars)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := m[n.field]
+	if !ok {
+		return nil, fmt.Errorf("no such key %q", n.field)
+	}
+	return v, nil
+}
+
+func (n *exprSelect) object(vars exprVars) (map[string]interface{}, error) {
+	v, err := n.operand.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cannot select field %q of %s", n.field, exprTypeName(v))
+	}
+	return m, nil
+}
+
+type exprHas struct {
+	sel *exprSelect
+}
+
+func (n *exprHas) eval(vars exprVars) (interface{}, error) {
+	m, err := n.sel.object(vars)
+	if err != nil {
+		return nil, err
+	}
+	_, ok := m[n.sel.field]
+	return ok, nil
+}
+
+type exprIndex struct {
+	operand, index exprNode
+}
+
+func (n *exprIndex) eval(vars exprVars) (interface{}, error) {
+	v, err := n.operand.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	index, err := n.index.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		key, ok := index.(string)
+		if !ok {
+			return nil, fmt.Errorf("map keys are strings, got %s", exprTypeName(index))
+		}
+		value, ok := v[key]
+		if !ok {
+			return nil, fmt.Errorf("no such key %q", key)
+		}
+		return value, nil
+	case []interface{}:
+		i, ok := index.(int64)
+		if !ok {
+			return nil, fmt.Errorf("list indexes are ints, got %s", exprTypeName(index))
+		}
+		if i < 0 || i >= int64(len(v)) {
+			return nil, fmt.Errorf("index %d out of range", i)
+		}
+		return v[i], nil
+	}
+	return nil, fmt.Errorf("cannot index %s", exprTypeName(v))
+}
+
+type exprUnary struct {
+	op      string
+	operand exprNode
+}
+
+func (n *exprUnary) eval(vars exprVars) (interface{}, error) {
+	v, err := n.operand.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	switch v := v.(type) {
+	case bool:
+		if n.op == "!" {
+			return !v, nil
+		}
+	case int64:
+		if n.op == "-" {
+			return -v, nil
+		}
+	case float64:
+		if n.op == "-" {
+			return -v, nil
+		}
+	}
+	return nil, fmt.Errorf("no such overload %s%s", n.op, exprTypeName(v))
+}
+
+type exprConditional struct {
+	cond, then, els exprNode
+}
+
+func (n *exprConditional) eval(vars exprVars) (interface{}, error) {
+	v, err := n.cond.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return nil, fmt.Errorf("condition of ?: must be a bool, got %s", exprTypeName(v))
+	}
+	if b {
+		return n.then.eval(vars)
+	}
+	return n.els.eval(vars)
+}
+
+type exprBinary struct {
+	op          string
+	left, right exprNode
+}
+
+func (n *exprBinary) eval(vars exprVars) (interface{}, error) {
+	if n.op == "&&" || n.op == "||" {
+		return n.logical(vars)
+	}
+	left, err := n.left.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "==":
+		return exprEqual(left, right), nil
+	case "!=":
+		return !exprEqual(left, right), nil
+	case "in":
+		return exprIn(left, right)
+	case "<", "<=", ">", ">=":
+		return exprCompare(n.op, left, right)
+	}
+	return exprArithmetic(n.op, left, right)
+}
+
+// logical evaluates && and || so that an error on one side is ignored if the
+// other side decides the result
+func (n *exprBinary) logical(vars exprVars) (interface{}, error) {
+	decisive := n.op == "||"
+	left, leftErr := exprBool(n.left.eval(vars))
+	if leftErr == nil && left == decisive {
+		return decisive, nil
+	}
+	right, rightErr := exprBool(n.right.eval(vars))
+	if rightErr == nil && right == decisive {
+		return decisive, nil
+	}
+	if leftErr != nil {
+		return nil, leftErr
+	}
+	if rightErr != nil {
+		return nil, rightErr
+	}
+	return !decisive, nil
+}
+
+func exprBool(v interface{}, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("operands of && and || must be bools, got %s", exprTypeName(v))
+	}
+	return b, nil
+}
+
+type exprCall struct {
+	function string
+	target   exprNode
+	args     []exprNode
+	pattern  *regexp.Regexp
+}
+
+func (n *exprCall) eval(vars exprVars) (interface{}, error) {
+	target, err := n.target.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	if n.function == "size" {
+		switch t := target.(type) {
+		case string:
+			return int64(len([]rune(t))), nil
+		case []interface{}:
+			return int64(len(t)), nil
+		case map[string]interface{}:
+			return int64(len(t)), nil
+		}
+		return nil, fmt.Errorf("no such overload size(%s)", exprTypeName(target))
+	}
+	s, ok := target.(string)
+	if !ok {
+		return nil, fmt.Errorf("no such overload %s.%s()", exprTypeName(target), n.function)
+	}
+	switch n.function {
+	case "lowerAscii":
+		return strings.ToLower(s), nil
+	case "upperAscii":
+		return strings.ToUpper(s), nil
+	}
+	arg, err := n.args[0].eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	a, ok := arg.(string)
+	if !ok {
+		return nil, fmt.Errorf("no such overload string.%s(%s)", n.function, exprTypeName(arg))
+	}
+	switch n.function {
+	case "startsWith":
+		return strings.HasPrefix(s, a), nil
+	case "endsWith":
+		return strings.HasSuffix(s, a), nil
+	case "contains":
+		return strings.Contains(s, a), nil
+	}
+	re := n.pattern
+	if re == nil {
+		if re, err = regexp.Compile(a); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %s", a, err)
+		}
+	}
+	return re.MatchString(s), nil
+}
+
+type exprMacro struct {
+	name     string
+	target   exprNode
+	variable string
+	body     exprNode
+}
+
+func (n *exprMacro) eval(vars exprVars) (interface{}, error) {
+	target, err := n.target.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	var elems []interface{}
+	switch t := target.(type) {
+	case []interface{}:
+		elems = t
+	case map[string]interface{}:
+		for k := range t {
+			elems = append(elems, k)
+		}
+	default:
+		return nil, fmt.Errorf("no such overload %s.%s()", exprTypeName(target), n.name)
+	}
+	scope := make(exprVars, len(vars)+1)
+	for k, v := range vars {
+		scope[k] = v
+	}
+	decisive := n.name == "exists"
+	var firstErr error
+	for _, e := range elems {
+		scope[n.variable] = e
+		b, err := exprBool(n.body.eval(scope))
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if b == decisive {
+			return decisive, nil
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return !decisive, nil
+}
+
+// exprNumber returns numbers as doubles for comparisons between ints and
+// doubles
+func exprNumber(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+func exprEqual(a, b interface{}) bool {
+	if x, ok := exprNumber(a); ok {
+		y, ok := exprNumber(b)
+		return ok && x == y
+	}
+	switch a := a.(type) {
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !exprEqual(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k, v := range a {
+			if w, ok := b[k]; !ok || !exprEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
+
+func exprIn(elem, container interface{}) (interface{}, error) {
+	switch c := container.(type) {
+	case []interface{}:
+		for _, e := range c {
+			if exprEqual(elem, e) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case map[string]interface{}:
+		key, ok := elem.(string)
+		if !ok {
+			return false, nil
+		}
+		_, ok = c[key]
+		return ok, nil
+	}
+	return nil, fmt.Errorf("no such overload %s in %s", exprTypeName(elem), exprTypeName(container))
+}
+
+func exprCompare(op string, a, b interface{}) (interface{}, error) {
+	var cmp int
+	x, xok := exprNumber(a)
+	y, yok := exprNumber(b)
+	s, sok := a.(string)
+	t, tok := b.(string)
+	switch {
+	case xok && yok:
+		if x < y {
+			cmp = -1
+		} else if x > y {
+			cmp = 1
+		} else {
+			cmp = 0
+		}
+	case sok && tok:
+		cmp = strings.Compare(s, t)
+	default:
+		return nil, fmt.Errorf("no such overload %s %s %s", exprTypeName(a), op, exprTypeName(b))
+	}
+	switch op {
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	}
+	return cmp >= 0, nil
+}
+
+func exprArithmetic(op string, a, b interface{}) (interface{}, error) {
+	switch x := a.(type) {
+	case int64:
+		if y, ok := b.(int64); ok {
+			switch op {
+			case "+":
+				return x + y, nil
+			case "-":
+				return x - y, nil
+			case "*":
+				return x * y, nil
+			case "/", "%":
+				if y == 0 {
+					return nil, fmt.Errorf("division by zero")
+				}
+				if op == "/" {
+					return x / y, nil
+				}
+				return x % y, nil
+			}
+		}
+	case float64:
+		if y, ok := b.(float64); ok {
+			switch op {
+			case "+":
+				return x + y, nil
+			case "-":
+				return x - y, nil
+			case "*":
+				return x * y, nil
+			case "/":
+				return x / y, nil
+			}
+		}
+	case string:
+		if y, ok := b.(string); ok && op == "+" {
+			return x + y, nil
+		}
+	case []interface{}:
+		if y, ok := b.([]interface{}); ok && op == "+" {
+			return append(append([]interface{}{}, x...), y...), nil
+		}
+	}
+	return nil, fmt.Errorf("no such overload %s %s %s", exprTypeName(a), op, exprTypeName(b))
+}
+
+// exprTypeName names the type of a value for error messages
+func exprTypeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "bool"
+	case int64:
+		return "int"
+	case float64:
+		return "double"
+	case string:
+		return "string"
+	case []interface{}:
+		return "list"
+	case map[string]interface{}:
+		return "map"
+	}
+	return fmt.Sprintf("%T", v)
+}
@@ -0,0 +1,129 @@
+package oauthproxy
+
+import (
+	"encoding/base64"
+	"net/http"
+	"os"
+	"testing"
+
+	sessionsapi "github.com/OpusCapita/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExprEval(t *testing.T) {
+	vars := exprVars{
+		"claims": map[string]interface{}{
+			"email":      "jane@example.com",
+			"department": "finance",
+			"level":      int64(3),
+			"groups":     []interface{}{"ops", "finance-readers"},
+			"address":    map[string]interface{}{"country": "FI"},
+		},
+		"request": map[string]interface{}{
+			"method":  "GET",
+			"path":    "/reports/2019",
+			"headers": map[string]interface{}{"x-team": "blue"},
+		},
+	}
+	tests := []struct {
+		expr   string
+		result bool
+	}{
+		{`claims.department == "finance" && request.path.startsWith("/reports")`, true},
+		{`claims.department == 'sales' || request.method != "GET"`, false},
+		{`"ops" in claims.groups && !("admins" in claims.groups)`, true},
+		{`claims.groups.exists(g, g.endsWith("-readers"))`, true},
+		{`claims.groups.all(g, g.size() > 3)`, false},
+		{`claims.level >= 2 && claims.level * 2 + 1 == 7 && claims.level < 3.5`, true},
+		{`size(claims.groups) == 2 && claims.groups[1] == "finance-readers"`, true},
+		{`request.headers["x-team"] == "blue" && claims.address.country in ["FI", "SE"]`, true},
+		{`has(claims.manager) ? claims.manager == "bob" : claims.email.matches("^[a-z]+@example[.]com$")`, true},
+		{`claims.email.upperAscii().contains("EXAMPLE") && [1, 2] + [3] == [1, 2, 3]`, true},
+		// an error is ignored if the other side decides the result
+		{`claims.missing == "x" || true`, true},
+		{`false && claims.missing == "x"`, false},
+	}
+	for _, tt := range tests {
+		p, err := compileExpr(tt.expr)
+		if !assert.NoError(t, err, tt.expr) {
+			continue
+		}
+		result, err := p.Eval(vars)
+		assert.NoError(t, err, tt.expr)
+		assert.Equal(t, tt.result, result, tt.expr)
+	}
+
+	for _, expr := range []string{`claims.missing == "x"`, `claims.level + "x" == "3x"`, `claims.department`, `claims.level / 0 == 1`} {
+		p, err := compileExpr(expr)
+		assert.NoError(t, err, expr)
+		_, err = p.Eval(vars)
+		assert.Error(t, err, expr)
+	}
+}
+
+func TestCompileExprErrors(t *testing.T) {
+	tests := map[string]string{
+		`user == "jane"`:                `undeclared reference to "user"`,
+		`claims.email.lower() == "x"`:   `undeclared function "lower"`,
+		`claims.email.startsWith()`:     `startsWith() takes 1 argument(s)`,
+		`claims.email.matches("(")`:     "invalid pattern \"(\": error parsing regexp: missing closing ): `(`",
+		`claims.groups.exists(1, true)`: `exists() needs a variable name, got "1"`,
+		`claims.email == "x`:            `unterminated string`,
+		`(claims.email == "x"`:          `expected ")", got end of expression`,
+		`claims.email == "x" claims`:    `unexpected "claims"`,
+		`has(claims)`:                   `has() needs a field selection such as claims.department`,
+	}
+	for expr, msg := range tests {
+		_, err := compileExpr(expr)
+		assert.EqualError(t, err, msg, expr)
+	}
+}
+
+func TestNewExprVars(t *testing.T) {
+	claims := base64.RawURLEncoding.EncodeToString([]byte(`{"email": "old@example.com", "department": "finance", "age": 42}`))
+	s := &sessionsapi.SessionState{
+		Email: "jane@example.com", User: "jane", IDToken: "header." + claims + ".signature",
+		Groups: []string{"ops"}, Tenant: "tenant-a"}
+	req, _ := http.NewRequest("GET", "https://app.example.com/reports?year=2019", nil)
+	req.Header.Set("X-Team", "blue")
+	req.Header.Set("Cookie", "secret")
+
+	vars := newExprVars(req, "app.example.com", "GET", "/reports", s)
+	assert.Equal(t, map[string]interface{}{
+		"email": "jane@example.com", "user": "jane", "department": "finance", "age": int64(42),
+		"groups": []interface{}{"ops"}, "tenant": "tenant-a"}, vars["claims"])
+	request := vars["request"].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"x-team": "blue"}, request["headers"])
+	assert.Equal(t, map[string]interface{}{"year": "2019"}, request["query"])
+	assert.Equal(t, "app.example.com", request["host"])
+}
+
+func TestAuthzPolicyConditions(t *testing.T) {
+	path := writeAuthzPolicy(t, `
+rules:
+  - path: /reports/**
+    condition: claims.department == "finance" && request.method == "GET"
+`)
+	defer os.Remove(path)
+
+	opts := NewOptions()
+	opts.CookieSecret = "foobar"
+	opts.DevFakeIdentity = "jane@example.com"
+	opts.AuthzPolicyFile = path
+	assert.NoError(t, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(email string) bool { return true })
+
+	req, _ := http.NewRequest("GET", "/reports/2019", nil)
+	claims := base64.RawURLEncoding.EncodeToString([]byte(`{"department": "finance"}`))
+	finance := &sessionsapi.SessionState{Email: "jane@example.com", IDToken: "header." + claims + ".signature"}
+	assert.True(t, proxy.authorized(req, "GET", "/reports/2019", finance))
+	assert.False(t, proxy.authorized(req, "POST", "/reports/2019", finance))
+	// the claim is missing
+	assert.False(t, proxy.authorized(req, "GET", "/reports/2019", &sessionsapi.SessionState{Email: "john@example.com"}))
+	assert.True(t, proxy.authorized(req, "GET", "/", &sessionsapi.SessionState{Email: "john@example.com"}))
+
+	invalid := writeAuthzPolicy(t, "rules:\n  - path: /reports/**\n    condition: claims.department ==\n")
+	defer os.Remove(invalid)
+	_, err := loadAuthzPolicy(invalid)
+	assert.EqualError(t, err, `rule 1: invalid condition "claims.department ==": unexpected end of expression`)
+}
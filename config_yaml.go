@@ -0,0 +1,276 @@
+package oauthproxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// yamlSection is a section of the YAML config, holding the options listed by
+// their cfg names. The key of an option in the section is its cfg name
+// without the prefix strip, or given as "key=option".
+type yamlSection struct {
+	path    string
+	strip   string
+	options []string
+}
+
+// yamlSections lay out every option of the legacy config in the YAML config
+var yamlSections = []yamlSection{
+	{"", "", []string{"upstreams"}},
+	{"server", "", []string{"http_address", "https_address", "socket_file_mode", "force_https", "http2", "h2c",
+		"http2_max_concurrent_streams", "hsts_max_age", "shutdown_timeout", "watch_config", "ext_authz_address", "gcp_healthchecks",
+		"trusted_real_ip_cidrs", "custom_templates_dir", "footer"}},
+	{"server.tls", "tls_", []string{"tls_cert_file", "tls_key_file", "tls_cert_pairs", "tls_cert_dir", "tls_min_version",
+		"tls_cipher_suites", "tls_curves"}},
+	{"server.acme", "acme_", []string{"acme_domains", "acme_cache_dir", "acme_email", "acme_directory_url"}},
+	{"vault", "vault_", []string{"vault_address", "vault_token", "vault_kubernetes_role", "vault_kubernetes_mount",
+		"vault_client_secret", "vault_cookie_secret", "vault_pki_role", "vault_pki_common_name", "vault_pki_ttl"}},
+	{"aws", "aws_", []string{"aws_region", "aws_endpoint_url", "aws_client_secret", "aws_cookie_secret",
+		"aws_secrets_refresh_interval"}},
+	{"provider", "", []string{"type=provider", "plugins=provider_plugins", "client_id", "client_secret", "client_secret_file", "redirect_url", "login_url", "redeem_url",
+		"profile_url", "validate_url", "resource", "scope", "approval_prompt", "acr_values", "skip_provider_button",
+		"azure_tenant", "github_org", "github_team", "jwt_key", "jwt_key_file", "pubjwk_url", "token_exchange_url"}},
+	{"provider.oidc", "oidc_", []string{"oidc_issuer_url", "skip_discovery=skip_oidc_discovery", "oidc_jwks_url"}},
+	{"provider.google", "google_", []string{"google_group", "google_admin_email", "google_service_account_json"}},
+	{"proxy", "", []string{"prefix=proxy-prefix", "upstream_regexes", "proxy_websockets", "pass_basic_auth", "basic_auth_password",
+		"pass_access_token", "pass_access_token_header", "pass_access_token_format", "pass_host_header",
+		"pass_user_headers", "pass_authorization_header", "pass_id_token", "set_xauthrequest", "set_authorization_header",
+		"pass_groups_header", "groups_header_delimiter", "groups_header_max_size", "signature_key", "preserve_fragment",
+		"ssl_insecure_skip_verify", "flush_interval", "flush_immediately_types", "max_request_body_size",
+		"compress_responses", "compress_types", "compress_min_size", "upstream_health_check_interval",
+		"upstream_health_check_timeout", "response_headers", "strip_request_headers", "set_request_headers",
+		"strip_authorization_header"}},
+	{"proxy.upstream_jwt", "upstream_jwt_", []string{"upstream_jwt_key_file", "upstream_jwt_header", "upstream_jwt_issuer",
+		"upstream_jwt_ttl"}},
+	{"proxy.cors", "cors_", []string{"cors_allowed_origins", "cors_allowed_headers", "cors_allow_credentials",
+		"cors_answer_preflight"}},
+	{"proxy.forward_auth", "forward_auth_", []string{"enabled=forward_auth", "forward_auth_user_header",
+		"forward_auth_email_header"}},
+	{"policies", "", []string{"email_domains", "whitelist_domains", "sign_out_redirect_whitelist", "redirect_whitelist",
+		"authenticated_emails_file", "authenticated_emails_file_poll_interval", "denied_users_file", "required_groups",
+		"skip_auth_regex", "skip_auth_preflight", "unauthenticated_routes", "api_routes", "step_up_routes", "trusted_ips",
+		"rate_limit", "rate_limit_routes", "authz_policy_file", "authz_policy_dry_run", "kube_proxy_policies",
+		"kube_proxy_policy_namespace", "skip_jwt_bearer_tokens", "extra_jwt_issuers"}},
+	{"policies.opa", "opa_", []string{"opa_url", "opa_timeout"}},
+	{"maintenance", "maintenance_", []string{"maintenance_mode", "maintenance_paths", "maintenance_allowed_emails", "maintenance_allowed_groups"}},
+	{"sessions", "session_store_", []string{"session_store_type"}},
+	{"sessions.cookie", "cookie_", []string{"cookie_name", "cookie_secret", "cookie_secret_file", "cookie_domain", "cookie_path", "cookie_expire",
+		"cookie_refresh", "cookie_secure", "cookie_httponly"}},
+	{"sessions.redis", "redis_", []string{"redis_connection_url", "redis_use_sentinel", "redis_sentinel_master_name",
+		"redis_sentinel_connection_urls", "redis_leader_lease"}},
+	{"htpasswd", "htpasswd_", []string{"htpasswd_file", "display_form=display_htpasswd_form", "htpasswd_totp_file",
+		"htpasswd_failure_delay"}},
+	{"webauthn", "webauthn_", []string{"webauthn_rp_id", "webauthn_origin", "webauthn_credentials_file"}},
+	{"sso", "sso_", []string{"sso_url", "sso_allowed_domains", "sso_secret", "sso_secret_file"}},
+	{"development", "dev_", []string{"dev_fake_identity", "dev_fake_groups"}},
+	{"logging", "logging_", []string{"logging_filename", "logging_max_size", "logging_max_age", "logging_max_backups",
+		"logging_local_time", "logging_compress", "logging_rotate_interval", "logging_exclude_paths",
+		"logging_exclude_status", "logging_redact_pii"}},
+	{"logging.standard", "standard_logging_", []string{"enabled=standard_logging", "standard_logging_format",
+		"standard_logging_filename"}},
+	{"logging.request", "request_logging_", []string{"enabled=request_logging", "request_logging_format",
+		"request_logging_filename", "request_logging_sample_ratio", "request_logging_sample_limit"}},
+	{"logging.auth", "auth_logging_", []string{"enabled=auth_logging", "auth_logging_format", "auth_logging_filename"}},
+	{"logging.syslog", "syslog_", []string{"syslog_address", "syslog_facility", "syslog_tag", "syslog_ca_file"}},
+	{"tracing", "tracing_", []string{"tracing_otlp_endpoint", "tracing_service_name", "tracing_sample_ratio",
+		"headers=trace_headers"}},
+	{"audit", "audit_", []string{"audit_log_filename", "audit_webhook_url", "audit_kafka_rest_url"}},
+	{"metrics", "metrics_", []string{"enabled=metrics", "metrics_address"}},
+	{"error_reporting", "", []string{"sentry_dsn", "sentry_environment", "webhook_url=error_webhook_url"}},
+	{"failure_alerts", "failure_webhook_", []string{"failure_webhook_url", "failure_webhook_threshold",
+		"failure_webhook_window"}},
+	{"debug", "debug_", []string{"debug_address", "debug_htpasswd_file"}},
+}
+
+// yamlSchema is the layout of the YAML config: the sections, and the cfg
+// name and type of the option at every path, e.g. sessions.cookie.name
+type yamlSchema struct {
+	sections map[string]bool
+	options  map[string]string
+	types    map[string]reflect.Type
+}
+
+func newYAMLSchema() *yamlSchema {
+	s := &yamlSchema{
+		sections: map[string]bool{},
+		options:  map[string]string{},
+		types:    cfgTypes(reflect.TypeOf(Options{}), map[string]reflect.Type{}),
+	}
+	for _, section := range yamlSections {
+		s.sections[section.path] = true
+		for _, option := range section.options {
+			key := strings.TrimPrefix(option, section.strip)
+			if i := strings.Index(option, "="); i >= 0 {
+				key, option = option[:i], option[i+1:]
+			}
+			path := key
+			if section.path != "" {
+				path = section.path + "." + key
+			}
+			s.options[path] = option
+		}
+	}
+	return s
+}
+
+// cfgTypes collects the types of the options of the struct type by their cfg
+// names, including those of embedded structs
+func cfgTypes(typ reflect.Type, types map[string]reflect.Type) map[string]reflect.Type {
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			cfgTypes(field.Type, types)
+			continue
+		}
+		if name := field.Tag.Get("cfg"); name != "" {
+			types[name] = field.Type
+		}
+	}
+	return types
+}
+
+// isYAMLConfig returns whether the config file is in the YAML format
+func isYAMLConfig(filename string) bool {
+	ext := strings.ToLower(filepath.Ext(filename))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// loadYAMLConfig loads a YAML config file into the legacy config options.
+// All the errors of the file are reported together.
+func loadYAMLConfig(filename string) (EnvOptions, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var root map[interface{}]interface{}
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	cfg := make(EnvOptions)
+	errs := newYAMLSchema().load("", root, cfg, nil)
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return nil, fmt.Errorf("invalid configuration:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return cfg, nil
+}
+
+func (s *yamlSchema) load(section string, m map[interface{}]interface{}, cfg EnvOptions, errs []string) []string {
+	for k, value := range m {
+		key := fmt.Sprint(k)
+		path := key
+		if section != "" {
+			path = section + "." + key
+		}
+		if s.sections[path] {
+			if value == nil {
+				continue
+			}
+			sub, ok := value.(map[interface{}]interface{})
+			if !ok {
+				errs = append(errs, fmt.Sprintf("%s: expected a section of options", path))
+				continue
+			}
+			errs = s.load(path, sub, cfg, errs)
+			continue
+		}
+		option, ok := s.options[path]
+		if !ok {
+			errs = append(errs, fmt.Sprintf("%s: unknown option%s", path, s.suggest(key)))
+			continue
+		}
+		if value == nil {
+			// an empty value leaves the option unset
+			continue
+		}
+		v, err := yamlValue(value, s.types[option])
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", path, err))
+			continue
+		}
+		cfg[option] = v
+	}
+	return errs
+}
+
+// suggest points to the path of an option of the legacy config, or with the
+// same key in another section
+func (s *yamlSchema) suggest(key string) string {
+	var paths []string
+	for path, option := range s.options {
+		if option == key || strings.HasSuffix(path, "."+key) {
+			paths = append(paths, path)
+		}
+	}
+	if len(paths) == 0 {
+		return ""
+	}
+	sort.Strings(paths)
+	return fmt.Sprintf(", did you mean %s?", strings.Join(paths, " or "))
+}
+
+// yamlValue checks a YAML value against the type of its option and converts
+// it to the type of the legacy config
+func yamlValue(value interface{}, typ reflect.Type) (interface{}, error) {
+	if typ == reflect.TypeOf(time.Duration(0)) {
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected a duration such as 1h30m, got %v", value)
+		}
+		if _, err := time.ParseDuration(s); err != nil {
+			return nil, fmt.Errorf("expected a duration such as 1h30m, got %q", s)
+		}
+		return s, nil
+	}
+	switch typ.Kind() {
+	case reflect.Bool:
+		if b, ok := value.(bool); ok {
+			return b, nil
+		}
+		return nil, fmt.Errorf("expected true or false, got %v", value)
+	case reflect.Int, reflect.Int64:
+		if i, ok := value.(int); ok {
+			return int64(i), nil
+		}
+		return nil, fmt.Errorf("expected an integer, got %v", value)
+	case reflect.Float64:
+		switch f := value.(type) {
+		case float64:
+			return f, nil
+		case int:
+			return float64(f), nil
+		}
+		return nil, fmt.Errorf("expected a number, got %v", value)
+	case reflect.String:
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+		return nil, fmt.Errorf("expected a string, got %v (quote values such as 0660)", value)
+	case reflect.Slice:
+		if s, ok := value.(string); ok {
+			return []interface{}{s}, nil
+		}
+		list, ok := value.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected a list, got %v", value)
+		}
+		var values []interface{}
+		for _, v := range list {
+			switch v.(type) {
+			case string, int, float64, bool:
+				values = append(values, fmt.Sprint(v))
+			default:
+				return nil, fmt.Errorf("expected a list of strings, got %v", v)
+			}
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("unsupported option type %s", typ)
+}
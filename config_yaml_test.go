@@ -0,0 +1,123 @@
+package oauthproxy
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeYAMLConfig(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "oauth2_proxy*.yaml")
+	assert.NoError(t, err)
+	f.WriteString(content)
+	f.Close()
+	return f.Name()
+}
+
+func TestYAMLSchemaCoversAllOptions(t *testing.T) {
+	s := newYAMLSchema()
+	paths := map[string]string{}
+	for path, option := range s.options {
+		assert.Contains(t, s.types, option, "unknown option %s at %s", option, path)
+		assert.Empty(t, paths[option], "%s is at %s and %s", option, paths[option], path)
+		paths[option] = path
+	}
+	for option := range s.types {
+		assert.NotEmpty(t, paths[option], "%s is missing from the YAML config", option)
+	}
+}
+
+func TestLoadYAMLConfig(t *testing.T) {
+	filename := writeYAMLConfig(t, `
+upstreams:
+  - http://127.0.0.1:8080/
+provider:
+  type: oidc
+  client_id: "12345"
+  oidc:
+    issuer_url: https://accounts.example.com
+sessions:
+  type: redis
+  cookie:
+    secret: secretthirtytwobytes+abcdefghijk
+    expire: 12h
+    secure: true
+  redis:
+    connection_url: redis://redis:6379
+policies:
+  email_domains: example.com
+logging:
+  exclude_status: [304, 2xx]
+  request:
+    sample_ratio: 0.5
+failure_alerts:
+  threshold: 5
+metrics:
+`)
+	defer os.Remove(filename)
+
+	cfg, err := loadYAMLConfig(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, EnvOptions{
+		"upstreams":                    []interface{}{"http://127.0.0.1:8080/"},
+		"provider":                     "oidc",
+		"client_id":                    "12345",
+		"oidc_issuer_url":              "https://accounts.example.com",
+		"session_store_type":           "redis",
+		"cookie_secret":                "secretthirtytwobytes+abcdefghijk",
+		"cookie_expire":                "12h",
+		"cookie_secure":                true,
+		"redis_connection_url":         "redis://redis:6379",
+		"email_domains":                []interface{}{"example.com"},
+		"logging_exclude_status":       []interface{}{"304", "2xx"},
+		"request_logging_sample_ratio": 0.5,
+		"failure_webhook_threshold":    int64(5),
+	}, cfg)
+}
+
+func TestLoadYAMLConfigErrors(t *testing.T) {
+	filename := writeYAMLConfig(t, `
+provider:
+  client_id: 12345
+  issuer_url: https://accounts.example.com
+sessions:
+  cookie:
+    expire: 12
+    secure: "yes"
+    nmae: _proxy
+server: :4180
+failure_alerts:
+  threshold: ten
+`)
+	defer os.Remove(filename)
+
+	_, err := loadYAMLConfig(filename)
+	assert.EqualError(t, err, `invalid configuration:
+  failure_alerts.threshold: expected an integer, got ten
+  provider.client_id: expected a string, got 12345 (quote values such as 0660)
+  provider.issuer_url: unknown option, did you mean provider.oidc.issuer_url?
+  server: expected a section of options
+  sessions.cookie.expire: expected a duration such as 1h30m, got 12
+  sessions.cookie.nmae: unknown option
+  sessions.cookie.secure: expected true or false, got yes`)
+}
+
+func TestYAMLValueTypes(t *testing.T) {
+	v, err := yamlValue("1m", reflect.TypeOf(NewOptions().OPATimeout))
+	assert.NoError(t, err)
+	assert.Equal(t, "1m", v)
+	_, err = yamlValue([]interface{}{map[interface{}]interface{}{"a": 1}}, reflect.TypeOf([]string{}))
+	assert.Error(t, err)
+	assert.True(t, isYAMLConfig("/etc/oauth2_proxy.YML"))
+	assert.False(t, isYAMLConfig("/etc/oauth2_proxy.cfg"))
+}
+
+func TestLoadYAMLConfigExample(t *testing.T) {
+	cfg, err := loadYAMLConfig("contrib/oauth2_proxy.yaml.example")
+	assert.NoError(t, err)
+	assert.Equal(t, "oidc", cfg["provider"])
+	assert.Equal(t, "168h", cfg["cookie_expire"])
+}
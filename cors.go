@@ -0,0 +1,101 @@
+package oauthproxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// upstreamCORSMethods are allowed by answers to preflight requests for the
+// upstreams
+const upstreamCORSMethods = "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS"
+
+// corsPolicy is the cross-origin resource sharing configuration of the
+// endpoints single page applications query the session state with
+type corsPolicy struct {
+	origins     []string
+	headers     string
+	credentials bool
+	// upstreamPreflight is set when preflight requests for the upstreams are
+	// answered by the proxy, as browsers don't send cookies with them
+	upstreamPreflight bool
+}
+
+// newCORSPolicy returns the CORS policy of opts, or nil if no origins are
+// allowed
+func newCORSPolicy(opts *Options) *corsPolicy {
+	if len(opts.CORSAllowedOrigins) == 0 {
+		return nil
+	}
+	return &corsPolicy{
+		origins:     opts.CORSAllowedOrigins,
+		headers:     strings.Join(opts.CORSAllowedHeaders, ", "),
+		credentials: opts.CORSAllowCredentials,
+
+		upstreamPreflight: opts.CORSAnswerPreflight,
+	}
+}
+
+// allowedOrigin returns the Access-Control-Allow-Origin value for origin, or
+// "" if it is not allowed
+func (c *corsPolicy) allowedOrigin(origin string) string {
+	for _, allowed := range c.origins {
+		if allowed == "*" {
+			return "*"
+		}
+		if strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// isCORSPath returns whether the CORS policy applies to path
+func (p *OAuthProxy) isCORSPath(path string) bool {
+	return path == p.UserInfoPath || path == p.RefreshPath || path == p.AuthOnlyPath || path == p.SignOutPath
+}
+
+// isPreflight returns whether req is a CORS preflight request
+func isPreflight(req *http.Request) bool {
+	return req.Method == http.MethodOptions && req.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// handleCORS adds the CORS headers to responses to requests from allowed
+// origins and answers preflight requests. It returns true when the request
+// has been handled.
+func (p *OAuthProxy) handleCORS(rw http.ResponseWriter, req *http.Request) bool {
+	if p.cors == nil {
+		return false
+	}
+	upstream := !strings.HasPrefix(req.URL.Path, p.ProxyPrefix)
+	if !p.isCORSPath(req.URL.Path) && !(upstream && p.cors.upstreamPreflight && isPreflight(req)) {
+		return false
+	}
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	rw.Header().Add("Vary", "Origin")
+	allowed := p.cors.allowedOrigin(origin)
+	if allowed == "" {
+		return false
+	}
+	rw.Header().Set("Access-Control-Allow-Origin", allowed)
+	if p.cors.credentials {
+		rw.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	if !isPreflight(req) {
+		return false
+	}
+	if upstream {
+		rw.Header().Set("Access-Control-Allow-Methods", upstreamCORSMethods)
+	} else {
+		rw.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	}
+	if p.cors.headers != "" {
+		rw.Header().Set("Access-Control-Allow-Headers", p.cors.headers)
+	}
+	rw.Header().Set("Access-Control-Max-Age", "600")
+	rw.WriteHeader(http.StatusNoContent)
+	return true
+}
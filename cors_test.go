@@ -0,0 +1,112 @@
+package oauthproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newCORSTestProxy(t *testing.T, modify func(*Options)) *OAuthProxy {
+	opts := NewOptions()
+	opts.CookieSecret = "foobar"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "xyzzyplugh"
+	opts.EmailDomains = []string{"*"}
+	modify(opts)
+	assert.NoError(t, opts.Validate())
+	return NewOAuthProxy(opts, func(email string) bool { return true })
+}
+
+func TestCORSPreflight(t *testing.T) {
+	proxy := newCORSTestProxy(t, func(opts *Options) {
+		opts.CORSAllowedOrigins = []string{"https://app.example.com"}
+		opts.CORSAllowedHeaders = []string{"X-Requested-With"}
+		opts.CORSAllowCredentials = true
+	})
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodOptions, "/oauth2/userinfo", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusNoContent, rw.Code)
+	assert.Equal(t, "https://app.example.com", rw.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", rw.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, "X-Requested-With", rw.Header().Get("Access-Control-Allow-Headers"))
+}
+
+func TestCORSRequest(t *testing.T) {
+	proxy := newCORSTestProxy(t, func(opts *Options) {
+		opts.CORSAllowedOrigins = []string{"https://app.example.com"}
+	})
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/oauth2/userinfo", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+	assert.Equal(t, "https://app.example.com", rw.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "", rw.Header().Get("Access-Control-Allow-Credentials"))
+
+	rw = httptest.NewRecorder()
+	req.Header.Set("Origin", "https://evil.example.com")
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, "", rw.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "Origin", rw.Header().Get("Vary"))
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/oauth2/sign_in", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, "", rw.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestCORSWildcardWithCredentials(t *testing.T) {
+	opts := NewOptions()
+	opts.CookieSecret = "foobar"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "xyzzyplugh"
+	opts.CORSAllowedOrigins = []string{"*"}
+	opts.CORSAllowCredentials = true
+	err := opts.Validate()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "cors-allowed-origin=* cannot be combined with cors-allow-credentials")
+}
+
+func TestCORSUpstreamPreflight(t *testing.T) {
+	proxy := newCORSTestProxy(t, func(opts *Options) {
+		opts.CORSAllowedOrigins = []string{"https://app.example.com"}
+		opts.CORSAllowedHeaders = []string{"Content-Type"}
+		opts.CORSAllowCredentials = true
+		opts.CORSAnswerPreflight = true
+	})
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodOptions, "/api/items", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", "PUT")
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusNoContent, rw.Code)
+	assert.Equal(t, "https://app.example.com", rw.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, upstreamCORSMethods, rw.Header().Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "Content-Type", rw.Header().Get("Access-Control-Allow-Headers"))
+
+	// other requests to the upstreams still need authentication
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPut, "/api/items", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("X-Requested-With", "XMLHttpRequest")
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+	assert.Equal(t, "", rw.Header().Get("Access-Control-Allow-Origin"))
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodOptions, "/api/items", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	req.Header.Set("Access-Control-Request-Method", "PUT")
+	req.Header.Set("X-Requested-With", "XMLHttpRequest")
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+}
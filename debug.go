@@ -0,0 +1,120 @@
+package oauthproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+
+	"github.com/OpusCapita/oauth2_proxy/logger"
+)
+
+// startTime is when the proxy started, for the uptime of the runtime stats
+var startTime = time.Now()
+
+// runtimeStats are the runtime statistics served by the debug endpoint
+type runtimeStats struct {
+	GoVersion     string  `json:"go_version"`
+	Version       string  `json:"version"`
+	Uptime        string  `json:"uptime"`
+	NumCPU        int     `json:"num_cpu"`
+	GOMAXPROCS    int     `json:"gomaxprocs"`
+	Goroutines    int     `json:"goroutines"`
+	HeapAlloc     uint64  `json:"heap_alloc_bytes"`
+	HeapSys       uint64  `json:"heap_sys_bytes"`
+	HeapObjects   uint64  `json:"heap_objects"`
+	TotalAlloc    uint64  `json:"total_alloc_bytes"`
+	Sys           uint64  `json:"sys_bytes"`
+	NumGC         uint32  `json:"num_gc"`
+	LastGC        string  `json:"last_gc,omitempty"`
+	PauseTotal    string  `json:"gc_pause_total"`
+	GCCPUFraction float64 `json:"gc_cpu_fraction"`
+}
+
+// parseDebug sets up the pprof and runtime stats handler of the debug-address.
+// It must be a loopback address unless a debug-htpasswd-file protects it.
+func parseDebug(o *Options, msgs []string) (http.Handler, []string) {
+	if o.DebugAddress == "" {
+		return nil, msgs
+	}
+	host, _, err := net.SplitHostPort(o.DebugAddress)
+	if err != nil {
+		return nil, append(msgs, fmt.Sprintf("invalid debug-address %q: %s", o.DebugAddress, err))
+	}
+	var htpasswd *HtpasswdFile
+	if o.DebugHtpasswdFile != "" {
+		if htpasswd, err = NewHtpasswdFromFile(o.DebugHtpasswdFile); err != nil {
+			return nil, append(msgs, fmt.Sprintf("invalid debug-htpasswd-file: %s", err))
+		}
+	} else if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, append(msgs, fmt.Sprintf("debug-address %q must be a loopback address, e.g. 127.0.0.1:6060, unless debug-htpasswd-file is set", o.DebugAddress))
+	}
+	return newDebugHandler(htpasswd), msgs
+}
+
+// newDebugHandler serves the pprof profiles on /debug/pprof/ and the runtime
+// stats on /debug/runtime, requiring basic auth if htpasswd is set
+func newDebugHandler(htpasswd *HtpasswdFile) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/runtime", serveRuntimeStats)
+	if htpasswd == nil {
+		return mux
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		user, password, ok := req.BasicAuth()
+		if !ok || !htpasswd.Validate(user, password) {
+			rw.Header().Set("WWW-Authenticate", `Basic realm="oauth2_proxy debug"`)
+			http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(rw, req)
+	})
+}
+
+func serveRuntimeStats(rw http.ResponseWriter, req *http.Request) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	stats := runtimeStats{
+		GoVersion:     runtime.Version(),
+		Version:       VERSION,
+		Uptime:        time.Since(startTime).Round(time.Second).String(),
+		NumCPU:        runtime.NumCPU(),
+		GOMAXPROCS:    runtime.GOMAXPROCS(0),
+		Goroutines:    runtime.NumGoroutine(),
+		HeapAlloc:     m.HeapAlloc,
+		HeapSys:       m.HeapSys,
+		HeapObjects:   m.HeapObjects,
+		TotalAlloc:    m.TotalAlloc,
+		Sys:           m.Sys,
+		NumGC:         m.NumGC,
+		PauseTotal:    time.Duration(m.PauseTotalNs).String(),
+		GCCPUFraction: m.GCCPUFraction,
+	}
+	if m.LastGC != 0 {
+		stats.LastGC = time.Unix(0, int64(m.LastGC)).UTC().Format(time.RFC3339)
+	}
+	rw.Header().Set("Content-Type", applicationJSON)
+	json.NewEncoder(rw).Encode(stats)
+}
+
+// serveDebug serves the debug endpoints on their own address
+func serveDebug(addr string, h http.Handler) {
+	ln, err := sockets.listen("debug", "tcp", addr)
+	if err != nil {
+		logger.Fatalf("FATAL: debug listen (%s) failed - %s", addr, err)
+	}
+	logger.Printf("debug: listening on %s", ln.Addr())
+
+	// no write timeout, as CPU profiles and traces take a while
+	if err := http.Serve(ln, h); err != nil {
+		logger.Printf("ERROR: debug Serve() - %s", err)
+	}
+}
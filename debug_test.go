@@ -0,0 +1,59 @@
+package oauthproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDebug(t *testing.T) {
+	o := testOptions()
+	h, msgs := parseDebug(o, nil)
+	assert.Nil(t, h)
+	assert.Empty(t, msgs)
+
+	for _, addr := range []string{"127.0.0.1:6060", "[::1]:6060", "localhost:6060"} {
+		o.DebugAddress = addr
+		h, msgs = parseDebug(o, nil)
+		assert.NotNil(t, h)
+		assert.Empty(t, msgs)
+	}
+
+	o.DebugAddress = ":6060"
+	_, msgs = parseDebug(o, nil)
+	assert.Equal(t, []string{`debug-address ":6060" must be a loopback address, e.g. 127.0.0.1:6060, unless debug-htpasswd-file is set`}, msgs)
+
+	o.DebugAddress = "127.0.0.1"
+	_, msgs = parseDebug(o, nil)
+	assert.Len(t, msgs, 1)
+}
+
+func TestDebugHandler(t *testing.T) {
+	htpasswd, err := NewHtpasswd(bytes.NewBufferString("testuser:{SHA}PaVBVZkYqAjCQCu6UBL2xgsnZhw=\n"))
+	assert.NoError(t, err)
+	h := newDebugHandler(htpasswd)
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest("GET", "/debug/runtime", nil))
+	assert.Equal(t, 401, rw.Code)
+
+	req := httptest.NewRequest("GET", "/debug/runtime", nil)
+	req.SetBasicAuth("testuser", "asdf")
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	var stats runtimeStats
+	assert.NoError(t, json.Unmarshal(rw.Body.Bytes(), &stats))
+	assert.True(t, stats.Goroutines > 0)
+	assert.True(t, stats.HeapAlloc > 0)
+
+	req = httptest.NewRequest("GET", "/debug/pprof/", nil)
+	req.SetBasicAuth("testuser", "asdf")
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	assert.Contains(t, rw.Body.String(), "goroutine")
+}
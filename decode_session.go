@@ -0,0 +1,127 @@
+package oauthproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/OpusCapita/oauth2_proxy/cookie"
+	"github.com/OpusCapita/oauth2_proxy/pkg/apis/sessions"
+)
+
+// decodedSession is the output of decode-session
+type decodedSession struct {
+	Cookie struct {
+		Name      string    `json:"name"`
+		SignedAt  time.Time `json:"signed_at"`
+		ExpiresAt time.Time `json:"expires_at"`
+		Expired   bool      `json:"expired"`
+	} `json:"cookie"`
+	Session struct {
+		Email        string     `json:"email,omitempty"`
+		User         string     `json:"user,omitempty"`
+		Groups       []string   `json:"groups,omitempty"`
+		ACR          string     `json:"acr,omitempty"`
+		Tenant       string     `json:"tenant,omitempty"`
+		CreatedAt    *time.Time `json:"created_at,omitempty"`
+		ExpiresOn    *time.Time `json:"expires_on,omitempty"`
+		AccessToken  string     `json:"access_token,omitempty"`
+		IDToken      string     `json:"id_token,omitempty"`
+		RefreshToken string     `json:"refresh_token,omitempty"`
+	} `json:"session"`
+	IDTokenClaims map[string]interface{} `json:"id_token_claims,omitempty"`
+}
+
+// decodeSessionCommand decrypts a session cookie and prints the session
+func decodeSessionCommand(args []string) int {
+	flagSet := flag.NewFlagSet("decode-session", flag.ContinueOnError)
+	secret := flagSet.String("cookie-secret", os.Getenv(envPrefix+"COOKIE_SECRET"), "the seed string for secure cookies (default $OAUTH2_PROXY_COOKIE_SECRET)")
+	name := flagSet.String("cookie-name", "_oauth2_proxy", "the name of the session cookie")
+	expire := flagSet.Duration("cookie-expire", 168*time.Hour, "the cookie-expire of the proxy, to tell whether the cookie expired")
+	showTokens := flagSet.Bool("show-tokens", false, "print the access, ID and refresh tokens instead of redacting them")
+	flagSet.Usage = func() {
+		fmt.Fprintf(flagSet.Output(), "Usage: oauth2_proxy decode-session [options] <cookie value>...\n\n"+
+			"The values of a session split over several cookies are given in order.\n\n")
+		flagSet.PrintDefaults()
+	}
+	if err := flagSet.Parse(args); err != nil {
+		return 2
+	}
+	if flagSet.NArg() == 0 || *secret == "" {
+		flagSet.Usage()
+		return 2
+	}
+	value := strings.Join(flagSet.Args(), "")
+	if err := decodeSession(os.Stdout, value, *name, *secret, *expire, *showTokens, time.Now()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// decodeSession checks the signature of a session cookie value, decrypts the
+// session and writes it to w as JSON. The cookie is decoded even if it
+// expired, as that is what was to be debugged.
+func decodeSession(w io.Writer, value, name, secret string, expire time.Duration, showTokens bool, now time.Time) error {
+	// a cookie given as name=value
+	value = strings.TrimPrefix(strings.TrimSpace(value), name+"=")
+	// accept a cookie of any age, whether it expired is reported
+	const anyAge = 100 * 365 * 24 * time.Hour
+	signed, signedAt, ok := cookie.Validate(&http.Cookie{Name: name, Value: value}, secret, anyAge)
+	if !ok {
+		return errors.New("invalid cookie: the signature does not match the cookie-secret and cookie-name")
+	}
+	if strings.HasPrefix(signed, name+"-") {
+		return errors.New("the cookie holds the ticket of a session stored in Redis, only sessions stored in cookies can be decoded")
+	}
+
+	var cipher *cookie.Cipher
+	if key := secretBytes(secret); len(key) == 16 || len(key) == 24 || len(key) == 32 {
+		var err error
+		if cipher, err = cookie.NewCipher(key); err != nil {
+			return err
+		}
+	}
+	session, err := sessions.DecodeSessionState(signed, cipher)
+	if err != nil {
+		return fmt.Errorf("error decoding session: %s", err)
+	}
+
+	var d decodedSession
+	d.Cookie.Name = name
+	d.Cookie.SignedAt = signedAt.UTC()
+	d.Cookie.ExpiresAt = signedAt.Add(expire).UTC()
+	d.Cookie.Expired = !now.Before(d.Cookie.ExpiresAt)
+	s := &d.Session
+	s.Email, s.User, s.Groups, s.ACR, s.Tenant = session.Email, session.User, session.Groups, session.ACR, session.Tenant
+	if !session.CreatedAt.IsZero() {
+		s.CreatedAt = &session.CreatedAt
+	}
+	if !session.ExpiresOn.IsZero() {
+		s.ExpiresOn = &session.ExpiresOn
+	}
+	s.AccessToken = redactToken(session.AccessToken, showTokens)
+	s.IDToken = redactToken(session.IDToken, showTokens)
+	s.RefreshToken = redactToken(session.RefreshToken, showTokens)
+	if session.IDToken != "" {
+		d.IDTokenClaims = idTokenClaims(session.IDToken)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(d)
+}
+
+// redactToken replaces a set token by its length unless it is to be shown
+func redactToken(token string, show bool) string {
+	if token == "" || show {
+		return token
+	}
+	return fmt.Sprintf("(redacted, %d characters)", len(token))
+}
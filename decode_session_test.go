@@ -0,0 +1,64 @@
+package oauthproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/OpusCapita/oauth2_proxy/cookie"
+	"github.com/OpusCapita/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+const testDecodeSecret = "0123456789abcdef0123456789abcdef"
+
+func testSessionCookie(t *testing.T, s *sessions.SessionState, signedAt time.Time) string {
+	cipher, err := cookie.NewCipher(secretBytes(testDecodeSecret))
+	assert.NoError(t, err)
+	value, err := s.EncodeSessionState(cipher)
+	assert.NoError(t, err)
+	return cookie.SignedValue(testDecodeSecret, "_oauth2_proxy", value, signedAt)
+}
+
+func TestDecodeSession(t *testing.T) {
+	now := time.Now()
+	created := now.Add(-2 * time.Hour).Truncate(time.Second)
+	idToken := "eyJhbGciOiJSUzI1NiJ9." + "eyJzdWIiOiIxMjMiLCJlbWFpbCI6ImphbmVAZXhhbXBsZS5jb20ifQ" + ".c2ln"
+	value := testSessionCookie(t, &sessions.SessionState{Email: "jane@example.com", Groups: []string{"admins"},
+		CreatedAt: created, AccessToken: "access-token", IDToken: idToken}, created)
+
+	var buf bytes.Buffer
+	assert.NoError(t, decodeSession(&buf, "_oauth2_proxy="+value, "_oauth2_proxy", testDecodeSecret, time.Hour, false, now))
+	var d decodedSession
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &d))
+	assert.Equal(t, created.Add(time.Hour).UTC(), d.Cookie.ExpiresAt)
+	assert.True(t, d.Cookie.Expired)
+	assert.Equal(t, "jane@example.com", d.Session.Email)
+	assert.Equal(t, "jane@example.com", d.Session.User)
+	assert.Equal(t, []string{"admins"}, d.Session.Groups)
+	assert.True(t, created.Equal(*d.Session.CreatedAt))
+	assert.Equal(t, "(redacted, 12 characters)", d.Session.AccessToken)
+	assert.Equal(t, "123", d.IDTokenClaims["sub"])
+	assert.NotContains(t, buf.String(), "access-token")
+
+	buf.Reset()
+	assert.NoError(t, decodeSession(&buf, value, "_oauth2_proxy", testDecodeSecret, 168*time.Hour, true, now))
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &d))
+	assert.False(t, d.Cookie.Expired)
+	assert.Equal(t, "access-token", d.Session.AccessToken)
+}
+
+func TestDecodeSessionInvalid(t *testing.T) {
+	now := time.Now()
+	value := testSessionCookie(t, &sessions.SessionState{Email: "jane@example.com"}, now)
+	var buf bytes.Buffer
+	assert.EqualError(t, decodeSession(&buf, value, "_oauth2_proxy", "other secret", time.Hour, false, now),
+		"invalid cookie: the signature does not match the cookie-secret and cookie-name")
+	assert.EqualError(t, decodeSession(&buf, value, "_other", testDecodeSecret, time.Hour, false, now),
+		"invalid cookie: the signature does not match the cookie-secret and cookie-name")
+
+	ticket := cookie.SignedValue(testDecodeSecret, "_oauth2_proxy", "_oauth2_proxy-0123abcd.c2VjcmV0", now)
+	assert.EqualError(t, decodeSession(&buf, ticket, "_oauth2_proxy", testDecodeSecret, time.Hour, false, now),
+		"the cookie holds the ticket of a session stored in Redis, only sessions stored in cookies can be decoded")
+}
@@ -0,0 +1,36 @@
+package oauthproxy
+
+import (
+	"strings"
+
+	"github.com/OpusCapita/oauth2_proxy/logger"
+)
+
+// denyList refuses the users and emails listed in a file, one per line,
+// regardless of any rule allowing them. The file is reloaded when it
+// changes, and sessions of users added to it stop working at their next
+// request.
+type denyList struct {
+	entries *UserMap
+}
+
+// newDenyList loads the deny list from path, watching it for changes until
+// done is closed
+func newDenyList(path string, done <-chan bool) *denyList {
+	logger.Printf("using deny list %s", path)
+	return &denyList{entries: NewUserMap(path, 0, done, func() {})}
+}
+
+// Denied reports whether the user or email is on the deny list. A nil
+// denyList denies nobody.
+func (d *denyList) Denied(user, email string) bool {
+	if d == nil {
+		return false
+	}
+	for _, id := range []string{user, email} {
+		if id != "" && d.entries.IsValid(strings.ToLower(id)) {
+			return true
+		}
+	}
+	return false
+}
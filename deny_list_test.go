@@ -0,0 +1,55 @@
+package oauthproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/OpusCapita/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestDenyList(t *testing.T, contents string) (*denyList, func()) {
+	f, err := ioutil.TempFile("", "denied_users")
+	assert.NoError(t, err)
+	f.WriteString(contents)
+	f.Close()
+	done := make(chan bool)
+	return newDenyList(f.Name(), done), func() {
+		close(done)
+		os.Remove(f.Name())
+	}
+}
+
+func TestDenyList(t *testing.T) {
+	d, cleanup := newTestDenyList(t, "jdoe\nMallory@Example.com\n")
+	defer cleanup()
+
+	assert.True(t, d.Denied("jdoe", ""))
+	assert.True(t, d.Denied("mallory", "mallory@example.com"))
+	assert.True(t, d.Denied("", "MALLORY@example.com"))
+	assert.False(t, d.Denied("alice", "alice@example.com"))
+	assert.False(t, d.Denied("", ""))
+
+	var nilList *denyList
+	assert.False(t, nilList.Denied("jdoe", ""))
+}
+
+func TestDenyListEndsSessions(t *testing.T) {
+	d, cleanup := newTestDenyList(t, "michael.bland@gsa.gov\n")
+	defer cleanup()
+
+	test := NewProcessCookieTestWithOptionsModifiers()
+	test.proxy.denyList = d
+	test.req, _ = http.NewRequest("GET", test.opts.ProxyPrefix+"/userinfo", nil)
+	test.SaveSession(&sessions.SessionState{
+		User: "michael.bland", Email: "michael.bland@gsa.gov", AccessToken: "my_access_token",
+		CreatedAt: time.Now()})
+	test.req.Header.Set("X-Requested-With", "XMLHttpRequest")
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, http.StatusUnauthorized, test.rw.Code)
+	cookies := test.rw.Header()["Set-Cookie"]
+	assert.Contains(t, cookies[len(cookies)-1], test.opts.CookieName+"=;")
+}
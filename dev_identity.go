@@ -0,0 +1,69 @@
+package oauthproxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	sessionsapi "github.com/OpusCapita/oauth2_proxy/pkg/apis/sessions"
+)
+
+// isLoopbackAddress returns whether a listen address of the form
+// [scheme://]host:port only accepts connections from the local machine.
+// Unix sockets are local; an empty host listens on all interfaces.
+func isLoopbackAddress(addr string) bool {
+	if strings.HasPrefix(addr, "unix://") {
+		return true
+	}
+	if i := strings.Index(addr, "://"); i > -1 {
+		addr = addr[i+3:]
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// parseDevFakeIdentity returns the session every request is authenticated
+// with in developer mode. It refuses listeners other clients could reach, as
+// anyone connecting would be signed in.
+func parseDevFakeIdentity(o *Options, msgs []string) (*sessionsapi.SessionState, []string) {
+	if o.DevFakeIdentity == "" {
+		return nil, msgs
+	}
+	addrs := map[string]string{"http-address": o.HTTPAddress}
+	if o.tlsEnabled() || len(o.ACMEDomains) > 0 {
+		addrs["https-address"] = o.HTTPSAddress
+	}
+	if o.ExtAuthzAddress != "" {
+		addrs["ext-authz-address"] = o.ExtAuthzAddress
+	}
+	for name, addr := range addrs {
+		if !isLoopbackAddress(addr) {
+			msgs = append(msgs, fmt.Sprintf("dev-fake-identity requires %s to be bound to localhost, got %q", name, addr))
+		}
+	}
+	user := o.DevFakeIdentity
+	if i := strings.Index(user, "@"); i > -1 {
+		user = user[:i]
+	}
+	return &sessionsapi.SessionState{
+		User:   user,
+		Email:  o.DevFakeIdentity,
+		Groups: o.DevFakeGroups,
+	}, msgs
+}
+
+// devSession returns a new copy of the developer mode session
+func (p *OAuthProxy) devSession() *sessionsapi.SessionState {
+	s := *p.devFakeSession
+	s.Groups = append([]string{}, p.devFakeSession.Groups...)
+	s.CreatedAt = time.Now()
+	return &s
+}
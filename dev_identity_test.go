@@ -0,0 +1,49 @@
+package oauthproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsLoopbackAddress(t *testing.T) {
+	assert.True(t, isLoopbackAddress("127.0.0.1:4180"))
+	assert.True(t, isLoopbackAddress("http://127.0.0.1:4180"))
+	assert.True(t, isLoopbackAddress("localhost:4180"))
+	assert.True(t, isLoopbackAddress("[::1]:4180"))
+	assert.True(t, isLoopbackAddress("unix:///run/oauth2_proxy.sock"))
+	assert.False(t, isLoopbackAddress(":4180"))
+	assert.False(t, isLoopbackAddress("0.0.0.0:4180"))
+	assert.False(t, isLoopbackAddress("10.0.0.1:4180"))
+}
+
+func TestDevFakeIdentity(t *testing.T) {
+	opts := NewOptions()
+	opts.CookieSecret = "foobar"
+	opts.DevFakeIdentity = "jane@example.com"
+	opts.DevFakeGroups = []string{"admins"}
+	assert.NoError(t, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(email string) bool { return false })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/oauth2/userinfo", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, `{"user":"jane","email":"jane@example.com","groups":["admins"]}`+"\n", rw.Body.String())
+
+	session, err := proxy.getAuthenticatedSession(httptest.NewRecorder(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"admins"}, session.Groups)
+}
+
+func TestDevFakeIdentityRequiresLocalhost(t *testing.T) {
+	opts := NewOptions()
+	opts.CookieSecret = "foobar"
+	opts.DevFakeIdentity = "jane@example.com"
+	opts.HTTPAddress = "0.0.0.0:4180"
+	err := opts.Validate()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `dev-fake-identity requires http-address to be bound to localhost, got "0.0.0.0:4180"`)
+}
@@ -0,0 +1,63 @@
+package oauthproxy
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/OpusCapita/oauth2_proxy/logger"
+)
+
+// Handler is the proxy embedded in a Go service, created by NewHandler
+type Handler struct {
+	http.Handler
+
+	done      chan bool
+	closeOnce sync.Once
+}
+
+// Close stops the background tasks of the handler, such as watching the
+// authenticated emails file, and releases the leader lease of the replica.
+// Requests should not be served after closing the handler.
+func (h *Handler) Close() error {
+	h.closeOnce.Do(func() { close(h.done) })
+	return nil
+}
+
+// NewHandler validates opts and returns the proxy as an http.Handler, so a Go
+// service can embed the authentication instead of running oauth2_proxy in
+// front of it. Requests to the proxy prefix, e.g. the sign in and callback,
+// are answered by the proxy; authenticated requests are passed to
+// opts.UpstreamHandler with the headers configured by the pass options set.
+//
+//	opts := oauthproxy.NewOptions()
+//	opts.ClientID, opts.ClientSecret, opts.CookieSecret = clientID, clientSecret, cookieSecret
+//	opts.EmailDomains = []string{"example.com"}
+//	opts.UpstreamHandler = app
+//	handler, err := oauthproxy.NewHandler(opts)
+//	defer handler.Close()
+//
+// The background tasks of the proxy, such as watching the authenticated
+// emails file, run until the handler is closed. Unlike the oauth2_proxy
+// command, the handler does not reload the configuration when an AWS
+// Secrets Manager secret was rotated: opts.OnSecretRotation is called
+// instead, e.g. to create a new handler.
+func NewHandler(opts *Options) (*Handler, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.awsSecrets != nil {
+		opts.awsSecrets.rotated = opts.OnSecretRotation
+		if opts.awsSecrets.rotated == nil {
+			opts.awsSecrets.rotated = func() {
+				logger.Printf("create a new handler to use the rotated secret")
+			}
+		}
+	}
+	done := make(chan bool)
+	oauthproxy, err := newProxy(opts, &maintenanceMode{}, nil, done)
+	if err != nil {
+		close(done)
+		return nil, err
+	}
+	return &Handler{Handler: newProxyHandler(opts, oauthproxy), done: done}, nil
+}
@@ -0,0 +1,60 @@
+package oauthproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewHandler(t *testing.T) {
+	opts := NewOptions()
+	opts.CookieSecret = "foobar"
+	opts.DevFakeIdentity = "jane@example.com"
+	opts.UpstreamHandler = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(req.Header.Get("X-Forwarded-Email") + " " + req.URL.Path))
+	})
+	handler, err := NewHandler(opts)
+	assert.NoError(t, err)
+	defer handler.Close()
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/app/", nil)
+	handler.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "jane@example.com /app/", rw.Body.String())
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/oauth2/userinfo", nil)
+	handler.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Contains(t, rw.Body.String(), `"email":"jane@example.com"`)
+}
+
+func TestNewHandlerInvalid(t *testing.T) {
+	opts := NewOptions()
+	opts.CookieSecret = "foobar"
+	opts.DevFakeIdentity = "jane@example.com"
+	opts.Upstreams = []string{"http://127.0.0.1:8080/"}
+	opts.UpstreamHandler = http.NotFoundHandler()
+	_, err := NewHandler(opts)
+	assert.EqualError(t, err, "Invalid configuration:\n  upstreams cannot be combined with an upstream handler")
+}
+
+func TestNewHandlerClose(t *testing.T) {
+	opts := NewOptions()
+	opts.CookieSecret = "foobar"
+	opts.DevFakeIdentity = "jane@example.com"
+	opts.UpstreamHandler = http.NotFoundHandler()
+	handler, err := NewHandler(opts)
+	assert.NoError(t, err)
+
+	assert.NoError(t, handler.Close())
+	assert.NoError(t, handler.Close())
+	select {
+	case <-handler.done:
+	default:
+		t.Error("the background tasks were not stopped")
+	}
+}
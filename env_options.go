@@ -1,38 +1,110 @@
-package main
+package oauthproxy
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
 	"reflect"
 	"strings"
+
+	"github.com/OpusCapita/oauth2_proxy/logger"
 )
 
+// envPrefix is the prefix of the environment variables of the options
+const envPrefix = "OAUTH2_PROXY_"
+
+// legacyEnvNames are the former environment variables of options, which are
+// still read if the current one is not set
+var legacyEnvNames = map[string]string{
+	"OAUTH2_PROXY_SKIP_OIDC_DISCOVERY":          "OAUTH2_SKIP_OIDC_DISCOVERY",
+	"OAUTH2_PROXY_OIDC_JWKS_URL":                "OAUTH2_OIDC_JWKS_URL",
+	"OAUTH2_PROXY_LOGGING_FILENAME":             "OAUTH2_LOGGING_FILENAME",
+	"OAUTH2_PROXY_LOGGING_MAX_SIZE":             "OAUTH2_LOGGING_MAX_SIZE",
+	"OAUTH2_PROXY_LOGGING_MAX_AGE":              "OAUTH2_LOGGING_MAX_AGE",
+	"OAUTH2_PROXY_LOGGING_MAX_BACKUPS":          "OAUTH2_LOGGING_MAX_BACKUPS",
+	"OAUTH2_PROXY_LOGGING_LOCAL_TIME":           "OAUTH2_LOGGING_LOCAL_TIME",
+	"OAUTH2_PROXY_LOGGING_COMPRESS":             "OAUTH2_LOGGING_COMPRESS",
+	"OAUTH2_PROXY_STANDARD_LOGGING":             "OAUTH2_STANDARD_LOGGING",
+	"OAUTH2_PROXY_STANDARD_LOGGING_FORMAT":      "OAUTH2_STANDARD_LOGGING_FORMAT",
+	"OAUTH2_PROXY_REQUEST_LOGGING":              "OAUTH2_REQUEST_LOGGING",
+	"OAUTH2_PROXY_REQUEST_LOGGING_FORMAT":       "OAUTH2_REQUEST_LOGGING_FORMAT",
+	"OAUTH2_PROXY_AUTH_LOGGING":                 "OAUTH2_LOGGING_AUTH_LOGGING",
+	"OAUTH2_PROXY_AUTH_LOGGING_FORMAT":          "OAUTH2_AUTH_LOGGING_FORMAT",
+	"OAUTH2_PROXY_LOGGING_ROTATE_INTERVAL":      "OAUTH2_LOGGING_ROTATE_INTERVAL",
+	"OAUTH2_PROXY_LOGGING_EXCLUDE_PATHS":        "OAUTH2_LOGGING_EXCLUDE_PATHS",
+	"OAUTH2_PROXY_LOGGING_EXCLUDE_STATUS":       "OAUTH2_LOGGING_EXCLUDE_STATUS",
+	"OAUTH2_PROXY_LOGGING_REDACT_PII":           "OAUTH2_LOGGING_REDACT_PII",
+	"OAUTH2_PROXY_REQUEST_LOGGING_SAMPLE_RATIO": "OAUTH2_REQUEST_LOGGING_SAMPLE_RATIO",
+	"OAUTH2_PROXY_REQUEST_LOGGING_SAMPLE_LIMIT": "OAUTH2_REQUEST_LOGGING_SAMPLE_LIMIT",
+	"OAUTH2_PROXY_STANDARD_LOGGING_FILENAME":    "OAUTH2_STANDARD_LOGGING_FILENAME",
+	"OAUTH2_PROXY_REQUEST_LOGGING_FILENAME":     "OAUTH2_REQUEST_LOGGING_FILENAME",
+	"OAUTH2_PROXY_AUTH_LOGGING_FILENAME":        "OAUTH2_AUTH_LOGGING_FILENAME",
+	"OAUTH2_PROXY_SYSLOG_ADDRESS":               "OAUTH2_SYSLOG_ADDRESS",
+	"OAUTH2_PROXY_SYSLOG_FACILITY":              "OAUTH2_SYSLOG_FACILITY",
+	"OAUTH2_PROXY_SYSLOG_TAG":                   "OAUTH2_SYSLOG_TAG",
+	"OAUTH2_PROXY_SYSLOG_CA_FILE":               "OAUTH2_SYSLOG_CA_FILE",
+}
+
 // EnvOptions holds program options loaded from the process environment
 type EnvOptions map[string]interface{}
 
+// envField is an option which can be set from the environment
+type envField struct {
+	cfgName string
+	envName string
+}
+
 // LoadEnvForStruct loads environment variables for each field in an options
 // struct passed into it.
 //
-// Fields in the options struct must have an `env` and `cfg` tag to be read
-// from the environment
-func (cfg EnvOptions) LoadEnvForStruct(options interface{}) {
-	val := reflect.ValueOf(options)
-	var typ reflect.Type
-	if val.Kind() == reflect.Ptr {
-		typ = val.Elem().Type()
-	} else {
-		typ = val.Type()
+// Every field with a `flag` or `cfg` tag is read from the environment. The
+// name of its environment variable is given by the `env` tag, and defaults to
+// OAUTH2_PROXY_ followed by its cfg name in upper case. If the variable is not
+// set, the contents of the file named by the variable with a _FILE suffix are
+// read instead, as with Docker and Kubernetes secrets.
+func (cfg EnvOptions) LoadEnvForStruct(options interface{}) error {
+	fields := envFields(reflect.Indirect(reflect.ValueOf(options)).Type(), nil)
+	envNames := make(map[string]bool)
+	for _, field := range fields {
+		envNames[field.envName] = true
+	}
+
+	for _, field := range fields {
+		v := os.Getenv(field.envName)
+		if legacy := legacyEnvNames[field.envName]; v == "" && legacy != "" {
+			if v = os.Getenv(legacy); v != "" {
+				logger.Printf("WARNING: %s is deprecated, use %s instead", legacy, field.envName)
+			}
+		}
+		// the _FILE variable of an option like client-secret is the one of
+		// its own -file option
+		fileEnvName := field.envName + "_FILE"
+		if filename := os.Getenv(fileEnvName); v == "" && filename != "" && !envNames[fileEnvName] {
+			data, err := ioutil.ReadFile(filename)
+			if err != nil {
+				return fmt.Errorf("error reading %s: %s", fileEnvName, err)
+			}
+			v = strings.TrimRight(string(data), "\r\n")
+		}
+		if v != "" {
+			cfg[field.cfgName] = v
+		}
 	}
+	return nil
+}
 
+// envFields lists the options of the struct type, including those of
+// embedded structs
+func envFields(typ reflect.Type, fields []envField) []envField {
 	for i := 0; i < typ.NumField(); i++ {
 		// pull out the struct tags:
 		//    flag - the name of the command line flag
 		//    deprecated - (optional) the name of the deprecated command line flag
 		//    cfg - (optional, defaults to underscored flag) the name of the config file option
 		field := typ.Field(i)
-		fieldV := reflect.Indirect(val).Field(i)
 
 		if field.Type.Kind() == reflect.Struct && field.Anonymous {
-			cfg.LoadEnvForStruct(fieldV.Interface())
+			fields = envFields(field.Type, fields)
 			continue
 		}
 
@@ -42,13 +114,14 @@ func (cfg EnvOptions) LoadEnvForStruct(options interface{}) {
 		if cfgName == "" && flagName != "" {
 			cfgName = strings.Replace(flagName, "-", "_", -1)
 		}
-		if envName == "" || cfgName == "" {
-			// resolvable fields must have the `env` and `cfg` struct tag
+		if cfgName == "" {
+			// resolvable fields must have the `flag` or `cfg` struct tag
 			continue
 		}
-		v := os.Getenv(envName)
-		if v != "" {
-			cfg[cfgName] = v
+		if envName == "" {
+			envName = envPrefix + strings.ToUpper(strings.Replace(cfgName, "-", "_", -1))
 		}
+		fields = append(fields, envField{cfgName: cfgName, envName: envName})
 	}
+	return fields
 }
@@ -1,7 +1,10 @@
-package main_test
+package oauthproxy_test
 
 import (
+	"io/ioutil"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
 
 	proxy "github.com/OpusCapita/oauth2_proxy"
@@ -44,3 +47,74 @@ func TestLoadEnvForStructWithEmbeddedFields(t *testing.T) {
 	v := cfg["target_field_embed"]
 	assert.Equal(t, v, "1234abcd")
 }
+
+func TestLoadEnvForStructDefaultName(t *testing.T) {
+	type options struct {
+		Field string `flag:"some-field"`
+	}
+	cfg := make(proxy.EnvOptions)
+	os.Setenv("OAUTH2_PROXY_SOME_FIELD", "1234abcd")
+	defer os.Unsetenv("OAUTH2_PROXY_SOME_FIELD")
+	cfg.LoadEnvForStruct(&options{})
+	assert.Equal(t, "1234abcd", cfg["some_field"])
+}
+
+func TestLoadEnvForStructLegacyName(t *testing.T) {
+	cfg := make(proxy.EnvOptions)
+	os.Setenv("OAUTH2_LOGGING_AUTH_LOGGING", "false")
+	defer os.Unsetenv("OAUTH2_LOGGING_AUTH_LOGGING")
+	cfg.LoadEnvForStruct(proxy.NewOptions())
+	assert.Equal(t, "false", cfg["auth_logging"])
+
+	os.Setenv("OAUTH2_PROXY_AUTH_LOGGING", "true")
+	defer os.Unsetenv("OAUTH2_PROXY_AUTH_LOGGING")
+	cfg.LoadEnvForStruct(proxy.NewOptions())
+	assert.Equal(t, "true", cfg["auth_logging"])
+}
+
+func TestEnvNamesOfOptions(t *testing.T) {
+	var check func(typ reflect.Type)
+	check = func(typ reflect.Type) {
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			if field.Anonymous && field.Type.Kind() == reflect.Struct {
+				check(field.Type)
+				continue
+			}
+			cfgName := field.Tag.Get("cfg")
+			if cfgName == "" {
+				continue
+			}
+			expected := "OAUTH2_PROXY_" + strings.ToUpper(strings.Replace(cfgName, "-", "_", -1))
+			if cfgName == "google_group" {
+				// named before the convention
+				expected = "OAUTH2_PROXY_GOOGLE_GROUPS"
+			}
+			assert.Equal(t, expected, field.Tag.Get("env"), "environment variable of %s", cfgName)
+		}
+	}
+	check(reflect.TypeOf(proxy.Options{}))
+}
+
+func TestLoadEnvForStructFromFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "secret")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString("s3cr3t\n")
+	f.Close()
+
+	os.Setenv("OAUTH2_PROXY_COOKIE_SECRET_FILE", f.Name())
+	defer os.Unsetenv("OAUTH2_PROXY_COOKIE_SECRET_FILE")
+	os.Setenv("OAUTH2_PROXY_CLIENT_ID_FILE", f.Name())
+	defer os.Unsetenv("OAUTH2_PROXY_CLIENT_ID_FILE")
+	cfg := make(proxy.EnvOptions)
+	assert.NoError(t, cfg.LoadEnvForStruct(proxy.NewOptions()))
+	// the variable of the cookie-secret-file option
+	assert.Equal(t, f.Name(), cfg["cookie_secret_file"])
+	assert.Nil(t, cfg["cookie_secret"])
+	// the _FILE convention
+	assert.Equal(t, "s3cr3t", cfg["client_id"])
+
+	os.Setenv("OAUTH2_PROXY_CLIENT_ID_FILE", "/nonexistent/client-id")
+	assert.EqualError(t, cfg.LoadEnvForStruct(proxy.NewOptions()), "error reading OAUTH2_PROXY_CLIENT_ID_FILE: open /nonexistent/client-id: no such file or directory")
+}
@@ -0,0 +1,305 @@
+package oauthproxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/OpusCapita/oauth2_proxy/logger"
+	sessionsapi "github.com/OpusCapita/oauth2_proxy/pkg/apis/sessions"
+)
+
+// errorQueueSize bounds the error reports waiting to be sent, further reports
+// are dropped
+const errorQueueSize = 100
+
+// sensitiveHeaders are left out of the request attached to error reports
+var sensitiveHeaders = map[string]bool{
+	"Authorization":               true,
+	"Cookie":                      true,
+	"Proxy-Authorization":         true,
+	"X-Forwarded-Access-Token":    true,
+	"X-Forwarded-Id-Token":        true,
+	"X-Auth-Request-Access-Token": true,
+}
+
+// sensitiveParams are filtered from the query string of the request attached
+// to error reports
+var sensitiveParams = []string{"code", "state", "token", "access_token", "id_token"}
+
+// errorEvent is an error report in the format of the Sentry store API
+type errorEvent struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   string            `json:"timestamp"`
+	Level       string            `json:"level"`
+	Platform    string            `json:"platform"`
+	Logger      string            `json:"logger"`
+	ServerName  string            `json:"server_name,omitempty"`
+	Release     string            `json:"release"`
+	Environment string            `json:"environment,omitempty"`
+	Message     string            `json:"message"`
+	Exception   *errorException   `json:"exception,omitempty"`
+	Request     *errorRequest     `json:"request,omitempty"`
+	User        *errorUser        `json:"user,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+}
+
+type errorException struct {
+	Values []errorExceptionValue `json:"values"`
+}
+
+type errorExceptionValue struct {
+	Type       string           `json:"type"`
+	Value      string           `json:"value"`
+	Stacktrace *errorStacktrace `json:"stacktrace,omitempty"`
+}
+
+type errorStacktrace struct {
+	Frames []errorFrame `json:"frames"`
+}
+
+type errorFrame struct {
+	Function string `json:"function"`
+	Filename string `json:"filename"`
+	Lineno   int    `json:"lineno"`
+}
+
+type errorRequest struct {
+	URL         string            `json:"url"`
+	Method      string            `json:"method"`
+	QueryString string            `json:"query_string,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+}
+
+type errorUser struct {
+	ID        string `json:"id,omitempty"`
+	Email     string `json:"email,omitempty"`
+	IPAddress string `json:"ip_address,omitempty"`
+}
+
+// errorReporter sends reports of panics and provider errors to Sentry or an
+// error webhook in the background. The methods of a nil errorReporter do
+// nothing.
+type errorReporter struct {
+	url         string
+	sentryAuth  string
+	environment string
+	provider    string
+	hostname    string
+	client      *http.Client
+	queue       chan *errorEvent
+}
+
+// parseErrorReporting sets up error reporting to the Sentry DSN or error
+// webhook of the options, if any
+func parseErrorReporting(o *Options, msgs []string) (*errorReporter, []string) {
+	if o.SentryDSN == "" && o.ErrorWebhookURL == "" {
+		return nil, msgs
+	}
+	if o.SentryDSN != "" && o.ErrorWebhookURL != "" {
+		return nil, append(msgs, "only one of sentry-dsn and error-webhook-url may be set")
+	}
+	hostname, _ := os.Hostname()
+	r := &errorReporter{
+		environment: o.SentryEnvironment,
+		provider:    o.Provider,
+		hostname:    hostname,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		queue:       make(chan *errorEvent, errorQueueSize),
+	}
+	if o.SentryDSN != "" {
+		var err error
+		if r.url, r.sentryAuth, err = parseSentryDSN(o.SentryDSN); err != nil {
+			return nil, append(msgs, fmt.Sprintf("invalid sentry-dsn: %s", err))
+		}
+		return r, msgs
+	}
+	if u, err := url.Parse(o.ErrorWebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, append(msgs, fmt.Sprintf("invalid error-webhook-url %q: must be an http(s) URL", o.ErrorWebhookURL))
+	}
+	r.url = o.ErrorWebhookURL
+	return r, msgs
+}
+
+// parseSentryDSN returns the store endpoint and the X-Sentry-Auth header of a
+// DSN such as https://<key>@o0.ingest.sentry.io/<project>
+func parseSentryDSN(dsn string) (string, string, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", "", err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User == nil || u.User.Username() == "" {
+		return "", "", fmt.Errorf("expected https://<key>@<host>/<project>")
+	}
+	i := strings.LastIndex(u.Path, "/")
+	project := u.Path[i+1:]
+	if project == "" {
+		return "", "", fmt.Errorf("missing project ID")
+	}
+	auth := fmt.Sprintf("Sentry sentry_version=7, sentry_client=oauth2_proxy/%s, sentry_key=%s", VERSION, u.User.Username())
+	if secret, ok := u.User.Password(); ok {
+		auth += ", sentry_secret=" + secret
+	}
+	store := fmt.Sprintf("%s://%s%s/api/%s/store/", u.Scheme, u.Host, u.Path[:i], project)
+	return store, auth, nil
+}
+
+// Report reports an error of the kind, e.g. provider.redeem, that occurred
+// serving a request. The session may be nil.
+func (r *errorReporter) Report(req *http.Request, s *sessionsapi.SessionState, kind string, err error) {
+	if r == nil {
+		return
+	}
+	r.send(r.newEvent(req, s, kind, fmt.Sprintf("%T", err), err.Error(), nil))
+}
+
+// Handler reports and recovers from panics of the handler, answering with a
+// 500. A nil reporter returns the handler unchanged.
+func (r *errorReporter) Handler(h http.Handler) http.Handler {
+	if r == nil {
+		return h
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				// the reverse proxy aborts responses the client went away from
+				panic(v)
+			}
+			logger.Printf("panic serving %s %s: %v", req.Method, req.URL.Path, v)
+			// skip the frames of the stack trace up to the panic
+			r.send(r.newEvent(req, nil, "panic", "panic", fmt.Sprint(v), stacktrace(4)))
+			http.Error(rw, "Internal Error", http.StatusInternalServerError)
+		}()
+		h.ServeHTTP(rw, req)
+	})
+}
+
+func (r *errorReporter) newEvent(req *http.Request, s *sessionsapi.SessionState, kind, errType, message string, trace *errorStacktrace) *errorEvent {
+	id := make([]byte, 16)
+	rand.Read(id)
+	event := &errorEvent{
+		EventID:     hex.EncodeToString(id),
+		Timestamp:   time.Now().UTC().Format(time.RFC3339),
+		Level:       "error",
+		Platform:    "go",
+		Logger:      "oauth2_proxy",
+		ServerName:  r.hostname,
+		Release:     VERSION,
+		Environment: r.environment,
+		Message:     message,
+		Exception: &errorException{Values: []errorExceptionValue{
+			{Type: errType, Value: message, Stacktrace: trace},
+		}},
+		Tags: map[string]string{"kind": kind, "provider": r.provider},
+		User: &errorUser{IPAddress: logger.GetClient(req)},
+	}
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	event.Request = &errorRequest{
+		URL:         scheme + "://" + req.Host + req.URL.Path,
+		Method:      req.Method,
+		QueryString: filterQuery(req.URL.Query()),
+		Headers:     map[string]string{},
+	}
+	for name, values := range req.Header {
+		if !sensitiveHeaders[name] {
+			event.Request.Headers[name] = strings.Join(values, ", ")
+		}
+	}
+	if s != nil {
+		event.User.ID = s.User
+		event.User.Email = s.Email
+	}
+	return event
+}
+
+// filterQuery encodes a query, replacing the values of sensitive parameters
+func filterQuery(query url.Values) string {
+	for _, param := range sensitiveParams {
+		if _, ok := query[param]; ok {
+			query.Set(param, "[Filtered]")
+		}
+	}
+	return query.Encode()
+}
+
+// stacktrace returns the stack of the caller, skipping frames, with the
+// outermost frame first as Sentry expects
+func stacktrace(skip int) *errorStacktrace {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(skip, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	var trace []errorFrame
+	for {
+		frame, more := frames.Next()
+		trace = append([]errorFrame{{Function: frame.Function, Filename: frame.File, Lineno: frame.Line}}, trace...)
+		if !more {
+			break
+		}
+	}
+	return &errorStacktrace{Frames: trace}
+}
+
+func (r *errorReporter) send(event *errorEvent) {
+	select {
+	case r.queue <- event:
+	default:
+		logger.Printf("error report queue full: dropping report of %s", event.Message)
+	}
+}
+
+// Run sends the queued reports until done is closed. Reports which cannot be
+// sent are logged and dropped.
+func (r *errorReporter) Run(done <-chan bool) {
+	if r == nil {
+		return
+	}
+	for {
+		select {
+		case <-done:
+			return
+		case event := <-r.queue:
+			if err := r.deliver(event); err != nil {
+				logger.Printf("error sending error report to %s: %s", r.url, err)
+			}
+		}
+	}
+}
+
+func (r *errorReporter) deliver(event *errorEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", r.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if r.sentryAuth != "" {
+		req.Header.Set("X-Sentry-Auth", r.sentryAuth)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("got %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package oauthproxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSentryDSN(t *testing.T) {
+	store, auth, err := parseSentryDSN("https://abc123@o0.ingest.sentry.io/42")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://o0.ingest.sentry.io/api/42/store/", store)
+	assert.Equal(t, "Sentry sentry_version=7, sentry_client=oauth2_proxy/"+VERSION+", sentry_key=abc123", auth)
+
+	store, _, err = parseSentryDSN("http://abc123@sentry.example.com/sentry/7")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://sentry.example.com/sentry/api/7/store/", store)
+
+	_, _, err = parseSentryDSN("https://sentry.example.com/7")
+	assert.Error(t, err)
+	_, _, err = parseSentryDSN("https://abc123@sentry.example.com/")
+	assert.Error(t, err)
+}
+
+func TestParseErrorReporting(t *testing.T) {
+	o := testOptions()
+	r, msgs := parseErrorReporting(o, nil)
+	assert.Nil(t, r)
+	assert.Empty(t, msgs)
+
+	o.SentryDSN = "https://abc123@o0.ingest.sentry.io/42"
+	o.ErrorWebhookURL = "https://errors.example.com/"
+	_, msgs = parseErrorReporting(o, nil)
+	assert.Equal(t, []string{"only one of sentry-dsn and error-webhook-url may be set"}, msgs)
+
+	o.SentryDSN = ""
+	o.ErrorWebhookURL = "errors.example.com"
+	_, msgs = parseErrorReporting(o, nil)
+	assert.Equal(t, []string{`invalid error-webhook-url "errors.example.com": must be an http(s) URL`}, msgs)
+}
+
+func TestErrorReporterHandlerReportsPanics(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	var event errorEvent
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		json.Unmarshal(body, &event)
+		received <- req
+	}))
+	defer server.Close()
+
+	o := testOptions()
+	o.ErrorWebhookURL = server.URL
+	r, msgs := parseErrorReporting(o, nil)
+	assert.Empty(t, msgs)
+	done := make(chan bool)
+	defer close(done)
+	go r.Run(done)
+
+	handler := r.Handler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		panic("boom")
+	}))
+	req := httptest.NewRequest("GET", "http://proxy.example.com/oauth2/callback?code=secret&foo=bar", nil)
+	req.Header.Set("Cookie", "_oauth2_proxy=secret")
+	req.Header.Set("User-Agent", "test")
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusInternalServerError, rw.Code)
+
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("error report not sent")
+	}
+	assert.Equal(t, "boom", event.Message)
+	assert.Equal(t, "panic", event.Tags["kind"])
+	assert.Equal(t, "http://proxy.example.com/oauth2/callback", event.Request.URL)
+	assert.Equal(t, "code=%5BFiltered%5D&foo=bar", event.Request.QueryString)
+	assert.Equal(t, map[string]string{"User-Agent": "test"}, event.Request.Headers)
+	frames := event.Exception.Values[0].Stacktrace.Frames
+	assert.Contains(t, frames[len(frames)-1].Function, "TestErrorReporterHandlerReportsPanics")
+}
@@ -0,0 +1,278 @@
+package oauthproxy
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/OpusCapita/oauth2_proxy/logger"
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v2"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	envoytype "github.com/envoyproxy/go-control-plane/envoy/type"
+	envoytypev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// ExtAuthzServer implements the Envoy external authorization gRPC API, v2 and
+// v3, on top of an OAuthProxy so that a service mesh can delegate
+// authentication to it
+type ExtAuthzServer struct {
+	// proxy returns the proxy of the current configuration
+	proxy func() *OAuthProxy
+}
+
+// NewExtAuthzServer creates an ExtAuthzServer checking requests against the
+// sessions of the given proxy
+func NewExtAuthzServer(proxy *OAuthProxy) *ExtAuthzServer {
+	return &ExtAuthzServer{proxy: func() *OAuthProxy { return proxy }}
+}
+
+// newReloadableExtAuthzServer creates an ExtAuthzServer checking requests
+// against the proxy of the configuration handler currently serves, so that
+// it follows configuration reloads
+func newReloadableExtAuthzServer(handler *reloadableHandler) *ExtAuthzServer {
+	return &ExtAuthzServer{proxy: handler.Proxy}
+}
+
+// extAuthzServerV3 serves the v3 API of the ExtAuthzServer
+type extAuthzServerV3 struct {
+	*ExtAuthzServer
+}
+
+// extAuthzResult is the decision on a request, whichever API version asked
+type extAuthzResult struct {
+	code codes.Code
+	// status is the HTTP status of denied requests
+	status int
+	// headers are set on allowed requests, or on the response to denied ones
+	headers http.Header
+	// remove lists the request headers removed from allowed requests
+	remove []string
+	body   string
+}
+
+// ListenAndServe registers the authorization service on a gRPC server and
+// serves it on the given address
+func (s *ExtAuthzServer) ListenAndServe(addr string) {
+	ln, err := sockets.listen("ext-authz", "tcp", addr)
+	if err != nil {
+		logger.Fatalf("FATAL: ext_authz listen (%s) failed - %s", addr, err)
+	}
+	logger.Printf("ext_authz: listening on %s", ln.Addr())
+
+	srv := grpc.NewServer()
+	auth.RegisterAuthorizationServer(srv, s)
+	authv3.RegisterAuthorizationServer(srv, extAuthzServerV3{s})
+	if err := srv.Serve(ln); err != nil {
+		logger.Printf("ERROR: ext_authz Serve() - %s", err)
+	}
+}
+
+// check authenticates the HTTP request the same way the auth endpoint does.
+// Allowed requests get the identity headers that would have been sent to an
+// upstream, and lose the headers the proxy strips.
+func (s *ExtAuthzServer) check(req *http.Request) extAuthzResult {
+	proxy := s.proxy()
+	original := req.Header
+	req.Header = cloneHeader(original)
+
+	rw := newHeaderWriter()
+	session, err := proxy.getAuthenticatedSession(rw, req)
+	if err != nil {
+		if err != ErrNeedsLogin {
+			logger.Printf("ext_authz: unexpected internal error: %s", err)
+		}
+		// pass on any headers, e.g. cleared session cookies, the proxy set
+		return extAuthzResult{code: codes.Unauthenticated, status: http.StatusUnauthorized, headers: rw.Header(), body: "unauthorized request"}
+	}
+	if denial := proxy.checkRequest(req, req.Method, req.URL.Path, session); denial != nil {
+		result := extAuthzResult{code: codes.PermissionDenied, status: denial.status, headers: make(http.Header), body: denial.message}
+		switch denial.status {
+		case http.StatusServiceUnavailable:
+			result.code = codes.Unavailable
+		case http.StatusTooManyRequests:
+			result.code = codes.ResourceExhausted
+			result.headers.Set("Retry-After", retryAfter(denial.retryAfter))
+		}
+		return result
+	}
+	proxy.rewriteRequestHeaders(req)
+	proxy.addHeadersForProxying(rw, req, session)
+
+	result := extAuthzResult{code: codes.OK, headers: make(http.Header)}
+	for name, values := range req.Header {
+		if len(values) > 0 && !equalHeaderValues(original[name], values) {
+			result.headers[name] = values
+		}
+	}
+	for name := range original {
+		if len(req.Header[name]) == 0 {
+			result.remove = append(result.remove, name)
+		}
+	}
+	sort.Strings(result.remove)
+	return result
+}
+
+// Check answers the v2 API. It cannot remove request headers, so those the
+// proxy strips are overridden with an empty value instead.
+func (s *ExtAuthzServer) Check(ctx context.Context, check *auth.CheckRequest) (*auth.CheckResponse, error) {
+	attrs := check.GetAttributes()
+	httpAttrs := attrs.GetRequest().GetHttp()
+	result := s.check(newCheckHTTPRequest(httpAttrs.GetMethod(), httpAttrs.GetPath(), httpAttrs.GetHost(), httpAttrs.GetScheme(), httpAttrs.GetProtocol(),
+		httpAttrs.GetHeaders(), attrs.GetSource().GetAddress().GetSocketAddress().GetAddress()))
+
+	var headers []*core.HeaderValueOption
+	if result.code != codes.OK {
+		for name, values := range result.headers {
+			for _, v := range values {
+				headers = append(headers, headerValueOption(name, v))
+			}
+		}
+		return &auth.CheckResponse{
+			Status: &rpcstatus.Status{Code: int32(result.code)},
+			HttpResponse: &auth.CheckResponse_DeniedResponse{
+				DeniedResponse: &auth.DeniedHttpResponse{
+					Status:  &envoytype.HttpStatus{Code: envoytype.StatusCode(result.status)},
+					Headers: headers,
+					Body:    result.body,
+				},
+			},
+		}, nil
+	}
+	for name, values := range result.headers {
+		headers = append(headers, headerValueOption(name, strings.Join(values, ",")))
+	}
+	for _, name := range result.remove {
+		headers = append(headers, headerValueOption(name, ""))
+	}
+	return &auth.CheckResponse{
+		Status: &rpcstatus.Status{Code: int32(codes.OK)},
+		HttpResponse: &auth.CheckResponse_OkResponse{
+			OkResponse: &auth.OkHttpResponse{Headers: headers},
+		},
+	}, nil
+}
+
+// Check answers the v3 API
+func (s extAuthzServerV3) Check(ctx context.Context, check *authv3.CheckRequest) (*authv3.CheckResponse, error) {
+	attrs := check.GetAttributes()
+	httpAttrs := attrs.GetRequest().GetHttp()
+	result := s.check(newCheckHTTPRequest(httpAttrs.GetMethod(), httpAttrs.GetPath(), httpAttrs.GetHost(), httpAttrs.GetScheme(), httpAttrs.GetProtocol(),
+		httpAttrs.GetHeaders(), attrs.GetSource().GetAddress().GetSocketAddress().GetAddress()))
+
+	var headers []*corev3.HeaderValueOption
+	if result.code != codes.OK {
+		for name, values := range result.headers {
+			for _, v := range values {
+				headers = append(headers, headerValueOptionV3(name, v))
+			}
+		}
+		return &authv3.CheckResponse{
+			Status: &rpcstatus.Status{Code: int32(result.code)},
+			HttpResponse: &authv3.CheckResponse_DeniedResponse{
+				DeniedResponse: &authv3.DeniedHttpResponse{
+					Status:  &envoytypev3.HttpStatus{Code: envoytypev3.StatusCode(result.status)},
+					Headers: headers,
+					Body:    result.body,
+				},
+			},
+		}, nil
+	}
+	for name, values := range result.headers {
+		headers = append(headers, headerValueOptionV3(name, strings.Join(values, ",")))
+	}
+	return &authv3.CheckResponse{
+		Status: &rpcstatus.Status{Code: int32(codes.OK)},
+		HttpResponse: &authv3.CheckResponse_OkResponse{
+			OkResponse: &authv3.OkHttpResponse{Headers: headers, HeadersToRemove: result.remove},
+		},
+	}, nil
+}
+
+func headerValueOption(name, value string) *core.HeaderValueOption {
+	return &core.HeaderValueOption{
+		Header: &core.HeaderValue{Key: name, Value: value},
+	}
+}
+
+func headerValueOptionV3(name, value string) *corev3.HeaderValueOption {
+	return &corev3.HeaderValueOption{
+		Header: &corev3.HeaderValue{Key: name, Value: value},
+	}
+}
+
+// equalHeaderValues returns whether a header has the same values before and
+// after the proxy handled the request
+func equalHeaderValues(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// newCheckHTTPRequest rebuilds the HTTP request Envoy is asking about
+func newCheckHTTPRequest(method, path, host, scheme, protocol string, headers map[string]string, remoteAddr string) *http.Request {
+	header := make(http.Header)
+	for k, v := range headers {
+		header.Set(k, v)
+	}
+	u, err := url.ParseRequestURI(path)
+	if err != nil {
+		u = &url.URL{Path: "/"}
+	}
+	u.Scheme = scheme
+	u.Host = host
+
+	return &http.Request{
+		Method:     method,
+		URL:        u,
+		Proto:      protocol,
+		Header:     header,
+		Host:       host,
+		RequestURI: path,
+		RemoteAddr: remoteAddr,
+	}
+}
+
+func cloneHeader(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for k, v := range h {
+		c[k] = append([]string(nil), v...)
+	}
+	return c
+}
+
+// headerWriter is an http.ResponseWriter that only records headers, used to
+// capture the headers the proxy sets while checking a session
+type headerWriter struct {
+	header http.Header
+}
+
+func newHeaderWriter() *headerWriter {
+	return &headerWriter{header: make(http.Header)}
+}
+
+// Header returns the recorded headers
+func (w *headerWriter) Header() http.Header {
+	return w.header
+}
+
+// Write discards the body
+func (w *headerWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// WriteHeader discards the status code
+func (w *headerWriter) WriteHeader(int) {}
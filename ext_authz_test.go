@@ -0,0 +1,157 @@
+package oauthproxy
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/OpusCapita/oauth2_proxy/pkg/apis/sessions"
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v2"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	envoytype "github.com/envoyproxy/go-control-plane/envoy/type"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+)
+
+func newCheckRequest(headers map[string]string) *auth.CheckRequest {
+	return &auth.CheckRequest{
+		Attributes: &auth.AttributeContext{
+			Request: &auth.AttributeContext_Request{
+				Http: &auth.AttributeContext_HttpRequest{
+					Method:  "GET",
+					Host:    "app.example.com",
+					Path:    "/some/path",
+					Scheme:  "https",
+					Headers: headers,
+				},
+			},
+		},
+	}
+}
+
+func TestExtAuthzCheckAllowed(t *testing.T) {
+	pcTest := NewProcessCookieTestWithDefaults()
+	startSession := &sessions.SessionState{
+		User: "oauth_user", Email: "oauth_user@example.com", AccessToken: "oauth_token", CreatedAt: time.Now()}
+	require.NoError(t, pcTest.SaveSession(startSession))
+
+	server := NewExtAuthzServer(pcTest.proxy)
+	resp, err := server.Check(context.Background(), newCheckRequest(map[string]string{
+		"cookie": pcTest.req.Header.Get("Cookie"),
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, int32(codes.OK), resp.GetStatus().GetCode())
+
+	headers := make(map[string]string)
+	for _, h := range resp.GetOkResponse().GetHeaders() {
+		headers[h.GetHeader().GetKey()] = h.GetHeader().GetValue()
+	}
+	assert.Equal(t, "oauth_user", headers["X-Forwarded-User"])
+	assert.Equal(t, "oauth_user@example.com", headers["X-Forwarded-Email"])
+	assert.NotContains(t, headers, "Cookie")
+}
+
+func TestExtAuthzCheckDenied(t *testing.T) {
+	pcTest := NewProcessCookieTestWithDefaults()
+
+	server := NewExtAuthzServer(pcTest.proxy)
+	resp, err := server.Check(context.Background(), newCheckRequest(nil))
+	require.NoError(t, err)
+	assert.Equal(t, int32(codes.Unauthenticated), resp.GetStatus().GetCode())
+	assert.Equal(t, envoytype.StatusCode_Unauthorized, resp.GetDeniedResponse().GetStatus().GetCode())
+}
+
+func TestExtAuthzCheckV3RemovesHeaders(t *testing.T) {
+	pcTest := NewProcessCookieTestWithDefaults()
+	pcTest.proxy.stripRequestHeaders = []string{"X-Real-IP"}
+	startSession := &sessions.SessionState{
+		User: "oauth_user", Email: "oauth_user@example.com", AccessToken: "oauth_token", CreatedAt: time.Now()}
+	require.NoError(t, pcTest.SaveSession(startSession))
+
+	server := extAuthzServerV3{NewExtAuthzServer(pcTest.proxy)}
+	resp, err := server.Check(context.Background(), &authv3.CheckRequest{
+		Attributes: &authv3.AttributeContext{
+			Request: &authv3.AttributeContext_Request{
+				Http: &authv3.AttributeContext_HttpRequest{
+					Method: "GET",
+					Host:   "app.example.com",
+					Path:   "/some/path",
+					Scheme: "https",
+					Headers: map[string]string{
+						"cookie":            pcTest.req.Header.Get("Cookie"),
+						"x-real-ip":         "10.0.0.1",
+						"x-forwarded-email": "oauth_user@example.com",
+					},
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int32(codes.OK), resp.GetStatus().GetCode())
+	assert.Equal(t, []string{"X-Real-Ip"}, resp.GetOkResponse().GetHeadersToRemove())
+
+	headers := make(map[string]string)
+	for _, h := range resp.GetOkResponse().GetHeaders() {
+		headers[h.GetHeader().GetKey()] = h.GetHeader().GetValue()
+	}
+	assert.Equal(t, "oauth_user", headers["X-Forwarded-User"])
+	// unchanged headers are left alone
+	assert.NotContains(t, headers, "X-Forwarded-Email")
+}
+
+func TestEqualHeaderValues(t *testing.T) {
+	assert.True(t, equalHeaderValues(nil, nil))
+	assert.True(t, equalHeaderValues([]string{"a", "b"}, []string{"a", "b"}))
+	assert.False(t, equalHeaderValues([]string{"a"}, []string{"a", "b"}))
+	assert.False(t, equalHeaderValues([]string{"a", "b"}, []string{"a", "c"}))
+}
+
+func TestExtAuthzFollowsReload(t *testing.T) {
+	stale := NewProcessCookieTest(ProcessCookieTestOpts{}, func(opts *Options) {
+		opts.CookieName = "_stale_proxy"
+	})
+	handler := &reloadableHandler{}
+	handler.Store(http.NotFoundHandler(), stale.proxy)
+	server := newReloadableExtAuthzServer(handler)
+
+	pcTest := NewProcessCookieTestWithDefaults()
+	startSession := &sessions.SessionState{
+		User: "oauth_user", Email: "oauth_user@example.com", AccessToken: "oauth_token", CreatedAt: time.Now()}
+	require.NoError(t, pcTest.SaveSession(startSession))
+	check := newCheckRequest(map[string]string{"cookie": pcTest.req.Header.Get("Cookie")})
+
+	resp, err := server.Check(context.Background(), check)
+	require.NoError(t, err)
+	assert.Equal(t, int32(codes.Unauthenticated), resp.GetStatus().GetCode())
+
+	handler.Store(http.NotFoundHandler(), pcTest.proxy)
+	resp, err = server.Check(context.Background(), check)
+	require.NoError(t, err)
+	assert.Equal(t, int32(codes.OK), resp.GetStatus().GetCode())
+}
+
+func TestExtAuthzCheckRequestChecks(t *testing.T) {
+	pcTest := NewProcessCookieTestWithOptionsModifiers(func(opts *Options) {
+		opts.MaintenancePaths = []string{"^/some/"}
+		opts.StepUpRoutes = []string{"^/admin/=urn:example:mfa"}
+	})
+	require.NoError(t, pcTest.SaveSession(&sessions.SessionState{
+		Email: "user@example.com", AccessToken: "token", CreatedAt: time.Now()}))
+	server := NewExtAuthzServer(pcTest.proxy)
+	check := newCheckRequest(map[string]string{"cookie": pcTest.req.Header.Get("Cookie")})
+
+	pcTest.proxy.maintenance.Set(true)
+	resp, err := server.Check(context.Background(), check)
+	require.NoError(t, err)
+	assert.Equal(t, int32(codes.Unavailable), resp.GetStatus().GetCode())
+	assert.Equal(t, envoytype.StatusCode_ServiceUnavailable, resp.GetDeniedResponse().GetStatus().GetCode())
+	pcTest.proxy.maintenance.Set(false)
+
+	check.Attributes.Request.Http.Path = "/admin/users"
+	resp, err = server.Check(context.Background(), check)
+	require.NoError(t, err)
+	assert.Equal(t, int32(codes.PermissionDenied), resp.GetStatus().GetCode())
+	assert.Equal(t, "step-up authentication required", resp.GetDeniedResponse().GetBody())
+}
@@ -0,0 +1,154 @@
+package oauthproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/OpusCapita/oauth2_proxy/logger"
+)
+
+// Kinds of failures counted towards the failure alerts
+const (
+	failureDenial   = "authorization denials"
+	failureProvider = "provider errors"
+)
+
+// failureAlertQueueSize bounds the alerts waiting to be sent
+const failureAlertQueueSize = 10
+
+// failureAlert is the JSON payload of a failure alert. Slack incoming
+// webhooks, and compatible ones, display its text.
+type failureAlert struct {
+	Text      string    `json:"text"`
+	Kind      string    `json:"kind"`
+	Count     int       `json:"count"`
+	Window    string    `json:"window"`
+	Latest    string    `json:"latest"`
+	Provider  string    `json:"provider"`
+	Host      string    `json:"host,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// failureAlerter posts an alert to a webhook when the authorization denials
+// or the provider errors within a window reach a threshold, at most once per
+// window and kind. The methods of a nil failureAlerter do nothing.
+type failureAlerter struct {
+	url       string
+	threshold int
+	window    time.Duration
+	provider  string
+	hostname  string
+	client    *http.Client
+	queue     chan *failureAlert
+
+	mu        sync.Mutex
+	failures  map[string][]time.Time
+	lastAlert map[string]time.Time
+}
+
+// parseFailureAlerts sets up the failure alerts of the failure-webhook-url,
+// if any
+func parseFailureAlerts(o *Options, msgs []string) (*failureAlerter, []string) {
+	if o.FailureWebhookURL == "" {
+		return nil, msgs
+	}
+	if u, err := url.Parse(o.FailureWebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		msgs = append(msgs, fmt.Sprintf("invalid failure-webhook-url %q: must be an http(s) URL", o.FailureWebhookURL))
+	}
+	if o.FailureWebhookThreshold < 1 {
+		msgs = append(msgs, "failure-webhook-threshold must be at least 1")
+	}
+	if o.FailureWebhookWindow <= 0 {
+		msgs = append(msgs, "failure-webhook-window must be positive")
+	}
+	hostname, _ := os.Hostname()
+	return &failureAlerter{
+		url:       o.FailureWebhookURL,
+		threshold: o.FailureWebhookThreshold,
+		window:    o.FailureWebhookWindow,
+		provider:  o.Provider,
+		hostname:  hostname,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		queue:     make(chan *failureAlert, failureAlertQueueSize),
+		failures:  map[string][]time.Time{},
+		lastAlert: map[string]time.Time{},
+	}, msgs
+}
+
+// Record counts a failure of the kind for the reason, queueing an alert if
+// the threshold is reached
+func (a *failureAlerter) Record(kind, reason string) {
+	if a == nil {
+		return
+	}
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	failures := append(a.failures[kind], now)
+	for len(failures) > 0 && now.Sub(failures[0]) > a.window {
+		failures = failures[1:]
+	}
+	a.failures[kind] = failures
+	if len(failures) < a.threshold || now.Sub(a.lastAlert[kind]) < a.window {
+		return
+	}
+	a.lastAlert[kind] = now
+	a.failures[kind] = nil
+
+	alert := &failureAlert{
+		Text:      fmt.Sprintf("oauth2_proxy on %s: %d %s of the %s provider in the last %s, latest: %s", a.hostname, len(failures), kind, a.provider, a.window, reason),
+		Kind:      kind,
+		Count:     len(failures),
+		Window:    a.window.String(),
+		Latest:    reason,
+		Provider:  a.provider,
+		Host:      a.hostname,
+		Timestamp: now.UTC(),
+	}
+	select {
+	case a.queue <- alert:
+	default:
+		logger.Printf("failure alert queue full: dropping alert of %d %s", alert.Count, kind)
+	}
+}
+
+// Run sends the queued alerts until done is closed. Alerts which cannot be
+// sent are logged and dropped.
+func (a *failureAlerter) Run(done <-chan bool) {
+	if a == nil {
+		return
+	}
+	for {
+		select {
+		case <-done:
+			return
+		case alert := <-a.queue:
+			if err := a.deliver(alert); err != nil {
+				logger.Printf("error sending failure alert to %s: %s", a.url, err)
+			}
+		}
+	}
+}
+
+func (a *failureAlerter) deliver(alert *failureAlert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	resp, err := a.client.Post(a.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("got %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package oauthproxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFailureAlerts(t *testing.T) {
+	o := testOptions()
+	a, msgs := parseFailureAlerts(o, nil)
+	assert.Nil(t, a)
+	assert.Empty(t, msgs)
+
+	o.FailureWebhookURL = "hooks.slack.com"
+	o.FailureWebhookThreshold = 0
+	o.FailureWebhookWindow = 0
+	_, msgs = parseFailureAlerts(o, nil)
+	assert.Equal(t, []string{
+		`invalid failure-webhook-url "hooks.slack.com": must be an http(s) URL`,
+		"failure-webhook-threshold must be at least 1",
+		"failure-webhook-window must be positive",
+	}, msgs)
+}
+
+func TestFailureAlerterThreshold(t *testing.T) {
+	received := make(chan failureAlert, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		var alert failureAlert
+		json.Unmarshal(body, &alert)
+		received <- alert
+	}))
+	defer server.Close()
+
+	o := testOptions()
+	o.FailureWebhookURL = server.URL
+	o.FailureWebhookThreshold = 3
+	a, msgs := parseFailureAlerts(o, nil)
+	assert.Empty(t, msgs)
+	done := make(chan bool)
+	defer close(done)
+	go a.Run(done)
+
+	a.Record(failureProvider, "error redeeming code: invalid_client")
+	a.Record(failureDenial, "by OPA")
+	a.Record(failureProvider, "error redeeming code: invalid_client")
+	assert.Len(t, a.queue, 0)
+	a.Record(failureProvider, "error redeeming code: unauthorized_client")
+
+	select {
+	case alert := <-received:
+		assert.Equal(t, failureProvider, alert.Kind)
+		assert.Equal(t, 3, alert.Count)
+		assert.Equal(t, "5m0s", alert.Window)
+		assert.Equal(t, "error redeeming code: unauthorized_client", alert.Latest)
+		assert.Contains(t, alert.Text, "3 provider errors of the google provider in the last 5m0s")
+	case <-time.After(5 * time.Second):
+		t.Fatal("failure alert not sent")
+	}
+
+	// only one alert per window
+	for i := 0; i < 5; i++ {
+		a.Record(failureProvider, "error redeeming code: invalid_client")
+	}
+	select {
+	case alert := <-received:
+		t.Errorf("unexpected alert %q", alert.Text)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,64 @@
+package oauthproxy
+
+import (
+	"mime"
+	"net/http"
+)
+
+// defaultFlushImmediatelyTypes are the content types flushed after every
+// write when no flush-immediately-type is configured
+var defaultFlushImmediatelyTypes = []string{"text/event-stream"}
+
+func flushImmediatelyTypes(opts *Options) []string {
+	if len(opts.FlushImmediatelyTypes) == 0 {
+		return defaultFlushImmediatelyTypes
+	}
+	return opts.FlushImmediatelyTypes
+}
+
+// withImmediateFlush flushes every write of responses with one of the given
+// content types to the client, instead of waiting for the flush interval.
+// With always set every response is flushed after each write.
+func withImmediateFlush(h http.Handler, types []string, always bool) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if _, ok := rw.(http.Flusher); !ok {
+			h.ServeHTTP(rw, req)
+			return
+		}
+		h.ServeHTTP(&flushingResponseWriter{ResponseWriter: rw, types: types, flush: always}, req)
+	})
+}
+
+// flushingResponseWriter decides from the Content-Type of the response
+// whether to flush after each write
+type flushingResponseWriter struct {
+	http.ResponseWriter
+	types       []string
+	flush       bool
+	wroteHeader bool
+}
+
+func (w *flushingResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		mediaType, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+		w.flush = w.flush || contains(w.types, mediaType)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *flushingResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(b)
+	if w.flush {
+		w.Flush()
+	}
+	return n, err
+}
+
+// Flush sends any buffered data to the client
+func (w *flushingResponseWriter) Flush() {
+	w.ResponseWriter.(http.Flusher).Flush()
+}
@@ -0,0 +1,46 @@
+package oauthproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// flushRecorder counts how often the response is flushed
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushes int
+}
+
+func (r *flushRecorder) Flush() {
+	r.flushes++
+	r.ResponseRecorder.Flush()
+}
+
+func TestImmediateFlush(t *testing.T) {
+	stream := func(contentType string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			w.Write([]byte("data: 1\n\n"))
+			w.Write([]byte("data: 2\n\n"))
+		})
+	}
+	serve := func(h http.Handler) *flushRecorder {
+		rw := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+		req, _ := http.NewRequest("GET", "/", nil)
+		h.ServeHTTP(rw, req)
+		return rw
+	}
+
+	rw := serve(withImmediateFlush(stream("text/event-stream; charset=utf-8"), defaultFlushImmediatelyTypes, false))
+	assert.Equal(t, 2, rw.flushes)
+	assert.Equal(t, "data: 1\n\ndata: 2\n\n", rw.Body.String())
+
+	rw = serve(withImmediateFlush(stream("text/html"), defaultFlushImmediatelyTypes, false))
+	assert.Equal(t, 0, rw.flushes)
+
+	rw = serve(withImmediateFlush(stream("text/html"), defaultFlushImmediatelyTypes, true))
+	assert.Equal(t, 2, rw.flushes)
+}
@@ -0,0 +1,32 @@
+package oauthproxy
+
+import (
+	"net/http"
+)
+
+// skipSignInPage starts the OAuth2 flow straight away. With preserve-fragment
+// the fragment bridge page is served first, as the URL fragment is never
+// sent to the proxy and would be lost.
+func (p *OAuthProxy) skipSignInPage(rw http.ResponseWriter, req *http.Request, redirect string) {
+	if p.preserveFragment {
+		p.FragmentBridgePage(rw, redirect)
+		return
+	}
+	p.OAuthStart(rw, req)
+}
+
+// FragmentBridgePage serves a page which appends the URL fragment to the
+// redirect and continues to the OAuth2 start endpoint, so single page
+// applications get their client side route back after signing in
+func (p *OAuthProxy) FragmentBridgePage(rw http.ResponseWriter, redirect string) {
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusOK)
+	t := struct {
+		Redirect    string
+		ProxyPrefix string
+	}{
+		Redirect:    redirect,
+		ProxyPrefix: p.ProxyPrefix,
+	}
+	p.templates.ExecuteTemplate(rw, "fragment_bridge.html", t)
+}
@@ -0,0 +1,77 @@
+package oauthproxy
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// sampleConfig is the YAML config printed by generate-secret -sample-config
+const sampleConfig = `## OAuth2 Proxy YAML Config File
+## https://github.com/OpusCapita/oauth2_proxy
+##
+## Used with -config=/etc/oauth2_proxy.yaml. See
+## contrib/oauth2_proxy.yaml.example for more options.
+
+upstreams:
+  - http://127.0.0.1:8080/
+
+server:
+  http_address: 127.0.0.1:4180
+
+provider:
+  type: oidc
+  client_id: oauth2_proxy
+  client_secret: ""
+  oidc:
+    issuer_url: https://accounts.example.com
+
+policies:
+  email_domains:
+    - yourcompany.com
+
+sessions:
+  cookie:
+    secret: %q
+    expire: 168h
+    secure: true
+    httponly: true
+`
+
+// generateSecretCommand prints a random cookie secret, or a sample config
+// using one
+func generateSecretCommand(args []string) int {
+	flagSet := flag.NewFlagSet("generate-secret", flag.ContinueOnError)
+	size := flagSet.Int("bytes", 32, "size of the secret in bytes: 16, 24 or 32 for AES-128, AES-192 or AES-256")
+	sample := flagSet.Bool("sample-config", false, "print a sample YAML config file using the secret")
+	if err := flagSet.Parse(args); err != nil {
+		return 2
+	}
+	if err := generateSecret(os.Stdout, *size, *sample); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// generateSecret writes a random cookie secret of size bytes, base64
+// encoded, to w, or a sample config using it
+func generateSecret(w io.Writer, size int, sample bool) error {
+	if size != 16 && size != 24 && size != 32 {
+		return fmt.Errorf("invalid -bytes %d: must be 16, 24 or 32", size)
+	}
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Errorf("error generating secret: %s", err)
+	}
+	secret := base64.URLEncoding.EncodeToString(b)
+	if sample {
+		_, err := fmt.Fprintf(w, sampleConfig, secret)
+		return err
+	}
+	_, err := fmt.Fprintln(w, secret)
+	return err
+}
@@ -0,0 +1,46 @@
+package oauthproxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/OpusCapita/oauth2_proxy/cookie"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateSecret(t *testing.T) {
+	for _, size := range []int{16, 24, 32} {
+		var buf bytes.Buffer
+		assert.NoError(t, generateSecret(&buf, size, false))
+		secret := strings.TrimSuffix(buf.String(), "\n")
+		assert.Len(t, secretBytes(secret), size)
+		_, err := cookie.NewCipher(secretBytes(secret))
+		assert.NoError(t, err)
+	}
+
+	var first, second bytes.Buffer
+	generateSecret(&first, 32, false)
+	generateSecret(&second, 32, false)
+	assert.NotEqual(t, first.String(), second.String())
+
+	assert.EqualError(t, generateSecret(&first, 20, false), "invalid -bytes 20: must be 16, 24 or 32")
+}
+
+func TestGenerateSecretSampleConfig(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, generateSecret(&buf, 32, true))
+	dir, err := ioutil.TempDir("", "generate-secret")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "oauth2_proxy.yaml")
+	assert.NoError(t, ioutil.WriteFile(filename, buf.Bytes(), 0600))
+
+	cfg, err := loadYAMLConfig(filename)
+	assert.NoError(t, err)
+	assert.Len(t, secretBytes(cfg["cookie_secret"].(string)), 32)
+	assert.Equal(t, "oidc", cfg["provider"])
+}
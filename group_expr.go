@@ -0,0 +1,208 @@
+package oauthproxy
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// groupExpr is a boolean expression over the groups of a user such as
+// `acme AND (acme/sre OR acme/oncall) AND NOT acme/contractors`. NOT binds
+// tighter than AND, which binds tighter than OR. Group names containing
+// spaces, parentheses or a keyword are written in double quotes.
+type groupExpr struct {
+	op    string
+	group string
+	args  []*groupExpr
+}
+
+// parseRequiredGroups parses the required-groups option
+func parseRequiredGroups(o *Options, msgs []string) (*groupExpr, []string) {
+	if o.RequiredGroups == "" {
+		return nil, msgs
+	}
+	e, err := parseGroupExpr(o.RequiredGroups)
+	if err != nil {
+		return nil, append(msgs, fmt.Sprintf("invalid required-groups %q: %s", o.RequiredGroups, err))
+	}
+	return e, msgs
+}
+
+// parseGroupExpr parses a group expression
+func parseGroupExpr(s string) (*groupExpr, error) {
+	tokens, err := tokenizeGroupExpr(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &groupExprParser{tokens: tokens}
+	e, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	return e, nil
+}
+
+// groupExprToken is a parenthesis, keyword or group name. Quoted group names
+// are never keywords.
+type groupExprToken struct {
+	text   string
+	quoted bool
+}
+
+func tokenizeGroupExpr(s string) ([]groupExprToken, error) {
+	var tokens []groupExprToken
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, groupExprToken{text: string(c)})
+			i++
+		case c == '"':
+			end := strings.IndexByte(s[i+1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quote")
+			}
+			tokens = append(tokens, groupExprToken{text: s[i+1 : i+1+end], quoted: true})
+			i += end + 2
+		default:
+			end := strings.IndexFunc(s[i:], func(r rune) bool {
+				return unicode.IsSpace(r) || r == '(' || r == ')' || r == '"'
+			})
+			if end < 0 {
+				end = len(s) - i
+			}
+			tokens = append(tokens, groupExprToken{text: s[i : i+end]})
+			i += end
+		}
+	}
+	return tokens, nil
+}
+
+type groupExprParser struct {
+	tokens []groupExprToken
+	pos    int
+}
+
+// accept consumes the next token if it is the unquoted keyword or
+// parenthesis want
+func (p *groupExprParser) accept(want string) bool {
+	if p.pos < len(p.tokens) && !p.tokens[p.pos].quoted && strings.EqualFold(p.tokens[p.pos].text, want) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *groupExprParser) or() (*groupExpr, error) {
+	return p.binary("OR", p.and)
+}
+
+func (p *groupExprParser) and() (*groupExpr, error) {
+	return p.binary("AND", p.not)
+}
+
+func (p *groupExprParser) binary(op string, operand func() (*groupExpr, error)) (*groupExpr, error) {
+	e, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	args := []*groupExpr{e}
+	for p.accept(op) {
+		e, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, e)
+	}
+	if len(args) == 1 {
+		return args[0], nil
+	}
+	return &groupExpr{op: op, args: args}, nil
+}
+
+func (p *groupExprParser) not() (*groupExpr, error) {
+	if p.accept("NOT") {
+		e, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return &groupExpr{op: "NOT", args: []*groupExpr{e}}, nil
+	}
+	if p.accept("(") {
+		e, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		return e, nil
+	}
+	if p.pos == len(p.tokens) {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	t := p.tokens[p.pos]
+	if !t.quoted {
+		switch strings.ToUpper(t.text) {
+		case "AND", "OR", ")":
+			return nil, fmt.Errorf("unexpected %q", t.text)
+		}
+	}
+	p.pos++
+	return &groupExpr{group: t.text}, nil
+}
+
+// Matches tells whether the groups satisfy the expression. A nil expression
+// matches any groups.
+func (e *groupExpr) Matches(groups []string) bool {
+	if e == nil {
+		return true
+	}
+	member := make(map[string]bool, len(groups))
+	for _, g := range groups {
+		member[g] = true
+	}
+	return e.eval(member)
+}
+
+func (e *groupExpr) eval(member map[string]bool) bool {
+	switch e.op {
+	case "AND":
+		for _, a := range e.args {
+			if !a.eval(member) {
+				return false
+			}
+		}
+		return true
+	case "OR":
+		for _, a := range e.args {
+			if a.eval(member) {
+				return true
+			}
+		}
+		return false
+	case "NOT":
+		return !e.args[0].eval(member)
+	}
+	return member[e.group]
+}
+
+// String formats the expression with explicit parentheses
+func (e *groupExpr) String() string {
+	switch e.op {
+	case "AND", "OR":
+		args := make([]string, len(e.args))
+		for i, a := range e.args {
+			args[i] = a.String()
+		}
+		return "(" + strings.Join(args, " "+e.op+" ") + ")"
+	case "NOT":
+		return "NOT " + e.args[0].String()
+	}
+	return fmt.Sprintf("%q", e.group)
+}
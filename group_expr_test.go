@@ -0,0 +1,62 @@
+package oauthproxy
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/OpusCapita/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseGroupExpr(t *testing.T) {
+	e, err := parseGroupExpr(`acme and acme/sre OR not "acme/on call" AND (x or y)`)
+	assert.NoError(t, err)
+	assert.Equal(t, `(("acme" AND "acme/sre") OR (NOT "acme/on call" AND ("x" OR "y")))`, e.String())
+
+	e, err = parseGroupExpr(`"and" AND "or"`)
+	assert.NoError(t, err)
+	assert.Equal(t, `("and" AND "or")`, e.String())
+
+	for _, s := range []string{"", "acme AND", "OR acme", "(acme", "acme)", "acme sre", `"acme`, "NOT", "()"} {
+		_, err := parseGroupExpr(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestGroupExprMatches(t *testing.T) {
+	e, _ := parseGroupExpr("acme AND acme/sre AND acme/oncall")
+	assert.True(t, e.Matches([]string{"acme/oncall", "acme", "acme/sre"}))
+	assert.False(t, e.Matches([]string{"acme", "acme/sre"}))
+
+	e, _ = parseGroupExpr("acme AND (acme/sre OR acme/dev) AND NOT acme/contractors")
+	assert.True(t, e.Matches([]string{"acme", "acme/dev"}))
+	assert.False(t, e.Matches([]string{"acme", "acme/dev", "acme/contractors"}))
+	assert.False(t, e.Matches(nil))
+
+	var none *groupExpr
+	assert.True(t, none.Matches(nil))
+}
+
+func TestParseRequiredGroups(t *testing.T) {
+	o := NewOptions()
+	e, msgs := parseRequiredGroups(o, nil)
+	assert.Nil(t, e)
+	assert.Empty(t, msgs)
+
+	o.RequiredGroups = "acme AND"
+	_, msgs = parseRequiredGroups(o, nil)
+	assert.Equal(t, []string{`invalid required-groups "acme AND": unexpected end of expression`}, msgs)
+}
+
+func TestRequiredGroupsEndSessions(t *testing.T) {
+	test := NewProcessCookieTestWithOptionsModifiers()
+	test.proxy.requiredGroups, _ = parseGroupExpr("acme AND acme/sre")
+	test.req, _ = http.NewRequest("GET", test.opts.ProxyPrefix+"/userinfo", nil)
+	test.SaveSession(&sessions.SessionState{
+		User: "michael.bland", Email: "michael.bland@gsa.gov", AccessToken: "my_access_token",
+		Groups: []string{"acme"}, CreatedAt: time.Now()})
+	test.req.Header.Set("X-Requested-With", "XMLHttpRequest")
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, http.StatusUnauthorized, test.rw.Code)
+}
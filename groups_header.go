@@ -0,0 +1,49 @@
+package oauthproxy
+
+import (
+	"strings"
+
+	"github.com/OpusCapita/oauth2_proxy/logger"
+)
+
+// groupsHeader passes the groups of the session to the upstreams in a
+// header, joined by a delimiter
+type groupsHeader struct {
+	name      string
+	delimiter string
+	maxSize   int
+}
+
+// newGroupsHeader returns the groups header of opts, or nil if groups are
+// not passed
+func newGroupsHeader(opts *Options) *groupsHeader {
+	if opts.PassGroupsHeader == "" {
+		return nil
+	}
+	return &groupsHeader{
+		name:      opts.PassGroupsHeader,
+		delimiter: opts.GroupsHeaderDelimiter,
+		maxSize:   opts.GroupsHeaderMaxSize,
+	}
+}
+
+// Value joins the groups, leaving out those which would make the value
+// longer than the maximum size, if any
+func (h *groupsHeader) Value(groups []string) string {
+	var b strings.Builder
+	for i, g := range groups {
+		size := len(g)
+		if b.Len() > 0 {
+			size += len(h.delimiter)
+		}
+		if h.maxSize > 0 && b.Len()+size > h.maxSize {
+			logger.Printf("%s header truncated to %d of %d groups by groups-header-max-size=%d", h.name, i, len(groups), h.maxSize)
+			break
+		}
+		if b.Len() > 0 {
+			b.WriteString(h.delimiter)
+		}
+		b.WriteString(g)
+	}
+	return b.String()
+}
@@ -0,0 +1,59 @@
+package oauthproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroupsHeaderValue(t *testing.T) {
+	h := &groupsHeader{name: "X-Forwarded-Groups", delimiter: ",", maxSize: 0}
+	assert.Equal(t, "admins,ops,dev", h.Value([]string{"admins", "ops", "dev"}))
+	assert.Equal(t, "", h.Value(nil))
+
+	h.delimiter = "; "
+	h.maxSize = 13
+	assert.Equal(t, "admins; ops", h.Value([]string{"admins", "ops", "dev"}))
+}
+
+func TestGroupsHeaderPassedToUpstream(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Forwarded-Groups")))
+	}))
+	defer upstream.Close()
+
+	opts := NewOptions()
+	opts.Upstreams = []string{upstream.URL}
+	opts.CookieSecret = "foobar"
+	opts.DevFakeIdentity = "jane@example.com"
+	opts.DevFakeGroups = []string{"admins", "ops"}
+	opts.PassGroupsHeader = "X-Forwarded-Groups"
+	opts.SkipAuthRegex = []string{"^/public"}
+	opts.SetXAuthRequest = true
+	assert.NoError(t, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(email string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Forwarded-Groups", "spoofed")
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, "admins,ops", rw.Body.String())
+
+	// clients can't send groups to paths skipping authentication
+	rw = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/public", nil)
+	req.Header.Set("X-Forwarded-Groups", "spoofed")
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, "", rw.Body.String())
+
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, httptest.NewRequest("GET", "/oauth2/auth", nil))
+	assert.Equal(t, http.StatusAccepted, rw.Code)
+	assert.Equal(t, "admins,ops", rw.Header().Get("X-Auth-Request-Groups"))
+
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, httptest.NewRequest("GET", "/oauth2/userinfo", nil))
+	assert.JSONEq(t, `{"user":"jane","email":"jane@example.com","groups":["admins","ops"]}`, rw.Body.String())
+}
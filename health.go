@@ -0,0 +1,96 @@
+package oauthproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	sessionsapi "github.com/OpusCapita/oauth2_proxy/pkg/apis/sessions"
+)
+
+// componentCheckTimeout bounds each request made by the health endpoint
+const componentCheckTimeout = 5 * time.Second
+
+// componentHealth is the state of one dependency of the proxy
+type componentHealth struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// providerHealthURL returns the URL requested to check that logins with the
+// provider can succeed: the OIDC discovery document or JWKS when the provider
+// is configured from them, otherwise the login URL. strict is set when the
+// URL has to answer with 200 OK.
+func providerHealthURL(opts *Options) (u string, strict bool) {
+	switch {
+	case opts.OIDCIssuerURL != "" && !opts.SkipOIDCDiscovery:
+		return strings.TrimSuffix(opts.OIDCIssuerURL, "/") + "/.well-known/openid-configuration", true
+	case opts.OIDCJwksURL != "":
+		return opts.OIDCJwksURL, true
+	case opts.provider != nil && opts.provider.Data().LoginURL != nil:
+		return opts.provider.Data().LoginURL.String(), false
+	}
+	return "", false
+}
+
+// checkProvider requests the provider health URL. Any response short of a
+// server error shows the provider is reachable, unless the URL is strict.
+func (p *OAuthProxy) checkProvider() error {
+	if p.providerCheckURL == "" {
+		return nil
+	}
+	client := &http.Client{
+		Timeout: componentCheckTimeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(p.providerCheckURL)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 || (p.providerCheckStrict && resp.StatusCode != http.StatusOK) {
+		return fmt.Errorf("got %d from %s", resp.StatusCode, p.providerCheckURL)
+	}
+	return nil
+}
+
+// checkSessionStore pings the session store if it depends on an external
+// service
+func (p *OAuthProxy) checkSessionStore() error {
+	if checker, ok := p.sessionStore.(sessionsapi.HealthChecker); ok {
+		return checker.Ping()
+	}
+	return nil
+}
+
+// HealthPage writes the state of the provider and session store as JSON,
+// with a 503 status if logins would fail
+func (p *OAuthProxy) HealthPage(rw http.ResponseWriter) {
+	checks := map[string]func() error{
+		"provider":      p.checkProvider,
+		"session_store": p.checkSessionStore,
+	}
+	status := "ok"
+	code := http.StatusOK
+	components := make(map[string]componentHealth, len(checks))
+	for name, check := range checks {
+		if err := check(); err != nil {
+			components[name] = componentHealth{Status: "error", Error: err.Error()}
+			status = "error"
+			code = http.StatusServiceUnavailable
+		} else {
+			components[name] = componentHealth{Status: "ok"}
+		}
+	}
+	rw.Header().Set("Content-Type", applicationJSON)
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(code)
+	json.NewEncoder(rw).Encode(map[string]interface{}{
+		"status":     status,
+		"components": components,
+	})
+}
@@ -0,0 +1,100 @@
+package oauthproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	sessionsapi "github.com/OpusCapita/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+// pingSessionStore adds a health check to a session store
+type pingSessionStore struct {
+	sessionsapi.SessionStore
+	err error
+}
+
+func (s *pingSessionStore) Ping() error {
+	return s.err
+}
+
+func TestHealthPage(t *testing.T) {
+	discovery := http.StatusOK
+	issuer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/.well-known/openid-configuration", r.URL.Path)
+		w.WriteHeader(discovery)
+	}))
+	defer issuer.Close()
+
+	opts := NewOptions()
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "xyzzyplugh"
+	opts.Validate()
+	opts.OIDCIssuerURL = issuer.URL + "/"
+	url, strict := providerHealthURL(opts)
+	assert.Equal(t, issuer.URL+"/.well-known/openid-configuration", url)
+	assert.Equal(t, true, strict)
+
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+	store := &pingSessionStore{SessionStore: proxy.sessionStore}
+	proxy.sessionStore = store
+
+	serve := func() (int, map[string]componentHealth) {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/oauth2/health", nil)
+		proxy.ServeHTTP(rw, req)
+		var health struct {
+			Status     string                     `json:"status"`
+			Components map[string]componentHealth `json:"components"`
+		}
+		assert.Equal(t, nil, json.Unmarshal(rw.Body.Bytes(), &health))
+		return rw.Code, health.Components
+	}
+
+	code, components := serve()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, componentHealth{Status: "ok"}, components["provider"])
+	assert.Equal(t, componentHealth{Status: "ok"}, components["session_store"])
+
+	discovery = http.StatusNotFound
+	store.err = errors.New("dial tcp 127.0.0.1:6379: connect: connection refused")
+	code, components = serve()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, componentHealth{Status: "error", Error: "got 404 from " + issuer.URL + "/.well-known/openid-configuration"}, components["provider"])
+	assert.Equal(t, componentHealth{Status: "error", Error: "dial tcp 127.0.0.1:6379: connect: connection refused"}, components["session_store"])
+}
+
+func TestReadyPage(t *testing.T) {
+	opts := NewOptions()
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "xyzzyplugh"
+	opts.Validate()
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+	store := &pingSessionStore{SessionStore: proxy.sessionStore, err: errors.New("connection refused")}
+	proxy.sessionStore = store
+	proxy.providerCheckURL = ""
+
+	serve := func() *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/ready", nil)
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+	rw := serve()
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+	assert.Equal(t, "Not Ready", rw.Body.String())
+
+	store.err = nil
+	rw = serve()
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "OK", rw.Body.String())
+
+	// stays ready once the dependencies could be reached
+	store.err = errors.New("connection refused")
+	assert.Equal(t, http.StatusOK, serve().Code)
+}
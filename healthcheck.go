@@ -0,0 +1,148 @@
+package oauthproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/OpusCapita/oauth2_proxy/logger"
+)
+
+// upstreamHealthCheck periodically requests the health check URL of an
+// upstream and records whether it answered with a 2xx status. A nil check
+// is always healthy.
+type upstreamHealthCheck struct {
+	upstream string
+	url      string
+	client   *http.Client
+
+	mu        sync.RWMutex
+	healthy   bool
+	lastCheck time.Time
+	lastError string
+}
+
+// newUpstreamHealthCheck creates a health check requesting path on the host
+// of upstream. Upstreams are assumed to be healthy until the first probe.
+func newUpstreamHealthCheck(upstream *url.URL, path string, timeout time.Duration) *upstreamHealthCheck {
+	u := &url.URL{Scheme: upstream.Scheme, Host: upstream.Host, Path: path}
+	return &upstreamHealthCheck{
+		upstream: upstream.Host,
+		url:      u.String(),
+		client:   &http.Client{Timeout: timeout},
+		healthy:  true,
+	}
+}
+
+// Healthy returns the result of the last probe
+func (c *upstreamHealthCheck) Healthy() bool {
+	if c == nil {
+		return true
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.healthy
+}
+
+// Check probes the upstream once and records the result
+func (c *upstreamHealthCheck) Check() {
+	var errMsg string
+	resp, err := c.client.Get(c.url)
+	if err != nil {
+		errMsg = err.Error()
+	} else {
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			errMsg = fmt.Sprintf("got %d from %s", resp.StatusCode, c.url)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	healthy := errMsg == ""
+	if healthy != c.healthy {
+		if healthy {
+			logger.Printf("upstream %q is healthy again", c.upstream)
+		} else {
+			logger.Printf("upstream %q is unhealthy, taking it out of rotation: %s", c.upstream, errMsg)
+		}
+	}
+	c.healthy = healthy
+	c.lastCheck = time.Now()
+	c.lastError = errMsg
+}
+
+// Run probes the upstream every interval until done is closed
+func (c *upstreamHealthCheck) Run(interval time.Duration, done <-chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	c.Check()
+	for {
+		select {
+		case <-ticker.C:
+			c.Check()
+		case <-done:
+			return
+		}
+	}
+}
+
+// healthCheckedProxy answers with the unavailable page instead of proxying
+// while the upstream is unhealthy, so clients don't wait for the connection
+// to the upstream to time out
+type healthCheckedProxy struct {
+	check       *upstreamHealthCheck
+	handler     http.Handler
+	unavailable func(rw http.ResponseWriter)
+}
+
+func (h *healthCheckedProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if !h.check.Healthy() {
+		h.unavailable(rw)
+		return
+	}
+	h.handler.ServeHTTP(rw, req)
+}
+
+// StartHealthChecks probes the upstreams with a health check every interval
+// until done is closed
+func (p *OAuthProxy) StartHealthChecks(interval time.Duration, done <-chan bool) {
+	for _, c := range p.healthChecks {
+		logger.Printf("checking health of upstream %q at %s every %s", c.upstream, c.url, interval)
+		go c.Run(interval, done)
+	}
+}
+
+// UpstreamHealth writes the state of the upstream health checks as JSON,
+// with a 503 status if any upstream is unhealthy
+func (p *OAuthProxy) UpstreamHealth(rw http.ResponseWriter) {
+	type upstreamState struct {
+		Upstream  string     `json:"upstream"`
+		URL       string     `json:"url"`
+		Healthy   bool       `json:"healthy"`
+		LastCheck *time.Time `json:"last_check,omitempty"`
+		Error     string     `json:"error,omitempty"`
+	}
+	states := []upstreamState{}
+	code := http.StatusOK
+	for _, c := range p.healthChecks {
+		c.mu.RLock()
+		s := upstreamState{Upstream: c.upstream, URL: c.url, Healthy: c.healthy, Error: c.lastError}
+		if !c.lastCheck.IsZero() {
+			lastCheck := c.lastCheck
+			s.LastCheck = &lastCheck
+		}
+		c.mu.RUnlock()
+		if !s.Healthy {
+			code = http.StatusServiceUnavailable
+		}
+		states = append(states, s)
+	}
+	rw.Header().Set("Content-Type", applicationJSON)
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(code)
+	json.NewEncoder(rw).Encode(map[string]interface{}{"upstreams": states})
+}
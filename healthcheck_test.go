@@ -0,0 +1,122 @@
+package oauthproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpstreamHealthCheck(t *testing.T) {
+	status := int32(http.StatusOK)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/healthz", r.URL.Path)
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer backend.Close()
+
+	u, _ := url.Parse(backend.URL + "/app/")
+	c := newUpstreamHealthCheck(u, "/healthz", time.Second)
+	assert.Equal(t, true, c.Healthy())
+
+	c.Check()
+	assert.Equal(t, true, c.Healthy())
+	assert.Equal(t, "", c.lastError)
+
+	atomic.StoreInt32(&status, http.StatusInternalServerError)
+	c.Check()
+	assert.Equal(t, false, c.Healthy())
+	assert.Equal(t, "got 500 from "+backend.URL+"/healthz", c.lastError)
+
+	backend.Close()
+	atomic.StoreInt32(&status, http.StatusOK)
+	c.Check()
+	assert.Equal(t, false, c.Healthy())
+
+	var nilCheck *upstreamHealthCheck
+	assert.Equal(t, true, nilCheck.Healthy())
+}
+
+func TestHealthCheckedUpstream(t *testing.T) {
+	healthy := int32(1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" && atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("upstream"))
+	}))
+	defer backend.Close()
+
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, backend.URL+"/#health-check=/healthz")
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "xyzzyplugh"
+	opts.SkipAuthRegex = []string{"^/"}
+	opts.Validate()
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+	assert.Equal(t, 1, len(proxy.healthChecks))
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+	rw := serve("/")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "upstream", rw.Body.String())
+
+	atomic.StoreInt32(&healthy, 0)
+	proxy.healthChecks[0].Check()
+	rw = serve("/")
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+	assert.Contains(t, rw.Body.String(), "503 Service Unavailable")
+
+	rw = serve("/oauth2/upstreams")
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+	var state struct {
+		Upstreams []struct {
+			Upstream string `json:"upstream"`
+			Healthy  bool   `json:"healthy"`
+			Error    string `json:"error"`
+		} `json:"upstreams"`
+	}
+	assert.Equal(t, nil, json.Unmarshal(rw.Body.Bytes(), &state))
+	assert.Equal(t, 1, len(state.Upstreams))
+	assert.Equal(t, false, state.Upstreams[0].Healthy)
+	assert.Equal(t, "got 503 from "+backend.URL+"/healthz", state.Upstreams[0].Error)
+
+	atomic.StoreInt32(&healthy, 1)
+	proxy.healthChecks[0].Check()
+	assert.Equal(t, http.StatusOK, serve("/").Code)
+	assert.Equal(t, http.StatusOK, serve("/oauth2/upstreams").Code)
+}
+
+func TestCanaryProxyFailover(t *testing.T) {
+	respond := func(body string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(body))
+		})
+	}
+	primary := &upstreamHealthCheck{healthy: true}
+	canary := &upstreamHealthCheck{healthy: false}
+	c := &canaryProxy{primary: respond("primary"), canary: respond("canary"), weight: 100, primaryHealth: primary, canaryHealth: canary}
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	c.ServeHTTP(rw, req)
+	assert.Equal(t, "primary", rw.Body.String())
+
+	primary.healthy, canary.healthy = false, true
+	c.weight = 0
+	rw = httptest.NewRecorder()
+	c.ServeHTTP(rw, req)
+	assert.Equal(t, "canary", rw.Body.String())
+}
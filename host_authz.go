@@ -0,0 +1,92 @@
+package oauthproxy
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	sessionsapi "github.com/OpusCapita/oauth2_proxy/pkg/apis/sessions"
+)
+
+// hostRule restricts the requests for hosts matching a glob, and optionally
+// only some of their paths and methods, to the users of the listed tenants
+// or the emails, email domains and groups of the rule. This lets one proxy
+// serve the virtual hosts of several customers. The path defaults to every
+// path.
+type hostRule struct {
+	Host      string   `yaml:"host"`
+	Tenants   []string `yaml:"tenants"`
+	authzRule `yaml:",inline"`
+
+	hostPattern *regexp.Regexp
+}
+
+// compile checks and parses the host rule
+func (r *hostRule) compile() error {
+	var err error
+	if r.Host == "" {
+		return fmt.Errorf("host is required")
+	}
+	if r.hostPattern, err = hostGlobToRegexp(r.Host); err != nil {
+		return err
+	}
+	if r.Path == "" {
+		r.Path = "/**"
+	}
+	if !strings.HasPrefix(r.Path, "/") {
+		return fmt.Errorf("path must start with /")
+	}
+	if r.pattern, err = globToRegexp(r.Path); err != nil {
+		return err
+	}
+	return r.compileCondition()
+}
+
+// hostGlobToRegexp compiles a host glob, in which * matches within a label
+func hostGlobToRegexp(glob string) (*regexp.Regexp, error) {
+	parts := strings.Split(strings.ToLower(glob), "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	return regexp.Compile("^" + strings.Join(parts, "[^.]*") + "$")
+}
+
+// matchesHost returns whether the rule applies to a request for host, which
+// may include a port
+func (r *hostRule) matchesHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return r.hostPattern.MatchString(strings.ToLower(host))
+}
+
+// allows returns whether the rule lets the user of the session through
+func (r *hostRule) allows(s *sessionsapi.SessionState) bool {
+	for _, t := range r.Tenants {
+		if s.Tenant != "" && strings.EqualFold(t, s.Tenant) {
+			return true
+		}
+	}
+	if len(r.Tenants) > 0 && len(r.Emails) == 0 && len(r.Domains) == 0 && len(r.Groups) == 0 {
+		return false
+	}
+	return r.authzRule.allows(s)
+}
+
+// AuthorizeHost applies the first host rule matching the request. Requests
+// no host rule matches are allowed. Dry run host rules are skipped.
+func (pol *authzPolicy) AuthorizeHost(host, method, path string, s *sessionsapi.SessionState) (bool, *hostRule) {
+	return pol.authorizeHost(host, method, path, s, false)
+}
+
+// authorizeHost applies the first host rule matching the request, including
+// the dry run host rules if dryRun is set
+func (pol *authzPolicy) authorizeHost(host, method, path string, s *sessionsapi.SessionState, dryRun bool) (bool, *hostRule) {
+	for _, rule := range pol.Hosts {
+		if (dryRun || !rule.DryRun) && rule.matchesHost(host) && rule.matches(method, path) {
+			return rule.allows(s), rule
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,86 @@
+package oauthproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	sessionsapi "github.com/OpusCapita/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostRules(t *testing.T) {
+	path := writeAuthzPolicy(t, `
+hosts:
+  - host: customer-a.tools.example.com
+    tenants: [tenant-a]
+  - host: "*.tools.example.com"
+    path: /admin/**
+    groups: [ops]
+  - host: "*.tools.example.com"
+    tenants: [tenant-b]
+    domains: [example.com]
+`)
+	defer os.Remove(path)
+	policy, err := loadAuthzPolicy(path)
+	assert.NoError(t, err)
+
+	a := &sessionsapi.SessionState{Email: "jane@a.com", Tenant: "TENANT-A"}
+	b := &sessionsapi.SessionState{Email: "john@b.com", Tenant: "tenant-b"}
+	staff := &sessionsapi.SessionState{Email: "bob@example.com", Groups: []string{"ops"}}
+
+	allowed, rule := policy.AuthorizeHost("Customer-A.tools.example.com:443", "GET", "/", a)
+	assert.True(t, allowed)
+	assert.Equal(t, "customer-a.tools.example.com", rule.Host)
+	allowed, _ = policy.AuthorizeHost("customer-a.tools.example.com", "GET", "/", b)
+	assert.False(t, allowed)
+	allowed, _ = policy.AuthorizeHost("customer-a.tools.example.com", "GET", "/", staff)
+	assert.False(t, allowed)
+
+	allowed, _ = policy.AuthorizeHost("customer-b.tools.example.com", "GET", "/", b)
+	assert.True(t, allowed)
+	allowed, _ = policy.AuthorizeHost("customer-b.tools.example.com", "GET", "/", staff)
+	assert.True(t, allowed)
+	allowed, _ = policy.AuthorizeHost("customer-b.tools.example.com", "GET", "/", a)
+	assert.False(t, allowed)
+	allowed, rule = policy.AuthorizeHost("customer-b.tools.example.com", "GET", "/admin/", b)
+	assert.False(t, allowed)
+	assert.Equal(t, "/admin/**", rule.Path)
+
+	allowed, rule = policy.AuthorizeHost("x.customer-b.tools.example.com", "GET", "/", a)
+	assert.True(t, allowed)
+	assert.Nil(t, rule)
+}
+
+func TestLoadHostRulesErrors(t *testing.T) {
+	path := writeAuthzPolicy(t, "hosts:\n  - tenants: [a]\n")
+	defer os.Remove(path)
+	_, err := loadAuthzPolicy(path)
+	assert.EqualError(t, err, "host 1: host is required")
+}
+
+func TestHostRulesForwardAuth(t *testing.T) {
+	path := writeAuthzPolicy(t, "hosts:\n  - host: customer-a.example.com\n    tenants: [tenant-a]\n")
+	defer os.Remove(path)
+
+	opts := NewOptions()
+	opts.CookieSecret = "foobar"
+	opts.DevFakeIdentity = "jane@example.com"
+	opts.AuthzPolicyFile = path
+	opts.ForwardAuth = true
+	assert.NoError(t, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(email string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/oauth2/auth", nil)
+	req.Header.Set("X-Forwarded-Host", "customer-a.example.com")
+	req.Header.Set("X-Forwarded-Uri", "/")
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+
+	rw = httptest.NewRecorder()
+	req.Header.Set("X-Forwarded-Host", "customer-b.example.com")
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusAccepted, rw.Code)
+}
@@ -1,4 +1,4 @@
-package main
+package oauthproxy
 
 import (
 	"crypto/sha1"
@@ -6,6 +6,8 @@ import (
 	"encoding/csv"
 	"io"
 	"os"
+	"strings"
+	"sync"
 
 	"github.com/OpusCapita/oauth2_proxy/logger"
 	"golang.org/x/crypto/bcrypt"
@@ -16,6 +18,7 @@ import (
 
 // HtpasswdFile represents the structure of an htpasswd file
 type HtpasswdFile struct {
+	mu    sync.RWMutex
 	Users map[string]string
 }
 
@@ -31,6 +34,14 @@ func NewHtpasswdFromFile(path string) (*HtpasswdFile, error) {
 
 // NewHtpasswd  consctructs an HtpasswdFile from an io.Reader (opened file)
 func NewHtpasswd(file io.Reader) (*HtpasswdFile, error) {
+	users, err := readHtpasswd(file)
+	if err != nil {
+		return nil, err
+	}
+	return &HtpasswdFile{Users: users}, nil
+}
+
+func readHtpasswd(file io.Reader) (map[string]string, error) {
 	csvReader := csv.NewReader(file)
 	csvReader.Comma = ':'
 	csvReader.Comment = '#'
@@ -40,31 +51,54 @@ func NewHtpasswd(file io.Reader) (*HtpasswdFile, error) {
 	if err != nil {
 		return nil, err
 	}
-	h := &HtpasswdFile{Users: make(map[string]string)}
+	users := make(map[string]string)
 	for _, record := range records {
-		h.Users[record[0]] = record[1]
+		users[record[0]] = record[1]
+	}
+	return users, nil
+}
+
+// Reload replaces the entries with the contents of the file at the path
+// given. The entries are kept if the file cannot be read, e.g. while it is
+// being replaced.
+func (h *HtpasswdFile) Reload(path string) {
+	r, err := os.Open(path)
+	if err != nil {
+		logger.Printf("error opening htpasswd file %s, keeping the previous entries: %s", path, err)
+		return
+	}
+	defer r.Close()
+	users, err := readHtpasswd(r)
+	if err != nil {
+		logger.Printf("error reading htpasswd file %s, keeping the previous entries: %s", path, err)
+		return
 	}
-	return h, nil
+	h.mu.Lock()
+	h.Users = users
+	h.mu.Unlock()
+	logger.Printf("loaded %d users from htpasswd file %s", len(users), path)
 }
 
 // Validate checks a users password against the HtpasswdFile entries
 func (h *HtpasswdFile) Validate(user string, password string) bool {
+	h.mu.RLock()
 	realPassword, exists := h.Users[user]
+	h.mu.RUnlock()
 	if !exists {
 		return false
 	}
 
-	shaPrefix := realPassword[:5]
-	if shaPrefix == "{SHA}" {
+	if strings.HasPrefix(realPassword, "{SHA}") {
 		shaValue := realPassword[5:]
 		d := sha1.New()
 		d.Write([]byte(password))
 		return shaValue == base64.StdEncoding.EncodeToString(d.Sum(nil))
 	}
 
-	bcryptPrefix := realPassword[:4]
-	if bcryptPrefix == "$2a$" || bcryptPrefix == "$2b$" || bcryptPrefix == "$2x$" || bcryptPrefix == "$2y$" {
-		return bcrypt.CompareHashAndPassword([]byte(realPassword), []byte(password)) == nil
+	for _, prefix := range []string{"$2a$", "$2b$", "$2x$", "$2y$"} {
+		if strings.HasPrefix(realPassword, prefix) {
+			return bcrypt.CompareHashAndPassword([]byte(realPassword), []byte(password)) == nil
+		}
 	}
 
 	logger.Printf("Invalid htpasswd entry for %s. Must be a SHA or bcrypt entry.", user)
@@ -1,8 +1,10 @@
-package main
+package oauthproxy
 
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -36,3 +38,28 @@ func TestBcrypt(t *testing.T) {
 	valid = h.Validate("testuser2", "top-secret")
 	assert.Equal(t, valid, true)
 }
+
+func TestHtpasswdReload(t *testing.T) {
+	f, err := ioutil.TempFile("", "htpasswd")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString("testuser:{SHA}PaVBVZkYqAjCQCu6UBL2xgsnZhw=\n")
+	f.Close()
+
+	h, err := NewHtpasswdFromFile(f.Name())
+	assert.NoError(t, err)
+	assert.True(t, h.Validate("testuser", "asdf"))
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(f.Name(), []byte(fmt.Sprintf("otheruser:%s\nbroken:x\n", hash)), 0600))
+	h.Reload(f.Name())
+	assert.False(t, h.Validate("testuser", "asdf"))
+	assert.True(t, h.Validate("otheruser", "password"))
+	assert.False(t, h.Validate("broken", "x"))
+
+	// the entries are kept while the file is missing
+	os.Remove(f.Name())
+	h.Reload(f.Name())
+	assert.True(t, h.Validate("otheruser", "password"))
+}
@@ -1,30 +1,140 @@
-package main
+package oauthproxy
 
 import (
+	"context"
 	"crypto/tls"
+	"fmt"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/OpusCapita/oauth2_proxy/logger"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 // Server represents an HTTP server
 type Server struct {
 	Handler http.Handler
 	Opts    *Options
+
+	mu      sync.Mutex
+	servers []*http.Server
+	active  sync.WaitGroup
+	acme    *autocert.Manager
+
+	// activated holds the sockets passed by systemd socket activation or by
+	// the previous binary on an upgrade. Unnamed sockets are used in order,
+	// httpsIndex is the HTTPS listener's.
+	activated  []activatedListener
+	httpsIndex int
+	// starting counts the listeners not serving yet
+	starting sync.WaitGroup
 }
 
-// ListenAndServe will serve traffic on HTTP or HTTPS depending on TLS options
-func (s *Server) ListenAndServe() {
-	if s.Opts.TLSKeyFile != "" || s.Opts.TLSCertFile != "" {
-		s.ServeHTTPS()
-	} else {
-		s.ServeHTTP()
+// ListenAndServe will serve traffic on HTTP or HTTPS depending on TLS options.
+// It returns http.ErrServerClosed once Shutdown has been called.
+func (s *Server) ListenAndServe() error {
+	s.activated = sockets.inherited
+	listeners := 1
+	if len(s.Opts.ACMEDomains) > 0 || ((s.Opts.tlsEnabled() || s.Opts.vaultCertificate != nil) && s.Opts.ForceHTTPS) {
+		listeners = 2
+	}
+	s.starting.Add(listeners)
+	go func() {
+		s.starting.Wait()
+		sockets.signalReady()
+	}()
+
+	if len(s.Opts.ACMEDomains) > 0 {
+		// the HTTP listener answers ACME HTTP-01 challenges
+		s.acme = newACMEManager(s.Opts)
+		s.httpsIndex = 1
+		go s.ServeHTTP()
+		return s.ServeHTTPS()
+	}
+	if s.Opts.tlsEnabled() || s.Opts.vaultCertificate != nil {
+		if s.Opts.ForceHTTPS {
+			s.httpsIndex = 1
+			go s.ServeHTTP()
+		}
+		return s.ServeHTTPS()
+	}
+	return s.ServeHTTP()
+}
+
+// Shutdown stops accepting new connections and waits for in flight requests,
+// including proxied websocket connections, to finish or for ctx to be done
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	servers := s.servers
+	s.mu.Unlock()
+
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
+// serve registers srv for Shutdown and serves ln with it. Requests are
+// counted while their handler runs since http.Server.Shutdown does not wait
+// for hijacked (websocket) connections.
+func (s *Server) serve(srv *http.Server, ln net.Listener) error {
+	h := srv.Handler
+	srv.Handler = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		s.active.Add(1)
+		defer s.active.Done()
+		h.ServeHTTP(rw, req)
+	})
+
+	s.mu.Lock()
+	s.servers = append(s.servers, srv)
+	s.mu.Unlock()
+	return srv.Serve(ln)
+}
+
+// http2Server returns the HTTP/2 server settings for the proxy's listeners
+func (s *Server) http2Server() *http2.Server {
+	return &http2.Server{
+		MaxConcurrentStreams: uint32(s.Opts.HTTP2MaxConcurrentStreams),
+	}
+}
+
+// newACMEManager creates an autocert manager obtaining certificates for the
+// configured ACME domains
+func newACMEManager(opts *Options) *autocert.Manager {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(opts.ACMEDomains...),
+		Cache:      autocert.DirCache(opts.ACMECacheDir),
+		Email:      opts.ACMEEmail,
+	}
+	if opts.ACMEDirectoryURL != "" {
+		m.Client = &acme.Client{DirectoryURL: opts.ACMEDirectoryURL}
+	}
+	return m
+}
+
 // Used with gcpHealthcheck()
 const userAgentHeader = "User-Agent"
 const googleHealthCheckUserAgent = "GoogleHC/1.0"
@@ -65,7 +175,7 @@ func gcpHealthcheck(h http.Handler) http.Handler {
 }
 
 // ServeHTTP constructs a net.Listener and starts handling HTTP requests
-func (s *Server) ServeHTTP() {
+func (s *Server) ServeHTTP() error {
 	HTTPAddress := s.Opts.HTTPAddress
 	var scheme string
 
@@ -85,54 +195,194 @@ func (s *Server) ServeHTTP() {
 	slice := strings.SplitN(HTTPAddress, "//", 2)
 	listenAddr := slice[len(slice)-1]
 
-	listener, err := net.Listen(networkType, listenAddr)
-	if err != nil {
-		logger.Fatalf("FATAL: listen (%s, %s) failed - %s", networkType, listenAddr, err)
+	listener := s.inheritedListener("http", 0)
+	if listener != nil {
+		logger.Printf("HTTP: listening on %s passed by systemd or the previous process", listener.Addr())
+	} else {
+		if networkType == "unix" {
+			removeStaleSocket(listenAddr)
+		}
+		var err error
+		listener, err = net.Listen(networkType, listenAddr)
+		if err != nil {
+			logger.Fatalf("FATAL: listen (%s, %s) failed - %s", networkType, listenAddr, err)
+		}
+		if networkType == "unix" && s.Opts.socketFileMode != 0 {
+			if err := os.Chmod(listenAddr, s.Opts.socketFileMode); err != nil {
+				logger.Fatalf("FATAL: setting mode of socket %s failed - %s", listenAddr, err)
+			}
+		}
+		logger.Printf("HTTP: listening on %s", listenAddr)
 	}
-	logger.Printf("HTTP: listening on %s", listenAddr)
+	sockets.add("http", listener)
 
-	server := &http.Server{Handler: s.Handler}
-	err = server.Serve(listener)
-	if err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
+	handler := s.Handler
+	if s.Opts.ForceHTTPS && (s.acme != nil || s.Opts.tlsEnabled() || s.Opts.vaultCertificate != nil) {
+		handler = http.HandlerFunc(s.redirectToHTTPS)
+	}
+	if s.Opts.H2C {
+		handler = h2c.NewHandler(handler, s.http2Server())
+	}
+	if s.acme != nil {
+		handler = s.acme.HTTPHandler(handler)
+	}
+	server := &http.Server{Handler: handler}
+	s.starting.Done()
+	err := s.serve(server, listener)
+	if err != nil && err != http.ErrServerClosed && !strings.Contains(err.Error(), "use of closed network connection") {
 		logger.Printf("ERROR: http.Serve() - %s", err)
 	}
 
 	logger.Printf("HTTP: closing %s", listener.Addr())
+	return err
+}
+
+// removeStaleSocket removes a unix socket left behind by a previous instance
+// which did not shut down cleanly, so that listening on it does not fail
+func removeStaleSocket(path string) {
+	info, err := os.Stat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		// still in use by a running process
+		conn.Close()
+		return
+	}
+	os.Remove(path)
+}
+
+// redirectToHTTPS permanently redirects a plain HTTP request to the same URL
+// on the HTTPS listener
+func (s *Server) redirectToHTTPS(rw http.ResponseWriter, req *http.Request) {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if _, port, err := net.SplitHostPort(s.Opts.HTTPSAddress); err == nil && port != "" && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	target := url.URL{Scheme: httpsScheme, Host: host, Path: req.URL.Path, RawQuery: req.URL.RawQuery}
+	http.Redirect(rw, req, target.String(), http.StatusMovedPermanently)
+}
+
+// hsts adds a Strict-Transport-Security header to every response
+func hsts(h http.Handler, maxAge time.Duration) http.Handler {
+	value := fmt.Sprintf("max-age=%d", int64(maxAge/time.Second))
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Strict-Transport-Security", value)
+		h.ServeHTTP(rw, req)
+	})
 }
 
 // ServeHTTPS constructs a net.Listener and starts handling HTTPS requests
-func (s *Server) ServeHTTPS() {
+func (s *Server) ServeHTTPS() error {
 	addr := s.Opts.HTTPSAddress
 	config := &tls.Config{
-		MinVersion: tls.VersionTLS12,
-		MaxVersion: tls.VersionTLS12,
+		MinVersion:               s.Opts.tlsMinVersion,
+		CipherSuites:             s.Opts.tlsCipherSuites,
+		CurvePreferences:         s.Opts.tlsCurves,
+		PreferServerCipherSuites: len(s.Opts.tlsCipherSuites) > 0,
 	}
 	if config.NextProtos == nil {
 		config.NextProtos = []string{"http/1.1"}
+		if s.Opts.HTTP2 {
+			config.NextProtos = []string{"h2", "http/1.1"}
+		}
 	}
 
 	var err error
-	config.Certificates = make([]tls.Certificate, 1)
-	config.Certificates[0], err = tls.LoadX509KeyPair(s.Opts.TLSCertFile, s.Opts.TLSKeyFile)
-	if err != nil {
-		logger.Fatalf("FATAL: loading tls config (%s, %s) failed - %s", s.Opts.TLSCertFile, s.Opts.TLSKeyFile, err)
+	if s.acme != nil {
+		config.GetCertificate = s.acme.GetCertificate
+		// allow the ACME TLS-ALPN-01 challenge
+		config.NextProtos = append(config.NextProtos, acme.ALPNProto)
+	} else if s.Opts.vaultCertificate != nil {
+		if err := s.Opts.vaultCertificate.Issue(); err != nil {
+			logger.Fatalf("FATAL: loading tls config failed - %s", err)
+		}
+		// the certificate is renewed for the lifetime of the listener
+		go s.Opts.vaultCertificate.Run(nil)
+		config.GetCertificate = s.Opts.vaultCertificate.GetCertificate
+	} else {
+		config.Certificates, err = loadCertificates(s.Opts)
+		if err != nil {
+			logger.Fatalf("FATAL: loading tls config failed - %s", err)
+		}
+		// select the certificate by SNI server name
+		config.BuildNameToCertificate()
 	}
 
-	ln, err := net.Listen("tcp", addr)
-	if err != nil {
-		logger.Fatalf("FATAL: listen (%s) failed - %s", addr, err)
+	ln := s.inheritedListener("https", s.httpsIndex)
+	if ln != nil {
+		logger.Printf("HTTPS: listening on %s passed by systemd or the previous process", ln.Addr())
+	} else {
+		ln, err = net.Listen("tcp", addr)
+		if err != nil {
+			logger.Fatalf("FATAL: listen (%s) failed - %s", addr, err)
+		}
+		logger.Printf("HTTPS: listening on %s", ln.Addr())
+	}
+	sockets.add("https", ln)
+	if tcpListener, ok := ln.(*net.TCPListener); ok {
+		ln = tcpKeepAliveListener{tcpListener}
 	}
-	logger.Printf("HTTPS: listening on %s", ln.Addr())
 
-	tlsListener := tls.NewListener(tcpKeepAliveListener{ln.(*net.TCPListener)}, config)
-	srv := &http.Server{Handler: s.Handler}
-	err = srv.Serve(tlsListener)
+	tlsListener := tls.NewListener(ln, config)
+	handler := s.Handler
+	if s.Opts.HSTSMaxAge > 0 {
+		handler = hsts(handler, s.Opts.HSTSMaxAge)
+	}
+	srv := &http.Server{Handler: handler}
+	if s.Opts.HTTP2 {
+		if err := http2.ConfigureServer(srv, s.http2Server()); err != nil {
+			logger.Fatalf("FATAL: configuring http2 failed - %s", err)
+		}
+	}
+	s.starting.Done()
+	err = s.serve(srv, tlsListener)
 
-	if err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
+	if err != nil && err != http.ErrServerClosed && !strings.Contains(err.Error(), "use of closed network connection") {
 		logger.Printf("ERROR: https.Serve() - %s", err)
 	}
 
 	logger.Printf("HTTPS: closing %s", tlsListener.Addr())
+	return err
+}
+
+// loadCertificates loads the certificate and key pairs configured with
+// tls-cert/tls-key, tls-cert-pair and tls-cert-dir. In tls-cert-dir each
+// <name>.crt file is paired with the <name>.key file next to it.
+func loadCertificates(opts *Options) ([]tls.Certificate, error) {
+	var pairs [][2]string
+	if opts.TLSCertFile != "" || opts.TLSKeyFile != "" {
+		pairs = append(pairs, [2]string{opts.TLSCertFile, opts.TLSKeyFile})
+	}
+	for _, pair := range opts.TLSCertPairs {
+		files := strings.SplitN(pair, ":", 2)
+		pairs = append(pairs, [2]string{files[0], files[1]})
+	}
+	if opts.TLSCertDir != "" {
+		certFiles, err := filepath.Glob(filepath.Join(opts.TLSCertDir, "*.crt"))
+		if err != nil {
+			return nil, err
+		}
+		for _, certFile := range certFiles {
+			pairs = append(pairs, [2]string{certFile, strings.TrimSuffix(certFile, ".crt") + ".key"})
+		}
+	}
+
+	var certs []tls.Certificate
+	for _, pair := range pairs {
+		cert, err := tls.LoadX509KeyPair(pair[0], pair[1])
+		if err != nil {
+			return nil, fmt.Errorf("(%s, %s) %s", pair[0], pair[1], err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates found in %s", opts.TLSCertDir)
+	}
+	return certs, nil
 }
 
 // tcpKeepAliveListener sets TCP keep-alive timeouts on accepted
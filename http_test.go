@@ -1,9 +1,14 @@
-package main
+package oauthproxy
 
 import (
+	"context"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -103,3 +108,66 @@ func TestGCPHealthcheckNotIngressPut(t *testing.T) {
 
 	assert.Equal(t, "test", rw.Body.String())
 }
+
+func TestServerShutdownWaitsForActiveRequests(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	s := &Server{Opts: NewOptions()}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		close(started)
+		<-release
+	})}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	go s.serve(srv, ln)
+	go http.Get("http://" + ln.Addr().String())
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, s.Shutdown(ctx))
+
+	close(release)
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Equal(t, nil, s.Shutdown(ctx))
+}
+
+func TestLoadCertificatesEmptyDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oauth2_proxy_certs")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	opts := NewOptions()
+	opts.TLSCertDir = dir
+	_, err = loadCertificates(opts)
+	assert.Equal(t, "no certificates found in "+dir, err.Error())
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	opts := NewOptions()
+	opts.HTTPSAddress = ":8443"
+	s := &Server{Opts: opts}
+
+	rw := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/foo?bar=baz", nil)
+	r.Host = "example.com:8080"
+	s.redirectToHTTPS(rw, r)
+
+	assert.Equal(t, http.StatusMovedPermanently, rw.Code)
+	assert.Equal(t, "https://example.com:8443/foo?bar=baz", rw.Header().Get("Location"))
+}
+
+func TestHSTS(t *testing.T) {
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("test"))
+	}
+
+	h := hsts(http.HandlerFunc(handler), 24*time.Hour)
+	rw := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/", nil)
+	h.ServeHTTP(rw, r)
+
+	assert.Equal(t, "max-age=86400", rw.Header().Get("Strict-Transport-Security"))
+	assert.Equal(t, "test", rw.Body.String())
+}
@@ -0,0 +1,232 @@
+package oauthproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/OpusCapita/oauth2_proxy/logger"
+)
+
+const (
+	// kubeServiceAccountDir holds the credentials of the service account
+	// of a pod
+	kubeServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	// proxyPolicyAPI is the API group and version of the ProxyPolicy
+	// custom resource
+	proxyPolicyAPI = "oauth2-proxy.opuscapita.com/v1alpha1"
+	// kubeRetryInterval is how long to wait after the API server failed
+	kubeRetryInterval = 10 * time.Second
+)
+
+// kubePolicies builds authorization policies from the ProxyPolicy custom
+// resources of a Kubernetes cluster, watching them for changes. The spec of
+// a ProxyPolicy has the hosts, rules and access_hours of the
+// authz-policy-file. Each resource is a policy of its own, so that the
+// entries of one team's resource only decide the requests they match and
+// cannot shadow those of another.
+type kubePolicies struct {
+	apiServer string
+	tokenFile string
+	namespace string
+	client    *http.Client
+	retry     time.Duration
+
+	// policies holds the []*authzPolicy of the last listing, unset until
+	// the resources are first listed
+	policies atomic.Value
+}
+
+// proxyPolicyList is a listing of ProxyPolicy resources
+type proxyPolicyList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []proxyPolicy `json:"items"`
+}
+
+type proxyPolicy struct {
+	Metadata struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"metadata"`
+	Spec json.RawMessage `json:"spec"`
+}
+
+// parseKubePolicies sets up the in-cluster client of the API server if
+// kube-proxy-policies is enabled
+func parseKubePolicies(o *Options, msgs []string) (*kubePolicies, []string) {
+	if !o.KubeProxyPolicies {
+		return nil, msgs
+	}
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, append(msgs, "kube-proxy-policies requires running in a Kubernetes cluster")
+	}
+	ca, err := ioutil.ReadFile(filepath.Join(kubeServiceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, append(msgs, fmt.Sprintf("kube-proxy-policies: %s", err))
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, append(msgs, "kube-proxy-policies: invalid service account ca.crt")
+	}
+	return &kubePolicies{
+		apiServer: "https://" + net.JoinHostPort(host, port),
+		tokenFile: filepath.Join(kubeServiceAccountDir, "token"),
+		namespace: o.KubeProxyPolicyNamespace,
+		client: &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		}},
+		retry: kubeRetryInterval,
+	}, msgs
+}
+
+// Policies returns the policies of the ProxyPolicy resources, in the order
+// of their namespace and name, and whether they have been listed yet
+func (k *kubePolicies) Policies() ([]*authzPolicy, bool) {
+	if k == nil {
+		return nil, false
+	}
+	policies, ok := k.policies.Load().([]*authzPolicy)
+	return policies, ok
+}
+
+// url returns the URL of the ProxyPolicy resources in the namespace, or all
+// namespaces
+func (k *kubePolicies) url() string {
+	if k.namespace == "" {
+		return fmt.Sprintf("%s/apis/%s/proxypolicies", k.apiServer, proxyPolicyAPI)
+	}
+	return fmt.Sprintf("%s/apis/%s/namespaces/%s/proxypolicies", k.apiServer, proxyPolicyAPI, k.namespace)
+}
+
+func (k *kubePolicies) get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if k.tokenFile != "" {
+		// the token is read for every request as it is rotated
+		token, err := ioutil.ReadFile(k.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+string(token))
+	}
+	resp, err := k.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("got %d from %s %s", resp.StatusCode, url, body)
+	}
+	return resp, nil
+}
+
+// Watch keeps the policy up to date with the ProxyPolicy resources until
+// done is closed
+func (k *kubePolicies) Watch(done <-chan bool) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-done
+		cancel()
+	}()
+	for {
+		err := k.watch(ctx)
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if err != nil {
+			logger.Printf("error watching ProxyPolicy resources: %s", err)
+			select {
+			case <-done:
+				return
+			case <-time.After(k.retry):
+			}
+		}
+	}
+}
+
+// watch lists the resources and then relists them whenever a change is
+// reported, until the API server ends the watch
+func (k *kubePolicies) watch(ctx context.Context) error {
+	version, err := k.list(ctx)
+	if err != nil {
+		return err
+	}
+	resp, err := k.get(ctx, k.url()+"?watch=true&resourceVersion="+version)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	d := json.NewDecoder(resp.Body)
+	for {
+		var event struct {
+			Type   string          `json:"type"`
+			Object json.RawMessage `json:"object"`
+		}
+		if err := d.Decode(&event); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if event.Type == "ERROR" {
+			// e.g. 410 Gone when the resource version is too old
+			return fmt.Errorf("watch failed: %s", event.Object)
+		}
+		if _, err := k.list(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// list builds the policies of the current resources, returning their
+// resource version. Resources with errors are left out, so that one team's
+// mistake does not lock out the others.
+func (k *kubePolicies) list(ctx context.Context) (string, error) {
+	resp, err := k.get(ctx, k.url())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var list proxyPolicyList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return "", fmt.Errorf("invalid ProxyPolicy list: %s", err)
+	}
+
+	sort.Slice(list.Items, func(i, j int) bool {
+		a, b := list.Items[i].Metadata, list.Items[j].Metadata
+		return a.Namespace < b.Namespace || a.Namespace == b.Namespace && a.Name < b.Name
+	})
+	policies := []*authzPolicy{}
+	for _, item := range list.Items {
+		pol, err := compileAuthzPolicy(item.Spec)
+		if err != nil {
+			logger.Printf("ignoring ProxyPolicy %s/%s: %s", item.Metadata.Namespace, item.Metadata.Name, err)
+			continue
+		}
+		policies = append(policies, pol)
+	}
+	if _, loaded := k.Policies(); !loaded {
+		logger.Printf("loaded %d ProxyPolicy resources", len(list.Items))
+	}
+	k.policies.Store(policies)
+	return list.Metadata.ResourceVersion, nil
+}
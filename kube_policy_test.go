@@ -0,0 +1,167 @@
+package oauthproxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	sessionsapi "github.com/OpusCapita/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+// testKubeAPI serves ProxyPolicy listings and a watch reporting a change
+// whenever one is sent on events
+type testKubeAPI struct {
+	mu      sync.Mutex
+	version int
+	items   string
+	events  chan string
+}
+
+func (api *testKubeAPI) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Header.Get("Authorization") != "Bearer kube-token" {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if req.URL.Path != "/apis/"+proxyPolicyAPI+"/namespaces/apps/proxypolicies" {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if req.URL.Query().Get("watch") != "true" {
+		api.mu.Lock()
+		defer api.mu.Unlock()
+		fmt.Fprintf(rw, `{"metadata": {"resourceVersion": "%d"}, "items": [%s]}`, api.version, api.items)
+		return
+	}
+	rw.(http.Flusher).Flush()
+	for {
+		select {
+		case event := <-api.events:
+			fmt.Fprintln(rw, event)
+			rw.(http.Flusher).Flush()
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+func (api *testKubeAPI) set(items string) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.version++
+	api.items = items
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	for i := 0; i < 100 && !condition(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, condition())
+}
+
+func TestKubePoliciesWatch(t *testing.T) {
+	token, err := ioutil.TempFile("", "kube-token")
+	assert.NoError(t, err)
+	defer os.Remove(token.Name())
+	token.WriteString("kube-token")
+	token.Close()
+
+	api := &testKubeAPI{events: make(chan string)}
+	api.set(`
+{"metadata": {"name": "admin", "namespace": "apps"}, "spec": {"rules": [{"path": "/admin/**", "groups": ["ops"]}]}},
+{"metadata": {"name": "broken", "namespace": "apps"}, "spec": {"rules": [{"path": "admin/**"}]}}`)
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	k := &kubePolicies{
+		apiServer: server.URL,
+		tokenFile: token.Name(),
+		namespace: "apps",
+		client:    server.Client(),
+		retry:     10 * time.Millisecond,
+	}
+	_, loaded := k.Policies()
+	assert.False(t, loaded)
+
+	done := make(chan bool)
+	stopped := make(chan bool)
+	go func() {
+		k.Watch(done)
+		close(stopped)
+	}()
+	waitFor(t, func() bool {
+		_, loaded := k.Policies()
+		return loaded
+	})
+	policies, _ := k.Policies()
+	assert.Len(t, policies, 1)
+	allowed, _ := policies[0].Authorize("GET", "/admin/", &sessionsapi.SessionState{Email: "jane@example.com"})
+	assert.False(t, allowed)
+
+	api.set(`{"metadata": {"name": "admin", "namespace": "apps"}, "spec": {"rules": [{"path": "/admin/**"}]}}`)
+	api.events <- `{"type": "MODIFIED", "object": {}}`
+	waitFor(t, func() bool {
+		policies, _ := k.Policies()
+		allowed, _ := policies[0].Authorize("GET", "/admin/", &sessionsapi.SessionState{Email: "jane@example.com"})
+		return allowed
+	})
+
+	close(done)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Error("Watch did not stop")
+	}
+}
+
+func TestKubePoliciesNotLoaded(t *testing.T) {
+	opts := NewOptions()
+	opts.CookieSecret = "foobar"
+	opts.DevFakeIdentity = "jane@example.com"
+	assert.NoError(t, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(email string) bool { return true })
+	proxy.kubePolicies = &kubePolicies{}
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	s := &sessionsapi.SessionState{Email: "jane@example.com"}
+	assert.False(t, proxy.authorized(req, "GET", "/", s))
+	proxy.kubePolicies.policies.Store([]*authzPolicy{})
+	assert.True(t, proxy.authorized(req, "GET", "/", s))
+}
+
+func TestKubePoliciesDoNotShadowEachOther(t *testing.T) {
+	opts := NewOptions()
+	opts.CookieSecret = "foobar"
+	opts.DevFakeIdentity = "jane@example.com"
+	assert.NoError(t, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(email string) bool { return true })
+	proxy.kubePolicies = &kubePolicies{}
+
+	// a broad rule of one resource does not let requests past the more
+	// specific rule of another, whatever their order
+	open, err := compileAuthzPolicy([]byte(`{"rules": [{"path": "/**"}]}`))
+	assert.NoError(t, err)
+	finance, err := compileAuthzPolicy([]byte(`{"rules": [{"path": "/reports/**", "groups": ["finance"]}]}`))
+	assert.NoError(t, err)
+	proxy.kubePolicies.policies.Store([]*authzPolicy{open, finance})
+
+	req, _ := http.NewRequest("GET", "/reports/q1", nil)
+	s := &sessionsapi.SessionState{Email: "jane@example.com"}
+	assert.False(t, proxy.authorized(req, "GET", "/reports/q1", s))
+	assert.True(t, proxy.authorized(req, "GET", "/home", s))
+	s.Groups = []string{"finance"}
+	assert.True(t, proxy.authorized(req, "GET", "/reports/q1", s))
+}
+
+func TestParseKubePoliciesOutsideCluster(t *testing.T) {
+	os.Unsetenv("KUBERNETES_SERVICE_HOST")
+	o := NewOptions()
+	o.KubeProxyPolicies = true
+	_, msgs := parseKubePolicies(o, nil)
+	assert.Equal(t, []string{"kube-proxy-policies requires running in a Kubernetes cluster"}, msgs)
+}
@@ -0,0 +1,110 @@
+package oauthproxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/OpusCapita/oauth2_proxy/logger"
+	sessionsapi "github.com/OpusCapita/oauth2_proxy/pkg/apis/sessions"
+)
+
+// leaderLockName is the name of the lease held by the leader
+const leaderLockName = "leader"
+
+// leaderElection elects, among the instances sharing a session store, the
+// one which runs the background jobs on the store, by holding a lease in the
+// store. A nil leaderElection, when the store is not shared or the election
+// is disabled, always leads.
+type leaderElection struct {
+	locker sessionsapi.Locker
+	holder string
+	lease  time.Duration
+	// leading is 1 while holding the lease
+	leading int32
+	// stopped is closed once Run has released the lease
+	stopped chan struct{}
+}
+
+// newLeaderElection returns the election of the store, or nil if the store
+// cannot hold leases or lease is not positive
+func newLeaderElection(store sessionsapi.SessionStore, lease time.Duration) *leaderElection {
+	locker, ok := store.(sessionsapi.Locker)
+	if !ok || lease <= 0 {
+		return nil
+	}
+	hostname, _ := os.Hostname()
+	b := make([]byte, 8)
+	rand.Read(b)
+	return &leaderElection{
+		locker:  locker,
+		holder:  fmt.Sprintf("%s-%s", hostname, hex.EncodeToString(b)),
+		lease:   lease,
+		stopped: make(chan struct{}),
+	}
+}
+
+// Leading returns whether this instance should run the background jobs on
+// the store
+func (e *leaderElection) Leading() bool {
+	return e == nil || atomic.LoadInt32(&e.leading) == 1
+}
+
+// Run acquires the lease, or renews it while leading, every third of its
+// duration until done is closed, and then releases it so that another
+// instance takes over without waiting for it to expire
+func (e *leaderElection) Run(done <-chan bool) {
+	if e == nil {
+		return
+	}
+	defer close(e.stopped)
+	ticker := time.NewTicker(e.lease / 3)
+	defer ticker.Stop()
+	for {
+		e.campaign()
+		select {
+		case <-done:
+			atomic.StoreInt32(&e.leading, 0)
+			if err := e.locker.Unlock(leaderLockName, e.holder); err != nil {
+				logger.Printf("error releasing the leader lease: %s", err)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Wait waits for up to timeout until Run has released the lease, so that the
+// process does not exit while still holding it
+func (e *leaderElection) Wait(timeout time.Duration) {
+	if e == nil {
+		return
+	}
+	select {
+	case <-e.stopped:
+	case <-time.After(timeout):
+	}
+}
+
+// campaign acquires or renews the lease. An instance which cannot reach the
+// store stops leading, as its lease may have expired meanwhile.
+func (e *leaderElection) campaign() {
+	leading, err := e.locker.Lock(leaderLockName, e.holder, e.lease)
+	if err != nil {
+		logger.Printf("error renewing the leader lease: %s", err)
+	}
+	var value int32
+	if leading {
+		value = 1
+	}
+	if previous := atomic.SwapInt32(&e.leading, value); previous != value {
+		if leading {
+			logger.Printf("elected leader %s, running the background jobs on the session store", e.holder)
+		} else {
+			logger.Printf("no longer the leader, %s stops running the background jobs on the session store", e.holder)
+		}
+	}
+}
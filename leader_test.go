@@ -0,0 +1,46 @@
+package oauthproxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/OpusCapita/oauth2_proxy/pkg/apis/options"
+	"github.com/OpusCapita/oauth2_proxy/pkg/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLeaderElection(t *testing.T) {
+	mr, err := miniredis.Run()
+	assert.NoError(t, err)
+	defer mr.Close()
+	store, err := sessions.NewSessionStore(&options.SessionOptions{
+		Type:              options.RedisSessionStoreType,
+		RedisStoreOptions: options.RedisStoreOptions{RedisConnectionURL: "redis://" + mr.Addr()},
+	}, &options.CookieOptions{CookieName: "_oauth2_proxy"})
+	assert.NoError(t, err)
+
+	assert.Nil(t, newLeaderElection(store, 0))
+	assert.True(t, (*leaderElection)(nil).Leading())
+
+	first := newLeaderElection(store, time.Minute)
+	second := newLeaderElection(store, time.Minute)
+	first.campaign()
+	second.campaign()
+	assert.True(t, first.Leading())
+	assert.False(t, second.Leading())
+
+	// the leader releases the lease when stopped
+	done := make(chan bool)
+	close(done)
+	first.Run(done)
+	first.Wait(time.Second)
+	assert.False(t, first.Leading())
+	second.campaign()
+	assert.True(t, second.Leading())
+
+	// and an instance which cannot reach the store stops leading
+	mr.Close()
+	second.campaign()
+	assert.False(t, second.Leading())
+}
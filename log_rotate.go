@@ -0,0 +1,32 @@
+package oauthproxy
+
+import (
+	"sync"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// intervalRotator starts a new log file whenever a multiple of the interval
+// has passed, in addition to the rotation by size of the lumberjack.Logger.
+// An interval of 24h rotates the file at midnight UTC.
+type intervalRotator struct {
+	*lumberjack.Logger
+	interval time.Duration
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+func (r *intervalRotator) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	now := time.Now()
+	if r.next.IsZero() {
+		r.next = now.Truncate(r.interval).Add(r.interval)
+	} else if !now.Before(r.next) {
+		r.Logger.Rotate()
+		r.next = now.Truncate(r.interval).Add(r.interval)
+	}
+	r.mu.Unlock()
+	return r.Logger.Write(p)
+}
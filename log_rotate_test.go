@@ -0,0 +1,38 @@
+package oauthproxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+func TestIntervalRotator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logs")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	r := &intervalRotator{
+		Logger:   &lumberjack.Logger{Filename: filepath.Join(dir, "access.log")},
+		interval: time.Hour,
+	}
+	defer r.Close()
+
+	r.Write([]byte("first\n"))
+	assert.True(t, r.next.After(time.Now()))
+	assert.Equal(t, time.Duration(0), r.next.Sub(r.next.Truncate(time.Hour)))
+	r.Write([]byte("second\n"))
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 1)
+
+	r.next = time.Now().Add(-time.Second)
+	r.Write([]byte("third\n"))
+	files, _ = ioutil.ReadDir(dir)
+	assert.Len(t, files, 2)
+	current, _ := ioutil.ReadFile(r.Filename)
+	assert.Equal(t, "third\n", string(current))
+}
@@ -3,11 +3,13 @@ package logger
 import (
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"runtime"
+	"strings"
 	"sync"
 	"text/template"
 	"time"
@@ -23,6 +25,14 @@ const (
 	DefaultAuthLoggingFormat = "{{.Client}} - {{.Username}} [{{.Timestamp}}] [{{.Status}}] {{.Message}}"
 	// DefaultRequestLoggingFormat defines the default request log format
 	DefaultRequestLoggingFormat = "{{.Client}} - {{.Username}} [{{.Timestamp}}] {{.Host}} {{.RequestMethod}} {{.Upstream}} {{.RequestURI}} {{.Protocol}} {{.UserAgent}} {{.StatusCode}} {{.ResponseSize}} {{.RequestDuration}}"
+	// CombinedRequestLoggingFormat defines the request log format of the
+	// Apache Combined Log Format
+	CombinedRequestLoggingFormat = "{{.Client}} - {{.Username}} [{{.CLFTimestamp}}] {{.Request}} {{.StatusCode}} {{.ResponseSize}} {{.Referer}} {{.UserAgent}}"
+
+	// StandardFormat names the default format of a type of logging
+	StandardFormat = "standard"
+	// CombinedFormat names the Apache Combined Log Format for request logging
+	CombinedFormat = "combined"
 
 	// AuthSuccess indicates that an auth attempt has succeeded explicitly
 	AuthSuccess AuthStatus = "AuthSuccess"
@@ -30,6 +40,9 @@ const (
 	AuthFailure AuthStatus = "AuthFailure"
 	// AuthError indicates that an auth attempt has failed due to an error
 	AuthError AuthStatus = "AuthError"
+	// AuthDryRun indicates that a dry run authorization rule would have
+	// denied a request it did not deny
+	AuthDryRun AuthStatus = "AuthDryRun"
 
 	// Llongfile flag to log full file name and line number: /a/b/c/d.go:23
 	Llongfile = 1 << iota
@@ -41,6 +54,32 @@ const (
 	LstdFlags = Lshortfile
 )
 
+// clfTimestampFormat is the timestamp format of the Common Log Format
+const clfTimestampFormat = "02/Jan/2006:15:04:05 -0700"
+
+// Named formats for each type of logging
+var (
+	stdLogFormats = map[string]string{
+		StandardFormat: DefaultStandardLoggingFormat,
+	}
+	authLogFormats = map[string]string{
+		StandardFormat: DefaultAuthLoggingFormat,
+	}
+	reqLogFormats = map[string]string{
+		StandardFormat: DefaultRequestLoggingFormat,
+		CombinedFormat: CombinedRequestLoggingFormat,
+	}
+)
+
+// parseTemplate parses a logging format, which is either the name of one of
+// the formats or a template
+func parseTemplate(name string, formats map[string]string, format string) (*template.Template, error) {
+	if f, ok := formats[format]; ok {
+		format = f
+	}
+	return template.New(name).Parse(format)
+}
+
 // These are the containers for all values that are available as variables in the logging formats.
 // All values are pre-formatted strings so it is easy to use them in the format string.
 type stdLogMessageData struct {
@@ -63,8 +102,12 @@ type authLogMessageData struct {
 
 type reqLogMessageData struct {
 	Client,
+	CLFTimestamp,
 	Host,
 	Protocol,
+	Referer,
+	Request,
+	AuthDuration,
 	RequestDuration,
 	RequestMethod,
 	RequestURI,
@@ -72,10 +115,21 @@ type reqLogMessageData struct {
 	StatusCode,
 	Timestamp,
 	Upstream,
+	UpstreamTTFB,
 	UserAgent,
 	Username string
 }
 
+// RequestTimings break down the duration of a request for the request log.
+// Durations which were not measured are zero.
+type RequestTimings struct {
+	// Auth is the time spent checking the session and authorization
+	Auth time.Duration
+	// UpstreamFirstByte is the time from passing the request to the upstream
+	// until it started to respond
+	UpstreamFirstByte time.Duration
+}
+
 // A Logger represents an active logging object that generates lines of
 // output to an io.Writer passed through a formatter. Each logging
 // operation makes a single call to the Writer's Write method. A Logger
@@ -85,12 +139,29 @@ type Logger struct {
 	mu             sync.Mutex
 	flag           int
 	writer         io.Writer
+	stdWriter      io.Writer
+	authWriter     io.Writer
+	reqWriter      io.Writer
 	stdEnabled     bool
 	authEnabled    bool
 	reqEnabled     bool
 	stdLogTemplate *template.Template
 	authTemplate   *template.Template
 	reqTemplate    *template.Template
+	trustedProxies []*net.IPNet
+
+	// requests which are not logged
+	reqExcludePaths  []string
+	reqExcludeStatus []string
+
+	// sampling of the successful requests logged
+	reqSampleRatio  float64
+	reqSampleLimit  int
+	reqSampleSecond int64
+	reqSampleCount  int
+
+	// redactor redacts the emails and user names logged, unless nil
+	redactor *redactor
 }
 
 // New creates a new Standarderr Logger.
@@ -101,6 +172,7 @@ func New(flag int) *Logger {
 		stdEnabled:     true,
 		authEnabled:    true,
 		reqEnabled:     true,
+		reqSampleRatio: 1,
 		stdLogTemplate: template.Must(template.New("std-log").Parse(DefaultStandardLoggingFormat)),
 		authTemplate:   template.Must(template.New("auth-log").Parse(DefaultAuthLoggingFormat)),
 		reqTemplate:    template.Must(template.New("req-log").Parse(DefaultRequestLoggingFormat)),
@@ -126,13 +198,14 @@ func (l *Logger) Output(calldepth int, message string) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	l.stdLogTemplate.Execute(l.writer, stdLogMessageData{
+	w := l.output(l.stdWriter)
+	l.stdLogTemplate.Execute(w, stdLogMessageData{
 		Timestamp: FormatTimestamp(now),
 		File:      file,
-		Message:   message,
+		Message:   l.redactor.text(message),
 	})
 
-	l.writer.Write([]byte("\n"))
+	w.Write([]byte("\n"))
 }
 
 // PrintAuth writes auth info to the logger. Requires an http.Request to
@@ -149,30 +222,31 @@ func (l *Logger) PrintAuth(username string, req *http.Request, status AuthStatus
 		username = "-"
 	}
 
-	client := GetClient(req)
+	client := l.GetClient(req)
 
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	l.authTemplate.Execute(l.writer, authLogMessageData{
+	w := l.output(l.authWriter)
+	l.authTemplate.Execute(w, authLogMessageData{
 		Client:        client,
 		Host:          req.Host,
 		Protocol:      req.Proto,
 		RequestMethod: req.Method,
 		Timestamp:     FormatTimestamp(now),
 		UserAgent:     fmt.Sprintf("%q", req.UserAgent()),
-		Username:      username,
+		Username:      l.redactor.name(username),
 		Status:        fmt.Sprintf("%s", status),
-		Message:       fmt.Sprintf(format, a...),
+		Message:       l.redactor.text(fmt.Sprintf(format, a...)),
 	})
 
-	l.writer.Write([]byte("\n"))
+	w.Write([]byte("\n"))
 }
 
 // PrintReq writes request details to the Logger using the http.Request,
 // url, and timestamp of the request.  Writes a final newline to the end
 // of every message.
-func (l *Logger) PrintReq(username, upstream string, req *http.Request, url url.URL, ts time.Time, status int, size int) {
+func (l *Logger) PrintReq(username, upstream string, req *http.Request, url url.URL, ts time.Time, status int, size int, timings RequestTimings) {
 	if !l.reqEnabled {
 		return
 	}
@@ -193,27 +267,55 @@ func (l *Logger) PrintReq(username, upstream string, req *http.Request, url url.
 		}
 	}
 
-	client := GetClient(req)
+	client := l.GetClient(req)
 
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	l.reqTemplate.Execute(l.writer, reqLogMessageData{
+	if l.reqExcluded(url.Path, status) || !l.reqSampled(status, ts) {
+		return
+	}
+
+	w := l.output(l.reqWriter)
+	l.reqTemplate.Execute(w, reqLogMessageData{
 		Client:          client,
+		CLFTimestamp:    ts.Format(clfTimestampFormat),
 		Host:            req.Host,
 		Protocol:        req.Proto,
+		Referer:         fmt.Sprintf("%q", l.redactor.text(req.Referer())),
+		Request:         fmt.Sprintf("%q", req.Method+" "+l.redactor.text(url.RequestURI())+" "+req.Proto),
+		AuthDuration:    formatDuration(timings.Auth),
 		RequestDuration: fmt.Sprintf("%0.3f", duration),
 		RequestMethod:   req.Method,
-		RequestURI:      fmt.Sprintf("%q", url.RequestURI()),
+		RequestURI:      fmt.Sprintf("%q", l.redactor.text(url.RequestURI())),
 		ResponseSize:    fmt.Sprintf("%d", size),
 		StatusCode:      fmt.Sprintf("%d", status),
 		Timestamp:       FormatTimestamp(ts),
 		Upstream:        upstream,
+		UpstreamTTFB:    formatDuration(timings.UpstreamFirstByte),
 		UserAgent:       fmt.Sprintf("%q", req.UserAgent()),
-		Username:        username,
+		Username:        l.redactor.name(username),
 	})
 
-	l.writer.Write([]byte("\n"))
+	w.Write([]byte("\n"))
+}
+
+// formatDuration formats a duration in seconds like the request duration, or
+// as "-" if it was not measured
+func formatDuration(d time.Duration) string {
+	if d <= 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%0.3f", d.Seconds())
+}
+
+// output returns the destination of a type of logging, which defaults to the
+// output of the logger
+func (l *Logger) output(w io.Writer) io.Writer {
+	if w != nil {
+		return w
+	}
+	return l.writer
 }
 
 // GetFileLineString will find the caller file and line number
@@ -244,20 +346,67 @@ func (l *Logger) GetFileLineString(calldepth int) string {
 	return fmt.Sprintf("%s:%d", file, line)
 }
 
-// GetClient parses an HTTP request for the client/remote IP address.
-func GetClient(req *http.Request) string {
-	client := req.Header.Get("X-Real-IP")
-	if client == "" {
-		client = req.RemoteAddr
-	}
+// GetClient parses an HTTP request for the client/remote IP address. When
+// trusted proxies are configured the X-Real-IP and X-Forwarded-For headers
+// are only honoured for requests coming from one of them.
+func (l *Logger) GetClient(req *http.Request) string {
+	l.mu.Lock()
+	trusted := l.trustedProxies
+	l.mu.Unlock()
 
-	if c, _, err := net.SplitHostPort(client); err == nil {
-		client = c
+	if trusted == nil {
+		client := req.Header.Get("X-Real-IP")
+		if client == "" {
+			client = req.RemoteAddr
+		}
+		return stripPort(client)
 	}
 
+	client := stripPort(req.RemoteAddr)
+	if !isTrustedProxy(trusted, client) {
+		return client
+	}
+	if realIP := req.Header.Get("X-Real-IP"); realIP != "" {
+		return stripPort(realIP)
+	}
+	// Walk X-Forwarded-For from the closest hop, skipping our own proxies
+	var hops []string
+	for _, h := range req.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := stripPort(strings.TrimSpace(hops[i]))
+		if hop == "" {
+			continue
+		}
+		client = hop
+		if !isTrustedProxy(trusted, hop) {
+			break
+		}
+	}
 	return client
 }
 
+func stripPort(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+func isTrustedProxy(trusted []*net.IPNet, addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 // FormatTimestamp returns a formatted timestamp.
 func (l *Logger) FormatTimestamp(ts time.Time) string {
 	if l.flag&LUTC != 0 {
@@ -295,6 +444,14 @@ func (l *Logger) SetAuthEnabled(e bool) {
 	l.authEnabled = e
 }
 
+// SetTrustedProxies sets the networks whose X-Real-IP and X-Forwarded-For
+// headers are trusted when determining the client address.
+func (l *Logger) SetTrustedProxies(trusted []*net.IPNet) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.trustedProxies = trusted
+}
+
 // SetReqEnabled enabled or disables request logging.
 func (l *Logger) SetReqEnabled(e bool) {
 	l.mu.Lock()
@@ -302,25 +459,172 @@ func (l *Logger) SetReqEnabled(e bool) {
 	l.reqEnabled = e
 }
 
-// SetStandardTemplate sets the template for standard logging.
-func (l *Logger) SetStandardTemplate(t string) {
+// SetReqExcludePaths sets the paths of the requests not to log. A path ending
+// in * excludes every path starting with it.
+func (l *Logger) SetReqExcludePaths(paths []string) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	l.stdLogTemplate = template.Must(template.New("std-log").Parse(t))
+	l.reqExcludePaths = paths
 }
 
-// SetAuthTemplate sets the template for auth logging.
-func (l *Logger) SetAuthTemplate(t string) {
+// SetReqExcludeStatus sets the status codes of the requests not to log, such
+// as 304, or classes of status codes such as 2xx.
+func (l *Logger) SetReqExcludeStatus(codes []string) error {
+	for _, code := range codes {
+		if !validStatusPattern(code) {
+			return fmt.Errorf("invalid status code %q", code)
+		}
+	}
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	l.authTemplate = template.Must(template.New("auth-log").Parse(t))
+	l.reqExcludeStatus = codes
+	return nil
 }
 
-// SetReqTemplate sets the template for request logging.
-func (l *Logger) SetReqTemplate(t string) {
+// validStatusPattern checks a status code or class of status codes
+func validStatusPattern(code string) bool {
+	if len(code) != 3 || code[0] < '1' || code[0] > '5' {
+		return false
+	}
+	if strings.ToLower(code[1:]) == "xx" {
+		return true
+	}
+	return code[1] >= '0' && code[1] <= '9' && code[2] >= '0' && code[2] <= '9'
+}
+
+// reqExcluded returns whether a request is not logged. The caller holds the
+// lock.
+func (l *Logger) reqExcluded(path string, status int) bool {
+	for _, p := range l.reqExcludePaths {
+		if p == path || (strings.HasSuffix(p, "*") && strings.HasPrefix(path, strings.TrimSuffix(p, "*"))) {
+			return true
+		}
+	}
+	code := fmt.Sprintf("%03d", status)
+	for _, c := range l.reqExcludeStatus {
+		if c == code || (strings.EqualFold(c[1:], "xx") && c[0] == code[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetRedaction sets how emails and user names are redacted from the logs,
+// one of RedactNone, RedactHash and RedactMask. The key of RedactHash should
+// be secret, so that the hashes of known emails cannot be computed.
+func (l *Logger) SetRedaction(mode string, key []byte) error {
+	r, err := newRedactor(mode, key)
+	if err != nil {
+		return err
+	}
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	l.reqTemplate = template.Must(template.New("req-log").Parse(t))
+	l.redactor = r
+	return nil
+}
+
+// SetReqSampling samples the requests with a 2xx status logged: each is logged
+// with the probability ratio, and at most limit of them a second unless limit
+// is 0. Other requests are always logged.
+func (l *Logger) SetReqSampling(ratio float64, limit int) error {
+	if ratio < 0 || ratio > 1 {
+		return fmt.Errorf("the sample ratio must be between 0 and 1")
+	}
+	if limit < 0 {
+		return fmt.Errorf("the sample limit must not be negative")
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.reqSampleRatio = ratio
+	l.reqSampleLimit = limit
+	return nil
+}
+
+// reqSampled returns whether a request made at ts is sampled for logging. The
+// caller holds the lock.
+func (l *Logger) reqSampled(status int, ts time.Time) bool {
+	if status < 200 || status > 299 {
+		return true
+	}
+	if l.reqSampleRatio < 1 && rand.Float64() >= l.reqSampleRatio {
+		return false
+	}
+	if l.reqSampleLimit == 0 {
+		return true
+	}
+	if second := ts.Unix(); second != l.reqSampleSecond {
+		l.reqSampleSecond = second
+		l.reqSampleCount = 0
+	}
+	if l.reqSampleCount >= l.reqSampleLimit {
+		return false
+	}
+	l.reqSampleCount++
+	return true
+}
+
+// SetStandardOutput sets the destination of standard logging, or nil for the
+// output of the logger.
+func (l *Logger) SetStandardOutput(w io.Writer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stdWriter = w
+}
+
+// SetAuthOutput sets the destination of auth logging, or nil for the output
+// of the logger.
+func (l *Logger) SetAuthOutput(w io.Writer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.authWriter = w
+}
+
+// SetReqOutput sets the destination of request logging, or nil for the
+// output of the logger.
+func (l *Logger) SetReqOutput(w io.Writer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.reqWriter = w
+}
+
+// SetStandardTemplate sets the template for standard logging. The template
+// is either a Go template or "standard".
+func (l *Logger) SetStandardTemplate(t string) error {
+	tmpl, err := parseTemplate("std-log", stdLogFormats, t)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stdLogTemplate = tmpl
+	return nil
+}
+
+// SetAuthTemplate sets the template for auth logging. The template is either
+// a Go template or "standard".
+func (l *Logger) SetAuthTemplate(t string) error {
+	tmpl, err := parseTemplate("auth-log", authLogFormats, t)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.authTemplate = tmpl
+	return nil
+}
+
+// SetReqTemplate sets the template for request logging. The template is
+// either a Go template or the name of one of the formats "standard" and
+// "combined".
+func (l *Logger) SetReqTemplate(t string) error {
+	tmpl, err := parseTemplate("req-log", reqLogFormats, t)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.reqTemplate = tmpl
+	return nil
 }
 
 // These functions utilize the standard logger.
@@ -335,6 +639,17 @@ func Flags() int {
 	return std.Flags()
 }
 
+// GetClient parses an HTTP request for the client/remote IP address using
+// the trusted proxies of the standard logger.
+func GetClient(req *http.Request) string {
+	return std.GetClient(req)
+}
+
+// SetTrustedProxies sets the trusted proxy networks for the standard logger.
+func SetTrustedProxies(trusted []*net.IPNet) {
+	std.SetTrustedProxies(trusted)
+}
+
 // SetFlags sets the output flags for the standard logger.
 func SetFlags(flag int) {
 	std.SetFlags(flag)
@@ -347,6 +662,24 @@ func SetOutput(w io.Writer) {
 	std.writer = w
 }
 
+// SetStandardOutput sets the destination of standard logging for the
+// standard logger.
+func SetStandardOutput(w io.Writer) {
+	std.SetStandardOutput(w)
+}
+
+// SetAuthOutput sets the destination of auth logging for the standard
+// logger.
+func SetAuthOutput(w io.Writer) {
+	std.SetAuthOutput(w)
+}
+
+// SetReqOutput sets the destination of request logging for the standard
+// logger.
+func SetReqOutput(w io.Writer) {
+	std.SetReqOutput(w)
+}
+
 // SetStandardEnabled enables or disables standard logging for the
 // standard logger.
 func SetStandardEnabled(e bool) {
@@ -365,22 +698,46 @@ func SetReqEnabled(e bool) {
 	std.SetReqEnabled(e)
 }
 
+// SetReqExcludePaths sets the paths of the requests not to log for the
+// standard logger.
+func SetReqExcludePaths(paths []string) {
+	std.SetReqExcludePaths(paths)
+}
+
+// SetReqExcludeStatus sets the status codes of the requests not to log for
+// the standard logger.
+func SetReqExcludeStatus(codes []string) error {
+	return std.SetReqExcludeStatus(codes)
+}
+
+// SetReqSampling samples the successful requests logged by the standard
+// logger.
+func SetReqSampling(ratio float64, limit int) error {
+	return std.SetReqSampling(ratio, limit)
+}
+
+// SetRedaction sets how emails and user names are redacted from the logs of
+// the standard logger.
+func SetRedaction(mode string, key []byte) error {
+	return std.SetRedaction(mode, key)
+}
+
 // SetStandardTemplate sets the template for standard logging for
 // the standard logger.
-func SetStandardTemplate(t string) {
-	std.SetStandardTemplate(t)
+func SetStandardTemplate(t string) error {
+	return std.SetStandardTemplate(t)
 }
 
 // SetAuthTemplate sets the template for auth logging for the
 // standard logger.
-func SetAuthTemplate(t string) {
-	std.SetAuthTemplate(t)
+func SetAuthTemplate(t string) error {
+	return std.SetAuthTemplate(t)
 }
 
 // SetReqTemplate sets the template for request logging for the
 // standard logger.
-func SetReqTemplate(t string) {
-	std.SetReqTemplate(t)
+func SetReqTemplate(t string) error {
+	return std.SetReqTemplate(t)
 }
 
 // Print calls Output to print to the standard logger.
@@ -447,6 +804,6 @@ func PrintAuthf(username string, req *http.Request, status AuthStatus, format st
 }
 
 // PrintReq writes request details to the standard logger.
-func PrintReq(username, upstream string, req *http.Request, url url.URL, ts time.Time, status int, size int) {
-	std.PrintReq(username, upstream, req, url, ts, status, size)
+func PrintReq(username, upstream string, req *http.Request, url url.URL, ts time.Time, status int, size int, timings RequestTimings) {
+	std.PrintReq(username, upstream, req, url, ts, status, size, timings)
 }
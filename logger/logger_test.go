@@ -0,0 +1,36 @@
+package logger
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestGetClientTrustedProxies(t *testing.T) {
+	l := New(0)
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "203.0.113.7:4567"
+	req.Header.Set("X-Real-IP", "10.1.2.3")
+	req.Header.Set("X-Forwarded-For", "198.51.100.1, 10.0.0.2")
+
+	// without trusted proxies the X-Real-IP header is always used
+	if client := l.GetClient(req); client != "10.1.2.3" {
+		t.Errorf("expected 10.1.2.3, got %s", client)
+	}
+
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+	l.SetTrustedProxies([]*net.IPNet{trusted})
+	if client := l.GetClient(req); client != "203.0.113.7" {
+		t.Errorf("expected untrusted peer 203.0.113.7, got %s", client)
+	}
+
+	req.RemoteAddr = "10.0.0.1:4567"
+	if client := l.GetClient(req); client != "10.1.2.3" {
+		t.Errorf("expected 10.1.2.3, got %s", client)
+	}
+
+	req.Header.Del("X-Real-IP")
+	if client := l.GetClient(req); client != "198.51.100.1" {
+		t.Errorf("expected 198.51.100.1, got %s", client)
+	}
+}
@@ -0,0 +1,88 @@
+package logger
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Modes of redacting personal data from the logs
+const (
+	// RedactNone logs emails and user names as they are
+	RedactNone = ""
+	// RedactHash replaces emails and user names by a keyed hash, so that
+	// the log lines of a user can still be correlated
+	RedactHash = "hash"
+	// RedactMask masks all but the first letters of emails and user names
+	RedactMask = "mask"
+)
+
+// piiPattern matches the user of a session description or an email, which
+// may be URL encoded
+var piiPattern = regexp.MustCompile(`\buser:[^\s}]+|[A-Za-z0-9._%+\-]+(@|%40)[A-Za-z0-9\-]+(\.[A-Za-z0-9\-]+)+`)
+
+// redactor redacts emails and user names according to its mode
+type redactor struct {
+	mode string
+	key  []byte
+}
+
+func newRedactor(mode string, key []byte) (*redactor, error) {
+	switch mode {
+	case RedactNone:
+		return nil, nil
+	case RedactHash, RedactMask:
+		return &redactor{mode: mode, key: key}, nil
+	}
+	return nil, fmt.Errorf("invalid redaction mode %q, expected %q or %q", mode, RedactHash, RedactMask)
+}
+
+// name redacts a user name or email. A nil redactor returns it unchanged.
+func (r *redactor) name(s string) string {
+	if r == nil || s == "" || s == "-" {
+		return s
+	}
+	if r.mode == RedactHash {
+		mac := hmac.New(sha256.New, r.key)
+		mac.Write([]byte(strings.ToLower(s)))
+		return "pii-" + hex.EncodeToString(mac.Sum(nil))[:12]
+	}
+	if i := strings.LastIndex(s, "@"); i > 0 {
+		domain := s[i+1:]
+		if j := strings.LastIndex(domain, "."); j > 0 {
+			return mask(s[:i]) + "@" + mask(domain[:j]) + domain[j:]
+		}
+		return mask(s[:i]) + "@" + mask(domain)
+	}
+	return mask(s)
+}
+
+// text redacts the emails, and the users of session descriptions, in a
+// message. A nil redactor returns it unchanged.
+func (r *redactor) text(s string) string {
+	if r == nil {
+		return s
+	}
+	return piiPattern.ReplaceAllStringFunc(s, func(m string) string {
+		if strings.HasPrefix(m, "user:") {
+			return "user:" + r.name(strings.TrimPrefix(m, "user:"))
+		}
+		if email, err := url.QueryUnescape(m); err == nil {
+			m = email
+		}
+		return r.name(m)
+	})
+}
+
+// mask keeps the first letter of s
+func mask(s string) string {
+	runes := []rune(s)
+	if len(runes) <= 1 {
+		return "*"
+	}
+	return string(runes[:1]) + strings.Repeat("*", len(runes)-1)
+}
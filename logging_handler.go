@@ -1,16 +1,18 @@
 // largely adapted from https://github.com/gorilla/handlers/blob/master/handlers.go
 // to add logging of request duration as last value (and drop referrer)
 
-package main
+package oauthproxy
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"net"
 	"net/http"
 	"time"
 
 	"github.com/OpusCapita/oauth2_proxy/logger"
+	"github.com/OpusCapita/oauth2_proxy/pkg/tracing"
 )
 
 // responseLogger is wrapper of http.ResponseWriter that keeps track of its HTTP status
@@ -21,6 +23,8 @@ type responseLogger struct {
 	size     int
 	upstream string
 	authInfo string
+	// firstByte is when the response was started
+	firstByte time.Time
 }
 
 // Header returns the ResponseWriter's Header
@@ -56,6 +60,7 @@ func (l *responseLogger) Write(b []byte) (int, error) {
 	if l.status == 0 {
 		// The status will be StatusOK if WriteHeader has not been called yet
 		l.status = http.StatusOK
+		l.firstByte = time.Now()
 	}
 	l.ExtractGAPMetadata()
 	size, err := l.w.Write(b)
@@ -67,6 +72,9 @@ func (l *responseLogger) Write(b []byte) (int, error) {
 func (l *responseLogger) WriteHeader(s int) {
 	l.ExtractGAPMetadata()
 	l.w.WriteHeader(s)
+	if l.status == 0 {
+		l.firstByte = time.Now()
+	}
 	l.status = s
 }
 
@@ -86,9 +94,42 @@ func (l *responseLogger) Flush() {
 	}
 }
 
+// requestTimings collects where the time serving a request went, to tell the
+// overhead of the proxy from slow upstreams. The methods of a nil
+// requestTimings do nothing.
+type requestTimings struct {
+	// auth is the time spent checking the session and authorization
+	auth time.Duration
+	// upstreamStart is when the request was passed to the upstream
+	upstreamStart time.Time
+}
+
+type timingsKey struct{}
+
+// timingsFromContext returns the timings of the request of the context, or nil
+func timingsFromContext(ctx context.Context) *requestTimings {
+	t, _ := ctx.Value(timingsKey{}).(*requestTimings)
+	return t
+}
+
+// addAuth adds the time since start to the auth duration, so that
+// `defer t.addAuth(time.Now())` times the rest of a function
+func (t *requestTimings) addAuth(start time.Time) {
+	if t != nil {
+		t.auth += time.Since(start)
+	}
+}
+
+func (t *requestTimings) startUpstream() {
+	if t != nil {
+		t.upstreamStart = time.Now()
+	}
+}
+
 // loggingHandler is the http.Handler implementation for LoggingHandlerTo and its friends
 type loggingHandler struct {
 	handler http.Handler
+	metrics *proxyMetrics
 }
 
 // LoggingHandler provides an http.Handler which logs requests to the HTTP server
@@ -102,6 +143,13 @@ func (h loggingHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	t := time.Now()
 	url := *req.URL
 	responseLogger := &responseLogger{w: w}
-	h.handler.ServeHTTP(responseLogger, req)
-	logger.PrintReq(responseLogger.authInfo, responseLogger.upstream, req, url, t, responseLogger.Status(), responseLogger.Size())
+	timings := &requestTimings{}
+	h.handler.ServeHTTP(responseLogger, req.WithContext(context.WithValue(req.Context(), timingsKey{}, timings)))
+	tracing.FromContext(req.Context()).SetAttribute("http.status_code", responseLogger.Status())
+	h.metrics.observeRequest(responseLogger.Status(), responseLogger.upstream, time.Since(t))
+	logTimings := logger.RequestTimings{Auth: timings.auth}
+	if !timings.upstreamStart.IsZero() && responseLogger.firstByte.After(timings.upstreamStart) {
+		logTimings.UpstreamFirstByte = responseLogger.firstByte.Sub(timings.upstreamStart)
+	}
+	logger.PrintReq(responseLogger.authInfo, responseLogger.upstream, req, url, t, responseLogger.Status(), responseLogger.Size(), logTimings)
 }
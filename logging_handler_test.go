@@ -1,4 +1,4 @@
-package main
+package oauthproxy
 
 import (
 	"bytes"
@@ -21,6 +21,7 @@ func TestLoggingHandler_ServeHTTP(t *testing.T) {
 	}{
 		{logger.DefaultRequestLoggingFormat, fmt.Sprintf("127.0.0.1 - - [%s] test-server GET - \"/foo/bar\" HTTP/1.1 \"\" 200 4 0.000\n", logger.FormatTimestamp(ts))},
 		{"{{.RequestMethod}}", "GET\n"},
+		{logger.CombinedFormat, fmt.Sprintf("127.0.0.1 - - [%s] \"GET /foo/bar HTTP/1.1\" 200 4 \"https://test-server/\" \"\"\n", ts.Format("02/Jan/2006:15:04:05 -0700"))},
 	}
 
 	for _, test := range tests {
@@ -41,6 +42,7 @@ func TestLoggingHandler_ServeHTTP(t *testing.T) {
 		r, _ := http.NewRequest("GET", "/foo/bar", nil)
 		r.RemoteAddr = "127.0.0.1"
 		r.Host = "test-server"
+		r.Header.Set("Referer", "https://test-server/")
 
 		h.ServeHTTP(httptest.NewRecorder(), r)
 
@@ -50,3 +52,190 @@ func TestLoggingHandler_ServeHTTP(t *testing.T) {
 		}
 	}
 }
+
+func TestSetReqTemplateInvalid(t *testing.T) {
+	l := logger.New(0)
+	if err := l.SetReqTemplate("{{.Client"); err == nil {
+		t.Error("expected an error for an invalid template")
+	}
+	if err := l.SetReqTemplate(logger.StandardFormat); err != nil {
+		t.Errorf("unexpected error %s", err)
+	}
+}
+
+func TestLoggingExcludedRequests(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	l := logger.New(0)
+	l.SetReqOutput(buf)
+	l.SetReqTemplate("{{.RequestURI}} {{.StatusCode}}")
+	l.SetReqExcludePaths([]string{"/ping", "/static/*"})
+	if err := l.SetReqExcludeStatus([]string{"304", "1xx"}); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	for _, test := range []struct {
+		path   string
+		status int
+	}{
+		{"/ping", 200},
+		{"/ping/more", 200},
+		{"/static/app.js", 200},
+		{"/app", 304},
+		{"/app", 101},
+		{"/app", 200},
+	} {
+		r, _ := http.NewRequest("GET", test.path, nil)
+		l.PrintReq("", "", r, *r.URL, time.Now(), test.status, 0, logger.RequestTimings{})
+	}
+	if expected := "\"/ping/more\" 200\n\"/app\" 200\n"; buf.String() != expected {
+		t.Errorf("Log was\n%s\ninstead of\n%s", buf.String(), expected)
+	}
+
+	for _, code := range []string{"30", "600", "2x0", "abc"} {
+		if err := l.SetReqExcludeStatus([]string{code}); err == nil {
+			t.Errorf("expected an error for status code %q", code)
+		}
+	}
+}
+
+func TestLoggingRedaction(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	l := logger.New(0)
+	l.SetStandardOutput(buf)
+	l.SetAuthOutput(buf)
+	l.SetReqOutput(buf)
+	l.SetStandardTemplate("{{.Message}}")
+	l.SetAuthTemplate("{{.Username}} {{.Message}}")
+	l.SetReqTemplate("{{.Username}} {{.RequestURI}}")
+
+	log := func() string {
+		buf.Reset()
+		r, _ := http.NewRequest("GET", "/app?login_hint=jane.doe%40example.com", nil)
+		l.PrintAuth("jane.doe@example.com", r, logger.AuthSuccess, "Authenticated via OAuth2: Session{email:jane.doe@example.com user:jdoe}")
+		l.PrintReq("jdoe", "", r, *r.URL, time.Now(), 200, 0, logger.RequestTimings{})
+		l.Output(0, `got 200 from "https://api.github.com/user/emails" [{"email":"Jane.Doe@example.com"}]`)
+		return buf.String()
+	}
+
+	if err := l.SetRedaction(logger.RedactMask, nil); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	expected := `j*******@e******.com Authenticated via OAuth2: Session{email:j*******@e******.com user:j***}
+j*** "/app?login_hint=j*******@e******.com"
+got 200 from "https://api.github.com/user/emails" [{"email":"J*******@e******.com"}]
+`
+	if actual := log(); actual != expected {
+		t.Errorf("Log was\n%s\ninstead of\n%s", actual, expected)
+	}
+
+	if err := l.SetRedaction(logger.RedactHash, []byte("secret")); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	lines := strings.Split(log(), "\n")
+	email := strings.Fields(lines[0])[0]
+	user := strings.Fields(lines[1])[0]
+	if !strings.HasPrefix(email, "pii-") || !strings.HasPrefix(user, "pii-") || email == user {
+		t.Errorf("expected distinct hashes of the email and user, got %s and %s", email, user)
+	}
+	// the same user is logged the same everywhere, regardless of case
+	for _, line := range lines[:3] {
+		if strings.Contains(line, "@") || strings.Contains(line, "jdoe") {
+			t.Errorf("unredacted line %s", line)
+		}
+	}
+	if !strings.Contains(lines[0], "email:"+email+" user:"+user) || !strings.Contains(lines[1], email) || !strings.Contains(lines[2], email) {
+		t.Errorf("hashes are not correlatable:\n%s", strings.Join(lines, "\n"))
+	}
+
+	if err := l.SetRedaction("encrypt", nil); err == nil {
+		t.Error("expected an error for an invalid redaction mode")
+	}
+}
+
+func TestLoggingSampling(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	l := logger.New(0)
+	l.SetReqOutput(buf)
+	l.SetReqTemplate("{{.StatusCode}}")
+
+	count := func(status int) int {
+		buf.Reset()
+		ts := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+		for i := 0; i < 100; i++ {
+			r, _ := http.NewRequest("GET", "/", nil)
+			l.PrintReq("", "", r, *r.URL, ts, status, 0, logger.RequestTimings{})
+		}
+		return strings.Count(buf.String(), "\n")
+	}
+
+	if err := l.SetReqSampling(0, 0); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if n := count(200); n != 0 {
+		t.Errorf("logged %d requests with a ratio of 0", n)
+	}
+	if n := count(502); n != 100 {
+		t.Errorf("logged %d instead of every failed request", n)
+	}
+
+	if err := l.SetReqSampling(1, 10); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if n := count(200); n != 10 {
+		t.Errorf("logged %d requests a second with a limit of 10", n)
+	}
+
+	if err := l.SetReqSampling(0.5, 0); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if n := count(200); n == 0 || n == 100 {
+		t.Errorf("logged %d of 100 requests with a ratio of 0.5", n)
+	}
+
+	if err := l.SetReqSampling(1.5, 0); err == nil {
+		t.Error("expected an error for a ratio above 1")
+	}
+}
+
+func TestLoggingHandlerTimings(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	logger.SetOutput(buf)
+	logger.SetReqTemplate("{{.AuthDuration}} {{.UpstreamTTFB}} {{.RequestDuration}}")
+	defer logger.SetReqTemplate(logger.DefaultRequestLoggingFormat)
+
+	upstream := &UpstreamProxy{
+		upstream: "test-upstream",
+		handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			time.Sleep(20 * time.Millisecond)
+			w.WriteHeader(http.StatusOK)
+			time.Sleep(20 * time.Millisecond)
+			w.Write([]byte("test"))
+		}),
+	}
+	h := LoggingHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		func() {
+			defer timingsFromContext(req.Context()).addAuth(time.Now())
+			time.Sleep(10 * time.Millisecond)
+		}()
+		upstream.ServeHTTP(w, req)
+	}))
+	r, _ := http.NewRequest("GET", "/foo/bar", nil)
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	var auth, ttfb, total float64
+	if _, err := fmt.Sscanf(buf.String(), "%f %f %f", &auth, &ttfb, &total); err != nil {
+		t.Fatalf("unexpected log message %q: %s", buf.String(), err)
+	}
+	if auth < 0.010 || ttfb < 0.020 || ttfb >= total-0.015 || auth+ttfb > total {
+		t.Errorf("unexpected timings: auth %0.3f, upstream %0.3f, total %0.3f", auth, ttfb, total)
+	}
+
+	buf.Reset()
+	h = LoggingHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("test"))
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if !strings.HasPrefix(buf.String(), "- - ") {
+		t.Errorf("expected unmeasured timings, got %q", buf.String())
+	}
+}
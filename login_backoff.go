@@ -0,0 +1,135 @@
+package oauthproxy
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// maxLoginBackoff bounds the time a user has to wait after failed logins,
+	// so guessing passwords can't lock a user out for long
+	maxLoginBackoff = 5 * time.Minute
+	// maxLoginFailures bounds the number of users and addresses whose failed
+	// logins are remembered
+	maxLoginFailures = 10000
+)
+
+// loginKey identifies the login attempts of a user from a client address
+type loginKey struct {
+	user string
+	addr string
+}
+
+// loginFailures counts the consecutive failed logins of a user from a client
+// address
+type loginFailures struct {
+	count int
+	until time.Time
+}
+
+// loginBackoff slows down password guessing: after a failed login with a
+// password the user has to wait delay before trying again from the same
+// client address, doubled with each further failure up to maxLoginBackoff.
+// Failures from other addresses don't delay the user, so they can't be used
+// to lock the user out. A nil loginBackoff never delays.
+type loginBackoff struct {
+	delay time.Duration
+	now   func() time.Time
+
+	mu       sync.Mutex
+	failures map[loginKey]*loginFailures
+	pruned   time.Time
+}
+
+// newLoginBackoff returns a loginBackoff waiting delay after the first
+// failure, or nil if delay isn't positive
+func newLoginBackoff(delay time.Duration) *loginBackoff {
+	if delay <= 0 {
+		return nil
+	}
+	return &loginBackoff{
+		delay:    delay,
+		now:      time.Now,
+		failures: make(map[loginKey]*loginFailures),
+	}
+}
+
+// Wait returns how long the user has to wait before the next login attempt
+// from addr
+func (b *loginBackoff) Wait(user, addr string) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f, ok := b.failures[loginKey{user, addr}]
+	if !ok {
+		return 0
+	}
+	if wait := f.until.Sub(b.now()); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// Failed records a failed login of the user from addr
+func (b *loginBackoff) Failed(user, addr string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	key := loginKey{user, addr}
+	f, ok := b.failures[key]
+	if !ok {
+		b.prune(now)
+		f = &loginFailures{}
+		b.failures[key] = f
+	}
+	f.count++
+	wait := b.delay
+	for i := 1; i < f.count && wait < maxLoginBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxLoginBackoff {
+		wait = maxLoginBackoff
+	}
+	f.until = now.Add(wait)
+}
+
+// prune forgets the failures whose longest backoff has passed, at most once
+// every maxLoginBackoff, and makes room for a new entry once
+// maxLoginFailures are remembered by forgetting the one whose wait ends
+// first. It must be called with mu held.
+func (b *loginBackoff) prune(now time.Time) {
+	if now.Sub(b.pruned) >= maxLoginBackoff {
+		b.pruned = now
+		for k, f := range b.failures {
+			if now.Sub(f.until) > maxLoginBackoff {
+				delete(b.failures, k)
+			}
+		}
+	}
+	if len(b.failures) < maxLoginFailures {
+		return
+	}
+	var first loginKey
+	var until time.Time
+	for k, f := range b.failures {
+		if until.IsZero() || f.until.Before(until) {
+			first, until = k, f.until
+		}
+	}
+	delete(b.failures, first)
+}
+
+// Succeeded forgets the failed logins of the user from addr
+func (b *loginBackoff) Succeeded(user, addr string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.failures, loginKey{user, addr})
+}
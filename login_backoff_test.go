@@ -0,0 +1,61 @@
+package oauthproxy
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoginBackoff(t *testing.T) {
+	now := time.Now()
+	b := newLoginBackoff(time.Second)
+	b.now = func() time.Time { return now }
+
+	assert.Equal(t, time.Duration(0), b.Wait("john", "10.0.0.1"))
+	b.Failed("john", "10.0.0.1")
+	assert.Equal(t, time.Second, b.Wait("john", "10.0.0.1"))
+	assert.Equal(t, time.Duration(0), b.Wait("jane", "10.0.0.1"))
+	assert.Equal(t, time.Duration(0), b.Wait("john", "10.0.0.2"))
+
+	now = now.Add(time.Second)
+	assert.Equal(t, time.Duration(0), b.Wait("john", "10.0.0.1"))
+	b.Failed("john", "10.0.0.1")
+	assert.Equal(t, 2*time.Second, b.Wait("john", "10.0.0.1"))
+
+	for i := 0; i < 20; i++ {
+		b.Failed("john", "10.0.0.1")
+	}
+	assert.Equal(t, maxLoginBackoff, b.Wait("john", "10.0.0.1"))
+
+	b.Succeeded("john", "10.0.0.1")
+	assert.Equal(t, time.Duration(0), b.Wait("john", "10.0.0.1"))
+}
+
+func TestLoginBackoffPrune(t *testing.T) {
+	now := time.Now()
+	b := newLoginBackoff(time.Second)
+	b.now = func() time.Time { return now }
+
+	b.Failed("john", "10.0.0.1")
+	now = now.Add(2*maxLoginBackoff + time.Second)
+	b.Failed("jane", "10.0.0.1")
+	assert.Len(t, b.failures, 1)
+
+	for i := 0; i < maxLoginFailures+10; i++ {
+		now = now.Add(time.Millisecond)
+		b.Failed(fmt.Sprintf("user%d", i), "10.0.0.1")
+	}
+	assert.Len(t, b.failures, maxLoginFailures)
+	// the entries whose wait ends first make room
+	assert.Equal(t, time.Duration(0), b.Wait("jane", "10.0.0.1"))
+	assert.NotEqual(t, time.Duration(0), b.Wait(fmt.Sprintf("user%d", maxLoginFailures+9), "10.0.0.1"))
+}
+
+func TestLoginBackoffDisabled(t *testing.T) {
+	b := newLoginBackoff(0)
+	assert.Nil(t, b)
+	b.Failed("john", "10.0.0.1")
+	assert.Equal(t, time.Duration(0), b.Wait("john", "10.0.0.1"))
+}
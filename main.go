@@ -1,13 +1,19 @@
-package main
+package oauthproxy
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/BurntSushi/toml"
@@ -15,45 +21,158 @@ import (
 	"github.com/OpusCapita/oauth2_proxy/logger"
 )
 
-func main() {
+// Main runs oauth2_proxy configured by the command line flags, the config
+// files and the environment
+func Main() {
+	if len(os.Args) > 1 {
+		if command, ok := subcommands[os.Args[1]]; ok {
+			os.Exit(command(os.Args[2:]))
+		}
+	}
+
 	logger.SetFlags(logger.Lshortfile)
 	flagSet := flag.NewFlagSet("oauth2_proxy", flag.ExitOnError)
 
 	emailDomains := StringArray{}
 	whitelistDomains := StringArray{}
+	signOutRedirects := StringArray{}
+	redirectWhitelist := StringArray{}
 	upstreams := StringArray{}
+	upstreamRegexes := StringArray{}
+	providerPlugins := StringArray{}
 	skipAuthRegex := StringArray{}
+	stepUpRoutes := StringArray{}
+	apiRoutes := StringArray{}
+	devFakeGroups := StringArray{}
+	ssoAllowedDomains := StringArray{}
+	unauthenticatedRoutes := StringArray{}
+	rateLimitRoutes := StringArray{}
+	corsAllowedOrigins := StringArray{}
+	corsAllowedHeaders := StringArray{}
 	jwtIssuers := StringArray{}
 	googleGroups := StringArray{}
 	redisSentinelConnectionURLs := StringArray{}
+	responseHeaders := StringArray{}
+	stripRequestHeaders := StringArray{}
+	setRequestHeaders := StringArray{}
+	trustedRealIPCIDRs := StringArray{}
+	trustedIPs := StringArray{}
+	loggingExcludePaths := StringArray{}
+	traceHeaders := StringArray{}
+	loggingExcludeStatus := StringArray{}
+	acmeDomains := StringArray{}
+	tlsCipherSuites := StringArray{}
+	tlsCertPairs := StringArray{}
+	compressTypes := StringArray{}
+	flushImmediatelyTypes := StringArray{}
+	tlsCurves := StringArray{}
+	maintenancePaths := StringArray{}
+	maintenanceAllowedEmails := StringArray{}
+	maintenanceAllowedGroups := StringArray{}
 
-	config := flagSet.String("config", "", "path to config file")
+	config := flagSet.String("config", "", "path to config file, in the structured YAML format if it ends in .yaml or .yml (default $OAUTH2_PROXY_CONFIG)")
+	configDir := flagSet.String("config-dir", "", "directory of drop-in config files (*.cfg, *.conf, *.toml, *.yaml or *.yml) applied in lexical order after -config (default $OAUTH2_PROXY_CONFIG_DIR)")
 	showVersion := flagSet.Bool("version", false, "print version string")
+	validateOnly := flagSet.Bool("validate-config", false, "load and validate the configuration, including OIDC discovery, check that the upstreams can be reached, and exit: non-zero if there are problems")
+	printConfig := flagSet.Bool("print-config", false, "print the effective configuration resolved from the defaults, config files, environment and flags, with secrets redacted, and exit")
 
 	flagSet.String("http-address", "127.0.0.1:4180", "[http://]<addr>:<port> or unix://<path> to listen on for HTTP clients")
 	flagSet.String("https-address", ":443", "<addr>:<port> to listen on for HTTPS clients")
+	flagSet.String("socket-file-mode", "", "octal file mode to set on the unix socket when listening on unix://<path>, e.g. 0660")
 	flagSet.String("tls-cert", "", "path to certificate file")
 	flagSet.String("tls-key", "", "path to private key file")
+	flagSet.Var(&acmeDomains, "acme-domain", "obtain a TLS certificate for this hostname from an ACME CA such as Let's Encrypt (may be given multiple times)")
+	flagSet.String("acme-cache-dir", "", "directory to store ACME account keys and certificates in")
+	flagSet.String("acme-email", "", "contact email address registered with the ACME CA")
+	flagSet.String("acme-directory-url", "", "ACME directory URL (default Let's Encrypt production)")
+	flagSet.Var(&tlsCertPairs, "tls-cert-pair", "an additional certfile:keyfile pair for the HTTPS listener, selected by SNI (may be given multiple times)")
+	flagSet.String("tls-cert-dir", "", "directory of <name>.crt and <name>.key pairs for the HTTPS listener, selected by SNI")
+	flagSet.Bool("force-https", false, "when serving HTTPS, also listen on -http-address and redirect all plain HTTP requests to HTTPS")
+	flagSet.Duration("hsts-max-age", time.Duration(0), "set a Strict-Transport-Security header with this max-age on HTTPS responses; 0 to disable")
+	flagSet.String("tls-min-version", "TLS1.2", "minimum TLS version accepted by the HTTPS listener: TLS1.0, TLS1.1, TLS1.2 or TLS1.3")
+	flagSet.Var(&tlsCipherSuites, "tls-cipher-suite", "restrict the HTTPS listener to this TLS cipher suite, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 (may be given multiple times)")
+	flagSet.Var(&tlsCurves, "tls-curve", "preferred elliptic curve for the HTTPS listener: P256, P384, P521 or X25519 (may be given multiple times)")
+	flagSet.Bool("http2", false, "enable HTTP/2 on the HTTPS listener")
+	flagSet.Bool("h2c", false, "enable HTTP/2 over cleartext (h2c) on the HTTP listener")
+	flagSet.Int("http2-max-concurrent-streams", 250, "maximum number of concurrent HTTP/2 streams per client connection")
+	flagSet.String("dev-fake-identity", "", "developer mode: authenticate every request as this email without a provider; only allowed when listening on localhost")
+	flagSet.Var(&devFakeGroups, "dev-fake-group", "a group of the developer mode identity (may be given multiple times)")
+	flagSet.String("sso-url", "", "sign users in at the SSO endpoint of a central proxy instead of the provider (e.g. https://auth.example.com/oauth2/sso)")
+	flagSet.Var(&ssoAllowedDomains, "sso-allowed-domain", "serve single sign-on to the application proxies on this domain; prefix with a . to allow subdomains (may be given multiple times)")
+	flagSet.String("sso-secret", "", "the secret shared by the central proxy and the application proxies sealing the SSO assertions")
+	flagSet.String("sso-secret-file", "", "the file with the sso-secret")
+	flagSet.String("ext-authz-address", "", "<addr>:<port> to serve the Envoy ext_authz gRPC API on (disabled if empty)")
 	flagSet.String("redirect-url", "", "the OAuth Redirect URL. ie: \"https://internalapp.yourcompany.com/oauth2/callback\"")
 	flagSet.Bool("set-xauthrequest", false, "set X-Auth-Request-User and X-Auth-Request-Email response headers (useful in Nginx auth_request mode)")
 	flagSet.Var(&upstreams, "upstream", "the http url(s) of the upstream endpoint or file:// paths for static files. Routing is based on the path")
+	flagSet.Var(&upstreamRegexes, "upstream-regex", "route requests whose path matches a regex to an upstream, with $1 style capture group substitution: pattern=http(s)://target (may be given multiple times)")
 	flagSet.Bool("pass-basic-auth", true, "pass HTTP Basic Auth, X-Forwarded-User and X-Forwarded-Email information to upstream")
 	flagSet.Bool("pass-user-headers", true, "pass X-Forwarded-User and X-Forwarded-Email information to upstream")
 	flagSet.String("basic-auth-password", "", "the password to set when passing the HTTP Basic Auth header")
 	flagSet.Bool("pass-access-token", false, "pass OAuth access_token to upstream via X-Forwarded-Access-Token header")
+	flagSet.String("pass-access-token-header", "X-Forwarded-Access-Token", "the header the access_token is passed to upstream in when -pass-access-token is set")
+	flagSet.String("pass-access-token-format", "raw", "the format of the passed access_token: raw or bearer (prefixed with \"Bearer \")")
 	flagSet.Bool("pass-host-header", true, "pass the request Host Header to upstream")
 	flagSet.Bool("pass-authorization-header", false, "pass the Authorization Header to upstream")
+	flagSet.Bool("pass-id-token", false, "pass the raw OIDC IDToken to upstream via X-Forwarded-Id-Token header (and X-Auth-Request-Id-Token with -set-xauthrequest)")
 	flagSet.Bool("set-authorization-header", false, "set Authorization response headers (useful in Nginx auth_request mode)")
-	flagSet.Var(&skipAuthRegex, "skip-auth-regex", "bypass authentication for requests path's that match (may be given multiple times)")
+	flagSet.Bool("strip-authorization-header", false, "remove the client supplied Authorization header before proxying; only an Authorization header set by the proxy is passed upstream")
+	flagSet.Bool("forward-auth", false, "act as a Traefik forwardAuth target: build redirects from X-Forwarded-Host/X-Forwarded-Uri and send unauthenticated requests to sign in")
+	flagSet.String("forward-auth-user-header", "X-Forwarded-User", "the response header the authenticated user is returned in when -forward-auth is set")
+	flagSet.String("forward-auth-email-header", "X-Forwarded-Email", "the response header the authenticated email is returned in when -forward-auth is set")
+	flagSet.String("pass-groups-header", "", "pass the groups of the user to the upstream in this header, e.g. X-Forwarded-Groups (disabled if empty)")
+	flagSet.String("groups-header-delimiter", ",", "the delimiter between groups in the pass-groups-header")
+	flagSet.Int("groups-header-max-size", 4096, "leave out groups which would make the pass-groups-header longer than this many bytes (0 for no limit)")
+	flagSet.String("required-groups", "", "only allow users whose groups satisfy this expression, e.g. 'acme AND (acme/sre OR acme/oncall)'")
+	flagSet.Bool("maintenance-mode", false, "start in maintenance mode, serving a 503 maintenance page instead of proxying; toggled at runtime with SIGUSR1")
+	flagSet.Var(&maintenancePaths, "maintenance-path", "only serve the maintenance page for request paths matching this regex (may be given multiple times; default all proxied paths)")
+	flagSet.Var(&maintenanceAllowedEmails, "maintenance-allowed-email", "an email address, or @domain, which is still proxied in maintenance mode (may be given multiple times)")
+	flagSet.Var(&maintenanceAllowedGroups, "maintenance-allowed-group", "a group whose members are still proxied in maintenance mode (may be given multiple times)")
+	flagSet.Var(&corsAllowedOrigins, "cors-allowed-origin", "an origin, e.g. https://app.example.com, or * allowed to call the userinfo, auth and sign out endpoints cross-origin (may be given multiple times)")
+	flagSet.Var(&corsAllowedHeaders, "cors-allowed-header", "a request header allowed in cross-origin requests to the userinfo, auth and sign out endpoints (may be given multiple times)")
+	flagSet.Bool("cors-allow-credentials", false, "allow cross-origin requests to the userinfo, auth and sign out endpoints to send the session cookie")
+	flagSet.Bool("cors-answer-preflight", false, "answer CORS preflight requests for the upstreams from the cors-allowed-origin policy, without authentication")
+	flagSet.Var(&skipAuthRegex, "skip-auth-regex", "bypass authentication for requests path's that match, or only for some methods with METHOD[,METHOD]=regex (may be given multiple times)")
+	flagSet.Var(&apiRoutes, "api-route", "answer unauthenticated requests for paths matching this regex with a 401 JSON response instead of a redirect to sign in (may be given multiple times)")
+	flagSet.Var(&unauthenticatedRoutes, "unauthenticated-route", "answer unauthenticated requests for paths matching a regex with redirect (to sign in), 401 (JSON) or 403: pattern=response, overriding api-route and the Accept header (may be given multiple times)")
+	flagSet.String("authz-policy-file", "", "YAML file of per-route authorization rules restricting paths and methods to emails, domains or groups")
+	flagSet.Bool("authz-policy-dry-run", false, "only log the requests the authz-policy-file and ProxyPolicy resources would deny, without denying them")
+	flagSet.String("opa-url", "", "Open Policy Agent decision URL, e.g. http://127.0.0.1:8181/v1/data/oauth2_proxy/allow, queried with the request and session as input to authorize every request")
+	flagSet.Duration("opa-timeout", defaultOPATimeout, "timeout of an Open Policy Agent decision query")
+	flagSet.Bool("kube-proxy-policies", false, "when running in a Kubernetes cluster, add the authorization rules of the ProxyPolicy resources, watching them for changes")
+	flagSet.String("kube-proxy-policy-namespace", "", "only use the ProxyPolicy resources of this namespace (default all namespaces)")
+	flagSet.String("rate-limit", "", "limit the requests of each user to the upstreams to a rate such as 10/s, 100/m or 1000/h, allowing bursts of that many requests")
+	flagSet.Var(&rateLimitRoutes, "rate-limit-route", "limit the requests of each user for paths matching a regex to a rate instead of rate-limit: pattern=rate, e.g. ^/api/export=5/m (may be given multiple times)")
+	flagSet.Var(&stepUpRoutes, "step-up-route", "require sessions authenticated with an acr for request paths matching a regex: pattern=acr (may be given multiple times)")
 	flagSet.Bool("skip-provider-button", false, "will skip sign-in-page to directly reach the next step: oauth/start")
-	flagSet.Bool("skip-auth-preflight", false, "will skip authentication for OPTIONS requests")
+	flagSet.Bool("preserve-fragment", false, "with -skip-provider-button, serve a small page keeping the URL fragment of the requested page across the sign in")
+	flagSet.Bool("skip-auth-preflight", false, "will skip authentication for OPTIONS requests, passing them to the upstream")
 	flagSet.Bool("ssl-insecure-skip-verify", false, "skip validation of certificates presented when using HTTPS")
-	flagSet.Duration("flush-interval", time.Duration(1)*time.Second, "period between response flushing when streaming responses")
+	flagSet.Duration("flush-interval", time.Duration(1)*time.Second, "period between response flushing when streaming responses; a negative value flushes after every write")
+	flagSet.Var(&flushImmediatelyTypes, "flush-immediately-type", "a content type flushed to the client after every write, ignoring -flush-interval (may be given multiple times; default text/event-stream)")
+	flagSet.Bool("compress-responses", false, "gzip or brotli compress upstream responses which are not already compressed")
+	flagSet.Var(&compressTypes, "compress-type", "a content type to compress with -compress-responses (may be given multiple times; default text/html, text/css, text/plain, text/xml, application/javascript, application/json, application/xml and image/svg+xml)")
+	flagSet.Int64("compress-min-size", 1024, "minimum response size in bytes to compress with -compress-responses")
+	flagSet.Int64("max-request-body-size", 0, "maximum size in bytes of request bodies passed to upstreams, larger requests are rejected with 413; 0 for no limit")
+	flagSet.Duration("shutdown-timeout", time.Duration(30)*time.Second, "how long to wait for in flight requests and websocket connections to finish on SIGTERM")
+	flagSet.Bool("watch-config", false, "reload the configuration when the config file or a file of -config-dir changes, as on SIGHUP")
+	flagSet.Duration("upstream-health-check-interval", time.Duration(10)*time.Second, "period between probes of upstreams with a health-check option")
+	flagSet.Duration("upstream-health-check-timeout", time.Duration(2)*time.Second, "timeout of an upstream health check probe")
+	flagSet.String("token-exchange-url", "", "the RFC 8693 token exchange endpoint used for upstreams with a token-exchange-audience option (default the redeem-url of the provider)")
+	flagSet.String("upstream-jwt-key-file", "", "path to a PEM RSA private key: sign a short-lived JWT identifying the user for upstreams, and publish the public key at /oauth2/.well-known/jwks.json")
+	flagSet.String("upstream-jwt-header", "X-Forwarded-Jwt", "the request header the upstream JWT is passed in")
+	flagSet.String("upstream-jwt-issuer", "oauth2_proxy", "the iss claim of the upstream JWT")
+	flagSet.Duration("upstream-jwt-ttl", time.Duration(1)*time.Minute, "lifetime of the upstream JWT")
+	flagSet.Var(&stripRequestHeaders, "strip-request-header", "a client supplied request header to remove before proxying, e.g. X-Real-IP (may be given multiple times)")
+	flagSet.Var(&setRequestHeaders, "set-request-header", "a \"Name: value\" header to set on every request before proxying, replacing any client supplied value (may be given multiple times)")
+	flagSet.Var(&responseHeaders, "response-header", "a \"Name: value\" header to set on every upstream response, e.g. \"Strict-Transport-Security: max-age=31536000\" (may be given multiple times)")
 	flagSet.Bool("skip-jwt-bearer-tokens", false, "will skip requests that have verified JWT bearer tokens (default false)")
 	flagSet.Var(&jwtIssuers, "extra-jwt-issuers", "if skip-jwt-bearer-tokens is set, a list of extra JWT issuer=audience pairs (where the issuer URL has a .well-known/openid-configuration or a .well-known/jwks.json)")
 
-	flagSet.Var(&emailDomains, "email-domain", "authenticate emails with the specified domain (may be given multiple times). Use * to authenticate any email")
+	flagSet.Var(&emailDomains, "email-domain", "authenticate emails with the specified domain (may be given multiple times). Use *.example.com to authenticate the subdomains of example.com, or * to authenticate any email")
 	flagSet.Var(&whitelistDomains, "whitelist-domain", "allowed domains for redirection after authentication. Prefix domain with a . to allow subdomains (eg .example.com)")
+	flagSet.Var(&signOutRedirects, "sign-out-redirect-whitelist", "allowed rd targets of the sign out endpoint: a /path prefix, a domain or a domain/path prefix. Prefix domain with a . to allow subdomains (may be given multiple times)")
+	flagSet.Var(&redirectWhitelist, "redirect-whitelist", "allowed rd targets after signing in, in addition to -whitelist-domain: a /path prefix, a domain or a domain/path prefix. Prefix domain with a . to allow subdomains (may be given multiple times)")
 	flagSet.String("azure-tenant", "common", "go to a tenant-specific or common (tenant-independent) endpoint.")
 	flagSet.String("github-org", "", "restrict logins to members of this organisation")
 	flagSet.String("github-team", "", "restrict logins to members of this team")
@@ -62,8 +181,30 @@ func main() {
 	flagSet.String("google-service-account-json", "", "the path to the service account json credentials")
 	flagSet.String("client-id", "", "the OAuth Client ID: ie: \"123456.apps.googleusercontent.com\"")
 	flagSet.String("client-secret", "", "the OAuth Client Secret")
+	flagSet.String("client-secret-file", "", "the file to read the OAuth Client Secret from, e.g. a mounted Docker or Kubernetes secret")
+	flagSet.String("vault-address", "", "the address of the HashiCorp Vault to read secrets from, e.g. https://vault.example.com:8200")
+	flagSet.String("vault-token", "", "the Vault token, preferably given by OAUTH2_PROXY_VAULT_TOKEN or OAUTH2_PROXY_VAULT_TOKEN_FILE")
+	flagSet.String("vault-kubernetes-role", "", "log in to Vault as this role of the Kubernetes auth method with the service account token of the pod, instead of -vault-token")
+	flagSet.String("vault-kubernetes-mount", "kubernetes", "the path the Kubernetes auth method is mounted at in Vault")
+	flagSet.String("vault-client-secret", "", "read the OAuth Client Secret from this value of a Vault KV version 2 secret: <mount>/<path>#<key>")
+	flagSet.String("vault-cookie-secret", "", "read the cookie secret from this value of a Vault KV version 2 secret: <mount>/<path>#<key>")
+	flagSet.String("vault-pki-role", "", "serve HTTPS with a certificate issued, and renewed, by this role of a Vault PKI secrets engine: <mount>/<role>")
+	flagSet.String("vault-pki-common-name", "", "the common name of the certificate issued by -vault-pki-role")
+	flagSet.Duration("vault-pki-ttl", time.Duration(0), "the lifetime of the certificate issued by -vault-pki-role (0 for the TTL of the role)")
+	flagSet.String("aws-client-secret", "", "read the OAuth Client Secret from an AWS Secrets Manager secret ARN, optionally followed by #<key> of a JSON secret, or decrypt it from a base64 KMS encrypted blob")
+	flagSet.String("aws-cookie-secret", "", "read the cookie secret from an AWS Secrets Manager secret ARN, optionally followed by #<key> of a JSON secret, or decrypt it from a base64 KMS encrypted blob")
+	flagSet.String("aws-region", "", "the AWS region of KMS (default from AWS_REGION or AWS_DEFAULT_REGION)")
+	flagSet.String("aws-endpoint-url", "", "reach the AWS services at this URL, e.g. a VPC endpoint")
+	flagSet.Duration("aws-secrets-refresh-interval", time.Duration(1)*time.Hour, "check the Secrets Manager secrets for a new version this often and reload the configuration when one was rotated (0 to disable)")
 	flagSet.String("authenticated-emails-file", "", "authenticate against emails via file (one per line)")
+	flagSet.String("denied-users-file", "", "refuse the users and emails in this file (one per line) and end their sessions, regardless of any other rule")
+	flagSet.Duration("authenticated-emails-file-poll-interval", time.Duration(0), "check the authenticated emails file for changes this often instead of watching it, e.g. on NFS (0 to watch with file system notifications)")
 	flagSet.String("htpasswd-file", "", "additionally authenticate against a htpasswd file. Entries must be created with \"htpasswd -s\" for SHA encryption or \"htpasswd -B\" for bcrypt encryption")
+	flagSet.Duration("htpasswd-failure-delay", time.Duration(1)*time.Second, "time a htpasswd user has to wait after a failed login, doubled with each further failure up to 5m (0 to disable)")
+	flagSet.String("htpasswd-totp-file", "", "additionally require a TOTP code from htpasswd users, whose base32 secrets are read from this file of user:secret lines")
+	flagSet.String("webauthn-rp-id", "", "enable signing in with passkeys registered at /oauth2/webauthn/register; the domain the passkeys are bound to, e.g. example.com")
+	flagSet.String("webauthn-origin", "", "the origin of the sign in page passkeys are used on (default https://<webauthn-rp-id>)")
+	flagSet.String("webauthn-credentials-file", "", "the file registered passkeys are stored in; required unless sessions are stored in redis")
 	flagSet.Bool("display-htpasswd-form", true, "display username / password login form if an htpasswd file is provided")
 	flagSet.String("custom-templates-dir", "", "path to custom html templates")
 	flagSet.String("footer", "", "custom footer string. Use \"-\" to disable default footer.")
@@ -72,6 +213,7 @@ func main() {
 
 	flagSet.String("cookie-name", "_oauth2_proxy", "the name of the cookie that the oauth_proxy creates")
 	flagSet.String("cookie-secret", "", "the seed string for secure cookies (optionally base64 encoded)")
+	flagSet.String("cookie-secret-file", "", "the file to read the seed string for secure cookies from, e.g. a mounted Docker or Kubernetes secret")
 	flagSet.String("cookie-domain", "", "an optional cookie domain to force cookies to (ie: .yourcompany.com)*")
 	flagSet.String("cookie-path", "/", "an optional cookie path to force cookies to (ie: /poc/)*")
 	flagSet.Duration("cookie-expire", time.Duration(168)*time.Hour, "expire timeframe for cookie")
@@ -84,24 +226,66 @@ func main() {
 	flagSet.Bool("redis-use-sentinel", false, "Connect to redis via sentinels. Must set --redis-sentinel-master-name and --redis-sentinel-connection-urls to use this feature")
 	flagSet.String("redis-sentinel-master-name", "", "Redis sentinel master name. Used in conjuction with --redis-use-sentinel")
 	flagSet.Var(&redisSentinelConnectionURLs, "redis-sentinel-connection-urls", "List of Redis sentinel connection URLs (eg redis://HOST[:PORT]). Used in conjuction with --redis-use-sentinel")
+	flagSet.Duration("redis-leader-lease", time.Duration(15)*time.Second, "lease of the instance elected in redis to count the sessions in the shared session store; 0 counts them on every instance")
 
-	flagSet.String("logging-filename", "", "File to log requests to, empty for stdout")
+	flagSet.String("logging-filename", "", "File to log requests to, \"syslog\", empty for stdout")
 	flagSet.Int("logging-max-size", 100, "Maximum size in megabytes of the log file before rotation")
 	flagSet.Int("logging-max-age", 7, "Maximum number of days to retain old log files")
 	flagSet.Int("logging-max-backups", 0, "Maximum number of old log files to retain; 0 to disable")
 	flagSet.Bool("logging-local-time", true, "If the time in log files and backup filenames are local or UTC time")
 	flagSet.Bool("logging-compress", false, "Should rotated log files be compressed using gzip")
+	flagSet.Var(&loggingExcludePaths, "logging-exclude-path", "don't log requests for this path, e.g. /ping; a path ending in * excludes every path starting with it (may be given multiple times or comma separated)")
+	flagSet.Var(&loggingExcludeStatus, "logging-exclude-status", "don't log requests answered with this status code, e.g. 304, or class of status codes, e.g. 2xx (may be given multiple times or comma separated)")
+	flagSet.Float64("request-logging-sample-ratio", 1, "fraction of the requests with a 2xx status to log; other requests are always logged")
+	flagSet.Int("request-logging-sample-limit", 0, "log at most this many requests with a 2xx status a second; 0 for no limit")
+	flagSet.String("logging-redact-pii", "", "redact emails and user names from the logs: \"hash\" to replace them by a keyed hash, which still correlates the lines of a user, or \"mask\" to mask all but their first letters")
+	flagSet.Duration("logging-rotate-interval", time.Duration(0), "Also rotate log files this often, e.g. 24h to rotate at midnight UTC; 0 to only rotate by size")
 
 	flagSet.Bool("standard-logging", true, "Log standard runtime information")
 	flagSet.String("standard-logging-format", logger.DefaultStandardLoggingFormat, "Template for standard log lines")
+	flagSet.String("standard-logging-filename", "", "File to write standard logs to, \"stdout\", \"stderr\" or \"syslog\", empty for the logging-filename")
 
 	flagSet.Bool("request-logging", true, "Log HTTP requests")
-	flagSet.String("request-logging-format", logger.DefaultRequestLoggingFormat, "Template for HTTP request log lines")
+	flagSet.String("request-logging-format", logger.DefaultRequestLoggingFormat, "Template for HTTP request log lines, or one of the formats \"standard\" and \"combined\"")
+	flagSet.String("request-logging-filename", "", "File to write HTTP request logs to, \"stdout\", \"stderr\" or \"syslog\", empty for the logging-filename")
 
 	flagSet.Bool("auth-logging", true, "Log authentication attempts")
 	flagSet.String("auth-logging-format", logger.DefaultAuthLoggingFormat, "Template for authentication log lines")
+	flagSet.String("auth-logging-filename", "", "File to write authentication logs to, \"stdout\", \"stderr\" or \"syslog\", empty for the logging-filename")
+
+	flagSet.String("syslog-address", "", "syslog server of the \"syslog\" logging destination: udp://host:port, tcp://host:port, tls://host:port or unix:///path (default the local syslog daemon)")
+	flagSet.String("syslog-facility", "daemon", "syslog facility of log messages, e.g. daemon, auth or local0")
+	flagSet.String("syslog-tag", "oauth2_proxy", "syslog app name of log messages")
+	flagSet.String("syslog-ca-file", "", "CA certificates to verify a tls:// syslog server with instead of the system roots")
+
+	flagSet.String("tracing-otlp-endpoint", "", "OTLP/HTTP traces endpoint to export OpenTelemetry spans of requests to, e.g. http://otel-collector:4318/v1/traces")
+	flagSet.String("tracing-service-name", "oauth2_proxy", "service.name of the exported spans")
+	flagSet.Float64("tracing-sample-ratio", 1, "fraction of new traces to sample; traces continued from a traceparent header follow its sampled flag")
+	flagSet.Var(&traceHeaders, "trace-header", "<header>=<policy> for a tracing header of client requests, one of traceparent, b3, x-request-id or baggage, with a policy of trust (default), regenerate or strip (may be given multiple times or comma separated)")
+
+	flagSet.String("audit-log-filename", "", "file to write audit events of logins, token refreshes, logouts, denials and session revocations to as JSON lines, or stdout, stderr or syslog")
+	flagSet.String("audit-webhook-url", "", "URL to POST every audit event to as JSON")
+	flagSet.String("audit-kafka-rest-url", "", "Kafka REST Proxy topic URL to produce audit events to, e.g. http://kafka-rest:8082/topics/oauth2-proxy-audit")
+
+	flagSet.Bool("metrics", false, "serve Prometheus metrics on /metrics")
+	flagSet.String("metrics-address", "", "<addr>:<port> to serve Prometheus metrics on /metrics instead of the proxy address (enables -metrics)")
+
+	flagSet.String("sentry-dsn", "", "Sentry DSN to report panics and provider errors to, e.g. https://<key>@o0.ingest.sentry.io/<project>")
+	flagSet.String("sentry-environment", "", "environment of the errors reported to Sentry, e.g. production")
+	flagSet.String("error-webhook-url", "", "URL to POST reports of panics and provider errors to as JSON, instead of Sentry")
+
+	flagSet.String("failure-webhook-url", "", "URL to POST a Slack compatible JSON alert to when the authorization denials or provider errors within -failure-webhook-window reach -failure-webhook-threshold")
+	flagSet.Int("failure-webhook-threshold", 10, "number of authorization denials, or of provider errors, within -failure-webhook-window that triggers a failure alert")
+	flagSet.Duration("failure-webhook-window", time.Duration(5)*time.Minute, "window in which failures are counted; at most one alert per kind of failure is sent per window")
+
+	flagSet.String("debug-address", "", "<addr>:<port> to serve pprof profiles on /debug/pprof/ and runtime stats on /debug/runtime on, e.g. 127.0.0.1:6060 (disabled if empty)")
+	flagSet.String("debug-htpasswd-file", "", "htpasswd file of the users allowed to access the debug-address, required unless it is a loopback address")
+
+	flagSet.Var(&trustedRealIPCIDRs, "trusted-real-ip-cidr", "only trust X-Real-IP and X-Forwarded-For headers from proxies in this CIDR (may be given multiple times)")
+	flagSet.Var(&trustedIPs, "trusted-ip", "skip authentication for requests from this CIDR or address, e.g. of health checkers (may be given multiple times or comma separated)")
 
 	flagSet.String("provider", "google", "OAuth provider")
+	flagSet.Var(&providerPlugins, "provider-plugin", "path of a Go plugin registering an out-of-tree provider (may be given multiple times)")
 	flagSet.String("oidc-issuer-url", "", "OpenID Connect issuer URL (ie: https://accounts.google.com)")
 	flagSet.Bool("skip-oidc-discovery", false, "Skip OIDC discovery and use manually supplied Endpoints")
 	flagSet.String("oidc-jwks-url", "", "OpenID Connect JWKS URL (ie: https://www.googleapis.com/oauth2/v3/certs)")
@@ -127,26 +311,288 @@ func main() {
 		return
 	}
 
+	if *config == "" {
+		*config = os.Getenv(envPrefix + "CONFIG")
+	}
+	if *configDir == "" {
+		*configDir = os.Getenv(envPrefix + "CONFIG_DIR")
+	}
+	if *validateOnly {
+		if !validateConfig(flagSet, *config, *configDir, os.Stdout) {
+			os.Exit(1)
+		}
+		return
+	}
+	if *printConfig {
+		opts, err := resolveOptions(flagSet, *config, *configDir)
+		if err != nil {
+			logger.Printf("%s", err)
+			os.Exit(1)
+		}
+		writeConfig(os.Stdout, opts)
+		return
+	}
+	opts, err := loadOptions(flagSet, *config, *configDir)
+	if err != nil {
+		logger.Printf("%s", err)
+		os.Exit(1)
+	}
+
+	rand.Seed(time.Now().UnixNano())
+
+	maintenance := &maintenanceMode{}
+	maintenance.Set(opts.MaintenanceMode)
+
+	var metrics *proxyMetrics
+	if opts.Metrics || opts.MetricsAddress != "" {
+		metrics = newProxyMetrics()
+	}
+
+	if err := sockets.inherit(); err != nil {
+		logger.Fatalf("FATAL: inheriting the listening sockets failed - %s", err)
+	}
+
+	// done stops the background jobs of the current proxy, replaced on
+	// reload and closed on shutdown
+	var doneMu sync.Mutex
+	done := make(chan bool)
+	oauthproxy, err := newProxy(opts, maintenance, metrics, done)
+	if err != nil {
+		logger.Fatalf("FATAL: %s", err)
+	}
+
+	if opts.MetricsAddress != "" {
+		go serveMetrics(opts.MetricsAddress, metrics)
+	}
+	if opts.debugHandler != nil {
+		go serveDebug(opts.DebugAddress, opts.debugHandler)
+	}
+
+	handler := &reloadableHandler{}
+	handler.Store(newProxyHandler(opts, oauthproxy), oauthproxy)
+	if opts.ExtAuthzAddress != "" {
+		go newReloadableExtAuthzServer(handler).ListenAndServe(opts.ExtAuthzAddress)
+	}
+	s := &Server{
+		Handler: handler,
+		Opts:    opts,
+	}
+
+	if opts.WatchConfig {
+		if *config == "" && *configDir == "" {
+			logger.Printf("WARNING: watch-config is set without a config file or -config-dir to watch")
+		}
+		watchConfig(*config, *configDir)
+	}
+
+	go func() {
+		current := opts
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGHUP)
+		for range signals {
+			logger.Printf("received SIGHUP, reloading configuration")
+			newOpts, err := loadOptions(flagSet, *config, *configDir)
+			if err != nil {
+				logger.Printf("ERROR: reload failed, keeping current configuration - %s", err)
+				continue
+			}
+			newDone := make(chan bool)
+			newOAuthProxy, err := newProxy(newOpts, maintenance, metrics, newDone)
+			if err != nil {
+				logger.Printf("ERROR: reload failed, keeping current configuration - %s", err)
+				close(newDone)
+				continue
+			}
+			doneMu.Lock()
+			if done == nil {
+				// shutting down
+				doneMu.Unlock()
+				close(newDone)
+				return
+			}
+			handler.Store(newProxyHandler(newOpts, newOAuthProxy), newOAuthProxy)
+			close(done)
+			done = newDone
+			doneMu.Unlock()
+			changes := configChanges(current, newOpts)
+			current = newOpts
+			if len(changes) == 0 {
+				logger.Printf("configuration reloaded, no options changed")
+				continue
+			}
+			logger.Printf("configuration reloaded, changed options:")
+			for _, change := range changes {
+				logger.Printf("  %s", change)
+			}
+		}
+	}()
+
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGUSR1)
+		for range signals {
+			if maintenance.Toggle() {
+				logger.Printf("received SIGUSR1, maintenance mode enabled")
+			} else {
+				logger.Printf("received SIGUSR1, maintenance mode disabled")
+			}
+		}
+	}()
+
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGUSR2)
+		for range signals {
+			executable, err := os.Executable()
+			if err != nil {
+				logger.Printf("ERROR: upgrade failed, keeping the current process - %s", err)
+				continue
+			}
+			logger.Printf("received SIGUSR2, starting %s to take over the listening sockets", executable)
+			pid, err := sockets.upgrade(executable, os.Args[1:])
+			if err != nil {
+				logger.Printf("ERROR: upgrade failed, keeping the current process - %s", err)
+				continue
+			}
+			logger.Printf("process %d serves the listening sockets", pid)
+			shutdown <- syscall.SIGUSR2
+			return
+		}
+	}()
+
+	drained := make(chan struct{})
+	go func() {
+		sig := <-shutdown
+		logger.Printf("received %s, draining connections for up to %s", sig, opts.ShutdownTimeout)
+
+		ctx, cancel := context.WithTimeout(context.Background(), opts.ShutdownTimeout)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			logger.Printf("ERROR: graceful shutdown - %s", err)
+		}
+		// release the leader lease so that another instance takes over
+		// right away
+		doneMu.Lock()
+		close(done)
+		done = nil
+		leader := handler.Proxy().leader
+		doneMu.Unlock()
+		leader.Wait(5 * time.Second)
+		close(drained)
+	}()
+
+	if err := s.ListenAndServe(); err == http.ErrServerClosed {
+		<-drained
+	}
+}
+
+// loadOptions resolves the options from the config file, the drop-in config
+// files, environment and command line flags and validates them
+func loadOptions(flagSet *flag.FlagSet, config, configDir string) (*Options, error) {
+	opts, err := resolveOptions(flagSet, config, configDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+// resolveOptions resolves the options from the defaults, the config file, the
+// drop-in config files, environment and command line flags
+func resolveOptions(flagSet *flag.FlagSet, config, configDir string) (*Options, error) {
 	opts := NewOptions()
 
+	var files []string
+	if config != "" {
+		files = append(files, config)
+	}
+	if configDir != "" {
+		dirFiles, err := configDirFiles(configDir)
+		if err != nil {
+			return nil, fmt.Errorf("ERROR: failed to read config dir %s - %s", configDir, err)
+		}
+		files = append(files, dirFiles...)
+	}
 	cfg := make(EnvOptions)
-	if *config != "" {
-		_, err := toml.DecodeFile(*config, &cfg)
+	for _, filename := range files {
+		fileCfg, err := loadConfigFile(filename)
 		if err != nil {
-			logger.Fatalf("ERROR: failed to load config file %s - %s", *config, err)
+			return nil, fmt.Errorf("ERROR: failed to load config file %s - %s", filename, err)
 		}
+		// options of later files replace those of earlier ones
+		for name, value := range fileCfg {
+			cfg[name] = value
+		}
+	}
+	if err := cfg.LoadEnvForStruct(opts); err != nil {
+		return nil, fmt.Errorf("ERROR: %s", err)
 	}
-	cfg.LoadEnvForStruct(opts)
 	options.Resolve(opts, flagSet, cfg)
+	return opts, nil
+}
 
-	err := opts.Validate()
+// loadConfigFile loads a config file in the YAML or the legacy TOML format
+func loadConfigFile(filename string) (EnvOptions, error) {
+	if isYAMLConfig(filename) {
+		return loadYAMLConfig(filename)
+	}
+	cfg := make(EnvOptions)
+	_, err := toml.DecodeFile(filename, &cfg)
+	return cfg, err
+}
+
+// configDirExtensions are the extensions of the drop-in config files
+var configDirExtensions = map[string]bool{".cfg": true, ".conf": true, ".toml": true, ".yaml": true, ".yml": true}
+
+// configDirFiles lists the drop-in config files of dir in lexical order,
+// skipping hidden files such as the ..data link of a Kubernetes ConfigMap
+func configDirFiles(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
 	if err != nil {
-		logger.Printf("%s", err)
-		os.Exit(1)
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") || !configDirExtensions[strings.ToLower(filepath.Ext(name))] {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		// follow symbolic links, e.g. to the files of a ConfigMap
+		if fi, err := os.Stat(path); err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		files = append(files, path)
 	}
+	return files, nil
+}
 
-	validator := NewValidator(opts.EmailDomains, opts.AuthenticatedEmailsFile)
+// newProxy creates the OAuthProxy for the given options, switched into
+// maintenance by the shared maintenance mode. Watchers of the authenticated
+// emails file and upstream health checks are stopped when done is closed.
+func newProxy(opts *Options, maintenance *maintenanceMode, metrics *proxyMetrics, done <-chan bool) (*OAuthProxy, error) {
+	validator := newValidatorImpl(opts.EmailDomains, opts.AuthenticatedEmailsFile, opts.AuthenticatedEmailsPoll, done, func() {})
 	oauthproxy := NewOAuthProxy(opts, validator)
+	oauthproxy.maintenance = maintenance
+	if done != nil {
+		// without done the lease would never be released, and would keep
+		// the other instances from leading until it expires
+		oauthproxy.leader = newLeaderElection(oauthproxy.sessionStore, opts.LeaderLease)
+		go oauthproxy.leader.Run(done)
+	}
+	if metrics != nil {
+		// metrics are served on their own address if one is set
+		oauthproxy.metrics = metrics
+		metrics.setSessionStore(oauthproxy.sessionStore, oauthproxy.leader)
+		if opts.MetricsAddress == "" {
+			oauthproxy.metricsHandler = metrics
+		}
+	}
+	oauthproxy.StartHealthChecks(opts.HealthCheckInterval, done)
 
 	if len(opts.EmailDomains) != 0 && opts.AuthenticatedEmailsFile == "" {
 		if len(opts.EmailDomains) > 1 {
@@ -158,24 +604,53 @@ func main() {
 
 	if opts.HtpasswdFile != "" {
 		logger.Printf("using htpasswd file %s", opts.HtpasswdFile)
+		var err error
 		oauthproxy.HtpasswdFile, err = NewHtpasswdFromFile(opts.HtpasswdFile)
 		oauthproxy.DisplayHtpasswdForm = opts.DisplayHtpasswdForm
 		if err != nil {
-			logger.Fatalf("FATAL: unable to open %s %s", opts.HtpasswdFile, err)
+			return nil, fmt.Errorf("unable to open %s %s", opts.HtpasswdFile, err)
 		}
+		watchFile(opts.HtpasswdFile, done, func() {
+			oauthproxy.HtpasswdFile.Reload(opts.HtpasswdFile)
+		})
 	}
+	if opts.DeniedUsersFile != "" {
+		oauthproxy.denyList = newDenyList(opts.DeniedUsersFile, done)
+	}
+	if oauthproxy.kubePolicies != nil {
+		go oauthproxy.kubePolicies.Watch(done)
+	}
+	if oauthproxy.tracer != nil {
+		go oauthproxy.tracer.Run(done)
+	}
+	if oauthproxy.auditLog != nil {
+		go oauthproxy.auditLog.Run(done)
+	}
+	if oauthproxy.errorReporter != nil {
+		go oauthproxy.errorReporter.Run(done)
+	}
+	if oauthproxy.failureAlerts != nil {
+		go oauthproxy.failureAlerts.Run(done)
+	}
+	if opts.awsSecrets != nil {
+		go opts.awsSecrets.Run(done)
+	}
+	if opts.HtpasswdTOTPFile != "" {
+		logger.Printf("using htpasswd TOTP file %s", opts.HtpasswdTOTPFile)
+		var err error
+		oauthproxy.TOTPFile, err = NewTOTPFromFile(opts.HtpasswdTOTPFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open %s %s", opts.HtpasswdTOTPFile, err)
+		}
+	}
+	return oauthproxy, nil
+}
 
-	rand.Seed(time.Now().UnixNano())
-
-	var handler http.Handler
+func newProxyHandler(opts *Options, oauthproxy *OAuthProxy) http.Handler {
+	var handler http.Handler = loggingHandler{handler: oauthproxy.errorReporter.Handler(oauthproxy), metrics: oauthproxy.metrics}
+	handler = oauthproxy.traceHeaders.Strip(oauthproxy.tracer.Handler(oauthproxy.traceHeaders.Regenerate(handler)))
 	if opts.GCPHealthChecks {
-		handler = gcpHealthcheck(LoggingHandler(oauthproxy))
-	} else {
-		handler = LoggingHandler(oauthproxy)
-	}
-	s := &Server{
-		Handler: handler,
-		Opts:    opts,
+		return gcpHealthcheck(handler)
 	}
-	s.ListenAndServe()
+	return handler
 }
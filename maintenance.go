@@ -0,0 +1,110 @@
+package oauthproxy
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	sessionsapi "github.com/OpusCapita/oauth2_proxy/pkg/apis/sessions"
+)
+
+// maintenanceMode is the runtime switch for serving the maintenance page.
+// main shares one instance between the proxies created on configuration
+// reloads, so the state is kept across SIGHUP.
+type maintenanceMode struct {
+	enabled int32
+}
+
+// Enabled returns whether maintenance mode is switched on
+func (m *maintenanceMode) Enabled() bool {
+	return atomic.LoadInt32(&m.enabled) == 1
+}
+
+// Set switches maintenance mode on or off
+func (m *maintenanceMode) Set(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&m.enabled, v)
+}
+
+// Toggle flips maintenance mode and returns the new state
+func (m *maintenanceMode) Toggle() bool {
+	for {
+		old := atomic.LoadInt32(&m.enabled)
+		if atomic.CompareAndSwapInt32(&m.enabled, old, 1-old) {
+			return old == 0
+		}
+	}
+}
+
+// underMaintenance returns whether the maintenance page is served for a
+// request for path with the session, which may be nil, instead of passing it
+// upstream. Users whose email matches one of the maintenance allowed emails
+// or @domains, or who are members of one of the maintenance allowed groups,
+// always get through.
+func (p *OAuthProxy) underMaintenance(path string, session *sessionsapi.SessionState) bool {
+	if p.maintenance == nil || !p.maintenance.Enabled() {
+		return false
+	}
+	if len(p.maintenancePaths) > 0 {
+		matched := false
+		for _, r := range p.maintenancePaths {
+			if r.MatchString(path) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if session == nil {
+		return true
+	}
+	if email := strings.ToLower(session.Email); email != "" {
+		for _, allowed := range p.maintenanceAllowed {
+			allowed = strings.ToLower(allowed)
+			if email == allowed || (strings.HasPrefix(allowed, "@") && strings.HasSuffix(email, allowed)) {
+				return false
+			}
+		}
+	}
+	for _, allowed := range p.maintenanceGroups {
+		for _, group := range session.Groups {
+			if group == allowed {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// maintenanceSession returns the session cookie sent with a request which
+// skips authentication, so allowed users reach those paths during maintenance
+// too
+func (p *OAuthProxy) maintenanceSession(req *http.Request) *sessionsapi.SessionState {
+	if p.maintenance == nil || !p.maintenance.Enabled() {
+		return nil
+	}
+	session, err := p.LoadCookiedSession(req)
+	if err != nil {
+		return nil
+	}
+	return session
+}
+
+// MaintenancePage writes the maintenance template with a 503 status
+func (p *OAuthProxy) MaintenancePage(rw http.ResponseWriter) {
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusServiceUnavailable)
+	t := struct {
+		Title       string
+		ProxyPrefix string
+	}{
+		Title:       "Down for Maintenance",
+		ProxyPrefix: p.ProxyPrefix,
+	}
+	p.templates.ExecuteTemplate(rw, "maintenance.html", t)
+}
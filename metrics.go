@@ -0,0 +1,188 @@
+package oauthproxy
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/OpusCapita/oauth2_proxy/logger"
+	sessionsapi "github.com/OpusCapita/oauth2_proxy/pkg/apis/sessions"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsPath is the path the metrics are served on
+const metricsPath = "/metrics"
+
+// proxyMetrics are the Prometheus metrics of the proxy. They outlive
+// configuration reloads, so that the counters are not reset. The methods of
+// nil proxyMetrics do nothing.
+type proxyMetrics struct {
+	http.Handler
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	logins          *prometheus.CounterVec
+	refreshes       *prometheus.CounterVec
+	dryRunDenials   *prometheus.CounterVec
+
+	// sessionCounter holds the sessionCounter of the current session store
+	sessionCounter atomic.Value
+}
+
+// sessionCounter wraps the session store and its leader election so that
+// atomic.Value always holds the same type
+type sessionCounter struct {
+	sessionsapi.Counter
+	leader *leaderElection
+}
+
+func newProxyMetrics() *proxyMetrics {
+	m := &proxyMetrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "oauth2_proxy_requests_total",
+			Help: "Requests served, by status code and upstream.",
+		}, []string{"code", "upstream"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "oauth2_proxy_request_duration_seconds",
+			Help:    "Latency of the requests served, by status code and upstream.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"code", "upstream"}),
+		logins: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "oauth2_proxy_logins_total",
+			Help: "Logins, by provider, method and result.",
+		}, []string{"provider", "method", "result"}),
+		refreshes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "oauth2_proxy_token_refreshes_total",
+			Help: "Refreshes of the tokens of sessions, by provider and result.",
+		}, []string{"provider", "result"}),
+		dryRunDenials: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "oauth2_proxy_authz_dry_run_denials_total",
+			Help: "Requests which dry run authorization rules would have denied, by check.",
+		}, []string{"check"}),
+	}
+	// a registry of its own rather than the default one, as the metrics of
+	// the proxy are created again by tests
+	r := prometheus.NewRegistry()
+	r.MustRegister(m.requests, m.requestDuration, m.logins, m.refreshes, m.dryRunDenials,
+		newOptionalGauge("oauth2_proxy_active_sessions",
+			"Sessions in the session store which have not expired.", m.activeSessions),
+		newOptionalGauge("oauth2_proxy_leader",
+			"Whether this instance runs the background jobs on the session store.", m.leading))
+	m.Handler = promhttp.HandlerFor(r, promhttp.HandlerOpts{})
+	return m
+}
+
+// optionalGauge is a gauge whose value is read when the metrics are
+// collected, and which is left out when its value is unknown, e.g. the
+// active sessions of a store that cannot count them
+type optionalGauge struct {
+	desc  *prometheus.Desc
+	value func() (float64, bool)
+}
+
+func newOptionalGauge(name, help string, value func() (float64, bool)) *optionalGauge {
+	return &optionalGauge{desc: prometheus.NewDesc(name, help, nil, nil), value: value}
+}
+
+func (g *optionalGauge) Describe(ch chan<- *prometheus.Desc) {
+	ch <- g.desc
+}
+
+func (g *optionalGauge) Collect(ch chan<- prometheus.Metric) {
+	if v, ok := g.value(); ok {
+		ch <- prometheus.MustNewConstMetric(g.desc, prometheus.GaugeValue, v)
+	}
+}
+
+// setSessionStore counts the active sessions of the store, if it keeps them
+// on the server, on the instance elected leader
+func (m *proxyMetrics) setSessionStore(store sessionsapi.SessionStore, leader *leaderElection) {
+	if m == nil {
+		return
+	}
+	counter, _ := store.(sessionsapi.Counter)
+	m.sessionCounter.Store(sessionCounter{counter, leader})
+}
+
+// activeSessions counts the sessions on the leader only, so that the count
+// of a store shared by several instances is scanned and exposed once
+func (m *proxyMetrics) activeSessions() (float64, bool) {
+	c, _ := m.sessionCounter.Load().(sessionCounter)
+	if c.Counter == nil || !c.leader.Leading() {
+		return 0, false
+	}
+	n, err := c.Count()
+	if err != nil {
+		logger.Printf("Error counting active sessions: %s", err)
+		return 0, false
+	}
+	return float64(n), true
+}
+
+// observeRequest records a request served with the status by the upstream,
+// which is empty for requests the proxy answered itself
+func (m *proxyMetrics) observeRequest(status int, upstream string, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	code := strconv.Itoa(status)
+	m.requests.WithLabelValues(code, upstream).Inc()
+	m.requestDuration.WithLabelValues(code, upstream).Observe(duration.Seconds())
+}
+
+// login records a login via the provider and method
+func (m *proxyMetrics) login(provider, method string, success bool) {
+	if m == nil {
+		return
+	}
+	m.logins.WithLabelValues(provider, method, metricResult(success)).Inc()
+}
+
+// refresh records a refresh of the tokens of a session with the provider
+func (m *proxyMetrics) refresh(provider string, success bool) {
+	if m == nil {
+		return
+	}
+	m.refreshes.WithLabelValues(provider, metricResult(success)).Inc()
+}
+
+// dryRunDenial records a request which the dry run authz policy or access
+// hours check would have denied
+func (m *proxyMetrics) dryRunDenial(check string) {
+	if m == nil {
+		return
+	}
+	m.dryRunDenials.WithLabelValues(check).Inc()
+}
+
+func (m *proxyMetrics) leading() (float64, bool) {
+	c, ok := m.sessionCounter.Load().(sessionCounter)
+	if !ok || !c.leader.Leading() {
+		return 0, ok
+	}
+	return 1, true
+}
+
+func metricResult(success bool) string {
+	if success {
+		return "success"
+	}
+	return "failure"
+}
+
+// serveMetrics serves the metrics on a separate address, e.g. one that is
+// only reachable by Prometheus
+func serveMetrics(addr string, m *proxyMetrics) {
+	ln, err := sockets.listen("metrics", "tcp", addr)
+	if err != nil {
+		logger.Fatalf("FATAL: metrics listen (%s) failed - %s", addr, err)
+	}
+	logger.Printf("metrics: listening on %s", ln.Addr())
+
+	mux := http.NewServeMux()
+	mux.Handle(metricsPath, m)
+	if err := http.Serve(ln, mux); err != nil {
+		logger.Printf("ERROR: metrics Serve() - %s", err)
+	}
+}
@@ -0,0 +1,47 @@
+package oauthproxy
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	opts := testOptions()
+	opts.Metrics = true
+	assert.NoError(t, opts.Validate())
+	done := make(chan bool)
+	defer close(done)
+	metrics := newProxyMetrics()
+	proxy, err := newProxy(opts, &maintenanceMode{}, metrics, done)
+	assert.NoError(t, err)
+	handler := newProxyHandler(opts, proxy)
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/ping", nil))
+	proxy.auditLogin(httptest.NewRequest("POST", "/oauth2/sign_in", nil), nil, "jdoe", "htpasswd", "invalid password")
+	proxy.metrics.refresh(proxy.providerID, true)
+
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, 200, rw.Code)
+	body := rw.Body.String()
+	assert.Contains(t, body, `oauth2_proxy_requests_total{code="200",upstream=""} 1`)
+	assert.Contains(t, body, `oauth2_proxy_request_duration_seconds_count{code="200",upstream=""} 1`)
+	assert.Contains(t, body, `oauth2_proxy_logins_total{method="htpasswd",provider="google",result="failure"} 1`)
+	assert.Contains(t, body, `oauth2_proxy_token_refreshes_total{provider="google",result="success"} 1`)
+	// cookie sessions cannot be counted
+	assert.NotContains(t, body, "oauth2_proxy_active_sessions")
+	// nor shared, so every instance leads
+	assert.Contains(t, body, "oauth2_proxy_leader 1")
+
+	// on a separate address the proxy does not serve the metrics
+	opts = testOptions()
+	opts.MetricsAddress = "127.0.0.1:9100"
+	assert.NoError(t, opts.Validate())
+	proxy, err = newProxy(opts, &maintenanceMode{}, metrics, done)
+	assert.NoError(t, err)
+	rw = httptest.NewRecorder()
+	newProxyHandler(opts, proxy).ServeHTTP(rw, httptest.NewRequest("GET", "/metrics", nil))
+	assert.NotEqual(t, 200, rw.Code)
+}
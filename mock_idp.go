@@ -0,0 +1,63 @@
+package oauthproxy
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/OpusCapita/oauth2_proxy/pkg/mockidp"
+)
+
+// mockIDPCommand serves a mock OpenID Connect identity provider for local
+// development and tests
+func mockIDPCommand(args []string) int {
+	flagSet := flag.NewFlagSet("mock-idp", flag.ContinueOnError)
+	address := flagSet.String("address", "127.0.0.1:4181", "<addr>:<port> to serve the identity provider on")
+	issuer := flagSet.String("issuer", "", "the issuer URL of the tokens (default http://<address>)")
+	userFlags := StringArray{}
+	flagSet.Var(&userFlags, "user", "a user to sign in as email, \"Name <email>\", either followed by =group1,group2 (may be given multiple times, default user@example.com)")
+	if err := flagSet.Parse(args); err != nil {
+		return 2
+	}
+	if len(userFlags) == 0 {
+		userFlags = append(userFlags, "user@example.com")
+	}
+	server, err := mockidp.New(parseMockUsers(userFlags))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	server.Issuer = *issuer
+	if server.Issuer == "" {
+		server.Issuer = "http://" + *address
+	}
+	fmt.Printf("mock identity provider listening on %s, run the proxy with\n"+
+		"  -provider=oidc -oidc-issuer-url=%s -client-id=oauth2_proxy -client-secret=mock\n", *address, server.Issuer)
+	if err := http.ListenAndServe(*address, server); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// parseMockUsers parses the -user values of mock-idp, each an email or a
+// name followed by the email in angle brackets, optionally followed by = and
+// the groups
+func parseMockUsers(values []string) []mockidp.User {
+	var users []mockidp.User
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		user := mockidp.User{Email: strings.TrimSpace(parts[0])}
+		if i := strings.Index(user.Email, "<"); i >= 0 && strings.HasSuffix(user.Email, ">") {
+			user.Name = strings.TrimSpace(user.Email[:i])
+			user.Email = user.Email[i+1 : len(user.Email)-1]
+		}
+		if len(parts) == 2 && parts[1] != "" {
+			user.Groups = strings.Split(parts[1], ",")
+		}
+		users = append(users, user)
+	}
+	return users
+}
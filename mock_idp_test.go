@@ -0,0 +1,17 @@
+package oauthproxy
+
+import (
+	"testing"
+
+	"github.com/OpusCapita/oauth2_proxy/pkg/mockidp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMockUsers(t *testing.T) {
+	assert.Equal(t, []mockidp.User{
+		{Email: "alice@example.com", Groups: []string{"admins", "devs"}},
+		{Email: "bob@example.com"},
+		{Email: "carol@example.com", Name: "Carol Smith", Groups: []string{"devs"}},
+		{Email: "dave@example.com", Name: "Dave"},
+	}, parseMockUsers([]string{"alice@example.com=admins,devs", "bob@example.com=", "Carol Smith <carol@example.com>=devs", "Dave <dave@example.com>"}))
+}
@@ -0,0 +1,243 @@
+package oauthproxy
+
+import (
+	"container/heap"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/OpusCapita/oauth2_proxy/logger"
+	sessionsapi "github.com/OpusCapita/oauth2_proxy/pkg/apis/sessions"
+)
+
+// oauthStateMaxAge is how long a login may take at the provider before the
+// OAuth2 state is rejected by the callback
+const oauthStateMaxAge = time.Hour
+
+// Errors of the OAuth2 state check of the callback
+var (
+	errStateInvalid  = errors.New("invalid state")
+	errStateExpired  = errors.New("state expired")
+	errStateCSRF     = errors.New("state does not match the CSRF cookie")
+	errStateReplayed = errors.New("state already used")
+)
+
+// oauthState is the OAuth2 state passed through the provider. It is sealed
+// with a key derived from the cookie secret, so the callback can be handled
+// by any replica sharing the cookie secret, not only the one that started the
+// login.
+type oauthState struct {
+	// Nonce identifies the state, so that it is accepted only once
+	Nonce string `json:"n"`
+	// CSRF is the HMAC of the CSRF cookie of the browser which started the
+	// login
+	CSRF string `json:"c"`
+	// IDNonce is the nonce sent to a providers.NonceProvider, which must be
+	// returned in the ID token
+	IDNonce  string `json:"o,omitempty"`
+	Redirect string `json:"r"`
+	IssuedAt int64  `json:"i"`
+	Expires  int64  `json:"e"`
+}
+
+// deriveKey returns a key for the given purpose derived from the cookie
+// secret
+func deriveKey(secret, purpose string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// stateCipher returns the AES-GCM cipher sealing the OAuth2 state
+func (p *OAuthProxy) stateCipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(deriveKey(p.CookieSeed, "oauth2_proxy state"))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealJSON encodes v as JSON, seals it with aead under a random nonce and
+// returns it base64 URL encoded
+func sealJSON(aead cipher.AEAD, v interface{}) (string, error) {
+	plaintext, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	sealed := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, sealed); err != nil {
+		return "", err
+	}
+	sealed = aead.Seal(sealed, sealed, plaintext, nil)
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// openJSON opens a value sealed by sealJSON into v
+func openJSON(aead cipher.AEAD, value string, v interface{}) error {
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return errors.New("invalid encoding")
+	}
+	if len(sealed) < aead.NonceSize() {
+		return errors.New("invalid length")
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return errors.New("invalid signature")
+	}
+	return json.Unmarshal(plaintext, v)
+}
+
+// csrfMAC returns the HMAC binding a state to the value of the CSRF cookie
+func (p *OAuthProxy) csrfMAC(csrf string) string {
+	mac := hmac.New(sha256.New, deriveKey(p.CookieSeed, "oauth2_proxy csrf"))
+	mac.Write([]byte(csrf))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// encodeState seals a fresh nonce, the HMAC of the CSRF cookie value, the ID
+// token nonce and the redirect into an OAuth2 state that expires
+// oauthStateMaxAge after now
+func (p *OAuthProxy) encodeState(csrf, idNonce, redirect string, now time.Time) (string, error) {
+	aead, err := p.stateCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return sealJSON(aead, oauthState{
+		Nonce:    hex.EncodeToString(nonce),
+		CSRF:     p.csrfMAC(csrf),
+		IDNonce:  idNonce,
+		Redirect: redirect,
+		IssuedAt: now.Unix(),
+		Expires:  now.Add(oauthStateMaxAge).Unix(),
+	})
+}
+
+// decodeState opens an OAuth2 state created by encodeState and checks that
+// it has not expired
+func (p *OAuthProxy) decodeState(state string, now time.Time) (*oauthState, error) {
+	aead, err := p.stateCipher()
+	if err != nil {
+		return nil, err
+	}
+	s := &oauthState{}
+	if err := openJSON(aead, state, s); err != nil {
+		return nil, err
+	}
+	if now.After(time.Unix(s.Expires, 0)) {
+		return nil, fmt.Errorf("expired at %s", time.Unix(s.Expires, 0).UTC().Format(time.RFC3339))
+	}
+	return s, nil
+}
+
+// checkState returns the OAuth2 state of a callback once it is opened, not
+// expired, bound to the CSRF cookie of the browser and not used before. The
+// returned error is one of the errState errors, the details are logged.
+func (p *OAuthProxy) checkState(state, csrf string, now time.Time) (*oauthState, error) {
+	aead, err := p.stateCipher()
+	if err != nil {
+		return nil, err
+	}
+	s := &oauthState{}
+	if err := openJSON(aead, state, s); err != nil {
+		logger.Printf("Error while parsing OAuth2 state: %s", err.Error())
+		return nil, errStateInvalid
+	}
+	if now.After(time.Unix(s.Expires, 0)) {
+		logger.Printf("OAuth2 state issued at %s expired at %s", time.Unix(s.IssuedAt, 0).UTC().Format(time.RFC3339), time.Unix(s.Expires, 0).UTC().Format(time.RFC3339))
+		return nil, errStateExpired
+	}
+	if !hmac.Equal([]byte(s.CSRF), []byte(p.csrfMAC(csrf))) {
+		return nil, errStateCSRF
+	}
+	if !p.usedStates.use(s.Nonce, time.Unix(s.Expires, 0), now) {
+		return nil, errStateReplayed
+	}
+	return s, nil
+}
+
+// usedStates remembers the nonces of the OAuth2 states accepted by the
+// callback until they expire, so that a state is accepted only once. When the
+// session store can hold locks, the nonces are also locked in the store, so
+// that a state is accepted once among all the replicas sharing it.
+type usedStates struct {
+	locker sessionsapi.Locker
+	holder string
+
+	mu     sync.Mutex
+	nonces map[string]time.Time
+	// expiries orders the nonces by expiry, so the expired ones are
+	// forgotten without scanning them all
+	expiries nonceExpiries
+}
+
+// nonceExpiry is a used nonce and the time its state expires
+type nonceExpiry struct {
+	nonce   string
+	expires time.Time
+}
+
+// nonceExpiries is a heap of used nonces, the earliest expiring first
+type nonceExpiries []nonceExpiry
+
+func (h nonceExpiries) Len() int            { return len(h) }
+func (h nonceExpiries) Less(i, j int) bool  { return h[i].expires.Before(h[j].expires) }
+func (h nonceExpiries) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *nonceExpiries) Push(x interface{}) { *h = append(*h, x.(nonceExpiry)) }
+func (h *nonceExpiries) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// newUsedStates returns the used states, shared through the store if it can
+// hold locks
+func newUsedStates(store sessionsapi.SessionStore) *usedStates {
+	locker, _ := store.(sessionsapi.Locker)
+	holder := make([]byte, 8)
+	rand.Read(holder)
+	return &usedStates{locker: locker, holder: hex.EncodeToString(holder), nonces: map[string]time.Time{}}
+}
+
+// use records the nonce of a state expiring at expires, and returns false if
+// it was already used
+func (u *usedStates) use(nonce string, expires, now time.Time) bool {
+	u.mu.Lock()
+	for len(u.expiries) > 0 && now.After(u.expiries[0].expires) {
+		delete(u.nonces, heap.Pop(&u.expiries).(nonceExpiry).nonce)
+	}
+	_, used := u.nonces[nonce]
+	if !used {
+		u.nonces[nonce] = expires
+		heap.Push(&u.expiries, nonceExpiry{nonce, expires})
+	}
+	u.mu.Unlock()
+	if used {
+		return false
+	}
+	if u.locker == nil {
+		return true
+	}
+	ok, err := u.locker.Lock("state-"+nonce, u.holder, expires.Sub(now))
+	if err != nil {
+		// accept it as long as it is not used on this instance
+		logger.Printf("Error locking OAuth2 state: %s", err.Error())
+		return true
+	}
+	return ok
+}
@@ -0,0 +1,149 @@
+package oauthproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/OpusCapita/oauth2_proxy/pkg/apis/options"
+	"github.com/OpusCapita/oauth2_proxy/pkg/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+func newStateTestProxy(cookieSecret string) *OAuthProxy {
+	opts := NewOptions()
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = cookieSecret
+	opts.Validate()
+	return NewOAuthProxy(opts, func(string) bool { return true })
+}
+
+func TestOAuthState(t *testing.T) {
+	now := time.Now()
+	proxy := newStateTestProxy("xyzzyplugh")
+	state, err := proxy.encodeState("nonce", "idnonce", "/app?a=b:c", now)
+	assert.NoError(t, err)
+	assert.NotContains(t, state, "/app")
+	assert.NotContains(t, state, "idnonce")
+
+	// another replica with the same cookie secret
+	replica := newStateTestProxy("xyzzyplugh")
+	s, err := replica.decodeState(state, now.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Len(t, s.Nonce, 32)
+	assert.Equal(t, proxy.csrfMAC("nonce"), s.CSRF)
+	assert.Equal(t, "idnonce", s.IDNonce)
+	assert.Equal(t, now.Unix(), s.IssuedAt)
+	assert.Equal(t, "/app?a=b:c", s.Redirect)
+
+	_, err = replica.decodeState(state, now.Add(oauthStateMaxAge+time.Second))
+	assert.True(t, strings.HasPrefix(err.Error(), "expired at "))
+	_, err = newStateTestProxy("other secret").decodeState(state, now)
+	assert.EqualError(t, err, "invalid signature")
+	tampered := []byte(state)
+	tampered[len(tampered)/2] ^= 1
+	_, err = replica.decodeState(string(tampered), now)
+	assert.Error(t, err)
+	_, err = replica.decodeState("nonce:/app", now)
+	assert.EqualError(t, err, "invalid encoding")
+}
+
+func TestCheckState(t *testing.T) {
+	now := time.Now()
+	proxy := newStateTestProxy("xyzzyplugh")
+	state, err := proxy.encodeState("csrf", "", "/app", now)
+	assert.NoError(t, err)
+
+	_, err = proxy.checkState("garbage", "csrf", now)
+	assert.Equal(t, errStateInvalid, err)
+	_, err = proxy.checkState(state, "csrf", now.Add(oauthStateMaxAge+time.Second))
+	assert.Equal(t, errStateExpired, err)
+	_, err = proxy.checkState(state, "other csrf", now)
+	assert.Equal(t, errStateCSRF, err)
+	s, err := proxy.checkState(state, "csrf", now)
+	assert.NoError(t, err)
+	assert.Equal(t, "/app", s.Redirect)
+	_, err = proxy.checkState(state, "csrf", now)
+	assert.Equal(t, errStateReplayed, err)
+
+	// another state is accepted
+	state, _ = proxy.encodeState("csrf", "", "/app", now)
+	_, err = proxy.checkState(state, "csrf", now)
+	assert.NoError(t, err)
+}
+
+func TestUsedStatesShared(t *testing.T) {
+	mr, err := miniredis.Run()
+	assert.NoError(t, err)
+	defer mr.Close()
+	store, err := sessions.NewSessionStore(&options.SessionOptions{
+		Type:              options.RedisSessionStoreType,
+		RedisStoreOptions: options.RedisStoreOptions{RedisConnectionURL: "redis://" + mr.Addr()},
+	}, &options.CookieOptions{CookieName: "_oauth2_proxy"})
+	assert.NoError(t, err)
+
+	now := time.Now()
+	first := newUsedStates(store)
+	second := newUsedStates(store)
+	assert.True(t, first.use("nonce", now.Add(time.Minute), now))
+	// the replica sharing the store rejects it too
+	assert.False(t, second.use("nonce", now.Add(time.Minute), now))
+	assert.True(t, second.use("other nonce", now.Add(time.Minute), now))
+
+	// the nonces are forgotten once expired
+	later := now.Add(2 * time.Minute)
+	mr.FastForward(2 * time.Minute)
+	assert.True(t, first.use("nonce", later.Add(time.Minute), later))
+	assert.Len(t, first.nonces, 1)
+	assert.True(t, second.use("third nonce", later.Add(time.Minute), later))
+	assert.Len(t, second.nonces, 1)
+	assert.Len(t, second.expiries, 1)
+}
+
+func TestOAuthCallbackState(t *testing.T) {
+	proxy := newStateTestProxy("xyzzyplugh")
+	callback := func(state string, csrf *http.Cookie) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/oauth2/callback?code=callback_code&state="+url.QueryEscape(state), nil)
+		if csrf != nil {
+			req.AddCookie(csrf)
+		}
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	csrf := proxy.MakeCSRFCookie(req, "csrf", time.Hour, time.Now())
+
+	state, _ := proxy.encodeState("csrf", "", "/", time.Now().Add(-oauthStateMaxAge-time.Minute))
+	rw := callback(state, csrf)
+	assert.Equal(t, 403, rw.Code)
+	assert.Contains(t, rw.Body.String(), "The sign in took too long. Please sign in again.")
+
+	state, _ = proxy.encodeState("csrf", "", "/", time.Now())
+	rw = callback(state, nil)
+	assert.Equal(t, 403, rw.Code)
+	rw = callback(state, proxy.MakeCSRFCookie(req, "other", time.Hour, time.Now()))
+	assert.Equal(t, 403, rw.Code)
+	assert.Contains(t, rw.Body.String(), "csrf failed")
+	rw = callback("garbage", csrf)
+	assert.Equal(t, 403, rw.Code)
+	assert.Contains(t, rw.Body.String(), "Invalid State")
+
+	// the state is checked before the code is redeemed, so a replayed state
+	// never reaches the provider
+	proxy.usedStates.use(mustDecodeState(t, proxy, state).Nonce, time.Now().Add(time.Hour), time.Now())
+	rw = callback(state, csrf)
+	assert.Equal(t, 403, rw.Code)
+	assert.Contains(t, rw.Body.String(), "This sign in was already completed.")
+}
+
+func mustDecodeState(t *testing.T, proxy *OAuthProxy, state string) *oauthState {
+	s, err := proxy.decodeState(state, time.Now())
+	assert.NoError(t, err)
+	return s
+}
@@ -1,8 +1,9 @@
-package main
+package oauthproxy
 
 import (
 	"context"
 	b64 "encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
@@ -10,6 +11,7 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"path"
 	"regexp"
 	"strings"
 	"time"
@@ -19,6 +21,8 @@ import (
 	"github.com/OpusCapita/oauth2_proxy/cookie"
 	"github.com/OpusCapita/oauth2_proxy/logger"
 	sessionsapi "github.com/OpusCapita/oauth2_proxy/pkg/apis/sessions"
+	"github.com/OpusCapita/oauth2_proxy/pkg/signature"
+	"github.com/OpusCapita/oauth2_proxy/pkg/tracing"
 	"github.com/OpusCapita/oauth2_proxy/providers"
 	"github.com/yhat/wsutil"
 )
@@ -26,7 +30,7 @@ import (
 const (
 	// SignatureHeader is the name of the request header containing the GAP Signature
 	// Part of hmacauth
-	SignatureHeader = "GAP-Signature"
+	SignatureHeader = signature.Header
 
 	httpScheme  = "http"
 	httpsScheme = "https"
@@ -36,18 +40,7 @@ const (
 
 // SignatureHeaders contains the headers to be signed by the hmac algorithm
 // Part of hmacauth
-var SignatureHeaders = []string{
-	"Content-Length",
-	"Content-Md5",
-	"Content-Type",
-	"Date",
-	"Authorization",
-	"X-Forwarded-User",
-	"X-Forwarded-Email",
-	"X-Forwarded-Access-Token",
-	"Cookie",
-	"Gap-Auth",
-}
+var SignatureHeaders = signature.Headers
 
 var (
 	// ErrNeedsLogin means the user should be redirected to the login page
@@ -69,54 +62,130 @@ type OAuthProxy struct {
 
 	RobotsPath        string
 	PingPath          string
+	ReadyPath         string
+	HealthPath        string
 	SignInPath        string
 	SignOutPath       string
+	SignOutAllPath    string
 	OAuthStartPath    string
 	OAuthCallbackPath string
+	SilentAuthPath    string
+	StepUpPath        string
 	AuthOnlyPath      string
+	UserInfoPath      string
+	RefreshPath       string
+	StaticPath        string
+	UpstreamsPath     string
+	JWKSPath          string
+	WebAuthnPath      string
+	SSOPath           string
 
 	redirectURL         *url.URL // the url to receive requests at
 	whitelistDomains    []string
+	signOutRedirects    []string
+	redirectWhitelist   []string
 	provider            providers.Provider
+	providerID          string
 	sessionStore        sessionsapi.SessionStore
 	ProxyPrefix         string
 	SignInMessage       string
 	HtpasswdFile        *HtpasswdFile
+	TOTPFile            *TOTPFile
+	loginBackoff        *loginBackoff
+	denyList            *denyList
 	DisplayHtpasswdForm bool
 	serveMux            http.Handler
 	SetXAuthRequest     bool
 	PassBasicAuth       bool
 	SkipProviderButton  bool
+	preserveFragment    bool
 	PassUserHeaders     bool
 	BasicAuthPassword   string
 	PassAccessToken     bool
+	accessTokenHeader   string
+	accessTokenBearer   bool
 	SetAuthorization    bool
 	PassAuthorization   bool
+	PassIDToken         bool
+	forwardAuth         bool
+	forwardUserHeader   string
+	forwardEmailHeader  string
+	groupsHeader        *groupsHeader
+	stripRequestHeaders []string
+	setRequestHeaders   http.Header
 	skipAuthRegex       []string
 	skipAuthPreflight   bool
 	skipJwtBearerTokens bool
 	jwtBearerVerifiers  []*oidc.IDTokenVerifier
-	compiledRegex       []*regexp.Regexp
+	skipAuthRules       []skipAuthRule
+	maintenance         *maintenanceMode
+	maintenancePaths    []*regexp.Regexp
+	maintenanceAllowed  []string
+	maintenanceGroups   []string
+	apiRoutes           []*regexp.Regexp
+	cors                *corsPolicy
+	upstreamJWT         *upstreamJWTSigner
+	webAuthn            *webAuthnConfig
+	healthChecks        []*upstreamHealthCheck
+	providerCheckURL    string
+	providerCheckStrict bool
+	ready               int32
+	stepUpRoutes        []stepUpRoute
+	unauthRoutes        []unauthenticatedRoute
+	devFakeSession      *sessionsapi.SessionState
+	ssoURL              *url.URL
+	ssoDomains          []string
+	ssoSecret           string
+	authzPolicy         *authzPolicy
+	kubePolicies        *kubePolicies
+	authzDryRun         bool
+	opa                 *opaClient
+	trustedIPs          *trustedNetworks
+	rateLimits          *rateLimiter
+	requiredGroups      *groupExpr
+	tracer              *tracing.Tracer
+	traceHeaders        traceHeaderPolicy
+	auditLog            *auditLog
+	metrics             *proxyMetrics
+	errorReporter       *errorReporter
+	failureAlerts       *failureAlerter
+	leader              *leaderElection
+	usedStates          *usedStates
+	metricsHandler      http.Handler
 	templates           *template.Template
+	staticHandler       http.Handler
 	Footer              string
 }
 
 // UpstreamProxy represents an upstream server to proxy to
 type UpstreamProxy struct {
-	upstream  string
-	handler   http.Handler
-	wsHandler http.Handler
-	auth      hmacauth.HmacAuth
+	upstream    string
+	handler     http.Handler
+	wsHandler   http.Handler
+	auth        hmacauth.HmacAuth
+	maxBodySize int64
 }
 
-// ServeHTTP proxies requests to the upstream provider while signing the
-// request headers
+// ServeHTTP proxies requests to the upstream provider. With a signature key,
+// the directors of the upstream's proxies sign the request.
 func (u *UpstreamProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("GAP-Upstream-Address", u.upstream)
+	if u.maxBodySize > 0 {
+		if r.ContentLength > u.maxBodySize {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, u.maxBodySize)
+	}
+	ctx, span := tracing.Start(r.Context(), "upstream", tracing.KindClient)
+	defer span.End()
+	span.SetAttribute("upstream", u.upstream)
+	tracing.Inject(ctx, r.Header)
+	r = r.WithContext(ctx)
 	if u.auth != nil {
 		r.Header.Set("GAP-Auth", w.Header().Get("GAP-Auth"))
-		u.auth.SignRequest(r)
 	}
+	timingsFromContext(r.Context()).startUpstream()
 	if u.wsHandler != nil && strings.ToLower(r.Header.Get("Connection")) == "upgrade" && r.Header.Get("Upgrade") == "websocket" {
 		u.wsHandler.ServeHTTP(w, r)
 	} else {
@@ -154,6 +223,42 @@ func setProxyDirector(proxy *httputil.ReverseProxy) {
 	}
 }
 
+// signingDirector signs the request as the director sends it upstream, i.e.
+// with the rewritten path, so the upstream can verify the signature against
+// the request it receives
+func signingDirector(director func(*http.Request), auth hmacauth.HmacAuth) func(*http.Request) {
+	return func(req *http.Request) {
+		director(req)
+		// the directors may pass the path in URL.Opaque, which is not signed
+		signed := *req
+		if u, err := url.ParseRequestURI(req.URL.RequestURI()); err == nil {
+			signed.URL = u
+		}
+		auth.SignRequest(&signed)
+	}
+}
+
+// setProxyResponseHeaders overrides the given headers on every response
+// received from the upstream
+func setProxyResponseHeaders(proxy *httputil.ReverseProxy, headers http.Header) {
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		for name, values := range headers {
+			resp.Header[name] = values
+		}
+		return nil
+	}
+}
+
+// withResponseHeaders sets the given headers on every response served by h
+func withResponseHeaders(h http.Handler, headers http.Header) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		for name, values := range headers {
+			rw.Header()[name] = values
+		}
+		h.ServeHTTP(rw, req)
+	})
+}
+
 // NewFileServer creates a http.Handler to serve files from the filesystem
 func NewFileServer(path string, filesystemPath string) (proxy http.Handler) {
 	return http.StripPrefix(path, http.FileServer(http.Dir(filesystemPath)))
@@ -161,13 +266,51 @@ func NewFileServer(path string, filesystemPath string) (proxy http.Handler) {
 
 // NewWebSocketOrRestReverseProxy creates a reverse proxy for REST or websocket based on url
 func NewWebSocketOrRestReverseProxy(u *url.URL, opts *Options, auth hmacauth.HmacAuth) (restProxy http.Handler) {
+	path := u.Path
 	u.Path = ""
+	uo, err := parseUpstreamOptions(u)
+	if err != nil {
+		uo = &upstreamOptions{}
+	}
 	proxy := NewReverseProxy(u, opts.FlushInterval)
-	if !opts.PassHostHeader {
+	switch {
+	case uo.host == "preserve":
+		setProxyDirector(proxy)
+	case uo.host == "upstream":
 		setProxyUpstreamHostHeader(proxy, u)
-	} else {
+	case uo.host != "":
+		setProxyUpstreamHostHeader(proxy, &url.URL{Host: uo.host})
+	case !opts.PassHostHeader:
+		setProxyUpstreamHostHeader(proxy, u)
+	default:
 		setProxyDirector(proxy)
 	}
+	if uo.stripPrefix {
+		setProxyPathRewrite(proxy, path, "/")
+	} else if uo.rewritePrefix != "" {
+		setProxyPathRewrite(proxy, path, uo.rewritePrefix)
+	}
+	if auth != nil {
+		proxy.Director = signingDirector(proxy.Director, auth)
+	}
+	if len(opts.responseHeaders) > 0 {
+		setProxyResponseHeaders(proxy, opts.responseHeaders)
+	}
+	flushTypes := flushImmediatelyTypes(opts)
+	if opts.CompressResponses {
+		types := opts.CompressTypes
+		if len(types) == 0 {
+			types = defaultCompressTypes
+		}
+		// compressing would buffer the streamed responses
+		var compressTypes []string
+		for _, t := range types {
+			if !contains(flushTypes, t) {
+				compressTypes = append(compressTypes, t)
+			}
+		}
+		setProxyCompression(proxy, compressTypes, opts.CompressMinSize)
+	}
 
 	// this should give us a wss:// scheme if the url is https:// based.
 	var wsProxy *wsutil.ReverseProxy
@@ -175,24 +318,93 @@ func NewWebSocketOrRestReverseProxy(u *url.URL, opts *Options, auth hmacauth.Hma
 		wsScheme := "ws" + strings.TrimPrefix(u.Scheme, "http")
 		wsURL := &url.URL{Scheme: wsScheme, Host: u.Host}
 		wsProxy = wsutil.NewSingleHostReverseProxy(wsURL)
+		if auth != nil {
+			wsProxy.Director = signingDirector(wsProxy.Director, auth)
+		}
+	}
+	maxBodySize := opts.MaxRequestBodySize
+	if uo.maxBodySize > 0 {
+		maxBodySize = uo.maxBodySize
 	}
-	return &UpstreamProxy{u.Host, proxy, wsProxy, auth}
+	handler := withImmediateFlush(proxy, flushTypes, opts.FlushInterval < 0)
+	return &UpstreamProxy{u.Host, handler, wsProxy, auth, maxBodySize}
 }
 
 // NewOAuthProxy creates a new instance of OOuthProxy from the options provided
 func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
+	var p *OAuthProxy
 	serveMux := http.NewServeMux()
 	var auth hmacauth.HmacAuth
 	if sigData := opts.signatureData; sigData != nil {
-		auth = hmacauth.NewHmacAuth(sigData.hash, []byte(sigData.key),
-			SignatureHeader, SignatureHeaders)
+		// identity headers passed under other names are signed too
+		auth = signature.New(sigData.hash, sigData.key, opts.AccessTokenHeader, opts.PassGroupsHeader, opts.UpstreamJWTHeader)
+	}
+	var healthChecks []*upstreamHealthCheck
+	unavailable := func(rw http.ResponseWriter) {
+		p.ErrorPage(rw, http.StatusServiceUnavailable, "Service Unavailable", "The upstream server is not responding to health checks. Please try again later.")
+	}
+	var exchanger *tokenExchanger
+	exchangeFailed := func(rw http.ResponseWriter) {
+		p.ErrorPage(rw, http.StatusBadGateway, "Bad Gateway", "Could not obtain a token for the upstream server.")
+	}
+	basicAuthDenied := func(rw http.ResponseWriter) {
+		p.ErrorPage(rw, http.StatusForbidden, "Permission Denied", "You have no account for this application.")
+	}
+	healthChecked := func(proxy http.Handler, u *url.URL, path string) (http.Handler, *upstreamHealthCheck) {
+		if path == "" {
+			return proxy, nil
+		}
+		check := newUpstreamHealthCheck(u, path, opts.HealthCheckTimeout)
+		healthChecks = append(healthChecks, check)
+		return &healthCheckedProxy{check, proxy, unavailable}, check
 	}
 	for _, u := range opts.proxyURLs {
 		path := u.Path
 		switch u.Scheme {
 		case httpScheme, httpsScheme:
+			uo, err := parseUpstreamOptions(u)
+			if err != nil {
+				uo = &upstreamOptions{}
+			}
+			if uo.vhost != "" {
+				// ServeMux patterns starting with a host only match that host
+				path = uo.vhost + path
+			}
+			var canaryURL *url.URL
+			if uo.canary != nil {
+				c := *u
+				c.Scheme, c.Host = uo.canary.Scheme, uo.canary.Host
+				canaryURL = &c
+			}
 			logger.Printf("mapping path %q => upstream %q", path, u)
-			proxy := NewWebSocketOrRestReverseProxy(u, opts, auth)
+			proxy, check := healthChecked(NewWebSocketOrRestReverseProxy(u, opts, auth), u, uo.healthCheck)
+			if canaryURL != nil {
+				logger.Printf("mapping path %q => canary upstream %q", path, canaryURL)
+				canary, canaryCheck := healthChecked(NewWebSocketOrRestReverseProxy(canaryURL, opts, auth), canaryURL, uo.healthCheck)
+				proxy = &canaryProxy{
+					primary:       proxy,
+					canary:        canary,
+					weight:        uo.canaryWeight,
+					header:        uo.canaryHeader,
+					cookie:        uo.canaryCookie,
+					primaryHealth: check,
+					canaryHealth:  canaryCheck,
+				}
+			}
+			if uo.tokenExchangeAudience != "" {
+				if exchanger == nil {
+					tokenURL := opts.provider.Data().RedeemURL
+					if opts.tokenExchangeURL != nil && opts.tokenExchangeURL.String() != "" {
+						tokenURL = opts.tokenExchangeURL
+					}
+					exchanger = newTokenExchanger(tokenURL.String(), opts.ClientID, opts.ClientSecret)
+				}
+				logger.Printf("exchanging access tokens for audience %q at %q for upstream %q", uo.tokenExchangeAudience, exchanger.url, u)
+				proxy = &tokenExchangeProxy{exchanger, uo.tokenExchangeAudience, proxy, exchangeFailed}
+			}
+			if uo.basicAuthUsers != nil {
+				proxy = &basicAuthProxy{uo.basicAuthUsers, proxy, basicAuthDenied}
+			}
 			serveMux.Handle(path, proxy)
 
 		case "file":
@@ -201,13 +413,40 @@ func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 			}
 			logger.Printf("mapping path %q => file system %q", path, u.Path)
 			proxy := NewFileServer(path, u.Path)
-			serveMux.Handle(path, &UpstreamProxy{path, proxy, nil, nil})
+			if len(opts.responseHeaders) > 0 {
+				proxy = withResponseHeaders(proxy, opts.responseHeaders)
+			}
+			serveMux.Handle(path, &UpstreamProxy{path, proxy, nil, nil, opts.MaxRequestBodySize})
 		default:
 			panic(fmt.Sprintf("unknown upstream protocol %s", u.Scheme))
 		}
 	}
-	for _, u := range opts.CompiledRegex {
-		logger.Printf("compiled skip-auth-regex => %q", u)
+	var handler http.Handler = serveMux
+	if opts.UpstreamHandler != nil {
+		handler = opts.UpstreamHandler
+	}
+	if len(opts.regexUpstreams) > 0 {
+		router := &regexRouter{upstreams: opts.regexUpstreams, fallback: serveMux}
+		for _, ru := range opts.regexUpstreams {
+			logger.Printf("mapping path regex %q => upstream %q", ru.pattern, ru.target)
+			proxy := newRegexUpstreamProxy(ru, opts)
+			if auth != nil {
+				proxy.Director = signingDirector(proxy.Director, auth)
+			}
+			if len(opts.responseHeaders) > 0 {
+				setProxyResponseHeaders(proxy, opts.responseHeaders)
+			}
+			handler := withImmediateFlush(proxy, flushImmediatelyTypes(opts), opts.FlushInterval < 0)
+			router.handlers = append(router.handlers, &UpstreamProxy{ru.pattern.String(), handler, nil, auth, opts.MaxRequestBodySize})
+		}
+		handler = router
+	}
+	for _, r := range opts.skipAuthRules {
+		if len(r.methods) > 0 {
+			logger.Printf("compiled skip-auth-regex => %q for %s", r.pattern, strings.Join(r.methods, ", "))
+		} else {
+			logger.Printf("compiled skip-auth-regex => %q", r.pattern)
+		}
 	}
 
 	if opts.SkipJwtBearerTokens {
@@ -221,7 +460,19 @@ func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 		redirectURL.Path = fmt.Sprintf("%s/callback", opts.ProxyPrefix)
 	}
 
-	logger.Printf("OAuthProxy configured for %s Client ID: %s", opts.provider.Data().ProviderName, opts.ClientID)
+	if opts.ssoURL != nil {
+		// the sign in page offers the central proxy instead of the provider
+		opts.provider.Data().ProviderName = "Single Sign-On"
+		logger.Printf("OAuthProxy configured to sign users in at %s", opts.ssoURL)
+	} else {
+		logger.Printf("OAuthProxy configured for %s Client ID: %s", opts.provider.Data().ProviderName, opts.ClientID)
+	}
+	if len(opts.SSOAllowedDomains) > 0 {
+		logger.Printf("serving single sign-on to applications on %s", strings.Join(opts.SSOAllowedDomains, ", "))
+	}
+	if opts.devFakeSession != nil {
+		logger.Printf("WARNING: developer mode, every request is authenticated as %s without the provider", opts.DevFakeIdentity)
+	}
 	refresh := "disabled"
 	if opts.CookieRefresh != time.Duration(0) {
 		refresh = fmt.Sprintf("after %s", opts.CookieRefresh)
@@ -229,7 +480,27 @@ func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 
 	logger.Printf("Cookie settings: name:%s secure(https):%v httponly:%v expiry:%s domain:%s path:%s refresh:%s", opts.CookieName, opts.CookieSecure, opts.CookieHTTPOnly, opts.CookieExpire, opts.CookieDomain, opts.CookiePath, refresh)
 
-	return &OAuthProxy{
+	stripRequestHeaders := append([]string{}, opts.StripRequestHeaders...)
+	if opts.StripAuthorization {
+		stripRequestHeaders = append(stripRequestHeaders, "Authorization")
+	}
+	if opts.PassGroupsHeader != "" {
+		// groups sent by clients must never reach the upstream
+		stripRequestHeaders = append(stripRequestHeaders, opts.PassGroupsHeader)
+	}
+
+	staticPath := fmt.Sprintf("%s/static/", opts.ProxyPrefix)
+	var staticHandler http.Handler
+	if dir := staticAssetsDir(opts.CustomTemplatesDir); dir != "" {
+		logger.Printf("serving sign-in page assets %q => %q", staticPath, dir)
+		staticHandler = NewFileServer(staticPath, dir)
+	}
+
+	maintenance := &maintenanceMode{}
+	maintenance.Set(opts.MaintenanceMode)
+	providerURL, providerStrict := providerHealthURL(opts)
+
+	p = &OAuthProxy{
 		CookieName:     opts.CookieName,
 		CSRFCookieName: fmt.Sprintf("%v_%v", opts.CookieName, "csrf"),
 		CookieSeed:     opts.CookieSecret,
@@ -243,34 +514,92 @@ func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 
 		RobotsPath:        "/robots.txt",
 		PingPath:          "/ping",
+		ReadyPath:         "/ready",
+		HealthPath:        fmt.Sprintf("%s/health", opts.ProxyPrefix),
 		SignInPath:        fmt.Sprintf("%s/sign_in", opts.ProxyPrefix),
 		SignOutPath:       fmt.Sprintf("%s/sign_out", opts.ProxyPrefix),
+		SignOutAllPath:    fmt.Sprintf("%s/sign_out_all", opts.ProxyPrefix),
 		OAuthStartPath:    fmt.Sprintf("%s/start", opts.ProxyPrefix),
 		OAuthCallbackPath: fmt.Sprintf("%s/callback", opts.ProxyPrefix),
+		SilentAuthPath:    fmt.Sprintf("%s/silent_auth", opts.ProxyPrefix),
+		StepUpPath:        fmt.Sprintf("%s/step_up", opts.ProxyPrefix),
 		AuthOnlyPath:      fmt.Sprintf("%s/auth", opts.ProxyPrefix),
+		UserInfoPath:      fmt.Sprintf("%s/userinfo", opts.ProxyPrefix),
+		RefreshPath:       fmt.Sprintf("%s/refresh", opts.ProxyPrefix),
+		StaticPath:        staticPath,
+		UpstreamsPath:     fmt.Sprintf("%s/upstreams", opts.ProxyPrefix),
+		JWKSPath:          fmt.Sprintf("%s/.well-known/jwks.json", opts.ProxyPrefix),
+		WebAuthnPath:      fmt.Sprintf("%s/webauthn", opts.ProxyPrefix),
+		SSOPath:           fmt.Sprintf("%s/sso", opts.ProxyPrefix),
 
 		ProxyPrefix:         opts.ProxyPrefix,
 		provider:            opts.provider,
+		providerID:          opts.Provider,
 		sessionStore:        opts.sessionStore,
-		serveMux:            serveMux,
+		usedStates:          newUsedStates(opts.sessionStore),
+		serveMux:            handler,
 		redirectURL:         redirectURL,
 		whitelistDomains:    opts.WhitelistDomains,
+		signOutRedirects:    opts.SignOutRedirects,
+		redirectWhitelist:   opts.RedirectWhitelist,
+		forwardAuth:         opts.ForwardAuth,
+		forwardUserHeader:   opts.ForwardAuthUserHeader,
+		forwardEmailHeader:  opts.ForwardAuthEmailHeader,
+		groupsHeader:        newGroupsHeader(opts),
+		stripRequestHeaders: stripRequestHeaders,
+		setRequestHeaders:   opts.requestHeaders,
 		skipAuthRegex:       opts.SkipAuthRegex,
 		skipAuthPreflight:   opts.SkipAuthPreflight,
 		skipJwtBearerTokens: opts.SkipJwtBearerTokens,
 		jwtBearerVerifiers:  opts.jwtBearerVerifiers,
-		compiledRegex:       opts.CompiledRegex,
+		skipAuthRules:       opts.skipAuthRules,
+		maintenance:         maintenance,
+		maintenancePaths:    opts.maintenancePaths,
+		maintenanceAllowed:  opts.MaintenanceAllowedEmails,
+		maintenanceGroups:   opts.MaintenanceAllowedGroups,
+		apiRoutes:           opts.apiRoutes,
+		cors:                newCORSPolicy(opts),
+		upstreamJWT:         opts.upstreamJWT,
+		webAuthn:            opts.webAuthn,
+		healthChecks:        healthChecks,
+		providerCheckURL:    providerURL,
+		providerCheckStrict: providerStrict,
+		stepUpRoutes:        opts.stepUpRoutes,
+		unauthRoutes:        opts.unauthRoutes,
+		devFakeSession:      opts.devFakeSession,
+		ssoURL:              opts.ssoURL,
+		ssoDomains:          opts.SSOAllowedDomains,
+		ssoSecret:           opts.SSOSecret,
+		authzPolicy:         opts.authzPolicy,
+		kubePolicies:        opts.kubePolicies,
+		authzDryRun:         opts.AuthzPolicyDryRun,
+		opa:                 opts.opa,
+		trustedIPs:          opts.trustedIPs,
+		rateLimits:          opts.rateLimits,
+		requiredGroups:      opts.requiredGroups,
+		tracer:              opts.tracer,
+		traceHeaders:        opts.traceHeaders,
+		auditLog:            opts.auditLog,
+		errorReporter:       opts.errorReporter,
+		failureAlerts:       opts.failureAlerts,
+		loginBackoff:        newLoginBackoff(opts.HtpasswdFailureDelay),
 		SetXAuthRequest:     opts.SetXAuthRequest,
 		PassBasicAuth:       opts.PassBasicAuth,
 		PassUserHeaders:     opts.PassUserHeaders,
 		BasicAuthPassword:   opts.BasicAuthPassword,
 		PassAccessToken:     opts.PassAccessToken,
+		accessTokenHeader:   opts.AccessTokenHeader,
+		accessTokenBearer:   opts.AccessTokenFormat == "bearer",
 		SetAuthorization:    opts.SetAuthorization,
 		PassAuthorization:   opts.PassAuthorization,
+		PassIDToken:         opts.PassIDToken,
 		SkipProviderButton:  opts.SkipProviderButton,
+		preserveFragment:    opts.PreserveFragment,
 		templates:           loadTemplates(opts.CustomTemplatesDir),
+		staticHandler:       staticHandler,
 		Footer:              opts.Footer,
 	}
+	return p
 }
 
 // GetRedirectURI returns the redirectURL that the upstream OAuth Provider will
@@ -297,25 +626,38 @@ func (p *OAuthProxy) displayCustomLoginForm() bool {
 	return p.HtpasswdFile != nil && p.DisplayHtpasswdForm
 }
 
-func (p *OAuthProxy) redeemCode(host, code string) (s *sessionsapi.SessionState, err error) {
+func (p *OAuthProxy) redeemCode(ctx context.Context, host, code, idNonce string) (s *sessionsapi.SessionState, err error) {
 	if code == "" {
 		return nil, errors.New("missing code")
 	}
 	redirectURI := p.GetRedirectURI(host)
-	s, err = p.provider.Redeem(redirectURI, code)
+	_, span := tracing.Start(ctx, "provider.redeem", tracing.KindClient)
+	if nonceProvider, ok := p.provider.(providers.NonceProvider); ok {
+		s, err = nonceProvider.RedeemWithNonce(redirectURI, code, idNonce)
+	} else {
+		s, err = p.provider.Redeem(redirectURI, code)
+	}
+	span.SetError(err)
+	span.End()
 	if err != nil {
 		return
 	}
 
 	if s.Email == "" {
+		_, span := tracing.Start(ctx, "provider.email", tracing.KindClient)
 		s.Email, err = p.provider.GetEmailAddress(s)
+		span.SetError(err)
+		span.End()
 	}
 
 	if s.User == "" {
+		_, span := tracing.Start(ctx, "provider.user", tracing.KindClient)
 		s.User, err = p.provider.GetUserName(s)
 		if err != nil && err.Error() == "not implemented" {
 			err = nil
 		}
+		span.SetError(err)
+		span.End()
 	}
 	return
 }
@@ -361,17 +703,29 @@ func (p *OAuthProxy) SetCSRFCookie(rw http.ResponseWriter, req *http.Request, va
 // ClearSessionCookie creates a cookie to unset the user's authentication cookie
 // stored in the user's session
 func (p *OAuthProxy) ClearSessionCookie(rw http.ResponseWriter, req *http.Request) error {
-	return p.sessionStore.Clear(rw, req)
+	_, span := tracing.Start(req.Context(), "session.clear", tracing.KindInternal)
+	defer span.End()
+	err := p.sessionStore.Clear(rw, req)
+	span.SetError(err)
+	return err
 }
 
 // LoadCookiedSession reads the user's authentication details from the request
 func (p *OAuthProxy) LoadCookiedSession(req *http.Request) (*sessionsapi.SessionState, error) {
-	return p.sessionStore.Load(req)
+	_, span := tracing.Start(req.Context(), "session.load", tracing.KindInternal)
+	defer span.End()
+	s, err := p.sessionStore.Load(req)
+	span.SetError(err)
+	return s, err
 }
 
 // SaveSession creates a new session cookie value and sets this on the response
 func (p *OAuthProxy) SaveSession(rw http.ResponseWriter, req *http.Request, s *sessionsapi.SessionState) error {
-	return p.sessionStore.Save(rw, req, s)
+	_, span := tracing.Start(req.Context(), "session.save", tracing.KindInternal)
+	defer span.End()
+	err := p.sessionStore.Save(rw, req, s)
+	span.SetError(err)
+	return err
 }
 
 // RobotsTxt disallows scraping pages from the OAuthProxy
@@ -401,34 +755,37 @@ func (p *OAuthProxy) ErrorPage(rw http.ResponseWriter, code int, title string, m
 	p.templates.ExecuteTemplate(rw, "error.html", t)
 }
 
-// SignInPage writes the sing in template to the response
-func (p *OAuthProxy) SignInPage(rw http.ResponseWriter, req *http.Request, code int) {
-	p.ClearSessionCookie(rw, req)
-	rw.WriteHeader(code)
-
+// signInRedirect returns where to send the user after signing in from a
+// request which needs authentication
+func (p *OAuthProxy) signInRedirect(req *http.Request) string {
 	redirecURL := req.URL.RequestURI()
+	if forwarded := p.getForwardedRedirect(req); forwarded != "" {
+		redirecURL = forwarded
+	}
 	if req.Header.Get("X-Auth-Request-Redirect") != "" {
 		redirecURL = req.Header.Get("X-Auth-Request-Redirect")
 	}
 	if redirecURL == p.SignInPath {
 		redirecURL = "/"
 	}
+	return redirecURL
+}
 
-	t := struct {
-		ProviderName  string
-		SignInMessage string
-		CustomLogin   bool
-		Redirect      string
-		Version       string
-		ProxyPrefix   string
-		Footer        template.HTML
-	}{
+// SignInPage writes the sing in template to the response
+func (p *OAuthProxy) SignInPage(rw http.ResponseWriter, req *http.Request, code int) {
+	p.ClearSessionCookie(rw, req)
+	rw.WriteHeader(code)
+
+	t := signInPageData{
 		ProviderName:  p.provider.Data().ProviderName,
 		SignInMessage: p.SignInMessage,
 		CustomLogin:   p.displayCustomLoginForm(),
-		Redirect:      redirecURL,
+		TOTP:          p.TOTPFile != nil,
+		WebAuthn:      p.webAuthn != nil,
+		Redirect:      p.signInRedirect(req),
 		Version:       VERSION,
 		ProxyPrefix:   p.ProxyPrefix,
+		StaticPath:    p.StaticPath,
 		Footer:        template.HTML(p.Footer),
 	}
 	p.templates.ExecuteTemplate(rw, "sign_in.html", t)
@@ -444,12 +801,33 @@ func (p *OAuthProxy) ManualSignIn(rw http.ResponseWriter, req *http.Request) (st
 	if user == "" {
 		return "", false
 	}
+	if p.denyList.Denied(user, "") {
+		logger.PrintAuthf(user, req, logger.AuthFailure, "Invalid authentication via HtpasswdFile: denied")
+		p.auditLogin(req, nil, user, "htpasswd", "denied")
+		return "", false
+	}
+	addr := p.trustedIPs.Source(req)
+	if wait := p.loginBackoff.Wait(user, addr); wait > 0 {
+		logger.PrintAuthf(user, req, logger.AuthFailure, "Invalid authentication via HtpasswdFile: too many failed attempts, retry in %s", wait.Round(time.Second))
+		p.auditLogin(req, nil, user, "htpasswd", "too many failed attempts")
+		return "", false
+	}
 	// check auth
 	if p.HtpasswdFile.Validate(user, passwd) {
+		if p.TOTPFile != nil && !p.TOTPFile.Validate(user, req.FormValue("totp"), time.Now()) {
+			p.loginBackoff.Failed(user, addr)
+			logger.PrintAuthf(user, req, logger.AuthFailure, "Invalid authentication via HtpasswdFile: invalid TOTP code")
+			p.auditLogin(req, nil, user, "htpasswd", "invalid TOTP code")
+			return "", false
+		}
+		p.loginBackoff.Succeeded(user, addr)
 		logger.PrintAuthf(user, req, logger.AuthSuccess, "Authenticated via HtpasswdFile")
+		p.auditLogin(req, nil, user, "htpasswd", "")
 		return user, true
 	}
+	p.loginBackoff.Failed(user, addr)
 	logger.PrintAuthf(user, req, logger.AuthFailure, "Invalid authentication via HtpasswdFile")
+	p.auditLogin(req, nil, user, "htpasswd", "invalid password")
 	return "", false
 }
 
@@ -462,7 +840,10 @@ func (p *OAuthProxy) GetRedirect(req *http.Request) (redirect string, err error)
 	}
 
 	redirect = req.Form.Get("rd")
-	if !p.IsValidRedirect(redirect) {
+	if redirect == "" {
+		redirect = p.getForwardedRedirect(req)
+	}
+	if !p.validRedirect(req, redirect) {
 		redirect = req.URL.Path
 		if strings.HasPrefix(redirect, p.ProxyPrefix) {
 			redirect = "/"
@@ -472,37 +853,155 @@ func (p *OAuthProxy) GetRedirect(req *http.Request) (redirect string, err error)
 	return
 }
 
-// IsValidRedirect checks whether the redirect URL is whitelisted
+// getForwardedRedirect rebuilds the URL originally requested by the client
+// from the X-Forwarded-* headers set by a forwardAuth capable reverse proxy.
+// An empty string is returned unless forward-auth mode is enabled.
+func (p *OAuthProxy) getForwardedRedirect(req *http.Request) string {
+	if !p.forwardAuth {
+		return ""
+	}
+	uri := req.Header.Get("X-Forwarded-Uri")
+	if uri == "" {
+		return ""
+	}
+	host := req.Header.Get("X-Forwarded-Host")
+	if host == "" {
+		return uri
+	}
+	scheme := req.Header.Get("X-Forwarded-Proto")
+	if scheme == "" {
+		scheme = httpScheme
+		if p.CookieSecure {
+			scheme = httpsScheme
+		}
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, host, uri)
+}
+
+// getRequestHost returns the host the client originally addressed, which in
+// forward-auth mode is passed in the X-Forwarded-Host header
+func (p *OAuthProxy) getRequestHost(req *http.Request) string {
+	if p.forwardAuth && req.Header.Get("X-Forwarded-Host") != "" {
+		return req.Header.Get("X-Forwarded-Host")
+	}
+	return req.Host
+}
+
+// IsValidRedirect checks whether the redirect URL is whitelisted. Relative
+// redirects and redirects to the whitelisted domains are valid unless the
+// redirect whitelist is set, which they must then match too. Redirects to the
+// proxy's single sign-on and silent auth endpoints, which check their own
+// parameters, stay valid.
 func (p *OAuthProxy) IsValidRedirect(redirect string) bool {
+	if strings.ContainsAny(redirect, "\\\t\r\n") {
+		// browsers read /\ as // and drop tabs and newlines
+		return false
+	}
+	redirectURL, err := url.Parse(redirect)
+	if err != nil {
+		return false
+	}
 	switch {
 	case strings.HasPrefix(redirect, "/") && !strings.HasPrefix(redirect, "//"):
-		return true
 	case strings.HasPrefix(redirect, "http://") || strings.HasPrefix(redirect, "https://"):
-		redirectURL, err := url.Parse(redirect)
-		if err != nil {
-			return false
-		}
+		whitelisted := false
 		for _, domain := range p.whitelistDomains {
 			if (redirectURL.Host == domain) || (strings.HasPrefix(domain, ".") && strings.HasSuffix(redirectURL.Host, domain)) {
-				return true
+				whitelisted = true
+				break
 			}
 		}
+		if !whitelisted {
+			return false
+		}
+	default:
+		return false
+	}
+	if len(p.redirectWhitelist) == 0 {
+		return true
+	}
+	if redirectURL.Host == "" {
+		switch cleanRedirectPath(redirectURL) {
+		case p.SSOPath, p.SilentAuthPath:
+			return true
+		}
+	}
+	return matchRedirect(p.redirectWhitelist, redirectURL)
+}
+
+// validRedirect checks the redirect of req like IsValidRedirect and logs it
+// when rejected
+func (p *OAuthProxy) validRedirect(req *http.Request, redirect string) bool {
+	if p.IsValidRedirect(redirect) {
+		return true
+	}
+	if redirect != "" {
+		logger.Printf("%s rejected redirect %q", getRemoteAddr(req), redirect)
+	}
+	return false
+}
+
+// IsValidSignOutRedirect checks whether the redirect matches one of the sign
+// out redirect whitelist entries: a /path prefix for relative redirects, or
+// a domain optionally followed by a path prefix
+func (p *OAuthProxy) IsValidSignOutRedirect(redirect string) bool {
+	if strings.Contains(redirect, "\\") {
+		return false
+	}
+	redirectURL, err := url.Parse(redirect)
+	if err != nil {
 		return false
+	}
+	switch {
+	case strings.HasPrefix(redirect, "/") && !strings.HasPrefix(redirect, "//"):
+	case (redirectURL.Scheme == httpScheme || redirectURL.Scheme == httpsScheme) && redirectURL.Host != "":
 	default:
 		return false
 	}
+	return matchRedirect(p.signOutRedirects, redirectURL)
+}
+
+// cleanRedirectPath returns the path of the redirect URL with the dot
+// segments resolved, as browsers do before following it
+func cleanRedirectPath(redirectURL *url.URL) string {
+	if redirectURL.Path == "" {
+		return "/"
+	}
+	return path.Clean("/" + redirectURL.Path)
+}
+
+// matchRedirect checks whether the redirect URL matches one of the allowed
+// entries: a /path prefix for relative redirects, or a domain optionally
+// followed by a path prefix. Prefix domain with a . to allow subdomains. The
+// path prefix matches whole path segments of the cleaned redirect path.
+func matchRedirect(whitelist []string, redirectURL *url.URL) bool {
+	redirectPath := cleanRedirectPath(redirectURL)
+	for _, allowed := range whitelist {
+		domain, prefix := allowed, "/"
+		if i := strings.Index(allowed, "/"); i != -1 {
+			domain, prefix = allowed[:i], path.Clean(allowed[i:])
+		}
+		if domain == "" && redirectURL.Host != "" {
+			continue
+		}
+		if domain != "" && redirectURL.Host != domain && !(strings.HasPrefix(domain, ".") && strings.HasSuffix(redirectURL.Host, domain)) {
+			continue
+		}
+		if prefix == "/" || redirectPath == prefix || strings.HasPrefix(redirectPath, prefix+"/") {
+			return true
+		}
+	}
+	return false
 }
 
 // IsWhitelistedRequest is used to check if auth should be skipped for this request
 func (p *OAuthProxy) IsWhitelistedRequest(req *http.Request) bool {
 	isPreflightRequestAllowed := p.skipAuthPreflight && req.Method == "OPTIONS"
-	return isPreflightRequestAllowed || p.IsWhitelistedPath(req.URL.Path)
-}
-
-// IsWhitelistedPath is used to check if the request path is allowed without auth
-func (p *OAuthProxy) IsWhitelistedPath(path string) bool {
-	for _, u := range p.compiledRegex {
-		if u.MatchString(path) {
+	if isPreflightRequestAllowed {
+		return true
+	}
+	for _, r := range p.skipAuthRules {
+		if r.Matches(req.Method, req.URL.Path) {
 			return true
 		}
 	}
@@ -511,30 +1010,68 @@ func (p *OAuthProxy) IsWhitelistedPath(path string) bool {
 
 func getRemoteAddr(req *http.Request) (s string) {
 	s = req.RemoteAddr
-	if req.Header.Get("X-Real-IP") != "" {
-		s += fmt.Sprintf(" (%q)", req.Header.Get("X-Real-IP"))
+	host, _, err := net.SplitHostPort(s)
+	if err != nil {
+		host = s
+	}
+	if client := logger.GetClient(req); client != host {
+		s += fmt.Sprintf(" (%q)", client)
 	}
 	return
 }
 
 func (p *OAuthProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if p.handleCORS(rw, req) {
+		return
+	}
 	switch path := req.URL.Path; {
 	case path == p.RobotsPath:
 		p.RobotsTxt(rw)
 	case path == p.PingPath:
 		p.PingPage(rw)
-	case p.IsWhitelistedRequest(req):
+	case path == p.ReadyPath:
+		p.ReadyPage(rw)
+	case path == p.HealthPath:
+		p.HealthPage(rw)
+	case path == p.UpstreamsPath:
+		p.UpstreamHealth(rw)
+	case p.metricsHandler != nil && path == metricsPath:
+		p.metricsHandler.ServeHTTP(rw, req)
+	case path == p.JWKSPath:
+		p.JWKS(rw)
+	case p.staticHandler != nil && strings.HasPrefix(path, p.StaticPath):
+		p.staticHandler.ServeHTTP(rw, req)
+	case p.IsWhitelistedRequest(req) || (!strings.HasPrefix(path, p.ProxyPrefix) && p.trustedSource(req)):
+		if p.underMaintenance(path, p.maintenanceSession(req)) {
+			p.MaintenancePage(rw)
+			return
+		}
+		p.rewriteRequestHeaders(req)
 		p.serveMux.ServeHTTP(rw, req)
 	case path == p.SignInPath:
 		p.SignIn(rw, req)
 	case path == p.SignOutPath:
 		p.SignOut(rw, req)
+	case path == p.SignOutAllPath:
+		p.SignOutAll(rw, req)
 	case path == p.OAuthStartPath:
 		p.OAuthStart(rw, req)
 	case path == p.OAuthCallbackPath:
 		p.OAuthCallback(rw, req)
+	case path == p.SilentAuthPath:
+		p.SilentAuthPage(rw, req)
+	case path == p.StepUpPath:
+		p.StepUp(rw, req)
 	case path == p.AuthOnlyPath:
 		p.AuthenticateOnly(rw, req)
+	case path == p.UserInfoPath:
+		p.UserInfo(rw, req)
+	case path == p.RefreshPath:
+		p.RefreshSession(rw, req)
+	case strings.HasPrefix(path, p.WebAuthnPath+"/"):
+		p.WebAuthn(rw, req)
+	case path == p.SSOPath:
+		p.SSO(rw, req)
 	default:
 		p.Proxy(rw, req)
 	}
@@ -555,37 +1092,139 @@ func (p *OAuthProxy) SignIn(rw http.ResponseWriter, req *http.Request) {
 		p.SaveSession(rw, req, session)
 		http.Redirect(rw, req, redirect, 302)
 	} else {
-		if p.SkipProviderButton {
+		if req.Form.Get("provider") != "" {
 			p.OAuthStart(rw, req)
+		} else if p.SkipProviderButton {
+			p.skipSignInPage(rw, req, redirect)
 		} else {
 			p.SignInPage(rw, req, http.StatusOK)
 		}
 	}
 }
 
-// SignOut sends a response to clear the authentication cookie
+// SignOut sends a response to clear the authentication cookie and redirects
+// to the rd parameter if it is allowed by the sign out redirect whitelist
 func (p *OAuthProxy) SignOut(rw http.ResponseWriter, req *http.Request) {
+	if p.auditLog != nil {
+		if session, _ := p.LoadCookiedSession(req); session != nil {
+			p.auditLog.Record(req, session, auditEvent{Type: auditLogout, Success: true})
+		}
+	}
 	p.ClearSessionCookie(rw, req)
-	http.Redirect(rw, req, "/", 302)
+	redirect := req.FormValue("rd")
+	if !p.IsValidSignOutRedirect(redirect) {
+		redirect = "/"
+	}
+	http.Redirect(rw, req, redirect, 302)
 }
 
-// OAuthStart starts the OAuth2 authentication flow
+// SignOutAll revokes every session of the signed in user in the session
+// store, signing them out on all their devices, and redirects like SignOut.
+// Sessions kept entirely in cookies cannot be revoked.
+func (p *OAuthProxy) SignOutAll(rw http.ResponseWriter, req *http.Request) {
+	session, err := p.getAuthenticatedSession(rw, req)
+	if err != nil {
+		if p.isAPIRequest(req) {
+			p.UnauthorizedJSON(rw, p.loginURL(req))
+		} else {
+			p.SignInPage(rw, req, http.StatusForbidden)
+		}
+		return
+	}
+	revoker, ok := p.sessionStore.(sessionsapi.Revoker)
+	if !ok {
+		p.ErrorPage(rw, http.StatusNotImplemented, "Not Implemented", "Signing out of all sessions requires the redis session store")
+		return
+	}
+	if err := revoker.RevokeAll(session); err != nil {
+		logger.Printf("Error revoking sessions of %s: %s", session.Email, err)
+		p.ErrorPage(rw, http.StatusInternalServerError, "Internal Error", err.Error())
+		return
+	}
+	logger.PrintAuthf(session.Email, req, logger.AuthSuccess, "Signed out of all sessions")
+	p.auditLog.Record(req, session, auditEvent{Type: auditSessionRevoked, Success: true, Reason: "signed out of all sessions"})
+	p.SignOut(rw, req)
+}
+
+// OAuthStart starts the OAuth2 authentication flow. With prompt=none the
+// provider is asked to authenticate the user silently and the flow ends on
+// the silent auth page. Started from the step-up endpoint, the provider is
+// asked for a fresh authentication with the requested acr. A provider
+// parameter must name the configured provider.
 func (p *OAuthProxy) OAuthStart(rw http.ResponseWriter, req *http.Request) {
-	nonce, err := cookie.Nonce()
+	if provider := req.FormValue("provider"); provider != "" && !strings.EqualFold(provider, p.providerID) {
+		p.ErrorPage(rw, http.StatusBadRequest, "Bad Request", fmt.Sprintf("unknown provider %q", provider))
+		return
+	}
+	csrf, err := cookie.Nonce()
 	if err != nil {
 		logger.Printf("Error obtaining nonce: %s", err.Error())
 		p.ErrorPage(rw, 500, "Internal Error", err.Error())
 		return
 	}
-	p.SetCSRFCookie(rw, req, nonce)
+	p.SetCSRFCookie(rw, req, csrf)
 	redirect, err := p.GetRedirect(req)
 	if err != nil {
 		logger.Printf("Error obtaining redirect: %s", err.Error())
 		p.ErrorPage(rw, 500, "Internal Error", err.Error())
 		return
 	}
-	redirectURI := p.GetRedirectURI(req.Host)
-	http.Redirect(rw, req, p.provider.GetLoginURL(redirectURI, fmt.Sprintf("%v:%v", nonce, redirect)), 302)
+	params := url.Values{}
+	if req.Form.Get("prompt") == "none" {
+		redirect = p.SilentAuthPath
+		params.Set("prompt", "none")
+	}
+	if req.URL.Path == p.StepUpPath {
+		params.Set("acr_values", req.Form.Get("acr"))
+		params.Set("max_age", "0")
+	}
+	nonceProvider, _ := p.provider.(providers.NonceProvider)
+	var idNonce string
+	if nonceProvider != nil {
+		idNonce, err = cookie.Nonce()
+		if err != nil {
+			logger.Printf("Error obtaining nonce: %s", err.Error())
+			p.ErrorPage(rw, 500, "Internal Error", err.Error())
+			return
+		}
+	}
+	state, err := p.encodeState(csrf, idNonce, redirect, time.Now())
+	if err != nil {
+		logger.Printf("Error encoding OAuth2 state: %s", err.Error())
+		p.ErrorPage(rw, 500, "Internal Error", err.Error())
+		return
+	}
+	redirectURI := p.GetRedirectURI(p.getRequestHost(req))
+	loginURL := p.provider.GetLoginURL(redirectURI, state)
+	if nonceProvider != nil {
+		loginURL = nonceProvider.GetLoginURLWithNonce(redirectURI, state, idNonce)
+	}
+	if p.ssoURL != nil {
+		loginURL = p.ssoLoginURL(redirectURI, state)
+	}
+	if len(params) > 0 {
+		loginURL = setLoginURLParams(loginURL, params)
+	}
+	http.Redirect(rw, req, loginURL, 302)
+}
+
+// setLoginURLParams adds OpenID Connect authentication request parameters to
+// the provider login URL. An OpenID Connect prompt replaces the non standard
+// approval_prompt.
+func setLoginURLParams(loginURL string, params url.Values) string {
+	u, err := url.Parse(loginURL)
+	if err != nil {
+		return loginURL
+	}
+	query := u.Query()
+	if params.Get("prompt") != "" {
+		query.Del("approval_prompt")
+	}
+	for name, values := range params {
+		query[name] = values
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
 }
 
 // OAuthCallback is the OAuth2 authentication flow callback that finishes the
@@ -601,47 +1240,93 @@ func (p *OAuthProxy) OAuthCallback(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 	errorString := req.Form.Get("error")
+	if errorString != "" && p.isSilentAuthState(req.Form.Get("state")) {
+		// the provider could not sign the user in without interaction
+		p.ClearCSRFCookie(rw, req)
+		http.Redirect(rw, req, p.SilentAuthPath+"?error="+url.QueryEscape(errorString), 302)
+		return
+	}
 	if errorString != "" {
 		logger.Printf("Error while parsing OAuth2 callback: %s ", errorString)
+		p.auditLogin(req, nil, "", "oauth2", "provider error: "+errorString)
+		p.failureAlerts.Record(failureProvider, "login: "+errorString)
 		p.ErrorPage(rw, 403, "Permission Denied", errorString)
 		return
 	}
 
-	session, err := p.redeemCode(req.Host, req.Form.Get("code"))
+	c, err := req.Cookie(p.CSRFCookieName)
 	if err != nil {
-		logger.Printf("Error redeeming code during OAuth2 callback: %s ", err.Error())
+		logger.PrintAuthf("", req, logger.AuthFailure, "Invalid authentication via OAuth2: unable too obtain CSRF cookie")
+		p.auditLogin(req, nil, "", "oauth2", "missing CSRF cookie")
+		p.ErrorPage(rw, 403, "Permission Denied", "The sign in was not started from this browser, or it took too long. Please sign in again.")
+		return
+	}
+	p.ClearCSRFCookie(rw, req)
+	state, err := p.checkState(req.Form.Get("state"), c.Value, time.Now())
+	switch err {
+	case nil:
+	case errStateExpired:
+		logger.PrintAuthf("", req, logger.AuthFailure, "Invalid authentication via OAuth2: state expired")
+		p.auditLogin(req, nil, "", "oauth2", "state expired")
+		p.ErrorPage(rw, 403, "Sign In Expired", "The sign in took too long. Please sign in again.")
+		return
+	case errStateReplayed:
+		logger.PrintAuthf("", req, logger.AuthFailure, "Invalid authentication via OAuth2: state replayed, potential attack")
+		p.auditLogin(req, nil, "", "oauth2", "state replayed")
+		p.ErrorPage(rw, 403, "Permission Denied", "This sign in was already completed. Please sign in again.")
+		return
+	case errStateCSRF:
+		logger.PrintAuthf("", req, logger.AuthFailure, "Invalid authentication via OAuth2: csrf token mismatch, potential attack")
+		p.auditLogin(req, nil, "", "oauth2", "CSRF token mismatch")
+		p.ErrorPage(rw, 403, "Permission Denied", "csrf failed")
+		return
+	case errStateInvalid:
+		logger.PrintAuthf("", req, logger.AuthFailure, "Invalid authentication via OAuth2: invalid state")
+		p.auditLogin(req, nil, "", "oauth2", "invalid state")
+		p.ErrorPage(rw, 403, "Permission Denied", "Invalid State")
+		return
+	default:
+		logger.Printf("Error while checking OAuth2 state: %s", err.Error())
 		p.ErrorPage(rw, 500, "Internal Error", "Internal Error")
 		return
 	}
+	redirect := state.Redirect
 
-	s := strings.SplitN(req.Form.Get("state"), ":", 2)
-	if len(s) != 2 {
-		logger.Printf("Error while parsing OAuth2 state: invalid length")
-		p.ErrorPage(rw, 500, "Internal Error", "Invalid State")
-		return
+	var session *sessionsapi.SessionState
+	if p.ssoURL != nil {
+		// signed in by the central proxy
+		session, err = p.decodeAssertion(req.Form.Get("assertion"), p.GetRedirectURI(req.Host), req.Form.Get("state"), time.Now())
+	} else {
+		session, err = p.redeemCode(req.Context(), req.Host, req.Form.Get("code"), state.IDNonce)
 	}
-	nonce := s[0]
-	redirect := s[1]
-	c, err := req.Cookie(p.CSRFCookieName)
 	if err != nil {
-		logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Invalid authentication via OAuth2: unable too obtain CSRF cookie")
-		p.ErrorPage(rw, 403, "Permission Denied", err.Error())
-		return
-	}
-	p.ClearCSRFCookie(rw, req)
-	if c.Value != nonce {
-		logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Invalid authentication via OAuth2: csrf token mismatch, potential attack")
-		p.ErrorPage(rw, 403, "Permission Denied", "csrf failed")
+		logger.Printf("Error redeeming code during OAuth2 callback: %s ", err.Error())
+		p.auditLogin(req, nil, "", "oauth2", "error redeeming code: "+err.Error())
+		p.errorReporter.Report(req, nil, "provider.redeem", err)
+		p.failureAlerts.Record(failureProvider, "error redeeming code: "+err.Error())
+		p.ErrorPage(rw, 500, "Internal Error", "Internal Error")
 		return
 	}
 
-	if !p.IsValidRedirect(redirect) {
+	if !p.validRedirect(req, redirect) {
 		redirect = "/"
 	}
 
+	if !p.checkStepUp(rw, req, session.ACR) {
+		logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Invalid authentication via OAuth2: required acr not reached")
+		p.auditLogin(req, session, "", "oauth2", "required acr not reached")
+		p.ErrorPage(rw, 403, "Permission Denied", "The required authentication level was not reached")
+		return
+	}
+
 	// set cookie, or deny
-	if p.Validator(session.Email) && p.provider.ValidateGroup(session.Email) {
+	if p.denyList.Denied(session.User, session.Email) {
+		logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Invalid authentication via OAuth2: denied")
+		p.auditLogin(req, session, "", "oauth2", "denied")
+		p.ErrorPage(rw, 403, "Permission Denied", "Invalid Account")
+	} else if p.Validator(session.Email) && p.provider.ValidateGroup(session.Email) && p.requiredGroups.Matches(session.Groups) {
 		logger.PrintAuthf(session.Email, req, logger.AuthSuccess, "Authenticated via OAuth2: %s", session)
+		p.auditLogin(req, session, "", "oauth2", "")
 		err := p.SaveSession(rw, req, session)
 		if err != nil {
 			logger.Printf("%s %s", remoteAddr, err)
@@ -651,23 +1336,162 @@ func (p *OAuthProxy) OAuthCallback(rw http.ResponseWriter, req *http.Request) {
 		http.Redirect(rw, req, redirect, 302)
 	} else {
 		logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Invalid authentication via OAuth2: unauthorized")
+		p.auditLogin(req, session, "", "oauth2", "unauthorized")
 		p.ErrorPage(rw, 403, "Permission Denied", "Invalid Account")
 	}
 }
 
 // AuthenticateOnly checks whether the user is currently logged in
 func (p *OAuthProxy) AuthenticateOnly(rw http.ResponseWriter, req *http.Request) {
+	if p.trustedSource(req) {
+		rw.WriteHeader(http.StatusAccepted)
+		return
+	}
 	session, err := p.getAuthenticatedSession(rw, req)
 	if err != nil {
+		if p.forwardAuth && err == ErrNeedsLogin {
+			// the response is relayed to the client, so send them to sign in
+			p.NeedsLogin(rw, req)
+			return
+		}
 		http.Error(rw, "unauthorized request", http.StatusUnauthorized)
 		return
 	}
 
 	// we are authenticated
+	method, path := authRequestTarget(req)
+	if denial := p.checkRequest(req, method, path, session); denial != nil {
+		switch {
+		case denial.acr != "" && p.forwardAuth:
+			// the response is relayed to the client, so send them to step up
+			p.stepUpRedirect(rw, req, denial.acr)
+		case denial.retryAfter > 0:
+			rw.Header().Set("Retry-After", retryAfter(denial.retryAfter))
+			http.Error(rw, denial.message, denial.status)
+		default:
+			http.Error(rw, denial.message, denial.status)
+		}
+		return
+	}
 	p.addHeadersForProxying(rw, req, session)
+	if p.forwardAuth {
+		p.addForwardAuthHeaders(rw, session)
+	}
 	rw.WriteHeader(http.StatusAccepted)
 }
 
+// UserInfo writes the identity of the authenticated session as JSON
+func (p *OAuthProxy) UserInfo(rw http.ResponseWriter, req *http.Request) {
+	session, err := p.getAuthenticatedSession(rw, req)
+	if err != nil {
+		p.ErrorJSON(rw, http.StatusUnauthorized)
+		return
+	}
+
+	userInfo := struct {
+		User      string     `json:"user"`
+		Email     string     `json:"email"`
+		ACR       string     `json:"acr,omitempty"`
+		Groups    []string   `json:"groups,omitempty"`
+		ExpiresOn *time.Time `json:"expires_on,omitempty"`
+	}{
+		User:   session.User,
+		Email:  session.Email,
+		ACR:    session.ACR,
+		Groups: session.Groups,
+	}
+	if !session.ExpiresOn.IsZero() {
+		userInfo.ExpiresOn = &session.ExpiresOn
+	}
+	rw.Header().Set("Content-Type", applicationJSON)
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(userInfo)
+}
+
+// RefreshSession keeps the session of a single page application alive: it
+// loads the session, refreshing it with the provider if needed, and returns
+// when the access token and the session cookie expire as JSON
+func (p *OAuthProxy) RefreshSession(rw http.ResponseWriter, req *http.Request) {
+	session, err := p.getAuthenticatedSession(rw, req)
+	if err != nil {
+		p.ErrorJSON(rw, http.StatusUnauthorized)
+		return
+	}
+
+	expiry := struct {
+		ExpiresOn        *time.Time `json:"expires_on,omitempty"`
+		SessionExpiresOn *time.Time `json:"session_expires_on,omitempty"`
+	}{}
+	if !session.ExpiresOn.IsZero() {
+		expiry.ExpiresOn = &session.ExpiresOn
+	}
+	if !session.CreatedAt.IsZero() {
+		sessionExpiresOn := session.CreatedAt.Add(p.CookieExpire)
+		expiry.SessionExpiresOn = &sessionExpiresOn
+	}
+	rw.Header().Set("Content-Type", applicationJSON)
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(expiry)
+}
+
+// addForwardAuthHeaders returns the identity of the session on the response so
+// the forwardAuth reverse proxy can copy it on to the upstream request
+func (p *OAuthProxy) addForwardAuthHeaders(rw http.ResponseWriter, session *sessionsapi.SessionState) {
+	if p.forwardUserHeader != "" {
+		rw.Header().Set(p.forwardUserHeader, session.User)
+	}
+	if p.forwardEmailHeader != "" && session.Email != "" {
+		rw.Header().Set(p.forwardEmailHeader, session.Email)
+	}
+	if p.groupsHeader != nil && len(session.Groups) > 0 {
+		rw.Header().Set(p.groupsHeader.name, p.groupsHeader.Value(session.Groups))
+	}
+}
+
+// requestDenial is why checkRequest refuses an authenticated request
+type requestDenial struct {
+	// status and message answer the auth endpoint and ext_authz checks
+	status  int
+	message string
+	// hours are the access hours the request was made outside of
+	hours *accessHours
+	// acr is the authentication context class the session has to step up to
+	acr string
+	// retryAfter is how long a rate limited user has to wait
+	retryAfter time.Duration
+}
+
+// checkRequest applies the checks every authenticated request goes through,
+// whether it is proxied or checked by the auth endpoint or the ext_authz
+// API: maintenance mode, access hours, the authorization policies, step-up
+// authentication and rate limits. It returns nil if the request is allowed.
+// Requests whose path is unknown are denied when policies apply.
+func (p *OAuthProxy) checkRequest(req *http.Request, method, path string, session *sessionsapi.SessionState) *requestDenial {
+	path = cleanRequestPath(path)
+	if path == "" && (len(p.policies()) > 0 || p.kubePolicies != nil || p.opa != nil) {
+		logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Permission denied for %s without a request path", method)
+		return &requestDenial{status: http.StatusForbidden, message: "forbidden"}
+	}
+	if p.underMaintenance(path, session) {
+		return &requestDenial{status: http.StatusServiceUnavailable, message: "down for maintenance"}
+	}
+	if hours := p.outsideAccessHours(req, method, path, session); hours != nil {
+		return &requestDenial{status: http.StatusForbidden, message: "forbidden", hours: hours}
+	}
+	if !p.authorized(req, method, path, session) {
+		return &requestDenial{status: http.StatusForbidden, message: "forbidden"}
+	}
+	if acr := p.requiredACR(path); acr != "" && session.ACR != acr {
+		return &requestDenial{status: http.StatusForbidden, message: "step-up authentication required", acr: acr}
+	}
+	if wait := p.rateLimitWait(req, method, path, session); wait > 0 {
+		return &requestDenial{status: http.StatusTooManyRequests, message: "too many requests", retryAfter: wait}
+	}
+	return nil
+}
+
 // Proxy proxies the user request if the user is authenticated else it prompts
 // them to authenticate
 func (p *OAuthProxy) Proxy(rw http.ResponseWriter, req *http.Request) {
@@ -675,22 +1499,29 @@ func (p *OAuthProxy) Proxy(rw http.ResponseWriter, req *http.Request) {
 	switch err {
 	case nil:
 		// we are authenticated
+		if denial := p.checkRequest(req, req.Method, req.URL.Path, session); denial != nil {
+			switch {
+			case denial.status == http.StatusServiceUnavailable:
+				p.MaintenancePage(rw)
+			case denial.hours != nil:
+				p.OutsideAccessHoursPage(rw, denial.hours)
+			case denial.acr != "":
+				p.stepUpRedirect(rw, req, denial.acr)
+			case denial.retryAfter > 0:
+				rw.Header().Set("Retry-After", retryAfter(denial.retryAfter))
+				p.ErrorPage(rw, http.StatusTooManyRequests, "Too Many Requests", "You have made too many requests. Please try again later.")
+			default:
+				p.ErrorPage(rw, http.StatusForbidden, "Permission Denied", "You are not authorized to access this page")
+			}
+			return
+		}
+		p.rewriteRequestHeaders(req)
 		p.addHeadersForProxying(rw, req, session)
-		p.serveMux.ServeHTTP(rw, req)
+		p.serveMux.ServeHTTP(rw, withSession(req, session))
 
 	case ErrNeedsLogin:
 		// we need to send the user to a login screen
-		if isAjax(req) {
-			// no point redirecting an AJAX request
-			p.ErrorJSON(rw, http.StatusUnauthorized)
-			return
-		}
-
-		if p.SkipProviderButton {
-			p.OAuthStart(rw, req)
-		} else {
-			p.SignInPage(rw, req, http.StatusForbidden)
-		}
+		p.NeedsLogin(rw, req)
 
 	default:
 		// unknown error
@@ -709,6 +1540,15 @@ func (p *OAuthProxy) getAuthenticatedSession(rw http.ResponseWriter, req *http.R
 	var err error
 	var saveSession, clearSession, revalidated bool
 
+	if p.devFakeSession != nil {
+		return p.devSession(), nil
+	}
+
+	defer timingsFromContext(req.Context()).addAuth(time.Now())
+	ctx, span := tracing.Start(req.Context(), "authenticate", tracing.KindInternal)
+	defer span.End()
+	req = req.WithContext(ctx)
+
 	if p.skipJwtBearerTokens && req.Header.Get("Authorization") != "" {
 		session, err = p.GetJwtSession(req)
 		if err != nil {
@@ -732,11 +1572,21 @@ func (p *OAuthProxy) getAuthenticatedSession(rw http.ResponseWriter, req *http.R
 				saveSession = true
 			}
 
-			if ok, err := p.provider.RefreshSessionIfNeeded(session); err != nil {
+			_, refreshSpan := tracing.Start(ctx, "provider.refresh", tracing.KindClient)
+			ok, err := p.provider.RefreshSessionIfNeeded(session)
+			refreshSpan.SetError(err)
+			refreshSpan.End()
+			if err != nil {
 				logger.Printf("%s removing session. error refreshing access token %s %s", remoteAddr, err, session)
+				p.auditLog.Record(req, session, auditEvent{Type: auditTokenRefresh, Reason: err.Error()})
+				p.metrics.refresh(p.providerID, false)
+				p.errorReporter.Report(req, session, "provider.refresh", err)
+				p.failureAlerts.Record(failureProvider, "error refreshing session: "+err.Error())
 				clearSession = true
 				session = nil
 			} else if ok {
+				p.auditLog.Record(req, session, auditEvent{Type: auditTokenRefresh, Success: true})
+				p.metrics.refresh(p.providerID, true)
 				saveSession = true
 				revalidated = true
 			}
@@ -751,7 +1601,10 @@ func (p *OAuthProxy) getAuthenticatedSession(rw http.ResponseWriter, req *http.R
 	}
 
 	if saveSession && !revalidated && session != nil && session.AccessToken != "" {
-		if !p.provider.ValidateSessionState(session) {
+		_, validateSpan := tracing.Start(ctx, "provider.validate", tracing.KindClient)
+		valid := p.provider.ValidateSessionState(session)
+		validateSpan.End()
+		if !valid {
 			logger.Printf("Removing session: error validating %s", session)
 			saveSession = false
 			session = nil
@@ -760,8 +1613,9 @@ func (p *OAuthProxy) getAuthenticatedSession(rw http.ResponseWriter, req *http.R
 	}
 
 	if session != nil && session.Email != "" {
-		if !p.Validator(session.Email) || !p.provider.ValidateGroup(session.Email) {
+		if !p.Validator(session.Email) || !p.provider.ValidateGroup(session.Email) || !p.requiredGroups.Matches(session.Groups) {
 			logger.Printf(session.Email, req, logger.AuthFailure, "Invalid authentication via session: removing session %s", session)
+			p.auditLog.Record(req, session, auditEvent{Type: auditSessionRevoked, Success: true, Reason: "no longer authorized"})
 			session = nil
 			saveSession = false
 			clearSession = true
@@ -787,6 +1641,13 @@ func (p *OAuthProxy) getAuthenticatedSession(rw http.ResponseWriter, req *http.R
 		}
 	}
 
+	if session != nil && p.denyList.Denied(session.User, session.Email) {
+		logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Denied access: removing session %s", session)
+		p.auditLog.Record(req, session, auditEvent{Type: auditSessionRevoked, Success: true, Reason: "denied"})
+		p.ClearSessionCookie(rw, req)
+		session = nil
+	}
+
 	if session == nil {
 		return nil, ErrNeedsLogin
 	}
@@ -794,6 +1655,21 @@ func (p *OAuthProxy) getAuthenticatedSession(rw http.ResponseWriter, req *http.R
 	return session, nil
 }
 
+// rewriteRequestHeaders removes and overrides client supplied request headers
+// according to the configured rules before the request is passed upstream
+func (p *OAuthProxy) rewriteRequestHeaders(req *http.Request) {
+	for _, name := range p.stripRequestHeaders {
+		req.Header.Del(name)
+	}
+	for name, values := range p.setRequestHeaders {
+		req.Header[name] = values
+	}
+	if p.upstreamJWT != nil {
+		// only the proxy may set the upstream JWT
+		req.Header.Del(p.upstreamJWT.header)
+	}
+}
+
 // addHeadersForProxying adds the appropriate headers the request / response for proxying
 func (p *OAuthProxy) addHeadersForProxying(rw http.ResponseWriter, req *http.Request, session *sessionsapi.SessionState) {
 	if p.PassBasicAuth {
@@ -817,9 +1693,28 @@ func (p *OAuthProxy) addHeadersForProxying(rw http.ResponseWriter, req *http.Req
 		if p.PassAccessToken && session.AccessToken != "" {
 			rw.Header().Set("X-Auth-Request-Access-Token", session.AccessToken)
 		}
+		if p.PassIDToken && session.IDToken != "" {
+			rw.Header().Set("X-Auth-Request-Id-Token", session.IDToken)
+		}
+		if p.groupsHeader != nil && len(session.Groups) > 0 {
+			rw.Header().Set("X-Auth-Request-Groups", p.groupsHeader.Value(session.Groups))
+		}
+	}
+	if p.groupsHeader != nil {
+		req.Header.Del(p.groupsHeader.name)
+		if len(session.Groups) > 0 {
+			req.Header.Set(p.groupsHeader.name, p.groupsHeader.Value(session.Groups))
+		}
 	}
 	if p.PassAccessToken && session.AccessToken != "" {
-		req.Header["X-Forwarded-Access-Token"] = []string{session.AccessToken}
+		token := session.AccessToken
+		if p.accessTokenBearer {
+			token = fmt.Sprintf("Bearer %s", token)
+		}
+		req.Header.Set(p.accessTokenHeader, token)
+	}
+	if p.PassIDToken && session.IDToken != "" {
+		req.Header["X-Forwarded-Id-Token"] = []string{session.IDToken}
 	}
 	if p.PassAuthorization && session.IDToken != "" {
 		req.Header["Authorization"] = []string{fmt.Sprintf("Bearer %s", session.IDToken)}
@@ -827,6 +1722,14 @@ func (p *OAuthProxy) addHeadersForProxying(rw http.ResponseWriter, req *http.Req
 	if p.SetAuthorization && session.IDToken != "" {
 		rw.Header().Set("Authorization", fmt.Sprintf("Bearer %s", session.IDToken))
 	}
+	if p.upstreamJWT != nil {
+		token, err := p.upstreamJWT.Sign(session)
+		if err != nil {
+			logger.Printf("Error signing upstream JWT: %s", err)
+		} else {
+			req.Header.Set(p.upstreamJWT.header, token)
+		}
+	}
 	if session.Email == "" {
 		rw.Header().Set("GAP-Auth", session.User)
 	} else {
@@ -856,16 +1759,35 @@ func (p *OAuthProxy) CheckBasicAuth(req *http.Request) (*sessionsapi.SessionStat
 	if len(pair) != 2 {
 		return nil, fmt.Errorf("invalid format %s", b)
 	}
+	addr := p.trustedIPs.Source(req)
+	if wait := p.loginBackoff.Wait(pair[0], addr); wait > 0 {
+		logger.PrintAuthf(pair[0], req, logger.AuthFailure, "Invalid authentication via basic auth: too many failed attempts, retry in %s", wait.Round(time.Second))
+		p.auditLogin(req, nil, pair[0], "basic_auth", "too many failed attempts")
+		return nil, nil
+	}
 	if p.HtpasswdFile.Validate(pair[0], pair[1]) {
+		if p.TOTPFile != nil {
+			// basic auth has no room for the second factor
+			logger.PrintAuthf(pair[0], req, logger.AuthFailure, "Invalid authentication via basic auth: TOTP required")
+			p.auditLogin(req, nil, pair[0], "basic_auth", "TOTP required")
+			return nil, nil
+		}
+		p.loginBackoff.Succeeded(pair[0], addr)
 		logger.PrintAuthf(pair[0], req, logger.AuthSuccess, "Authenticated via basic auth and HTpasswd File")
+		p.auditLogin(req, nil, pair[0], "basic_auth", "")
 		return &sessionsapi.SessionState{User: pair[0]}, nil
 	}
+	p.loginBackoff.Failed(pair[0], addr)
 	logger.PrintAuthf(pair[0], req, logger.AuthFailure, "Invalid authentication via basic auth: not in Htpasswd File")
+	p.auditLogin(req, nil, pair[0], "basic_auth", "not in Htpasswd File")
 	return nil, nil
 }
 
 // isAjax checks if a request is an ajax request
 func isAjax(req *http.Request) bool {
+	if req.Header.Get("X-Requested-With") == "XMLHttpRequest" {
+		return true
+	}
 	acceptValues, ok := req.Header["accept"]
 	if !ok {
 		acceptValues = req.Header["Accept"]
@@ -885,6 +1807,27 @@ func (p *OAuthProxy) ErrorJSON(rw http.ResponseWriter, code int) {
 	rw.WriteHeader(code)
 }
 
+// UnauthorizedJSON returns a 401 with a JSON body giving the URL the client
+// should send the user to for signing in
+func (p *OAuthProxy) UnauthorizedJSON(rw http.ResponseWriter, loginURL string) {
+	rw.Header().Set("Cache-Control", "no-store")
+	p.ErrorJSON(rw, http.StatusUnauthorized)
+	json.NewEncoder(rw).Encode(map[string]string{
+		"error":     "unauthorized",
+		"login_url": loginURL,
+	})
+}
+
+// loginURL returns the URL signing in the user and sending them back to the
+// page of the request
+func (p *OAuthProxy) loginURL(req *http.Request) string {
+	path := p.SignInPath
+	if p.SkipProviderButton {
+		path = p.OAuthStartPath
+	}
+	return path + "?" + url.Values{"rd": {p.signInRedirect(req)}}.Encode()
+}
+
 // GetJwtSession loads a session based on a JWT token in the authorization header.
 func (p *OAuthProxy) GetJwtSession(req *http.Request) (*sessionsapi.SessionState, error) {
 	rawBearerToken, err := p.findBearerToken(req)
@@ -1,9 +1,10 @@
-package main
+package oauthproxy
 
 import (
 	"context"
 	"crypto"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -11,6 +12,8 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path"
 	"regexp"
 	"strings"
 	"testing"
@@ -135,6 +138,90 @@ func TestNewReverseProxy(t *testing.T) {
 	}
 }
 
+func TestProxyResponseHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Frame-Options", "ALLOW")
+		w.WriteHeader(200)
+	}))
+	defer backend.Close()
+
+	backendURL, _ := url.Parse(backend.URL)
+	headers := http.Header{
+		"X-Frame-Options":           {"DENY"},
+		"Strict-Transport-Security": {"max-age=31536000"},
+	}
+	proxyHandler := NewReverseProxy(backendURL, time.Second)
+	setProxyResponseHeaders(proxyHandler, headers)
+	frontend := httptest.NewServer(proxyHandler)
+	defer frontend.Close()
+
+	res, err := http.Get(frontend.URL)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"DENY"}, res.Header["X-Frame-Options"])
+	assert.Equal(t, "max-age=31536000", res.Header.Get("Strict-Transport-Security"))
+}
+
+func TestUpstreamHostOverride(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte(r.Host))
+	}))
+	defer backend.Close()
+
+	backendURL, _ := url.Parse(backend.URL + "/#host=bucket.example.com")
+	frontend := httptest.NewServer(NewWebSocketOrRestReverseProxy(backendURL, NewOptions(), nil))
+	defer frontend.Close()
+
+	res, err := http.Get(frontend.URL)
+	require.NoError(t, err)
+	bodyBytes, _ := ioutil.ReadAll(res.Body)
+	assert.Equal(t, "bucket.example.com", string(bodyBytes))
+}
+
+func TestUpstreamPathPrefixRewrite(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte(r.RequestURI))
+	}))
+	defer backend.Close()
+
+	for fragment, expected := range map[string]string{
+		"strip-prefix=true":    "/api/health?full=1",
+		"rewrite-prefix=/app/": "/app/api/health?full=1",
+		"strip-prefix=false":   "/grafana/api/health?full=1",
+	} {
+		backendURL, _ := url.Parse(backend.URL + "/grafana/#" + fragment)
+		frontend := httptest.NewServer(NewWebSocketOrRestReverseProxy(backendURL, NewOptions(), nil))
+
+		res, err := http.Get(frontend.URL + "/grafana/api/health?full=1")
+		require.NoError(t, err)
+		bodyBytes, _ := ioutil.ReadAll(res.Body)
+		assert.Equal(t, expected, string(bodyBytes))
+		frontend.Close()
+	}
+}
+
+func TestUpstreamMaxBodySize(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	defer backend.Close()
+
+	backendURL, _ := url.Parse(backend.URL + "/#max-body-size=4")
+	opts := NewOptions()
+	opts.MaxRequestBodySize = 1024
+	frontend := httptest.NewServer(NewWebSocketOrRestReverseProxy(backendURL, opts, nil))
+	defer frontend.Close()
+
+	res, err := http.Post(frontend.URL, "text/plain", strings.NewReader("1234"))
+	require.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+
+	res, err = http.Post(frontend.URL, "text/plain", strings.NewReader("12345"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode)
+}
+
 func TestEncodedSlashes(t *testing.T) {
 	var seen string
 	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -225,6 +312,97 @@ func TestIsValidRedirect(t *testing.T) {
 
 	invalidHTTPS2 := proxy.IsValidRedirect("https://evil.corp/redirect?rd=foo.bar")
 	assert.Equal(t, false, invalidHTTPS2)
+
+	backslash := proxy.IsValidRedirect("/\\evil.corp/redirect")
+	assert.Equal(t, false, backslash)
+
+	tab := proxy.IsValidRedirect("/\t/evil.corp/redirect")
+	assert.Equal(t, false, tab)
+}
+
+func TestRedirectWhitelist(t *testing.T) {
+	opts := NewOptions()
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "xyzzyplugh"
+	opts.EmailDomains = []string{"*"}
+	opts.WhitelistDomains = []string{".example.com", "evil.corp"}
+	opts.RedirectWhitelist = []string{"/app", ".example.com/dashboard", "www.example.com"}
+	assert.NoError(t, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	assert.Equal(t, true, proxy.IsValidRedirect("/app/page?x=1"))
+	assert.Equal(t, false, proxy.IsValidRedirect("/admin"))
+	assert.Equal(t, true, proxy.IsValidRedirect("/app"))
+	assert.Equal(t, false, proxy.IsValidRedirect("/application"))
+	assert.Equal(t, false, proxy.IsValidRedirect("/app/../admin"))
+	assert.Equal(t, false, proxy.IsValidRedirect("/app/%2e%2e/admin"))
+	assert.Equal(t, true, proxy.IsValidRedirect("/oauth2/sso?redirect_uri=https%3A%2F%2Fapp.example.com"))
+	assert.Equal(t, true, proxy.IsValidRedirect("/oauth2/silent_auth"))
+	assert.Equal(t, false, proxy.IsValidRedirect("/oauth2/../admin"))
+	assert.Equal(t, false, proxy.IsValidRedirect("/oauth2/start?rd=/admin"))
+	assert.Equal(t, true, proxy.IsValidRedirect("https://app.example.com/dashboard/1"))
+	assert.Equal(t, false, proxy.IsValidRedirect("https://app.example.com/admin"))
+	assert.Equal(t, false, proxy.IsValidRedirect("https://app.example.com/dashboard/../admin"))
+	assert.Equal(t, false, proxy.IsValidRedirect("https://app.example.com/dashboards"))
+	assert.Equal(t, true, proxy.IsValidRedirect("https://www.example.com/anything"))
+	// the domain must be allowed by -whitelist-domain too
+	assert.Equal(t, false, proxy.IsValidRedirect("https://www.example.org/app"))
+	assert.Equal(t, false, proxy.IsValidRedirect("https://evil.corp/app"))
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/oauth2/start?rd="+url.QueryEscape("https://evil.corp/app"), nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	state := mustDecodeState(t, proxy, mustLoginState(t, rw.Header().Get("Location")))
+	assert.Equal(t, "/", state.Redirect)
+
+	opts.RedirectWhitelist = []string{"https://www.example.com"}
+	assert.Error(t, opts.Validate())
+}
+
+func mustLoginState(t *testing.T, loginURL string) string {
+	u, err := url.Parse(loginURL)
+	assert.NoError(t, err)
+	return u.Query().Get("state")
+}
+
+func TestSignOutRedirect(t *testing.T) {
+	opts := NewOptions()
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "xyzzyplugh"
+	opts.SignOutRedirects = []string{"/goodbye", ".example.com/signed-out", "www.example.org"}
+	opts.Validate()
+
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	assert.Equal(t, true, proxy.IsValidSignOutRedirect("/goodbye"))
+	assert.Equal(t, true, proxy.IsValidSignOutRedirect("/goodbye/page?x=1"))
+	assert.Equal(t, false, proxy.IsValidSignOutRedirect("/admin"))
+	assert.Equal(t, false, proxy.IsValidSignOutRedirect("/goodbye/../admin"))
+	assert.Equal(t, false, proxy.IsValidSignOutRedirect("/goodbyes"))
+	assert.Equal(t, false, proxy.IsValidSignOutRedirect("//evil.com/goodbye"))
+	assert.Equal(t, false, proxy.IsValidSignOutRedirect("/\\evil.com/goodbye"))
+	assert.Equal(t, false, proxy.IsValidSignOutRedirect("https://evil.com/goodbye"))
+	assert.Equal(t, true, proxy.IsValidSignOutRedirect("https://app.example.com/signed-out"))
+	assert.Equal(t, false, proxy.IsValidSignOutRedirect("https://app.example.com/other"))
+	assert.Equal(t, false, proxy.IsValidSignOutRedirect("https://evilexample.com/signed-out"))
+	assert.Equal(t, true, proxy.IsValidSignOutRedirect("http://www.example.org/anything"))
+	assert.Equal(t, false, proxy.IsValidSignOutRedirect("javascript:alert(1)"))
+	assert.Equal(t, false, proxy.IsValidSignOutRedirect(""))
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/sign_out?rd="+url.QueryEscape("https://app.example.com/signed-out"), nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, "https://app.example.com/signed-out", rw.Header().Get("Location"))
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth2/sign_out?rd="+url.QueryEscape("https://evil.com/"), nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, "/", rw.Header().Get("Location"))
 }
 
 type TestProvider struct {
@@ -315,7 +493,8 @@ func TestBasicAuthPassword(t *testing.T) {
 	})
 
 	rw := httptest.NewRecorder()
-	req, _ := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:",
+	state, _ := proxy.encodeState("nonce", "", "", time.Now())
+	req, _ := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state="+state,
 		strings.NewReader(""))
 	req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", proxy.CookieExpire, time.Now()))
 	proxy.ServeHTTP(rw, req)
@@ -364,11 +543,17 @@ type PassAccessTokenTest struct {
 }
 
 type PassAccessTokenTestOptions struct {
-	PassAccessToken bool
+	PassAccessToken   bool
+	AccessTokenHeader string
+	AccessTokenFormat string
 }
 
 func NewPassAccessTokenTest(opts PassAccessTokenTestOptions) *PassAccessTokenTest {
 	t := &PassAccessTokenTest{}
+	tokenHeader := "X-Forwarded-Access-Token"
+	if opts.AccessTokenHeader != "" {
+		tokenHeader = opts.AccessTokenHeader
+	}
 
 	t.providerServer = httptest.NewServer(
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -378,7 +563,7 @@ func NewPassAccessTokenTest(opts PassAccessTokenTestOptions) *PassAccessTokenTes
 			case "/oauth/token":
 				payload = `{"access_token": "my_auth_token"}`
 			default:
-				payload = r.Header.Get("X-Forwarded-Access-Token")
+				payload = r.Header.Get(tokenHeader)
 				if payload == "" {
 					payload = "No access token found."
 				}
@@ -396,6 +581,12 @@ func NewPassAccessTokenTest(opts PassAccessTokenTestOptions) *PassAccessTokenTes
 	t.opts.ClientSecret = "foobar"
 	t.opts.CookieSecure = false
 	t.opts.PassAccessToken = opts.PassAccessToken
+	if opts.AccessTokenHeader != "" {
+		t.opts.AccessTokenHeader = opts.AccessTokenHeader
+	}
+	if opts.AccessTokenFormat != "" {
+		t.opts.AccessTokenFormat = opts.AccessTokenFormat
+	}
 	t.opts.Validate()
 
 	providerURL, _ := url.Parse(t.providerServer.URL)
@@ -415,7 +606,8 @@ func (patTest *PassAccessTokenTest) Close() {
 func (patTest *PassAccessTokenTest) getCallbackEndpoint() (httpCode int,
 	cookie string) {
 	rw := httptest.NewRecorder()
-	req, err := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:",
+	state, _ := patTest.proxy.encodeState("nonce", "", "", time.Now())
+	req, err := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state="+state,
 		strings.NewReader(""))
 	if err != nil {
 		return 0, ""
@@ -504,6 +696,26 @@ func TestDoNotForwardAccessTokenUpstream(t *testing.T) {
 	assert.Equal(t, "No access token found.", payload)
 }
 
+func TestForwardAccessTokenUpstreamBearerAuthorization(t *testing.T) {
+	patTest := NewPassAccessTokenTest(PassAccessTokenTestOptions{
+		PassAccessToken:   true,
+		AccessTokenHeader: "Authorization",
+		AccessTokenFormat: "bearer",
+	})
+	defer patTest.Close()
+
+	code, cookie := patTest.getCallbackEndpoint()
+	if code != 302 {
+		t.Fatalf("expected 302; got %d", code)
+	}
+
+	code, payload := patTest.getRootEndpoint(cookie)
+	if code != 200 {
+		t.Fatalf("expected 200; got %d", code)
+	}
+	assert.Equal(t, "Bearer my_auth_token", payload)
+}
+
 type SignInPageTest struct {
 	opts                 *Options
 	proxy                *OAuthProxy
@@ -601,6 +813,60 @@ func TestSignInPageSkipProviderDirect(t *testing.T) {
 	}
 }
 
+func TestSignInPageProviderPreselection(t *testing.T) {
+	sipTest := NewSignInPageTest(false)
+
+	code, body := sipTest.GetEndpoint("/oauth2/sign_in?provider=google&rd=/app")
+	assert.Equal(t, 302, code)
+	match := sipTest.signInProviderRegexp.FindStringSubmatch(body)
+	if match == nil {
+		t.Fatal("Did not find pattern in body: " +
+			signInSkipProvider + "\nBody:\n" + body)
+	}
+
+	code, body = sipTest.GetEndpoint("/oauth2/start?provider=github")
+	assert.Equal(t, 400, code)
+	assert.Contains(t, body, "unknown provider &#34;github&#34;")
+}
+
+func TestSignInPagePreserveFragment(t *testing.T) {
+	sipTest := NewSignInPageTest(true)
+	sipTest.proxy.preserveFragment = true
+
+	code, body := sipTest.GetEndpoint("/app/?page=2")
+	assert.Equal(t, 200, code)
+	assert.Contains(t, body, `window.location.replace("\/oauth2/start?rd=" + encodeURIComponent("/app/?page=2" + window.location.hash));`)
+
+	code, body = sipTest.GetEndpoint("/oauth2/sign_in?rd=/app/")
+	assert.Equal(t, 200, code)
+	assert.Contains(t, body, `encodeURIComponent("/app/" + window.location.hash)`)
+}
+
+func TestSignInPageServesCustomStaticAssets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, os.Mkdir(path.Join(dir, "static"), 0755))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "static", "logo.svg"), []byte("<svg/>"), 0644))
+
+	opts := NewOptions()
+	opts.CookieSecret = "foobar"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "xyzzyplugh"
+	opts.CustomTemplatesDir = dir
+	opts.Validate()
+
+	proxy := NewOAuthProxy(opts, func(email string) bool {
+		return true
+	})
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/static/logo.svg", nil)
+	proxy.ServeHTTP(rw, req)
+
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "<svg/>", rw.Body.String())
+}
+
 type ProcessCookieTest struct {
 	opts         *Options
 	proxy        *OAuthProxy
@@ -774,6 +1040,69 @@ func TestAuthOnlyEndpointUnauthorizedOnNoCookieSetError(t *testing.T) {
 	assert.Equal(t, "unauthorized request\n", string(bodyBytes))
 }
 
+func TestUserInfoEndpoint(t *testing.T) {
+	test := NewProcessCookieTestWithOptionsModifiers()
+	test.req, _ = http.NewRequest("GET", test.opts.ProxyPrefix+"/userinfo", nil)
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, http.StatusUnauthorized, test.rw.Code)
+	assert.Equal(t, applicationJSON, test.rw.Header().Get("Content-Type"))
+
+	test = NewProcessCookieTestWithOptionsModifiers()
+	test.req, _ = http.NewRequest("GET", test.opts.ProxyPrefix+"/userinfo", nil)
+	expires := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	test.SaveSession(&sessions.SessionState{
+		User: "michael.bland", Email: "michael.bland@gsa.gov", AccessToken: "my_access_token",
+		CreatedAt: time.Now(), ExpiresOn: expires})
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, http.StatusOK, test.rw.Code)
+	assert.Equal(t, "no-store", test.rw.Header().Get("Cache-Control"))
+	assert.Equal(t, `{"user":"michael.bland","email":"michael.bland@gsa.gov","expires_on":"2030-01-02T03:04:05Z"}`+"\n", test.rw.Body.String())
+}
+
+func TestRefreshEndpoint(t *testing.T) {
+	test := NewProcessCookieTestWithOptionsModifiers()
+	test.req, _ = http.NewRequest("POST", test.opts.ProxyPrefix+"/refresh", nil)
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, http.StatusUnauthorized, test.rw.Code)
+
+	test = NewProcessCookieTestWithOptionsModifiers(func(opts *Options) {
+		opts.CookieExpire = 24 * time.Hour
+	})
+	test.req, _ = http.NewRequest("POST", test.opts.ProxyPrefix+"/refresh", nil)
+	created := time.Now().Truncate(time.Second)
+	expires := created.Add(time.Hour)
+	test.SaveSession(&sessions.SessionState{
+		User: "michael.bland", Email: "michael.bland@gsa.gov", AccessToken: "my_access_token",
+		CreatedAt: created, ExpiresOn: expires})
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, http.StatusOK, test.rw.Code)
+	assert.Equal(t, "no-store", test.rw.Header().Get("Cache-Control"))
+	var expiry struct {
+		ExpiresOn        time.Time `json:"expires_on"`
+		SessionExpiresOn time.Time `json:"session_expires_on"`
+	}
+	assert.NoError(t, json.Unmarshal(test.rw.Body.Bytes(), &expiry))
+	assert.True(t, expires.Equal(expiry.ExpiresOn))
+	assert.True(t, created.Add(24*time.Hour).Equal(expiry.SessionExpiresOn))
+}
+
+func TestSignOutAllEndpoint(t *testing.T) {
+	test := NewProcessCookieTestWithOptionsModifiers()
+	test.req, _ = http.NewRequest("GET", test.opts.ProxyPrefix+"/sign_out_all", nil)
+	test.req.Header.Set("X-Requested-With", "XMLHttpRequest")
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, http.StatusUnauthorized, test.rw.Code)
+
+	// sessions kept in cookies can't be revoked
+	test = NewProcessCookieTestWithOptionsModifiers()
+	test.req, _ = http.NewRequest("GET", test.opts.ProxyPrefix+"/sign_out_all", nil)
+	test.SaveSession(&sessions.SessionState{
+		User: "michael.bland", Email: "michael.bland@gsa.gov", AccessToken: "my_access_token",
+		CreatedAt: time.Now()})
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, http.StatusNotImplemented, test.rw.Code)
+}
+
 func TestAuthOnlyEndpointUnauthorizedOnExpiration(t *testing.T) {
 	test := NewAuthOnlyEndpointTest(func(opts *Options) {
 		opts.CookieExpire = time.Duration(24) * time.Hour
@@ -851,6 +1180,61 @@ func TestAuthOnlyEndpointSetXAuthRequestHeaders(t *testing.T) {
 	assert.Equal(t, "oauth_user@example.com", pcTest.rw.HeaderMap["X-Auth-Request-Email"][0])
 }
 
+func TestAuthOnlyEndpointPassIDToken(t *testing.T) {
+	test := NewAuthOnlyEndpointTest(func(opts *Options) {
+		opts.SetXAuthRequest = true
+		opts.PassIDToken = true
+	})
+	startSession := &sessions.SessionState{
+		User: "oauth_user", Email: "oauth_user@example.com", IDToken: "oauth_id_token", CreatedAt: time.Now()}
+	test.SaveSession(startSession)
+
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, http.StatusAccepted, test.rw.Code)
+	assert.Equal(t, "oauth_id_token", test.rw.Header().Get("X-Auth-Request-Id-Token"))
+	assert.Equal(t, "oauth_id_token", test.req.Header.Get("X-Forwarded-Id-Token"))
+}
+
+func TestAuthOnlyEndpointForwardAuthHeaders(t *testing.T) {
+	test := NewAuthOnlyEndpointTest(func(opts *Options) {
+		opts.ForwardAuth = true
+		opts.ForwardAuthUserHeader = "Remote-User"
+	})
+	startSession := &sessions.SessionState{
+		User: "oauth_user", Email: "oauth_user@example.com", AccessToken: "oauth_token", CreatedAt: time.Now()}
+	test.SaveSession(startSession)
+
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, http.StatusAccepted, test.rw.Code)
+	assert.Equal(t, "oauth_user", test.rw.Header().Get("Remote-User"))
+	assert.Equal(t, "oauth_user@example.com", test.rw.Header().Get("X-Forwarded-Email"))
+}
+
+func TestAuthOnlyEndpointForwardAuthSignIn(t *testing.T) {
+	test := NewAuthOnlyEndpointTest(func(opts *Options) {
+		opts.ForwardAuth = true
+	})
+	test.proxy.provider = NewTestProvider(&url.URL{Host: "localhost"}, "")
+	test.req.Header.Set("X-Forwarded-Proto", "https")
+	test.req.Header.Set("X-Forwarded-Host", "app.example.com")
+	test.req.Header.Set("X-Forwarded-Uri", "/some/path?q=1")
+
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, http.StatusForbidden, test.rw.Code)
+	match := regexp.MustCompile(signInRedirectPattern).FindStringSubmatch(test.rw.Body.String())
+	require.NotNil(t, match)
+	assert.Equal(t, "https://app.example.com/some/path?q=1", match[1])
+}
+
+func TestGetForwardedRedirectDisabled(t *testing.T) {
+	test := NewAuthOnlyEndpointTest()
+	test.req.Header.Set("X-Forwarded-Host", "app.example.com")
+	test.req.Header.Set("X-Forwarded-Uri", "/some/path")
+
+	assert.Equal(t, "", test.proxy.getForwardedRedirect(test.req))
+	assert.Equal(t, test.req.Host, test.proxy.getRequestHost(test.req))
+}
+
 func TestAuthSkippedForPreflightRequests(t *testing.T) {
 	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(200)
@@ -878,6 +1262,168 @@ func TestAuthSkippedForPreflightRequests(t *testing.T) {
 	assert.Equal(t, "response", rw.Body.String())
 }
 
+func TestVirtualHostUpstreams(t *testing.T) {
+	newUpstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+	}
+	grafana, kibana, fallback := newUpstream("grafana"), newUpstream("kibana"), newUpstream("fallback")
+	defer grafana.Close()
+	defer kibana.Close()
+	defer fallback.Close()
+
+	opts := NewOptions()
+	opts.Upstreams = []string{
+		grafana.URL + "/#vhost=grafana.example.com",
+		kibana.URL + "/#vhost=kibana.example.com",
+		fallback.URL,
+	}
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "xyzzyplugh"
+	opts.SkipAuthRegex = []string{"^/public"}
+	opts.Validate()
+
+	proxy := NewOAuthProxy(opts, func(string) bool { return false })
+	for host, expected := range map[string]string{
+		"grafana.example.com":    "grafana",
+		"kibana.example.com:443": "kibana",
+		"elsewhere.example.com":  "fallback",
+	} {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/public", nil)
+		req.Host = host
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, expected, rw.Body.String())
+	}
+}
+
+func TestRequestHeaderRulesOnWhitelistedPath(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte(r.Header.Get("X-Forwarded-Email") + "|" + r.Header.Get("X-Real-Ip")))
+	}))
+	defer upstream.Close()
+
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, upstream.URL)
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "xyzzyplugh"
+	opts.SkipAuthRegex = []string{"^/public"}
+	opts.StripRequestHeaders = []string{"X-Forwarded-Email"}
+	opts.SetRequestHeaders = []string{"X-Real-IP: 10.0.0.1"}
+	opts.Validate()
+
+	proxy := NewOAuthProxy(opts, func(string) bool { return false })
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/public", nil)
+	req.Header.Set("X-Forwarded-Email", "spoofed@example.com")
+	req.Header.Set("X-Real-IP", "1.2.3.4")
+	proxy.ServeHTTP(rw, req)
+
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "|10.0.0.1", rw.Body.String())
+}
+
+func TestStripAuthorizationHeader(t *testing.T) {
+	test := NewProcessCookieTestWithOptionsModifiers(func(opts *Options) {
+		opts.StripRequestHeaders = []string{"X-Real-IP"}
+		opts.StripAuthorization = true
+	})
+	assert.Equal(t, []string{"X-Real-IP", "Authorization"}, test.proxy.stripRequestHeaders)
+	assert.Equal(t, []string{"X-Real-IP"}, test.opts.StripRequestHeaders)
+
+	test.req.Header.Set("Authorization", "Bearer smuggled")
+	test.proxy.rewriteRequestHeaders(test.req)
+	assert.Equal(t, "", test.req.Header.Get("Authorization"))
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("response"))
+	}))
+	defer upstream.Close()
+
+	test := NewProcessCookieTestWithOptionsModifiers(func(opts *Options) {
+		opts.Upstreams = []string{upstream.URL}
+		opts.MaintenancePaths = []string{"^/app/"}
+		opts.MaintenanceAllowedEmails = []string{"@ops.example.com"}
+		opts.MaintenanceAllowedGroups = []string{"qa"}
+	})
+	test.req, _ = http.NewRequest("GET", "/app/page", nil)
+	test.SaveSession(&sessions.SessionState{Email: "user@example.com", AccessToken: "token", CreatedAt: time.Now()})
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		test.req.URL.Path = path
+		test.proxy.ServeHTTP(rw, test.req)
+		return rw
+	}
+
+	assert.Equal(t, 200, serve("/app/page").Code)
+
+	test.proxy.maintenance.Toggle()
+	rw := serve("/app/page")
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+	assert.Contains(t, rw.Body.String(), "Down for Maintenance")
+	assert.Equal(t, 200, serve("/other").Code)
+
+	test.req.Header.Del("Cookie")
+	test.rw = httptest.NewRecorder()
+	test.SaveSession(&sessions.SessionState{Email: "admin@ops.example.com", AccessToken: "token", CreatedAt: time.Now()})
+	assert.Equal(t, 200, serve("/app/page").Code)
+
+	test.req.Header.Del("Cookie")
+	test.rw = httptest.NewRecorder()
+	test.SaveSession(&sessions.SessionState{Email: "qa@example.com", Groups: []string{"staff", "qa"}, AccessToken: "token", CreatedAt: time.Now()})
+	assert.Equal(t, 200, serve("/app/page").Code)
+
+	test.proxy.maintenance.Toggle()
+	assert.False(t, test.proxy.maintenance.Enabled())
+}
+
+func TestAuthOnlyEndpointRequestChecks(t *testing.T) {
+	test := NewAuthOnlyEndpointTest(func(opts *Options) {
+		opts.MaintenancePaths = []string{"^/app/"}
+		opts.StepUpRoutes = []string{"^/admin/=urn:example:mfa"}
+		opts.RateLimit = "1/h"
+	})
+	test.SaveSession(&sessions.SessionState{Email: "user@example.com", AccessToken: "token", CreatedAt: time.Now()})
+
+	serve := func(uri string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		test.req.Header.Set("X-Original-URI", uri)
+		test.proxy.ServeHTTP(rw, test.req)
+		return rw
+	}
+
+	test.proxy.maintenance.Set(true)
+	assert.Equal(t, http.StatusServiceUnavailable, serve("/app/page").Code)
+	test.proxy.maintenance.Set(false)
+
+	assert.Equal(t, http.StatusForbidden, serve("/admin/users").Code)
+
+	assert.Equal(t, http.StatusAccepted, serve("/page").Code)
+	rw := serve("/page")
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.Equal(t, "3600", rw.Header().Get("Retry-After"))
+}
+
+func TestAuthOnlyEndpointForwardAuthStepUp(t *testing.T) {
+	test := NewAuthOnlyEndpointTest(func(opts *Options) {
+		opts.ForwardAuth = true
+		opts.StepUpRoutes = []string{"^/admin/=urn:example:mfa"}
+	})
+	test.SaveSession(&sessions.SessionState{Email: "user@example.com", AccessToken: "token", CreatedAt: time.Now()})
+	test.req.Header.Set("X-Forwarded-Uri", "/admin/users")
+
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, 302, test.rw.Code)
+	assert.Equal(t, "/oauth2/step_up?acr=urn%3Aexample%3Amfa&rd=%2Fadmin%2Fusers", test.rw.Header().Get("Location"))
+}
+
 type SignatureAuthenticator struct {
 	auth hmacauth.HmacAuth
 }
@@ -1101,6 +1647,89 @@ func TestAjaxUnauthorizedRequest2(t *testing.T) {
 	testAjaxUnauthorizedRequest(t, header)
 }
 
+func TestAjaxUnauthorizedRequestXMLHttpRequest(t *testing.T) {
+	header := make(http.Header)
+	header.Add("X-Requested-With", "XMLHttpRequest")
+
+	testAjaxUnauthorizedRequest(t, header)
+}
+
+func TestAjaxUnauthorizedRequestLoginURL(t *testing.T) {
+	test := newAjaxRequestTest()
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/test?page=2", nil)
+	req.Header.Set("Accept", applicationJSON)
+	test.proxy.ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+	var body map[string]string
+	assert.NoError(t, json.Unmarshal(rw.Body.Bytes(), &body))
+	assert.Equal(t, "unauthorized", body["error"])
+	assert.Equal(t, "/oauth2/sign_in?rd=%2Ftest%3Fpage%3D2", body["login_url"])
+}
+
+func TestAPIRouteUnauthorizedRequest(t *testing.T) {
+	opts := NewOptions()
+	opts.CookieSecret = "foobar"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "xyzzyplugh"
+	opts.EmailDomains = []string{"*"}
+	opts.SkipProviderButton = true
+	opts.APIRoutes = []string{"^/api/"}
+	assert.NoError(t, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(email string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/api/items", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+	assert.Equal(t, applicationJSON, rw.Header().Get("Content-Type"))
+	assert.Contains(t, rw.Body.String(), `"login_url":"/oauth2/start?rd=%2Fapi%2Fitems"`)
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/items", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusFound, rw.Code)
+}
+
+func TestUnauthenticatedRoutes(t *testing.T) {
+	opts := NewOptions()
+	opts.CookieSecret = "foobar"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "xyzzyplugh"
+	opts.EmailDomains = []string{"*"}
+	opts.SkipProviderButton = true
+	opts.APIRoutes = []string{"^/api/"}
+	opts.UnauthenticatedRoutes = []string{"^/api/login=redirect", "^/internal/=403", "^/data/=401"}
+	assert.NoError(t, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(email string) bool { return true })
+
+	tests := []struct {
+		path   string
+		accept string
+		code   int
+	}{
+		{"/api/login", applicationJSON, http.StatusFound},
+		{"/api/items", "", http.StatusUnauthorized},
+		{"/internal/metrics", "", http.StatusForbidden},
+		{"/data/report.csv", "", http.StatusUnauthorized},
+		{"/items", "", http.StatusFound},
+		{"/items", applicationJSON, http.StatusUnauthorized},
+	}
+	for _, tc := range tests {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, tc.path, nil)
+		if tc.accept != "" {
+			req.Header.Set("Accept", tc.accept)
+		}
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, tc.code, rw.Code, tc.path)
+	}
+
+	opts.UnauthenticatedRoutes = []string{"^/api/=404", "^/api/"}
+	assert.Error(t, opts.Validate())
+}
+
 func TestAjaxForbiddendRequest(t *testing.T) {
 	test := newAjaxRequestTest()
 	endpoint := "/test"
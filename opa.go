@@ -0,0 +1,111 @@
+package oauthproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	sessionsapi "github.com/OpusCapita/oauth2_proxy/pkg/apis/sessions"
+)
+
+// defaultOPATimeout bounds each decision query
+const defaultOPATimeout = time.Second
+
+// opaClient queries an Open Policy Agent decision for every authorized
+// request
+type opaClient struct {
+	url    string
+	client *http.Client
+}
+
+// opaInput is the input document of the OPA decision: the attributes of
+// the request and the claims of the session
+type opaInput struct {
+	Method     string            `json:"method"`
+	Path       string            `json:"path"`
+	Host       string            `json:"host"`
+	RemoteAddr string            `json:"remote_addr"`
+	Headers    map[string]string `json:"headers"`
+	User       string            `json:"user"`
+	Email      string            `json:"email"`
+	Groups     []string          `json:"groups"`
+	ACR        string            `json:"acr,omitempty"`
+}
+
+// opaExcludedHeaders carry credentials, which are not passed to OPA
+var opaExcludedHeaders = map[string]bool{
+	"Authorization": true,
+	"Cookie":        true,
+}
+
+// parseOPA sets up the OPA decision queries if an opa-url is configured
+func parseOPA(o *Options, msgs []string) (*opaClient, []string) {
+	if o.OPAURL == "" {
+		return nil, msgs
+	}
+	return &opaClient{url: o.OPAURL, client: &http.Client{Timeout: o.OPATimeout}}, msgs
+}
+
+// newOPAInput builds the OPA input for a request with method and path
+func newOPAInput(req *http.Request, method, path string, s *sessionsapi.SessionState) *opaInput {
+	input := &opaInput{
+		Method:     method,
+		Path:       path,
+		Host:       req.Host,
+		RemoteAddr: getRemoteAddr(req),
+		Headers:    make(map[string]string, len(req.Header)),
+		User:       s.User,
+		Email:      s.Email,
+		Groups:     s.Groups,
+		ACR:        s.ACR,
+	}
+	if input.Groups == nil {
+		input.Groups = []string{}
+	}
+	for name, values := range req.Header {
+		if !opaExcludedHeaders[name] && len(values) > 0 {
+			input.Headers[name] = values[0]
+		}
+	}
+	return input
+}
+
+// Allow asks OPA for the decision on input. The decision is either a
+// boolean or an object with an allow boolean; an undefined decision denies
+// the request.
+func (c *opaClient) Allow(input *opaInput) (bool, error) {
+	body, err := json.Marshal(map[string]interface{}{"input": input})
+	if err != nil {
+		return false, err
+	}
+	resp, err := c.client.Post(c.url, applicationJSON, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("got %d from %s", resp.StatusCode, c.url)
+	}
+	var decision struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&decision); err != nil {
+		return false, fmt.Errorf("invalid decision from %s: %v", c.url, err)
+	}
+	if len(decision.Result) == 0 {
+		return false, nil
+	}
+	var allowed bool
+	if err := json.Unmarshal(decision.Result, &allowed); err == nil {
+		return allowed, nil
+	}
+	var result struct {
+		Allow bool `json:"allow"`
+	}
+	if err := json.Unmarshal(decision.Result, &result); err != nil {
+		return false, fmt.Errorf("invalid decision from %s: %s", c.url, decision.Result)
+	}
+	return result.Allow, nil
+}
@@ -0,0 +1,91 @@
+package oauthproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	sessionsapi "github.com/OpusCapita/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOPAAllow(t *testing.T) {
+	var input map[string]interface{}
+	decision := `{"result": true}`
+	opa := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var body struct {
+			Input map[string]interface{} `json:"input"`
+		}
+		assert.NoError(t, json.NewDecoder(req.Body).Decode(&body))
+		input = body.Input
+		rw.Write([]byte(decision))
+	}))
+	defer opa.Close()
+	client := &opaClient{url: opa.URL, client: http.DefaultClient}
+
+	req := httptest.NewRequest(http.MethodGet, "http://app.example.com/admin/", nil)
+	req.Header.Set("Cookie", "_oauth2_proxy=secret")
+	req.Header.Set("X-Request-Id", "42")
+	session := &sessionsapi.SessionState{User: "jane", Email: "jane@example.com", Groups: []string{"ops"}}
+
+	allowed, err := client.Allow(newOPAInput(req, "DELETE", "/admin/users", session))
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+	assert.Equal(t, "DELETE", input["method"])
+	assert.Equal(t, "/admin/users", input["path"])
+	assert.Equal(t, "app.example.com", input["host"])
+	assert.Equal(t, "jane@example.com", input["email"])
+	assert.Equal(t, []interface{}{"ops"}, input["groups"])
+	assert.Equal(t, map[string]interface{}{"X-Request-Id": "42"}, input["headers"])
+
+	decision = `{"result": {"allow": false, "reason": "not an admin"}}`
+	allowed, err = client.Allow(newOPAInput(req, "GET", "/", session))
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+
+	// an undefined decision denies
+	decision = `{}`
+	allowed, err = client.Allow(newOPAInput(req, "GET", "/", session))
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+
+	decision = `{"result": "yes"}`
+	_, err = client.Allow(newOPAInput(req, "GET", "/", session))
+	assert.Error(t, err)
+}
+
+func TestOPAAuthOnly(t *testing.T) {
+	opa := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var body struct {
+			Input opaInput `json:"input"`
+		}
+		json.NewDecoder(req.Body).Decode(&body)
+		json.NewEncoder(rw).Encode(map[string]bool{"result": body.Input.Path != "/admin/"})
+	}))
+	defer opa.Close()
+
+	opts := NewOptions()
+	opts.CookieSecret = "foobar"
+	opts.DevFakeIdentity = "jane@example.com"
+	opts.OPAURL = opa.URL
+	assert.NoError(t, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(email string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/oauth2/auth", nil)
+	req.Header.Set("X-Original-URI", "/admin/")
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+
+	rw = httptest.NewRecorder()
+	req.Header.Set("X-Original-URI", "/app/")
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusAccepted, rw.Code)
+
+	// requests are denied while OPA can't be reached
+	opa.Close()
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+}
@@ -1,4 +1,4 @@
-package main
+package oauthproxy
 
 import (
 	"context"
@@ -6,22 +6,27 @@ import (
 	"crypto/tls"
 	"encoding/base64"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
 	oidc "github.com/coreos/go-oidc"
 	"github.com/dgrijalva/jwt-go"
-	"github.com/mbland/hmacauth"
 	"github.com/OpusCapita/oauth2_proxy/cookie"
 	"github.com/OpusCapita/oauth2_proxy/logger"
 	"github.com/OpusCapita/oauth2_proxy/pkg/apis/options"
 	sessionsapi "github.com/OpusCapita/oauth2_proxy/pkg/apis/sessions"
 	"github.com/OpusCapita/oauth2_proxy/pkg/sessions"
+	"github.com/OpusCapita/oauth2_proxy/pkg/signature"
+	"github.com/OpusCapita/oauth2_proxy/pkg/tracing"
+	"github.com/OpusCapita/oauth2_proxy/pkg/vault"
 	"github.com/OpusCapita/oauth2_proxy/providers"
 	"gopkg.in/natefinch/lumberjack.v2"
 )
@@ -38,11 +43,64 @@ type Options struct {
 	ClientSecret    string `flag:"client-secret" cfg:"client_secret" env:"OAUTH2_PROXY_CLIENT_SECRET"`
 	TLSCertFile     string `flag:"tls-cert" cfg:"tls_cert_file" env:"OAUTH2_PROXY_TLS_CERT_FILE"`
 	TLSKeyFile      string `flag:"tls-key" cfg:"tls_key_file" env:"OAUTH2_PROXY_TLS_KEY_FILE"`
+	ExtAuthzAddress string `flag:"ext-authz-address" cfg:"ext_authz_address" env:"OAUTH2_PROXY_EXT_AUTHZ_ADDRESS"`
+
+	ClientSecretFile string `flag:"client-secret-file" cfg:"client_secret_file" env:"OAUTH2_PROXY_CLIENT_SECRET_FILE"`
+
+	VaultAddress         string        `flag:"vault-address" cfg:"vault_address" env:"OAUTH2_PROXY_VAULT_ADDRESS"`
+	VaultToken           string        `flag:"vault-token" cfg:"vault_token" env:"OAUTH2_PROXY_VAULT_TOKEN"`
+	VaultKubernetesRole  string        `flag:"vault-kubernetes-role" cfg:"vault_kubernetes_role" env:"OAUTH2_PROXY_VAULT_KUBERNETES_ROLE"`
+	VaultKubernetesMount string        `flag:"vault-kubernetes-mount" cfg:"vault_kubernetes_mount" env:"OAUTH2_PROXY_VAULT_KUBERNETES_MOUNT"`
+	VaultClientSecret    string        `flag:"vault-client-secret" cfg:"vault_client_secret" env:"OAUTH2_PROXY_VAULT_CLIENT_SECRET"`
+	VaultCookieSecret    string        `flag:"vault-cookie-secret" cfg:"vault_cookie_secret" env:"OAUTH2_PROXY_VAULT_COOKIE_SECRET"`
+	VaultPKIRole         string        `flag:"vault-pki-role" cfg:"vault_pki_role" env:"OAUTH2_PROXY_VAULT_PKI_ROLE"`
+	VaultPKICommonName   string        `flag:"vault-pki-common-name" cfg:"vault_pki_common_name" env:"OAUTH2_PROXY_VAULT_PKI_COMMON_NAME"`
+	VaultPKITTL          time.Duration `flag:"vault-pki-ttl" cfg:"vault_pki_ttl" env:"OAUTH2_PROXY_VAULT_PKI_TTL"`
+
+	AWSRegion                 string        `flag:"aws-region" cfg:"aws_region" env:"OAUTH2_PROXY_AWS_REGION"`
+	AWSEndpointURL            string        `flag:"aws-endpoint-url" cfg:"aws_endpoint_url" env:"OAUTH2_PROXY_AWS_ENDPOINT_URL"`
+	AWSClientSecret           string        `flag:"aws-client-secret" cfg:"aws_client_secret" env:"OAUTH2_PROXY_AWS_CLIENT_SECRET"`
+	AWSCookieSecret           string        `flag:"aws-cookie-secret" cfg:"aws_cookie_secret" env:"OAUTH2_PROXY_AWS_COOKIE_SECRET"`
+	AWSSecretsRefreshInterval time.Duration `flag:"aws-secrets-refresh-interval" cfg:"aws_secrets_refresh_interval" env:"OAUTH2_PROXY_AWS_SECRETS_REFRESH_INTERVAL"`
+
+	TLSCertPairs    []string `flag:"tls-cert-pair" cfg:"tls_cert_pairs" env:"OAUTH2_PROXY_TLS_CERT_PAIRS"`
+	TLSCertDir      string   `flag:"tls-cert-dir" cfg:"tls_cert_dir" env:"OAUTH2_PROXY_TLS_CERT_DIR"`
+	TLSMinVersion   string   `flag:"tls-min-version" cfg:"tls_min_version" env:"OAUTH2_PROXY_TLS_MIN_VERSION"`
+	ForceHTTPS      bool     `flag:"force-https" cfg:"force_https" env:"OAUTH2_PROXY_FORCE_HTTPS"`
+	TLSCipherSuites []string `flag:"tls-cipher-suite" cfg:"tls_cipher_suites" env:"OAUTH2_PROXY_TLS_CIPHER_SUITES"`
+	TLSCurves       []string `flag:"tls-curve" cfg:"tls_curves" env:"OAUTH2_PROXY_TLS_CURVES"`
+
+	HTTP2                     bool `flag:"http2" cfg:"http2" env:"OAUTH2_PROXY_HTTP2"`
+	H2C                       bool `flag:"h2c" cfg:"h2c" env:"OAUTH2_PROXY_H2C"`
+	HTTP2MaxConcurrentStreams int  `flag:"http2-max-concurrent-streams" cfg:"http2_max_concurrent_streams" env:"OAUTH2_PROXY_HTTP2_MAX_CONCURRENT_STREAMS"`
+
+	SocketFileMode string        `flag:"socket-file-mode" cfg:"socket_file_mode" env:"OAUTH2_PROXY_SOCKET_FILE_MODE"`
+	HSTSMaxAge     time.Duration `flag:"hsts-max-age" cfg:"hsts_max_age" env:"OAUTH2_PROXY_HSTS_MAX_AGE"`
+
+	ACMEDomains      []string `flag:"acme-domain" cfg:"acme_domains" env:"OAUTH2_PROXY_ACME_DOMAINS"`
+	ACMECacheDir     string   `flag:"acme-cache-dir" cfg:"acme_cache_dir" env:"OAUTH2_PROXY_ACME_CACHE_DIR"`
+	ACMEEmail        string   `flag:"acme-email" cfg:"acme_email" env:"OAUTH2_PROXY_ACME_EMAIL"`
+	ACMEDirectoryURL string   `flag:"acme-directory-url" cfg:"acme_directory_url" env:"OAUTH2_PROXY_ACME_DIRECTORY_URL"`
+
+	DevFakeIdentity string   `flag:"dev-fake-identity" cfg:"dev_fake_identity" env:"OAUTH2_PROXY_DEV_FAKE_IDENTITY"`
+	DevFakeGroups   []string `flag:"dev-fake-group" cfg:"dev_fake_groups" env:"OAUTH2_PROXY_DEV_FAKE_GROUPS"`
+
+	SSOURL            string   `flag:"sso-url" cfg:"sso_url" env:"OAUTH2_PROXY_SSO_URL"`
+	SSOAllowedDomains []string `flag:"sso-allowed-domain" cfg:"sso_allowed_domains" env:"OAUTH2_PROXY_SSO_ALLOWED_DOMAINS"`
+	SSOSecret         string   `flag:"sso-secret" cfg:"sso_secret" env:"OAUTH2_PROXY_SSO_SECRET"`
+	SSOSecretFile     string   `flag:"sso-secret-file" cfg:"sso_secret_file" env:"OAUTH2_PROXY_SSO_SECRET_FILE"`
+
+	HtpasswdFailureDelay time.Duration `flag:"htpasswd-failure-delay" cfg:"htpasswd_failure_delay" env:"OAUTH2_PROXY_HTPASSWD_FAILURE_DELAY"`
+	DeniedUsersFile      string        `flag:"denied-users-file" cfg:"denied_users_file" env:"OAUTH2_PROXY_DENIED_USERS_FILE"`
+
+	AuthenticatedEmailsPoll time.Duration `flag:"authenticated-emails-file-poll-interval" cfg:"authenticated_emails_file_poll_interval" env:"OAUTH2_PROXY_AUTHENTICATED_EMAILS_FILE_POLL_INTERVAL"`
 
 	AuthenticatedEmailsFile  string   `flag:"authenticated-emails-file" cfg:"authenticated_emails_file" env:"OAUTH2_PROXY_AUTHENTICATED_EMAILS_FILE"`
 	AzureTenant              string   `flag:"azure-tenant" cfg:"azure_tenant" env:"OAUTH2_PROXY_AZURE_TENANT"`
 	EmailDomains             []string `flag:"email-domain" cfg:"email_domains" env:"OAUTH2_PROXY_EMAIL_DOMAINS"`
 	WhitelistDomains         []string `flag:"whitelist-domain" cfg:"whitelist_domains" env:"OAUTH2_PROXY_WHITELIST_DOMAINS"`
+	SignOutRedirects         []string `flag:"sign-out-redirect-whitelist" cfg:"sign_out_redirect_whitelist" env:"OAUTH2_PROXY_SIGN_OUT_REDIRECT_WHITELIST"`
+	RedirectWhitelist        []string `flag:"redirect-whitelist" cfg:"redirect_whitelist" env:"OAUTH2_PROXY_REDIRECT_WHITELIST"`
 	GitHubOrg                string   `flag:"github-org" cfg:"github_org" env:"OAUTH2_PROXY_GITHUB_ORG"`
 	GitHubTeam               string   `flag:"github-team" cfg:"github_team" env:"OAUTH2_PROXY_GITHUB_TEAM"`
 	GoogleGroups             []string `flag:"google-group" cfg:"google_group" env:"OAUTH2_PROXY_GOOGLE_GROUPS"`
@@ -50,6 +108,10 @@ type Options struct {
 	GoogleServiceAccountJSON string   `flag:"google-service-account-json" cfg:"google_service_account_json" env:"OAUTH2_PROXY_GOOGLE_SERVICE_ACCOUNT_JSON"`
 	HtpasswdFile             string   `flag:"htpasswd-file" cfg:"htpasswd_file" env:"OAUTH2_PROXY_HTPASSWD_FILE"`
 	DisplayHtpasswdForm      bool     `flag:"display-htpasswd-form" cfg:"display_htpasswd_form" env:"OAUTH2_PROXY_DISPLAY_HTPASSWD_FORM"`
+	HtpasswdTOTPFile         string   `flag:"htpasswd-totp-file" cfg:"htpasswd_totp_file" env:"OAUTH2_PROXY_HTPASSWD_TOTP_FILE"`
+	WebAuthnRPID             string   `flag:"webauthn-rp-id" cfg:"webauthn_rp_id" env:"OAUTH2_PROXY_WEBAUTHN_RP_ID"`
+	WebAuthnOrigin           string   `flag:"webauthn-origin" cfg:"webauthn_origin" env:"OAUTH2_PROXY_WEBAUTHN_ORIGIN"`
+	WebAuthnCredentialsFile  string   `flag:"webauthn-credentials-file" cfg:"webauthn_credentials_file" env:"OAUTH2_PROXY_WEBAUTHN_CREDENTIALS_FILE"`
 	CustomTemplatesDir       string   `flag:"custom-templates-dir" cfg:"custom_templates_dir" env:"OAUTH2_PROXY_CUSTOM_TEMPLATES_DIR"`
 	Footer                   string   `flag:"footer" cfg:"footer" env:"OAUTH2_PROXY_FOOTER"`
 
@@ -60,28 +122,77 @@ type Options struct {
 	options.SessionOptions
 
 	Upstreams             []string      `flag:"upstream" cfg:"upstreams" env:"OAUTH2_PROXY_UPSTREAMS"`
+	UpstreamRegexes       []string      `flag:"upstream-regex" cfg:"upstream_regexes" env:"OAUTH2_PROXY_UPSTREAM_REGEXES"`
 	SkipAuthRegex         []string      `flag:"skip-auth-regex" cfg:"skip_auth_regex" env:"OAUTH2_PROXY_SKIP_AUTH_REGEX"`
+	StepUpRoutes          []string      `flag:"step-up-route" cfg:"step_up_routes" env:"OAUTH2_PROXY_STEP_UP_ROUTES"`
+	APIRoutes             []string      `flag:"api-route" cfg:"api_routes" env:"OAUTH2_PROXY_API_ROUTES"`
+	UnauthenticatedRoutes []string      `flag:"unauthenticated-route" cfg:"unauthenticated_routes" env:"OAUTH2_PROXY_UNAUTHENTICATED_ROUTES"`
+	AuthzPolicyFile       string        `flag:"authz-policy-file" cfg:"authz_policy_file" env:"OAUTH2_PROXY_AUTHZ_POLICY_FILE"`
+	AuthzPolicyDryRun     bool          `flag:"authz-policy-dry-run" cfg:"authz_policy_dry_run" env:"OAUTH2_PROXY_AUTHZ_POLICY_DRY_RUN"`
+	OPAURL                string        `flag:"opa-url" cfg:"opa_url" env:"OAUTH2_PROXY_OPA_URL"`
+	OPATimeout            time.Duration `flag:"opa-timeout" cfg:"opa_timeout" env:"OAUTH2_PROXY_OPA_TIMEOUT"`
+	RateLimit             string        `flag:"rate-limit" cfg:"rate_limit" env:"OAUTH2_PROXY_RATE_LIMIT"`
+	RateLimitRoutes       []string      `flag:"rate-limit-route" cfg:"rate_limit_routes" env:"OAUTH2_PROXY_RATE_LIMIT_ROUTES"`
 	SkipJwtBearerTokens   bool          `flag:"skip-jwt-bearer-tokens" cfg:"skip_jwt_bearer_tokens" env:"OAUTH2_PROXY_SKIP_JWT_BEARER_TOKENS"`
 	ExtraJwtIssuers       []string      `flag:"extra-jwt-issuers" cfg:"extra_jwt_issuers" env:"OAUTH2_PROXY_EXTRA_JWT_ISSUERS"`
 	PassBasicAuth         bool          `flag:"pass-basic-auth" cfg:"pass_basic_auth" env:"OAUTH2_PROXY_PASS_BASIC_AUTH"`
 	BasicAuthPassword     string        `flag:"basic-auth-password" cfg:"basic_auth_password" env:"OAUTH2_PROXY_BASIC_AUTH_PASSWORD"`
 	PassAccessToken       bool          `flag:"pass-access-token" cfg:"pass_access_token" env:"OAUTH2_PROXY_PASS_ACCESS_TOKEN"`
+	AccessTokenHeader     string        `flag:"pass-access-token-header" cfg:"pass_access_token_header" env:"OAUTH2_PROXY_PASS_ACCESS_TOKEN_HEADER"`
+	AccessTokenFormat     string        `flag:"pass-access-token-format" cfg:"pass_access_token_format" env:"OAUTH2_PROXY_PASS_ACCESS_TOKEN_FORMAT"`
 	PassHostHeader        bool          `flag:"pass-host-header" cfg:"pass_host_header" env:"OAUTH2_PROXY_PASS_HOST_HEADER"`
 	SkipProviderButton    bool          `flag:"skip-provider-button" cfg:"skip_provider_button" env:"OAUTH2_PROXY_SKIP_PROVIDER_BUTTON"`
+	PreserveFragment      bool          `flag:"preserve-fragment" cfg:"preserve_fragment" env:"OAUTH2_PROXY_PRESERVE_FRAGMENT"`
 	PassUserHeaders       bool          `flag:"pass-user-headers" cfg:"pass_user_headers" env:"OAUTH2_PROXY_PASS_USER_HEADERS"`
 	SSLInsecureSkipVerify bool          `flag:"ssl-insecure-skip-verify" cfg:"ssl_insecure_skip_verify" env:"OAUTH2_PROXY_SSL_INSECURE_SKIP_VERIFY"`
 	SetXAuthRequest       bool          `flag:"set-xauthrequest" cfg:"set_xauthrequest" env:"OAUTH2_PROXY_SET_XAUTHREQUEST"`
 	SetAuthorization      bool          `flag:"set-authorization-header" cfg:"set_authorization_header" env:"OAUTH2_PROXY_SET_AUTHORIZATION_HEADER"`
 	PassAuthorization     bool          `flag:"pass-authorization-header" cfg:"pass_authorization_header" env:"OAUTH2_PROXY_PASS_AUTHORIZATION_HEADER"`
+	PassIDToken           bool          `flag:"pass-id-token" cfg:"pass_id_token" env:"OAUTH2_PROXY_PASS_ID_TOKEN"`
 	SkipAuthPreflight     bool          `flag:"skip-auth-preflight" cfg:"skip_auth_preflight" env:"OAUTH2_PROXY_SKIP_AUTH_PREFLIGHT"`
 	FlushInterval         time.Duration `flag:"flush-interval" cfg:"flush_interval" env:"OAUTH2_PROXY_FLUSH_INTERVAL"`
+	FlushImmediatelyTypes []string      `flag:"flush-immediately-type" cfg:"flush_immediately_types" env:"OAUTH2_PROXY_FLUSH_IMMEDIATELY_TYPES"`
+	MaxRequestBodySize    int64         `flag:"max-request-body-size" cfg:"max_request_body_size" env:"OAUTH2_PROXY_MAX_REQUEST_BODY_SIZE"`
+	CompressResponses     bool          `flag:"compress-responses" cfg:"compress_responses" env:"OAUTH2_PROXY_COMPRESS_RESPONSES"`
+	CompressTypes         []string      `flag:"compress-type" cfg:"compress_types" env:"OAUTH2_PROXY_COMPRESS_TYPES"`
+	CompressMinSize       int64         `flag:"compress-min-size" cfg:"compress_min_size" env:"OAUTH2_PROXY_COMPRESS_MIN_SIZE"`
+	ShutdownTimeout       time.Duration `flag:"shutdown-timeout" cfg:"shutdown_timeout" env:"OAUTH2_PROXY_SHUTDOWN_TIMEOUT"`
+	WatchConfig           bool          `flag:"watch-config" cfg:"watch_config" env:"OAUTH2_PROXY_WATCH_CONFIG"`
+	HealthCheckInterval   time.Duration `flag:"upstream-health-check-interval" cfg:"upstream_health_check_interval" env:"OAUTH2_PROXY_UPSTREAM_HEALTH_CHECK_INTERVAL"`
+	HealthCheckTimeout    time.Duration `flag:"upstream-health-check-timeout" cfg:"upstream_health_check_timeout" env:"OAUTH2_PROXY_UPSTREAM_HEALTH_CHECK_TIMEOUT"`
+	ResponseHeaders       []string      `flag:"response-header" cfg:"response_headers" env:"OAUTH2_PROXY_RESPONSE_HEADERS"`
+	StripRequestHeaders   []string      `flag:"strip-request-header" cfg:"strip_request_headers" env:"OAUTH2_PROXY_STRIP_REQUEST_HEADERS"`
+	SetRequestHeaders     []string      `flag:"set-request-header" cfg:"set_request_headers" env:"OAUTH2_PROXY_SET_REQUEST_HEADERS"`
+	StripAuthorization    bool          `flag:"strip-authorization-header" cfg:"strip_authorization_header" env:"OAUTH2_PROXY_STRIP_AUTHORIZATION_HEADER"`
+
+	MaintenanceMode          bool     `flag:"maintenance-mode" cfg:"maintenance_mode" env:"OAUTH2_PROXY_MAINTENANCE_MODE"`
+	MaintenancePaths         []string `flag:"maintenance-path" cfg:"maintenance_paths" env:"OAUTH2_PROXY_MAINTENANCE_PATHS"`
+	MaintenanceAllowedEmails []string `flag:"maintenance-allowed-email" cfg:"maintenance_allowed_emails" env:"OAUTH2_PROXY_MAINTENANCE_ALLOWED_EMAILS"`
+	MaintenanceAllowedGroups []string `flag:"maintenance-allowed-group" cfg:"maintenance_allowed_groups" env:"OAUTH2_PROXY_MAINTENANCE_ALLOWED_GROUPS"`
+
+	CORSAllowedOrigins   []string `flag:"cors-allowed-origin" cfg:"cors_allowed_origins" env:"OAUTH2_PROXY_CORS_ALLOWED_ORIGINS"`
+	CORSAllowedHeaders   []string `flag:"cors-allowed-header" cfg:"cors_allowed_headers" env:"OAUTH2_PROXY_CORS_ALLOWED_HEADERS"`
+	CORSAllowCredentials bool     `flag:"cors-allow-credentials" cfg:"cors_allow_credentials" env:"OAUTH2_PROXY_CORS_ALLOW_CREDENTIALS"`
+	CORSAnswerPreflight  bool     `flag:"cors-answer-preflight" cfg:"cors_answer_preflight" env:"OAUTH2_PROXY_CORS_ANSWER_PREFLIGHT"`
+
+	ForwardAuth            bool   `flag:"forward-auth" cfg:"forward_auth" env:"OAUTH2_PROXY_FORWARD_AUTH"`
+	ForwardAuthUserHeader  string `flag:"forward-auth-user-header" cfg:"forward_auth_user_header" env:"OAUTH2_PROXY_FORWARD_AUTH_USER_HEADER"`
+	ForwardAuthEmailHeader string `flag:"forward-auth-email-header" cfg:"forward_auth_email_header" env:"OAUTH2_PROXY_FORWARD_AUTH_EMAIL_HEADER"`
+
+	PassGroupsHeader      string `flag:"pass-groups-header" cfg:"pass_groups_header" env:"OAUTH2_PROXY_PASS_GROUPS_HEADER"`
+	GroupsHeaderDelimiter string `flag:"groups-header-delimiter" cfg:"groups_header_delimiter" env:"OAUTH2_PROXY_GROUPS_HEADER_DELIMITER"`
+	GroupsHeaderMaxSize   int    `flag:"groups-header-max-size" cfg:"groups_header_max_size" env:"OAUTH2_PROXY_GROUPS_HEADER_MAX_SIZE"`
+	RequiredGroups        string `flag:"required-groups" cfg:"required_groups" env:"OAUTH2_PROXY_REQUIRED_GROUPS"`
+
+	KubeProxyPolicies        bool   `flag:"kube-proxy-policies" cfg:"kube_proxy_policies" env:"OAUTH2_PROXY_KUBE_PROXY_POLICIES"`
+	KubeProxyPolicyNamespace string `flag:"kube-proxy-policy-namespace" cfg:"kube_proxy_policy_namespace" env:"OAUTH2_PROXY_KUBE_PROXY_POLICY_NAMESPACE"`
 
 	// These options allow for other providers besides Google, with
 	// potential overrides.
 	Provider          string `flag:"provider" cfg:"provider" env:"OAUTH2_PROXY_PROVIDER"`
 	OIDCIssuerURL     string `flag:"oidc-issuer-url" cfg:"oidc_issuer_url" env:"OAUTH2_PROXY_OIDC_ISSUER_URL"`
-	SkipOIDCDiscovery bool   `flag:"skip-oidc-discovery" cfg:"skip_oidc_discovery" env:"OAUTH2_SKIP_OIDC_DISCOVERY"`
-	OIDCJwksURL       string `flag:"oidc-jwks-url" cfg:"oidc_jwks_url" env:"OAUTH2_OIDC_JWKS_URL"`
+	SkipOIDCDiscovery bool   `flag:"skip-oidc-discovery" cfg:"skip_oidc_discovery" env:"OAUTH2_PROXY_SKIP_OIDC_DISCOVERY"`
+	OIDCJwksURL       string `flag:"oidc-jwks-url" cfg:"oidc_jwks_url" env:"OAUTH2_PROXY_OIDC_JWKS_URL"`
 	LoginURL          string `flag:"login-url" cfg:"login_url" env:"OAUTH2_PROXY_LOGIN_URL"`
 	RedeemURL         string `flag:"redeem-url" cfg:"redeem_url" env:"OAUTH2_PROXY_REDEEM_URL"`
 	ProfileURL        string `flag:"profile-url" cfg:"profile_url" env:"OAUTH2_PROXY_PROFILE_URL"`
@@ -90,19 +201,72 @@ type Options struct {
 	Scope             string `flag:"scope" cfg:"scope" env:"OAUTH2_PROXY_SCOPE"`
 	ApprovalPrompt    string `flag:"approval-prompt" cfg:"approval_prompt" env:"OAUTH2_PROXY_APPROVAL_PROMPT"`
 
+	// Go plugins registering out-of-tree providers
+	ProviderPlugins []string `flag:"provider-plugin" cfg:"provider_plugins" env:"OAUTH2_PROXY_PROVIDER_PLUGINS"`
+
 	// Configuration values for logging
-	LoggingFilename       string `flag:"logging-filename" cfg:"logging_filename" env:"OAUTH2_LOGGING_FILENAME"`
-	LoggingMaxSize        int    `flag:"logging-max-size" cfg:"logging_max_size" env:"OAUTH2_LOGGING_MAX_SIZE"`
-	LoggingMaxAge         int    `flag:"logging-max-age" cfg:"logging_max_age" env:"OAUTH2_LOGGING_MAX_AGE"`
-	LoggingMaxBackups     int    `flag:"logging-max-backups" cfg:"logging_max_backups" env:"OAUTH2_LOGGING_MAX_BACKUPS"`
-	LoggingLocalTime      bool   `flag:"logging-local-time" cfg:"logging_local_time" env:"OAUTH2_LOGGING_LOCAL_TIME"`
-	LoggingCompress       bool   `flag:"logging-compress" cfg:"logging_compress" env:"OAUTH2_LOGGING_COMPRESS"`
-	StandardLogging       bool   `flag:"standard-logging" cfg:"standard_logging" env:"OAUTH2_STANDARD_LOGGING"`
-	StandardLoggingFormat string `flag:"standard-logging-format" cfg:"standard_logging_format" env:"OAUTH2_STANDARD_LOGGING_FORMAT"`
-	RequestLogging        bool   `flag:"request-logging" cfg:"request_logging" env:"OAUTH2_REQUEST_LOGGING"`
-	RequestLoggingFormat  string `flag:"request-logging-format" cfg:"request_logging_format" env:"OAUTH2_REQUEST_LOGGING_FORMAT"`
-	AuthLogging           bool   `flag:"auth-logging" cfg:"auth_logging" env:"OAUTH2_LOGGING_AUTH_LOGGING"`
-	AuthLoggingFormat     string `flag:"auth-logging-format" cfg:"auth_logging_format" env:"OAUTH2_AUTH_LOGGING_FORMAT"`
+	LoggingFilename       string `flag:"logging-filename" cfg:"logging_filename" env:"OAUTH2_PROXY_LOGGING_FILENAME"`
+	LoggingMaxSize        int    `flag:"logging-max-size" cfg:"logging_max_size" env:"OAUTH2_PROXY_LOGGING_MAX_SIZE"`
+	LoggingMaxAge         int    `flag:"logging-max-age" cfg:"logging_max_age" env:"OAUTH2_PROXY_LOGGING_MAX_AGE"`
+	LoggingMaxBackups     int    `flag:"logging-max-backups" cfg:"logging_max_backups" env:"OAUTH2_PROXY_LOGGING_MAX_BACKUPS"`
+	LoggingLocalTime      bool   `flag:"logging-local-time" cfg:"logging_local_time" env:"OAUTH2_PROXY_LOGGING_LOCAL_TIME"`
+	LoggingCompress       bool   `flag:"logging-compress" cfg:"logging_compress" env:"OAUTH2_PROXY_LOGGING_COMPRESS"`
+	StandardLogging       bool   `flag:"standard-logging" cfg:"standard_logging" env:"OAUTH2_PROXY_STANDARD_LOGGING"`
+	StandardLoggingFormat string `flag:"standard-logging-format" cfg:"standard_logging_format" env:"OAUTH2_PROXY_STANDARD_LOGGING_FORMAT"`
+	RequestLogging        bool   `flag:"request-logging" cfg:"request_logging" env:"OAUTH2_PROXY_REQUEST_LOGGING"`
+	RequestLoggingFormat  string `flag:"request-logging-format" cfg:"request_logging_format" env:"OAUTH2_PROXY_REQUEST_LOGGING_FORMAT"`
+	AuthLogging           bool   `flag:"auth-logging" cfg:"auth_logging" env:"OAUTH2_PROXY_AUTH_LOGGING"`
+	AuthLoggingFormat     string `flag:"auth-logging-format" cfg:"auth_logging_format" env:"OAUTH2_PROXY_AUTH_LOGGING_FORMAT"`
+
+	LoggingRotateInterval time.Duration `flag:"logging-rotate-interval" cfg:"logging_rotate_interval" env:"OAUTH2_PROXY_LOGGING_ROTATE_INTERVAL"`
+
+	// Requests left out of the request log, e.g. health checks
+	LoggingExcludePaths  []string `flag:"logging-exclude-path" cfg:"logging_exclude_paths" env:"OAUTH2_PROXY_LOGGING_EXCLUDE_PATHS"`
+	LoggingExcludeStatus []string `flag:"logging-exclude-status" cfg:"logging_exclude_status" env:"OAUTH2_PROXY_LOGGING_EXCLUDE_STATUS"`
+
+	LoggingRedactPII string `flag:"logging-redact-pii" cfg:"logging_redact_pii" env:"OAUTH2_PROXY_LOGGING_REDACT_PII"`
+
+	// Sampling of the successful requests logged under load
+	RequestLoggingSampleRatio float64 `flag:"request-logging-sample-ratio" cfg:"request_logging_sample_ratio" env:"OAUTH2_PROXY_REQUEST_LOGGING_SAMPLE_RATIO"`
+	RequestLoggingSampleLimit int     `flag:"request-logging-sample-limit" cfg:"request_logging_sample_limit" env:"OAUTH2_PROXY_REQUEST_LOGGING_SAMPLE_LIMIT"`
+
+	// Destinations of each type of logging, overriding LoggingFilename
+	StandardLoggingFilename string `flag:"standard-logging-filename" cfg:"standard_logging_filename" env:"OAUTH2_PROXY_STANDARD_LOGGING_FILENAME"`
+	RequestLoggingFilename  string `flag:"request-logging-filename" cfg:"request_logging_filename" env:"OAUTH2_PROXY_REQUEST_LOGGING_FILENAME"`
+	AuthLoggingFilename     string `flag:"auth-logging-filename" cfg:"auth_logging_filename" env:"OAUTH2_PROXY_AUTH_LOGGING_FILENAME"`
+
+	// Syslog server of the "syslog" logging destination
+	SyslogAddress  string `flag:"syslog-address" cfg:"syslog_address" env:"OAUTH2_PROXY_SYSLOG_ADDRESS"`
+	SyslogFacility string `flag:"syslog-facility" cfg:"syslog_facility" env:"OAUTH2_PROXY_SYSLOG_FACILITY"`
+	SyslogTag      string `flag:"syslog-tag" cfg:"syslog_tag" env:"OAUTH2_PROXY_SYSLOG_TAG"`
+	SyslogCAFile   string `flag:"syslog-ca-file" cfg:"syslog_ca_file" env:"OAUTH2_PROXY_SYSLOG_CA_FILE"`
+
+	TracingOTLPEndpoint string  `flag:"tracing-otlp-endpoint" cfg:"tracing_otlp_endpoint" env:"OAUTH2_PROXY_TRACING_OTLP_ENDPOINT"`
+	TracingServiceName  string  `flag:"tracing-service-name" cfg:"tracing_service_name" env:"OAUTH2_PROXY_TRACING_SERVICE_NAME"`
+	TracingSampleRatio  float64 `flag:"tracing-sample-ratio" cfg:"tracing_sample_ratio" env:"OAUTH2_PROXY_TRACING_SAMPLE_RATIO"`
+
+	TraceHeaders []string `flag:"trace-header" cfg:"trace_headers" env:"OAUTH2_PROXY_TRACE_HEADERS"`
+
+	AuditLogFilename  string `flag:"audit-log-filename" cfg:"audit_log_filename" env:"OAUTH2_PROXY_AUDIT_LOG_FILENAME"`
+	AuditWebhookURL   string `flag:"audit-webhook-url" cfg:"audit_webhook_url" env:"OAUTH2_PROXY_AUDIT_WEBHOOK_URL"`
+	AuditKafkaRESTURL string `flag:"audit-kafka-rest-url" cfg:"audit_kafka_rest_url" env:"OAUTH2_PROXY_AUDIT_KAFKA_REST_URL"`
+
+	Metrics        bool   `flag:"metrics" cfg:"metrics" env:"OAUTH2_PROXY_METRICS"`
+	MetricsAddress string `flag:"metrics-address" cfg:"metrics_address" env:"OAUTH2_PROXY_METRICS_ADDRESS"`
+
+	SentryDSN         string `flag:"sentry-dsn" cfg:"sentry_dsn" env:"OAUTH2_PROXY_SENTRY_DSN"`
+	SentryEnvironment string `flag:"sentry-environment" cfg:"sentry_environment" env:"OAUTH2_PROXY_SENTRY_ENVIRONMENT"`
+	ErrorWebhookURL   string `flag:"error-webhook-url" cfg:"error_webhook_url" env:"OAUTH2_PROXY_ERROR_WEBHOOK_URL"`
+
+	FailureWebhookURL       string        `flag:"failure-webhook-url" cfg:"failure_webhook_url" env:"OAUTH2_PROXY_FAILURE_WEBHOOK_URL"`
+	FailureWebhookThreshold int           `flag:"failure-webhook-threshold" cfg:"failure_webhook_threshold" env:"OAUTH2_PROXY_FAILURE_WEBHOOK_THRESHOLD"`
+	FailureWebhookWindow    time.Duration `flag:"failure-webhook-window" cfg:"failure_webhook_window" env:"OAUTH2_PROXY_FAILURE_WEBHOOK_WINDOW"`
+
+	DebugAddress      string `flag:"debug-address" cfg:"debug_address" env:"OAUTH2_PROXY_DEBUG_ADDRESS"`
+	DebugHtpasswdFile string `flag:"debug-htpasswd-file" cfg:"debug_htpasswd_file" env:"OAUTH2_PROXY_DEBUG_HTPASSWD_FILE"`
+
+	TrustedRealIPCIDRs []string `flag:"trusted-real-ip-cidr" cfg:"trusted_real_ip_cidrs" env:"OAUTH2_PROXY_TRUSTED_REAL_IP_CIDRS"`
+	TrustedIPs         []string `flag:"trusted-ip" cfg:"trusted_ips" env:"OAUTH2_PROXY_TRUSTED_IPS"`
 
 	SignatureKey    string `flag:"signature-key" cfg:"signature_key" env:"OAUTH2_PROXY_SIGNATURE_KEY"`
 	AcrValues       string `flag:"acr-values" cfg:"acr_values" env:"OAUTH2_PROXY_ACR_VALUES"`
@@ -111,13 +275,57 @@ type Options struct {
 	PubJWKURL       string `flag:"pubjwk-url" cfg:"pubjwk_url" env:"OAUTH2_PROXY_PUBJWK_URL"`
 	GCPHealthChecks bool   `flag:"gcp-healthchecks" cfg:"gcp_healthchecks" env:"OAUTH2_PROXY_GCP_HEALTHCHECKS"`
 
+	UpstreamJWTKeyFile string        `flag:"upstream-jwt-key-file" cfg:"upstream_jwt_key_file" env:"OAUTH2_PROXY_UPSTREAM_JWT_KEY_FILE"`
+	UpstreamJWTHeader  string        `flag:"upstream-jwt-header" cfg:"upstream_jwt_header" env:"OAUTH2_PROXY_UPSTREAM_JWT_HEADER"`
+	UpstreamJWTIssuer  string        `flag:"upstream-jwt-issuer" cfg:"upstream_jwt_issuer" env:"OAUTH2_PROXY_UPSTREAM_JWT_ISSUER"`
+	UpstreamJWTTTL     time.Duration `flag:"upstream-jwt-ttl" cfg:"upstream_jwt_ttl" env:"OAUTH2_PROXY_UPSTREAM_JWT_TTL"`
+
+	TokenExchangeURL string `flag:"token-exchange-url" cfg:"token_exchange_url" env:"OAUTH2_PROXY_TOKEN_EXCHANGE_URL"`
+
+	// UpstreamHandler serves the authenticated requests instead of the
+	// upstreams when the proxy is embedded in a Go service with NewHandler
+	UpstreamHandler http.Handler
+	// OnSecretRotation is called when an AWS Secrets Manager secret was
+	// rotated while the proxy is embedded with NewHandler
+	OnSecretRotation func()
+
 	// internal values that are set after config validation
 	redirectURL        *url.URL
 	proxyURLs          []*url.URL
-	CompiledRegex      []*regexp.Regexp
+	regexUpstreams     []regexUpstream
+	skipAuthRules      []skipAuthRule
+	maintenancePaths   []*regexp.Regexp
+	apiRoutes          []*regexp.Regexp
+	stepUpRoutes       []stepUpRoute
+	unauthRoutes       []unauthenticatedRoute
+	devFakeSession     *sessionsapi.SessionState
+	ssoURL             *url.URL
+	authzPolicy        *authzPolicy
+	kubePolicies       *kubePolicies
+	opa                *opaClient
+	trustedIPs         *trustedNetworks
+	rateLimits         *rateLimiter
+	requiredGroups     *groupExpr
+	tracer             *tracing.Tracer
+	traceHeaders       traceHeaderPolicy
+	auditLog           *auditLog
+	errorReporter      *errorReporter
+	failureAlerts      *failureAlerter
+	vaultCertificate   *vault.Certificate
+	awsSecrets         *awsSecrets
+	debugHandler       http.Handler
+	responseHeaders    http.Header
+	requestHeaders     http.Header
+	socketFileMode     os.FileMode
+	tlsMinVersion      uint16
+	tlsCipherSuites    []uint16
+	tlsCurves          []tls.CurveID
 	provider           providers.Provider
 	sessionStore       sessionsapi.SessionStore
 	signatureData      *SignatureData
+	upstreamJWT        *upstreamJWTSigner
+	tokenExchangeURL   *url.URL
+	webAuthn           *webAuthnConfig
 	oidcVerifier       *oidc.IDTokenVerifier
 	jwtBearerVerifiers []*oidc.IDTokenVerifier
 }
@@ -145,15 +353,22 @@ func NewOptions() *Options {
 		},
 		SessionOptions: options.SessionOptions{
 			Type: "cookie",
+			RedisStoreOptions: options.RedisStoreOptions{
+				LeaderLease: 15 * time.Second,
+			},
 		},
 		SetXAuthRequest:       false,
 		SkipAuthPreflight:     false,
 		PassBasicAuth:         true,
 		PassUserHeaders:       true,
 		PassAccessToken:       false,
+		AccessTokenHeader:     "X-Forwarded-Access-Token",
+		AccessTokenFormat:     "raw",
 		PassHostHeader:        true,
 		SetAuthorization:      false,
 		PassAuthorization:     false,
+		PassIDToken:           false,
+		Provider:              "google",
 		ApprovalPrompt:        "force",
 		SkipOIDCDiscovery:     false,
 		LoggingFilename:       "",
@@ -168,6 +383,33 @@ func NewOptions() *Options {
 		RequestLoggingFormat:  logger.DefaultRequestLoggingFormat,
 		AuthLogging:           true,
 		AuthLoggingFormat:     logger.DefaultAuthLoggingFormat,
+		SyslogFacility:        "daemon",
+		SyslogTag:             "oauth2_proxy",
+		TracingServiceName:    "oauth2_proxy",
+		TracingSampleRatio:    1,
+
+		ForwardAuthUserHeader:  "X-Forwarded-User",
+		ForwardAuthEmailHeader: "X-Forwarded-Email",
+
+		GroupsHeaderDelimiter: ",",
+		GroupsHeaderMaxSize:   4096,
+
+		HTTP2MaxConcurrentStreams: 250,
+		RequestLoggingSampleRatio: 1,
+		TLSMinVersion:             "TLS1.2",
+		CompressMinSize:           1024,
+		ShutdownTimeout:           time.Duration(30) * time.Second,
+		HealthCheckInterval:       time.Duration(10) * time.Second,
+		HealthCheckTimeout:        time.Duration(2) * time.Second,
+		UpstreamJWTHeader:         "X-Forwarded-Jwt",
+		UpstreamJWTIssuer:         "oauth2_proxy",
+		UpstreamJWTTTL:            time.Duration(1) * time.Minute,
+		OPATimeout:                defaultOPATimeout,
+		HtpasswdFailureDelay:      time.Duration(1) * time.Second,
+		FailureWebhookThreshold:   10,
+		FailureWebhookWindow:      time.Duration(5) * time.Minute,
+		VaultKubernetesMount:      "kubernetes",
+		AWSSecretsRefreshInterval: time.Duration(1) * time.Hour,
 	}
 }
 
@@ -198,20 +440,30 @@ func (o *Options) Validate() error {
 	}
 
 	msgs := make([]string, 0)
+	msgs = parseSecretFiles(o, msgs)
+	o.vaultCertificate, msgs = parseVault(o, msgs)
+	o.awsSecrets, msgs = parseAWSSecrets(o, msgs)
 	if o.CookieSecret == "" {
 		msgs = append(msgs, "missing setting: cookie-secret")
 	}
-	if o.ClientID == "" {
+	// the provider is not used with a fake identity, or when the central
+	// proxy of sso-url signs users in
+	if o.ClientID == "" && o.DevFakeIdentity == "" && o.SSOURL == "" {
 		msgs = append(msgs, "missing setting: client-id")
 	}
 	// login.gov uses a signed JWT to authenticate, not a client-secret
-	if o.ClientSecret == "" && o.Provider != "login.gov" {
+	if o.ClientSecret == "" && o.Provider != "login.gov" && o.DevFakeIdentity == "" && o.SSOURL == "" {
 		msgs = append(msgs, "missing setting: client-secret")
 	}
-	if o.AuthenticatedEmailsFile == "" && len(o.EmailDomains) == 0 && o.HtpasswdFile == "" {
+	if o.AuthenticatedEmailsFile == "" && len(o.EmailDomains) == 0 && o.HtpasswdFile == "" && o.DevFakeIdentity == "" {
 		msgs = append(msgs, "missing setting for email validation: email-domain or authenticated-emails-file required."+
 			"\n      use email-domain=* to authorize all email addresses")
 	}
+	for _, allowed := range o.RedirectWhitelist {
+		if allowed == "" || strings.Contains(allowed, "://") {
+			msgs = append(msgs, fmt.Sprintf("invalid redirect-whitelist entry %q: expected a /path prefix, a domain or a domain/path prefix", allowed))
+		}
+	}
 
 	if o.OIDCIssuerURL != "" {
 
@@ -282,22 +534,75 @@ func (o *Options) Validate() error {
 			if upstreamURL.Path == "" {
 				upstreamURL.Path = "/"
 			}
+			if upstreamURL.Scheme != "file" {
+				if _, err := parseUpstreamOptions(upstreamURL); err != nil {
+					msgs = append(msgs, fmt.Sprintf("error parsing upstream %q: %s", u, err))
+				}
+			}
 			o.proxyURLs = append(o.proxyURLs, upstreamURL)
 		}
 	}
 
+	o.regexUpstreams, msgs = parseRegexUpstreams(o.UpstreamRegexes, msgs)
+	if o.UpstreamHandler != nil && (len(o.Upstreams) > 0 || len(o.UpstreamRegexes) > 0) {
+		msgs = append(msgs, "upstreams cannot be combined with an upstream handler")
+	}
+
 	for _, u := range o.SkipAuthRegex {
-		CompiledRegex, err := regexp.Compile(u)
+		methods, pattern := splitSkipAuthMethods(u)
+		compiledRegex, err := regexp.Compile(pattern)
 		if err != nil {
 			msgs = append(msgs, fmt.Sprintf("error compiling regex=%q %s", u, err))
 			continue
 		}
-		o.CompiledRegex = append(o.CompiledRegex, CompiledRegex)
+		o.skipAuthRules = append(o.skipAuthRules, skipAuthRule{methods: methods, pattern: compiledRegex})
 	}
+	o.maintenancePaths = nil
+	for _, p := range o.MaintenancePaths {
+		r, err := regexp.Compile(p)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("error compiling maintenance-path=%q %s", p, err))
+			continue
+		}
+		o.maintenancePaths = append(o.maintenancePaths, r)
+	}
+	for _, origin := range o.CORSAllowedOrigins {
+		if origin == "*" && o.CORSAllowCredentials {
+			msgs = append(msgs, "cors-allowed-origin=* cannot be combined with cors-allow-credentials")
+		}
+	}
+	o.apiRoutes = nil
+	for _, p := range o.APIRoutes {
+		r, err := regexp.Compile(p)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("error compiling api-route=%q %s", p, err))
+			continue
+		}
+		o.apiRoutes = append(o.apiRoutes, r)
+	}
+	o.stepUpRoutes, msgs = parseStepUpRoutes(o.StepUpRoutes, msgs)
+	o.unauthRoutes, msgs = parseUnauthenticatedRoutes(o.UnauthenticatedRoutes, msgs)
+	o.devFakeSession, msgs = parseDevFakeIdentity(o, msgs)
+	msgs = parseSSO(o, msgs)
+	o.authzPolicy, msgs = parseAuthzPolicy(o, msgs)
+	o.kubePolicies, msgs = parseKubePolicies(o, msgs)
+	o.opa, msgs = parseOPA(o, msgs)
+	o.trustedIPs, msgs = parseTrustedIPs(o, msgs)
+	o.rateLimits, msgs = parseRateLimits(o, msgs)
+	o.requiredGroups, msgs = parseRequiredGroups(o, msgs)
+	o.tracer, msgs = parseTracing(o, msgs)
+	o.traceHeaders, msgs = parseTraceHeaders(o, msgs)
+	o.auditLog, msgs = parseAuditLog(o, msgs)
+	o.errorReporter, msgs = parseErrorReporting(o, msgs)
+	o.failureAlerts, msgs = parseFailureAlerts(o, msgs)
+	o.debugHandler, msgs = parseDebug(o, msgs)
+	msgs = loadProviderPlugins(o, msgs)
 	msgs = parseProviderInfo(o, msgs)
+	o.responseHeaders, msgs = parseHeaders(o.ResponseHeaders, "response-header", msgs)
+	o.requestHeaders, msgs = parseHeaders(o.SetRequestHeaders, "set-request-header", msgs)
 
 	var cipher *cookie.Cipher
-	if o.PassAccessToken || o.SetAuthorization || o.PassAuthorization || (o.CookieRefresh != time.Duration(0)) {
+	if o.PassAccessToken || o.SetAuthorization || o.PassAuthorization || o.PassIDToken || (o.CookieRefresh != time.Duration(0)) {
 		validCookieSecretSize := false
 		for _, i := range []int{16, 24, 32} {
 			if len(secretBytes(o.CookieSecret)) == i {
@@ -335,6 +640,7 @@ func (o *Options) Validate() error {
 	} else {
 		o.sessionStore = sessionStore
 	}
+	o.webAuthn, msgs = parseWebAuthn(o, msgs)
 
 	if o.CookieRefresh >= o.CookieExpire {
 		msgs = append(msgs, fmt.Sprintf(
@@ -356,6 +662,52 @@ func (o *Options) Validate() error {
 		}
 	}
 
+	switch o.AccessTokenFormat {
+	case "raw", "bearer":
+	default:
+		msgs = append(msgs, fmt.Sprintf("invalid pass-access-token-format %q: must be raw or bearer", o.AccessTokenFormat))
+	}
+	if o.AccessTokenHeader == "" {
+		msgs = append(msgs, "missing setting: pass-access-token-header")
+	}
+
+	if len(o.ACMEDomains) > 0 {
+		if o.ACMECacheDir == "" {
+			msgs = append(msgs, "missing setting: acme-cache-dir is required when acme-domain is set")
+		}
+		if o.tlsEnabled() {
+			msgs = append(msgs, "acme-domain cannot be combined with tls-cert and tls-key")
+		}
+	}
+
+	if o.SocketFileMode != "" {
+		mode, err := strconv.ParseUint(o.SocketFileMode, 8, 32)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("invalid socket-file-mode %q: must be an octal file mode", o.SocketFileMode))
+		}
+		o.socketFileMode = os.FileMode(mode)
+	}
+
+	if o.HTTP2MaxConcurrentStreams < 1 {
+		msgs = append(msgs, "http2-max-concurrent-streams must be greater than 0")
+	}
+
+	if o.HealthCheckInterval <= 0 {
+		msgs = append(msgs, "upstream-health-check-interval must be greater than 0")
+	}
+	if o.HealthCheckTimeout <= 0 {
+		msgs = append(msgs, "upstream-health-check-timeout must be greater than 0")
+	}
+
+	o.upstreamJWT, msgs = parseUpstreamJWT(o, msgs)
+	o.tokenExchangeURL, msgs = parseURL(o.TokenExchangeURL, "token-exchange", msgs)
+
+	for _, pair := range o.TLSCertPairs {
+		if len(strings.Split(pair, ":")) != 2 {
+			msgs = append(msgs, fmt.Sprintf("invalid tls-cert-pair %q: must be of the form certfile:keyfile", pair))
+		}
+	}
+	msgs = parseTLSOptions(o, msgs)
 	msgs = parseSignatureKey(o, msgs)
 	msgs = validateCookieName(o, msgs)
 	msgs = setupLogger(o, msgs)
@@ -386,6 +738,9 @@ func parseProviderInfo(o *Options, msgs []string) []string {
 		p.Configure(o.AzureTenant)
 	case *providers.GitHubProvider:
 		p.SetOrgTeam(o.GitHubOrg, o.GitHubTeam)
+		if o.RequiredGroups != "" || o.PassGroupsHeader != "" {
+			p.SetLoadGroups()
+		}
 	case *providers.GoogleProvider:
 		if o.GoogleServiceAccountJSON != "" {
 			file, err := os.Open(o.GoogleServiceAccountJSON)
@@ -436,23 +791,127 @@ func parseProviderInfo(o *Options, msgs []string) []string {
 	return msgs
 }
 
+// parseSecretFiles reads the client and cookie secrets from their files, if
+// given, without a trailing newline
+func parseSecretFiles(o *Options, msgs []string) []string {
+	for _, secret := range []struct {
+		name  string
+		value *string
+		file  string
+	}{
+		{"client-secret", &o.ClientSecret, o.ClientSecretFile},
+		{"cookie-secret", &o.CookieSecret, o.CookieSecretFile},
+		{"sso-secret", &o.SSOSecret, o.SSOSecretFile},
+	} {
+		if secret.file == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(secret.file)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("unable to read %s-file: %s", secret.name, err))
+			continue
+		}
+		value := strings.TrimRight(string(data), "\r\n")
+		if *secret.value != "" && *secret.value != value {
+			msgs = append(msgs, fmt.Sprintf("only one of %s and %s-file may be set", secret.name, secret.name))
+			continue
+		}
+		*secret.value = value
+	}
+	return msgs
+}
+
+// parseHeaders parses a list of "Name: value" header specs given for the
+// named option into an http.Header
+func parseHeaders(specs []string, option string, msgs []string) (http.Header, []string) {
+	headers := make(http.Header)
+	for _, h := range specs {
+		components := strings.SplitN(h, ":", 2)
+		if len(components) != 2 || strings.TrimSpace(components[0]) == "" {
+			msgs = append(msgs, fmt.Sprintf("invalid %s %q: must be of the form \"Name: value\"", option, h))
+			continue
+		}
+		headers.Add(strings.TrimSpace(components[0]), strings.TrimSpace(components[1]))
+	}
+	return headers, msgs
+}
+
+// tlsEnabled returns whether any certificate for the HTTPS listener is
+// configured
+func (o *Options) tlsEnabled() bool {
+	return o.TLSCertFile != "" || o.TLSKeyFile != "" || len(o.TLSCertPairs) > 0 || o.TLSCertDir != ""
+}
+
+var tlsVersions = map[string]uint16{
+	"TLS1.0": tls.VersionTLS10,
+	"TLS1.1": tls.VersionTLS11,
+	"TLS1.2": tls.VersionTLS12,
+	"TLS1.3": tls.VersionTLS13,
+}
+
+var tlsCipherSuites = map[string]uint16{
+	"TLS_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305":    tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305":  tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+	"X25519": tls.X25519,
+}
+
+// parseTLSOptions converts the names of the TLS version, cipher suites and
+// curves for the HTTPS listener into their crypto/tls identifiers
+func parseTLSOptions(o *Options, msgs []string) []string {
+	version, ok := tlsVersions[o.TLSMinVersion]
+	if !ok {
+		msgs = append(msgs, fmt.Sprintf("invalid tls-min-version %q: must be one of TLS1.0, TLS1.1, TLS1.2 or TLS1.3", o.TLSMinVersion))
+	}
+	o.tlsMinVersion = version
+
+	o.tlsCipherSuites = nil
+	for _, name := range o.TLSCipherSuites {
+		suite, ok := tlsCipherSuites[name]
+		if !ok {
+			msgs = append(msgs, fmt.Sprintf("unsupported tls-cipher-suite %q", name))
+			continue
+		}
+		o.tlsCipherSuites = append(o.tlsCipherSuites, suite)
+	}
+
+	o.tlsCurves = nil
+	for _, name := range o.TLSCurves {
+		curve, ok := tlsCurves[name]
+		if !ok {
+			msgs = append(msgs, fmt.Sprintf("unsupported tls-curve %q: must be one of P256, P384, P521 or X25519", name))
+			continue
+		}
+		o.tlsCurves = append(o.tlsCurves, curve)
+	}
+	return msgs
+}
+
 func parseSignatureKey(o *Options, msgs []string) []string {
 	if o.SignatureKey == "" {
 		return msgs
 	}
 
-	components := strings.Split(o.SignatureKey, ":")
-	if len(components) != 2 {
-		return append(msgs, "invalid signature hash:key spec: "+
-			o.SignatureKey)
-	}
-
-	algorithm, secretKey := components[0], components[1]
-	var hash crypto.Hash
-	var err error
-	if hash, err = hmacauth.DigestNameToCryptoHash(algorithm); err != nil {
-		return append(msgs, "unsupported signature hash algorithm: "+
-			o.SignatureKey)
+	hash, secretKey, err := signature.ParseKey(o.SignatureKey)
+	if err != nil {
+		return append(msgs, err.Error())
 	}
 	o.signatureData = &SignatureData{hash, secretKey}
 	return msgs
@@ -528,30 +987,100 @@ func secretBytes(secret string) []byte {
 	return []byte(secret)
 }
 
+// logWriter returns the destination of logs for a filename, which is either
+// "stdout", "stderr", "syslog" or a file rotated as configured by the logging
+// options
+func logWriter(o *Options, filename string) (io.Writer, error) {
+	switch filename {
+	case "stdout":
+		return os.Stdout, nil
+	case "stderr":
+		return os.Stderr, nil
+	case syslogDestination:
+		return newSyslogWriter(o)
+	}
+
+	// Validate that the file/dir can be written
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		if os.IsPermission(err) {
+			return nil, fmt.Errorf("unable to write to log file: %s", filename)
+		}
+	}
+	file.Close()
+
+	w := &lumberjack.Logger{
+		Filename:   filename,
+		MaxSize:    o.LoggingMaxSize, // megabytes
+		MaxAge:     o.LoggingMaxAge,  // days
+		MaxBackups: o.LoggingMaxBackups,
+		LocalTime:  o.LoggingLocalTime,
+		Compress:   o.LoggingCompress,
+	}
+	if o.LoggingRotateInterval > 0 {
+		return &intervalRotator{Logger: w, interval: o.LoggingRotateInterval}, nil
+	}
+	return w, nil
+}
+
+// splitList splits the comma separated lists of the values of an option
+func splitList(values []string) []string {
+	var list []string
+	for _, value := range values {
+		for _, s := range strings.Split(value, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				list = append(list, s)
+			}
+		}
+	}
+	return list
+}
+
 func setupLogger(o *Options, msgs []string) []string {
+	if o.LoggingRotateInterval < 0 {
+		return append(msgs, "logging-rotate-interval must not be negative")
+	}
+
+	// writers holds the destination of each log file, so that logs sharing a
+	// file are rotated together
+	writers := map[string]io.Writer{}
+
 	// Setup the log file
 	if len(o.LoggingFilename) > 0 {
-		// Validate that the file/dir can be written
-		file, err := os.OpenFile(o.LoggingFilename, os.O_WRONLY|os.O_CREATE, 0666)
+		w, err := logWriter(o, o.LoggingFilename)
 		if err != nil {
-			if os.IsPermission(err) {
-				return append(msgs, "unable to write to log file: "+o.LoggingFilename)
-			}
+			return append(msgs, err.Error())
 		}
-		file.Close()
 
 		logger.Printf("Redirecting logging to file: %s", o.LoggingFilename)
 
-		logWriter := &lumberjack.Logger{
-			Filename:   o.LoggingFilename,
-			MaxSize:    o.LoggingMaxSize, // megabytes
-			MaxAge:     o.LoggingMaxAge,  // days
-			MaxBackups: o.LoggingMaxBackups,
-			LocalTime:  o.LoggingLocalTime,
-			Compress:   o.LoggingCompress,
-		}
+		logger.SetOutput(w)
+		writers[o.LoggingFilename] = w
+	}
 
-		logger.SetOutput(logWriter)
+	// Setup the destinations of the types of logging
+	for _, dest := range []struct {
+		filename  string
+		setOutput func(io.Writer)
+	}{
+		{o.StandardLoggingFilename, logger.SetStandardOutput},
+		{o.RequestLoggingFilename, logger.SetReqOutput},
+		{o.AuthLoggingFilename, logger.SetAuthOutput},
+	} {
+		if dest.filename == "" {
+			dest.setOutput(nil)
+			continue
+		}
+		w, ok := writers[dest.filename]
+		if !ok {
+			var err error
+			if w, err = logWriter(o, dest.filename); err != nil {
+				msgs = append(msgs, err.Error())
+				continue
+			}
+			writers[dest.filename] = w
+		}
+		dest.setOutput(w)
 	}
 
 	// Supply a sanity warning to the logger if all logging is disabled
@@ -563,9 +1092,40 @@ func setupLogger(o *Options, msgs []string) []string {
 	logger.SetStandardEnabled(o.StandardLogging)
 	logger.SetAuthEnabled(o.AuthLogging)
 	logger.SetReqEnabled(o.RequestLogging)
-	logger.SetStandardTemplate(o.StandardLoggingFormat)
-	logger.SetAuthTemplate(o.AuthLoggingFormat)
-	logger.SetReqTemplate(o.RequestLoggingFormat)
+	if err := logger.SetStandardTemplate(o.StandardLoggingFormat); err != nil {
+		msgs = append(msgs, fmt.Sprintf("invalid standard-logging-format: %s", err))
+	}
+	if err := logger.SetAuthTemplate(o.AuthLoggingFormat); err != nil {
+		msgs = append(msgs, fmt.Sprintf("invalid auth-logging-format: %s", err))
+	}
+	if err := logger.SetReqTemplate(o.RequestLoggingFormat); err != nil {
+		msgs = append(msgs, fmt.Sprintf("invalid request-logging-format: %s", err))
+	}
+	logger.SetReqExcludePaths(splitList(o.LoggingExcludePaths))
+	if err := logger.SetReqExcludeStatus(splitList(o.LoggingExcludeStatus)); err != nil {
+		msgs = append(msgs, fmt.Sprintf("invalid logging-exclude-status: %s", err))
+	}
+	if err := logger.SetReqSampling(o.RequestLoggingSampleRatio, o.RequestLoggingSampleLimit); err != nil {
+		msgs = append(msgs, fmt.Sprintf("invalid request logging sampling: %s", err))
+	}
+	// the cookie secret keys the hashes, so that they are the same on every
+	// replica but cannot be computed for known emails
+	if err := logger.SetRedaction(o.LoggingRedactPII, []byte(o.CookieSecret)); err != nil {
+		msgs = append(msgs, fmt.Sprintf("invalid logging-redact-pii: %s", err))
+	}
+
+	if len(o.TrustedRealIPCIDRs) > 0 {
+		var trusted []*net.IPNet
+		for _, cidr := range o.TrustedRealIPCIDRs {
+			_, ipNet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				msgs = append(msgs, fmt.Sprintf("invalid trusted-real-ip-cidr %q: %s", cidr, err))
+				continue
+			}
+			trusted = append(trusted, ipNet)
+		}
+		logger.SetTrustedProxies(trusted)
+	}
 
 	if !o.LoggingLocalTime {
 		logger.SetFlags(logger.Flags() | logger.LUTC)
@@ -1,13 +1,19 @@
-package main
+package oauthproxy
 
 import (
 	"crypto"
+	"crypto/tls"
 	"fmt"
+	"io/ioutil"
+	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/OpusCapita/oauth2_proxy/logger"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -28,6 +34,28 @@ func errorMsg(msgs []string) string {
 	return strings.Join(result, "\n  ")
 }
 
+func TestSecretFiles(t *testing.T) {
+	f, err := ioutil.TempFile("", "client-secret")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString("s3cr3t\n")
+	f.Close()
+
+	o := testOptions()
+	o.ClientSecret = ""
+	o.ClientSecretFile = f.Name()
+	assert.Empty(t, parseSecretFiles(o, nil))
+	assert.Equal(t, "s3cr3t", o.ClientSecret)
+
+	o = testOptions()
+	o.ClientSecretFile = f.Name()
+	o.CookieSecretFile = "/nonexistent/cookie-secret"
+	msgs := parseSecretFiles(o, nil)
+	assert.Len(t, msgs, 2)
+	assert.Equal(t, "only one of client-secret and client-secret-file may be set", msgs[0])
+	assert.Contains(t, msgs[1], "unable to read cookie-secret-file: ")
+}
+
 func TestNewOptions(t *testing.T) {
 	o := NewOptions()
 	o.EmailDomains = []string{"*"}
@@ -113,8 +141,8 @@ func TestCompiledRegex(t *testing.T) {
 	o.SkipAuthRegex = regexps
 	assert.Equal(t, nil, o.Validate())
 	actual := make([]string, 0)
-	for _, regex := range o.CompiledRegex {
-		actual = append(actual, regex.String())
+	for _, rule := range o.skipAuthRules {
+		actual = append(actual, rule.pattern.String())
 	}
 	assert.Equal(t, regexps, actual)
 }
@@ -142,6 +170,36 @@ func TestCompiledRegexError(t *testing.T) {
 	assert.Equal(t, expected, err.Error())
 }
 
+func TestResponseHeaders(t *testing.T) {
+	o := testOptions()
+	o.ResponseHeaders = []string{"strict-transport-security: max-age=31536000", "X-Content-Type-Options:nosniff"}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, "max-age=31536000", o.responseHeaders.Get("Strict-Transport-Security"))
+	assert.Equal(t, "nosniff", o.responseHeaders.Get("X-Content-Type-Options"))
+}
+
+func TestSetRequestHeadersError(t *testing.T) {
+	o := testOptions()
+	o.SetRequestHeaders = []string{": value"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"invalid set-request-header \": value\": must be of the form \"Name: value\""})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestResponseHeadersError(t *testing.T) {
+	o := testOptions()
+	o.ResponseHeaders = []string{"X-Frame-Options"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"invalid response-header \"X-Frame-Options\": must be of the form \"Name: value\""})
+	assert.Equal(t, expected, err.Error())
+}
+
 func TestDefaultProviderApiSettings(t *testing.T) {
 	o := testOptions()
 	assert.Equal(t, nil, o.Validate())
@@ -274,3 +332,126 @@ func TestGCPHealthcheck(t *testing.T) {
 	o.GCPHealthChecks = true
 	assert.Equal(t, nil, o.Validate())
 }
+
+func TestAccessTokenFormat(t *testing.T) {
+	o := testOptions()
+	o.AccessTokenFormat = "basic"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"invalid pass-access-token-format \"basic\": must be raw or bearer"})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestHTTP2MaxConcurrentStreams(t *testing.T) {
+	o := testOptions()
+	assert.Equal(t, 250, o.HTTP2MaxConcurrentStreams)
+
+	o.HTTP2MaxConcurrentStreams = 0
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"http2-max-concurrent-streams must be greater than 0"})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestHealthCheckTimeout(t *testing.T) {
+	o := testOptions()
+	o.HealthCheckTimeout = 0
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"upstream-health-check-timeout must be greater than 0"})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestSocketFileMode(t *testing.T) {
+	o := testOptions()
+	o.SocketFileMode = "0660"
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, os.FileMode(0660), o.socketFileMode)
+
+	o = testOptions()
+	o.SocketFileMode = "rw-rw----"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"invalid socket-file-mode \"rw-rw----\": must be an octal file mode"})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestACMEDomainsRequireCacheDir(t *testing.T) {
+	o := testOptions()
+	o.ACMEDomains = []string{"internal.example.com"}
+	o.TLSCertFile = "cert.pem"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"missing setting: acme-cache-dir is required when acme-domain is set",
+		"acme-domain cannot be combined with tls-cert and tls-key"})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestTLSOptions(t *testing.T) {
+	o := testOptions()
+	o.TLSMinVersion = "TLS1.3"
+	o.TLSCipherSuites = []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}
+	o.TLSCurves = []string{"X25519", "P256"}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, uint16(tls.VersionTLS13), o.tlsMinVersion)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}, o.tlsCipherSuites)
+	assert.Equal(t, []tls.CurveID{tls.X25519, tls.CurveP256}, o.tlsCurves)
+
+	o = testOptions()
+	o.TLSMinVersion = "SSL3"
+	o.TLSCipherSuites = []string{"TLS_RSA_WITH_RC4_128_SHA"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"invalid tls-min-version \"SSL3\": must be one of TLS1.0, TLS1.1, TLS1.2 or TLS1.3",
+		"unsupported tls-cipher-suite \"TLS_RSA_WITH_RC4_128_SHA\""})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestTLSCertPairs(t *testing.T) {
+	o := testOptions()
+	o.TLSCertPairs = []string{"cert.pem"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"invalid tls-cert-pair \"cert.pem\": must be of the form certfile:keyfile"})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestSeparateLogFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logs")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	o := testOptions()
+	o.RequestLoggingFilename = filepath.Join(dir, "access.log")
+	o.AuthLoggingFilename = filepath.Join(dir, "auth.log")
+	o.StandardLoggingFilename = filepath.Join(dir, "auth.log")
+	assert.NoError(t, o.Validate())
+	defer testOptions().Validate()
+
+	req, _ := http.NewRequest("GET", "/foo", nil)
+	logger.PrintReq("jane", "", req, *req.URL, time.Now(), 200, 4, logger.RequestTimings{})
+	logger.PrintAuthf("jane", req, logger.AuthSuccess, "signed in")
+	logger.Print("started")
+
+	access, _ := ioutil.ReadFile(o.RequestLoggingFilename)
+	assert.Contains(t, string(access), `GET - "/foo"`)
+	assert.NotContains(t, string(access), "signed in")
+	auth, _ := ioutil.ReadFile(o.AuthLoggingFilename)
+	assert.Contains(t, string(auth), "[AuthSuccess] signed in\n")
+	assert.Contains(t, string(auth), "started\n")
+	assert.NotContains(t, string(auth), `"/foo"`)
+}
@@ -1,6 +1,8 @@
 package options
 
 import (
+	"time"
+
 	"github.com/OpusCapita/oauth2_proxy/cookie"
 )
 
@@ -29,4 +31,6 @@ type RedisStoreOptions struct {
 	UseSentinel            bool     `flag:"redis-use-sentinel" cfg:"redis_use_sentinel" env:"OAUTH2_PROXY_REDIS_USE_SENTINEL"`
 	SentinelMasterName     string   `flag:"redis-sentinel-master-name" cfg:"redis_sentinel_master_name" env:"OAUTH2_PROXY_REDIS_SENTINEL_MASTER_NAME"`
 	SentinelConnectionURLs []string `flag:"redis-sentinel-connection-urls" cfg:"redis_sentinel_connection_urls" env:"OAUTH2_PROXY_REDIS_SENTINEL_CONNECTION_URLS"`
+
+	LeaderLease time.Duration `flag:"redis-leader-lease" cfg:"redis_leader_lease" env:"OAUTH2_PROXY_REDIS_LEADER_LEASE"`
 }
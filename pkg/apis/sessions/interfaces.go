@@ -2,6 +2,7 @@ package sessions
 
 import (
 	"net/http"
+	"time"
 )
 
 // SessionStore is an interface to storing user sessions in the proxy
@@ -10,3 +11,30 @@ type SessionStore interface {
 	Load(req *http.Request) (*SessionState, error)
 	Clear(rw http.ResponseWriter, req *http.Request) error
 }
+
+// HealthChecker is implemented by session stores which depend on an external
+// service, to report whether it can be reached
+type HealthChecker interface {
+	Ping() error
+}
+
+// Revoker is implemented by session stores which keep sessions on the
+// server, to revoke every session of the user a session belongs to
+type Revoker interface {
+	RevokeAll(s *SessionState) error
+}
+
+// Counter is implemented by session stores which keep sessions on the
+// server, to count the sessions which have not expired
+type Counter interface {
+	Count() (int, error)
+}
+
+// Locker is implemented by session stores which are shared between
+// instances, to hold named leases which expire unless renewed. Lock acquires
+// or renews the lease of name for holder and returns whether holder holds
+// it; Unlock releases it if holder holds it.
+type Locker interface {
+	Lock(name, holder string, ttl time.Duration) (bool, error)
+	Unlock(name, holder string) error
+}
@@ -19,6 +19,13 @@ type SessionState struct {
 	RefreshToken string    `json:",omitempty"`
 	Email        string    `json:",omitempty"`
 	User         string    `json:",omitempty"`
+	// ACR is the authentication context class reference the provider
+	// authenticated the user with
+	ACR string `json:",omitempty"`
+	// Groups are the groups the provider reported the user to be a member of
+	Groups []string `json:",omitempty"`
+	// Tenant is the directory tenant of the user, e.g. the Azure AD tid
+	Tenant string `json:",omitempty"`
 }
 
 // SessionStateJSON is used to encode SessionState into JSON without exposing time.Time zero value
@@ -62,6 +69,15 @@ func (s *SessionState) String() string {
 	if s.RefreshToken != "" {
 		o += " refresh_token:true"
 	}
+	if s.ACR != "" {
+		o += fmt.Sprintf(" acr:%s", s.ACR)
+	}
+	if len(s.Groups) > 0 {
+		o += fmt.Sprintf(" groups:%s", strings.Join(s.Groups, ","))
+	}
+	if s.Tenant != "" {
+		o += fmt.Sprintf(" tenant:%s", s.Tenant)
+	}
 	return o + "}"
 }
 
@@ -69,9 +85,12 @@ func (s *SessionState) String() string {
 func (s *SessionState) EncodeSessionState(c *cookie.Cipher) (string, error) {
 	var ss SessionState
 	if c == nil {
-		// Store only Email and User when cipher is unavailable
+		// Store only Email, User, ACR, Groups and Tenant when cipher is unavailable
 		ss.Email = s.Email
 		ss.User = s.User
+		ss.ACR = s.ACR
+		ss.Groups = s.Groups
+		ss.Tenant = s.Tenant
 	} else {
 		ss = *s
 		var err error
@@ -197,10 +216,13 @@ func DecodeSessionState(v string, c *cookie.Cipher) (*SessionState, error) {
 		}
 	}
 	if c == nil {
-		// Load only Email and User when cipher is unavailable
+		// Load only Email, User, ACR, Groups and Tenant when cipher is unavailable
 		ss = &SessionState{
-			Email: ss.Email,
-			User:  ss.User,
+			Email:  ss.Email,
+			User:   ss.User,
+			ACR:    ss.ACR,
+			Groups: ss.Groups,
+			Tenant: ss.Tenant,
 		}
 	} else {
 		// Backward compatibility with using unencrypted Email
@@ -132,6 +132,24 @@ func TestSessionStateSerializationNoCipherWithUser(t *testing.T) {
 	assert.Equal(t, "", ss.RefreshToken)
 }
 
+func TestSessionStateSerializationNoCipherWithACR(t *testing.T) {
+	s := &sessions.SessionState{
+		Email:       "user@domain.com",
+		AccessToken: "token1234",
+		ACR:         "urn:example:mfa",
+		Groups:      []string{"admins", "staff"},
+	}
+	encoded, err := s.EncodeSessionState(nil)
+	assert.Equal(t, nil, err)
+
+	ss, err := sessions.DecodeSessionState(encoded, nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, s.Email, ss.Email)
+	assert.Equal(t, s.ACR, ss.ACR)
+	assert.Equal(t, s.Groups, ss.Groups)
+	assert.Equal(t, "", ss.AccessToken)
+}
+
 func TestExpired(t *testing.T) {
 	s := &sessions.SessionState{ExpiresOn: time.Now().Add(time.Duration(-1) * time.Minute)}
 	assert.Equal(t, true, s.IsExpired())
@@ -0,0 +1,119 @@
+// Package aws decrypts KMS encrypted blobs and reads AWS Secrets Manager
+// secrets with the AWS SDK, using the credentials of its default chain: the
+// environment, the shared config, the web identity, the container or the EC2
+// instance.
+package aws
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+)
+
+// Client is a client of the KMS and Secrets Manager APIs
+type Client struct {
+	region  string
+	session *session.Session
+}
+
+// NewClient creates a client of the region, which is used for KMS and
+// defaults to DefaultRegion. All services are reached at endpointURL if
+// given, e.g. a VPC endpoint or a local emulation of AWS.
+func NewClient(region, endpointURL string) (*Client, error) {
+	if region == "" {
+		region = DefaultRegion()
+	}
+	config := aws.NewConfig().WithHTTPClient(&http.Client{Timeout: 10 * time.Second})
+	if endpointURL != "" {
+		config = config.WithEndpoint(endpointURL)
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            *config,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Client{region: region, session: sess}, nil
+}
+
+// DefaultRegion returns the region of the AWS_REGION or AWS_DEFAULT_REGION
+// environment variable
+func DefaultRegion() string {
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		return region
+	}
+	return os.Getenv("AWS_DEFAULT_REGION")
+}
+
+// Region returns the region of the client
+func (c *Client) Region() string {
+	return c.region
+}
+
+// Decrypt decrypts a blob encrypted by KMS
+func (c *Client) Decrypt(blob []byte) ([]byte, error) {
+	if c.region == "" {
+		return nil, fmt.Errorf("no region to decrypt with KMS in")
+	}
+	out, err := kms.New(c.session, aws.NewConfig().WithRegion(c.region)).Decrypt(&kms.DecryptInput{CiphertextBlob: blob})
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting with KMS: %s", describe(err))
+	}
+	return out.Plaintext, nil
+}
+
+// GetSecretValue reads the current version of a Secrets Manager secret given
+// by its ARN, returning the secret string and its version
+func (c *Client) GetSecretValue(arn string) (string, string, error) {
+	region, err := ARNRegion(arn)
+	if err != nil {
+		return "", "", err
+	}
+	out, err := secretsmanager.New(c.session, aws.NewConfig().WithRegion(region)).GetSecretValue(&secretsmanager.GetSecretValueInput{SecretId: aws.String(arn)})
+	if err != nil {
+		return "", "", fmt.Errorf("error reading %s from Secrets Manager: %s", arn, describe(err))
+	}
+	if out.SecretString == nil && out.SecretBinary != nil {
+		return string(out.SecretBinary), aws.StringValue(out.VersionId), nil
+	}
+	return aws.StringValue(out.SecretString), aws.StringValue(out.VersionId), nil
+}
+
+// describe formats the errors of AWS services without the request id and
+// wrapped errors the SDK adds
+func describe(err error) string {
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		return fmt.Sprintf("got %d: %s: %s", reqErr.StatusCode(), reqErr.Code(), reqErr.Message())
+	}
+	return err.Error()
+}
+
+// ARNRegion returns the region of a Secrets Manager secret ARN of the form
+// arn:<partition>:secretsmanager:<region>:<account>:secret:<name>
+func ARNRegion(arn string) (string, error) {
+	parts := strings.SplitN(arn, ":", 7)
+	if len(parts) != 7 || parts[0] != "arn" || parts[2] != "secretsmanager" || parts[3] == "" || parts[5] != "secret" || parts[6] == "" {
+		return "", fmt.Errorf("invalid Secrets Manager secret ARN %q", arn)
+	}
+	return parts[3], nil
+}
+
+// DecodeBlob decodes a base64 encoded KMS blob, e.g. the CiphertextBlob of
+// aws kms encrypt --output text
+func DecodeBlob(s string) ([]byte, error) {
+	blob, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(blob) == 0 {
+		return nil, fmt.Errorf("invalid KMS encrypted blob: must be base64 encoded")
+	}
+	return blob, nil
+}
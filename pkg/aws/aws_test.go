@@ -0,0 +1,80 @@
+package aws
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestARNRegion(t *testing.T) {
+	region, err := ARNRegion("arn:aws:secretsmanager:eu-west-1:123456789012:secret:oauth2-proxy-AbCdEf")
+	assert.NoError(t, err)
+	assert.Equal(t, "eu-west-1", region)
+
+	for _, invalid := range []string{"oauth2-proxy", "arn:aws:kms:eu-west-1:123456789012:key/abc", "arn:aws:secretsmanager::123456789012:secret:x"} {
+		_, err := ARNRegion(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func setenv(t *testing.T, env map[string]string) func() {
+	for name, value := range env {
+		assert.NoError(t, os.Setenv(name, value))
+	}
+	return func() {
+		for name := range env {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	defer setenv(t, map[string]string{"AWS_ACCESS_KEY_ID": "AKID", "AWS_SECRET_ACCESS_KEY": "secret", "AWS_SESSION_TOKEN": "session"})()
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "session", req.Header.Get("X-Amz-Security-Token"))
+		var body map[string]string
+		json.NewDecoder(req.Body).Decode(&body)
+		auth := req.Header.Get("Authorization")
+		switch req.Header.Get("X-Amz-Target") {
+		case "TrentService.Decrypt":
+			assert.Contains(t, auth, "Credential=AKID/")
+			assert.Contains(t, auth, "/eu-central-1/kms/aws4_request")
+			if body["CiphertextBlob"] != "YmxvYg==" {
+				rw.WriteHeader(400)
+				rw.Write([]byte(`{"__type": "InvalidCiphertextException", "message": "invalid ciphertext"}`))
+				return
+			}
+			rw.Write([]byte(`{"Plaintext": "czNjcjN0"}`))
+		case "secretsmanager.GetSecretValue":
+			assert.Contains(t, auth, "/eu-west-1/secretsmanager/aws4_request")
+			rw.Write([]byte(`{"SecretString": "s3cr3t", "VersionId": "v1"}`))
+		}
+	}))
+	defer server.Close()
+
+	c, err := NewClient("eu-central-1", server.URL)
+	assert.NoError(t, err)
+	plaintext, err := c.Decrypt([]byte("blob"))
+	assert.NoError(t, err)
+	assert.Equal(t, "s3cr3t", string(plaintext))
+	_, err = c.Decrypt([]byte("other"))
+	assert.EqualError(t, err, "error decrypting with KMS: got 400: InvalidCiphertextException: invalid ciphertext")
+
+	value, version, err := c.GetSecretValue("arn:aws:secretsmanager:eu-west-1:123456789012:secret:oauth2-proxy-AbCdEf")
+	assert.NoError(t, err)
+	assert.Equal(t, "s3cr3t", value)
+	assert.Equal(t, "v1", version)
+}
+
+func TestDecodeBlob(t *testing.T) {
+	blob, err := DecodeBlob(" YmxvYg==\n")
+	assert.NoError(t, err)
+	assert.Equal(t, "blob", string(blob))
+	_, err = DecodeBlob("not base64!")
+	assert.True(t, strings.HasPrefix(err.Error(), "invalid KMS encrypted blob"))
+}
@@ -0,0 +1,336 @@
+// Package mockidp is a minimal OpenID Connect identity provider for local
+// development and integration tests. It signs in configured users, chosen on
+// a page listing them, with the authorization code flow and issues RS256
+// signed ID tokens, without checking any credentials.
+package mockidp
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// tokenTTL is the lifetime of the access and ID tokens
+const tokenTTL = time.Hour
+
+// User is a user the mock identity provider signs in
+type User struct {
+	// Subject defaults to the email
+	Subject string
+	Email   string
+	Name    string
+	Groups  []string
+}
+
+// grant is what an authorization code or refresh token was issued for
+type grant struct {
+	user        User
+	clientID    string
+	redirectURI string
+	nonce       string
+	expires     time.Time
+}
+
+// Server is the mock identity provider, an http.Handler serving the
+// discovery document, the authorization, token and userinfo endpoints and
+// the signing keys.
+type Server struct {
+	// Issuer is the issuer URL of the tokens. If empty, it is the scheme and
+	// host of the request.
+	Issuer string
+
+	users []User
+	key   *rsa.PrivateKey
+	keyID string
+
+	mu           sync.Mutex
+	codes        map[string]*grant
+	refreshes    map[string]*grant
+	accessTokens map[string]*grant
+}
+
+// New creates a mock identity provider signing in users, with a new signing
+// key
+func New(users []User) (*Server, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	thumbprint, err := (&jose.JSONWebKey{Key: &key.PublicKey}).Thumbprint(crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	for i := range users {
+		if users[i].Subject == "" {
+			users[i].Subject = users[i].Email
+		}
+	}
+	return &Server{
+		users:        users,
+		key:          key,
+		keyID:        base64.RawURLEncoding.EncodeToString(thumbprint),
+		codes:        map[string]*grant{},
+		refreshes:    map[string]*grant{},
+		accessTokens: map[string]*grant{},
+	}, nil
+}
+
+// ServeHTTP serves the endpoints of the identity provider
+func (s *Server) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/.well-known/openid-configuration":
+		s.discovery(rw, req)
+	case "/authorize":
+		s.authorize(rw, req)
+	case "/token":
+		s.token(rw, req)
+	case "/userinfo":
+		s.userinfo(rw, req)
+	case "/jwks":
+		writeJSON(rw, http.StatusOK, jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{
+			Key:       &s.key.PublicKey,
+			KeyID:     s.keyID,
+			Algorithm: "RS256",
+			Use:       "sig",
+		}}})
+	default:
+		http.NotFound(rw, req)
+	}
+}
+
+// issuer returns the issuer URL for req
+func (s *Server) issuer(req *http.Request) string {
+	if s.Issuer != "" {
+		return strings.TrimSuffix(s.Issuer, "/")
+	}
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + req.Host
+}
+
+func (s *Server) discovery(rw http.ResponseWriter, req *http.Request) {
+	issuer := s.issuer(req)
+	writeJSON(rw, http.StatusOK, map[string]interface{}{
+		"issuer":                                issuer,
+		"authorization_endpoint":                issuer + "/authorize",
+		"token_endpoint":                        issuer + "/token",
+		"userinfo_endpoint":                     issuer + "/userinfo",
+		"jwks_uri":                              issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"scopes_supported":                      []string{"openid", "email", "profile", "groups"},
+		"grant_types_supported":                 []string{"authorization_code", "refresh_token"},
+	})
+}
+
+var signInPage = template.Must(template.New("sign_in").Parse(`<!DOCTYPE html>
+<html><head><title>Mock Identity Provider</title></head>
+<body>
+<h1>Mock Identity Provider</h1>
+<p>Sign in as:</p>
+{{range $i, $user := .Users}}<form method="POST">
+{{range $name, $values := $.Params}}{{range $values}}<input type="hidden" name="{{$name}}" value="{{.}}">
+{{end}}{{end}}<input type="hidden" name="user" value="{{$i}}">
+<button type="submit">{{$user.Email}}{{if $user.Groups}} ({{range $j, $g := $user.Groups}}{{if $j}}, {{end}}{{$g}}{{end}}){{end}}</button>
+</form>
+{{end}}</body></html>
+`))
+
+// authorize signs in the user chosen on the sign in page, or the only user,
+// and redirects back to the client with an authorization code
+func (s *Server) authorize(rw http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	redirectURI, err := url.Parse(req.Form.Get("redirect_uri"))
+	if err != nil || !redirectURI.IsAbs() {
+		http.Error(rw, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	params := url.Values{}
+	if state := req.Form.Get("state"); state != "" {
+		params.Set("state", state)
+	}
+	user, ok := s.chosenUser(req)
+	switch {
+	case !ok && req.Form.Get("prompt") == "none":
+		params.Set("error", "login_required")
+	case !ok:
+		form := url.Values{}
+		for name, values := range req.Form {
+			if name != "user" {
+				form[name] = values
+			}
+		}
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		signInPage.Execute(rw, map[string]interface{}{"Users": s.users, "Params": form})
+		return
+	case req.Form.Get("response_type") != "code":
+		params.Set("error", "unsupported_response_type")
+	default:
+		params.Set("code", s.issue(s.codes, &grant{
+			user:        user,
+			clientID:    req.Form.Get("client_id"),
+			redirectURI: redirectURI.String(),
+			nonce:       req.Form.Get("nonce"),
+			expires:     time.Now().Add(time.Minute),
+		}))
+	}
+	query := redirectURI.Query()
+	for name, values := range params {
+		query[name] = values
+	}
+	redirectURI.RawQuery = query.Encode()
+	http.Redirect(rw, req, redirectURI.String(), http.StatusFound)
+}
+
+// chosenUser returns the user chosen on the sign in page, the user given by
+// login_hint or the only user
+func (s *Server) chosenUser(req *http.Request) (User, bool) {
+	if i, err := strconv.Atoi(req.Form.Get("user")); err == nil && i >= 0 && i < len(s.users) {
+		return s.users[i], true
+	}
+	if hint := req.Form.Get("login_hint"); hint != "" {
+		for _, user := range s.users {
+			if strings.EqualFold(user.Email, hint) {
+				return user, true
+			}
+		}
+	}
+	if len(s.users) == 1 {
+		return s.users[0], true
+	}
+	return User{}, false
+}
+
+// token redeems an authorization code or a refresh token
+func (s *Server) token(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	req.ParseForm()
+	clientID, _, ok := req.BasicAuth()
+	if !ok {
+		clientID = req.PostForm.Get("client_id")
+	}
+	var g *grant
+	switch req.PostForm.Get("grant_type") {
+	case "authorization_code":
+		g = s.redeem(s.codes, req.PostForm.Get("code"))
+		if g != nil && g.redirectURI != req.PostForm.Get("redirect_uri") {
+			g = nil
+		}
+	case "refresh_token":
+		g = s.redeem(s.refreshes, req.PostForm.Get("refresh_token"))
+	default:
+		writeJSON(rw, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+	if g == nil || g.clientID != clientID {
+		writeJSON(rw, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	now := time.Now()
+	claims := s.claims(g.user)
+	claims["iss"] = s.issuer(req)
+	claims["aud"] = clientID
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(tokenTTL).Unix()
+	if g.nonce != "" {
+		claims["nonce"] = g.nonce
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = s.keyID
+	idToken, err := token.SignedString(s.key)
+	if err != nil {
+		writeJSON(rw, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+	access := *g
+	access.expires = now.Add(tokenTTL)
+	refresh := *g
+	refresh.expires = now.Add(30 * 24 * time.Hour)
+	writeJSON(rw, http.StatusOK, map[string]interface{}{
+		"access_token":  s.issue(s.accessTokens, &access),
+		"token_type":    "Bearer",
+		"expires_in":    int(tokenTTL / time.Second),
+		"id_token":      idToken,
+		"refresh_token": s.issue(s.refreshes, &refresh),
+	})
+}
+
+// userinfo returns the claims of the user of an access token
+func (s *Server) userinfo(rw http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	g := s.accessTokens[strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")]
+	s.mu.Unlock()
+	if g == nil || time.Now().After(g.expires) {
+		rw.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeJSON(rw, http.StatusUnauthorized, map[string]string{"error": "invalid_token"})
+		return
+	}
+	writeJSON(rw, http.StatusOK, s.claims(g.user))
+}
+
+// claims returns the claims describing user
+func (s *Server) claims(user User) jwt.MapClaims {
+	claims := jwt.MapClaims{
+		"sub":                user.Subject,
+		"email":              user.Email,
+		"email_verified":     true,
+		"preferred_username": user.Subject,
+	}
+	if user.Name != "" {
+		claims["name"] = user.Name
+	}
+	if len(user.Groups) > 0 {
+		claims["groups"] = user.Groups
+	}
+	return claims
+}
+
+// issue stores g under a new random value and returns the value
+func (s *Server) issue(grants map[string]*grant, g *grant) string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	value := hex.EncodeToString(b)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	grants[value] = g
+	return value
+}
+
+// redeem removes and returns the unexpired grant of value
+func (s *Server) redeem(grants map[string]*grant, value string) *grant {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g := grants[value]
+	delete(grants, value)
+	if g == nil || time.Now().After(g.expires) {
+		return nil
+	}
+	return g
+}
+
+func writeJSON(rw http.ResponseWriter, code int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(code)
+	json.NewEncoder(rw).Encode(v)
+}
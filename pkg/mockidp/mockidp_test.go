@@ -0,0 +1,105 @@
+package mockidp
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	oidc "github.com/coreos/go-oidc"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+func TestLoginFlow(t *testing.T) {
+	idp, err := New([]User{
+		{Email: "alice@example.com", Name: "Alice", Groups: []string{"admins", "devs"}},
+		{Email: "bob@example.com"},
+	})
+	assert.NoError(t, err)
+	server := httptest.NewServer(idp)
+	defer server.Close()
+
+	ctx := context.Background()
+	provider, err := oidc.NewProvider(ctx, server.URL)
+	assert.NoError(t, err)
+	config := &oauth2.Config{
+		ClientID:     "client",
+		ClientSecret: "secret",
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  "http://localhost/oauth2/callback",
+		Scopes:       []string{oidc.ScopeOpenID, "email"},
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	// with several users, the sign in page lists them
+	resp, err := client.Get(config.AuthCodeURL("state", oidc.Nonce("nonce")))
+	assert.NoError(t, err)
+	page, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(page), "alice@example.com (admins, devs)")
+	assert.Contains(t, string(page), `<input type="hidden" name="state" value="state">`)
+
+	resp, err = client.Get(config.AuthCodeURL("state", oauth2.SetAuthURLParam("prompt", "none")))
+	assert.NoError(t, err)
+	resp.Body.Close()
+	location, _ := url.Parse(resp.Header.Get("Location"))
+	assert.Equal(t, "login_required", location.Query().Get("error"))
+
+	form := url.Values{"user": {"0"}}
+	authURL, _ := url.Parse(config.AuthCodeURL("state", oidc.Nonce("nonce")))
+	for name, values := range authURL.Query() {
+		form[name] = values
+	}
+	resp, err = client.PostForm(server.URL+"/authorize", form)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	location, _ = url.Parse(resp.Header.Get("Location"))
+	assert.Equal(t, "state", location.Query().Get("state"))
+	code := location.Query().Get("code")
+
+	token, err := config.Exchange(ctx, code)
+	assert.NoError(t, err)
+	_, err = config.Exchange(ctx, code)
+	assert.Error(t, err, "an authorization code is redeemed once")
+
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: "client"}).Verify(ctx, token.Extra("id_token").(string))
+	assert.NoError(t, err)
+	var claims struct {
+		Email  string   `json:"email"`
+		Name   string   `json:"name"`
+		Groups []string `json:"groups"`
+	}
+	assert.NoError(t, idToken.Claims(&claims))
+	assert.Equal(t, "nonce", idToken.Nonce)
+	assert.Equal(t, "alice@example.com", idToken.Subject)
+	assert.Equal(t, []string{"admins", "devs"}, claims.Groups)
+
+	userInfo, err := provider.UserInfo(ctx, oauth2.StaticTokenSource(token))
+	assert.NoError(t, err)
+	assert.Equal(t, "alice@example.com", userInfo.Email)
+
+	refreshed, err := config.TokenSource(ctx, &oauth2.Token{RefreshToken: token.RefreshToken}).Token()
+	assert.NoError(t, err)
+	assert.NotEqual(t, token.AccessToken, refreshed.AccessToken)
+}
+
+func TestLoginHint(t *testing.T) {
+	idp, err := New([]User{{Email: "alice@example.com"}, {Email: "bob@example.com"}})
+	assert.NoError(t, err)
+	req := httptest.NewRequest("GET", "/authorize?response_type=code&client_id=client&redirect_uri=http%3A%2F%2Flocalhost%2Fcallback&login_hint=BOB%40example.com", nil)
+	rw := httptest.NewRecorder()
+	idp.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusFound, rw.Code)
+	assert.True(t, strings.HasPrefix(rw.Header().Get("Location"), "http://localhost/callback?code="))
+	for _, g := range idp.codes {
+		assert.Equal(t, "bob@example.com", g.user.Subject)
+	}
+}
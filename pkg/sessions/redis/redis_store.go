@@ -82,7 +82,7 @@ func (store *SessionStore) Save(rw http.ResponseWriter, req *http.Request, s *se
 	if err != nil {
 		return err
 	}
-	ticketString, err := store.storeValue(value, store.CookieOptions.CookieExpire, requestCookie)
+	ticketString, err := store.storeValue(value, store.CookieOptions.CookieExpire, requestCookie, sessionOwner(s))
 	if err != nil {
 		return err
 	}
@@ -183,6 +183,126 @@ func (store *SessionStore) Clear(rw http.ResponseWriter, req *http.Request) erro
 	return nil
 }
 
+// RevokeAll deletes every session in redis belonging to the user of s,
+// signing them out on all their devices
+func (store *SessionStore) RevokeAll(s *sessions.SessionState) error {
+	owner := sessionOwner(s)
+	if owner == "" {
+		return nil
+	}
+	userKey := store.userKey(owner)
+	handles, err := store.Client.SMembers(userKey).Result()
+	if err != nil {
+		return fmt.Errorf("error loading sessions from redis: %s", err)
+	}
+	if err := store.Client.Del(append(handles, userKey)...).Err(); err != nil {
+		return fmt.Errorf("error clearing sessions from redis: %s", err)
+	}
+	return nil
+}
+
+// sessionOwner identifies the user of a session: their email, or the user
+// name for sessions without one
+func sessionOwner(s *sessions.SessionState) string {
+	if s.Email != "" {
+		return strings.ToLower(s.Email)
+	}
+	return s.User
+}
+
+// userKey is the redis set of the session handles of a user
+func (store *SessionStore) userKey(owner string) string {
+	return fmt.Sprintf("%s-user-%s", store.CookieOptions.CookieName, owner)
+}
+
+// lockKey is the redis key of the lease of name
+func (store *SessionStore) lockKey(name string) string {
+	return fmt.Sprintf("%s-lock-%s", store.CookieOptions.CookieName, name)
+}
+
+// Lock acquires the lease of name for holder if it is free, or renews it if
+// holder already holds it, for ttl
+func (store *SessionStore) Lock(name, holder string, ttl time.Duration) (bool, error) {
+	key := store.lockKey(name)
+	locked := false
+	err := store.Client.Watch(func(tx *redis.Tx) error {
+		current, err := tx.Get(key).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if err == nil && current != holder {
+			return nil
+		}
+		_, err = tx.TxPipelined(func(pipe redis.Pipeliner) error {
+			pipe.Set(key, holder, ttl)
+			return nil
+		})
+		locked = err == nil
+		return err
+	}, key)
+	if err == redis.TxFailedErr {
+		// taken by another holder in the meantime
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error locking %s in redis: %s", name, err)
+	}
+	return locked, nil
+}
+
+// Unlock releases the lease of name if holder holds it
+func (store *SessionStore) Unlock(name, holder string) error {
+	key := store.lockKey(name)
+	err := store.Client.Watch(func(tx *redis.Tx) error {
+		current, err := tx.Get(key).Result()
+		if err == redis.Nil || (err == nil && current != holder) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(func(pipe redis.Pipeliner) error {
+			pipe.Del(key)
+			return nil
+		})
+		return err
+	}, key)
+	if err != nil && err != redis.TxFailedErr {
+		return fmt.Errorf("error unlocking %s in redis: %s", name, err)
+	}
+	return nil
+}
+
+// Count counts the sessions in redis, leaving out the index of each user and
+// the leases
+func (store *SessionStore) Count() (int, error) {
+	prefix := store.CookieOptions.CookieName + "-"
+	userPrefix := store.userKey("")
+	lockPrefix := store.lockKey("")
+	count := 0
+	var cursor uint64
+	for {
+		keys, next, err := store.Client.Scan(cursor, prefix+"*", 1000).Result()
+		if err != nil {
+			return 0, fmt.Errorf("error counting sessions in redis: %s", err)
+		}
+		for _, key := range keys {
+			if !strings.HasPrefix(key, userPrefix) && !strings.HasPrefix(key, lockPrefix) {
+				count++
+			}
+		}
+		if next == 0 {
+			return count, nil
+		}
+		cursor = next
+	}
+}
+
+// Ping checks the connection to the redis server
+func (store *SessionStore) Ping() error {
+	return store.Client.Ping().Err()
+}
+
 // makeCookie makes a cookie, signing the value if present
 func (store *SessionStore) makeCookie(req *http.Request, value string, expires time.Duration, now time.Time) *http.Cookie {
 	if value != "" {
@@ -198,7 +318,7 @@ func (store *SessionStore) makeCookie(req *http.Request, value string, expires t
 	)
 }
 
-func (store *SessionStore) storeValue(value string, expiration time.Duration, requestCookie *http.Cookie) (string, error) {
+func (store *SessionStore) storeValue(value string, expiration time.Duration, requestCookie *http.Cookie, owner string) (string, error) {
 	ticket, err := store.getTicket(requestCookie)
 	if err != nil {
 		return "", fmt.Errorf("error getting ticket: %v", err)
@@ -219,6 +339,18 @@ func (store *SessionStore) storeValue(value string, expiration time.Duration, re
 	if err != nil {
 		return "", err
 	}
+	if owner != "" {
+		// index the handles of each user, so RevokeAll can find them
+		userKey := store.userKey(owner)
+		_, err = store.Client.TxPipelined(func(pipe redis.Pipeliner) error {
+			pipe.SAdd(userKey, handle)
+			pipe.Expire(userKey, expiration)
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+	}
 	return ticket.encodeTicket(store.CookieOptions.CookieName), nil
 }
 
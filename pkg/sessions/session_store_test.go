@@ -135,6 +135,69 @@ var _ = Describe("NewSessionStore", func() {
 
 			CheckCookieOptions()
 		})
+
+		Context("when RevokeAll is called", func() {
+			var saveSession = func(s *sessionsapi.SessionState) *http.Request {
+				saveResp := httptest.NewRecorder()
+				err := ss.Save(saveResp, httptest.NewRequest("GET", "http://example.com/", nil), s)
+				Expect(err).ToNot(HaveOccurred())
+
+				loadReq := httptest.NewRequest("GET", "http://example.com/", nil)
+				for _, c := range saveResp.Result().Cookies() {
+					loadReq.AddCookie(c)
+				}
+				return loadReq
+			}
+
+			It("clears every session of the user", func() {
+				first := saveSession(&sessionsapi.SessionState{Email: "john@example.com", User: "john"})
+				second := saveSession(&sessionsapi.SessionState{Email: "John@example.com", User: "john"})
+				other := saveSession(&sessionsapi.SessionState{Email: "jane@example.com", User: "jane"})
+
+				revoker, ok := ss.(sessionsapi.Revoker)
+				Expect(ok).To(BeTrue())
+				Expect(revoker.RevokeAll(&sessionsapi.SessionState{Email: "john@example.com"})).To(Succeed())
+
+				_, err := ss.Load(first)
+				Expect(err).To(HaveOccurred())
+				_, err = ss.Load(second)
+				Expect(err).To(HaveOccurred())
+				loaded, err := ss.Load(other)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(loaded.Email).To(Equal("jane@example.com"))
+			})
+		})
+
+		Context("when Count is called", func() {
+			It("counts the sessions but not the index of each user", func() {
+				for _, email := range []string{"john@example.com", "john@example.com", "jane@example.com"} {
+					err := ss.Save(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/", nil), &sessionsapi.SessionState{Email: email})
+					Expect(err).ToNot(HaveOccurred())
+				}
+
+				counter, ok := ss.(sessionsapi.Counter)
+				Expect(ok).To(BeTrue())
+				Expect(counter.Count()).To(Equal(3))
+			})
+		})
+
+		Context("when Lock is called", func() {
+			It("holds the lease for one holder until it is released", func() {
+				locker, ok := ss.(sessionsapi.Locker)
+				Expect(ok).To(BeTrue())
+				Expect(locker.Lock("leader", "first", time.Minute)).To(BeTrue())
+				Expect(locker.Lock("leader", "second", time.Minute)).To(BeFalse())
+				Expect(locker.Lock("leader", "first", time.Minute)).To(BeTrue())
+
+				counter := ss.(sessionsapi.Counter)
+				Expect(counter.Count()).To(Equal(0))
+
+				Expect(locker.Unlock("leader", "second")).To(Succeed())
+				Expect(locker.Lock("leader", "second", time.Minute)).To(BeFalse())
+				Expect(locker.Unlock("leader", "first")).To(Succeed())
+				Expect(locker.Lock("leader", "second", time.Minute)).To(BeTrue())
+			})
+		})
 	}
 
 	SessionStoreInterfaceTests := func(persistent bool) {
@@ -429,6 +492,17 @@ var _ = Describe("NewSessionStore", func() {
 			Expect(ss).To(BeAssignableToTypeOf(&redis.SessionStore{}))
 		})
 
+		It("reports whether redis can be reached", func() {
+			ss, err := sessions.NewSessionStore(opts, cookieOpts)
+			Expect(err).NotTo(HaveOccurred())
+			checker, ok := ss.(sessionsapi.HealthChecker)
+			Expect(ok).To(BeTrue())
+			Expect(checker.Ping()).To(Succeed())
+
+			mr.Close()
+			Expect(checker.Ping()).ToNot(Succeed())
+		})
+
 		Context("the redis.SessionStore", func() {
 			RunSessionTests(true)
 		})
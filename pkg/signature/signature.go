@@ -0,0 +1,96 @@
+// Package signature signs and verifies the GAP-Signature header that
+// oauth2_proxy adds to proxied requests when a signature key is configured.
+// Upstream services written in Go can use VerifyRequest to check that the
+// identity headers they receive were set by the proxy.
+package signature
+
+import (
+	"crypto"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/mbland/hmacauth"
+)
+
+// Header is the name of the request header containing the GAP Signature
+const Header = "GAP-Signature"
+
+// Headers contains the headers to be signed by the hmac algorithm. The
+// request method and path are always part of the signed data.
+var Headers = []string{
+	"Content-Length",
+	"Content-Md5",
+	"Content-Type",
+	"Date",
+	"Authorization",
+	"X-Forwarded-User",
+	"X-Forwarded-Email",
+	"X-Forwarded-Access-Token",
+	"X-Forwarded-Groups",
+	"X-Forwarded-Id-Token",
+	"X-Forwarded-Jwt",
+	"Cookie",
+	"Gap-Auth",
+}
+
+// signedHeaders returns the Headers followed by those of extra they do not
+// contain yet
+func signedHeaders(extra []string) []string {
+	headers := append([]string{}, Headers...)
+	for _, name := range extra {
+		name = http.CanonicalHeaderKey(name)
+		if name == "" {
+			continue
+		}
+		found := false
+		for _, h := range headers {
+			if h == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			headers = append(headers, name)
+		}
+	}
+	return headers
+}
+
+// ParseKey splits a signature key of the form algorithm:secretkey into the
+// hash to use and the shared secret
+func ParseKey(key string) (crypto.Hash, string, error) {
+	components := strings.Split(key, ":")
+	if len(components) != 2 {
+		return 0, "", fmt.Errorf("invalid signature hash:key spec: %s", key)
+	}
+
+	algorithm, secretKey := components[0], components[1]
+	hash, err := hmacauth.DigestNameToCryptoHash(algorithm)
+	if err != nil {
+		return 0, "", fmt.Errorf("unsupported signature hash algorithm: %s", key)
+	}
+	return hash, secretKey, nil
+}
+
+// New creates an HmacAuth signing the Headers into the Header with the given
+// hash and secret. Extra headers, such as identity headers the proxy was
+// configured to pass under other names, are signed after the Headers.
+func New(hash crypto.Hash, secretKey string, extra ...string) hmacauth.HmacAuth {
+	return hmacauth.NewHmacAuth(hash, []byte(secretKey), Header, signedHeaders(extra))
+}
+
+// VerifyRequest checks that req carries a GAP-Signature matching the given
+// algorithm:secretkey signature key. The extra headers must be those the
+// proxy signs besides the Headers.
+func VerifyRequest(req *http.Request, key string, extra ...string) error {
+	hash, secretKey, err := ParseKey(key)
+	if err != nil {
+		return err
+	}
+	result, _, _ := New(hash, secretKey, extra...).AuthenticateRequest(req)
+	if result != hmacauth.ResultMatch {
+		return fmt.Errorf("request signature verification failed: %s", result)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package signature
+
+import (
+	"crypto"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseKey(t *testing.T) {
+	hash, secretKey, err := ParseKey("sha256:secret")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, crypto.SHA256, hash)
+	assert.Equal(t, "secret", secretKey)
+
+	_, _, err = ParseKey("secret")
+	assert.Equal(t, "invalid signature hash:key spec: secret", err.Error())
+
+	_, _, err = ParseKey("unknown:secret")
+	assert.Equal(t, "unsupported signature hash algorithm: unknown:secret", err.Error())
+}
+
+func TestVerifyRequest(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://upstream/foo/bar", nil)
+	req.Header.Set("X-Forwarded-User", "oauth_user")
+	req.Header.Set("X-Forwarded-Email", "oauth_user@example.com")
+	New(crypto.SHA256, "secret").SignRequest(req)
+
+	assert.Equal(t, nil, VerifyRequest(req, "sha256:secret"))
+	assert.NotEqual(t, nil, VerifyRequest(req, "sha256:other"))
+
+	req.Header.Set("X-Forwarded-User", "spoofed_user")
+	assert.NotEqual(t, nil, VerifyRequest(req, "sha256:secret"))
+
+	req.Header.Del(Header)
+	assert.NotEqual(t, nil, VerifyRequest(req, "sha256:secret"))
+}
+
+func TestVerifyRequestIdentityHeaders(t *testing.T) {
+	for _, name := range []string{"X-Forwarded-Groups", "X-Forwarded-Id-Token", "X-Forwarded-Jwt"} {
+		req, _ := http.NewRequest("GET", "http://upstream/foo/bar", nil)
+		req.Header.Set(name, "value")
+		New(crypto.SHA256, "secret").SignRequest(req)
+		assert.Equal(t, nil, VerifyRequest(req, "sha256:secret"))
+
+		req.Header.Set(name, "spoofed")
+		assert.NotEqual(t, nil, VerifyRequest(req, "sha256:secret"), name)
+	}
+}
+
+func TestVerifyRequestExtraHeaders(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://upstream/foo/bar", nil)
+	req.Header.Set("X-Groups", "admins")
+	New(crypto.SHA256, "secret", "x-groups", "X-Forwarded-Groups", "").SignRequest(req)
+	assert.Equal(t, nil, VerifyRequest(req, "sha256:secret", "X-Groups"))
+
+	req.Header.Set("X-Groups", "spoofed")
+	assert.NotEqual(t, nil, VerifyRequest(req, "sha256:secret", "X-Groups"))
+}
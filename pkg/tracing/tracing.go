@@ -0,0 +1,400 @@
+// Package tracing records OpenTelemetry compatible spans of the requests to
+// the proxy, propagates them with the W3C traceparent header and exports them
+// to an OTLP/HTTP collector.
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OpusCapita/oauth2_proxy/logger"
+)
+
+// Kinds of spans
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+)
+
+const (
+	// TraceparentHeader is the W3C Trace Context header
+	TraceparentHeader = "traceparent"
+	// B3Header is the single header format of Zipkin B3 propagation
+	B3Header = "b3"
+	// maxQueuedSpans bounds the spans waiting for export, further spans
+	// are dropped
+	maxQueuedSpans = 2048
+	// exportInterval is how often the queued spans are exported
+	exportInterval = 5 * time.Second
+)
+
+// SpanContext identifies a span within a trace
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// Traceparent returns the W3C traceparent header of the span context
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]), flags)
+}
+
+// B3 returns the single b3 header of the span context
+func (sc SpanContext) B3() string {
+	sampled := "0"
+	if sc.Sampled {
+		sampled = "1"
+	}
+	return fmt.Sprintf("%s-%s-%s", hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]), sampled)
+}
+
+// NewSpanContext returns the span context of a new, unsampled trace
+func NewSpanContext() SpanContext {
+	var sc SpanContext
+	rand.Read(sc.TraceID[:])
+	rand.Read(sc.SpanID[:])
+	return sc
+}
+
+// ParseTraceparent parses a W3C traceparent header
+func ParseTraceparent(header string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, false
+	}
+	traceID, err := hex.DecodeString(parts[1])
+	if err != nil || len(traceID) != 16 {
+		return sc, false
+	}
+	spanID, err := hex.DecodeString(parts[2])
+	if err != nil || len(spanID) != 8 {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return sc, false
+	}
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	if sc.TraceID == [16]byte{} || sc.SpanID == [8]byte{} {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, true
+}
+
+// Span is an operation of a trace. The methods of a nil Span do nothing, so
+// that code can be instrumented unconditionally.
+type Span struct {
+	tracer   *Tracer
+	context  SpanContext
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+
+	mu         sync.Mutex
+	end        time.Time
+	attributes map[string]interface{}
+	err        string
+}
+
+// Context returns the span context of the span
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.context
+}
+
+// SetAttribute sets an attribute of the span to a string, int, int64 or bool
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes[key] = value
+}
+
+// SetError marks the span as failed if err is not nil
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err.Error()
+}
+
+// End ends the span, queueing it for export if it is sampled
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.end.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.end = time.Now()
+	s.mu.Unlock()
+	if s.context.Sampled {
+		s.tracer.queue(s)
+	}
+}
+
+type spanKey struct{}
+
+// FromContext returns the current span of the context, or nil
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// Start starts a child span of the current span of the context. Without a
+// current span tracing is disabled and a nil span is returned.
+func Start(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	parent := FromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	s := parent.tracer.newSpan(name, kind, parent.context, true)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// Inject sets the traceparent header of the current span of the context
+func Inject(ctx context.Context, header http.Header) {
+	if s := FromContext(ctx); s != nil {
+		header.Set(TraceparentHeader, s.context.Traceparent())
+	}
+}
+
+// Tracer records the spans of the requests to the proxy and exports the
+// sampled ones to an OTLP/HTTP collector
+type Tracer struct {
+	endpoint    string
+	serviceName string
+	sampleRatio float64
+	client      *http.Client
+
+	mu    sync.Mutex
+	spans []*Span
+}
+
+// NewTracer creates a tracer exporting to the OTLP/HTTP traces endpoint of a
+// collector, e.g. http://otel-collector:4318/v1/traces. Traces started by
+// the proxy are sampled with the probability sampleRatio, traces continued
+// from a traceparent header follow its sampled flag.
+func NewTracer(endpoint, serviceName string, sampleRatio float64) *Tracer {
+	return &Tracer{
+		endpoint:    endpoint,
+		serviceName: serviceName,
+		sampleRatio: sampleRatio,
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (t *Tracer) newSpan(name string, kind int, parent SpanContext, hasParent bool) *Span {
+	s := &Span{
+		tracer:     t,
+		name:       name,
+		kind:       kind,
+		start:      time.Now(),
+		attributes: map[string]interface{}{},
+	}
+	if hasParent {
+		s.context.TraceID = parent.TraceID
+		s.context.Sampled = parent.Sampled
+		s.parentID = parent.SpanID
+	} else {
+		rand.Read(s.context.TraceID[:])
+		s.context.Sampled = sampled(s.context.TraceID, t.sampleRatio)
+	}
+	rand.Read(s.context.SpanID[:])
+	return s
+}
+
+// sampled decides from the random trace ID whether to sample a new trace,
+// so that all services using the same ratio agree
+func sampled(traceID [16]byte, ratio float64) bool {
+	if ratio >= 1 {
+		return true
+	}
+	if ratio <= 0 {
+		return false
+	}
+	return binary.BigEndian.Uint64(traceID[8:])>>11 < uint64(ratio*(1<<53))
+}
+
+// Handler starts a server span for every request, continuing the trace of
+// its traceparent header. A nil tracer returns the handler unchanged.
+func (t *Tracer) Handler(h http.Handler) http.Handler {
+	if t == nil {
+		return h
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		parent, ok := ParseTraceparent(req.Header.Get(TraceparentHeader))
+		s := t.newSpan(req.Method, KindServer, parent, ok)
+		defer s.End()
+		s.SetAttribute("http.method", req.Method)
+		s.SetAttribute("http.target", req.URL.Path)
+		s.SetAttribute("http.host", req.Host)
+		h.ServeHTTP(rw, req.WithContext(context.WithValue(req.Context(), spanKey{}, s)))
+	})
+}
+
+func (t *Tracer) queue(s *Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.spans) < maxQueuedSpans {
+		t.spans = append(t.spans, s)
+	}
+}
+
+// Run exports the queued spans periodically until done is closed, then
+// exports the remaining ones
+func (t *Tracer) Run(done <-chan bool) {
+	if t == nil {
+		return
+	}
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			t.Export()
+			return
+		case <-ticker.C:
+			t.Export()
+		}
+	}
+}
+
+// Export sends the queued spans to the collector
+func (t *Tracer) Export() {
+	t.mu.Lock()
+	spans := t.spans
+	t.spans = nil
+	t.mu.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(t.otlpRequest(spans))
+	if err != nil {
+		logger.Printf("error encoding %d spans: %s", len(spans), err)
+		return
+	}
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logger.Printf("error exporting %d spans: %s", len(spans), err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		logger.Printf("error exporting %d spans: got %d from %s", len(spans), resp.StatusCode, t.endpoint)
+	}
+}
+
+// The OTLP/JSON encoding of an export request, see
+// https://github.com/open-telemetry/opentelemetry-proto
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+func (t *Tracer) otlpRequest(spans []*Span) interface{} {
+	var encoded []otlpSpan
+	for _, s := range spans {
+		s.mu.Lock()
+		span := otlpSpan{
+			TraceID:           hex.EncodeToString(s.context.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.context.SpanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.attributes),
+		}
+		if s.parentID != [8]byte{} {
+			span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		if s.err != "" {
+			span.Status = otlpStatus{Code: 2, Message: s.err}
+		}
+		s.mu.Unlock()
+		encoded = append(encoded, span)
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]interface{}{"service.name": t.serviceName}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "github.com/OpusCapita/oauth2_proxy"},
+				"spans": encoded,
+			}},
+		}},
+	}
+}
+
+func otlpAttributes(attributes map[string]interface{}) []otlpKeyValue {
+	var keys []string
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var kvs []otlpKeyValue
+	for _, key := range keys {
+		value := attributes[key]
+		var v map[string]interface{}
+		switch value := value.(type) {
+		case bool:
+			v = map[string]interface{}{"boolValue": value}
+		case int:
+			v = map[string]interface{}{"intValue": strconv.Itoa(value)}
+		case int64:
+			v = map[string]interface{}{"intValue": strconv.FormatInt(value, 10)}
+		default:
+			v = map[string]interface{}{"stringValue": fmt.Sprint(value)}
+		}
+		kvs = append(kvs, otlpKeyValue{Key: key, Value: v})
+	}
+	return kvs
+}
@@ -0,0 +1,117 @@
+package tracing
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	header := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, ok := ParseTraceparent(header)
+	assert.True(t, ok)
+	assert.True(t, sc.Sampled)
+	assert.Equal(t, header, sc.Traceparent())
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01",
+	} {
+		_, ok := ParseTraceparent(invalid)
+		assert.False(t, ok, invalid)
+	}
+	// later versions may add fields
+	_, ok = ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra")
+	assert.True(t, ok)
+}
+
+func TestB3(t *testing.T) {
+	sc, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-1", sc.B3())
+	sc = NewSpanContext()
+	assert.False(t, sc.Sampled)
+	assert.NotEqual(t, [16]byte{}, sc.TraceID)
+	assert.NotEqual(t, [8]byte{}, sc.SpanID)
+}
+
+func TestTracerExport(t *testing.T) {
+	var exported map[string]interface{}
+	collector := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+		body, _ := ioutil.ReadAll(req.Body)
+		assert.NoError(t, json.Unmarshal(body, &exported))
+	}))
+	defer collector.Close()
+
+	tracer := NewTracer(collector.URL+"/v1/traces", "proxy", 1)
+	var traceparent string
+	handler := tracer.Handler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ctx, span := Start(req.Context(), "upstream", KindClient)
+		span.SetAttribute("upstream", "http://127.0.0.1:8080/")
+		header := http.Header{}
+		Inject(ctx, header)
+		traceparent = header.Get(TraceparentHeader)
+		span.End()
+	}))
+	req := httptest.NewRequest("GET", "/foo", nil)
+	req.Header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	sc, ok := ParseTraceparent(traceparent)
+	assert.True(t, ok)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", traceparent[3:35])
+	tracer.Export()
+
+	resourceSpans := exported["resourceSpans"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, []interface{}{map[string]interface{}{"key": "service.name", "value": map[string]interface{}{"stringValue": "proxy"}}},
+		resourceSpans["resource"].(map[string]interface{})["attributes"])
+	spans := resourceSpans["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})
+	assert.Len(t, spans, 2)
+	upstream, server := spans[0].(map[string]interface{}), spans[1].(map[string]interface{})
+	assert.Equal(t, "upstream", upstream["name"])
+	assert.Equal(t, float64(KindClient), upstream["kind"])
+	assert.Equal(t, server["spanId"], upstream["parentSpanId"])
+	assert.Equal(t, traceparent[36:52], upstream["spanId"])
+	assert.Equal(t, "GET", server["name"])
+	assert.Equal(t, "00f067aa0ba902b7", server["parentSpanId"])
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", server["traceId"])
+	assert.True(t, sc.Sampled)
+}
+
+func TestTracerSampling(t *testing.T) {
+	tracer := NewTracer("http://127.0.0.1:4318/v1/traces", "proxy", 0)
+	handler := tracer.Handler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, span := Start(req.Context(), "authenticate", KindInternal)
+		span.End()
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	assert.Len(t, tracer.spans, 0)
+
+	// the caller decided to sample the trace
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Len(t, tracer.spans, 2)
+}
+
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+	h := http.NewServeMux()
+	assert.Equal(t, h, tracer.Handler(h))
+	ctx, span := Start(httptest.NewRequest("GET", "/", nil).Context(), "authenticate", KindInternal)
+	assert.Nil(t, span)
+	span.SetAttribute("key", "value")
+	span.End()
+	header := http.Header{}
+	Inject(ctx, header)
+	assert.Empty(t, header)
+}
@@ -0,0 +1,353 @@
+// Package vault reads secrets from HashiCorp Vault with its API client:
+// values of a KV version 2 secrets engine and certificates issued by a PKI
+// secrets engine. The token of a client is renewed, or obtained again,
+// before it expires.
+package vault
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OpusCapita/oauth2_proxy/logger"
+	"github.com/hashicorp/vault/api"
+)
+
+// retryInterval is how long to wait after renewing a token or certificate
+// failed
+const retryInterval = time.Minute
+
+// Client is a client of the Vault HTTP API
+type Client struct {
+	client *api.Client
+	// login obtains a new token, it is nil for a fixed token
+	login func() (*api.Secret, error)
+
+	mu sync.Mutex
+	// auth is the secret of the current token, which the renewer keeps
+	// valid
+	auth *api.Secret
+}
+
+// NewTokenClient creates a client of the Vault at address authenticating with
+// a token. The TLS settings are read from the VAULT_CACERT and related
+// environment variables.
+func NewTokenClient(address, token string) (*Client, error) {
+	config := api.DefaultConfig()
+	if config.Error != nil {
+		return nil, fmt.Errorf("invalid Vault configuration: %s", config.Error)
+	}
+	config.Address = strings.TrimSuffix(address, "/")
+	config.Timeout = 10 * time.Second
+	client, err := api.NewClient(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Vault configuration: %s", err)
+	}
+	client.SetToken(token)
+	return &Client{client: client}, nil
+}
+
+// NewKubernetesClient creates a client of the Vault at address logging in
+// with the Kubernetes auth method mounted at mount as role, using the service
+// account token in jwtFile
+func NewKubernetesClient(address, mount, role, jwtFile string) (*Client, error) {
+	c, err := NewTokenClient(address, "")
+	if err != nil {
+		return nil, err
+	}
+	c.login = func() (*api.Secret, error) {
+		jwt, err := ioutil.ReadFile(jwtFile)
+		if err != nil {
+			return nil, err
+		}
+		// the login must not send the expiring token
+		client, err := c.client.Clone()
+		if err != nil {
+			return nil, err
+		}
+		client.ClearToken()
+		secret, err := client.Logical().Write("auth/"+mount+"/login", map[string]interface{}{
+			"role": role,
+			"jwt":  strings.TrimSpace(string(jwt)),
+		})
+		if err != nil {
+			return nil, describe(err)
+		}
+		if secret == nil || secret.Auth == nil {
+			return nil, fmt.Errorf("no token in the response of the login as %s", role)
+		}
+		return secret, nil
+	}
+	return c, nil
+}
+
+// describe shortens the errors of Vault responses, which include the
+// request, to their status and messages
+func describe(err error) error {
+	respErr, ok := err.(*api.ResponseError)
+	if !ok {
+		return err
+	}
+	if len(respErr.Errors) > 0 && !respErr.RawError {
+		return fmt.Errorf("got %d: %s", respErr.StatusCode, strings.Join(respErr.Errors, ", "))
+	}
+	return fmt.Errorf("got %d", respErr.StatusCode)
+}
+
+// Login obtains the token of the client, or looks up the expiry of a fixed
+// token
+func (c *Client) Login() error {
+	if c.login != nil {
+		secret, err := c.login()
+		if err != nil {
+			return fmt.Errorf("error logging in to Vault: %s", err)
+		}
+		c.setAuth(secret)
+		return nil
+	}
+	secret, err := c.client.Auth().Token().LookupSelf()
+	if err != nil {
+		return fmt.Errorf("error looking up the Vault token: %s", describe(err))
+	}
+	ttl, err := secret.TokenTTL()
+	if err != nil {
+		return fmt.Errorf("error looking up the Vault token: %s", err)
+	}
+	renewable, err := secret.TokenIsRenewable()
+	if err != nil {
+		return fmt.Errorf("error looking up the Vault token: %s", err)
+	}
+	c.setAuth(&api.Secret{Auth: &api.SecretAuth{
+		ClientToken:   c.client.Token(),
+		LeaseDuration: int(ttl.Seconds()),
+		Renewable:     renewable,
+	}})
+	return nil
+}
+
+func (c *Client) setAuth(secret *api.Secret) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.auth = secret
+	c.client.SetToken(secret.Auth.ClientToken)
+}
+
+// Run keeps the token valid until done is closed. Renewable tokens are
+// renewed by the renewer of the Vault client until they reach their maximum
+// TTL; tokens of a login are then, or when half of the lifetime of a token
+// which cannot be renewed is left, obtained by logging in again.
+func (c *Client) Run(done <-chan bool) {
+	for {
+		c.mu.Lock()
+		secret := c.auth
+		c.mu.Unlock()
+		if secret.Auth.LeaseDuration == 0 || (!secret.Auth.Renewable && c.login == nil) {
+			// the token does not expire, or cannot be kept valid
+			return
+		}
+		if secret.Auth.Renewable {
+			err := c.renew(secret, done)
+			if err == errStopped {
+				return
+			}
+			if err != nil {
+				logger.Printf("error renewing the Vault token: %s", err)
+			}
+			if c.login == nil {
+				if err == nil {
+					// the token reached its maximum TTL
+					return
+				}
+				if !wait(done, retryInterval) {
+					return
+				}
+				continue
+			}
+		} else if !wait(done, time.Duration(secret.Auth.LeaseDuration)*time.Second/2) {
+			return
+		}
+		for {
+			err := c.Login()
+			if err == nil {
+				break
+			}
+			logger.Printf("%s", err)
+			if !wait(done, retryInterval) {
+				return
+			}
+		}
+	}
+}
+
+// errStopped is returned by renew when done was closed
+var errStopped = fmt.Errorf("stopped")
+
+// renew renews the token of the secret until it cannot be extended any more,
+// done is closed or renewing it failed
+func (c *Client) renew(secret *api.Secret, done <-chan bool) error {
+	renewer, err := c.client.NewRenewer(&api.RenewerInput{Secret: secret})
+	if err != nil {
+		return err
+	}
+	go renewer.Renew()
+	defer renewer.Stop()
+	for {
+		select {
+		case <-done:
+			return errStopped
+		case err := <-renewer.DoneCh():
+			return describe(err)
+		case renewal := <-renewer.RenewCh():
+			if renewal.Secret != nil && renewal.Secret.Auth != nil {
+				c.mu.Lock()
+				c.auth = renewal.Secret
+				c.mu.Unlock()
+			}
+		}
+	}
+}
+
+// wait waits for d, returning false if done was closed first
+func wait(done <-chan bool, d time.Duration) bool {
+	select {
+	case <-done:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// ReadKV reads a value of a KV version 2 secret given as
+// <mount>/<path>#<key>, e.g. secret/oauth2-proxy#client_secret
+func (c *Client) ReadKV(ref string) (string, error) {
+	mount, path, key, err := ParseKVRef(ref)
+	if err != nil {
+		return "", err
+	}
+	secret, err := c.client.Logical().Read(mount + "/data/" + path)
+	if err != nil {
+		return "", fmt.Errorf("error reading %s from Vault: %s", ref, describe(err))
+	}
+	if secret == nil {
+		return "", fmt.Errorf("error reading %s from Vault: no such secret", ref)
+	}
+	data, _ := secret.Data["data"].(map[string]interface{})
+	value, ok := data[key].(string)
+	if !ok {
+		return "", fmt.Errorf("error reading %s from Vault: no string value %q in the secret", ref, key)
+	}
+	return value, nil
+}
+
+// ParseKVRef splits a reference to a value of a KV version 2 secret of the
+// form <mount>/<path>#<key>
+func ParseKVRef(ref string) (mount, path, key string, err error) {
+	parts := strings.SplitN(ref, "#", 2)
+	segments := strings.SplitN(strings.Trim(parts[0], "/"), "/", 2)
+	if len(parts) != 2 || parts[1] == "" || len(segments) != 2 || segments[0] == "" || segments[1] == "" {
+		return "", "", "", fmt.Errorf("invalid Vault secret %q: must be of the form <mount>/<path>#<key>", ref)
+	}
+	return segments[0], segments[1], parts[1], nil
+}
+
+// Certificate is a TLS certificate issued by a PKI secrets engine, which is
+// issued again when a third of its lifetime is left
+type Certificate struct {
+	client     *Client
+	mount      string
+	role       string
+	commonName string
+	ttl        time.Duration
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	issued  time.Time
+	expires time.Time
+}
+
+// Certificate returns a certificate for the common name issued by the role of
+// the PKI secrets engine at mount, with the TTL of the role if ttl is 0
+func (c *Client) Certificate(mount, role, commonName string, ttl time.Duration) *Certificate {
+	return &Certificate{client: c, mount: mount, role: role, commonName: commonName, ttl: ttl}
+}
+
+// Issue issues the certificate
+func (cr *Certificate) Issue() error {
+	body := map[string]interface{}{"common_name": cr.commonName}
+	if cr.ttl > 0 {
+		body["ttl"] = cr.ttl.String()
+	}
+	secret, err := cr.client.client.Logical().Write(cr.mount+"/issue/"+cr.role, body)
+	if err != nil {
+		return fmt.Errorf("error issuing a certificate for %s from Vault: %s", cr.commonName, describe(err))
+	}
+	if secret == nil {
+		return fmt.Errorf("error issuing a certificate for %s from Vault: empty response", cr.commonName)
+	}
+	var data struct {
+		Certificate string      `json:"certificate"`
+		PrivateKey  string      `json:"private_key"`
+		CAChain     []string    `json:"ca_chain"`
+		IssuingCA   string      `json:"issuing_ca"`
+		Expiration  json.Number `json:"expiration"`
+	}
+	// the data of a secret is decoded into generic values, decode it again
+	// into the fields of an issued certificate
+	raw, err := json.Marshal(secret.Data)
+	if err == nil {
+		err = json.Unmarshal(raw, &data)
+	}
+	if err != nil {
+		return fmt.Errorf("error issuing a certificate for %s from Vault: %s", cr.commonName, err)
+	}
+	expiration, _ := data.Expiration.Int64()
+	chain := []string{data.Certificate}
+	if len(data.CAChain) > 0 {
+		chain = append(chain, data.CAChain...)
+	} else if data.IssuingCA != "" {
+		chain = append(chain, data.IssuingCA)
+	}
+	cert, err := tls.X509KeyPair([]byte(strings.Join(chain, "\n")), []byte(data.PrivateKey))
+	if err != nil {
+		return fmt.Errorf("error loading the certificate for %s issued by Vault: %s", cr.commonName, err)
+	}
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.cert = &cert
+	cr.issued = time.Now()
+	cr.expires = time.Unix(expiration, 0)
+	return nil
+}
+
+// GetCertificate returns the current certificate, for tls.Config
+func (cr *Certificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if cr.cert == nil {
+		return nil, fmt.Errorf("no certificate issued by Vault")
+	}
+	return cr.cert, nil
+}
+
+// Run issues the certificate again when a third of its lifetime is left,
+// until done is closed
+func (cr *Certificate) Run(done <-chan bool) {
+	for {
+		cr.mu.Lock()
+		renewAt := cr.expires.Add(-cr.expires.Sub(cr.issued) / 3)
+		cr.mu.Unlock()
+		if !wait(done, time.Until(renewAt)) {
+			return
+		}
+		if err := cr.Issue(); err != nil {
+			logger.Printf("%s", err)
+			if !wait(done, retryInterval) {
+				return
+			}
+		}
+	}
+}
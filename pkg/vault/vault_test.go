@@ -0,0 +1,194 @@
+package vault
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeVault answers the requests of a client, recording the tokens sent
+type fakeVault struct {
+	*httptest.Server
+	mu      sync.Mutex
+	tokens  []string
+	renewed int
+}
+
+func newFakeVault(t *testing.T) *fakeVault {
+	v := &fakeVault{}
+	v.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		v.mu.Lock()
+		defer v.mu.Unlock()
+		v.tokens = append(v.tokens, req.Header.Get("X-Vault-Token"))
+		var body map[string]interface{}
+		json.NewDecoder(req.Body).Decode(&body)
+		switch req.URL.Path {
+		case "/v1/auth/token/lookup-self":
+			rw.Write([]byte(`{"data": {"ttl": 3600, "renewable": true}}`))
+		case "/v1/auth/token/renew-self":
+			v.renewed++
+			rw.Write([]byte(`{"auth": {"client_token": "s.token", "lease_duration": 7200, "renewable": true}}`))
+		case "/v1/auth/k8s/login":
+			if body["role"] != "oauth2-proxy" || body["jwt"] != "service-account-jwt" {
+				rw.WriteHeader(400)
+				rw.Write([]byte(`{"errors": ["invalid role or service account"]}`))
+				return
+			}
+			rw.Write([]byte(`{"auth": {"client_token": "s.k8s", "lease_duration": 60, "renewable": false}}`))
+		case "/v1/secret/data/oauth2-proxy":
+			rw.Write([]byte(`{"data": {"data": {"client_secret": "s3cr3t"}, "metadata": {"version": 2}}}`))
+		case "/v1/pki/issue/oauth2-proxy":
+			assert.Equal(t, "proxy.example.com", body["common_name"])
+			assert.Equal(t, "24h0m0s", body["ttl"])
+			cert, key := selfSignedCertificate(t, body["common_name"].(string))
+			resp, _ := json.Marshal(map[string]interface{}{"data": map[string]interface{}{
+				"certificate": cert,
+				"private_key": key,
+				"expiration":  time.Now().Add(24 * time.Hour).Unix(),
+			}})
+			rw.Write(resp)
+		default:
+			rw.WriteHeader(404)
+			rw.Write([]byte(`{"errors": []}`))
+		}
+	}))
+	return v
+}
+
+func selfSignedCertificate(t *testing.T, commonName string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
+
+func TestParseKVRef(t *testing.T) {
+	mount, path, key, err := ParseKVRef("secret/apps/oauth2-proxy#client_secret")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"secret", "apps/oauth2-proxy", "client_secret"}, []string{mount, path, key})
+
+	for _, invalid := range []string{"secret/oauth2-proxy", "secret#key", "secret/oauth2-proxy#", "/oauth2-proxy#key"} {
+		_, _, _, err := ParseKVRef(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func (v *fakeVault) counts() ([]string, int) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return append([]string(nil), v.tokens...), v.renewed
+}
+
+func TestTokenClient(t *testing.T) {
+	v := newFakeVault(t)
+	defer v.Close()
+	c, err := NewTokenClient(v.URL+"/", "s.token")
+	assert.NoError(t, err)
+	assert.NoError(t, c.Login())
+	assert.True(t, c.auth.Auth.Renewable)
+	assert.Equal(t, 3600, c.auth.Auth.LeaseDuration)
+
+	value, err := c.ReadKV("secret/oauth2-proxy#client_secret")
+	assert.NoError(t, err)
+	assert.Equal(t, "s3cr3t", value)
+
+	_, err = c.ReadKV("secret/oauth2-proxy#cookie_secret")
+	assert.EqualError(t, err, `error reading secret/oauth2-proxy#cookie_secret from Vault: no string value "cookie_secret" in the secret`)
+	_, err = c.ReadKV("secret/other#client_secret")
+	assert.EqualError(t, err, "error reading secret/other#client_secret from Vault: no such secret")
+	tokens, _ := v.counts()
+	assert.Equal(t, []string{"s.token", "s.token", "s.token", "s.token"}, tokens)
+
+	// the token is renewed in the background until done is closed
+	done := make(chan bool)
+	stopped := make(chan bool)
+	go func() {
+		c.Run(done)
+		close(stopped)
+	}()
+	for i := 0; i < 100; i++ {
+		if _, renewed := v.counts(); renewed > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	_, renewed := v.counts()
+	assert.Equal(t, 1, renewed)
+	close(done)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Error("Run did not stop")
+	}
+	c.mu.Lock()
+	assert.Equal(t, 7200, c.auth.Auth.LeaseDuration)
+	c.mu.Unlock()
+}
+
+func TestKubernetesClient(t *testing.T) {
+	v := newFakeVault(t)
+	defer v.Close()
+	jwt, err := ioutil.TempFile("", "jwt")
+	assert.NoError(t, err)
+	defer os.Remove(jwt.Name())
+	jwt.WriteString("service-account-jwt\n")
+	jwt.Close()
+
+	c, err := NewKubernetesClient(v.URL, "k8s", "oauth2-proxy", jwt.Name())
+	assert.NoError(t, err)
+	assert.NoError(t, c.Login())
+	assert.Equal(t, "s.k8s", c.client.Token())
+	assert.False(t, c.auth.Auth.Renewable)
+
+	// logging in again does not send the previous token
+	assert.NoError(t, c.Login())
+	tokens, renewed := v.counts()
+	assert.Equal(t, 0, renewed)
+	assert.Equal(t, []string{"", ""}, tokens)
+
+	c, err = NewKubernetesClient(v.URL, "k8s", "other", jwt.Name())
+	assert.NoError(t, err)
+	assert.EqualError(t, c.Login(), "error logging in to Vault: got 400: invalid role or service account")
+}
+
+func TestCertificate(t *testing.T) {
+	v := newFakeVault(t)
+	defer v.Close()
+	c, err := NewTokenClient(v.URL, "s.token")
+	assert.NoError(t, err)
+	cr := c.Certificate("pki", "oauth2-proxy", "proxy.example.com", 24*time.Hour)
+	_, err = cr.GetCertificate(nil)
+	assert.Error(t, err)
+
+	assert.NoError(t, cr.Issue())
+	cert, err := cr.GetCertificate(nil)
+	assert.NoError(t, err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	assert.NoError(t, err)
+	assert.Equal(t, "proxy.example.com", leaf.Subject.CommonName)
+	assert.WithinDuration(t, time.Now().Add(24*time.Hour), cr.expires, time.Minute)
+}
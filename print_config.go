@@ -0,0 +1,86 @@
+package oauthproxy
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redacted replaces the values of secrets in the printed configuration
+const redacted = "(redacted)"
+
+// writeConfig writes the options to w in the config file format, one
+// "<cfg name> = <value>" line per option in the order of the Options struct.
+// The values of secrets and the user info and fragments of URLs are redacted.
+func writeConfig(w io.Writer, o *Options) {
+	fmt.Fprintln(w, "# effective configuration, secrets redacted")
+	writeConfigFields(w, reflect.ValueOf(o).Elem())
+}
+
+func writeConfigFields(w io.Writer, v reflect.Value) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			writeConfigFields(w, v.Field(i))
+			continue
+		}
+		name := field.Tag.Get("cfg")
+		if name == "" {
+			continue
+		}
+		fmt.Fprintf(w, "%s = %s\n", name, formatConfigValue(v.Field(i).Interface(), isSecretOption(name)))
+	}
+}
+
+// formatConfigValue formats an option value as a TOML value
+func formatConfigValue(value interface{}, secret bool) string {
+	switch value := value.(type) {
+	case string:
+		return strconv.Quote(redactConfigString(value, secret))
+	case time.Duration:
+		return strconv.Quote(value.String())
+	case []string:
+		quoted := make([]string, len(value))
+		for i, s := range value {
+			quoted[i] = strconv.Quote(redactConfigString(s, secret))
+		}
+		return "[" + strings.Join(quoted, ", ") + "]"
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+// redactConfigString redacts a set secret, or the user info and fragment of
+// a URL, which may hold credentials such as the upstream options
+func redactConfigString(s string, secret bool) string {
+	if s == "" {
+		return s
+	}
+	if secret {
+		return redacted
+	}
+	if !strings.Contains(s, "://") {
+		return s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return redacted
+	}
+	if u.User == nil && u.Fragment == "" {
+		return s
+	}
+	user, fragment := u.User != nil, u.Fragment != ""
+	u.User, u.Fragment = nil, ""
+	s = u.String()
+	if user {
+		s = strings.Replace(s, "://", "://"+redacted+"@", 1)
+	}
+	if fragment {
+		s += "#" + redacted
+	}
+	return s
+}
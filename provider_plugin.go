@@ -0,0 +1,27 @@
+package oauthproxy
+
+import (
+	"fmt"
+	"plugin"
+
+	"github.com/OpusCapita/oauth2_proxy/logger"
+	"github.com/OpusCapita/oauth2_proxy/providers"
+)
+
+// loadProviderPlugins opens the Go plugins of the provider-plugin option,
+// whose init functions register their providers with providers.Register, and
+// checks that the configured provider exists. Opening a plugin again, e.g.
+// when the configuration is reloaded, returns the already loaded plugin.
+func loadProviderPlugins(o *Options, msgs []string) []string {
+	for _, path := range o.ProviderPlugins {
+		if _, err := plugin.Open(path); err != nil {
+			msgs = append(msgs, fmt.Sprintf("error loading provider-plugin %s: %s", path, err))
+			continue
+		}
+		logger.Printf("loaded provider plugin %s", path)
+	}
+	if !providers.Registered(o.Provider) {
+		msgs = append(msgs, fmt.Sprintf("unknown provider %q", o.Provider))
+	}
+	return msgs
+}
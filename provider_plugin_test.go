@@ -0,0 +1,20 @@
+package oauthproxy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadProviderPlugins(t *testing.T) {
+	o := testOptions()
+	assert.Empty(t, loadProviderPlugins(o, nil))
+
+	o.Provider = "bespoke"
+	o.ProviderPlugins = []string{"/nonexistent/bespoke.so"}
+	msgs := loadProviderPlugins(o, nil)
+	assert.Len(t, msgs, 2)
+	assert.True(t, strings.HasPrefix(msgs[0], "error loading provider-plugin /nonexistent/bespoke.so: "), msgs[0])
+	assert.Equal(t, `unknown provider "bespoke"`, msgs[1])
+}
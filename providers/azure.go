@@ -1,10 +1,13 @@
 package providers
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
 
 	"github.com/bitly/go-simplejson"
 	"github.com/OpusCapita/oauth2_proxy/api"
@@ -88,6 +91,26 @@ func getEmailFromJSON(json *simplejson.Json) (string, error) {
 	return email, err
 }
 
+// tenantFromAccessToken returns the tid claim of an Azure AD access token.
+// The token was just received from the token endpoint, so it is not verified.
+func tenantFromAccessToken(accessToken string) string {
+	parts := strings.Split(accessToken, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return ""
+	}
+	var claims struct {
+		Tenant string `json:"tid"`
+	}
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return ""
+	}
+	return claims.Tenant
+}
+
 // GetEmailAddress returns the Account email address
 func (p *AzureProvider) GetEmailAddress(s *sessions.SessionState) (string, error) {
 	var email string
@@ -96,6 +119,7 @@ func (p *AzureProvider) GetEmailAddress(s *sessions.SessionState) (string, error
 	if s.AccessToken == "" {
 		return "", errors.New("missing access token")
 	}
+	s.Tenant = tenantFromAccessToken(s.AccessToken)
 	req, err := http.NewRequest("GET", p.ProfileURL.String(), nil)
 	if err != nil {
 		return "", err
@@ -1,6 +1,7 @@
 package providers
 
 import (
+	"encoding/base64"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -199,3 +200,10 @@ func TestAzureProviderGetEmailAddressIncorrectOtherMails(t *testing.T) {
 	assert.Equal(t, "type assertion to string failed", err.Error())
 	assert.Equal(t, "", email)
 }
+
+func TestAzureTenantFromAccessToken(t *testing.T) {
+	claims := base64.RawURLEncoding.EncodeToString([]byte(`{"tid": "9188040d-6c67-4c5b-b112-36a304b66dad"}`))
+	assert.Equal(t, "9188040d-6c67-4c5b-b112-36a304b66dad", tenantFromAccessToken("header."+claims+".signature"))
+	assert.Equal(t, "", tenantFromAccessToken("imaginary_access_token"))
+	assert.Equal(t, "", tenantFromAccessToken("header.!.signature"))
+}
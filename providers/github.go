@@ -19,6 +19,18 @@ type GitHubProvider struct {
 	*ProviderData
 	Org  string
 	Team string
+	// LoadGroups sets the groups of sessions to the organizations of the
+	// user and their teams as org/team-slug
+	LoadGroups bool
+}
+
+// gitHubTeam is a team as listed by the GitHub API
+type gitHubTeam struct {
+	Name string `json:"name"`
+	Slug string `json:"slug"`
+	Org  struct {
+		Login string `json:"login"`
+	} `json:"organization"`
 }
 
 // NewGitHubProvider initiates a new GitHubProvider
@@ -61,13 +73,39 @@ func (p *GitHubProvider) SetOrgTeam(org, team string) {
 	}
 }
 
+// SetLoadGroups makes the provider load the organizations and teams of the
+// user as the groups of the session, adding the scope needed to read them
+func (p *GitHubProvider) SetLoadGroups() {
+	p.LoadGroups = true
+	if !strings.Contains(p.Scope, "read:org") {
+		p.Scope += " read:org"
+	}
+}
+
 func (p *GitHubProvider) hasOrg(accessToken string) (bool, error) {
-	// https://developer.github.com/v3/orgs/#list-your-organizations
+	orgs, err := p.listOrgs(accessToken)
+	if err != nil {
+		return false, err
+	}
 
-	var orgs []struct {
-		Login string `json:"login"`
+	var presentOrgs []string
+	for _, org := range orgs {
+		if p.Org == org {
+			logger.Printf("Found Github Organization: %q", org)
+			return true, nil
+		}
+		presentOrgs = append(presentOrgs, org)
 	}
 
+	logger.Printf("Missing Organization:%q in %v", p.Org, presentOrgs)
+	return false, nil
+}
+
+func (p *GitHubProvider) listOrgs(accessToken string) ([]string, error) {
+	// https://developer.github.com/v3/orgs/#list-your-organizations
+
+	var orgs []string
+
 	type orgsPage []struct {
 		Login string `json:"login"`
 	}
@@ -90,55 +128,74 @@ func (p *GitHubProvider) hasOrg(accessToken string) (bool, error) {
 		req.Header.Set("Authorization", fmt.Sprintf("token %s", accessToken))
 		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
-			return false, err
+			return nil, err
 		}
 
 		body, err := ioutil.ReadAll(resp.Body)
 		resp.Body.Close()
 		if err != nil {
-			return false, err
+			return nil, err
 		}
 		if resp.StatusCode != 200 {
-			return false, fmt.Errorf(
+			return nil, fmt.Errorf(
 				"got %d from %q %s", resp.StatusCode, endpoint.String(), body)
 		}
 
 		var op orgsPage
 		if err := json.Unmarshal(body, &op); err != nil {
-			return false, err
+			return nil, err
 		}
 		if len(op) == 0 {
 			break
 		}
 
-		orgs = append(orgs, op...)
+		for _, org := range op {
+			orgs = append(orgs, org.Login)
+		}
 		pn++
 	}
+	return orgs, nil
+}
+
+func (p *GitHubProvider) hasOrgAndTeam(accessToken string) (bool, error) {
+	teams, err := p.listTeams(accessToken)
+	if err != nil {
+		return false, err
+	}
 
-	var presentOrgs []string
-	for _, org := range orgs {
-		if p.Org == org.Login {
-			logger.Printf("Found Github Organization: %q", org.Login)
-			return true, nil
+	var hasOrg bool
+	presentOrgs := make(map[string]bool)
+	var presentTeams []string
+	for _, team := range teams {
+		presentOrgs[team.Org.Login] = true
+		if p.Org == team.Org.Login {
+			hasOrg = true
+			ts := strings.Split(p.Team, ",")
+			for _, t := range ts {
+				if t == team.Slug {
+					logger.Printf("Found Github Organization:%q Team:%q (Name:%q)", team.Org.Login, team.Slug, team.Name)
+					return true, nil
+				}
+			}
+			presentTeams = append(presentTeams, team.Slug)
 		}
-		presentOrgs = append(presentOrgs, org.Login)
 	}
-
-	logger.Printf("Missing Organization:%q in %v", p.Org, presentOrgs)
+	if hasOrg {
+		logger.Printf("Missing Team:%q from Org:%q in teams: %v", p.Team, p.Org, presentTeams)
+	} else {
+		var allOrgs []string
+		for org := range presentOrgs {
+			allOrgs = append(allOrgs, org)
+		}
+		logger.Printf("Missing Organization:%q in %#v", p.Org, allOrgs)
+	}
 	return false, nil
 }
 
-func (p *GitHubProvider) hasOrgAndTeam(accessToken string) (bool, error) {
+func (p *GitHubProvider) listTeams(accessToken string) ([]gitHubTeam, error) {
 	// https://developer.github.com/v3/orgs/teams/#list-user-teams
 
-	var teams []struct {
-		Name string `json:"name"`
-		Slug string `json:"slug"`
-		Org  struct {
-			Login string `json:"login"`
-		} `json:"organization"`
-	}
-
+	var teams []gitHubTeam
 	params := url.Values{
 		"limit": {"200"},
 	}
@@ -154,50 +211,40 @@ func (p *GitHubProvider) hasOrgAndTeam(accessToken string) (bool, error) {
 	req.Header.Set("Authorization", fmt.Sprintf("token %s", accessToken))
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
 	resp.Body.Close()
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 	if resp.StatusCode != 200 {
-		return false, fmt.Errorf(
+		return nil, fmt.Errorf(
 			"got %d from %q %s", resp.StatusCode, endpoint.String(), body)
 	}
 
 	if err := json.Unmarshal(body, &teams); err != nil {
-		return false, fmt.Errorf("%s unmarshaling %s", err, body)
+		return nil, fmt.Errorf("%s unmarshaling %s", err, body)
 	}
+	return teams, nil
+}
 
-	var hasOrg bool
-	presentOrgs := make(map[string]bool)
-	var presentTeams []string
-	for _, team := range teams {
-		presentOrgs[team.Org.Login] = true
-		if p.Org == team.Org.Login {
-			hasOrg = true
-			ts := strings.Split(p.Team, ",")
-			for _, t := range ts {
-				if t == team.Slug {
-					logger.Printf("Found Github Organization:%q Team:%q (Name:%q)", team.Org.Login, team.Slug, team.Name)
-					return true, nil
-				}
-			}
-			presentTeams = append(presentTeams, team.Slug)
-		}
+// groups lists the organizations of the user followed by their teams as
+// org/team-slug
+func (p *GitHubProvider) groups(accessToken string) ([]string, error) {
+	groups, err := p.listOrgs(accessToken)
+	if err != nil {
+		return nil, err
 	}
-	if hasOrg {
-		logger.Printf("Missing Team:%q from Org:%q in teams: %v", p.Team, p.Org, presentTeams)
-	} else {
-		var allOrgs []string
-		for org := range presentOrgs {
-			allOrgs = append(allOrgs, org)
-		}
-		logger.Printf("Missing Organization:%q in %#v", p.Org, allOrgs)
+	teams, err := p.listTeams(accessToken)
+	if err != nil {
+		return nil, err
 	}
-	return false, nil
+	for _, team := range teams {
+		groups = append(groups, team.Org.Login+"/"+team.Slug)
+	}
+	return groups, nil
 }
 
 // GetEmailAddress returns the Account email address
@@ -222,6 +269,14 @@ func (p *GitHubProvider) GetEmailAddress(s *sessions.SessionState) (string, erro
 		}
 	}
 
+	if p.LoadGroups {
+		groups, err := p.groups(s.AccessToken)
+		if err != nil {
+			logger.Printf("failed to load the Github groups of the user: %s", err)
+		}
+		s.Groups = groups
+	}
+
 	endpoint := &url.URL{
 		Scheme: p.ValidateURL.Scheme,
 		Host:   p.ValidateURL.Host,
@@ -244,8 +299,6 @@ func (p *GitHubProvider) GetEmailAddress(s *sessions.SessionState) (string, erro
 			resp.StatusCode, endpoint.String(), body)
 	}
 
-	logger.Printf("got %d from %q %s", resp.StatusCode, endpoint.String(), body)
-
 	if err := json.Unmarshal(body, &emails); err != nil {
 		return "", fmt.Errorf("%s unmarshaling %s", err, body)
 	}
@@ -294,8 +347,6 @@ func (p *GitHubProvider) GetUserName(s *sessions.SessionState) (string, error) {
 			resp.StatusCode, endpoint.String(), body)
 	}
 
-	logger.Printf("got %d from %q %s", resp.StatusCode, endpoint.String(), body)
-
 	if err := json.Unmarshal(body, &user); err != nil {
 		return "", fmt.Errorf("%s unmarshaling %s", err, body)
 	}
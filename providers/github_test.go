@@ -184,3 +184,33 @@ func TestGitHubProviderGetUserName(t *testing.T) {
 	assert.Equal(t, nil, err)
 	assert.Equal(t, "mbland", email)
 }
+
+func TestGitHubProviderGetEmailAddressLoadsGroups(t *testing.T) {
+	b := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.URL.Path == "/user/orgs" && r.URL.RawQuery == "limit=200&page=1":
+				w.Write([]byte(`[ {"login": "acme"}, {"login": "other"} ]`))
+			case r.URL.Path == "/user/orgs":
+				w.Write([]byte(`[ ]`))
+			case r.URL.Path == "/user/teams":
+				w.Write([]byte(`[ {"name": "SRE", "slug": "sre", "organization": {"login": "acme"}} ]`))
+			case r.URL.Path == "/user/emails":
+				w.Write([]byte(`[ {"email": "michael.bland@gsa.gov", "primary": true, "verified": true} ]`))
+			default:
+				w.WriteHeader(404)
+			}
+		}))
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testGitHubProvider(bURL.Host)
+	p.SetLoadGroups()
+	assert.Equal(t, "user:email read:org", p.Data().Scope)
+
+	session := &sessions.SessionState{AccessToken: "imaginary_access_token"}
+	email, err := p.GetEmailAddress(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "michael.bland@gsa.gov", email)
+	assert.Equal(t, []string{"acme", "other", "acme/sre"}, session.Groups)
+}
@@ -21,9 +21,6 @@ import (
 type LoginGovProvider struct {
 	*ProviderData
 
-	// TODO (@timothy-spencer): Ideally, the nonce would be in the session state, but the session state
-	// is created only upon code redemption, not during the auth, when this must be supplied.
-	Nonce     string
 	AcrValues string
 	JWTKey    *rsa.PrivateKey
 	PubJWKURL *url.URL
@@ -69,10 +66,7 @@ func NewLoginGovProvider(p *ProviderData) *LoginGovProvider {
 		p.Scope = "email openid"
 	}
 
-	return &LoginGovProvider{
-		ProviderData: p,
-		Nonce:        randSeq(32),
-	}
+	return &LoginGovProvider{ProviderData: p}
 }
 
 type loginGovCustomClaims struct {
@@ -89,7 +83,10 @@ type loginGovCustomClaims struct {
 }
 
 // checkNonce checks the nonce in the id_token
-func checkNonce(idToken string, p *LoginGovProvider) (err error) {
+func checkNonce(idToken string, p *LoginGovProvider, nonce string) (err error) {
+	if nonce == "" {
+		return errors.New("no nonce to check the id_token against")
+	}
 	token, err := jwt.ParseWithClaims(idToken, &loginGovCustomClaims{}, func(token *jwt.Token) (interface{}, error) {
 		resp, myerr := http.Get(p.PubJWKURL.String())
 		if myerr != nil {
@@ -119,7 +116,7 @@ func checkNonce(idToken string, p *LoginGovProvider) (err error) {
 	}
 
 	claims := token.Claims.(*loginGovCustomClaims)
-	if claims.Nonce != p.Nonce {
+	if claims.Nonce != nonce {
 		err = fmt.Errorf("nonce validation failed")
 		return
 	}
@@ -173,8 +170,15 @@ func emailFromUserInfo(accessToken string, userInfoEndpoint string) (email strin
 	return
 }
 
-// Redeem exchanges the OAuth2 authentication token for an ID token
+// Redeem exchanges the OAuth2 authentication token for an ID token. It fails
+// as there is no nonce to check the ID token against, use RedeemWithNonce.
 func (p *LoginGovProvider) Redeem(redirectURL, code string) (s *sessions.SessionState, err error) {
+	return p.RedeemWithNonce(redirectURL, code, "")
+}
+
+// RedeemWithNonce exchanges the OAuth2 authentication token for an ID token
+// carrying the nonce sent with the login
+func (p *LoginGovProvider) RedeemWithNonce(redirectURL, code, nonce string) (s *sessions.SessionState, err error) {
 	if code == "" {
 		err = errors.New("missing code")
 		return
@@ -236,7 +240,7 @@ func (p *LoginGovProvider) Redeem(redirectURL, code string) (s *sessions.Session
 	}
 
 	// check nonce here
-	err = checkNonce(jsonResponse.IDToken, p)
+	err = checkNonce(jsonResponse.IDToken, p, nonce)
 	if err != nil {
 		return
 	}
@@ -259,8 +263,15 @@ func (p *LoginGovProvider) Redeem(redirectURL, code string) (s *sessions.Session
 	return
 }
 
-// GetLoginURL overrides GetLoginURL to add login.gov parameters
+// GetLoginURL overrides GetLoginURL to add login.gov parameters. login.gov
+// requires a nonce, use GetLoginURLWithNonce.
 func (p *LoginGovProvider) GetLoginURL(redirectURI, state string) string {
+	return p.GetLoginURLWithNonce(redirectURI, state, "")
+}
+
+// GetLoginURLWithNonce returns the login URL with the login.gov parameters
+// and the nonce to be returned in the ID token
+func (p *LoginGovProvider) GetLoginURLWithNonce(redirectURI, state, nonce string) string {
 	var a url.URL
 	a = *p.LoginURL
 	params, _ := url.ParseQuery(a.RawQuery)
@@ -271,7 +282,7 @@ func (p *LoginGovProvider) GetLoginURL(redirectURI, state string) string {
 	params.Set("response_type", "code")
 	params.Add("state", state)
 	params.Add("acr_values", p.AcrValues)
-	params.Add("nonce", p.Nonce)
+	params.Add("nonce", nonce)
 	a.RawQuery = params.Encode()
 	return a.String()
 }
@@ -60,7 +60,6 @@ func newLoginGovProvider() (l *LoginGovProvider, serverKey *MyKeyData, err error
 			ValidateURL:  &url.URL{},
 			Scope:        ""})
 	l.JWTKey = privateKey
-	l.Nonce = "fakenonce"
 	return
 }
 
@@ -189,7 +188,7 @@ func TestLoginGovProviderSessionData(t *testing.T) {
 	p.PubJWKURL, pubjwkserver = newLoginGovServer(pubjwkbody)
 	defer pubjwkserver.Close()
 
-	session, err := p.Redeem("http://redirect/", "code1234")
+	session, err := p.RedeemWithNonce("http://redirect/", "code1234", "fakenonce")
 	assert.NoError(t, err)
 	assert.NotEqual(t, session, nil)
 	assert.Equal(t, "timothy.spencer@gsa.gov", session.Email)
@@ -283,7 +282,7 @@ func TestLoginGovProviderBadNonce(t *testing.T) {
 	p.PubJWKURL, pubjwkserver = newLoginGovServer(pubjwkbody)
 	defer pubjwkserver.Close()
 
-	_, err = p.Redeem("http://redirect/", "code1234")
+	_, err = p.RedeemWithNonce("http://redirect/", "code1234", "fakenonce")
 
 	// The "badfakenonce" in the idtoken above should cause this to error out
 	assert.Error(t, err)
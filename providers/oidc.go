@@ -90,6 +90,15 @@ func (p *OIDCProvider) redeemRefreshToken(s *sessions.SessionState) (err error)
 	s.CreatedAt = newSession.CreatedAt
 	s.ExpiresOn = newSession.ExpiresOn
 	s.Email = newSession.Email
+	if newSession.ACR != "" {
+		s.ACR = newSession.ACR
+	}
+	if newSession.Groups != nil {
+		s.Groups = newSession.Groups
+	}
+	if newSession.Tenant != "" {
+		s.Tenant = newSession.Tenant
+	}
 	return
 }
 
@@ -107,9 +116,12 @@ func (p *OIDCProvider) createSessionState(ctx context.Context, token *oauth2.Tok
 
 	// Extract custom claims.
 	var claims struct {
-		Subject  string `json:"sub"`
-		Email    string `json:"email"`
-		Verified *bool  `json:"email_verified"`
+		Subject  string   `json:"sub"`
+		Email    string   `json:"email"`
+		Verified *bool    `json:"email_verified"`
+		ACR      string   `json:"acr"`
+		Groups   []string `json:"groups"`
+		Tenant   string   `json:"tid"`
 	}
 	if err := idToken.Claims(&claims); err != nil {
 		return nil, fmt.Errorf("failed to parse id_token claims: %v", err)
@@ -131,6 +143,9 @@ func (p *OIDCProvider) createSessionState(ctx context.Context, token *oauth2.Tok
 		ExpiresOn:    idToken.Expiry,
 		Email:        claims.Email,
 		User:         claims.Subject,
+		ACR:          claims.ACR,
+		Groups:       claims.Groups,
+		Tenant:       claims.Tenant,
 	}, nil
 }
 
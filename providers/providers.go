@@ -1,6 +1,9 @@
 package providers
 
 import (
+	"fmt"
+	"sync"
+
 	"github.com/OpusCapita/oauth2_proxy/cookie"
 	"github.com/OpusCapita/oauth2_proxy/pkg/apis/sessions"
 )
@@ -19,8 +22,52 @@ type Provider interface {
 	CookieForSession(*sessions.SessionState, *cookie.Cipher) (string, error)
 }
 
+// NonceProvider is implemented by providers binding the ID token to the
+// login with a nonce. The proxy creates a nonce for each login and keeps it
+// in the OAuth2 state until the callback.
+type NonceProvider interface {
+	GetLoginURLWithNonce(redirectURI, finalRedirect, nonce string) string
+	RedeemWithNonce(redirectURI, code, nonce string) (*sessions.SessionState, error)
+}
+
+// builtin are the names of the providers implemented in this package
+var builtin = map[string]bool{"google": true, "linkedin": true, "facebook": true, "github": true, "azure": true,
+	"gitlab": true, "oidc": true, "login.gov": true}
+
+var (
+	registeredMu sync.RWMutex
+	registered   = map[string]func(*ProviderData) Provider{}
+)
+
+// Register makes an out-of-tree provider available under name, creating it
+// with constructor from the provider data of the configuration. It is meant
+// to be called by the init function of the package implementing the
+// provider, compiled into the proxy or loaded as a Go plugin. Register
+// panics if name is taken by a built in or another registered provider.
+func Register(name string, constructor func(*ProviderData) Provider) {
+	registeredMu.Lock()
+	defer registeredMu.Unlock()
+	if builtin[name] || registered[name] != nil {
+		panic(fmt.Sprintf("providers: provider %q is already registered", name))
+	}
+	registered[name] = constructor
+}
+
+// Registered returns whether name is a built in or registered provider
+func Registered(name string) bool {
+	registeredMu.RLock()
+	defer registeredMu.RUnlock()
+	return builtin[name] || registered[name] != nil
+}
+
 // New provides a new Provider based on the configured provider string
 func New(provider string, p *ProviderData) Provider {
+	registeredMu.RLock()
+	constructor := registered[provider]
+	registeredMu.RUnlock()
+	if constructor != nil {
+		return constructor(p)
+	}
 	switch provider {
 	case "linkedin":
 		return NewLinkedInProvider(p)
@@ -0,0 +1,28 @@
+package providers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testRegisteredProvider struct {
+	*ProviderData
+}
+
+func TestRegister(t *testing.T) {
+	assert.False(t, Registered("test-idp"))
+	Register("test-idp", func(p *ProviderData) Provider {
+		p.ProviderName = "Test IdP"
+		return &testRegisteredProvider{p}
+	})
+	assert.True(t, Registered("test-idp"))
+	assert.True(t, Registered("oidc"))
+
+	p := New("test-idp", &ProviderData{})
+	assert.IsType(t, &testRegisteredProvider{}, p)
+	assert.Equal(t, "Test IdP", p.Data().ProviderName)
+
+	assert.Panics(t, func() { Register("test-idp", nil) })
+	assert.Panics(t, func() { Register("github", nil) })
+}
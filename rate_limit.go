@@ -0,0 +1,168 @@
+package oauthproxy
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OpusCapita/oauth2_proxy/logger"
+	sessionsapi "github.com/OpusCapita/oauth2_proxy/pkg/apis/sessions"
+)
+
+// maxRateLimitBuckets bounds the number of buckets kept before full ones are
+// dropped
+const maxRateLimitBuckets = 10000
+
+// rateLimit allows a burst of requests which is refilled at the same number
+// of requests per period
+type rateLimit struct {
+	burst  float64
+	period time.Duration
+}
+
+// parseRateLimit parses a rate such as 10/s, 100/m or 1000/h
+func parseRateLimit(s string) (rateLimit, error) {
+	parts := strings.SplitN(s, "/", 2)
+	n, err := strconv.Atoi(parts[0])
+	if len(parts) != 2 || err != nil || n < 1 {
+		return rateLimit{}, fmt.Errorf("must be of the form <requests>/s, /m or /h")
+	}
+	period, ok := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}[parts[1]]
+	if !ok {
+		return rateLimit{}, fmt.Errorf("must be of the form <requests>/s, /m or /h")
+	}
+	return rateLimit{burst: float64(n), period: period}, nil
+}
+
+// rateLimitRoute is a rate limit for the paths matching a pattern
+type rateLimitRoute struct {
+	pattern *regexp.Regexp
+	limit   rateLimit
+}
+
+// tokenBucket holds the requests a user may still make
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter limits the requests of each user to the upstreams with token
+// buckets: one for the first rate limit route matching the path, otherwise
+// one for the global rate limit
+type rateLimiter struct {
+	global *rateLimit
+	routes []rateLimitRoute
+	now    func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// parseRateLimits parses the rate-limit and rate-limit-route options
+func parseRateLimits(o *Options, msgs []string) (*rateLimiter, []string) {
+	r := &rateLimiter{now: time.Now, buckets: make(map[string]*tokenBucket)}
+	if o.RateLimit != "" {
+		limit, err := parseRateLimit(o.RateLimit)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("invalid rate-limit %q: %s", o.RateLimit, err))
+		} else {
+			r.global = &limit
+		}
+	}
+	for _, spec := range o.RateLimitRoutes {
+		i := strings.LastIndex(spec, "=")
+		if i < 1 {
+			msgs = append(msgs, fmt.Sprintf("invalid rate-limit-route %q: must be of the form pattern=rate", spec))
+			continue
+		}
+		limit, err := parseRateLimit(spec[i+1:])
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("invalid rate-limit-route %q: %s", spec, err))
+			continue
+		}
+		pattern, err := regexp.Compile(spec[:i])
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("error compiling rate-limit-route %q: %s", spec, err))
+			continue
+		}
+		r.routes = append(r.routes, rateLimitRoute{pattern: pattern, limit: limit})
+	}
+	if r.global == nil && len(r.routes) == 0 {
+		return nil, msgs
+	}
+	return r, msgs
+}
+
+// Take takes a token for a request of the user for path from the bucket
+// applying to it. It returns how long the user has to wait for the next
+// token if the bucket is empty, and 0 if the request may go ahead.
+func (r *rateLimiter) Take(user, path string) time.Duration {
+	if r == nil {
+		return 0
+	}
+	limit, key := r.global, "*"
+	for i, route := range r.routes {
+		if route.pattern.MatchString(path) {
+			limit, key = &r.routes[i].limit, strconv.Itoa(i)
+			break
+		}
+	}
+	if limit == nil {
+		return 0
+	}
+	key += " " + user
+	rate := limit.burst / float64(limit.period)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	b, ok := r.buckets[key]
+	if !ok {
+		if len(r.buckets) >= maxRateLimitBuckets {
+			r.dropFullBuckets(now)
+		}
+		b = &tokenBucket{tokens: limit.burst, last: now}
+		r.buckets[key] = b
+	}
+	b.tokens = math.Min(limit.burst, b.tokens+float64(now.Sub(b.last))*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration(math.Ceil((1 - b.tokens) / rate))
+	}
+	b.tokens--
+	return 0
+}
+
+// dropFullBuckets forgets the buckets idle for the longest period, which
+// have refilled and so are the same as new ones
+func (r *rateLimiter) dropFullBuckets(now time.Time) {
+	for key, b := range r.buckets {
+		if now.Sub(b.last) > time.Hour {
+			delete(r.buckets, key)
+		}
+	}
+}
+
+// rateLimitWait returns how long the user of the session has to wait before
+// making a request with method for path, or 0 if they have not made too many
+func (p *OAuthProxy) rateLimitWait(req *http.Request, method, path string, s *sessionsapi.SessionState) time.Duration {
+	user := s.Email
+	if user == "" {
+		user = s.User
+	}
+	wait := p.rateLimits.Take(user, path)
+	if wait > 0 {
+		logger.PrintAuthf(s.Email, req, logger.AuthFailure, "Rate limit exceeded for %s %s", method, path)
+	}
+	return wait
+}
+
+// retryAfter formats a wait as the value of a Retry-After header
+func retryAfter(wait time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(wait.Seconds())))
+}
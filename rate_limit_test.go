@@ -0,0 +1,76 @@
+package oauthproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRateLimits(t *testing.T) {
+	o := NewOptions()
+	o.RateLimit = "10/s"
+	o.RateLimitRoutes = []string{"^/api/export=5/m"}
+	r, msgs := parseRateLimits(o, nil)
+	assert.Empty(t, msgs)
+	assert.Equal(t, rateLimit{burst: 10, period: time.Second}, *r.global)
+	assert.Equal(t, rateLimit{burst: 5, period: time.Minute}, r.routes[0].limit)
+
+	o.RateLimit = "10"
+	o.RateLimitRoutes = []string{"^/api=0/s", "^/x=1/d", "(=1/s", "10/s"}
+	_, msgs = parseRateLimits(o, nil)
+	assert.Len(t, msgs, 5)
+
+	o.RateLimit = ""
+	o.RateLimitRoutes = nil
+	r, msgs = parseRateLimits(o, nil)
+	assert.Nil(t, r)
+	assert.Empty(t, msgs)
+}
+
+func TestRateLimiter(t *testing.T) {
+	o := NewOptions()
+	o.RateLimit = "2/s"
+	o.RateLimitRoutes = []string{"^/export=1/m"}
+	r, _ := parseRateLimits(o, nil)
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	assert.Equal(t, time.Duration(0), r.Take("jane", "/"))
+	assert.Equal(t, time.Duration(0), r.Take("jane", "/"))
+	assert.Equal(t, 500*time.Millisecond, r.Take("jane", "/"))
+	// users and routes have their own buckets
+	assert.Equal(t, time.Duration(0), r.Take("john", "/"))
+	assert.Equal(t, time.Duration(0), r.Take("jane", "/export"))
+	assert.Equal(t, time.Minute, r.Take("jane", "/export"))
+
+	now = now.Add(500 * time.Millisecond)
+	assert.Equal(t, time.Duration(0), r.Take("jane", "/"))
+	assert.NotEqual(t, time.Duration(0), r.Take("jane", "/"))
+}
+
+func TestRateLimitedProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream"))
+	}))
+	defer upstream.Close()
+
+	opts := NewOptions()
+	opts.Upstreams = []string{upstream.URL}
+	opts.CookieSecret = "foobar"
+	opts.DevFakeIdentity = "jane@example.com"
+	opts.RateLimit = "1/h"
+	assert.NoError(t, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(email string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.Equal(t, "3600", rw.Header().Get("Retry-After"))
+}
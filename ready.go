@@ -0,0 +1,33 @@
+package oauthproxy
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// ReadyPage responds 200 OK once the proxy is able to sign users in and
+// 503 Service Unavailable before that
+func (p *OAuthProxy) ReadyPage(rw http.ResponseWriter) {
+	if !p.isReady() {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(rw, "Not Ready")
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+	fmt.Fprintf(rw, "OK")
+}
+
+// isReady checks that the templates are loaded and the provider and session
+// store can be reached. Once they could, the proxy stays ready and failures
+// are only reported by the health endpoint.
+func (p *OAuthProxy) isReady() bool {
+	if atomic.LoadInt32(&p.ready) == 1 {
+		return true
+	}
+	if p.templates == nil || p.checkProvider() != nil || p.checkSessionStore() != nil {
+		return false
+	}
+	atomic.StoreInt32(&p.ready, 1)
+	return true
+}
@@ -0,0 +1,122 @@
+package oauthproxy
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// reloadableHandler serves requests with the most recently stored handler,
+// allowing the configuration to be reloaded without restarting the listeners
+type reloadableHandler struct {
+	handler atomic.Value
+	proxy   atomic.Value
+}
+
+// Store replaces the handler used for new requests, and the proxy it was
+// built from. Requests already being served finish with the previous handler.
+func (h *reloadableHandler) Store(handler http.Handler, proxy *OAuthProxy) {
+	h.proxy.Store(proxy)
+	h.handler.Store(handler)
+}
+
+// Proxy returns the proxy of the most recently stored handler
+func (h *reloadableHandler) Proxy() *OAuthProxy {
+	return h.proxy.Load().(*OAuthProxy)
+}
+
+func (h *reloadableHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	h.handler.Load().(http.Handler).ServeHTTP(rw, req)
+}
+
+// reloadConfiguration reloads the configuration as on SIGHUP
+var reloadConfiguration = func() {
+	if p, err := os.FindProcess(os.Getpid()); err == nil {
+		p.Signal(syscall.SIGHUP)
+	}
+}
+
+// configReloadDelay is how long to wait for further changes after a config
+// file changed before reloading, as editors and Kubernetes write files in
+// several steps
+var configReloadDelay = time.Second
+
+// watchConfig reloads the configuration when the config file or a file of
+// the drop-in config directory changes
+func watchConfig(config, configDir string) {
+	var mu sync.Mutex
+	var timer *time.Timer
+	reload := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if timer != nil {
+			timer.Stop()
+		}
+		timer = time.AfterFunc(configReloadDelay, reloadConfiguration)
+	}
+	for _, path := range []string{config, configDir} {
+		if path != "" {
+			watchFile(path, nil, reload)
+		}
+	}
+}
+
+// secretOption matches the cfg names of options whose values are not logged
+var secretOption = regexp.MustCompile(`secret|password|(^|_)token$|_key$|dsn|connection_url|_webhook_url$`)
+
+// isSecretOption returns whether the values of the option are hidden. The
+// paths of files holding secrets are not.
+func isSecretOption(name string) bool {
+	return secretOption.MatchString(name) && !strings.HasSuffix(name, "_file")
+}
+
+// configChanges lists the options which differ between two configurations
+// as "<cfg name>: <old value> => <new value>", hiding the values of secrets
+// and the user info and fragments of URLs
+func configChanges(old, new *Options) []string {
+	return appendConfigChanges(nil, reflect.ValueOf(old).Elem(), reflect.ValueOf(new).Elem())
+}
+
+func appendConfigChanges(changes []string, old, new reflect.Value) []string {
+	for i := 0; i < old.NumField(); i++ {
+		field := old.Type().Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			changes = appendConfigChanges(changes, old.Field(i), new.Field(i))
+			continue
+		}
+		name := field.Tag.Get("cfg")
+		if name == "" || reflect.DeepEqual(old.Field(i).Interface(), new.Field(i).Interface()) {
+			continue
+		}
+		kind := field.Type.Kind()
+		if isSecretOption(name) && (kind == reflect.String || kind == reflect.Slice) {
+			changes = append(changes, fmt.Sprintf("%s: (secret changed)", name))
+			continue
+		}
+		changes = append(changes, fmt.Sprintf("%s: %v => %v", name, redactConfigValue(old.Field(i).Interface()), redactConfigValue(new.Field(i).Interface())))
+	}
+	return changes
+}
+
+// redactConfigValue redacts the URLs of a string or list option value
+func redactConfigValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case string:
+		return redactConfigString(value, false)
+	case []string:
+		redacted := make([]string, len(value))
+		for i, s := range value {
+			redacted[i] = redactConfigString(s, false)
+		}
+		return redacted
+	default:
+		return value
+	}
+}
@@ -0,0 +1,33 @@
+package oauthproxy
+
+import (
+	"net/http"
+	"time"
+)
+
+// isSilentAuthState checks whether the OAuth2 state was created for a
+// prompt=none request, which returns to the silent auth page
+func (p *OAuthProxy) isSilentAuthState(state string) bool {
+	s, err := p.decodeState(state, time.Now())
+	return err == nil && s.Redirect == p.SilentAuthPath
+}
+
+// SilentAuthPage ends a prompt=none flow run in a hidden iframe. It posts
+// the outcome to the parent window, so a single page application can
+// extend the session without any visible redirect.
+func (p *OAuthProxy) SilentAuthPage(rw http.ResponseWriter, req *http.Request) {
+	t := struct {
+		Authenticated bool
+		Error         string
+	}{}
+	if errorString := req.FormValue("error"); errorString != "" {
+		t.Error = errorString
+	} else if _, err := p.getAuthenticatedSession(rw, req); err != nil {
+		t.Error = "login_required"
+	} else {
+		t.Authenticated = true
+	}
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusOK)
+	p.templates.ExecuteTemplate(rw, "silent_auth.html", t)
+}
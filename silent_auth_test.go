@@ -0,0 +1,61 @@
+package oauthproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/OpusCapita/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSilentAuthStart(t *testing.T) {
+	opts := NewOptions()
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "xyzzyplugh"
+	opts.Validate()
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/start?prompt=none&rd=/app", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	loginURL, _ := url.Parse(rw.Header().Get("Location"))
+	params := loginURL.Query()
+	assert.Equal(t, "none", params.Get("prompt"))
+	assert.Equal(t, "", params.Get("approval_prompt"))
+	state, err := proxy.decodeState(params.Get("state"), time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, "/oauth2/silent_auth", state.Redirect)
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth2/callback?error=login_required&state="+url.QueryEscape(params.Get("state")), nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, "/oauth2/silent_auth?error=login_required", rw.Header().Get("Location"))
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth2/callback?error=access_denied&state=nonce:/app", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 403, rw.Code)
+}
+
+func TestSilentAuthPage(t *testing.T) {
+	test := NewProcessCookieTestWithOptionsModifiers()
+	test.req, _ = http.NewRequest("GET", "/oauth2/silent_auth?error=login_required", nil)
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, 200, test.rw.Code)
+	// html/template pads the values of JavaScript expressions with spaces
+	assert.Regexp(t, `authenticated: +false +, error: "login_required"`, test.rw.Body.String())
+
+	test = NewProcessCookieTestWithOptionsModifiers()
+	test.req, _ = http.NewRequest("GET", "/oauth2/silent_auth", nil)
+	test.SaveSession(&sessions.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token", CreatedAt: time.Now()})
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, 200, test.rw.Code)
+	assert.Regexp(t, `authenticated: +true +, error: ""`, test.rw.Body.String())
+}
@@ -0,0 +1,52 @@
+package oauthproxy
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// skipAuthRule lets requests to matching paths through without
+// authentication, only for the listed methods if any
+type skipAuthRule struct {
+	methods []string
+	pattern *regexp.Regexp
+}
+
+// methodPrefix matches the methods a -skip-auth-regex is limited to
+var methodPrefix = regexp.MustCompile(`^[A-Z]+(,[A-Z]+)*=`)
+
+// splitSkipAuthMethods splits a -skip-auth-regex of the form
+// METHOD[,METHOD...]=regex into the methods and the regex. Values without
+// the prefix apply to every method.
+func splitSkipAuthMethods(spec string) ([]string, string) {
+	prefix := methodPrefix.FindString(spec)
+	if prefix == "" {
+		return nil, spec
+	}
+	methods := strings.Split(strings.TrimSuffix(prefix, "="), ",")
+	for _, m := range methods {
+		if m == http.MethodGet {
+			// HEAD requests only differ from GET in the response body
+			methods = append(methods, http.MethodHead)
+			break
+		}
+	}
+	return methods, spec[len(prefix):]
+}
+
+// Matches returns whether the rule lets the request through
+func (r skipAuthRule) Matches(method, path string) bool {
+	if !r.pattern.MatchString(path) {
+		return false
+	}
+	if len(r.methods) == 0 {
+		return true
+	}
+	for _, m := range r.methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
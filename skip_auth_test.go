@@ -0,0 +1,61 @@
+package oauthproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitSkipAuthMethods(t *testing.T) {
+	methods, pattern := splitSkipAuthMethods("GET=^/public/")
+	assert.Equal(t, []string{"GET", "HEAD"}, methods)
+	assert.Equal(t, "^/public/", pattern)
+
+	methods, pattern = splitSkipAuthMethods("POST,PUT=^/hooks/")
+	assert.Equal(t, []string{"POST", "PUT"}, methods)
+	assert.Equal(t, "^/hooks/", pattern)
+
+	methods, pattern = splitSkipAuthMethods("^/search\\?q=")
+	assert.Nil(t, methods)
+	assert.Equal(t, "^/search\\?q=", pattern)
+}
+
+func TestMethodAwareSkipAuth(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream"))
+	}))
+	defer upstream.Close()
+
+	opts := NewOptions()
+	opts.Upstreams = []string{upstream.URL}
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.EmailDomains = []string{"*"}
+	opts.SkipAuthRegex = []string{"GET=^/public/", "^/static/"}
+	assert.NoError(t, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	for _, tc := range []struct {
+		method, path string
+		skipped      bool
+	}{
+		{"GET", "/public/page", true},
+		{"HEAD", "/public/page", true},
+		{"POST", "/public/page", false},
+		{"POST", "/static/app.js", true},
+		{"GET", "/private", false},
+	} {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		req.Header.Set("X-Requested-With", "XMLHttpRequest")
+		proxy.ServeHTTP(rw, req)
+		if tc.skipped {
+			assert.Equal(t, http.StatusOK, rw.Code, tc.method+" "+tc.path)
+		} else {
+			assert.Equal(t, http.StatusUnauthorized, rw.Code, tc.method+" "+tc.path)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package oauthproxy
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/OpusCapita/oauth2_proxy/logger"
+	sessionsapi "github.com/OpusCapita/oauth2_proxy/pkg/apis/sessions"
+)
+
+// ssoAssertionMaxAge is how long an application proxy may take to accept an
+// assertion of the central proxy
+const ssoAssertionMaxAge = time.Minute
+
+// ssoAssertion is the identity of a user signed in at the central proxy,
+// passed to the callback of an application proxy. It is sealed with a key
+// derived from the shared sso-secret and bound to the callback and the OAuth2
+// state of the application proxy, so it cannot be used for another
+// application or another browser.
+type ssoAssertion struct {
+	Audience string   `json:"aud"`
+	State    string   `json:"state"`
+	Expires  int64    `json:"exp"`
+	Email    string   `json:"email,omitempty"`
+	User     string   `json:"user,omitempty"`
+	Groups   []string `json:"groups,omitempty"`
+	ACR      string   `json:"acr,omitempty"`
+	Tenant   string   `json:"tenant,omitempty"`
+}
+
+// parseSSO checks the single sign-on settings: an application proxy signs
+// users in at the sso-url of a central proxy, which serves the applications
+// on the sso-allowed-domains
+func parseSSO(o *Options, msgs []string) []string {
+	if o.SSOURL == "" && len(o.SSOAllowedDomains) == 0 {
+		return msgs
+	}
+	if o.SSOSecret == "" {
+		msgs = append(msgs, "missing setting: sso-secret is required with sso-url and sso-allowed-domain")
+	}
+	if o.SSOURL != "" {
+		u, err := url.Parse(o.SSOURL)
+		if err != nil || (u.Scheme != httpScheme && u.Scheme != httpsScheme) || u.Host == "" {
+			msgs = append(msgs, fmt.Sprintf("invalid sso-url %q: must be an http or https URL", o.SSOURL))
+		} else {
+			o.ssoURL = u
+		}
+	}
+	for _, domain := range o.SSOAllowedDomains {
+		if domain == "" || strings.ContainsAny(domain, "/:") {
+			msgs = append(msgs, fmt.Sprintf("invalid sso-allowed-domain %q: must be a host name, or a domain starting with a .", domain))
+		}
+	}
+	return msgs
+}
+
+// ssoCipher returns the AES-GCM cipher sealing the assertions of the central
+// proxy
+func ssoCipher(secret string) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(deriveKey(secret, "oauth2_proxy sso assertion"))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encodeAssertion seals the identity of session into an assertion for the
+// callback and state of an application proxy, expiring ssoAssertionMaxAge
+// after now
+func (p *OAuthProxy) encodeAssertion(session *sessionsapi.SessionState, callback, state string, now time.Time) (string, error) {
+	aead, err := ssoCipher(p.ssoSecret)
+	if err != nil {
+		return "", err
+	}
+	return sealJSON(aead, ssoAssertion{
+		Audience: callback,
+		State:    state,
+		Expires:  now.Add(ssoAssertionMaxAge).Unix(),
+		Email:    session.Email,
+		User:     session.User,
+		Groups:   session.Groups,
+		ACR:      session.ACR,
+		Tenant:   session.Tenant,
+	})
+}
+
+// decodeAssertion opens an assertion of the central proxy and returns the
+// session it describes, if it was issued for callback and state and has not
+// expired
+func (p *OAuthProxy) decodeAssertion(assertion, callback, state string, now time.Time) (*sessionsapi.SessionState, error) {
+	if assertion == "" {
+		return nil, errors.New("missing assertion")
+	}
+	aead, err := ssoCipher(p.ssoSecret)
+	if err != nil {
+		return nil, err
+	}
+	a := &ssoAssertion{}
+	if err := openJSON(aead, assertion, a); err != nil {
+		return nil, fmt.Errorf("invalid assertion: %s", err)
+	}
+	switch {
+	case a.Audience != callback:
+		return nil, fmt.Errorf("assertion issued for %s", a.Audience)
+	case a.State != state:
+		return nil, errors.New("assertion issued for another state")
+	case now.After(time.Unix(a.Expires, 0)):
+		return nil, fmt.Errorf("assertion expired at %s", time.Unix(a.Expires, 0).UTC().Format(time.RFC3339))
+	}
+	return &sessionsapi.SessionState{
+		Email:  a.Email,
+		User:   a.User,
+		Groups: a.Groups,
+		ACR:    a.ACR,
+		Tenant: a.Tenant,
+	}, nil
+}
+
+// ssoLoginURL returns the URL of the central proxy signing the user in for
+// the callback of this proxy
+func (p *OAuthProxy) ssoLoginURL(callback, state string) string {
+	u := *p.ssoURL
+	query := u.Query()
+	query.Set("redirect_uri", callback)
+	query.Set("state", state)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// isSSODomain returns whether the central proxy serves applications on host
+func (p *OAuthProxy) isSSODomain(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, domain := range p.ssoDomains {
+		if host == domain || (strings.HasPrefix(domain, ".") && strings.HasSuffix(host, domain)) {
+			return true
+		}
+	}
+	return false
+}
+
+// SSO signs the user in for an application proxy on an allowed domain. A
+// signed in user is redirected to the callback of the application with an
+// assertion of their identity; others sign in at this proxy first and return
+// here. With prompt=none the callback gets a login_required error instead.
+func (p *OAuthProxy) SSO(rw http.ResponseWriter, req *http.Request) {
+	if len(p.ssoDomains) == 0 {
+		http.NotFound(rw, req)
+		return
+	}
+	req.ParseForm()
+	callback, err := url.Parse(req.Form.Get("redirect_uri"))
+	if err != nil || (callback.Scheme != httpScheme && callback.Scheme != httpsScheme) || !p.isSSODomain(callback.Host) {
+		p.ErrorPage(rw, http.StatusBadRequest, "Bad Request", "invalid redirect_uri")
+		return
+	}
+	state := req.Form.Get("state")
+	params := url.Values{"state": {state}}
+
+	session, err := p.getAuthenticatedSession(rw, req)
+	switch {
+	case err == ErrNeedsLogin && req.Form.Get("prompt") == "none":
+		params.Set("error", "login_required")
+	case err == ErrNeedsLogin && p.SkipProviderButton:
+		http.Redirect(rw, req, p.OAuthStartPath+"?rd="+url.QueryEscape(req.URL.RequestURI()), http.StatusFound)
+		return
+	case err == ErrNeedsLogin:
+		p.SignInPage(rw, req, http.StatusOK)
+		return
+	case err != nil:
+		logger.Printf("Unexpected internal error: %s", err)
+		p.ErrorPage(rw, http.StatusInternalServerError, "Internal Error", "Internal Error")
+		return
+	default:
+		assertion, err := p.encodeAssertion(session, callback.String(), state, time.Now())
+		if err != nil {
+			logger.Printf("Error encoding SSO assertion: %s", err)
+			p.ErrorPage(rw, http.StatusInternalServerError, "Internal Error", "Internal Error")
+			return
+		}
+		logger.PrintAuthf(session.Email, req, logger.AuthSuccess, "Signed in to %s via SSO", callback.Host)
+		params.Set("assertion", assertion)
+	}
+	query := callback.Query()
+	for name, values := range params {
+		query[name] = values
+	}
+	callback.RawQuery = query.Encode()
+	rw.Header().Set("Cache-Control", "no-store")
+	http.Redirect(rw, req, callback.String(), http.StatusFound)
+}
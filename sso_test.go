@@ -0,0 +1,135 @@
+package oauthproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	sessionsapi "github.com/OpusCapita/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSSO(t *testing.T) {
+	o := testOptions()
+	o.ClientID = ""
+	o.ClientSecret = ""
+	o.SSOURL = "auth.example.com/oauth2/sso"
+	o.SSOAllowedDomains = []string{"https://app.example.com"}
+	err := o.Validate()
+	assert.Error(t, err)
+	assert.Equal(t, errorMsg([]string{
+		"missing setting: sso-secret is required with sso-url and sso-allowed-domain",
+		`invalid sso-url "auth.example.com/oauth2/sso": must be an http or https URL`,
+		`invalid sso-allowed-domain "https://app.example.com": must be a host name, or a domain starting with a .`,
+	}), err.Error())
+
+	o = testOptions()
+	o.ClientID = ""
+	o.ClientSecret = ""
+	o.SSOURL = "https://auth.example.com/oauth2/sso"
+	o.SSOSecret = "sso-s3cr3t"
+	assert.NoError(t, o.Validate())
+	assert.Equal(t, "auth.example.com", o.ssoURL.Host)
+}
+
+func newSSOTestProxy(t *testing.T, configure func(*Options)) *OAuthProxy {
+	opts := testOptions()
+	opts.CookieSecure = false
+	opts.SSOSecret = "sso-s3cr3t"
+	configure(opts)
+	assert.NoError(t, opts.Validate())
+	return NewOAuthProxy(opts, func(string) bool { return true })
+}
+
+func TestSSOAssertion(t *testing.T) {
+	now := time.Now()
+	central := newSSOTestProxy(t, func(o *Options) { o.SSOAllowedDomains = []string{".example.com"} })
+	app := newSSOTestProxy(t, func(o *Options) { o.SSOURL = "http://auth.example.com/oauth2/sso" })
+	callback := "http://app.example.com/oauth2/callback"
+	session := &sessionsapi.SessionState{Email: "jane@example.com", User: "jane", Groups: []string{"admins"}, AccessToken: "secret"}
+
+	assertion, err := central.encodeAssertion(session, callback, "state", now)
+	assert.NoError(t, err)
+	s, err := app.decodeAssertion(assertion, callback, "state", now)
+	assert.NoError(t, err)
+	assert.Equal(t, &sessionsapi.SessionState{Email: "jane@example.com", User: "jane", Groups: []string{"admins"}}, s)
+
+	_, err = app.decodeAssertion(assertion, "http://other.example.com/oauth2/callback", "state", now)
+	assert.EqualError(t, err, "assertion issued for "+callback)
+	_, err = app.decodeAssertion(assertion, callback, "other", now)
+	assert.EqualError(t, err, "assertion issued for another state")
+	_, err = app.decodeAssertion(assertion, callback, "state", now.Add(ssoAssertionMaxAge+time.Second))
+	assert.True(t, strings.HasPrefix(err.Error(), "assertion expired at "))
+	app.ssoSecret = "other"
+	_, err = app.decodeAssertion(assertion, callback, "state", now)
+	assert.EqualError(t, err, "invalid assertion: invalid signature")
+	_, err = app.decodeAssertion("", callback, "state", now)
+	assert.EqualError(t, err, "missing assertion")
+}
+
+func TestSSOFlow(t *testing.T) {
+	central := newSSOTestProxy(t, func(o *Options) { o.SSOAllowedDomains = []string{".apps.example.com"} })
+	app := newSSOTestProxy(t, func(o *Options) {
+		o.ClientID = ""
+		o.ClientSecret = ""
+		o.SSOURL = "http://auth.example.com/oauth2/sso"
+	})
+
+	// the application proxy sends the user to the central proxy
+	rw := httptest.NewRecorder()
+	app.ServeHTTP(rw, httptest.NewRequest("GET", "http://wiki.apps.example.com/oauth2/start?rd=%2Fpage", nil))
+	assert.Equal(t, http.StatusFound, rw.Code)
+	location, _ := url.Parse(rw.Header().Get("Location"))
+	assert.Equal(t, "auth.example.com", location.Host)
+	assert.Equal(t, "/oauth2/sso", location.Path)
+	assert.Equal(t, "http://wiki.apps.example.com/oauth2/callback", location.Query().Get("redirect_uri"))
+	csrf := rw.Result().Cookies()[0]
+
+	// which signs them in first
+	ssoURL := "http://auth.example.com" + location.RequestURI()
+	rw = httptest.NewRecorder()
+	central.ServeHTTP(rw, httptest.NewRequest("GET", ssoURL, nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Contains(t, rw.Body.String(), `name="rd" value="/oauth2/sso?redirect_uri=`)
+
+	rw = httptest.NewRecorder()
+	central.ServeHTTP(rw, httptest.NewRequest("GET", ssoURL+"&prompt=none", nil))
+	silent, _ := url.Parse(rw.Header().Get("Location"))
+	assert.Equal(t, "login_required", silent.Query().Get("error"))
+
+	rw = httptest.NewRecorder()
+	central.ServeHTTP(rw, httptest.NewRequest("GET", "http://auth.example.com/oauth2/sso?redirect_uri=https%3A%2F%2Fevil.example.org%2Foauth2%2Fcallback", nil))
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+
+	// and returns them with an assertion once signed in
+	signedIn := httptest.NewRecorder()
+	central.SaveSession(signedIn, httptest.NewRequest("GET", "http://auth.example.com/", nil), &sessionsapi.SessionState{Email: "jane@example.com", User: "jane"})
+	req := httptest.NewRequest("GET", ssoURL, nil)
+	req.AddCookie(signedIn.Result().Cookies()[0])
+	rw = httptest.NewRecorder()
+	central.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusFound, rw.Code)
+	callback, _ := url.Parse(rw.Header().Get("Location"))
+	assert.Equal(t, "wiki.apps.example.com", callback.Host)
+	assert.NotEmpty(t, callback.Query().Get("assertion"))
+
+	// from which the application proxy creates its own session
+	req = httptest.NewRequest("GET", callback.String(), nil)
+	req.AddCookie(csrf)
+	rw = httptest.NewRecorder()
+	app.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusFound, rw.Code)
+	assert.Equal(t, "/page", rw.Header().Get("Location"))
+	req = httptest.NewRequest("GET", "http://wiki.apps.example.com/page", nil)
+	for _, c := range rw.Result().Cookies() {
+		if c.Name == app.CookieName {
+			req.AddCookie(c)
+		}
+	}
+	session, err := app.LoadCookiedSession(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "jane@example.com", session.Email)
+}
@@ -0,0 +1,95 @@
+package oauthproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/OpusCapita/oauth2_proxy/logger"
+)
+
+// stepUpRoute requires sessions used for paths matching pattern to have
+// been authenticated with the acr authentication context class
+type stepUpRoute struct {
+	pattern *regexp.Regexp
+	acr     string
+}
+
+// parseStepUpRoutes parses step-up-route specs of the form pattern=acr, e.g.
+// ^/admin/=http://schemas.openid.net/pape/policies/2007/06/multi-factor
+func parseStepUpRoutes(specs []string, msgs []string) ([]stepUpRoute, []string) {
+	var routes []stepUpRoute
+	for _, spec := range specs {
+		i := strings.LastIndex(spec, "=")
+		if i < 1 || i == len(spec)-1 {
+			msgs = append(msgs, fmt.Sprintf("invalid step-up-route %q: must be of the form pattern=acr", spec))
+			continue
+		}
+		pattern, err := regexp.Compile(spec[:i])
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("error compiling step-up-route %q: %s", spec, err))
+			continue
+		}
+		routes = append(routes, stepUpRoute{pattern: pattern, acr: spec[i+1:]})
+	}
+	return routes, msgs
+}
+
+// requiredACR returns the acr the session must have to access path, or an
+// empty string if the path does not require step-up authentication
+func (p *OAuthProxy) requiredACR(path string) string {
+	for _, route := range p.stepUpRoutes {
+		if route.pattern.MatchString(path) {
+			return route.acr
+		}
+	}
+	return ""
+}
+
+func (p *OAuthProxy) stepUpCookieName() string {
+	return fmt.Sprintf("%v_%v", p.CookieName, "step_up")
+}
+
+// StepUp forces a fresh authentication at the provider requesting the acr
+// parameter as acr_values. The requested acr is remembered in a cookie so
+// the callback can check the provider actually reached it.
+func (p *OAuthProxy) StepUp(rw http.ResponseWriter, req *http.Request) {
+	acr := req.FormValue("acr")
+	if acr == "" {
+		p.ErrorPage(rw, http.StatusBadRequest, "Bad Request", "missing acr parameter")
+		return
+	}
+	http.SetCookie(rw, p.makeCookie(req, p.stepUpCookieName(), acr, time.Duration(1)*time.Hour, time.Now()))
+	p.OAuthStart(rw, req)
+}
+
+// stepUpRedirect sends the user to the step-up endpoint to reach the acr
+// required for the request
+func (p *OAuthProxy) stepUpRedirect(rw http.ResponseWriter, req *http.Request, acr string) {
+	params := url.Values{}
+	params.Set("acr", acr)
+	params.Set("rd", p.signInRedirect(req))
+	if p.isAPIRequest(req) {
+		p.UnauthorizedJSON(rw, p.StepUpPath+"?"+params.Encode())
+		return
+	}
+	http.Redirect(rw, req, p.StepUpPath+"?"+params.Encode(), 302)
+}
+
+// checkStepUp verifies the acr of a new session against the one requested
+// by the step-up endpoint, if any
+func (p *OAuthProxy) checkStepUp(rw http.ResponseWriter, req *http.Request, acr string) bool {
+	c, err := req.Cookie(p.stepUpCookieName())
+	if err != nil || c.Value == "" {
+		return true
+	}
+	http.SetCookie(rw, p.makeCookie(req, p.stepUpCookieName(), "", time.Hour*-1, time.Now()))
+	if acr != c.Value {
+		logger.Printf("step-up authentication requested acr %q but got %q", c.Value, acr)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,110 @@
+package oauthproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/OpusCapita/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseStepUpRoutes(t *testing.T) {
+	routes, msgs := parseStepUpRoutes([]string{
+		"^/admin/=urn:example:mfa",
+		"^/a=b/=silver",
+		"^/no-acr/=",
+		"[=gold",
+	}, nil)
+	assert.Equal(t, []string{
+		"invalid step-up-route \"^/no-acr/=\": must be of the form pattern=acr",
+		"error compiling step-up-route \"[=gold\": error parsing regexp: missing closing ]: `[`"}, msgs)
+	assert.Equal(t, 2, len(routes))
+	assert.Equal(t, "^/admin/", routes[0].pattern.String())
+	assert.Equal(t, "urn:example:mfa", routes[0].acr)
+	assert.Equal(t, "^/a=b/", routes[1].pattern.String())
+	assert.Equal(t, "silver", routes[1].acr)
+}
+
+func TestStepUpStart(t *testing.T) {
+	opts := NewOptions()
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "xyzzyplugh"
+	opts.Validate()
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/step_up", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth2/step_up?acr=urn:example:mfa&rd=/admin/", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	loginURL, _ := url.Parse(rw.Header().Get("Location"))
+	params := loginURL.Query()
+	assert.Equal(t, "urn:example:mfa", params.Get("acr_values"))
+	assert.Equal(t, "0", params.Get("max_age"))
+	assert.Equal(t, "force", params.Get("approval_prompt"))
+
+	var stepUpCookie *http.Cookie
+	for _, c := range rw.Result().Cookies() {
+		if c.Name == "_oauth2_proxy_step_up" {
+			stepUpCookie = c
+		}
+	}
+	if assert.NotNil(t, stepUpCookie) {
+		assert.Equal(t, "urn:example:mfa", stepUpCookie.Value)
+	}
+}
+
+func TestStepUpRequiredForRoute(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream"))
+	}))
+	defer upstream.Close()
+
+	serve := func(path string, acr string) *httptest.ResponseRecorder {
+		test := NewProcessCookieTestWithOptionsModifiers(func(opts *Options) {
+			opts.Upstreams = []string{upstream.URL}
+			opts.StepUpRoutes = []string{"^/admin/=urn:example:mfa"}
+		})
+		test.req, _ = http.NewRequest("GET", path, nil)
+		test.SaveSession(&sessions.SessionState{
+			Email: "michael.bland@gsa.gov", AccessToken: "my_access_token", CreatedAt: time.Now(), ACR: acr})
+		test.rw = httptest.NewRecorder()
+		test.proxy.ServeHTTP(test.rw, test.req)
+		return test.rw
+	}
+
+	rw := serve("/public", "")
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	rw = serve("/admin/users?page=2", "")
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, "/oauth2/step_up?acr=urn%3Aexample%3Amfa&rd=%2Fadmin%2Fusers%3Fpage%3D2", rw.Header().Get("Location"))
+
+	rw = serve("/admin/users", "urn:example:mfa")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "upstream", rw.Body.String())
+}
+
+func TestCheckStepUp(t *testing.T) {
+	opts := NewOptions()
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "xyzzyplugh"
+	opts.Validate()
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	req, _ := http.NewRequest("GET", "/oauth2/callback", nil)
+	assert.Equal(t, true, proxy.checkStepUp(httptest.NewRecorder(), req, ""))
+
+	req.AddCookie(&http.Cookie{Name: "_oauth2_proxy_step_up", Value: "urn:example:mfa"})
+	assert.Equal(t, false, proxy.checkStepUp(httptest.NewRecorder(), req, "urn:example:password"))
+	assert.Equal(t, true, proxy.checkStepUp(httptest.NewRecorder(), req, "urn:example:mfa"))
+}
@@ -0,0 +1,9 @@
+package oauthproxy
+
+// subcommands are the tools run with "oauth2_proxy <name> [args]" instead of
+// the proxy. They return the exit status.
+var subcommands = map[string]func(args []string) int{
+	"generate-secret": generateSecretCommand,
+	"decode-session":  decodeSessionCommand,
+	"mock-idp":        mockIDPCommand,
+}
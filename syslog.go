@@ -0,0 +1,197 @@
+package oauthproxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// syslogDestination is the logging filename sending logs to syslog
+	syslogDestination = "syslog"
+	// syslogSeverity is the severity of the messages, informational
+	syslogSeverity = 6
+	// syslogDialTimeout bounds connecting to the syslog server
+	syslogDialTimeout = 5 * time.Second
+	// syslogWriteTimeout bounds sending a message to the syslog server
+	syslogWriteTimeout = 5 * time.Second
+	// syslogQueueSize is how many messages may wait to be sent before
+	// further ones are dropped
+	syslogQueueSize = 1024
+)
+
+// syslogFacilities are the facility codes of RFC 5424
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// localSyslogSockets are the sockets of the local syslog daemon
+var localSyslogSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// syslogWriter sends every line written to it as an RFC 5424 message to a
+// syslog server over UDP, TCP, TLS or the local syslog socket. Messages sent
+// over TCP and TLS are framed by octet counting (RFC 6587). The messages are
+// sent in the background, so that a slow or unreachable server does not hold
+// up the requests being logged; when the queue is full they are dropped. The
+// connection is reestablished when sending fails.
+type syslogWriter struct {
+	network   string
+	address   string
+	tlsConfig *tls.Config
+	facility  int
+	tag       string
+	hostname  string
+
+	mu    sync.Mutex
+	buf   bytes.Buffer
+	queue chan string
+	// dropped counts the messages dropped since the last one sent
+	dropped int64
+
+	// conn is only used by the sending goroutine
+	conn net.Conn
+}
+
+// newSyslogWriter configures the syslog writer of the options. The address
+// is a URL such as udp://host:514, tcp://host:601, tls://host:6514 or
+// unix:///dev/log, and defaults to the local syslog daemon.
+func newSyslogWriter(o *Options) (*syslogWriter, error) {
+	facility, ok := syslogFacilities[o.SyslogFacility]
+	if !ok {
+		return nil, fmt.Errorf("invalid syslog-facility %q", o.SyslogFacility)
+	}
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+	w := &syslogWriter{facility: facility, tag: o.SyslogTag, hostname: hostname, queue: make(chan string, syslogQueueSize)}
+	if w.tag == "" {
+		w.tag = "-"
+	}
+
+	if o.SyslogAddress == "" {
+		for _, socket := range localSyslogSockets {
+			if _, err := os.Stat(socket); err == nil {
+				w.network, w.address = "unixgram", socket
+				go w.run()
+				return w, nil
+			}
+		}
+		return nil, fmt.Errorf("no local syslog socket found, set syslog-address")
+	}
+
+	u, err := url.Parse(o.SyslogAddress)
+	if err != nil {
+		return nil, fmt.Errorf("invalid syslog-address %q: %s", o.SyslogAddress, err)
+	}
+	switch u.Scheme {
+	case "udp", "tcp":
+		w.network, w.address = u.Scheme, u.Host
+	case "tls":
+		w.network, w.address = "tcp", u.Host
+		w.tlsConfig = &tls.Config{ServerName: u.Hostname()}
+		if o.SyslogCAFile != "" {
+			ca, err := ioutil.ReadFile(o.SyslogCAFile)
+			if err != nil {
+				return nil, fmt.Errorf("invalid syslog-ca-file: %s", err)
+			}
+			w.tlsConfig.RootCAs = x509.NewCertPool()
+			if !w.tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+				return nil, fmt.Errorf("invalid syslog-ca-file: no certificates in %s", o.SyslogCAFile)
+			}
+		}
+	case "unix", "unixgram":
+		w.network, w.address = "unixgram", u.Path
+	default:
+		return nil, fmt.Errorf("invalid syslog-address %q: the scheme must be udp, tcp, tls or unix", o.SyslogAddress)
+	}
+	if w.network != "unixgram" {
+		if _, _, err := net.SplitHostPort(w.address); err != nil {
+			return nil, fmt.Errorf("invalid syslog-address %q: %s", o.SyslogAddress, err)
+		}
+	}
+	go w.run()
+	return w, nil
+}
+
+// Write queues the complete lines written so far, keeping the rest until its
+// line is complete. Lines are dropped while the queue is full.
+func (w *syslogWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf.Write(p)
+	for {
+		i := bytes.IndexByte(w.buf.Bytes(), '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := string(w.buf.Next(i + 1))
+		select {
+		case w.queue <- w.format(line[:i], time.Now()):
+		default:
+			atomic.AddInt64(&w.dropped, 1)
+		}
+	}
+}
+
+// run sends the queued messages, reporting the messages dropped meanwhile
+// once the server can be reached again
+func (w *syslogWriter) run() {
+	for msg := range w.queue {
+		if err := w.send(msg); err != nil {
+			fmt.Fprintf(os.Stderr, "error sending log message to syslog: %s\n", err)
+			continue
+		}
+		if n := atomic.SwapInt64(&w.dropped, 0); n > 0 {
+			w.send(w.format(fmt.Sprintf("dropped %d log messages while syslog was too slow or unreachable", n), time.Now()))
+		}
+	}
+}
+
+// format returns the RFC 5424 message of a log line
+func (w *syslogWriter) format(line string, now time.Time) string {
+	return fmt.Sprintf("<%d>1 %s %s %s %d - - %s",
+		w.facility*8+syslogSeverity, now.Format(time.RFC3339Nano), w.hostname, w.tag, os.Getpid(), line)
+}
+
+// send sends a message, connecting again once if the connection failed
+func (w *syslogWriter) send(msg string) error {
+	if w.network == "tcp" {
+		msg = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if w.conn == nil {
+			if w.conn, err = w.dial(); err != nil {
+				return err
+			}
+		}
+		w.conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout))
+		if _, err = w.conn.Write([]byte(msg)); err == nil {
+			return nil
+		}
+		w.conn.Close()
+		w.conn = nil
+	}
+	return err
+}
+
+func (w *syslogWriter) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: syslogDialTimeout}
+	if w.tlsConfig != nil {
+		return tls.DialWithDialer(dialer, w.network, w.address, w.tlsConfig)
+	}
+	return dialer.Dial(w.network, w.address)
+}
@@ -0,0 +1,97 @@
+package oauthproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyslogWriterUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	o := testOptions()
+	o.SyslogAddress = "udp://" + conn.LocalAddr().String()
+	o.SyslogFacility = "local3"
+	w, err := newSyslogWriter(o)
+	assert.NoError(t, err)
+
+	// a line is sent once it is complete
+	w.Write([]byte("GET /foo"))
+	w.Write([]byte(" 200\nsecond\n"))
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1024)
+	for _, line := range []string{"GET /foo 200", "second"} {
+		n, _, err := conn.ReadFrom(buf)
+		assert.NoError(t, err)
+		msg := string(buf[:n])
+		assert.True(t, strings.HasPrefix(msg, "<158>1 "), msg)
+		assert.True(t, strings.HasSuffix(msg, " oauth2_proxy "+strconv.Itoa(os.Getpid())+" - - "+line), msg)
+	}
+}
+
+func TestSyslogWriterTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+
+	o := testOptions()
+	o.SyslogAddress = "tcp://" + l.Addr().String()
+	w, err := newSyslogWriter(o)
+	assert.NoError(t, err)
+	w.hostname = "proxy-1"
+
+	go w.Write([]byte("signed in\n"))
+	conn, err := l.Accept()
+	assert.NoError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	r := bufio.NewReader(conn)
+	var n int
+	_, err = fmt.Fscanf(r, "%d ", &n)
+	assert.NoError(t, err)
+	msg := make([]byte, n)
+	_, err = io.ReadFull(r, msg)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(msg), "<30>1 "), string(msg))
+	assert.True(t, strings.HasSuffix(string(msg), " proxy-1 oauth2_proxy "+strconv.Itoa(os.Getpid())+" - - signed in"), string(msg))
+}
+
+func TestSyslogWriterDropsWhenQueueFull(t *testing.T) {
+	w := &syslogWriter{queue: make(chan string, 1)}
+	n, err := w.Write([]byte("first\nsecond\nthird\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, 19, n)
+	assert.Len(t, w.queue, 1)
+	assert.True(t, strings.HasSuffix(<-w.queue, " - - first"))
+	assert.Equal(t, int64(2), w.dropped)
+}
+
+func TestNewSyslogWriterErrors(t *testing.T) {
+	tests := map[string]string{
+		"syslog://logs.example.com": `invalid syslog-address "syslog://logs.example.com": the scheme must be udp, tcp, tls or unix`,
+		"tcp://logs.example.com":    `invalid syslog-address "tcp://logs.example.com": address logs.example.com: missing port in address`,
+	}
+	for address, msg := range tests {
+		o := testOptions()
+		o.SyslogAddress = address
+		_, err := newSyslogWriter(o)
+		assert.EqualError(t, err, msg)
+	}
+
+	o := testOptions()
+	o.SyslogAddress = "udp://logs.example.com:514"
+	o.SyslogFacility = "local9"
+	_, err := newSyslogWriter(o)
+	assert.EqualError(t, err, `invalid syslog-facility "local9"`)
+}
@@ -0,0 +1,83 @@
+package oauthproxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd socket
+// activation
+const listenFDsStart = 3
+
+// activatedListener is a socket passed by systemd, named by the
+// FileDescriptorName= of its socket unit
+type activatedListener struct {
+	name string
+	net.Listener
+}
+
+// systemdListeners returns the listening sockets passed to the process by
+// systemd socket activation, in the order of the LISTEN_FDS, and unsets the
+// LISTEN_* environment variables. It returns none when the process was not
+// socket activated.
+func systemdListeners() ([]activatedListener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+	}
+	var names []string
+	if fdNames := os.Getenv("LISTEN_FDNAMES"); fdNames != "" {
+		names = strings.Split(fdNames, ":")
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	return listenersFromFDs(listenFDsStart, count, names)
+}
+
+// listenersFromFDs creates listeners of count consecutive file descriptors
+// starting at start, named by names
+func listenersFromFDs(start, count int, names []string) ([]activatedListener, error) {
+	listeners := make([]activatedListener, 0, count)
+	for i := 0; i < count; i++ {
+		fd := start + i
+		var name string
+		if i < len(names) {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("LISTEN_FD_%d", fd))
+		ln, err := net.FileListener(f)
+		// the listener uses a duplicate of the file descriptor
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket %d (%s) passed by systemd is not a listening socket: %s", fd, name, err)
+		}
+		listeners = append(listeners, activatedListener{name: name, Listener: ln})
+	}
+	return listeners, nil
+}
+
+// inheritedListener returns the socket passed by systemd for the HTTP or
+// HTTPS listener, or nil when none was passed. A socket named "http" or
+// "https" is used by that listener; if neither name is used the sockets are
+// taken in order, the HTTP listener's first when both listeners run.
+func (s *Server) inheritedListener(name string, index int) net.Listener {
+	named := false
+	for _, l := range s.activated {
+		if l.name == name {
+			return l.Listener
+		}
+		named = named || l.name == "http" || l.name == "https"
+	}
+	if named || index >= len(s.activated) {
+		return nil
+	}
+	return s.activated[index].Listener
+}
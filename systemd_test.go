@@ -0,0 +1,68 @@
+package oauthproxy
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSystemdListeners(t *testing.T) {
+	os.Setenv("LISTEN_PID", "1")
+	os.Setenv("LISTEN_FDS", "2")
+	listeners, err := systemdListeners()
+	assert.NoError(t, err)
+	assert.Empty(t, listeners)
+	assert.Equal(t, "2", os.Getenv("LISTEN_FDS"))
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "many")
+	_, err = systemdListeners()
+	assert.EqualError(t, err, `invalid LISTEN_FDS "many"`)
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+}
+
+func TestListenersFromFDs(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+	f, err := ln.(*net.TCPListener).File()
+	assert.NoError(t, err)
+	defer f.Close()
+	// listenersFromFDs takes over the file descriptors
+	fd, err := syscall.Dup(int(f.Fd()))
+	assert.NoError(t, err)
+
+	listeners, err := listenersFromFDs(fd, 1, []string{"https"})
+	assert.NoError(t, err)
+	assert.Len(t, listeners, 1)
+	assert.Equal(t, "https", listeners[0].name)
+	assert.Equal(t, ln.Addr().String(), listeners[0].Addr().String())
+	listeners[0].Close()
+
+	file, err := os.Open(os.DevNull)
+	assert.NoError(t, err)
+	defer file.Close()
+	fd, err = syscall.Dup(int(file.Fd()))
+	assert.NoError(t, err)
+	_, err = listenersFromFDs(fd, 1, nil)
+	assert.Error(t, err)
+}
+
+func TestInheritedListener(t *testing.T) {
+	var a, b net.Listener = &net.TCPListener{}, &net.UnixListener{}
+	s := &Server{activated: []activatedListener{{"unknown", a}, {"unknown", b}}, httpsIndex: 1}
+	assert.Equal(t, a, s.inheritedListener("http", 0))
+	assert.Equal(t, b, s.inheritedListener("https", s.httpsIndex))
+
+	s = &Server{activated: []activatedListener{{"https", a}}}
+	assert.Equal(t, a, s.inheritedListener("https", 0))
+	assert.Nil(t, s.inheritedListener("http", 0))
+
+	s = &Server{}
+	assert.Nil(t, s.inheritedListener("http", 0))
+}
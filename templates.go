@@ -1,24 +1,61 @@
-package main
+package oauthproxy
 
 import (
 	"html/template"
+	"os"
 	"path"
+	"path/filepath"
 
 	"github.com/OpusCapita/oauth2_proxy/logger"
 )
 
+// signInPageData is the context the sign_in.html template is rendered with
+type signInPageData struct {
+	ProviderName  string
+	SignInMessage string
+	CustomLogin   bool
+	TOTP          bool
+	WebAuthn      bool
+	Redirect      string
+	Version       string
+	ProxyPrefix   string
+	StaticPath    string
+	Footer        template.HTML
+}
+
+// loadTemplates returns the built in templates overlaid with every *.html
+// file found in dir. Files may replace sign_in.html, error.html and maintenance.html or add
+// partials those templates include.
 func loadTemplates(dir string) *template.Template {
 	if dir == "" {
 		return getTemplates()
 	}
 	logger.Printf("using custom template directory %q", dir)
-	t, err := template.New("").ParseFiles(path.Join(dir, "sign_in.html"), path.Join(dir, "error.html"))
+	t := getTemplates()
+	// the directory may only hold static assets
+	if files, _ := filepath.Glob(path.Join(dir, "*.html")); len(files) == 0 {
+		return t
+	}
+	t, err := t.ParseGlob(path.Join(dir, "*.html"))
 	if err != nil {
 		logger.Fatalf("failed parsing template %s", err)
 	}
 	return t
 }
 
+// staticAssetsDir returns the directory holding custom sign-in page assets,
+// or an empty string if the template directory does not provide one
+func staticAssetsDir(dir string) string {
+	if dir == "" {
+		return ""
+	}
+	static := path.Join(dir, "static")
+	if fi, err := os.Stat(static); err != nil || !fi.IsDir() {
+		return ""
+	}
+	return static
+}
+
 func getTemplates() *template.Template {
 	t, err := template.New("foo").Parse(`{{define "sign_in.html"}}
 <!DOCTYPE html>
@@ -126,10 +163,44 @@ func getTemplates() *template.Template {
 		<input type="hidden" name="rd" value="{{.Redirect}}">
 		<label for="username">Username:</label><input type="text" name="username" id="username" size="10"><br/>
 		<label for="password">Password:</label><input type="password" name="password" id="password" size="10"><br/>
+		{{ if .TOTP }}
+		<label for="totp">Code:</label><input type="text" name="totp" id="totp" size="10" inputmode="numeric" autocomplete="one-time-code"><br/>
+		{{ end }}
 		<button type="submit" class="btn">Sign In</button>
 	</form>
 	</div>
 	{{ end }}
+	{{ if .WebAuthn }}
+	<div class="signin">
+	<button type="button" class="btn" id="webauthn-sign-in">Sign in with a passkey</button>
+	<p id="webauthn-error"></p>
+	</div>
+	<script>
+		{{template "webauthn.js" .}}
+		document.getElementById("webauthn-sign-in").addEventListener("click", function() {
+			webAuthnPost({{.ProxyPrefix}} + "/webauthn/login/begin").then(function(o) {
+				return navigator.credentials.get({publicKey: {
+					challenge: b64urlToBuf(o.challenge),
+					rpId: o.rpId,
+					userVerification: o.userVerification,
+					timeout: o.timeout
+				}});
+			}).then(function(c) {
+				return webAuthnPost({{.ProxyPrefix}} + "/webauthn/login/finish", {
+					id: bufToB64url(c.rawId),
+					clientDataJSON: bufToB64url(c.response.clientDataJSON),
+					authenticatorData: bufToB64url(c.response.authenticatorData),
+					signature: bufToB64url(c.response.signature),
+					rd: {{.Redirect}} + window.location.hash
+				});
+			}).then(function(r) {
+				window.location = r.redirect;
+			}).catch(function(e) {
+				document.getElementById("webauthn-error").textContent = e.message;
+			});
+		});
+	</script>
+	{{ end }}
 	<script>
 		if (window.location.hash) {
 			(function() {
@@ -168,6 +239,151 @@ func getTemplates() *template.Template {
 	<hr>
 	<p><a href="{{.ProxyPrefix}}/sign_in">Sign In</a></p>
 </body>
+</html>{{end}}`)
+	if err != nil {
+		logger.Fatalf("failed parsing template %s", err)
+	}
+
+	t, err = t.Parse(`{{define "fragment_bridge.html"}}
+<!DOCTYPE html>
+<html lang="en" charset="utf-8">
+<head>
+	<title>Redirecting</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1, maximum-scale=1, user-scalable=no">
+</head>
+<body>
+	<script>
+		window.location.replace("{{.ProxyPrefix}}/start?rd=" + encodeURIComponent({{.Redirect}} + window.location.hash));
+	</script>
+	<noscript>
+		<p><a href="{{.ProxyPrefix}}/start?rd={{.Redirect}}">Sign in</a></p>
+	</noscript>
+</body>
+</html>{{end}}`)
+	if err != nil {
+		logger.Fatalf("failed parsing template %s", err)
+	}
+
+	t, err = t.Parse(`{{define "silent_auth.html"}}
+<!DOCTYPE html>
+<html lang="en" charset="utf-8">
+<head>
+	<title>Silent Authentication</title>
+</head>
+<body>
+	<script>
+		if (window.parent !== window) {
+			window.parent.postMessage({type: "oauth2_proxy_silent_auth", authenticated: {{.Authenticated}}, error: {{.Error}}}, window.location.origin);
+		}
+	</script>
+</body>
+</html>{{end}}`)
+	if err != nil {
+		logger.Fatalf("failed parsing template %s", err)
+	}
+
+	t, err = t.Parse(`{{define "webauthn.js"}}
+		function b64urlToBuf(s) {
+			s = s.replace(/-/g, "+").replace(/_/g, "/");
+			while (s.length % 4) {
+				s += "=";
+			}
+			return Uint8Array.from(atob(s), function(c) { return c.charCodeAt(0); });
+		}
+		function bufToB64url(b) {
+			var s = "";
+			new Uint8Array(b).forEach(function(c) { s += String.fromCharCode(c); });
+			return btoa(s).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+		}
+		function webAuthnPost(url, body) {
+			return fetch(url, {
+				method: "POST",
+				credentials: "same-origin",
+				headers: {"Content-Type": "application/json"},
+				body: JSON.stringify(body || {})
+			}).then(function(r) {
+				return r.json().then(function(j) {
+					if (!r.ok) {
+						throw new Error(j.error || r.statusText);
+					}
+					return j;
+				});
+			});
+		}
+{{end}}`)
+	if err != nil {
+		logger.Fatalf("failed parsing template %s", err)
+	}
+
+	t, err = t.Parse(`{{define "webauthn_register.html"}}
+<!DOCTYPE html>
+<html lang="en" charset="utf-8">
+<head>
+	<title>{{.Title}}</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1, maximum-scale=1, user-scalable=no">
+</head>
+<body>
+	<h2>{{.Title}}</h2>
+	<p>Register a passkey for {{.User}} to sign in with it next time instead of a password.</p>
+	<button type="button" id="webauthn-register">Register a passkey</button>
+	<p id="webauthn-status"></p>
+	<script>
+		{{template "webauthn.js" .}}
+		document.getElementById("webauthn-register").addEventListener("click", function() {
+			var status = document.getElementById("webauthn-status");
+			webAuthnPost({{.ProxyPrefix}} + "/webauthn/register/begin").then(function(o) {
+				o.challenge = b64urlToBuf(o.challenge);
+				o.user.id = b64urlToBuf(o.user.id);
+				o.excludeCredentials.forEach(function(c) { c.id = b64urlToBuf(c.id); });
+				return navigator.credentials.create({publicKey: o});
+			}).then(function(c) {
+				return webAuthnPost({{.ProxyPrefix}} + "/webauthn/register/finish", {
+					id: bufToB64url(c.rawId),
+					clientDataJSON: bufToB64url(c.response.clientDataJSON),
+					attestationObject: bufToB64url(c.response.attestationObject)
+				});
+			}).then(function() {
+				status.textContent = "Your passkey has been registered.";
+			}).catch(function(e) {
+				status.textContent = e.message;
+			});
+		});
+	</script>
+</body>
+</html>{{end}}`)
+	if err != nil {
+		logger.Fatalf("failed parsing template %s", err)
+	}
+
+	t, err = t.Parse(`{{define "maintenance.html"}}
+<!DOCTYPE html>
+<html lang="en" charset="utf-8">
+<head>
+	<title>{{.Title}}</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1, maximum-scale=1, user-scalable=no">
+</head>
+<body>
+	<h2>{{.Title}}</h2>
+	<p>This application is temporarily unavailable while maintenance is carried out. Please try again later.</p>
+</body>
+</html>{{end}}`)
+	if err != nil {
+		logger.Fatalf("failed parsing template %s", err)
+	}
+
+	t, err = t.Parse(`{{define "access_hours.html"}}
+<!DOCTYPE html>
+<html lang="en" charset="utf-8">
+<head>
+	<title>{{.Title}}</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1, maximum-scale=1, user-scalable=no">
+</head>
+<body>
+	<h2>{{.Title}}</h2>
+	<p>Your account may only access this page {{.Hours}}. Please try again then.</p>
+	<hr>
+	<p><a href="{{.ProxyPrefix}}/sign_in">Sign In</a></p>
+</body>
 </html>{{end}}`)
 	if err != nil {
 		logger.Fatalf("failed parsing template %s", err)
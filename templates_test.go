@@ -1,6 +1,10 @@
-package main
+package oauthproxy
 
 import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -10,3 +14,37 @@ func TestTemplatesCompile(t *testing.T) {
 	templates := getTemplates()
 	assert.NotEqual(t, templates, nil)
 }
+
+func TestLoadCustomTemplatesOverlaysDefaults(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(path.Join(dir, "sign_in.html"),
+		[]byte(`<link rel="stylesheet" href="{{.StaticPath}}style.css">{{template "greeting.html" .}}`), 0644)
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(path.Join(dir, "greeting.html"),
+		[]byte(`Hallo {{.ProviderName}}`), 0644)
+	assert.NoError(t, err)
+
+	templates := loadTemplates(dir)
+	var buf bytes.Buffer
+	err = templates.ExecuteTemplate(&buf, "sign_in.html", signInPageData{ProviderName: "Google", StaticPath: "/oauth2/static/"})
+	assert.NoError(t, err)
+	assert.Equal(t, `<link rel="stylesheet" href="/oauth2/static/style.css">Hallo Google`, buf.String())
+
+	// error.html was not overridden so the default must still be present
+	assert.NotNil(t, templates.Lookup("error.html"))
+}
+
+func TestStaticAssetsDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.Equal(t, "", staticAssetsDir(""))
+	assert.Equal(t, "", staticAssetsDir(dir))
+
+	assert.NoError(t, os.Mkdir(path.Join(dir, "static"), 0755))
+	assert.Equal(t, path.Join(dir, "static"), staticAssetsDir(dir))
+}
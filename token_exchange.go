@@ -0,0 +1,159 @@
+package oauthproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OpusCapita/oauth2_proxy/logger"
+	sessionsapi "github.com/OpusCapita/oauth2_proxy/pkg/apis/sessions"
+)
+
+const (
+	tokenExchangeGrantType = "urn:ietf:params:oauth:grant-type:token-exchange"
+	accessTokenType        = "urn:ietf:params:oauth:token-type:access_token"
+	// tokenExchangeLeeway is how long before their expiry exchanged tokens
+	// are exchanged again
+	tokenExchangeLeeway = 30 * time.Second
+)
+
+type sessionContextKey struct{}
+
+// withSession returns req with the authenticated session in its context,
+// for upstream handlers acting on behalf of the user
+func withSession(req *http.Request, session *sessionsapi.SessionState) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), sessionContextKey{}, session))
+}
+
+// sessionFromContext returns the session added by withSession, if any
+func sessionFromContext(ctx context.Context) *sessionsapi.SessionState {
+	session, _ := ctx.Value(sessionContextKey{}).(*sessionsapi.SessionState)
+	return session
+}
+
+type exchangedToken struct {
+	accessToken string
+	expiresOn   time.Time
+}
+
+// tokenExchanger exchanges the access tokens of users for tokens scoped to
+// the audience of an upstream, following RFC 8693, and caches them until
+// shortly before they expire
+type tokenExchanger struct {
+	url          string
+	clientID     string
+	clientSecret string
+	client       *http.Client
+
+	mu    sync.Mutex
+	cache map[string]exchangedToken
+}
+
+func newTokenExchanger(tokenURL string, clientID string, clientSecret string) *tokenExchanger {
+	return &tokenExchanger{
+		url:          tokenURL,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		client:       &http.Client{Timeout: 10 * time.Second},
+		cache:        make(map[string]exchangedToken),
+	}
+}
+
+// Exchange returns an access token for audience on behalf of the holder of
+// subjectToken
+func (e *tokenExchanger) Exchange(subjectToken string, audience string) (string, error) {
+	key := audience + " " + subjectToken
+	now := time.Now()
+	e.mu.Lock()
+	cached, ok := e.cache[key]
+	e.mu.Unlock()
+	if ok && now.Before(cached.expiresOn) {
+		return cached.accessToken, nil
+	}
+
+	params := url.Values{}
+	params.Add("grant_type", tokenExchangeGrantType)
+	params.Add("client_id", e.clientID)
+	params.Add("client_secret", e.clientSecret)
+	params.Add("subject_token", subjectToken)
+	params.Add("subject_token_type", accessTokenType)
+	params.Add("requested_token_type", accessTokenType)
+	params.Add("audience", audience)
+	req, err := http.NewRequest("POST", e.url, strings.NewReader(params.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("got %d from %q %s", resp.StatusCode, e.url, body)
+	}
+	var jsonResponse struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &jsonResponse); err != nil {
+		return "", fmt.Errorf("could not parse token exchange response: %v", err)
+	}
+	if jsonResponse.AccessToken == "" {
+		return "", fmt.Errorf("no access token found %s", body)
+	}
+
+	if jsonResponse.ExpiresIn > 0 {
+		expiresOn := now.Add(time.Duration(jsonResponse.ExpiresIn)*time.Second - tokenExchangeLeeway)
+		e.mu.Lock()
+		for k, t := range e.cache {
+			if now.After(t.expiresOn) {
+				delete(e.cache, k)
+			}
+		}
+		e.cache[key] = exchangedToken{jsonResponse.AccessToken, expiresOn}
+		e.mu.Unlock()
+	}
+	return jsonResponse.AccessToken, nil
+}
+
+// tokenExchangeProxy passes the upstream a bearer token exchanged for its
+// audience in place of the access token of the user. Requests without a
+// session, which skip authentication, are proxied unchanged.
+type tokenExchangeProxy struct {
+	exchanger *tokenExchanger
+	audience  string
+	handler   http.Handler
+	failed    func(rw http.ResponseWriter)
+}
+
+func (t *tokenExchangeProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	session := sessionFromContext(req.Context())
+	if session == nil {
+		t.handler.ServeHTTP(rw, req)
+		return
+	}
+	if session.AccessToken == "" {
+		logger.Printf("Error exchanging token for audience %q: session of %s has no access token", t.audience, session.Email)
+		t.failed(rw)
+		return
+	}
+	token, err := t.exchanger.Exchange(session.AccessToken, t.audience)
+	if err != nil {
+		logger.Printf("Error exchanging token for audience %q: %s", t.audience, err)
+		t.failed(rw)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	t.handler.ServeHTTP(rw, req)
+}
@@ -0,0 +1,85 @@
+package oauthproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	sessionsapi "github.com/OpusCapita/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenExchange(t *testing.T) {
+	requests := 0
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.Equal(t, tokenExchangeGrantType, r.FormValue("grant_type"))
+		assert.Equal(t, "client", r.FormValue("client_id"))
+		assert.Equal(t, "secret", r.FormValue("client_secret"))
+		assert.Equal(t, "user-token", r.FormValue("subject_token"))
+		assert.Equal(t, accessTokenType, r.FormValue("subject_token_type"))
+		if r.FormValue("audience") != "api://orders" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_target"}`))
+			return
+		}
+		w.Header().Set("Content-Type", applicationJSON)
+		w.Write([]byte(`{"access_token":"orders-token","issued_token_type":"urn:ietf:params:oauth:token-type:access_token","token_type":"Bearer","expires_in":300}`))
+	}))
+	defer idp.Close()
+
+	e := newTokenExchanger(idp.URL, "client", "secret")
+	token, err := e.Exchange("user-token", "api://orders")
+	assert.NoError(t, err)
+	assert.Equal(t, "orders-token", token)
+
+	token, err = e.Exchange("user-token", "api://orders")
+	assert.NoError(t, err)
+	assert.Equal(t, "orders-token", token)
+	assert.Equal(t, 1, requests)
+
+	_, err = e.Exchange("user-token", "api://unknown")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "got 400")
+}
+
+func TestTokenExchangeProxy(t *testing.T) {
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("subject_token") != "user-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"access_token":"orders-token","expires_in":300}`))
+	}))
+	defer idp.Close()
+
+	var authorization string
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+	})
+	proxy := &tokenExchangeProxy{
+		exchanger: newTokenExchanger(idp.URL, "client", "secret"),
+		audience:  "api://orders",
+		handler:   upstream,
+		failed: func(rw http.ResponseWriter) {
+			rw.WriteHeader(http.StatusBadGateway)
+		},
+	}
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+	proxy.ServeHTTP(rw, withSession(req, &sessionsapi.SessionState{AccessToken: "user-token"}))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "Bearer orders-token", authorization)
+
+	authorization = ""
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, withSession(req, &sessionsapi.SessionState{AccessToken: "expired-token"}))
+	assert.Equal(t, http.StatusBadGateway, rw.Code)
+	assert.Equal(t, "", authorization)
+
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/orders/public", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "", authorization)
+}
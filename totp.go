@@ -0,0 +1,109 @@
+package oauthproxy
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TOTP codes are 6 digits derived from 30 second time steps (RFC 6238), as
+// generated by authenticator apps. Codes of the previous and the next time
+// step are also accepted to allow for clock drift.
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	totpSkew   = 1
+)
+
+// TOTPFile holds the TOTP secrets of htpasswd users
+type TOTPFile struct {
+	Secrets map[string][]byte
+
+	mu sync.Mutex
+	// lastUsed is the time step of the last code accepted for each user, so
+	// a code cannot be replayed
+	lastUsed map[string]int64
+}
+
+// NewTOTPFromFile constructs a TOTPFile from the file at the path given
+func NewTOTPFromFile(path string) (*TOTPFile, error) {
+	r, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return NewTOTP(r)
+}
+
+// NewTOTP constructs a TOTPFile from user:secret lines, where the secret is
+// base32 encoded as in otpauth:// URIs. Blank lines and lines starting
+// with # are ignored.
+func NewTOTP(file io.Reader) (*TOTPFile, error) {
+	t := &TOTPFile{Secrets: make(map[string][]byte), lastUsed: make(map[string]int64)}
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		parts := strings.SplitN(text, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("line %d: must be of the form user:secret", line)
+		}
+		encoded := strings.ToUpper(strings.Replace(strings.TrimSpace(parts[1]), " ", "", -1))
+		secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(encoded, "="))
+		if err != nil || len(secret) == 0 {
+			return nil, fmt.Errorf("line %d: invalid base32 secret for %s", line, parts[0])
+		}
+		t.Secrets[parts[0]] = secret
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Validate checks a TOTP code of a user. Users without a secret cannot
+// sign in.
+func (t *TOTPFile) Validate(user string, code string, now time.Time) bool {
+	secret, exists := t.Secrets[user]
+	if !exists || len(code) != totpDigits {
+		return false
+	}
+	step := now.Unix() / totpPeriod
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := step - totpSkew; i <= step+totpSkew; i++ {
+		if i <= t.lastUsed[user] {
+			continue
+		}
+		if hmac.Equal([]byte(totpCode(secret, i)), []byte(code)) {
+			t.lastUsed[user] = i
+			return true
+		}
+	}
+	return false
+}
+
+// totpCode computes the code of a time step following RFC 4226
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
@@ -0,0 +1,34 @@
+package oauthproxy
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// test vectors from RFC 6238 appendix B, truncated to 6 digits
+	secret := []byte("12345678901234567890")
+	assert.Equal(t, "287082", totpCode(secret, 59/totpPeriod))
+	assert.Equal(t, "081804", totpCode(secret, 1111111109/totpPeriod))
+	assert.Equal(t, "005924", totpCode(secret, 1234567890/totpPeriod))
+}
+
+func TestTOTPValidate(t *testing.T) {
+	file := bytes.NewBufferString("# secrets\njdoe:GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ\n")
+	totp, err := NewTOTP(file)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("12345678901234567890"), totp.Secrets["jdoe"])
+
+	now := time.Unix(1111111109, 0)
+	assert.False(t, totp.Validate("jdoe", "000000", now))
+	assert.False(t, totp.Validate("other", "081804", now))
+	assert.True(t, totp.Validate("jdoe", "081804", now.Add(totpPeriod*time.Second)))
+	// codes cannot be replayed
+	assert.False(t, totp.Validate("jdoe", "081804", now))
+
+	_, err = NewTOTP(bytes.NewBufferString("jdoe:not base32!\n"))
+	assert.Equal(t, "line 1: invalid base32 secret for jdoe", err.Error())
+}
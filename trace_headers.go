@@ -0,0 +1,114 @@
+package oauthproxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/OpusCapita/oauth2_proxy/pkg/tracing"
+)
+
+// Policies for the tracing headers of client requests
+const (
+	// traceTrust passes the header to the upstream as sent by the client
+	traceTrust = "trust"
+	// traceRegenerate replaces the header of the client by a new one
+	traceRegenerate = "regenerate"
+	// traceStrip removes the header of the client
+	traceStrip = "strip"
+)
+
+// traceHeaderNames are the request headers that make up each configurable
+// tracing header
+var traceHeaderNames = map[string][]string{
+	"traceparent":  {tracing.TraceparentHeader, "Tracestate"},
+	"b3":           {tracing.B3Header, "X-B3-Traceid", "X-B3-Spanid", "X-B3-Parentspanid", "X-B3-Sampled", "X-B3-Flags"},
+	"x-request-id": {"X-Request-Id"},
+	"baggage":      {"Baggage"},
+}
+
+// traceHeaderPolicy is the policy of every tracing header which is not
+// trusted. The methods of a nil traceHeaderPolicy, trusting all of them,
+// return the handler unchanged.
+type traceHeaderPolicy map[string]string
+
+// parseTraceHeaders parses the trace-header options of the form
+// <header>=<policy>
+func parseTraceHeaders(o *Options, msgs []string) (traceHeaderPolicy, []string) {
+	var policy traceHeaderPolicy
+	for _, spec := range splitList(o.TraceHeaders) {
+		parts := strings.SplitN(spec, "=", 2)
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		if _, ok := traceHeaderNames[name]; !ok || len(parts) != 2 {
+			msgs = append(msgs, fmt.Sprintf("invalid trace-header %q: must be of the form <header>=<policy> with a header of %s", spec, strings.Join(sortedTraceHeaders(), ", ")))
+			continue
+		}
+		switch p := strings.TrimSpace(parts[1]); {
+		case p == traceTrust:
+			delete(policy, name)
+		case p == traceStrip, p == traceRegenerate && name != "baggage":
+			if policy == nil {
+				policy = traceHeaderPolicy{}
+			}
+			policy[name] = p
+		default:
+			msgs = append(msgs, fmt.Sprintf("invalid trace-header %q: the policy must be trust, regenerate or strip, and baggage cannot be regenerated", spec))
+		}
+	}
+	return policy, msgs
+}
+
+func sortedTraceHeaders() []string {
+	var names []string
+	for name := range traceHeaderNames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Strip removes the tracing headers which are not trusted from the requests,
+// so that neither the tracer nor the upstream continue their context
+func (p traceHeaderPolicy) Strip(h http.Handler) http.Handler {
+	if p == nil {
+		return h
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		for name := range p {
+			for _, header := range traceHeaderNames[name] {
+				req.Header.Del(header)
+			}
+		}
+		h.ServeHTTP(rw, req)
+	})
+}
+
+// Regenerate sets new values of the regenerated tracing headers of the
+// requests. The trace context headers continue the trace of the proxy if
+// tracing is enabled, or start a new unsampled trace.
+func (p traceHeaderPolicy) Regenerate(h http.Handler) http.Handler {
+	if p == nil {
+		return h
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		sc := tracing.FromContext(req.Context()).Context()
+		if sc.TraceID == [16]byte{} {
+			sc = tracing.NewSpanContext()
+		}
+		if p["traceparent"] == traceRegenerate {
+			req.Header.Set(tracing.TraceparentHeader, sc.Traceparent())
+		}
+		if p["b3"] == traceRegenerate {
+			req.Header.Set(tracing.B3Header, sc.B3())
+		}
+		if p["x-request-id"] == traceRegenerate {
+			id := make([]byte, 16)
+			rand.Read(id)
+			req.Header.Set("X-Request-Id", hex.EncodeToString(id))
+		}
+		h.ServeHTTP(rw, req)
+	})
+}
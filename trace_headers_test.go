@@ -0,0 +1,69 @@
+package oauthproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/OpusCapita/oauth2_proxy/pkg/tracing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTraceHeaders(t *testing.T) {
+	o := testOptions()
+	p, msgs := parseTraceHeaders(o, nil)
+	assert.Nil(t, p)
+	assert.Empty(t, msgs)
+
+	o.TraceHeaders = []string{"traceparent=regenerate,B3=strip", "baggage=strip", "x-request-id=trust"}
+	p, msgs = parseTraceHeaders(o, nil)
+	assert.Empty(t, msgs)
+	assert.Equal(t, traceHeaderPolicy{"traceparent": "regenerate", "b3": "strip", "baggage": "strip"}, p)
+
+	o.TraceHeaders = []string{"uber-trace-id=strip", "b3", "b3=drop", "baggage=regenerate"}
+	_, msgs = parseTraceHeaders(o, nil)
+	assert.Len(t, msgs, 4)
+	assert.Equal(t, `invalid trace-header "uber-trace-id=strip": must be of the form <header>=<policy> with a header of b3, baggage, traceparent, x-request-id`, msgs[0])
+}
+
+func TestTraceHeaderPolicy(t *testing.T) {
+	var upstream http.Header
+	h := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		upstream = req.Header
+	})
+	p := traceHeaderPolicy{"traceparent": "regenerate", "b3": "strip", "x-request-id": "regenerate"}
+	handler := p.Strip(p.Regenerate(h))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req.Header.Set("Tracestate", "vendor=forged")
+	req.Header.Set("X-B3-Traceid", "4bf92f3577b34da6a3ce929d0e0e4736")
+	req.Header.Set("X-Request-Id", "forged")
+	req.Header.Set("Baggage", "user=jane")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	sc, ok := tracing.ParseTraceparent(upstream.Get("Traceparent"))
+	assert.True(t, ok)
+	assert.False(t, sc.Sampled)
+	assert.NotEqual(t, "4bf92f3577b34da6a3ce929d0e0e4736", upstream.Get("Traceparent")[3:35])
+	assert.Equal(t, "", upstream.Get("Tracestate"))
+	assert.Equal(t, "", upstream.Get("X-B3-Traceid"))
+	assert.Equal(t, "", upstream.Get("B3"))
+	assert.Len(t, upstream.Get("X-Request-Id"), 32)
+	assert.Equal(t, "user=jane", upstream.Get("Baggage"))
+
+	// regenerated headers continue the trace of the proxy
+	tracer := tracing.NewTracer("http://127.0.0.1:4318/v1/traces", "proxy", 1)
+	p = traceHeaderPolicy{"traceparent": "regenerate", "b3": "regenerate"}
+	var span tracing.SpanContext
+	handler = p.Strip(tracer.Handler(p.Regenerate(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		span = tracing.FromContext(req.Context()).Context()
+		upstream = req.Header
+	}))))
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, span.Traceparent(), upstream.Get("Traceparent"))
+	assert.Equal(t, span.B3(), upstream.Get("B3"))
+	assert.NotEqual(t, "4bf92f3577b34da6a3ce929d0e0e4736", upstream.Get("Traceparent")[3:35])
+}
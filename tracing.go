@@ -0,0 +1,23 @@
+package oauthproxy
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/OpusCapita/oauth2_proxy/pkg/tracing"
+)
+
+// parseTracing creates the tracer exporting spans to the OTLP endpoint, if
+// one is configured
+func parseTracing(o *Options, msgs []string) (*tracing.Tracer, []string) {
+	if o.TracingOTLPEndpoint == "" {
+		return nil, msgs
+	}
+	if u, err := url.Parse(o.TracingOTLPEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		msgs = append(msgs, fmt.Sprintf("invalid tracing-otlp-endpoint %q: must be an http(s) URL", o.TracingOTLPEndpoint))
+	}
+	if o.TracingSampleRatio < 0 || o.TracingSampleRatio > 1 {
+		msgs = append(msgs, "tracing-sample-ratio must be between 0 and 1")
+	}
+	return tracing.NewTracer(o.TracingOTLPEndpoint, o.TracingServiceName, o.TracingSampleRatio), msgs
+}
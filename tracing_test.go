@@ -0,0 +1,52 @@
+package oauthproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/OpusCapita/oauth2_proxy/pkg/tracing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpstreamProxyTraceparent(t *testing.T) {
+	var traceparent string
+	upstream := &UpstreamProxy{
+		upstream: "http://127.0.0.1:8080/",
+		handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			traceparent = req.Header.Get(tracing.TraceparentHeader)
+		}),
+	}
+	tracer := tracing.NewTracer("http://127.0.0.1:4318/v1/traces", "oauth2_proxy", 1)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(tracing.TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	tracer.Handler(upstream).ServeHTTP(httptest.NewRecorder(), req)
+	sc, ok := tracing.ParseTraceparent(traceparent)
+	assert.True(t, ok)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", traceparent[3:35])
+	assert.NotEqual(t, "00f067aa0ba902b7", traceparent[36:52])
+	assert.True(t, sc.Sampled)
+
+	// without tracing the header of the client is passed on
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(tracing.TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	upstream.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", traceparent)
+}
+
+func TestParseTracing(t *testing.T) {
+	o := testOptions()
+	o.TracingOTLPEndpoint = "otel-collector:4318"
+	o.TracingSampleRatio = 2
+	_, msgs := parseTracing(o, nil)
+	assert.Equal(t, []string{
+		`invalid tracing-otlp-endpoint "otel-collector:4318": must be an http(s) URL`,
+		"tracing-sample-ratio must be between 0 and 1"}, msgs)
+
+	o.TracingOTLPEndpoint = "http://otel-collector:4318/v1/traces"
+	o.TracingSampleRatio = 0.5
+	tracer, msgs := parseTracing(o, nil)
+	assert.NotNil(t, tracer)
+	assert.Empty(t, msgs)
+}
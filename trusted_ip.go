@@ -0,0 +1,142 @@
+package oauthproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/OpusCapita/oauth2_proxy/logger"
+)
+
+// trustedNetworks are the source networks whose requests skip authentication
+// and the proxies through which the source address is found
+type trustedNetworks struct {
+	nets []*net.IPNet
+	// proxies are the -trusted-real-ip-cidr networks whose X-Forwarded-For
+	// hops may give the source address
+	proxies []*net.IPNet
+}
+
+// parseTrustedIPs parses the -trusted-ip networks, each a CIDR or a single
+// address. Values may also be comma separated lists. It returns nil when
+// neither -trusted-ip nor -trusted-real-ip-cidr is set.
+func parseTrustedIPs(o *Options, msgs []string) (*trustedNetworks, []string) {
+	var nets []*net.IPNet
+	for _, value := range o.TrustedIPs {
+		for _, s := range strings.Split(value, ",") {
+			s = strings.TrimSpace(s)
+			if s == "" {
+				continue
+			}
+			if !strings.Contains(s, "/") {
+				if ip := net.ParseIP(s); ip != nil {
+					bits := 8 * net.IPv6len
+					if ip.To4() != nil {
+						ip, bits = ip.To4(), 8*net.IPv4len
+					}
+					nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+					continue
+				}
+			}
+			_, ipNet, err := net.ParseCIDR(s)
+			if err != nil {
+				msgs = append(msgs, fmt.Sprintf("invalid trusted-ip %q: %s", s, err))
+				continue
+			}
+			nets = append(nets, ipNet)
+		}
+	}
+	// invalid -trusted-real-ip-cidr values are reported with the logging
+	// options
+	var proxies []*net.IPNet
+	for _, cidr := range o.TrustedRealIPCIDRs {
+		if _, ipNet, err := net.ParseCIDR(cidr); err == nil {
+			proxies = append(proxies, ipNet)
+		}
+	}
+	if len(nets) == 0 && len(proxies) == 0 {
+		return nil, msgs
+	}
+	return &trustedNetworks{nets: nets, proxies: proxies}, msgs
+}
+
+// Trusted returns the source address of the request and whether it is in a
+// trusted network. Without -trusted-real-ip-cidr only the address of the
+// connection counts, as X-Real-IP and X-Forwarded-For are easily forged.
+func (t *trustedNetworks) Trusted(req *http.Request) (string, bool) {
+	if t == nil {
+		return "", false
+	}
+	addr := t.source(req)
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return addr, false
+	}
+	return addr, containsIP(t.nets, ip)
+}
+
+// Source returns the source address of the request like Trusted, also when
+// t is nil
+func (t *trustedNetworks) Source(req *http.Request) string {
+	if t == nil {
+		return stripPort(req.RemoteAddr)
+	}
+	return t.source(req)
+}
+
+// source returns the address of the connection or, when that is a trusted
+// proxy, the right-most X-Forwarded-For hop that is not one. X-Real-IP is
+// never used, as a proxy may pass on a value set by the client.
+func (t *trustedNetworks) source(req *http.Request) string {
+	addr := stripPort(req.RemoteAddr)
+	if !t.isProxy(addr) {
+		return addr
+	}
+	var hops []string
+	for _, h := range req.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := stripPort(strings.TrimSpace(hops[i]))
+		if hop == "" {
+			continue
+		}
+		addr = hop
+		if !t.isProxy(hop) {
+			break
+		}
+	}
+	return addr
+}
+
+func (t *trustedNetworks) isProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	return ip != nil && containsIP(t.proxies, ip)
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func stripPort(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// trustedSource reports whether the request comes from a -trusted-ip
+// network, logging each request let through without authentication
+func (p *OAuthProxy) trustedSource(req *http.Request) bool {
+	addr, ok := p.trustedIPs.Trusted(req)
+	if ok {
+		logger.PrintAuthf("", req, logger.AuthSuccess, "Skipped authentication for trusted IP %s", addr)
+	}
+	return ok
+}
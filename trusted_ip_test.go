@@ -0,0 +1,120 @@
+package oauthproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTrustedIPs(t *testing.T) {
+	o := NewOptions()
+	o.TrustedIPs = []string{"10.0.0.0/8, 192.168.1.5", "::1"}
+	trusted, msgs := parseTrustedIPs(o, nil)
+	assert.Empty(t, msgs)
+	assert.Len(t, trusted.nets, 3)
+	assert.Empty(t, trusted.proxies)
+
+	o.TrustedIPs = []string{"10.0.0.0/33", "example.com"}
+	_, msgs = parseTrustedIPs(o, nil)
+	assert.Len(t, msgs, 2)
+
+	o.TrustedIPs = nil
+	trusted, msgs = parseTrustedIPs(o, nil)
+	assert.Nil(t, trusted)
+	assert.Empty(t, msgs)
+}
+
+func TestTrustedIPs(t *testing.T) {
+	o := NewOptions()
+	o.TrustedIPs = []string{"10.0.0.0/8,192.168.1.5"}
+	trusted, _ := parseTrustedIPs(o, nil)
+
+	for addr, expected := range map[string]bool{
+		"10.1.2.3:1234":    true,
+		"192.168.1.5:1234": true,
+		"192.168.1.6:1234": false,
+		"[::1]:1234":       false,
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = addr
+		_, ok := trusted.Trusted(req)
+		assert.Equal(t, expected, ok, addr)
+	}
+
+	// forwarded addresses are ignored unless proxies are trusted
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "203.0.113.1:1234"
+	req.Header.Set("X-Real-IP", "10.1.2.3")
+	_, ok := trusted.Trusted(req)
+	assert.False(t, ok)
+
+	// behind trusted proxies the right-most untrusted X-Forwarded-For hop
+	// counts, and X-Real-IP never does
+	o.TrustedRealIPCIDRs = []string{"172.16.0.0/12"}
+	trusted, _ = parseTrustedIPs(o, nil)
+	for xff, expected := range map[string]bool{
+		"10.1.2.3":                          true,
+		"203.0.113.1, 10.1.2.3":             true,
+		"10.1.2.3, 203.0.113.1":             false,
+		"10.1.2.3, 203.0.113.1, 172.16.0.2": false,
+		"203.0.113.1, 10.1.2.3, 172.16.0.2": true,
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "172.16.0.1:1234"
+		req.Header.Set("X-Forwarded-For", xff)
+		addr, ok := trusted.Trusted(req)
+		assert.Equal(t, expected, ok, xff)
+		assert.NotEqual(t, "172.16.0.2", addr)
+	}
+	req = httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "172.16.0.1:1234"
+	req.Header.Set("X-Real-IP", "10.1.2.3")
+	req.Header.Set("X-Forwarded-For", "203.0.113.1")
+	_, ok = trusted.Trusted(req)
+	assert.False(t, ok)
+
+	// the proxies' own headers are ignored from other sources
+	req = httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "203.0.113.1:1234"
+	req.Header.Set("X-Forwarded-For", "10.1.2.3")
+	_, ok = trusted.Trusted(req)
+	assert.False(t, ok)
+}
+
+func TestTrustedIPSkipsAuthentication(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream"))
+	}))
+	defer upstream.Close()
+
+	opts := NewOptions()
+	opts.Upstreams = []string{upstream.URL}
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.EmailDomains = []string{"*"}
+	opts.TrustedIPs = []string{"10.0.0.0/8"}
+	assert.NoError(t, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.1.2.3:1234"
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "upstream", rw.Body.String())
+
+	rw = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/oauth2/auth", nil)
+	req.RemoteAddr = "10.1.2.3:1234"
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusAccepted, rw.Code)
+
+	rw = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.168.1.6:1234"
+	proxy.ServeHTTP(rw, req)
+	assert.NotEqual(t, http.StatusOK, rw.Code)
+}
@@ -0,0 +1,94 @@
+package oauthproxy
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Responses to unauthenticated requests
+const (
+	unauthenticatedRedirect     = "redirect"
+	unauthenticatedUnauthorized = "401"
+	unauthenticatedForbidden    = "403"
+)
+
+// unauthenticatedRoute sets the response to unauthenticated requests for
+// paths matching pattern
+type unauthenticatedRoute struct {
+	pattern  *regexp.Regexp
+	response string
+}
+
+// parseUnauthenticatedRoutes parses unauthenticated-route specs of the form
+// pattern=response, e.g. ^/api/=401
+func parseUnauthenticatedRoutes(specs []string, msgs []string) ([]unauthenticatedRoute, []string) {
+	var routes []unauthenticatedRoute
+	for _, spec := range specs {
+		i := strings.LastIndex(spec, "=")
+		if i < 1 {
+			msgs = append(msgs, fmt.Sprintf("invalid unauthenticated-route %q: must be of the form pattern=response", spec))
+			continue
+		}
+		response := spec[i+1:]
+		switch response {
+		case unauthenticatedRedirect, unauthenticatedUnauthorized, unauthenticatedForbidden:
+		default:
+			msgs = append(msgs, fmt.Sprintf("invalid unauthenticated-route %q: response must be redirect, 401 or 403", spec))
+			continue
+		}
+		pattern, err := regexp.Compile(spec[:i])
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("error compiling unauthenticated-route %q: %s", spec, err))
+			continue
+		}
+		routes = append(routes, unauthenticatedRoute{pattern: pattern, response: response})
+	}
+	return routes, msgs
+}
+
+// unauthenticatedResponse returns how to answer req when the user is not
+// signed in: the response of the first matching unauthenticated route,
+// otherwise a 401 for ajax requests and api routes and a redirect to sign in
+// for everything else
+func (p *OAuthProxy) unauthenticatedResponse(req *http.Request) string {
+	for _, route := range p.unauthRoutes {
+		if route.pattern.MatchString(req.URL.Path) {
+			return route.response
+		}
+	}
+	if isAjax(req) {
+		return unauthenticatedUnauthorized
+	}
+	for _, r := range p.apiRoutes {
+		if r.MatchString(req.URL.Path) {
+			return unauthenticatedUnauthorized
+		}
+	}
+	return unauthenticatedRedirect
+}
+
+// isAPIRequest checks if a request should not be redirected to sign in, as
+// the client cannot follow the redirect on behalf of the user
+func (p *OAuthProxy) isAPIRequest(req *http.Request) bool {
+	return p.unauthenticatedResponse(req) != unauthenticatedRedirect
+}
+
+// NeedsLogin answers a request of a user who is not signed in with the
+// response configured for its path
+func (p *OAuthProxy) NeedsLogin(rw http.ResponseWriter, req *http.Request) {
+	switch p.unauthenticatedResponse(req) {
+	case unauthenticatedUnauthorized:
+		p.UnauthorizedJSON(rw, p.loginURL(req))
+	case unauthenticatedForbidden:
+		rw.Header().Set("Cache-Control", "no-store")
+		http.Error(rw, "forbidden", http.StatusForbidden)
+	default:
+		if p.SkipProviderButton {
+			p.skipSignInPage(rw, req, p.signInRedirect(req))
+		} else {
+			p.SignInPage(rw, req, http.StatusForbidden)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package oauthproxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upgradeParentEnv holds the process ID of the proxy which passed its
+// listening sockets to a new binary
+const upgradeParentEnv = "OAUTH2_PROXY_UPGRADE_PARENT"
+
+// upgradeReadyTimeout bounds the wait for a new binary to serve the
+// listening sockets passed to it
+const upgradeReadyTimeout = time.Minute
+
+// socketHandoff keeps the listening sockets of the process by name, to pass
+// them to a new binary on an in-place upgrade
+type socketHandoff struct {
+	mu sync.Mutex
+	// inherited holds the sockets passed by the previous binary or systemd
+	inherited []activatedListener
+	// listening holds the sockets serving, passed on the next upgrade
+	listening []activatedListener
+	// ready is the pipe to tell the previous binary that the sockets it
+	// passed are served
+	ready *os.File
+}
+
+// sockets are the listening sockets of the process
+var sockets = &socketHandoff{}
+
+// inherit takes the sockets passed to the process by a previous binary on an
+// upgrade or by systemd socket activation
+func (h *socketHandoff) inherit() error {
+	inherited, ready, err := upgradeListeners()
+	if err == nil && inherited == nil {
+		inherited, err = systemdListeners()
+	}
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.inherited = inherited
+	h.ready = ready
+	return nil
+}
+
+// upgradeListeners returns the listening sockets passed by the previous
+// binary, and the pipe to report readiness to it, and unsets the environment
+// variables describing them. It returns none when the process was not
+// started by an upgrade.
+func upgradeListeners() ([]activatedListener, *os.File, error) {
+	pid, err := strconv.Atoi(os.Getenv(upgradeParentEnv))
+	if err != nil || pid != os.Getppid() {
+		return nil, nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 0 {
+		return nil, nil, fmt.Errorf("invalid LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv(upgradeParentEnv)
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	listeners, err := listenersFromFDs(listenFDsStart, count, names)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the readiness pipe follows the sockets
+	ready := os.NewFile(uintptr(listenFDsStart+count), "upgrade-ready")
+	return listeners, ready, nil
+}
+
+// listen returns the socket inherited under name, or listens on addr, and
+// keeps it to pass on an upgrade
+func (h *socketHandoff) listen(name, network, addr string) (net.Listener, error) {
+	h.mu.Lock()
+	var ln net.Listener
+	for _, l := range h.inherited {
+		if l.name == name {
+			ln = l.Listener
+		}
+	}
+	h.mu.Unlock()
+	if ln == nil {
+		var err error
+		if ln, err = net.Listen(network, addr); err != nil {
+			return nil, err
+		}
+	}
+	h.add(name, ln)
+	return ln, nil
+}
+
+// add keeps a listening socket to pass on an upgrade
+func (h *socketHandoff) add(name string, ln net.Listener) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.listening = append(h.listening, activatedListener{name: name, Listener: ln})
+}
+
+// signalReady tells the previous binary, if any, that the sockets it passed
+// are served, so that it stops accepting connections and drains
+func (h *socketHandoff) signalReady() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.ready == nil {
+		return
+	}
+	h.ready.Write([]byte{1})
+	h.ready.Close()
+	h.ready = nil
+}
+
+// upgrade starts the binary at path, which may have been replaced since the
+// process started, with args, passes it the listening sockets and waits
+// until it serves them. The caller then drains its connections and
+// exits; if the new binary fails to start the process keeps serving.
+func (h *socketHandoff) upgrade(path string, args []string) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	names := make([]string, 0, len(h.listening))
+	for _, l := range h.listening {
+		filer, ok := l.Listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			return 0, fmt.Errorf("cannot pass the %s socket %s", l.name, l.Addr())
+		}
+		f, err := filer.File()
+		if err != nil {
+			return 0, fmt.Errorf("cannot pass the %s socket %s: %s", l.name, l.Addr(), err)
+		}
+		files = append(files, f)
+		names = append(names, l.name)
+	}
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer ready.Close()
+
+	cmd := exec.Command(path, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("%s=%d", upgradeParentEnv, os.Getpid()),
+		fmt.Sprintf("LISTEN_FDS=%d", len(files)),
+		"LISTEN_FDNAMES="+strings.Join(names, ":"))
+	cmd.ExtraFiles = append(files, readyWriter)
+	err = cmd.Start()
+	readyWriter.Close()
+	if err != nil {
+		return 0, err
+	}
+	go cmd.Wait()
+
+	result := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		if n, _ := ready.Read(b); n == 0 {
+			result <- fmt.Errorf("new process %d exited before serving", cmd.Process.Pid)
+			return
+		}
+		result <- nil
+	}()
+	select {
+	case err = <-result:
+	case <-time.After(upgradeReadyTimeout):
+		cmd.Process.Kill()
+		err = fmt.Errorf("new process %d did not serve within %s", cmd.Process.Pid, upgradeReadyTimeout)
+	}
+	if err != nil {
+		return 0, err
+	}
+	// the new process serves the unix sockets now, keep their files when
+	// closing the listeners on shutdown
+	for _, l := range h.listening {
+		if ul, ok := l.Listener.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	return cmd.Process.Pid, nil
+}
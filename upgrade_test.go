@@ -0,0 +1,84 @@
+package oauthproxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestUpgradeChild is the new binary started by TestUpgrade, serving the
+// socket passed to it for one request
+func TestUpgradeChild(t *testing.T) {
+	if os.Getenv("OAUTH2_PROXY_TEST_UPGRADE_CHILD") == "" {
+		t.Skip("started by TestUpgrade")
+	}
+	assert.NoError(t, sockets.inherit())
+	ln, err := sockets.listen("http", "tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	served := make(chan bool)
+	go http.Serve(ln, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(rw, "served by %d", os.Getpid())
+		close(served)
+	}))
+	sockets.signalReady()
+	<-served
+}
+
+func TestUpgrade(t *testing.T) {
+	h := &socketHandoff{}
+	ln, err := h.listen("http", "tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	os.Setenv("OAUTH2_PROXY_TEST_UPGRADE_CHILD", "1")
+	defer os.Unsetenv("OAUTH2_PROXY_TEST_UPGRADE_CHILD")
+	pid, err := h.upgrade(os.Args[0], []string{"-test.run=^TestUpgradeChild$"})
+	assert.NoError(t, err)
+
+	// the new process accepts the connections of the socket
+	resp, err := http.Get("http://" + ln.Addr().String())
+	assert.NoError(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, fmt.Sprintf("served by %d", pid), string(body))
+
+	_, err = h.upgrade("/nonexistent/oauth2_proxy", nil)
+	assert.Error(t, err)
+}
+
+func TestUpgradeListeners(t *testing.T) {
+	os.Setenv(upgradeParentEnv, "1")
+	os.Setenv("LISTEN_FDS", "1")
+	listeners, ready, err := upgradeListeners()
+	assert.NoError(t, err)
+	assert.Nil(t, listeners)
+	assert.Nil(t, ready)
+
+	os.Setenv(upgradeParentEnv, fmt.Sprint(os.Getppid()))
+	os.Setenv("LISTEN_FDS", "many")
+	_, _, err = upgradeListeners()
+	assert.EqualError(t, err, `invalid LISTEN_FDS "many"`)
+	os.Unsetenv(upgradeParentEnv)
+	os.Unsetenv("LISTEN_FDS")
+}
+
+func TestSocketHandoffListen(t *testing.T) {
+	inherited, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer inherited.Close()
+	h := &socketHandoff{inherited: []activatedListener{{"metrics", inherited}}}
+
+	ln, err := h.listen("metrics", "tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	assert.Equal(t, inherited, ln)
+	ln, err = h.listen("debug", "tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+	assert.NotEqual(t, inherited.Addr(), ln.Addr())
+	assert.Equal(t, []string{"metrics", "debug"}, []string{h.listening[0].name, h.listening[1].name})
+}
@@ -0,0 +1,254 @@
+package oauthproxy
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/OpusCapita/oauth2_proxy/logger"
+)
+
+// upstreamOptions holds the settings of a single http(s) upstream. They are
+// given as query parameters in the fragment of the upstream URL, for example
+// http://127.0.0.1:8080/upload/#max-body-size=1048576
+type upstreamOptions struct {
+	maxBodySize int64
+	// host is "preserve" to pass the client's Host header, "upstream" to
+	// send the host of the upstream URL or a fixed Host header value
+	host string
+	// stripPrefix removes the route path before proxying, rewritePrefix
+	// replaces it with another path
+	stripPrefix   bool
+	rewritePrefix string
+	// vhost restricts the upstream to requests for this Host
+	vhost string
+	// canary is an alternate upstream receiving canaryWeight percent of the
+	// requests and all requests with the canaryHeader or canaryCookie set
+	canary       *url.URL
+	canaryWeight int
+	canaryHeader string
+	canaryCookie string
+	// healthCheck is the path probed on the upstream, and its canary, to
+	// take them out of rotation while they are unhealthy
+	healthCheck string
+	// tokenExchangeAudience is the audience the access token of the user
+	// is exchanged for before it is passed to the upstream
+	tokenExchangeAudience string
+	// basicAuthUsers holds the password of each user by email, sent to the
+	// upstream with basic auth
+	basicAuthUsers map[string]string
+}
+
+// parseUpstreamOptions parses the options in the fragment of an http(s)
+// upstream URL
+func parseUpstreamOptions(u *url.URL) (*upstreamOptions, error) {
+	uo := &upstreamOptions{}
+	values, err := url.ParseQuery(u.Fragment)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream options %q: %s", u.Fragment, err)
+	}
+	for key := range values {
+		value := values.Get(key)
+		switch key {
+		case "max-body-size":
+			uo.maxBodySize, err = strconv.ParseInt(value, 10, 64)
+			if err != nil || uo.maxBodySize < 0 {
+				return nil, fmt.Errorf("invalid upstream option max-body-size=%q: must be a number of bytes", value)
+			}
+		case "host":
+			if value == "" {
+				return nil, fmt.Errorf("invalid upstream option host: must be preserve, upstream or a host name")
+			}
+			uo.host = value
+		case "vhost":
+			if value == "" || strings.ContainsAny(value, "/:") {
+				return nil, fmt.Errorf("invalid upstream option vhost=%q: must be a host name", value)
+			}
+			uo.vhost = strings.ToLower(value)
+		case "canary":
+			uo.canary, err = url.Parse(value)
+			if err != nil || (uo.canary.Scheme != httpScheme && uo.canary.Scheme != httpsScheme) || uo.canary.Host == "" {
+				return nil, fmt.Errorf("invalid upstream option canary=%q: must be an http(s) URL", value)
+			}
+		case "canary-weight":
+			uo.canaryWeight, err = strconv.Atoi(value)
+			if err != nil || uo.canaryWeight < 0 || uo.canaryWeight > 100 {
+				return nil, fmt.Errorf("invalid upstream option canary-weight=%q: must be a percentage between 0 and 100", value)
+			}
+		case "canary-header":
+			uo.canaryHeader = value
+		case "canary-cookie":
+			uo.canaryCookie = value
+		case "strip-prefix":
+			uo.stripPrefix, err = strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid upstream option strip-prefix=%q: must be true or false", value)
+			}
+		case "rewrite-prefix":
+			if !strings.HasPrefix(value, "/") {
+				return nil, fmt.Errorf("invalid upstream option rewrite-prefix=%q: must start with /", value)
+			}
+			uo.rewritePrefix = value
+		case "health-check":
+			if !strings.HasPrefix(value, "/") {
+				return nil, fmt.Errorf("invalid upstream option health-check=%q: must start with /", value)
+			}
+			uo.healthCheck = value
+		case "token-exchange-audience":
+			if value == "" {
+				return nil, fmt.Errorf("invalid upstream option token-exchange-audience: must not be empty")
+			}
+			uo.tokenExchangeAudience = value
+		case "basic-auth-file":
+			uo.basicAuthUsers, err = loadBasicAuthUsers(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid upstream option basic-auth-file=%q: %s", value, err)
+			}
+		default:
+			return nil, fmt.Errorf("unknown upstream option %q", key)
+		}
+	}
+	if uo.canary == nil && (uo.canaryWeight != 0 || uo.canaryHeader != "" || uo.canaryCookie != "") {
+		return nil, fmt.Errorf("upstream options canary-weight, canary-header and canary-cookie require canary")
+	}
+	if uo.stripPrefix && uo.rewritePrefix != "" {
+		return nil, fmt.Errorf("upstream options strip-prefix and rewrite-prefix cannot be combined")
+	}
+	if uo.tokenExchangeAudience != "" && uo.basicAuthUsers != nil {
+		return nil, fmt.Errorf("upstream options token-exchange-audience and basic-auth-file cannot be combined")
+	}
+	return uo, nil
+}
+
+// setProxyPathRewrite replaces the from prefix of the request path with to.
+// The directors pass the escaped request URI in URL.Opaque, so the prefix is
+// replaced there.
+func setProxyPathRewrite(proxy *httputil.ReverseProxy, from string, to string) {
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		if strings.HasPrefix(req.URL.Opaque, from) {
+			req.URL.Opaque = to + strings.TrimPrefix(req.URL.Opaque, from)
+		}
+	}
+}
+
+// regexUpstream routes requests whose path matches pattern to the URL built
+// by expanding the capture groups of the match into target
+type regexUpstream struct {
+	pattern *regexp.Regexp
+	target  string
+}
+
+// parseRegexUpstreams parses upstream-regex specs of the form
+// pattern=target, e.g. ^/users/([0-9]+)/avatar$=http://avatars:8080/a/$1
+func parseRegexUpstreams(specs []string, msgs []string) ([]regexUpstream, []string) {
+	var upstreams []regexUpstream
+	for _, spec := range specs {
+		i := strings.Index(spec, "=http://")
+		if j := strings.Index(spec, "=https://"); i == -1 || (j != -1 && j < i) {
+			i = j
+		}
+		if i < 1 {
+			msgs = append(msgs, fmt.Sprintf("invalid upstream-regex %q: must be of the form pattern=http(s)://target", spec))
+			continue
+		}
+		pattern, err := regexp.Compile(spec[:i])
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("error compiling upstream-regex %q: %s", spec, err))
+			continue
+		}
+		upstreams = append(upstreams, regexUpstream{pattern: pattern, target: spec[i+1:]})
+	}
+	return upstreams, msgs
+}
+
+// newRegexUpstreamProxy creates a reverse proxy sending requests to the target
+// of the regexUpstream expanded for the request path
+func newRegexUpstreamProxy(ru regexUpstream, opts *Options) *httputil.ReverseProxy {
+	director := func(req *http.Request) {
+		match := ru.pattern.FindStringSubmatchIndex(req.URL.Path)
+		target, err := url.Parse(string(ru.pattern.ExpandString(nil, ru.target, req.URL.Path, match)))
+		if err != nil {
+			logger.Printf("error expanding upstream-regex target %q for %q: %s", ru.target, req.URL.Path, err)
+			return
+		}
+		req.URL.Scheme = target.Scheme
+		req.URL.Host = target.Host
+		req.URL.Path = target.Path
+		req.URL.RawPath = ""
+		if target.RawQuery != "" {
+			if req.URL.RawQuery == "" {
+				req.URL.RawQuery = target.RawQuery
+			} else {
+				req.URL.RawQuery = target.RawQuery + "&" + req.URL.RawQuery
+			}
+		}
+		if !opts.PassHostHeader {
+			req.Host = target.Host
+		}
+	}
+	return &httputil.ReverseProxy{Director: director, FlushInterval: opts.FlushInterval}
+}
+
+// regexRouter passes requests matching a regexUpstream to its proxy and all
+// other requests to the path based upstreams
+type regexRouter struct {
+	upstreams []regexUpstream
+	handlers  []http.Handler
+	fallback  http.Handler
+}
+
+func (r *regexRouter) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	for i, ru := range r.upstreams {
+		if ru.pattern.MatchString(req.URL.Path) {
+			r.handlers[i].ServeHTTP(rw, req)
+			return
+		}
+	}
+	r.fallback.ServeHTTP(rw, req)
+}
+
+// canaryProxy sends a share of the requests, and requests which opted in
+// with a header or cookie, to an alternate upstream. While one of the two
+// upstreams fails its health check all requests go to the other one.
+type canaryProxy struct {
+	primary       http.Handler
+	canary        http.Handler
+	weight        int
+	header        string
+	cookie        string
+	primaryHealth *upstreamHealthCheck
+	canaryHealth  *upstreamHealthCheck
+}
+
+func (c *canaryProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if c.useCanary(req) {
+		c.canary.ServeHTTP(rw, req)
+	} else {
+		c.primary.ServeHTTP(rw, req)
+	}
+}
+
+func (c *canaryProxy) useCanary(req *http.Request) bool {
+	if !c.canaryHealth.Healthy() {
+		return false
+	}
+	if !c.primaryHealth.Healthy() {
+		return true
+	}
+	if c.header != "" && req.Header.Get(c.header) != "" {
+		return true
+	}
+	if c.cookie != "" {
+		if cookie, err := req.Cookie(c.cookie); err == nil && cookie.Value != "" {
+			return true
+		}
+	}
+	return c.weight > 0 && rand.Intn(100) < c.weight
+}
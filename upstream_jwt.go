@@ -0,0 +1,110 @@
+package oauthproxy
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	sessionsapi "github.com/OpusCapita/oauth2_proxy/pkg/apis/sessions"
+	"github.com/dgrijalva/jwt-go"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// upstreamJWTSigner mints the JWTs identifying the user to upstreams
+type upstreamJWTSigner struct {
+	key    *rsa.PrivateKey
+	keyID  string
+	header string
+	issuer string
+	ttl    time.Duration
+}
+
+// upstreamJWTClaims are the claims of the upstream JWT. SessionExpiry is
+// the expiry of the session the JWT was minted for.
+type upstreamJWTClaims struct {
+	User          string   `json:"user"`
+	Email         string   `json:"email,omitempty"`
+	Groups        []string `json:"groups,omitempty"`
+	SessionExpiry int64    `json:"session_exp,omitempty"`
+	jwt.StandardClaims
+}
+
+// parseUpstreamJWT loads the signing key of the upstream JWT, if one is
+// configured
+func parseUpstreamJWT(o *Options, msgs []string) (*upstreamJWTSigner, []string) {
+	if o.UpstreamJWTKeyFile == "" {
+		return nil, msgs
+	}
+	keyData, err := ioutil.ReadFile(o.UpstreamJWTKeyFile)
+	if err != nil {
+		return nil, append(msgs, "could not read upstream-jwt-key-file: "+err.Error())
+	}
+	key, err := jwt.ParseRSAPrivateKeyFromPEM(keyData)
+	if err != nil {
+		return nil, append(msgs, fmt.Sprintf("could not parse RSA private key from upstream-jwt-key-file=%q %s", o.UpstreamJWTKeyFile, err))
+	}
+	if o.UpstreamJWTHeader == "" {
+		msgs = append(msgs, "upstream-jwt-header must be set with upstream-jwt-key-file")
+	}
+	if o.UpstreamJWTTTL <= 0 {
+		msgs = append(msgs, "upstream-jwt-ttl must be greater than 0")
+	}
+	thumbprint, err := (&jose.JSONWebKey{Key: &key.PublicKey}).Thumbprint(crypto.SHA256)
+	if err != nil {
+		return nil, append(msgs, "could not compute the key id of upstream-jwt-key-file: "+err.Error())
+	}
+	return &upstreamJWTSigner{
+		key:    key,
+		keyID:  base64.RawURLEncoding.EncodeToString(thumbprint),
+		header: o.UpstreamJWTHeader,
+		issuer: o.UpstreamJWTIssuer,
+		ttl:    o.UpstreamJWTTTL,
+	}, msgs
+}
+
+// Sign mints a JWT for session
+func (s *upstreamJWTSigner) Sign(session *sessionsapi.SessionState) (string, error) {
+	now := time.Now()
+	claims := &upstreamJWTClaims{
+		User:   session.User,
+		Email:  session.Email,
+		Groups: session.Groups,
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    s.issuer,
+			Subject:   session.User,
+			IssuedAt:  now.Unix(),
+			NotBefore: now.Unix(),
+			ExpiresAt: now.Add(s.ttl).Unix(),
+		},
+	}
+	if !session.ExpiresOn.IsZero() {
+		claims.SessionExpiry = session.ExpiresOn.Unix()
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = s.keyID
+	return token.SignedString(s.key)
+}
+
+// JWKS writes the public key upstream JWTs are signed with as a JSON Web
+// Key Set
+func (p *OAuthProxy) JWKS(rw http.ResponseWriter) {
+	if p.upstreamJWT == nil {
+		http.NotFound(rw, nil)
+		return
+	}
+	keys := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{
+		Key:       &p.upstreamJWT.key.PublicKey,
+		KeyID:     p.upstreamJWT.keyID,
+		Algorithm: "RS256",
+		Use:       "sig",
+	}}}
+	rw.Header().Set("Content-Type", applicationJSON)
+	rw.Header().Set("Cache-Control", "public, max-age=3600")
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(keys)
+}
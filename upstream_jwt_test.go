@@ -0,0 +1,93 @@
+package oauthproxy
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	sessionsapi "github.com/OpusCapita/oauth2_proxy/pkg/apis/sessions"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/square/go-jose.v2"
+)
+
+func newUpstreamJWTTestProxy(t *testing.T) (*OAuthProxy, func()) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	f, err := ioutil.TempFile("", "upstream_jwt")
+	require.NoError(t, err)
+	pem.Encode(f, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	f.Close()
+
+	opts := NewOptions()
+	opts.CookieSecret = "foobar"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "xyzzyplugh"
+	opts.EmailDomains = []string{"*"}
+	opts.UpstreamJWTKeyFile = f.Name()
+	require.NoError(t, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(email string) bool { return true })
+	return proxy, func() { os.Remove(f.Name()) }
+}
+
+func TestUpstreamJWT(t *testing.T) {
+	proxy, cleanup := newUpstreamJWTTestProxy(t)
+	defer cleanup()
+
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	session := &sessionsapi.SessionState{
+		User:      "jdoe",
+		Email:     "jdoe@example.com",
+		Groups:    []string{"admins"},
+		ExpiresOn: expires,
+	}
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Forwarded-Jwt", "forged")
+	proxy.rewriteRequestHeaders(req)
+	assert.Equal(t, "", req.Header.Get("X-Forwarded-Jwt"))
+	proxy.addHeadersForProxying(httptest.NewRecorder(), req, session)
+
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/oauth2/.well-known/jwks.json", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	var keys jose.JSONWebKeySet
+	require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &keys))
+	require.Len(t, keys.Keys, 1)
+
+	claims := &upstreamJWTClaims{}
+	token, err := jwt.ParseWithClaims(req.Header.Get("X-Forwarded-Jwt"), claims, func(token *jwt.Token) (interface{}, error) {
+		assert.Equal(t, keys.Keys[0].KeyID, token.Header["kid"])
+		return keys.Keys[0].Key, nil
+	})
+	require.NoError(t, err)
+	assert.True(t, token.Valid)
+	assert.Equal(t, "oauth2_proxy", claims.Issuer)
+	assert.Equal(t, "jdoe", claims.Subject)
+	assert.Equal(t, "jdoe@example.com", claims.Email)
+	assert.Equal(t, []string{"admins"}, claims.Groups)
+	assert.Equal(t, expires.Unix(), claims.SessionExpiry)
+	assert.True(t, claims.ExpiresAt <= time.Now().Add(time.Minute).Unix())
+}
+
+func TestUpstreamJWTDisabled(t *testing.T) {
+	opts := NewOptions()
+	opts.CookieSecret = "foobar"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "xyzzyplugh"
+	opts.EmailDomains = []string{"*"}
+	require.NoError(t, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(email string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/oauth2/.well-known/jwks.json", nil))
+	assert.Equal(t, http.StatusNotFound, rw.Code)
+}
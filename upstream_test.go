@@ -0,0 +1,147 @@
+package oauthproxy
+
+import (
+	"crypto"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/OpusCapita/oauth2_proxy/pkg/signature"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseUpstreamOptions(t *testing.T) {
+	u, _ := url.Parse("http://127.0.0.1:8080/upload/#max-body-size=1024")
+	uo, err := parseUpstreamOptions(u)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(1024), uo.maxBodySize)
+
+	u, _ = url.Parse("http://127.0.0.1:8080/upload/#max-body-size=1MB")
+	_, err = parseUpstreamOptions(u)
+	assert.Equal(t, "invalid upstream option max-body-size=\"1MB\": must be a number of bytes", err.Error())
+
+	u, _ = url.Parse("http://127.0.0.1:8080/orders/#token-exchange-audience=api%3A%2F%2Forders")
+	uo, err = parseUpstreamOptions(u)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "api://orders", uo.tokenExchangeAudience)
+
+	u, _ = url.Parse("http://127.0.0.1:8080/#unknown=1")
+	_, err = parseUpstreamOptions(u)
+	assert.Equal(t, "unknown upstream option \"unknown\"", err.Error())
+}
+
+func TestParseUpstreamHostOption(t *testing.T) {
+	u, _ := url.Parse("http://127.0.0.1:8080/#host=upstream&max-body-size=10")
+	uo, err := parseUpstreamOptions(u)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "upstream", uo.host)
+	assert.Equal(t, int64(10), uo.maxBodySize)
+}
+
+func TestParseRegexUpstreams(t *testing.T) {
+	upstreams, msgs := parseRegexUpstreams([]string{
+		"^/users/([0-9]+)/avatar$=http://avatars:8080/a/$1.png?size=64",
+		"^/a=b/(.*)=https://example.com/$1",
+		"/no/target",
+	}, nil)
+	assert.Equal(t, []string{
+		"invalid upstream-regex \"/no/target\": must be of the form pattern=http(s)://target"}, msgs)
+	assert.Equal(t, 2, len(upstreams))
+	assert.Equal(t, "^/users/([0-9]+)/avatar$", upstreams[0].pattern.String())
+	assert.Equal(t, "http://avatars:8080/a/$1.png?size=64", upstreams[0].target)
+	assert.Equal(t, "^/a=b/(.*)", upstreams[1].pattern.String())
+}
+
+func TestRegexUpstreamRouting(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.RequestURI()))
+	}))
+	defer backend.Close()
+
+	upstreams, _ := parseRegexUpstreams([]string{"^/users/([0-9]+)/avatar$=" + backend.URL + "/a/$1.png?size=64"}, nil)
+	router := &regexRouter{
+		upstreams: upstreams,
+		handlers:  []http.Handler{newRegexUpstreamProxy(upstreams[0], NewOptions())},
+		fallback:  http.NotFoundHandler(),
+	}
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/users/42/avatar", nil)
+	router.ServeHTTP(rw, req)
+	assert.Equal(t, "/a/42.png?size=64", rw.Body.String())
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/users/abc/avatar", nil)
+	router.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusNotFound, rw.Code)
+}
+
+func TestSignatureOfRewrittenPath(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := signature.VerifyRequest(r, "sha256:secret"); err != nil {
+			w.Write([]byte(err.Error()))
+			return
+		}
+		w.Write([]byte("signatures match " + r.URL.RequestURI()))
+	}))
+	defer backend.Close()
+	auth := signature.New(crypto.SHA256, "secret")
+
+	backendURL, _ := url.Parse(backend.URL + "/grafana/#strip-prefix=true")
+	proxy := NewWebSocketOrRestReverseProxy(backendURL, NewOptions(), auth)
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/grafana/api/health?full=1", nil)
+	req.RequestURI = "/grafana/api/health?full=1"
+	req.Header.Set("X-Forwarded-Groups", "admins")
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, "signatures match /api/health?full=1", rw.Body.String())
+
+	upstreams, _ := parseRegexUpstreams([]string{"^/users/([0-9]+)/avatar$=" + backend.URL + "/a/$1.png?size=64"}, nil)
+	regexProxy := newRegexUpstreamProxy(upstreams[0], NewOptions())
+	regexProxy.Director = signingDirector(regexProxy.Director, auth)
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/users/42/avatar", nil)
+	regexProxy.ServeHTTP(rw, req)
+	assert.Equal(t, "signatures match /a/42.png?size=64", rw.Body.String())
+}
+
+func TestCanaryProxy(t *testing.T) {
+	respond := func(body string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(body))
+		})
+	}
+	serve := func(c *canaryProxy, req *http.Request) string {
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, req)
+		return rw.Body.String()
+	}
+	c := &canaryProxy{primary: respond("primary"), canary: respond("canary"), header: "X-Canary", cookie: "canary"}
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	assert.Equal(t, "primary", serve(c, req))
+
+	req.Header.Set("X-Canary", "1")
+	assert.Equal(t, "canary", serve(c, req))
+
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: "canary", Value: "always"})
+	assert.Equal(t, "canary", serve(c, req))
+
+	c.weight = 100
+	req, _ = http.NewRequest("GET", "/", nil)
+	assert.Equal(t, "canary", serve(c, req))
+}
+
+func TestParseUpstreamCanaryOptions(t *testing.T) {
+	u, _ := url.Parse("http://127.0.0.1:8080/#canary=http://127.0.0.1:8081&canary-weight=10")
+	uo, err := parseUpstreamOptions(u)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "127.0.0.1:8081", uo.canary.Host)
+	assert.Equal(t, 10, uo.canaryWeight)
+
+	u, _ = url.Parse("http://127.0.0.1:8080/#canary-weight=10")
+	_, err = parseUpstreamOptions(u)
+	assert.Equal(t, "upstream options canary-weight, canary-header and canary-cookie require canary", err.Error())
+}
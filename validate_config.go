@@ -0,0 +1,100 @@
+package oauthproxy
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// endpointCheckTimeout bounds every connection attempt of the configuration
+// validation
+const endpointCheckTimeout = 5 * time.Second
+
+// validateConfig loads and validates the configuration as on startup,
+// including the OIDC discovery, and then checks that the upstreams and the
+// OIDC JWKS URL can be reached. It writes the problems found to w and returns
+// whether there were none.
+func validateConfig(flagSet *flag.FlagSet, config, configDir string, w io.Writer) bool {
+	opts, err := loadOptions(flagSet, config, configDir)
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return false
+	}
+	if problems := checkEndpoints(opts); len(problems) > 0 {
+		fmt.Fprintf(w, "Unreachable endpoints:\n  %s\n", strings.Join(problems, "\n  "))
+		return false
+	}
+	fmt.Fprintln(w, "configuration OK")
+	return true
+}
+
+// checkEndpoints returns the problems of the upstreams, including canary
+// upstreams and regex upstreams with a fixed host, and of the OIDC JWKS URL
+func checkEndpoints(o *Options) []string {
+	var problems []string
+	for _, u := range o.proxyURLs {
+		switch u.Scheme {
+		case httpScheme, httpsScheme:
+			if err := dialEndpoint(u); err != nil {
+				problems = append(problems, fmt.Sprintf("upstream %q: %s", u, err))
+			}
+			if uo, err := parseUpstreamOptions(u); err == nil && uo.canary != nil {
+				if err := dialEndpoint(uo.canary); err != nil {
+					problems = append(problems, fmt.Sprintf("canary upstream %q: %s", uo.canary, err))
+				}
+			}
+		case "file":
+			if _, err := os.Stat(u.Path); err != nil {
+				problems = append(problems, fmt.Sprintf("upstream %q: %s", u, err))
+			}
+		default:
+			problems = append(problems, fmt.Sprintf("upstream %q: unsupported scheme %q, must be http, https or file", u, u.Scheme))
+		}
+	}
+	for _, ru := range o.regexUpstreams {
+		u, err := url.Parse(ru.target)
+		if err != nil || strings.Contains(u.Host, "$") {
+			// the host is substituted per request
+			continue
+		}
+		if err := dialEndpoint(u); err != nil {
+			problems = append(problems, fmt.Sprintf("upstream-regex target %q: %s", ru.target, err))
+		}
+	}
+	if o.SkipOIDCDiscovery && o.OIDCJwksURL != "" {
+		client := &http.Client{Timeout: endpointCheckTimeout}
+		resp, err := client.Get(o.OIDCJwksURL)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("got %d", resp.StatusCode)
+			}
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("oidc-jwks-url %q: %s", o.OIDCJwksURL, err))
+		}
+	}
+	return problems
+}
+
+// dialEndpoint opens, and closes, a connection to the host of the http(s) URL
+func dialEndpoint(u *url.URL) error {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == httpsScheme {
+			port = "443"
+		}
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(u.Hostname(), port), endpointCheckTimeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
@@ -0,0 +1,40 @@
+package oauthproxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckEndpoints(t *testing.T) {
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	defer upstream.Close()
+	// a port nothing listens on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	closed := "http://" + ln.Addr().String()
+	ln.Close()
+
+	o := testOptions()
+	for _, u := range []string{upstream.URL + "/api/#canary=" + closed, "file://" + os.TempDir(), "file:///nonexistent/static/", "ftp://files.example.com/"} {
+		parsed, err := url.Parse(u)
+		assert.NoError(t, err)
+		o.proxyURLs = append(o.proxyURLs, parsed)
+	}
+	o.regexUpstreams = []regexUpstream{{target: closed + "/$1"}, {target: "http://$1.example.com/"}}
+	o.SkipOIDCDiscovery = true
+	o.OIDCJwksURL = upstream.URL + "/keys"
+
+	problems := checkEndpoints(o)
+	assert.Len(t, problems, 5)
+	assert.Contains(t, problems[0], `canary upstream "`+closed+`": dial tcp`)
+	assert.Equal(t, `upstream "file:///nonexistent/static/": stat /nonexistent/static/: no such file or directory`, problems[1])
+	assert.Equal(t, `upstream "ftp://files.example.com/": unsupported scheme "ftp", must be http, https or file`, problems[2])
+	assert.Contains(t, problems[3], `upstream-regex target "`+closed+`/$1": dial tcp`)
+	assert.Equal(t, `oidc-jwks-url "`+upstream.URL+`/keys": got 404`, problems[4])
+}
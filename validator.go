@@ -1,11 +1,13 @@
-package main
+package oauthproxy
 
 import (
+	"bytes"
 	"encoding/csv"
 	"fmt"
-	"os"
+	"io/ioutil"
 	"strings"
 	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"github.com/OpusCapita/oauth2_proxy/logger"
@@ -17,17 +19,24 @@ type UserMap struct {
 	m         unsafe.Pointer
 }
 
-// NewUserMap parses the authenticated emails file into a new UserMap
-func NewUserMap(usersFile string, done <-chan bool, onUpdate func()) *UserMap {
+// NewUserMap parses the authenticated emails file into a new UserMap and
+// reloads it whenever it changes: watched with file system notifications, or
+// by checking it every pollInterval if set
+func NewUserMap(usersFile string, pollInterval time.Duration, done <-chan bool, onUpdate func()) *UserMap {
 	um := &UserMap{usersFile: usersFile}
 	m := make(map[string]bool)
 	atomic.StorePointer(&um.m, unsafe.Pointer(&m))
 	if usersFile != "" {
 		logger.Printf("using authenticated emails file %s", usersFile)
-		WatchForUpdates(usersFile, done, func() {
-			um.LoadAuthenticatedEmailsFile()
+		reload := func() {
+			um.ReloadAuthenticatedEmailsFile()
 			onUpdate()
-		})
+		}
+		if pollInterval > 0 {
+			WatchForUpdatesByPolling(usersFile, pollInterval, done, reload)
+		} else {
+			watchFile(usersFile, done, reload)
+		}
 		um.LoadAuthenticatedEmailsFile()
 	}
 	return um
@@ -43,12 +52,29 @@ func (um *UserMap) IsValid(email string) (result bool) {
 // LoadAuthenticatedEmailsFile loads the authenticated emails file from disk
 // and parses the contents as CSV
 func (um *UserMap) LoadAuthenticatedEmailsFile() {
-	r, err := os.Open(um.usersFile)
+	data, err := ioutil.ReadFile(um.usersFile)
 	if err != nil {
 		logger.Fatalf("failed opening authenticated-emails-file=%q, %s", um.usersFile, err)
 	}
-	defer r.Close()
-	csvReader := csv.NewReader(r)
+	um.parseAuthenticatedEmails(data)
+}
+
+// ReloadAuthenticatedEmailsFile replaces the emails with the contents of the
+// authenticated emails file. The emails are kept if the file cannot be read,
+// e.g. while it is being replaced, so a change never locks out every user.
+func (um *UserMap) ReloadAuthenticatedEmailsFile() {
+	data, err := ioutil.ReadFile(um.usersFile)
+	if err != nil {
+		logger.Printf("error opening authenticated-emails-file=%q, keeping the previous emails: %s", um.usersFile, err)
+		return
+	}
+	um.parseAuthenticatedEmails(data)
+}
+
+// parseAuthenticatedEmails replaces the emails with those of the CSV contents
+// of the authenticated emails file, or keeps them if it is invalid
+func (um *UserMap) parseAuthenticatedEmails(data []byte) {
+	csvReader := csv.NewReader(bytes.NewReader(data))
 	csvReader.Comma = ','
 	csvReader.Comment = '#'
 	csvReader.TrimLeadingSpace = true
@@ -63,11 +89,12 @@ func (um *UserMap) LoadAuthenticatedEmailsFile() {
 		updated[address] = true
 	}
 	atomic.StorePointer(&um.m, unsafe.Pointer(&updated))
+	logger.Printf("loaded %d emails from authenticated-emails-file=%q", len(updated), um.usersFile)
 }
 
-func newValidatorImpl(domains []string, usersFile string,
+func newValidatorImpl(domains []string, usersFile string, pollInterval time.Duration,
 	done <-chan bool, onUpdate func()) func(string) bool {
-	validUsers := NewUserMap(usersFile, done, onUpdate)
+	validUsers := NewUserMap(usersFile, pollInterval, done, onUpdate)
 
 	var allowAll bool
 	for i, domain := range domains {
@@ -75,6 +102,11 @@ func newValidatorImpl(domains []string, usersFile string,
 			allowAll = true
 			continue
 		}
+		if strings.HasPrefix(domain, "*.") {
+			// *.example.com matches the subdomains of example.com
+			domains[i] = strings.ToLower(domain[1:])
+			continue
+		}
 		domains[i] = fmt.Sprintf("@%s", strings.ToLower(domain))
 	}
 
@@ -83,7 +115,12 @@ func newValidatorImpl(domains []string, usersFile string,
 			return
 		}
 		email = strings.ToLower(email)
+		at := strings.LastIndex(email, "@")
 		for _, domain := range domains {
+			if strings.HasPrefix(domain, ".") {
+				valid = valid || (at > -1 && strings.HasSuffix(email[at:], domain))
+				continue
+			}
 			valid = valid || strings.HasSuffix(email, domain)
 		}
 		if !valid {
@@ -99,5 +136,5 @@ func newValidatorImpl(domains []string, usersFile string,
 
 // NewValidator constructs a function to validate email addresses
 func NewValidator(domains []string, usersFile string) func(string) bool {
-	return newValidatorImpl(domains, usersFile, nil, func() {})
+	return newValidatorImpl(domains, usersFile, 0, nil, func() {})
 }
@@ -1,14 +1,16 @@
-package main
+package oauthproxy
 
 import (
 	"io/ioutil"
 	"os"
 	"strings"
 	"testing"
+	"time"
 )
 
 type ValidatorTest struct {
 	authEmailFile *os.File
+	pollInterval  time.Duration
 	done          chan bool
 	updateSeen    bool
 }
@@ -31,7 +33,7 @@ func (vt *ValidatorTest) TearDown() {
 
 func (vt *ValidatorTest) NewValidator(domains []string,
 	updated chan<- bool) func(string) bool {
-	return newValidatorImpl(domains, vt.authEmailFile.Name(),
+	return newValidatorImpl(domains, vt.authEmailFile.Name(), vt.pollInterval,
 		vt.done, func() {
 			if vt.updateSeen == false {
 				updated <- true
@@ -97,6 +99,31 @@ func TestValidatorSingleDomain(t *testing.T) {
 	}
 }
 
+func TestValidatorWildcardDomain(t *testing.T) {
+	vt := NewValidatorTest(t)
+	defer vt.TearDown()
+
+	vt.WriteEmails(t, []string(nil))
+	domains := []string{"*.Example.com"}
+	validator := vt.NewValidator(domains, nil)
+
+	if !validator("foo.bar@uk.example.com") {
+		t.Error("email from a subdomain should validate")
+	}
+	if !validator("foo.bar@sales.de.example.com") {
+		t.Error("email from a nested subdomain should validate")
+	}
+	if validator("foo.bar@example.com") {
+		t.Error("email from the domain itself should not validate")
+	}
+	if validator("foo.bar@badexample.com") {
+		t.Error("email from a domain with the same suffix should not validate")
+	}
+	if validator("foo.example.com") {
+		t.Error("a name without a domain part should not validate")
+	}
+}
+
 func TestValidatorMultipleEmailsMultipleDomains(t *testing.T) {
 	vt := NewValidatorTest(t)
 	defer vt.TearDown()
@@ -0,0 +1,50 @@
+package oauthproxy
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestValidatorPollEmailList(t *testing.T) {
+	vt := NewValidatorTest(t)
+	defer vt.TearDown()
+	vt.pollInterval = 10 * time.Millisecond
+
+	vt.WriteEmails(t, []string{"xyzzy@example.com"})
+	updated := make(chan bool, 1)
+	validator := vt.NewValidator(nil, updated)
+
+	if !validator("xyzzy@example.com") {
+		t.Error("email in list should validate")
+	}
+
+	err := ioutil.WriteFile(vt.authEmailFile.Name(), []byte("plugh@example.com\nxyzzy.plugh@example.com"), 0600)
+	if err != nil {
+		t.Fatal("failed to update temp file: " + err.Error())
+	}
+	<-updated
+
+	if validator("xyzzy@example.com") {
+		t.Error("email removed from list should not validate")
+	}
+	if !validator("plugh@example.com") {
+		t.Error("email added to list should validate")
+	}
+}
+
+func TestValidatorKeepsEmailListWhenFileIsMissing(t *testing.T) {
+	vt := NewValidatorTest(t)
+	defer vt.TearDown()
+
+	vt.WriteEmails(t, []string{"xyzzy@example.com"})
+	um := NewUserMap(vt.authEmailFile.Name(), time.Hour, vt.done, func() {})
+
+	os.Remove(vt.authEmailFile.Name())
+	um.ReloadAuthenticatedEmailsFile()
+
+	if !um.IsValid("xyzzy@example.com") {
+		t.Error("email should still validate after a failed reload")
+	}
+}
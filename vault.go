@@ -0,0 +1,126 @@
+package oauthproxy
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/OpusCapita/oauth2_proxy/pkg/vault"
+)
+
+// vaultServiceAccountTokenFile is the service account token of the pod, used
+// to log in to Vault with the Kubernetes auth method
+var vaultServiceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// vaultClients holds the Vault client of the options. It is kept across
+// reloads of the configuration while the Vault options are unchanged, so that
+// a single token is renewed for the lifetime of the process.
+var vaultClients struct {
+	sync.Mutex
+	settings string
+	client   *vault.Client
+}
+
+// parseVault reads the client and cookie secrets from Vault, and sets up the
+// certificate of the HTTPS listener issued by Vault, if configured
+func parseVault(o *Options, msgs []string) (*vault.Certificate, []string) {
+	if o.VaultAddress == "" {
+		if o.VaultClientSecret != "" || o.VaultCookieSecret != "" || o.VaultPKIRole != "" {
+			msgs = append(msgs, "missing setting: vault-address is required to read secrets from Vault")
+		}
+		return nil, msgs
+	}
+	if (o.VaultToken == "") == (o.VaultKubernetesRole == "") {
+		return nil, append(msgs, "exactly one of vault-token and vault-kubernetes-role must be set with vault-address")
+	}
+
+	invalid := len(msgs)
+	var pkiMount, pkiRole string
+	if o.VaultPKIRole != "" {
+		if i := strings.LastIndex(o.VaultPKIRole, "/"); i > 0 && i < len(o.VaultPKIRole)-1 {
+			pkiMount, pkiRole = o.VaultPKIRole[:i], o.VaultPKIRole[i+1:]
+		} else {
+			msgs = append(msgs, fmt.Sprintf("invalid vault-pki-role %q: must be of the form <mount>/<role>", o.VaultPKIRole))
+		}
+		if o.VaultPKICommonName == "" {
+			msgs = append(msgs, "missing setting: vault-pki-common-name is required when vault-pki-role is set")
+		}
+		if o.tlsEnabled() || len(o.ACMEDomains) > 0 {
+			msgs = append(msgs, "vault-pki-role cannot be combined with tls-cert, tls-key, tls-cert-pair, tls-cert-dir or acme-domain")
+		}
+	}
+	secrets := []struct {
+		name  string
+		value *string
+		ref   string
+	}{
+		{"client-secret", &o.ClientSecret, o.VaultClientSecret},
+		{"cookie-secret", &o.CookieSecret, o.VaultCookieSecret},
+	}
+	for _, secret := range secrets {
+		if secret.ref == "" {
+			continue
+		}
+		if _, _, _, err := vault.ParseKVRef(secret.ref); err != nil {
+			msgs = append(msgs, fmt.Sprintf("invalid vault-%s: %s", secret.name, err))
+		}
+		if *secret.value != "" {
+			msgs = append(msgs, fmt.Sprintf("only one of %s and vault-%s may be set", secret.name, secret.name))
+		}
+	}
+	if len(msgs) > invalid {
+		// do not contact Vault with an invalid configuration
+		return nil, msgs
+	}
+
+	client, err := vaultClient(o)
+	if err != nil {
+		return nil, append(msgs, err.Error())
+	}
+	for _, secret := range secrets {
+		if secret.ref == "" {
+			continue
+		}
+		value, err := client.ReadKV(secret.ref)
+		if err != nil {
+			msgs = append(msgs, err.Error())
+			continue
+		}
+		*secret.value = value
+	}
+	if o.VaultPKIRole == "" {
+		return nil, msgs
+	}
+	return client.Certificate(pkiMount, pkiRole, o.VaultPKICommonName, o.VaultPKITTL), msgs
+}
+
+// vaultClient returns the Vault client of the options, logging in and
+// keeping its token valid if the Vault options changed
+func vaultClient(o *Options) (*vault.Client, error) {
+	settings := strings.Join([]string{o.VaultAddress, o.VaultToken, o.VaultKubernetesMount, o.VaultKubernetesRole}, "\x00")
+	vaultClients.Lock()
+	defer vaultClients.Unlock()
+	if vaultClients.client != nil && vaultClients.settings == settings {
+		return vaultClients.client, nil
+	}
+
+	var client *vault.Client
+	var err error
+	if o.VaultToken != "" {
+		client, err = vault.NewTokenClient(o.VaultAddress, o.VaultToken)
+	} else {
+		client, err = vault.NewKubernetesClient(o.VaultAddress, o.VaultKubernetesMount, o.VaultKubernetesRole, vaultServiceAccountTokenFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Login(); err != nil {
+		return nil, err
+	}
+	// a previous client keeps its token valid too, as the certificate of the
+	// HTTPS listener may have been issued with it
+	go client.Run(nil)
+	vaultClients.settings = settings
+	vaultClients.client = client
+	return client, nil
+}
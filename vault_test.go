@@ -0,0 +1,86 @@
+package oauthproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseVault(t *testing.T) {
+	o := testOptions()
+	cert, msgs := parseVault(o, nil)
+	assert.Nil(t, cert)
+	assert.Empty(t, msgs)
+
+	o.VaultCookieSecret = "secret/oauth2-proxy#cookie_secret"
+	_, msgs = parseVault(o, nil)
+	assert.Equal(t, []string{"missing setting: vault-address is required to read secrets from Vault"}, msgs)
+
+	o.VaultAddress = "http://127.0.0.1:8200"
+	_, msgs = parseVault(o, nil)
+	assert.Equal(t, []string{"exactly one of vault-token and vault-kubernetes-role must be set with vault-address"}, msgs)
+
+	o.VaultToken = "s.token"
+	o.VaultClientSecret = "secret#client_secret"
+	o.VaultPKIRole = "pki"
+	o.TLSCertFile = "cert.pem"
+	_, msgs = parseVault(o, nil)
+	assert.Equal(t, []string{
+		`invalid vault-pki-role "pki": must be of the form <mount>/<role>`,
+		"missing setting: vault-pki-common-name is required when vault-pki-role is set",
+		"vault-pki-role cannot be combined with tls-cert, tls-key, tls-cert-pair, tls-cert-dir or acme-domain",
+		`invalid vault-client-secret: invalid Vault secret "secret#client_secret": must be of the form <mount>/<path>#<key>`,
+		"only one of client-secret and vault-client-secret may be set",
+		"only one of cookie-secret and vault-cookie-secret may be set",
+	}, msgs)
+}
+
+func TestParseVaultSecrets(t *testing.T) {
+	vault := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Vault-Token") != "s.token" {
+			rw.WriteHeader(403)
+			rw.Write([]byte(`{"errors": ["permission denied"]}`))
+			return
+		}
+		switch req.URL.Path {
+		case "/v1/auth/token/lookup-self":
+			rw.Write([]byte(`{"data": {"ttl": 0, "renewable": false}}`))
+		case "/v1/kv/data/oauth2-proxy":
+			rw.Write([]byte(`{"data": {"data": {"client_secret": "client-s3cr3t", "cookie_secret": "cookie-s3cr3t"}}}`))
+		default:
+			rw.WriteHeader(404)
+		}
+	}))
+	defer vault.Close()
+
+	o := testOptions()
+	o.ClientSecret = ""
+	o.CookieSecret = ""
+	o.VaultAddress = vault.URL
+	o.VaultToken = "s.token"
+	o.VaultClientSecret = "kv/oauth2-proxy#client_secret"
+	o.VaultCookieSecret = "kv/oauth2-proxy#cookie_secret"
+	o.VaultPKIRole = "pki/int/oauth2-proxy"
+	o.VaultPKICommonName = "proxy.example.com"
+	cert, msgs := parseVault(o, nil)
+	assert.Empty(t, msgs)
+	assert.NotNil(t, cert)
+	assert.Equal(t, "client-s3cr3t", o.ClientSecret)
+	assert.Equal(t, "cookie-s3cr3t", o.CookieSecret)
+
+	// the client is kept while the Vault options are unchanged
+	client := vaultClients.client
+	o.ClientSecret = ""
+	o.CookieSecret = ""
+	_, msgs = parseVault(o, nil)
+	assert.Empty(t, msgs)
+	assert.True(t, client == vaultClients.client)
+
+	o.ClientSecret = ""
+	o.CookieSecret = ""
+	o.VaultToken = "s.other"
+	_, msgs = parseVault(o, nil)
+	assert.Equal(t, []string{"error looking up the Vault token: got 403: permission denied"}, msgs)
+}
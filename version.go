@@ -1,4 +1,4 @@
-package main
+package oauthproxy
 
 // VERSION contains version information
 var VERSION = "undefined"
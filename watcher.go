@@ -1,8 +1,9 @@
 // +build go1.3,!plan9,!solaris
 
-package main
+package oauthproxy
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 	"time"
@@ -32,12 +33,17 @@ func WaitForReplacement(filename string, op fsnotify.Op,
 	}
 }
 
-// WatchForUpdates performs an action every time a file on disk is updated
-func WatchForUpdates(filename string, done <-chan bool, action func()) {
+// WatchForUpdates performs an action every time a file on disk is updated,
+// returning an error if the file cannot be watched
+func WatchForUpdates(filename string, done <-chan bool, action func()) error {
 	filename = filepath.Clean(filename)
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
-		logger.Fatal("failed to create watcher for ", filename, ": ", err)
+		return fmt.Errorf("failed to create watcher for %s: %s", filename, err)
+	}
+	if err = watcher.Add(filename); err != nil {
+		watcher.Close()
+		return fmt.Errorf("failed to add %s to watcher: %s", filename, err)
 	}
 	go func() {
 		defer watcher.Close()
@@ -59,13 +65,11 @@ func WatchForUpdates(filename string, done <-chan bool, action func()) {
 				}
 				logger.Printf("reloading after event: %s", event)
 				action()
-			case err = <-watcher.Errors:
+			case err := <-watcher.Errors:
 				logger.Printf("error watching %s: %s", filename, err)
 			}
 		}
 	}()
-	if err = watcher.Add(filename); err != nil {
-		logger.Fatal("failed to add ", filename, " to watcher: ", err)
-	}
 	logger.Printf("watching %s for updates", filename)
+	return nil
 }
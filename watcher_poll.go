@@ -0,0 +1,57 @@
+package oauthproxy
+
+import (
+	"os"
+	"time"
+
+	"github.com/OpusCapita/oauth2_proxy/logger"
+)
+
+// defaultPollInterval is the period between checks of files watched by
+// polling on platforms without file system notifications
+const defaultPollInterval = 5 * time.Second
+
+// WatchForUpdatesByPolling performs an action every time the modification
+// time or size of a file on disk changes, checking every interval. Unlike
+// WatchForUpdates it works on file systems without change notifications,
+// such as NFS. While the file is missing the action is not performed.
+func WatchForUpdatesByPolling(filename string, interval time.Duration, done <-chan bool, action func()) {
+	stat := func() (time.Time, int64, bool) {
+		fi, err := os.Stat(filename)
+		if err != nil {
+			return time.Time{}, 0, false
+		}
+		return fi.ModTime(), fi.Size(), true
+	}
+	modTime, size, _ := stat()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				logger.Printf("Shutting down watcher for: %s", filename)
+				return
+			case <-ticker.C:
+				m, s, ok := stat()
+				if !ok || (m.Equal(modTime) && s == size) {
+					continue
+				}
+				modTime, size = m, s
+				logger.Printf("reloading after change of %s", filename)
+				action()
+			}
+		}
+	}()
+	logger.Printf("polling %s for updates every %s", filename, interval)
+}
+
+// watchFile performs an action every time a file is updated, polling the
+// file if it cannot be watched with file system notifications, e.g. when
+// the process ran out of inotify watches
+func watchFile(filename string, done <-chan bool, action func()) {
+	if err := WatchForUpdates(filename, done, action); err != nil {
+		logger.Printf("%s, polling instead", err)
+		WatchForUpdatesByPolling(filename, defaultPollInterval, done, action)
+	}
+}
@@ -1,10 +1,13 @@
 // +build !go1.3 plan9 solaris
 
-package main
+package oauthproxy
 
 import "github.com/OpusCapita/oauth2_proxy/logger"
 
-func WatchForUpdates(filename string, done <-chan bool, action func()) {
-	logger.Printf("file watching not implemented on this platform")
-	go func() { <-done }()
+// WatchForUpdates falls back to polling the file, as file system
+// notifications are not implemented on this platform
+func WatchForUpdates(filename string, done <-chan bool, action func()) error {
+	logger.Printf("file watching not implemented on this platform, polling instead")
+	WatchForUpdatesByPolling(filename, defaultPollInterval, done, action)
+	return nil
 }
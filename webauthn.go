@@ -0,0 +1,578 @@
+package oauthproxy
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/OpusCapita/oauth2_proxy/cookie"
+	"github.com/OpusCapita/oauth2_proxy/logger"
+	"github.com/OpusCapita/oauth2_proxy/pkg/apis/options"
+	sessionsapi "github.com/OpusCapita/oauth2_proxy/pkg/apis/sessions"
+	redissessions "github.com/OpusCapita/oauth2_proxy/pkg/sessions/redis"
+)
+
+// webAuthnChallengeTTL bounds the time between starting and finishing a
+// WebAuthn ceremony
+const webAuthnChallengeTTL = 5 * time.Minute
+
+// Flags of the WebAuthn authenticator data
+const (
+	webAuthnUserPresent  = 0x01
+	webAuthnUserVerified = 0x04
+	webAuthnAttested     = 0x40
+)
+
+// COSE key parameters (RFC 8152)
+const (
+	coseKeyType   = 1
+	coseAlgorithm = 3
+	coseKeyTypeEC = 2
+	coseKeyTypeRS = 3
+	coseES256     = -7
+	coseRS256     = -257
+)
+
+// webAuthnConfig is the relying party configuration for passkeys
+type webAuthnConfig struct {
+	rpID   string
+	origin string
+	store  webAuthnStore
+}
+
+// parseWebAuthn sets up passkey registration and sign in if a relying party
+// id is configured. Credentials are kept in the credentials file, or in
+// redis when sessions are stored there.
+func parseWebAuthn(o *Options, msgs []string) (*webAuthnConfig, []string) {
+	if o.WebAuthnRPID == "" {
+		return nil, msgs
+	}
+	c := &webAuthnConfig{rpID: o.WebAuthnRPID, origin: o.WebAuthnOrigin}
+	if c.origin == "" {
+		c.origin = "https://" + o.WebAuthnRPID
+	}
+	switch {
+	case o.WebAuthnCredentialsFile != "":
+		store, err := newFileWebAuthnStore(o.WebAuthnCredentialsFile)
+		if err != nil {
+			return nil, append(msgs, fmt.Sprintf("could not load webauthn-credentials-file=%q %s", o.WebAuthnCredentialsFile, err))
+		}
+		c.store = store
+	case o.SessionOptions.Type == options.RedisSessionStoreType:
+		rs, ok := o.sessionStore.(*redissessions.SessionStore)
+		if !ok {
+			return nil, append(msgs, "webauthn-rp-id could not use the redis session store")
+		}
+		c.store = &redisWebAuthnStore{client: rs.Client}
+	default:
+		return nil, append(msgs, "webauthn-rp-id requires webauthn-credentials-file or the redis session store")
+	}
+	return c, msgs
+}
+
+// webAuthnClientData is the client data collected by the browser
+type webAuthnClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// verifyClientData checks the client data of a ceremony of type typ
+// against the challenge issued for it
+func (c *webAuthnConfig) verifyClientData(raw []byte, typ string, challenge string) error {
+	var data webAuthnClientData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return fmt.Errorf("invalid client data: %v", err)
+	}
+	if data.Type != typ {
+		return fmt.Errorf("unexpected client data type %q", data.Type)
+	}
+	if subtle.ConstantTimeCompare([]byte(data.Challenge), []byte(challenge)) != 1 {
+		return errors.New("challenge mismatch")
+	}
+	if data.Origin != c.origin {
+		return fmt.Errorf("unexpected origin %q", data.Origin)
+	}
+	return nil
+}
+
+// webAuthnAuthData is the parsed authenticator data
+type webAuthnAuthData struct {
+	flags        byte
+	signCount    uint32
+	credentialID []byte
+	publicKey    []byte
+}
+
+// parseAuthData parses authenticator data, checking its relying party id
+// hash and that the user was present and verified
+func (c *webAuthnConfig) parseAuthData(data []byte) (*webAuthnAuthData, error) {
+	if len(data) < 37 {
+		return nil, errors.New("authenticator data too short")
+	}
+	rpIDHash := sha256.Sum256([]byte(c.rpID))
+	if !bytes.Equal(data[:32], rpIDHash[:]) {
+		return nil, errors.New("relying party id mismatch")
+	}
+	ad := &webAuthnAuthData{flags: data[32], signCount: binary.BigEndian.Uint32(data[33:37])}
+	if ad.flags&webAuthnUserPresent == 0 || ad.flags&webAuthnUserVerified == 0 {
+		return nil, errors.New("user not verified by the authenticator")
+	}
+	if ad.flags&webAuthnAttested != 0 {
+		rest := data[37:]
+		// skip the AAGUID
+		if len(rest) < 18 {
+			return nil, errors.New("attested credential data too short")
+		}
+		idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if len(rest) < idLen {
+			return nil, errors.New("attested credential data too short")
+		}
+		ad.credentialID = rest[:idLen]
+		rest = rest[idLen:]
+		key, after, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid credential public key: %v", err)
+		}
+		if _, err := parseCOSEKey(key); err != nil {
+			return nil, err
+		}
+		ad.publicKey = rest[:len(rest)-len(after)]
+	}
+	return ad, nil
+}
+
+// parseCOSEKey returns the ES256 or RS256 public key of a decoded COSE key
+func parseCOSEKey(v interface{}) (crypto.PublicKey, error) {
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("credential public key is not a COSE key")
+	}
+	param := func(label int64) []byte {
+		b, _ := m[label].([]byte)
+		return b
+	}
+	switch {
+	case m[int64(coseKeyType)] == int64(coseKeyTypeEC) && m[int64(coseAlgorithm)] == int64(coseES256):
+		x, y := param(-2), param(-3)
+		if m[int64(-1)] != int64(1) || len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("unsupported elliptic curve key")
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("invalid elliptic curve key")
+		}
+		return key, nil
+	case m[int64(coseKeyType)] == int64(coseKeyTypeRS) && m[int64(coseAlgorithm)] == int64(coseRS256):
+		n, e := param(-1), param(-2)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("unsupported RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	}
+	return nil, errors.New("unsupported credential public key algorithm, must be ES256 or RS256")
+}
+
+// verifySignature checks an assertion signature over the authenticator
+// data and the hash of the client data
+func verifySignature(publicKey []byte, authData []byte, clientData []byte, sig []byte) error {
+	v, _, err := decodeCBOR(publicKey)
+	if err != nil {
+		return err
+	}
+	key, err := parseCOSEKey(v)
+	if err != nil {
+		return err
+	}
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		var esig struct {
+			R, S *big.Int
+		}
+		if rest, err := asn1.Unmarshal(sig, &esig); err != nil || len(rest) > 0 {
+			return errors.New("invalid signature")
+		}
+		if !ecdsa.Verify(k, digest[:], esig.R, esig.S) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig)
+	}
+	return errors.New("unsupported key")
+}
+
+// finishRegistration verifies the response of navigator.credentials.create
+// and returns the new credential. Only the "none" attestation format is
+// accepted, as the proxy does not restrict authenticator models.
+func (c *webAuthnConfig) finishRegistration(clientData []byte, attestationObject []byte, challenge string) (*webAuthnCredential, error) {
+	if err := c.verifyClientData(clientData, "webauthn.create", challenge); err != nil {
+		return nil, err
+	}
+	v, _, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("invalid attestation object: %v", err)
+	}
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("invalid attestation object")
+	}
+	if m["fmt"] != "none" {
+		return nil, fmt.Errorf("unsupported attestation format %q", m["fmt"])
+	}
+	authData, _ := m["authData"].([]byte)
+	ad, err := c.parseAuthData(authData)
+	if err != nil {
+		return nil, err
+	}
+	if ad.credentialID == nil {
+		return nil, errors.New("attested credential data missing")
+	}
+	return &webAuthnCredential{ID: ad.credentialID, PublicKey: ad.publicKey, SignCount: ad.signCount}, nil
+}
+
+// finishLogin verifies the response of navigator.credentials.get for the
+// credential and updates its signature counter
+func (c *webAuthnConfig) finishLogin(cred *webAuthnCredential, clientData []byte, authData []byte, sig []byte, challenge string) error {
+	if err := c.verifyClientData(clientData, "webauthn.get", challenge); err != nil {
+		return err
+	}
+	ad, err := c.parseAuthData(authData)
+	if err != nil {
+		return err
+	}
+	if err := verifySignature(cred.PublicKey, authData, clientData, sig); err != nil {
+		return err
+	}
+	// authenticators without a counter always report 0
+	if ad.signCount != 0 || cred.SignCount != 0 {
+		if ad.signCount <= cred.SignCount {
+			return errors.New("signature counter did not increase, the authenticator may be cloned")
+		}
+	}
+	cred.SignCount = ad.signCount
+	return nil
+}
+
+// htpasswdUsers returns the users of the htpasswd file, if any
+func (p *OAuthProxy) htpasswdUsers() map[string]string {
+	if p.HtpasswdFile == nil {
+		return nil
+	}
+	p.HtpasswdFile.mu.RLock()
+	defer p.HtpasswdFile.mu.RUnlock()
+	return p.HtpasswdFile.Users
+}
+
+// htpasswdAccount returns whether user is listed in the htpasswd file. Only
+// those accounts register passkeys: a passkey sign in does not ask the
+// provider, so it would keep provider users signed in after they are
+// disabled there.
+func (p *OAuthProxy) htpasswdAccount(user, email string) bool {
+	if email != "" {
+		return false
+	}
+	_, ok := p.htpasswdUsers()[user]
+	return ok
+}
+
+// webAuthnCookieName is the cookie holding the challenge of a ceremony
+func (p *OAuthProxy) webAuthnCookieName() string {
+	return p.CookieName + "_webauthn"
+}
+
+// newWebAuthnChallenge issues a challenge for a ceremony of type typ and
+// keeps it in a signed cookie
+func (p *OAuthProxy) newWebAuthnChallenge(rw http.ResponseWriter, req *http.Request, typ string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	challenge := base64.RawURLEncoding.EncodeToString(b)
+	name := p.webAuthnCookieName()
+	now := time.Now()
+	http.SetCookie(rw, p.makeCookie(req, name, cookie.SignedValue(p.CookieSeed, name, typ+":"+challenge, now), webAuthnChallengeTTL, now))
+	return challenge, nil
+}
+
+// webAuthnChallenge returns the challenge issued for a ceremony of type typ
+// and clears it, so it is only used once
+func (p *OAuthProxy) webAuthnChallenge(rw http.ResponseWriter, req *http.Request, typ string) (string, bool) {
+	name := p.webAuthnCookieName()
+	c, err := req.Cookie(name)
+	if err != nil {
+		return "", false
+	}
+	http.SetCookie(rw, p.makeCookie(req, name, "", time.Hour*-1, time.Now()))
+	value, _, ok := cookie.Validate(c, p.CookieSeed, webAuthnChallengeTTL)
+	if !ok || !strings.HasPrefix(value, typ+":") {
+		return "", false
+	}
+	return strings.TrimPrefix(value, typ+":"), true
+}
+
+// webAuthnResponse is the result of a WebAuthn ceremony posted by the
+// browser, with binary values base64url encoded
+type webAuthnResponse struct {
+	ID                string `json:"id"`
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AttestationObject string `json:"attestationObject"`
+	AuthenticatorData string `json:"authenticatorData"`
+	Signature         string `json:"signature"`
+	Redirect          string `json:"rd"`
+}
+
+func decodeWebAuthnValue(s string) []byte {
+	b, _ := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	return b
+}
+
+// writeWebAuthnJSON writes v as JSON with status code
+func writeWebAuthnJSON(rw http.ResponseWriter, code int, v interface{}) {
+	rw.Header().Set("Content-Type", applicationJSON)
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(code)
+	json.NewEncoder(rw).Encode(v)
+}
+
+func webAuthnError(rw http.ResponseWriter, code int, msg string) {
+	writeWebAuthnJSON(rw, code, map[string]string{"error": msg})
+}
+
+// WebAuthn serves the passkey registration page and the endpoints of the
+// registration and sign in ceremonies
+func (p *OAuthProxy) WebAuthn(rw http.ResponseWriter, req *http.Request) {
+	if p.webAuthn == nil {
+		http.NotFound(rw, req)
+		return
+	}
+	action := strings.TrimPrefix(req.URL.Path, p.WebAuthnPath)
+	if action == "/register" && req.Method == http.MethodGet {
+		p.WebAuthnRegisterPage(rw, req)
+		return
+	}
+	if req.Method != http.MethodPost {
+		webAuthnError(rw, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	switch action {
+	case "/register/begin":
+		p.webAuthnRegisterBegin(rw, req)
+	case "/register/finish":
+		p.webAuthnRegisterFinish(rw, req)
+	case "/login/begin":
+		p.webAuthnLoginBegin(rw, req)
+	case "/login/finish":
+		p.webAuthnLoginFinish(rw, req)
+	default:
+		http.NotFound(rw, req)
+	}
+}
+
+// WebAuthnRegisterPage serves the page registering a passkey for the
+// signed in user
+func (p *OAuthProxy) WebAuthnRegisterPage(rw http.ResponseWriter, req *http.Request) {
+	session, err := p.getAuthenticatedSession(rw, req)
+	if err != nil {
+		p.SignInPage(rw, req, http.StatusForbidden)
+		return
+	}
+	if !p.htpasswdAccount(session.User, session.Email) {
+		p.ErrorPage(rw, http.StatusForbidden, "Permission Denied", "Passkeys can only be registered for htpasswd accounts")
+		return
+	}
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusOK)
+	t := struct {
+		Title       string
+		User        string
+		ProxyPrefix string
+	}{
+		Title:       "Register a Passkey",
+		User:        session.User,
+		ProxyPrefix: p.ProxyPrefix,
+	}
+	p.templates.ExecuteTemplate(rw, "webauthn_register.html", t)
+}
+
+func (p *OAuthProxy) webAuthnRegisterBegin(rw http.ResponseWriter, req *http.Request) {
+	session, err := p.getAuthenticatedSession(rw, req)
+	if err != nil {
+		webAuthnError(rw, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	if !p.htpasswdAccount(session.User, session.Email) {
+		webAuthnError(rw, http.StatusForbidden, "passkeys can only be registered for htpasswd accounts")
+		return
+	}
+	existing, err := p.webAuthn.store.Credentials(session.User)
+	if err != nil {
+		logger.Printf("Error loading WebAuthn credentials of %s: %s", session.User, err)
+		webAuthnError(rw, http.StatusInternalServerError, "internal error")
+		return
+	}
+	challenge, err := p.newWebAuthnChallenge(rw, req, "create")
+	if err != nil {
+		webAuthnError(rw, http.StatusInternalServerError, "internal error")
+		return
+	}
+	exclude := []map[string]string{}
+	for _, c := range existing {
+		exclude = append(exclude, map[string]string{"type": "public-key", "id": base64.RawURLEncoding.EncodeToString(c.ID)})
+	}
+	displayName := session.Email
+	if displayName == "" {
+		displayName = session.User
+	}
+	userID := sha256.Sum256([]byte(session.User))
+	writeWebAuthnJSON(rw, http.StatusOK, map[string]interface{}{
+		"challenge": challenge,
+		"rp":        map[string]string{"id": p.webAuthn.rpID, "name": p.webAuthn.rpID},
+		"user": map[string]string{
+			"id":          base64.RawURLEncoding.EncodeToString(userID[:]),
+			"name":        session.User,
+			"displayName": displayName,
+		},
+		"pubKeyCredParams": []map[string]interface{}{
+			{"type": "public-key", "alg": coseES256},
+			{"type": "public-key", "alg": coseRS256},
+		},
+		"authenticatorSelection": map[string]string{
+			"residentKey":      "required",
+			"userVerification": "required",
+		},
+		"attestation":        "none",
+		"excludeCredentials": exclude,
+		"timeout":            int(webAuthnChallengeTTL / time.Millisecond),
+	})
+}
+
+func (p *OAuthProxy) webAuthnRegisterFinish(rw http.ResponseWriter, req *http.Request) {
+	session, err := p.getAuthenticatedSession(rw, req)
+	if err != nil {
+		webAuthnError(rw, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	if !p.htpasswdAccount(session.User, session.Email) {
+		webAuthnError(rw, http.StatusForbidden, "passkeys can only be registered for htpasswd accounts")
+		return
+	}
+	challenge, ok := p.webAuthnChallenge(rw, req, "create")
+	if !ok {
+		webAuthnError(rw, http.StatusBadRequest, "no registration in progress")
+		return
+	}
+	var resp webAuthnResponse
+	if err := json.NewDecoder(http.MaxBytesReader(rw, req.Body, 64*1024)).Decode(&resp); err != nil {
+		webAuthnError(rw, http.StatusBadRequest, "invalid request")
+		return
+	}
+	cred, err := p.webAuthn.finishRegistration(decodeWebAuthnValue(resp.ClientDataJSON), decodeWebAuthnValue(resp.AttestationObject), challenge)
+	if err != nil {
+		logger.PrintAuthf(session.User, req, logger.AuthFailure, "Invalid WebAuthn registration: %s", err)
+		webAuthnError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+	if existing, err := p.webAuthn.store.Credential(cred.ID); err != nil || existing != nil {
+		webAuthnError(rw, http.StatusConflict, "credential already registered")
+		return
+	}
+	cred.User = session.User
+	cred.Email = session.Email
+	if err := p.webAuthn.store.Save(cred); err != nil {
+		logger.Printf("Error saving WebAuthn credential of %s: %s", session.User, err)
+		webAuthnError(rw, http.StatusInternalServerError, "internal error")
+		return
+	}
+	logger.PrintAuthf(session.User, req, logger.AuthSuccess, "Registered WebAuthn credential")
+	writeWebAuthnJSON(rw, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (p *OAuthProxy) webAuthnLoginBegin(rw http.ResponseWriter, req *http.Request) {
+	challenge, err := p.newWebAuthnChallenge(rw, req, "get")
+	if err != nil {
+		webAuthnError(rw, http.StatusInternalServerError, "internal error")
+		return
+	}
+	writeWebAuthnJSON(rw, http.StatusOK, map[string]interface{}{
+		"challenge":        challenge,
+		"rpId":             p.webAuthn.rpID,
+		"userVerification": "required",
+		"timeout":          int(webAuthnChallengeTTL / time.Millisecond),
+	})
+}
+
+func (p *OAuthProxy) webAuthnLoginFinish(rw http.ResponseWriter, req *http.Request) {
+	challenge, ok := p.webAuthnChallenge(rw, req, "get")
+	if !ok {
+		webAuthnError(rw, http.StatusBadRequest, "no sign in in progress")
+		return
+	}
+	var resp webAuthnResponse
+	if err := json.NewDecoder(http.MaxBytesReader(rw, req.Body, 64*1024)).Decode(&resp); err != nil {
+		webAuthnError(rw, http.StatusBadRequest, "invalid request")
+		return
+	}
+	cred, err := p.webAuthn.store.Credential(decodeWebAuthnValue(resp.ID))
+	if err != nil {
+		logger.Printf("Error loading WebAuthn credential: %s", err)
+		webAuthnError(rw, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if cred == nil {
+		logger.PrintAuthf("", req, logger.AuthFailure, "Invalid WebAuthn sign in: unknown credential")
+		p.auditLogin(req, nil, "", "webauthn", "unknown credential")
+		webAuthnError(rw, http.StatusUnauthorized, "unknown credential")
+		return
+	}
+	err = p.webAuthn.finishLogin(cred, decodeWebAuthnValue(resp.ClientDataJSON), decodeWebAuthnValue(resp.AuthenticatorData), decodeWebAuthnValue(resp.Signature), challenge)
+	if err != nil {
+		logger.PrintAuthf(cred.User, req, logger.AuthFailure, "Invalid WebAuthn sign in: %s", err)
+		p.auditLogin(req, nil, cred.User, "webauthn", err.Error())
+		webAuthnError(rw, http.StatusUnauthorized, err.Error())
+		return
+	}
+	// credentials of htpasswd users stop working when they are removed, and
+	// those registered by provider users are not accepted
+	if !p.htpasswdAccount(cred.User, cred.Email) || p.denyList.Denied(cred.User, cred.Email) {
+		logger.PrintAuthf(cred.User, req, logger.AuthFailure, "Invalid WebAuthn sign in: unauthorized")
+		p.auditLogin(req, nil, cred.User, "webauthn", "unauthorized")
+		webAuthnError(rw, http.StatusForbidden, "permission denied")
+		return
+	}
+	if err := p.webAuthn.store.Save(cred); err != nil {
+		logger.Printf("Error saving WebAuthn credential of %s: %s", cred.User, err)
+	}
+
+	session := &sessionsapi.SessionState{User: cred.User, Email: cred.Email}
+	if err := p.SaveSession(rw, req, session); err != nil {
+		logger.Printf("Error saving session: %s", err)
+		webAuthnError(rw, http.StatusInternalServerError, "internal error")
+		return
+	}
+	logger.PrintAuthf(cred.User, req, logger.AuthSuccess, "Authenticated via WebAuthn")
+	p.auditLogin(req, session, "", "webauthn", "")
+	redirect := resp.Redirect
+	if !p.validRedirect(req, redirect) {
+		redirect = "/"
+	}
+	writeWebAuthnJSON(rw, http.StatusOK, map[string]string{"redirect": redirect})
+}
@@ -0,0 +1,169 @@
+package oauthproxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/go-redis/redis"
+)
+
+// webAuthnCredential is a public key credential (passkey) registered by a
+// user
+type webAuthnCredential struct {
+	ID []byte `json:"id"`
+	// PublicKey is the COSE encoded public key of the credential
+	PublicKey []byte `json:"public_key"`
+	SignCount uint32 `json:"sign_count"`
+	User      string `json:"user"`
+	Email     string `json:"email,omitempty"`
+}
+
+// webAuthnStore persists the registered credentials. Credential returns nil
+// without an error for unknown credentials.
+type webAuthnStore interface {
+	Credentials(user string) ([]*webAuthnCredential, error)
+	Credential(id []byte) (*webAuthnCredential, error)
+	Save(c *webAuthnCredential) error
+}
+
+// fileWebAuthnStore keeps the credentials in a JSON file, which is
+// rewritten on every change
+type fileWebAuthnStore struct {
+	path string
+
+	mu          sync.Mutex
+	credentials map[string]*webAuthnCredential
+}
+
+// newFileWebAuthnStore loads the credentials in path. A missing file is
+// created on the first registration.
+func newFileWebAuthnStore(path string) (*fileWebAuthnStore, error) {
+	s := &fileWebAuthnStore{path: path, credentials: make(map[string]*webAuthnCredential)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var credentials []*webAuthnCredential
+	if err := json.Unmarshal(data, &credentials); err != nil {
+		return nil, err
+	}
+	for _, c := range credentials {
+		s.credentials[base64.RawURLEncoding.EncodeToString(c.ID)] = c
+	}
+	return s, nil
+}
+
+func (s *fileWebAuthnStore) Credentials(user string) ([]*webAuthnCredential, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var credentials []*webAuthnCredential
+	for _, c := range s.credentials {
+		if c.User == user {
+			cred := *c
+			credentials = append(credentials, &cred)
+		}
+	}
+	return credentials, nil
+}
+
+func (s *fileWebAuthnStore) Credential(id []byte) (*webAuthnCredential, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.credentials[base64.RawURLEncoding.EncodeToString(id)]
+	if !ok {
+		return nil, nil
+	}
+	cred := *c
+	return &cred, nil
+}
+
+func (s *fileWebAuthnStore) Save(c *webAuthnCredential) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cred := *c
+	s.credentials[base64.RawURLEncoding.EncodeToString(c.ID)] = &cred
+	credentials := make([]*webAuthnCredential, 0, len(s.credentials))
+	for _, c := range s.credentials {
+		credentials = append(credentials, c)
+	}
+	data, err := json.MarshalIndent(credentials, "", "  ")
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first so a crash cannot truncate the store
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// redisWebAuthnStore keeps the credentials in the redis server of the
+// session store
+type redisWebAuthnStore struct {
+	client *redis.Client
+}
+
+const redisWebAuthnPrefix = "oauth2_proxy_webauthn"
+
+func (s *redisWebAuthnStore) credentialKey(id []byte) string {
+	return redisWebAuthnPrefix + "-credential-" + base64.RawURLEncoding.EncodeToString(id)
+}
+
+func (s *redisWebAuthnStore) userKey(user string) string {
+	return redisWebAuthnPrefix + "-user-" + user
+}
+
+func (s *redisWebAuthnStore) Credentials(user string) ([]*webAuthnCredential, error) {
+	keys, err := s.client.SMembers(s.userKey(user)).Result()
+	if err != nil {
+		return nil, err
+	}
+	var credentials []*webAuthnCredential
+	for _, key := range keys {
+		id, err := base64.RawURLEncoding.DecodeString(key)
+		if err != nil {
+			continue
+		}
+		c, err := s.Credential(id)
+		if err != nil {
+			return nil, err
+		}
+		if c != nil {
+			credentials = append(credentials, c)
+		}
+	}
+	return credentials, nil
+}
+
+func (s *redisWebAuthnStore) Credential(id []byte) (*webAuthnCredential, error) {
+	data, err := s.client.Get(s.credentialKey(id)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &webAuthnCredential{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *redisWebAuthnStore) Save(c *webAuthnCredential) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err := s.client.Set(s.credentialKey(c.ID), data, 0).Err(); err != nil {
+		return err
+	}
+	return s.client.SAdd(s.userKey(c.User), base64.RawURLEncoding.EncodeToString(c.ID)).Err()
+}
@@ -0,0 +1,309 @@
+package oauthproxy
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/OpusCapita/oauth2_proxy/pkg/apis/options"
+	"github.com/stretchr/testify/assert"
+)
+
+// cborPair is a map entry for encodeCBOR, keeping the key order
+type cborPair struct {
+	key   interface{}
+	value interface{}
+}
+
+func cborHead(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n < 1<<8:
+		return []byte{major<<5 | 24, byte(n)}
+	case n < 1<<16:
+		b := []byte{major<<5 | 25, 0, 0}
+		binary.BigEndian.PutUint16(b[1:], uint16(n))
+		return b
+	}
+	b := []byte{major<<5 | 26, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(b[1:], uint32(n))
+	return b
+}
+
+// encodeCBOR encodes the subset of CBOR written by authenticators
+func encodeCBOR(v interface{}) []byte {
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return cborHead(1, uint64(-1-v))
+		}
+		return cborHead(0, uint64(v))
+	case []byte:
+		return append(cborHead(2, uint64(len(v))), v...)
+	case string:
+		return append(cborHead(3, uint64(len(v))), v...)
+	case []cborPair:
+		b := cborHead(5, uint64(len(v)))
+		for _, p := range v {
+			b = append(b, encodeCBOR(p.key)...)
+			b = append(b, encodeCBOR(p.value)...)
+		}
+		return b
+	}
+	panic("unsupported value")
+}
+
+// testAuthenticator is a software ES256 authenticator
+type testAuthenticator struct {
+	key       *ecdsa.PrivateKey
+	id        []byte
+	rpID      string
+	origin    string
+	signCount uint32
+}
+
+func newTestAuthenticator(t *testing.T) *testAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	return &testAuthenticator{key: key, id: []byte("credential-1"), rpID: "example.com", origin: "https://example.com"}
+}
+
+func (a *testAuthenticator) clientData(typ, challenge string) []byte {
+	b, _ := json.Marshal(webAuthnClientData{Type: typ, Challenge: challenge, Origin: a.origin})
+	return b
+}
+
+func (a *testAuthenticator) authData(flags byte, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	b := append([]byte{}, rpIDHash[:]...)
+	b = append(b, flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(b[33:], a.signCount)
+	return append(b, attested...)
+}
+
+func (a *testAuthenticator) coseKey() []byte {
+	x := a.key.X.FillBytes(make([]byte, 32))
+	y := a.key.Y.FillBytes(make([]byte, 32))
+	return encodeCBOR([]cborPair{{1, 2}, {3, -7}, {-1, 1}, {-2, x}, {-3, y}})
+}
+
+func (a *testAuthenticator) create(challenge string) (clientData []byte, attestationObject []byte) {
+	attested := make([]byte, 16)
+	attested = append(attested, byte(len(a.id)>>8), byte(len(a.id)))
+	attested = append(attested, a.id...)
+	attested = append(attested, a.coseKey()...)
+	authData := a.authData(webAuthnUserPresent|webAuthnUserVerified|webAuthnAttested, attested)
+	attestationObject = encodeCBOR([]cborPair{
+		{"fmt", "none"},
+		{"attStmt", []cborPair{}},
+		{"authData", authData},
+	})
+	return a.clientData("webauthn.create", challenge), attestationObject
+}
+
+func (a *testAuthenticator) get(t *testing.T, challenge string) (clientData []byte, authData []byte, sig []byte) {
+	a.signCount++
+	clientData = a.clientData("webauthn.get", challenge)
+	authData = a.authData(webAuthnUserPresent|webAuthnUserVerified, nil)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	r, s, err := ecdsa.Sign(rand.Reader, a.key, digest[:])
+	assert.NoError(t, err)
+	sig, err = asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	assert.NoError(t, err)
+	return clientData, authData, sig
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	data := encodeCBOR([]cborPair{{"a", -300}, {1, []byte{1, 2}}, {-2, "text"}})
+	v, rest, err := decodeCBOR(append(data, 0xff))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0xff}, rest)
+	assert.Equal(t, map[interface{}]interface{}{
+		"a":       int64(-300),
+		int64(1):  []byte{1, 2},
+		int64(-2): "text",
+	}, v)
+
+	_, _, err = decodeCBOR(data[:len(data)-2])
+	assert.Error(t, err)
+}
+
+func TestWebAuthnRegistrationAndLogin(t *testing.T) {
+	a := newTestAuthenticator(t)
+	c := &webAuthnConfig{rpID: a.rpID, origin: a.origin}
+
+	clientData, attestationObject := a.create("challenge-1")
+	cred, err := c.finishRegistration(clientData, attestationObject, "challenge-1")
+	assert.NoError(t, err)
+	assert.Equal(t, a.id, cred.ID)
+
+	clientData, authData, sig := a.get(t, "challenge-2")
+	assert.NoError(t, c.finishLogin(cred, clientData, authData, sig, "challenge-2"))
+	assert.Equal(t, uint32(1), cred.SignCount)
+
+	// a replayed assertion doesn't increase the counter
+	assert.Error(t, c.finishLogin(cred, clientData, authData, sig, "challenge-2"))
+
+	clientData, authData, sig = a.get(t, "challenge-3")
+	assert.Error(t, c.finishLogin(cred, clientData, authData, sig, "challenge-4"))
+	sig[len(sig)-1] ^= 0xff
+	assert.Error(t, c.finishLogin(cred, clientData, authData, sig, "challenge-3"))
+}
+
+func TestWebAuthnRejectsUnverifiedUser(t *testing.T) {
+	a := newTestAuthenticator(t)
+	c := &webAuthnConfig{rpID: a.rpID, origin: a.origin}
+	_, err := c.parseAuthData(a.authData(webAuthnUserPresent, nil))
+	assert.Error(t, err)
+
+	a.origin = "https://evil.example.com"
+	clientData, attestationObject := a.create("challenge")
+	_, err = c.finishRegistration(clientData, attestationObject, "challenge")
+	assert.Error(t, err)
+}
+
+func TestFileWebAuthnStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webauthn")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "credentials.json")
+
+	store, err := newFileWebAuthnStore(path)
+	assert.NoError(t, err)
+	assert.NoError(t, store.Save(&webAuthnCredential{ID: []byte("id"), PublicKey: []byte("key"), User: "john", Email: "john@example.com"}))
+
+	store, err = newFileWebAuthnStore(path)
+	assert.NoError(t, err)
+	cred, err := store.Credential([]byte("id"))
+	assert.NoError(t, err)
+	assert.Equal(t, "john@example.com", cred.Email)
+	creds, err := store.Credentials("john")
+	assert.NoError(t, err)
+	assert.Len(t, creds, 1)
+	cred, err = store.Credential([]byte("unknown"))
+	assert.NoError(t, err)
+	assert.Nil(t, cred)
+}
+
+func TestWebAuthnLoginEndpoints(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webauthn")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	a := newTestAuthenticator(t)
+	c := &webAuthnConfig{rpID: a.rpID, origin: a.origin}
+	clientData, attestationObject := a.create("challenge")
+	cred, err := c.finishRegistration(clientData, attestationObject, "challenge")
+	assert.NoError(t, err)
+	cred.User = "john"
+	// a passkey registered by a provider user before they were refused
+	provider := newTestAuthenticator(t)
+	provider.id = []byte("credential-2")
+	clientData, attestationObject = provider.create("challenge")
+	providerCred, err := c.finishRegistration(clientData, attestationObject, "challenge")
+	assert.NoError(t, err)
+	providerCred.User = "jane"
+	providerCred.Email = "jane@example.com"
+
+	opts := NewOptions()
+	opts.CookieSecret = "foobar"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "xyzzyplugh"
+	opts.EmailDomains = []string{"*"}
+	opts.WebAuthnRPID = a.rpID
+	opts.WebAuthnCredentialsFile = filepath.Join(dir, "credentials.json")
+	assert.NoError(t, opts.Validate())
+	assert.NoError(t, opts.webAuthn.store.Save(cred))
+	assert.NoError(t, opts.webAuthn.store.Save(providerCred))
+	proxy := NewOAuthProxy(opts, func(email string) bool { return true })
+	proxy.HtpasswdFile = &HtpasswdFile{Users: map[string]string{"john": "{SHA}PaVBVZkYqAjCQCu6UBL2xgsnZhw="}}
+	assert.True(t, proxy.htpasswdAccount("john", ""))
+	assert.False(t, proxy.htpasswdAccount("jane", "jane@example.com"))
+	assert.False(t, proxy.htpasswdAccount("john", "john@example.com"))
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/oauth2/webauthn/login/begin", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	var begin struct {
+		Challenge string `json:"challenge"`
+		RPID      string `json:"rpId"`
+	}
+	assert.NoError(t, json.Unmarshal(rw.Body.Bytes(), &begin))
+	assert.Equal(t, a.rpID, begin.RPID)
+	challengeCookie := rw.Result().Cookies()[0]
+
+	clientData, authData, sig := a.get(t, begin.Challenge)
+	body, _ := json.Marshal(webAuthnResponse{
+		ID:                base64.RawURLEncoding.EncodeToString(a.id),
+		ClientDataJSON:    base64.RawURLEncoding.EncodeToString(clientData),
+		AuthenticatorData: base64.RawURLEncoding.EncodeToString(authData),
+		Signature:         base64.RawURLEncoding.EncodeToString(sig),
+		Redirect:          "/app",
+	})
+	rw = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/oauth2/webauthn/login/finish", bytes.NewReader(body))
+	req.AddCookie(challengeCookie)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.JSONEq(t, `{"redirect":"/app"}`, rw.Body.String())
+	var sessionCookie bool
+	for _, c := range rw.Result().Cookies() {
+		if c.Name == opts.CookieName && c.Value != "" {
+			sessionCookie = true
+		}
+	}
+	assert.True(t, sessionCookie)
+
+	// a replayed assertion is rejected
+	rw = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/oauth2/webauthn/login/finish", bytes.NewReader(body))
+	req.AddCookie(challengeCookie)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+	assert.True(t, strings.Contains(rw.Body.String(), "error"))
+
+	// the passkey of a provider user does not sign in, as the provider is
+	// not asked whether they are still allowed
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/oauth2/webauthn/login/begin", nil))
+	assert.NoError(t, json.Unmarshal(rw.Body.Bytes(), &begin))
+	challengeCookie = rw.Result().Cookies()[0]
+	clientData, authData, sig = provider.get(t, begin.Challenge)
+	body, _ = json.Marshal(webAuthnResponse{
+		ID:                base64.RawURLEncoding.EncodeToString(provider.id),
+		ClientDataJSON:    base64.RawURLEncoding.EncodeToString(clientData),
+		AuthenticatorData: base64.RawURLEncoding.EncodeToString(authData),
+		Signature:         base64.RawURLEncoding.EncodeToString(sig),
+	})
+	rw = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/oauth2/webauthn/login/finish", bytes.NewReader(body))
+	req.AddCookie(challengeCookie)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+}
+
+func TestParseWebAuthnWithoutRedisStore(t *testing.T) {
+	opts := NewOptions()
+	opts.WebAuthnRPID = "example.com"
+	opts.SessionOptions.Type = options.RedisSessionStoreType
+	c, msgs := parseWebAuthn(opts, nil)
+	assert.Nil(t, c)
+	assert.Equal(t, []string{"webauthn-rp-id could not use the redis session store"}, msgs)
+}